@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"strconv"
 	"time"
 
 	"github.com/eknkc/basex"
@@ -118,7 +119,7 @@ func (al *AttributeList) Map() map[AttributeTypeIdentifier]TranslatedString {
 	if al.attrMap == nil {
 		al.attrMap = make(map[AttributeTypeIdentifier]TranslatedString)
 		ctid := al.CredentialType().Identifier()
-		attrTypes := al.Conf.CredentialTypes[ctid].AttributeTypes
+		attrTypes := al.Conf.GetCredentialTypes()[ctid].AttributeTypes
 		for i, val := range al.Strings() {
 			if attrTypes[i].RevocationAttribute {
 				continue
@@ -391,3 +392,74 @@ func shortToByte(x uint) []byte {
 	binary.BigEndian.PutUint16(bytes, uint16(x))
 	return bytes
 }
+
+// AttributeValueType is the type of the values of an attribute type. Values of typed attributes
+// are encoded canonically, so that equal values always result in the same attribute.
+type AttributeValueType string
+
+const (
+	AttributeValueTypeString  = AttributeValueType("")
+	AttributeValueTypeDate    = AttributeValueType("date")    // Encoded as YYYY-MM-DD
+	AttributeValueTypeInteger = AttributeValueType("integer") // 64-bit, encoded in decimal notation
+	AttributeValueTypeBoolean = AttributeValueType("boolean") // Encoded as true or false
+)
+
+const attributeDateFormat = "2006-01-02"
+
+func (t AttributeValueType) valid() bool {
+	switch t {
+	case AttributeValueTypeString, AttributeValueTypeDate, AttributeValueTypeInteger, AttributeValueTypeBoolean:
+		return true
+	default:
+		return false
+	}
+}
+
+// EncodeValue returns the canonical encoding of the specified value of this attribute type, or an
+// error if the value does not match the type of the attribute. Besides canonical values, booleans
+// may be specified in any form accepted by strconv.ParseBool.
+func (ad AttributeType) EncodeValue(value string) (string, error) {
+	switch ad.Type {
+	case AttributeValueTypeString:
+		return value, nil
+	case AttributeValueTypeDate:
+		t, err := time.Parse(attributeDateFormat, value)
+		if err != nil {
+			return "", errors.Errorf("attribute %s is not a date of the form YYYY-MM-DD", ad.ID)
+		}
+		return t.Format(attributeDateFormat), nil
+	case AttributeValueTypeInteger:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", errors.Errorf("attribute %s is not a 64-bit integer", ad.ID)
+		}
+		return strconv.FormatInt(i, 10), nil
+	case AttributeValueTypeBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", errors.Errorf("attribute %s is not a boolean", ad.ID)
+		}
+		return strconv.FormatBool(b), nil
+	default:
+		return "", errors.Errorf("attribute %s has unknown type %s", ad.ID, ad.Type)
+	}
+}
+
+// DecodeValue parses the specified value of this attribute type into a string, a time.Time (for
+// dates, in UTC), an int64 or a bool, depending on the type of the attribute.
+func (ad AttributeType) DecodeValue(value string) (interface{}, error) {
+	canonical, err := ad.EncodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	switch ad.Type {
+	case AttributeValueTypeDate:
+		return time.Parse(attributeDateFormat, canonical)
+	case AttributeValueTypeInteger:
+		return strconv.ParseInt(canonical, 10, 64)
+	case AttributeValueTypeBoolean:
+		return strconv.ParseBool(canonical)
+	default:
+		return value, nil
+	}
+}
@@ -43,7 +43,7 @@ func (attrs *AttributeList) CredentialInfo() *CredentialInfo {
 }
 
 func (ci CredentialInfo) GetCredentialType(conf *Configuration) *CredentialType {
-	return conf.CredentialTypes[ci.Identifier()]
+	return conf.GetCredentialTypes()[ci.Identifier()]
 }
 
 // Returns true if credential is expired at moment of calling this function
@@ -1,6 +1,7 @@
 package irma
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"path/filepath"
@@ -30,7 +31,17 @@ type SchemeManager struct {
 	TimestampServer   string
 	Languages         []string `xml:"Languages>Language"`
 	XMLVersion        int      `xml:"version,attr"`
-	XMLName           xml.Name `xml:"SchemeManager"`
+	XMLName           xml.Name `xml:"SchemeManager" json:"-"`
+
+	// RequiredLanguages are the languages in which all descriptions within the scheme must be
+	// translated, also those of issuers and credential types declaring other Languages.
+	RequiredLanguages []string `xml:"RequiredLanguages>Language" json:",omitempty"`
+
+	// DeprecatedSince is the time from which credentials of this scheme are no longer issued.
+	// Until ValidUntil, if set, they can still be disclosed.
+	DeprecatedSince Timestamp
+	// ValidUntil is the time from which credentials of this scheme are no longer accepted.
+	ValidUntil Timestamp
 
 	Status    SchemeManagerStatus `xml:"-"`
 	Timestamp Timestamp
@@ -65,14 +76,14 @@ type CredentialType struct {
 	IsSingleton           bool             `xml:"ShouldBeSingleton"`
 	DisallowDelete        bool             `xml:"DisallowDelete"`
 	Description           TranslatedString
-	AttributeTypes        []*AttributeType `xml:"Attributes>Attribute" json:"-"`
+	AttributeTypes        []*AttributeType `xml:"Attributes>Attribute" json:",omitempty"`
 	RevocationServers     []string         `xml:"RevocationServers>RevocationServer"`
 	RevocationUpdateCount uint64
 	RevocationUpdateSpeed uint64
 	RevocationIndex       int      `xml:"-"`
 	Languages             []string `xml:"Languages>Language"`
 	XMLVersion            int      `xml:"version,attr"`
-	XMLName               xml.Name `xml:"IssueSpecification"`
+	XMLName               xml.Name `xml:"IssueSpecification" json:"-"`
 
 	IssueURL     *TranslatedString `xml:"IssueURL"`
 	IsULIssueURL bool              `xml:"IsULIssueURL"`
@@ -81,9 +92,13 @@ type CredentialType struct {
 
 	Dependencies CredentialDependencies
 
+	// Colors in which apps render the card of the credential type, of the form #RRGGBB
 	ForegroundColor         string
+	BackgroundColor         string
 	BackgroundGradientStart string
 	BackgroundGradientEnd   string
+	// Position of the card among the cards of other credential types, see SortCredentialTypes
+	DisplayIndex *int `xml:"DisplayIndex" json:",omitempty"`
 
 	IsInCredentialStore bool
 	Category            *TranslatedString
@@ -107,6 +122,9 @@ type AttributeType struct {
 	DisplayIndex *int   `xml:"displayIndex,attr" json:",omitempty"`
 	DisplayHint  string `xml:"displayHint,attr"  json:",omitempty"`
 
+	// Type of the values of the attribute, which determines their canonical encoding
+	Type AttributeValueType `xml:"type,attr" json:",omitempty"`
+
 	RevocationAttribute bool `xml:"revocation,attr" json:",omitempty"`
 
 	// Taken from containing CredentialType
@@ -327,7 +345,7 @@ func populateDepTree(
 // is returned.
 func (deps credentialDependencies) get(id CredentialTypeIdentifier, conf *Configuration, creds map[CredentialTypeIdentifier]struct{}) []IssueWizardItem {
 	if _, present := deps[id]; !present {
-		deps[id] = conf.CredentialTypes[id].Dependencies.WizardContents().ChoosePath(conf, creds)
+		deps[id] = conf.GetCredentialTypes()[id].Dependencies.WizardContents().ChoosePath(conf, creds)
 	}
 	return deps[id]
 }
@@ -542,14 +560,14 @@ func (item *IssueWizardItem) validate(conf *Configuration) error {
 		return errors.New("wizard item has type website, but no session URL specified")
 	}
 
-	if item.Credential == nil || conf.SchemeManagers[item.Credential.SchemeManagerIdentifier()] == nil {
+	if item.Credential == nil || conf.GetSchemeManagers()[item.Credential.SchemeManagerIdentifier()] == nil {
 		return nil
 	}
 
 	// In `irma scheme verify` is run on a single requestor scheme, we cannot expect mentioned
 	// credential types from other schemes to exist. So only require mentioned credential types
 	// to exist if their containing scheme also exists
-	if conf.CredentialTypes[*item.Credential] == nil {
+	if conf.GetCredentialTypes()[*item.Credential] == nil {
 		return errors.New("nonexisting credential type " + item.Credential.Name())
 	}
 
@@ -559,7 +577,7 @@ func (item *IssueWizardItem) validate(conf *Configuration) error {
 			return errors.New("Wizard item text field incomplete for item with credential type: " + item.Credential.String())
 		}
 	} else {
-		faqSummary := conf.CredentialTypes[*item.Credential].FAQSummary
+		faqSummary := conf.GetCredentialTypes()[*item.Credential].FAQSummary
 		if faqSummary == nil {
 			return errors.New("FAQSummary missing for wizard item with credential type: " + item.Credential.String())
 		}
@@ -569,7 +587,7 @@ func (item *IssueWizardItem) validate(conf *Configuration) error {
 	}
 
 	// All dependencies of the the item and their dependencies must contain FAQSummaries
-	if conf.CredentialTypes[*item.Credential].Dependencies != nil {
+	if conf.GetCredentialTypes()[*item.Credential].Dependencies != nil {
 		depChain := DependencyChain{*item.Credential}
 		if err := validateFAQSummary(*item.Credential, conf, depChain, item.languages); err != nil {
 			return err
@@ -580,10 +598,10 @@ func (item *IssueWizardItem) validate(conf *Configuration) error {
 }
 
 func validateFAQSummary(cred CredentialTypeIdentifier, conf *Configuration, validatedDeps DependencyChain, languages []string) error {
-	for _, outer := range conf.CredentialTypes[cred].Dependencies {
+	for _, outer := range conf.GetCredentialTypes()[cred].Dependencies {
 		for _, middle := range outer {
 			for _, item := range middle {
-				faqSummary := conf.CredentialTypes[item].FAQSummary
+				faqSummary := conf.GetCredentialTypes()[item].FAQSummary
 				updatedDeps := append(validatedDeps, item)
 
 				if faqSummary == nil {
@@ -594,7 +612,7 @@ func validateFAQSummary(cred CredentialTypeIdentifier, conf *Configuration, vali
 					return errors.New("FAQSummary incomplete for last item in chain: " + updatedDeps.String())
 				}
 
-				if conf.CredentialTypes[item].Dependencies != nil {
+				if conf.GetCredentialTypes()[item].Dependencies != nil {
 					return validateFAQSummary(item, conf, updatedDeps, languages)
 				}
 			}
@@ -688,9 +706,57 @@ func (ct CredentialType) AttributeType(ai AttributeTypeIdentifier) *AttributeTyp
 	return ct.AttributeTypes[i]
 }
 
-// TranslatedString is a map of translated strings.
+// TranslatedString is a map of translated strings, from language code to text. In JSON it is an
+// object with the language codes as keys, e.g. {"en": "Hello world", "nl": "Hallo wereld"}.
 type TranslatedString map[string]string
 
+// TranslationFallbacks configures for languages the languages whose translations are used by
+// TranslatedString.TranslationWithFallback, in order, when a translation is missing, e.g.
+// {"nl-BE": {"nl", "fr"}}. Languages not in this map fall back to their base language, e.g. nl
+// for nl-BE. After those, DefaultFallbackLanguages are tried.
+var TranslationFallbacks = map[string][]string{}
+
+// DefaultFallbackLanguages are the languages whose translations are used by
+// TranslatedString.TranslationWithFallback when those of the requested language and its
+// fallbacks are missing.
+var DefaultFallbackLanguages = []string{"en"}
+
+// Translation returns the translation for the specified language, or "" if it is missing.
+func (ts TranslatedString) Translation(lang string) string {
+	return ts[lang]
+}
+
+// TranslationWithFallback returns the translation for the specified language. If it is missing
+// or empty, the translations of the fallback languages of the language (see TranslationFallbacks)
+// and then of DefaultFallbackLanguages are tried, and finally the first nonempty translation in
+// order of language code. Only if all translations are empty, "" is returned.
+func (ts TranslatedString) TranslationWithFallback(lang string) string {
+	fallbacks, ok := TranslationFallbacks[lang]
+	if !ok {
+		if i := strings.Index(lang, "-"); i > 0 {
+			fallbacks = []string{lang[:i]}
+		}
+	}
+	langs := append(append([]string{lang}, fallbacks...), DefaultFallbackLanguages...)
+	for _, l := range langs {
+		if text := ts[l]; text != "" {
+			return text
+		}
+	}
+
+	available := make([]string, 0, len(ts))
+	for l := range ts {
+		available = append(available, l)
+	}
+	sort.Strings(available)
+	for _, l := range available {
+		if text := ts[l]; text != "" {
+			return text
+		}
+	}
+	return ""
+}
+
 type xmlTranslation struct {
 	XMLName xml.Name
 	Text    string `xml:",chardata"`
@@ -728,6 +794,49 @@ func (ts *TranslatedString) UnmarshalXML(d *xml.Decoder, start xml.StartElement)
 	return nil
 }
 
+// NewTranslatedStringFromMap returns a TranslatedString containing a copy of the specified
+// translations, keyed by language.
+func NewTranslatedStringFromMap(translations map[string]string) TranslatedString {
+	ts := make(TranslatedString, len(translations))
+	for lang, text := range translations {
+		ts[lang] = text
+	}
+	return ts
+}
+
+// Set sets the translation for the specified language.
+func (ts *TranslatedString) Set(lang, text string) {
+	if *ts == nil {
+		*ts = TranslatedString{}
+	}
+	(*ts)[lang] = text
+}
+
+// MarshalJSON implements json.Marshaler, marshaling the TranslatedString to an object
+// with the languages as keys.
+func (ts TranslatedString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string(ts))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Next to an object with languages as keys, it accepts
+// a plain string, which is used for all languages like NewTranslatedString does.
+func (ts *TranslatedString) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*ts = NewTranslatedString(&text)
+		return nil
+	}
+	var translations map[string]string
+	if err := json.Unmarshal(b, &translations); err != nil {
+		return errors.Errorf("translated string must be a string or an object of strings: %s", err.Error())
+	}
+	*ts = translations
+	return nil
+}
+
 // validate checks that all specified languages are present in the TranslatedString, and returns
 // those that are not or are empty.
 func (ts *TranslatedString) validate(langs []string) []string {
@@ -792,7 +901,7 @@ func (ct *CredentialType) SchemeManagerIdentifier() SchemeManagerIdentifier {
 }
 
 func (ct *CredentialType) Logo(conf *Configuration) string {
-	scheme := conf.SchemeManagers[ct.SchemeManagerIdentifier()]
+	scheme := conf.GetSchemeManagers()[ct.SchemeManagerIdentifier()]
 	path := filepath.Join(scheme.path(), ct.IssuerID, "Issues", ct.ID, "logo.png")
 	exists, err := common.PathExists(path)
 	if err != nil || !exists {
@@ -801,6 +910,22 @@ func (ct *CredentialType) Logo(conf *Configuration) string {
 	return path
 }
 
+// SortCredentialTypes sorts the credential types in the order in which their cards are to be
+// displayed: by DisplayIndex, followed by the credential types without DisplayIndex, each ordered
+// by their identifiers.
+func SortCredentialTypes(types []*CredentialType) {
+	sort.SliceStable(types, func(i, j int) bool {
+		a, b := types[i].DisplayIndex, types[j].DisplayIndex
+		switch {
+		case a != nil && b != nil && *a != *b:
+			return *a < *b
+		case (a == nil) != (b == nil):
+			return a != nil
+		}
+		return types[i].Identifier().String() < types[j].Identifier().String()
+	})
+}
+
 // Identifier returns the identifier of the specified issuer description.
 func (id *Issuer) Identifier() IssuerIdentifier {
 	return NewIssuerIdentifier(id.SchemeManagerID + "." + id.ID)
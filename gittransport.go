@@ -0,0 +1,208 @@
+package irma
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// Schemes can be distributed through git repositories instead of HTTP file servers, by using a
+// scheme URL of the form
+//
+//	git+https://host/path/to/repository.git[@ref][/subdirectory]
+//
+// where ref is the branch or tag to use, which cannot contain slashes (default: the default branch
+// of the repository), and subdirectory the directory within the repository containing the scheme
+// (default: its root).
+// Next to git+https, the git+ssh and git+file protocols are supported. As scheme URLs are
+// distributed in the scheme descriptions, git+file URLs, which refer to repositories on the local
+// filesystem, are only supported in ConfigurationOptions.SchemeURLs. Files are read using the git
+// command from bare clones of the repositories in GitSchemeCacheDir. As with schemes served over
+// HTTP, all files are verified against the signed scheme index.
+
+// GitSchemeCacheDir is the directory in which repositories of schemes with git+ URLs are cloned.
+// If empty, a subdirectory of the user's cache directory is used.
+var GitSchemeCacheDir string
+
+// gitFetchInterval is the minimum time between fetches of a repository, so that the files of
+// a scheme that are downloaded during a single update come from the same fetch.
+const gitFetchInterval = 30 * time.Second
+
+var gitProtocols = []string{"git+https", "git+ssh"}
+
+type gitTransport struct{}
+
+var (
+	gitFetched = map[string]time.Time{}
+	// Locks of the repository clones, so that fetches of different repositories do not wait
+	// for each other
+	gitRepoLocks = map[string]*sync.Mutex{}
+	// gitLock protects gitFetched and gitRepoLocks
+	gitLock sync.Mutex
+)
+
+func registerGitProtocols(transport *http.Transport, allowFile bool) {
+	for _, protocol := range gitProtocols {
+		transport.RegisterProtocol(protocol, gitTransport{})
+	}
+	if allowFile {
+		transport.RegisterProtocol("git+file", gitTransport{})
+	}
+}
+
+func (gitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return nil, errors.Errorf("unsupported method %s for git scheme URL", req.Method)
+	}
+	repo, ref, path, err := parseGitURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := gitFetch(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	bts, err := gitCommand(dir, "show", ref+":"+path)
+	status := http.StatusOK
+	if err != nil {
+		// git show fails if either the ref or the path does not exist
+		Logger.WithFields(logrus.Fields{"repository": repo, "ref": ref, "path": path}).Debug(err)
+		status, bts = http.StatusNotFound, nil
+	}
+	return &http.Response{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(bts)),
+		ContentLength: int64(len(bts)),
+		Request:       req,
+	}, nil
+}
+
+// parseGitURL splits a git+ scheme URL into the URL of the repository, the ref and the path
+// of the requested file within the repository.
+func parseGitURL(u *url.URL) (repo, ref, path string, err error) {
+	i := strings.Index(u.Path, ".git")
+	for i >= 0 && len(u.Path) > i+4 && u.Path[i+4] != '/' && u.Path[i+4] != '@' {
+		j := strings.Index(u.Path[i+4:], ".git")
+		if j < 0 {
+			i = -1
+			break
+		}
+		i += 4 + j
+	}
+	if i < 0 {
+		return "", "", "", errors.Errorf("git scheme URL %s does not contain a repository ending in .git", u.Redacted())
+	}
+
+	repoURL := *u
+	repoURL.Scheme = strings.TrimPrefix(u.Scheme, "git+")
+	repoURL.Path, repoURL.RawPath = u.Path[:i+4], ""
+	repoURL.RawQuery, repoURL.Fragment = "", ""
+	repo = repoURL.String()
+
+	rest := u.Path[i+4:]
+	ref = "HEAD"
+	if strings.HasPrefix(rest, "@") {
+		ref = strings.SplitN(rest[1:], "/", 2)[0]
+		rest = rest[1+len(ref):]
+		if ref == "" || strings.HasPrefix(ref, "-") || strings.Contains(ref, ":") {
+			return "", "", "", errors.Errorf("invalid ref in git scheme URL %s", u.Redacted())
+		}
+	}
+	path = strings.Trim(rest, "/")
+	return
+}
+
+// gitFetch clones the repository into the cache directory, or fetches it if it was not fetched
+// within the gitFetchInterval, and returns the directory of the clone.
+func gitFetch(repo string) (string, error) {
+	cache := GitSchemeCacheDir
+	if cache == "" {
+		var err error
+		if cache, err = os.UserCacheDir(); err != nil {
+			cache = os.TempDir()
+		}
+		cache = filepath.Join(cache, "irmago", "git")
+	}
+	hash := sha256.Sum256([]byte(repo))
+	dir := filepath.Join(cache, hex.EncodeToString(hash[:16]))
+
+	lock := gitRepoLock(dir)
+	lock.Lock()
+	defer lock.Unlock()
+	gitLock.Lock()
+	last, ok := gitFetched[dir]
+	gitLock.Unlock()
+	if ok && time.Since(last) < gitFetchInterval {
+		return dir, nil
+	}
+
+	exists, err := common.PathExists(dir)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		Logger.WithField("repository", repo).Info("cloning scheme repository")
+		if err = common.EnsureDirectoryExists(cache); err != nil {
+			return "", err
+		}
+		if _, err = gitCommand("", "clone", "--bare", "--quiet", "--", repo, dir); err != nil {
+			_ = os.RemoveAll(dir)
+			return "", err
+		}
+	} else {
+		Logger.WithField("repository", repo).Debug("fetching scheme repository")
+		if _, err = gitCommand(dir, "fetch", "--quiet", "--prune", "--force", "origin",
+			"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"); err != nil {
+			return "", err
+		}
+	}
+	gitLock.Lock()
+	gitFetched[dir] = time.Now()
+	gitLock.Unlock()
+	return dir, nil
+}
+
+func gitRepoLock(dir string) *sync.Mutex {
+	gitLock.Lock()
+	defer gitLock.Unlock()
+	if gitRepoLocks[dir] == nil {
+		gitRepoLocks[dir] = &sync.Mutex{}
+	}
+	return gitRepoLocks[dir]
+}
+
+func gitCommand(dir string, args ...string) ([]byte, error) {
+	command := args[0]
+	if dir != "" {
+		args = append([]string{"--git-dir", dir}, args...)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+	// Never prompt for credentials; private repositories must be accessible non-interactively
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Errorf("git %s failed: %s: %s", command, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,159 @@
+package irma
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpCache keeps the responses to GET requests together with their validators (the ETag and
+// Last-Modified headers), so that they can be revalidated using conditional requests: as long as
+// the file is unchanged, the server responds with 304 Not Modified and no body. A response is
+// reused without any request for as long as the Cache-Control header of the server allows.
+// The scheme update checks use this, as they periodically download the same files, which
+// usually have not changed. A nil *httpCache caches nothing.
+type httpCache struct {
+	sync.Mutex
+	entries map[string]*httpCacheEntry
+}
+
+type httpCacheEntry struct {
+	body         []byte
+	etag         string
+	lastModified string
+	expires      time.Time
+}
+
+func newHTTPCache() *httpCache {
+	return &httpCache{entries: map[string]*httpCacheEntry{}}
+}
+
+func (cache *httpCache) get(url string) *httpCacheEntry {
+	if cache == nil {
+		return nil
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.entries[url]
+}
+
+func (cache *httpCache) put(url string, entry *httpCacheEntry) {
+	if cache == nil {
+		return
+	}
+	cache.Lock()
+	defer cache.Unlock()
+	if entry == nil {
+		delete(cache.entries, url)
+	} else {
+		cache.entries[url] = entry
+	}
+}
+
+// fresh returns whether the entry can be used without revalidating it.
+func (entry *httpCacheEntry) fresh() bool {
+	return time.Now().Before(entry.expires)
+}
+
+// newHTTPCacheEntry returns an entry for the response with the specified body, or nil if the
+// Cache-Control header of the response forbids storing it.
+func newHTTPCacheEntry(res *http.Response, body []byte) *httpCacheEntry {
+	directives := parseCacheControl(res.Header.Get("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return nil
+	}
+	entry := &httpCacheEntry{
+		body:         body,
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+	}
+	entry.expires = cacheExpiry(res, directives)
+	return entry
+}
+
+// cacheExpiry returns until when the response is fresh according to its max-age directive,
+// taking into account the Age header. Responses with a no-cache directive or without max-age
+// are always revalidated.
+func cacheExpiry(res *http.Response, directives map[string]string) time.Time {
+	if _, ok := directives["no-cache"]; ok {
+		return time.Time{}
+	}
+	maxAge, err := strconv.Atoi(directives["max-age"])
+	if err != nil || maxAge <= 0 {
+		return time.Time{}
+	}
+	age, _ := strconv.Atoi(res.Header.Get("Age"))
+	if age >= maxAge {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(maxAge-age) * time.Second)
+}
+
+// parseCacheControl parses the directives of a Cache-Control header into a map, with an empty
+// value for directives without argument.
+func parseCacheControl(header string) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return directives
+}
+
+// getBytesCached is like GetBytes, but uses the cache to avoid downloading files that did not
+// change. It also returns whether the response was taken from the cache without contacting the
+// server.
+func (transport *HTTPTransport) getBytesCached(url string, cache *httpCache) ([]byte, bool, error) {
+	key := transport.Server + url
+	entry := cache.get(key)
+	if entry != nil && entry.fresh() {
+		return entry.body, true, nil
+	}
+
+	headers := http.Header{}
+	if entry != nil {
+		if entry.etag != "" {
+			headers.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			headers.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+	res, err := transport.requestWithHeaders(url, http.MethodGet, nil, "", headers)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotModified && entry != nil:
+		// The server may update the caching policy and validators in a 304 response
+		updated := newHTTPCacheEntry(res, entry.body)
+		if updated != nil {
+			if updated.etag == "" {
+				updated.etag = entry.etag
+			}
+			if updated.lastModified == "" {
+				updated.lastModified = entry.lastModified
+			}
+		}
+		cache.put(key, updated)
+		return entry.body, false, nil
+	case res.StatusCode != http.StatusOK:
+		return nil, false, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, false, &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+	}
+	cache.put(key, newHTTPCacheEntry(res, b))
+	return b, false, nil
+}
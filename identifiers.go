@@ -280,7 +280,11 @@ func (pki *PublicKeyIdentifier) UnmarshalText(text []byte) error {
 }
 
 func (pki *PublicKeyIdentifier) MarshalText() (text []byte, err error) {
-	return []byte(fmt.Sprintf("%s-%d", pki.Issuer, pki.Counter)), nil
+	return []byte(pki.String()), nil
+}
+
+func (pki PublicKeyIdentifier) String() string {
+	return fmt.Sprintf("%s-%d", pki.Issuer, pki.Counter)
 }
 
 // MarshalText implements encoding.TextMarshaler.
@@ -331,7 +335,7 @@ func (set *IrmaIdentifierSet) join(other *IrmaIdentifierSet) {
 
 func (set *IrmaIdentifierSet) Distributed(conf *Configuration) bool {
 	for id := range set.SchemeManagers {
-		if conf.SchemeManagers[id].Distributed() {
+		if conf.GetSchemeManagers()[id].Distributed() {
 			return true
 		}
 	}
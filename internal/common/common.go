@@ -11,6 +11,7 @@ import (
 	"github.com/privacybydesign/gabi/big"
 	"github.com/sirupsen/logrus"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path"
@@ -29,10 +30,15 @@ const (
 	AlphanumericChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	NumericChars      = "0123456789"
 
-	sessionTokenLength = 20 // duplicated in SessionTokenRegex as strconv.Itoa cannot be used in const block
-	pairingCodeLength  = 4
+	// Default (and minimum) and maximum length of session tokens, used as the bounds of SessionTokenRegex
+	// (duplicated there as strconv.Itoa cannot be used in const block)
+	SessionTokenLength    = 20
+	MaxSessionTokenLength = 128
+	pairingCodeLength     = 4
 
-	SessionTokenRegex = "[" + AlphanumericChars + "]{20}"
+	// SessionTokenRegex matches the tokens generated by NewSessionToken, but also allows longer tokens
+	// containing dashes and underscores, such as UUIDs or prefixed tokens from custom token generators.
+	SessionTokenRegex = "[" + AlphanumericChars + "_-]{20,128}"
 )
 
 // AssertPathExists returns nil only if it has been successfully
@@ -168,6 +174,24 @@ func CopyDirectory(src, dest string) error {
 
 }
 
+// CopyFS copies the directory src within the file system fsys to the directory dest on disk.
+func CopyFS(fsys fs.FS, src, dest string) error {
+	return fs.WalkDir(fsys, src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(path[len(src):], "/")))
+		if d.IsDir() {
+			return EnsureDirectoryExists(target)
+		}
+		bts, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		return SaveFile(target, bts)
+	})
+}
+
 // ReadKey returns either the content of the file specified at path, if it exists,
 // or []byte(key) otherwise. It is an error to specify both or none arguments, or
 // specify an empty or unreadable file. If there is no error then the return []byte is non-empty.
@@ -279,23 +303,30 @@ type SSECtx struct {
 }
 
 func NewSessionToken() string {
-	return NewRandomString(sessionTokenLength, AlphanumericChars)
+	return NewRandomString(SessionTokenLength, AlphanumericChars)
 }
 
 func NewPairingCode() string {
 	return NewRandomString(pairingCodeLength, NumericChars)
 }
 
+// NewRandomString returns a string of the specified length consisting of characters uniformly
+// drawn from characterSet, which must contain at most 256 characters, using crypto/rand.
 func NewRandomString(count int, characterSet string) string {
+	// Random bytes above the largest multiple of len(characterSet) are discarded, as using those
+	// would make the first characters of characterSet more likely than the others.
+	limit := 256 - 256%len(characterSet)
+	b := make([]byte, 0, count)
 	r := make([]byte, count)
-	_, err := rand.Read(r)
-	if err != nil {
-		panic(err)
-	}
-
-	b := make([]byte, count)
-	for i := range b {
-		b[i] = characterSet[r[i]%byte(len(characterSet))]
+	for len(b) < count {
+		if _, err := rand.Read(r); err != nil {
+			panic(err)
+		}
+		for _, c := range r {
+			if int(c) < limit && len(b) < count {
+				b = append(b, characterSet[int(c)%len(characterSet)])
+			}
+		}
 	}
 	return string(b)
 }
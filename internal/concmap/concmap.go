@@ -16,6 +16,32 @@ func New[K comparable, V any]() ConcMap[K, V] {
 	}
 }
 
+// Clone returns a new ConcMap containing the same elements.
+func (cm ConcMap[K, V]) Clone() ConcMap[K, V] {
+	cm.RLock()
+	defer cm.RUnlock()
+	clone := New[K, V]()
+	for key, val := range cm.m {
+		clone.m[key] = val
+	}
+	return clone
+}
+
+// Assign replaces all elements of this map by those of other at once, so that readers observe
+// either all old or all new elements.
+func (cm ConcMap[K, V]) Assign(other ConcMap[K, V]) {
+	other.RLock()
+	defer other.RUnlock()
+	cm.Lock()
+	defer cm.Unlock()
+	for key := range cm.m {
+		delete(cm.m, key)
+	}
+	for key, val := range other.m {
+		cm.m[key] = val
+	}
+}
+
 func (cm ConcMap[K, V]) IsSet(key K) bool {
 	cm.RLock()
 	defer cm.RUnlock()
@@ -0,0 +1,140 @@
+package concmap
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU is a generic map safe for concurrent use like ConcMap, that holds at most a fixed number
+// of elements: setting an element in a full map evicts the least recently used element.
+// As looking up an element marks it as used, all methods take an exclusive lock.
+type LRU[K comparable, V any] struct {
+	size  int
+	m     map[K]*list.Element
+	order *list.List // of *lruEntry[K, V], most recently used first
+	*sync.Mutex
+}
+
+type lruEntry[K comparable, V any] struct {
+	key K
+	val V
+}
+
+// NewLRU returns a new LRU holding at most size elements, or any number of elements if size <= 0.
+func NewLRU[K comparable, V any](size int) LRU[K, V] {
+	return LRU[K, V]{
+		size:  size,
+		m:     map[K]*list.Element{},
+		order: list.New(),
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// Clone returns a new LRU of the same size containing the same elements in the same order.
+func (lru LRU[K, V]) Clone() LRU[K, V] {
+	lru.Lock()
+	defer lru.Unlock()
+	clone := NewLRU[K, V](lru.size)
+	for e := lru.order.Back(); e != nil; e = e.Prev() {
+		clone.set(e.Value.(*lruEntry[K, V]).key, e.Value.(*lruEntry[K, V]).val)
+	}
+	return clone
+}
+
+// Assign replaces all elements of this map by those of other at once, so that readers observe
+// either all old or all new elements.
+func (lru LRU[K, V]) Assign(other LRU[K, V]) {
+	other.Lock()
+	defer other.Unlock()
+	lru.Lock()
+	defer lru.Unlock()
+	for key := range lru.m {
+		delete(lru.m, key)
+	}
+	lru.order.Init()
+	for e := other.order.Back(); e != nil; e = e.Prev() {
+		lru.set(e.Value.(*lruEntry[K, V]).key, e.Value.(*lruEntry[K, V]).val)
+	}
+}
+
+// Len returns the number of elements in the map.
+func (lru LRU[K, V]) Len() int {
+	lru.Lock()
+	defer lru.Unlock()
+	return len(lru.m)
+}
+
+// IsSet returns whether the map contains the key, without marking it as used.
+func (lru LRU[K, V]) IsSet(key K) bool {
+	lru.Lock()
+	defer lru.Unlock()
+	_, set := lru.m[key]
+	return set
+}
+
+func (lru LRU[K, V]) Delete(key K) {
+	lru.Lock()
+	defer lru.Unlock()
+	if e, ok := lru.m[key]; ok {
+		lru.order.Remove(e)
+		delete(lru.m, key)
+	}
+}
+
+// DeleteIf iterates over all map entries, and deletes them if the specified function returns true.
+func (lru LRU[K, V]) DeleteIf(cond func(K, V) bool) {
+	lru.Lock()
+	defer lru.Unlock()
+	for key, e := range lru.m {
+		if cond(key, e.Value.(*lruEntry[K, V]).val) {
+			lru.order.Remove(e)
+			delete(lru.m, key)
+		}
+	}
+}
+
+// Get returns the element with the specified key, marking it as the most recently used one.
+func (lru LRU[K, V]) Get(key K) V {
+	lru.Lock()
+	defer lru.Unlock()
+	e, ok := lru.m[key]
+	if !ok {
+		var zero V
+		return zero
+	}
+	lru.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).val
+}
+
+// Set sets the element with the specified key as the most recently used one, evicting the least
+// recently used element if the map is full.
+func (lru LRU[K, V]) Set(key K, val V) {
+	lru.Lock()
+	defer lru.Unlock()
+	lru.set(key, val)
+}
+
+func (lru LRU[K, V]) set(key K, val V) {
+	if e, ok := lru.m[key]; ok {
+		e.Value.(*lruEntry[K, V]).val = val
+		lru.order.MoveToFront(e)
+		return
+	}
+	lru.m[key] = lru.order.PushFront(&lruEntry[K, V]{key: key, val: val})
+	if lru.size > 0 && len(lru.m) > lru.size {
+		oldest := lru.order.Back()
+		lru.order.Remove(oldest)
+		delete(lru.m, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// Iterate through all elements in the map, without marking them as used. Note that the map is
+// locked during iteration, so invoking other methods will deadlock. To delete elements based on
+// a condition, use DeleteIf.
+func (lru LRU[K, V]) Iterate(f func(K, V)) {
+	lru.Lock()
+	defer lru.Unlock()
+	for key, e := range lru.m {
+		f(key, e.Value.(*lruEntry[K, V]).val)
+	}
+}
@@ -0,0 +1,24 @@
+// Package defaultschemes embeds the default schemes (see irma.DefaultSchemes), so that they can be
+// installed without network access using irma.Configuration.InstallDefaultSchemes(). The schemes
+// are not checked in: they are downloaded into the schemes directory by go generate when building
+// releases. Default schemes that were not embedded are downloaded when installing them instead.
+package defaultschemes
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:generate go run ./download schemes
+
+//go:embed schemes
+var schemes embed.FS
+
+// FS returns the file system containing a directory per embedded default scheme.
+func FS() fs.FS {
+	f, err := fs.Sub(schemes, "schemes")
+	if err != nil {
+		panic(err) // cannot happen, the schemes directory is embedded
+	}
+	return f
+}
@@ -0,0 +1,37 @@
+// Command download downloads the default schemes into the specified directory, replacing any
+// schemes already present, for embedding them into the irma binary (see package defaultschemes).
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		die(fmt.Errorf("usage: %s <directory>", os.Args[0]))
+	}
+	dir := os.Args[1]
+	for _, s := range irma.DefaultSchemes {
+		if err := os.RemoveAll(filepath.Join(dir, path.Base(s.URL))); err != nil {
+			die(err)
+		}
+	}
+
+	conf, err := irma.NewConfiguration(dir, irma.ConfigurationOptions{})
+	if err != nil {
+		die(err)
+	}
+	if err = conf.DownloadDefaultSchemes(); err != nil {
+		die(err)
+	}
+}
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
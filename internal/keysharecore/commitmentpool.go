@@ -0,0 +1,159 @@
+package keysharecore
+
+import (
+	"crypto/rand"
+	"strings"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// maxCommitmentKeySets is the maximum number of distinct sets of public keys for which
+// commitments are precomputed, bounding the memory and CPU time used by the pool.
+const maxCommitmentKeySets = 100
+
+// commitmentPool precomputes the random commitments of the keyshare proofs in the background,
+// for the sets of public keys that were used before. Computing them is the most expensive part of
+// GenerateCommitments, so this reduces the time the user waits after entering their PIN.
+type commitmentPool struct {
+	sync.Mutex
+	depth   int
+	keySets map[string]*commitmentKeySet
+	work    chan string
+	stop    chan struct{}
+}
+
+// commitmentKeySet contains the precomputed commitments for a set of public keys.
+type commitmentKeySet struct {
+	keys        []*gabikeys.PublicKey
+	commitments []*randomCommitment
+	pending     int
+}
+
+// randomCommitment is a randomizer along with the commitments to it for each key of a key set,
+// i.e. the part of gabi.NewKeyshareCommitments that does not depend on the keyshare secret.
+type randomCommitment struct {
+	randomizer *big.Int
+	pcommits   []*big.Int
+}
+
+func newCommitmentPool(depth, workers int) *commitmentPool {
+	p := &commitmentPool{
+		depth:   depth,
+		keySets: map[string]*commitmentKeySet{},
+		work:    make(chan string, maxCommitmentKeySets*depth),
+		stop:    make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *commitmentPool) worker() {
+	for {
+		select {
+		case <-p.stop:
+			return
+		case name := <-p.work:
+			p.Lock()
+			keys := p.keySets[name].keys
+			p.Unlock()
+
+			commitment, err := newRandomCommitment(keys)
+
+			p.Lock()
+			set := p.keySets[name]
+			set.pending--
+			if err == nil {
+				set.commitments = append(set.commitments, commitment)
+			}
+			p.Unlock()
+		}
+	}
+}
+
+// take returns a precomputed commitment for the keys if available, or nil otherwise. In both
+// cases it schedules the computation of new commitments to keep the target depth.
+func (p *commitmentPool) take(keyIDs []irma.PublicKeyIdentifier, keys []*gabikeys.PublicKey) *randomCommitment {
+	ids := make([]string, 0, len(keyIDs))
+	for _, id := range keyIDs {
+		ids = append(ids, id.String())
+	}
+	name := strings.Join(ids, ",")
+
+	p.Lock()
+	defer p.Unlock()
+
+	set := p.keySets[name]
+	if set == nil {
+		if len(p.keySets) >= maxCommitmentKeySets {
+			return nil
+		}
+		set = &commitmentKeySet{keys: keys}
+		p.keySets[name] = set
+	}
+
+	var commitment *randomCommitment
+	if len(set.commitments) > 0 {
+		commitment = set.commitments[0]
+		set.commitments = set.commitments[1:]
+	}
+	for ; len(set.commitments)+set.pending < p.depth; set.pending++ {
+		select {
+		case p.work <- name:
+		default:
+			return commitment // workers are busy enough
+		}
+	}
+	return commitment
+}
+
+func (p *commitmentPool) close() {
+	close(p.stop)
+}
+
+// commitmentRandomizerLength returns the length of the randomizer of the keyshare commitments for
+// the given keys, which is smaller if one of them is a 1024 bit key (see gabi.NewKeyshareCommitments).
+func commitmentRandomizerLength(keys []*gabikeys.PublicKey) uint {
+	for _, key := range keys {
+		if key.N.BitLen() == 1024 {
+			return gabikeys.DefaultSystemParameters[1024].LmCommit
+		}
+	}
+	return gabikeys.DefaultSystemParameters[2048].LmCommit
+}
+
+func newRandomCommitment(keys []*gabikeys.PublicKey) (*randomCommitment, error) {
+	randomizer, err := big.RandInt(rand.Reader, new(big.Int).Lsh(big.NewInt(1), commitmentRandomizerLength(keys)))
+	if err != nil {
+		return nil, err
+	}
+	commitment := &randomCommitment{randomizer: randomizer}
+	for _, key := range keys {
+		commitment.pcommits = append(commitment.pcommits, new(big.Int).Exp(key.R[0], randomizer, key.N))
+	}
+	return commitment, nil
+}
+
+// keyshareCommitments completes a precomputed random commitment to the keyshare commitments of
+// the given secret, like gabi.NewKeyshareCommitments does.
+func keyshareCommitments(secret *big.Int, keys []*gabikeys.PublicKey, commitment *randomCommitment) (*big.Int, []*gabi.ProofPCommitment, error) {
+	if commitmentRandomizerLength(keys) == gabikeys.DefaultSystemParameters[1024].LmCommit &&
+		secret.BitLen() > int(gabikeys.DefaultSystemParameters[1024].Lm-1) {
+		// minus one to allow for the client's contribution
+		return nil, nil, errors.New("cannot commit: secret too big for 1024 bit keys")
+	}
+	var commitments []*gabi.ProofPCommitment
+	for i, key := range keys {
+		commitments = append(commitments, &gabi.ProofPCommitment{
+			P:       new(big.Int).Exp(key.R[0], secret, key.N),
+			Pcommit: commitment.pcommits[i],
+		})
+	}
+	return commitment.randomizer, commitments, nil
+}
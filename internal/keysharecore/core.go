@@ -1,8 +1,10 @@
 package keysharecore
 
 import (
+	"crypto"
+	"crypto/cipher"
 	"crypto/rand"
-	"crypto/rsa"
+	"runtime"
 	"sync"
 
 	"github.com/privacybydesign/gabi/big"
@@ -20,12 +22,12 @@ type (
 
 	Core struct {
 		// Keys used for storage encryption/decryption
-		decryptionKeys  map[uint32]AESKey
-		decryptionKey   AESKey
+		decryptionKeys  map[uint32]cipher.AEAD
+		decryptionKey   cipher.AEAD
 		decryptionKeyID uint32
 
 		// Key used to sign keyshare protocol messages
-		jwtPrivateKey   *rsa.PrivateKey
+		jwtPrivateKey   crypto.Signer
 		jwtPrivateKeyID uint32
 
 		jwtIssuer    string
@@ -34,6 +36,8 @@ type (
 		// Commit values generated in first step of keyshare protocol
 		commitmentData  map[uint64]*big.Int
 		commitmentMutex sync.Mutex
+		// Precomputed random commitments, if enabled
+		commitmentPool *commitmentPool
 
 		// authorization challenges
 		authChallenges      map[string][]byte
@@ -48,25 +52,39 @@ type (
 		// Keys used for storage encryption/decryption
 		DecryptionKey   AESKey
 		DecryptionKeyID uint32
+		// If set, used for storage encryption/decryption instead of DecryptionKey, for example when
+		// the key is kept in a HSM. It must be AES-GCM with the standard nonce size.
+		Decrypter cipher.AEAD
 
-		// Key used to sign keyshare protocol messages
-		JWTPrivateKey   *rsa.PrivateKey
+		// Key used to sign keyshare protocol messages, which must be an RSA key. Keys that are not
+		// available in memory (e.g. kept in a HSM) can be used through a crypto.Signer implementation.
+		JWTPrivateKey   crypto.Signer
 		JWTPrivateKeyID uint32
 
 		JWTIssuer    string
 		JWTPinExpiry int // in seconds
+
+		// Number of commitments to precompute in the background per set of public keys used in
+		// keyshare sessions (0 to disable), and the number of workers precomputing them
+		// (defaults to the number of CPUs).
+		CommitmentPoolSize    int
+		CommitmentPoolWorkers int
 	}
 )
 
 func NewKeyshareCore(conf *Configuration) *Core {
 	c := &Core{
-		decryptionKeys: map[uint32]AESKey{},
+		decryptionKeys: map[uint32]cipher.AEAD{},
 		commitmentData: map[uint64]*big.Int{},
 		trustedKeys:    map[irma.PublicKeyIdentifier]*gabikeys.PublicKey{},
 		authChallenges: map[string][]byte{},
 	}
 
-	c.setDecryptionKey(conf.DecryptionKeyID, conf.DecryptionKey)
+	if conf.Decrypter != nil {
+		c.setDecryptionKey(conf.DecryptionKeyID, conf.Decrypter)
+	} else {
+		c.setDecryptionKey(conf.DecryptionKeyID, newGCM(conf.DecryptionKey))
+	}
 	c.setJWTPrivateKey(conf.JWTPrivateKeyID, conf.JWTPrivateKey)
 
 	c.jwtIssuer = conf.JWTIssuer
@@ -78,9 +96,24 @@ func NewKeyshareCore(conf *Configuration) *Core {
 		c.jwtPinExpiry = JWTPinExpiryDefault
 	}
 
+	if conf.CommitmentPoolSize > 0 {
+		workers := conf.CommitmentPoolWorkers
+		if workers == 0 {
+			workers = runtime.NumCPU()
+		}
+		c.commitmentPool = newCommitmentPool(conf.CommitmentPoolSize, workers)
+	}
+
 	return c
 }
 
+// Stop stops the background precomputation of commitments, if enabled.
+func (c *Core) Stop() {
+	if c.commitmentPool != nil {
+		c.commitmentPool.close()
+	}
+}
+
 func GenerateDecryptionKey() (AESKey, error) {
 	var res AESKey
 	_, err := rand.Read(res[:])
@@ -90,20 +123,27 @@ func GenerateDecryptionKey() (AESKey, error) {
 // DangerousAddDecryptionKey adds an AES key for decryption, with identifier keyID.
 // Calling this will cause all keyshare secrets generated with the key to be trusted.
 func (c *Core) DangerousAddDecryptionKey(keyID uint32, key AESKey) {
-	c.decryptionKeys[keyID] = key
+	c.DangerousAddDecrypter(keyID, newGCM(key))
+}
+
+// DangerousAddDecrypter adds an AES-GCM cipher for decryption, with identifier keyID, for keys
+// that are not available in memory (e.g. kept in a HSM).
+// Calling this will cause all keyshare secrets generated with the key to be trusted.
+func (c *Core) DangerousAddDecrypter(keyID uint32, decrypter cipher.AEAD) {
+	c.decryptionKeys[keyID] = decrypter
 }
 
 // Set the aes key for encrypting new/changed keyshare data
 // with identifier keyid
 // Calling this will also cause all keyshare user secrets generated with the key to be trusted
-func (c *Core) setDecryptionKey(keyID uint32, key AESKey) {
+func (c *Core) setDecryptionKey(keyID uint32, key cipher.AEAD) {
 	c.decryptionKeys[keyID] = key
 	c.decryptionKey = key
 	c.decryptionKeyID = keyID
 }
 
 // Set key used to sign keyshare protocol messages
-func (c *Core) setJWTPrivateKey(id uint32, key *rsa.PrivateKey) {
+func (c *Core) setJWTPrivateKey(id uint32, key crypto.Signer) {
 	c.jwtPrivateKey = key
 	c.jwtPrivateKeyID = id
 }
@@ -13,7 +13,7 @@ func (c *Core) ChangePinLegacy(secrets UserSecrets, oldpinRaw, newpinRaw string)
 	if err != nil {
 		return nil, err
 	}
-	if s.PublicKey != nil {
+	if len(s.PublicKeys) != 0 {
 		return nil, errors.New("JWT required")
 	}
 
@@ -39,7 +39,7 @@ func (c *Core) ValidateAuthLegacy(secrets UserSecrets, pin string) (string, erro
 		return "", err
 	}
 
-	if s.PublicKey != nil {
+	if len(s.PublicKeys) != 0 {
 		return "", ErrChallengeResponseRequired
 	}
 
@@ -11,7 +11,9 @@ import (
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/gabi/signed"
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
 
 	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
@@ -27,8 +29,15 @@ var (
 	ErrUnknownCommit             = errors.New("unknown commit id")
 	ErrChallengeResponseRequired = errors.New("challenge-response authentication required")
 	ErrWrongChallenge            = errors.New("wrong challenge")
+	ErrDeviceExists              = errors.New("device already registered")
+	ErrTooManyDevices            = errors.New("too many devices registered")
+	ErrUnknownDevice             = errors.New("unknown device")
+	ErrLastDevice                = errors.New("cannot revoke the last device")
 )
 
+// MaxDevices is the maximum amount of devices that can be registered to a keyshare account.
+const MaxDevices = 10
+
 // ChallengeJWTMaxExpiry is the maximum exp (expiry) that we allow JWTs to have with which calls to
 // GenerateChallenge() (i.e. /users/verify_start) are authenticated.
 const ChallengeJWTMaxExpiry = 6 * time.Minute
@@ -57,7 +66,9 @@ func (c *Core) NewUserSecrets(pin string, pk *ecdsa.PublicKey) (UserSecrets, err
 	if err = s.setID(id); err != nil {
 		return nil, err
 	}
-	s.PublicKey = pk
+	if pk != nil {
+		s.PublicKeys = []*ecdsa.PublicKey{pk}
+	}
 
 	// And encrypt
 	return c.encryptUserSecrets(s)
@@ -84,27 +95,48 @@ func (c *Core) ValidateAuth(secrets UserSecrets, jwtt string) (string, error) {
 
 func (c *Core) authJWT(s *unencryptedUserSecrets) (string, error) {
 	t := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+	return c.signJWT(jwt.MapClaims{
 		"iss":      c.jwtIssuer,
 		"sub":      "auth_tok",
 		"iat":      t.Unix(),
 		"exp":      t.Add(time.Duration(c.jwtPinExpiry) * time.Second).Unix(),
 		"token_id": base64.StdEncoding.EncodeToString(s.ID),
 	})
+}
+
+// signJWT signs the claims with the JWT private key using RS256. As the key may be any
+// crypto.Signer, the signing method of the server package is used that supports those.
+func (c *Core) signJWT(claims jwt.MapClaims) (string, error) {
+	method, err := server.JwtSigningMethod(c.jwtPrivateKey)
+	if err != nil {
+		return "", err
+	}
+	if method.Alg() != jwt.SigningMethodRS256.Alg() {
+		return "", errors.New("keyshare server JWT private key must be an RSA key")
+	}
+	token := jwt.NewWithClaims(method, claims)
 	token.Header["kid"] = c.jwtPrivateKeyID
 	return token.SignedString(c.jwtPrivateKey)
 }
 
 func (c *Core) verifyChallengeResponse(s unencryptedUserSecrets, jwtt string) (string, error) {
-	challenge := c.consumeChallenge(s.ID)
-	if challenge == nil {
-		return "", ErrChallengeResponseRequired
+	claims := &irma.KeyshareAuthResponseClaims{}
+	pk, err := s.parseJWT(jwtt, claims)
+	if err != nil {
+		if len(s.PublicKeys) == 0 {
+			return "", ErrChallengeResponseRequired
+		}
+		return "", err
 	}
 
-	claims := &irma.KeyshareAuthResponseClaims{}
-	if _, err := jwt.ParseWithClaims(jwtt, claims, s.publicKey); err != nil {
+	// Each device of the user has its own challenge
+	challenge, err := c.consumeChallenge(s.ID, pk)
+	if err != nil {
 		return "", err
 	}
+	if challenge == nil {
+		return "", ErrChallengeResponseRequired
+	}
 	if subtle.ConstantTimeCompare(challenge, claims.Challenge) != 1 {
 		return "", ErrWrongChallenge
 	}
@@ -128,7 +160,7 @@ func (c *Core) ChangePin(secrets UserSecrets, jwtt string) (UserSecrets, error)
 	}
 
 	claims := &irma.KeyshareChangePinClaims{}
-	if _, err = jwt.ParseWithClaims(jwtt, claims, s.publicKey); err != nil {
+	if _, err = s.parseJWT(jwtt, claims); err != nil {
 		return nil, err
 	}
 
@@ -160,7 +192,7 @@ func (c *Core) verifyAccess(secrets UserSecrets, jwtToken string) (unencryptedUs
 			return nil, ErrInvalidJWT
 		}
 
-		return &c.jwtPrivateKey.PublicKey, nil
+		return c.jwtPrivateKey.Public(), nil
 	})
 	if err != nil {
 		return unencryptedUserSecrets{}, ErrInvalidJWT
@@ -215,8 +247,20 @@ func (c *Core) GenerateCommitments(secrets UserSecrets, accessToken string, keyI
 		return nil, 0, err
 	}
 
-	// Generate commitment
-	commitSecret, commitments, err := gabi.NewKeyshareCommitments(s.KeyshareSecret, keyList)
+	// Generate commitment, using a precomputed one if available
+	var (
+		commitSecret *big.Int
+		commitments  []*gabi.ProofPCommitment
+		precomputed  *randomCommitment
+	)
+	if c.commitmentPool != nil {
+		precomputed = c.commitmentPool.take(keyIDs, keyList)
+	}
+	if precomputed != nil {
+		commitSecret, commitments, err = keyshareCommitments(s.KeyshareSecret, keyList, precomputed)
+	} else {
+		commitSecret, commitments, err = gabi.NewKeyshareCommitments(s.KeyshareSecret, keyList)
+	}
 	if err != nil {
 		return nil, 0, err
 	}
@@ -263,14 +307,12 @@ func (c *Core) GenerateResponse(secrets UserSecrets, accessToken string, commitI
 	}
 
 	// Generate response
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+	return c.signJWT(jwt.MapClaims{
 		"ProofP": gabi.KeyshareResponse(s.KeyshareSecret, commit, challenge, key),
 		"iat":    time.Now().Unix(),
 		"sub":    "ProofP",
 		"iss":    c.jwtIssuer,
 	})
-	token.Header["kid"] = c.jwtPrivateKeyID
-	return token.SignedString(c.jwtPrivateKey)
 }
 
 func (c *Core) GenerateChallenge(secrets UserSecrets, jwtt string) ([]byte, error) {
@@ -279,12 +321,13 @@ func (c *Core) GenerateChallenge(secrets UserSecrets, jwtt string) ([]byte, erro
 		return nil, err
 	}
 
-	if s.PublicKey == nil {
+	if len(s.PublicKeys) == 0 {
 		return nil, errors.New("can't do challenge-response: no public key associated to account")
 	}
 
 	claims := &irma.KeyshareAuthRequestClaims{}
-	if _, err = jwt.ParseWithClaims(jwtt, claims, s.publicKey); err != nil {
+	pk, err := s.parseJWT(jwtt, claims)
+	if err != nil {
 		return nil, err
 	}
 	// Impose explicit maximum on JWT expiry; we don't want eternally valid JWTs.
@@ -298,19 +341,35 @@ func (c *Core) GenerateChallenge(secrets UserSecrets, jwtt string) ([]byte, erro
 		return nil, err
 	}
 
+	key, err := challengeKey(s.ID, pk)
+	if err != nil {
+		return nil, err
+	}
 	c.authChallengesMutex.Lock()
 	defer c.authChallengesMutex.Unlock()
-	c.authChallenges[string(s.ID)] = challenge
+	c.authChallenges[key] = challenge
 	return challenge, nil
 }
 
-func (c *Core) consumeChallenge(id []byte) []byte {
+func (c *Core) consumeChallenge(id []byte, pk *ecdsa.PublicKey) ([]byte, error) {
+	key, err := challengeKey(id, pk)
+	if err != nil {
+		return nil, err
+	}
 	c.authChallengesMutex.Lock()
 	defer c.authChallengesMutex.Unlock()
-	stringID := string(id)
-	challenge := c.authChallenges[stringID]
-	delete(c.authChallenges, stringID)
-	return challenge
+	challenge := c.authChallenges[key]
+	delete(c.authChallenges, key)
+	return challenge, nil
+}
+
+// challengeKey returns the key under which the challenge for the specified user ID and device is stored.
+func challengeKey(id []byte, pk *ecdsa.PublicKey) (string, error) {
+	pkBts, err := signed.MarshalPublicKey(pk)
+	if err != nil {
+		return "", err
+	}
+	return string(id) + string(pkBts), nil
 }
 
 func (c *Core) SetUserPublicKey(secrets UserSecrets, pin string, pk *ecdsa.PublicKey) (string, UserSecrets, error) {
@@ -319,11 +378,145 @@ func (c *Core) SetUserPublicKey(secrets UserSecrets, pin string, pk *ecdsa.Publi
 		return "", nil, err
 	}
 
-	if s.PublicKey != nil {
+	if len(s.PublicKeys) != 0 {
 		return "", nil, errors.New("user already has public key")
 	}
 
-	s.PublicKey = pk
+	s.PublicKeys = []*ecdsa.PublicKey{pk}
+	secrets, err = c.encryptUserSecrets(s)
+	if err != nil {
+		return "", nil, err
+	}
+	jwtt, err := c.authJWT(&s)
+	if err != nil {
+		return "", nil, err
+	}
+	return jwtt, secrets, nil
+}
+
+// ResetUserSecrets replaces the pin and the public keys of all devices in an encrypted keyshare user
+// secret by the specified ones, keeping the keyshare secret itself, and generates a JWT for future
+// access. The caller must have established by other means that the user is entitled to this, as it
+// does not require the old pin.
+func (c *Core) ResetUserSecrets(secrets UserSecrets, pin string, pk *ecdsa.PublicKey) (string, UserSecrets, error) {
+	s, err := c.decryptUserSecrets(secrets)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id := make([]byte, 32)
+	_, err = rand.Read(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if err = s.setPin(pin); err != nil {
+		return "", nil, err
+	}
+	if err = s.setID(id); err != nil {
+		return "", nil, err
+	}
+	s.PublicKeys = []*ecdsa.PublicKey{pk}
+
+	secrets, err = c.encryptUserSecrets(s)
+	if err != nil {
+		return "", nil, err
+	}
+	jwtt, err := c.authJWT(&s)
+	if err != nil {
+		return "", nil, err
+	}
+	return jwtt, secrets, nil
+}
+
+// AddDevice registers the public key of a new device to an encrypted keyshare user secret, after
+// validating that the request was signed by one of the devices already registered and that the pin
+// is known by the caller.
+func (c *Core) AddDevice(secrets UserSecrets, jwtt string) (UserSecrets, error) {
+	s, err := c.decryptUserSecrets(secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &irma.KeyshareDeviceAddClaims{}
+	if _, err = s.parseJWT(jwtt, claims); err != nil {
+		return nil, ErrInvalidJWT
+	}
+	if err = s.verifyPin(claims.Pin); err != nil {
+		return nil, err
+	}
+
+	pk, err := signed.UnmarshalPublicKey(claims.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	pkBts, err := signed.MarshalPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	i, err := s.deviceIndex(irma.KeyshareDeviceID(pkBts))
+	if err != nil {
+		return nil, err
+	}
+	if i != -1 {
+		return nil, ErrDeviceExists
+	}
+	if len(s.PublicKeys) >= MaxDevices {
+		return nil, ErrTooManyDevices
+	}
+
+	s.PublicKeys = append(s.PublicKeys, pk)
+	return c.encryptUserSecrets(s)
+}
+
+// Devices returns the IDs of the devices registered to an encrypted keyshare user secret, after
+// validating the access token.
+func (c *Core) Devices(secrets UserSecrets, accessToken string) ([]string, error) {
+	s, err := c.verifyAccess(secrets, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(s.PublicKeys))
+	for _, pk := range s.PublicKeys {
+		pkBts, err := signed.MarshalPublicKey(pk)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, irma.KeyshareDeviceID(pkBts))
+	}
+	return ids, nil
+}
+
+// RevokeDevice removes the device with the specified ID from an encrypted keyshare user secret,
+// after validating the access token. As this invalidates all access tokens of the user, it returns
+// a new one.
+func (c *Core) RevokeDevice(secrets UserSecrets, accessToken, deviceID string) (string, UserSecrets, error) {
+	s, err := c.verifyAccess(secrets, accessToken)
+	if err != nil {
+		return "", nil, err
+	}
+
+	i, err := s.deviceIndex(deviceID)
+	if err != nil {
+		return "", nil, err
+	}
+	if i == -1 {
+		return "", nil, ErrUnknownDevice
+	}
+	if len(s.PublicKeys) == 1 {
+		return "", nil, ErrLastDevice
+	}
+	s.PublicKeys = append(s.PublicKeys[:i], s.PublicKeys[i+1:]...)
+
+	id := make([]byte, 32)
+	_, err = rand.Read(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if err = s.setID(id); err != nil {
+		return "", nil, err
+	}
+
 	secrets, err = c.encryptUserSecrets(s)
 	if err != nil {
 		return "", nil, err
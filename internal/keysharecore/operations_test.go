@@ -1,6 +1,9 @@
 package keysharecore
 
 import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
@@ -66,6 +69,46 @@ func TestPinFunctionality(t *testing.T) {
 	}
 }
 
+// opaqueSigner hides the private key, like crypto.Signer implementations of keys kept in a HSM.
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestExternalKeys(t *testing.T) {
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	block, err := aes.NewCipher(key[:])
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, Decrypter: gcm, JWTPrivateKeyID: 1, JWTPrivateKey: opaqueSigner{jwtTestKey}})
+
+	pin := generatePin()
+	secrets, err := c.NewUserSecrets(pin, nil)
+	require.NoError(t, err)
+	j, err := validateAuth(t, c, nil, secrets, pin)
+	require.NoError(t, err)
+	_, err = jwt.Parse(j, func(_ *jwt.Token) (interface{}, error) {
+		return &jwtTestKey.PublicKey, nil
+	})
+	require.NoError(t, err)
+	_, err = c.verifyAccess(secrets, j)
+	require.NoError(t, err)
+
+	// Secrets encrypted using the decrypter can be decrypted using the equivalent key
+	other := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+	_, err = other.decryptUserSecrets(secrets)
+	require.NoError(t, err)
+
+	// Only RSA keys can be used to sign keyshare JWTs
+	ecdsaKey, err := signed.GenerateKey()
+	require.NoError(t, err)
+	c = NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: ecdsaKey})
+	_, err = validateAuth(t, c, nil, secrets, pin)
+	require.Error(t, err)
+}
+
 func TestVerifyAccess(t *testing.T) {
 	// Setup keys for test
 	var key AESKey
@@ -101,7 +144,7 @@ func TestVerifyAccess(t *testing.T) {
 			"exp":      time.Now().Add(-3 * time.Minute).Unix(),
 			"token_id": tokenID,
 		})
-		jwtt, err = token.SignedString(c.jwtPrivateKey)
+		jwtt, err = token.SignedString(jwtTestKey)
 		require.NoError(t, err)
 		_, err = c.verifyAccess(secrets1, jwtt)
 		assert.Error(t, err)
@@ -111,7 +154,7 @@ func TestVerifyAccess(t *testing.T) {
 			"iat":      time.Now().Unix(),
 			"token_id": tokenID,
 		})
-		jwtt, err = token.SignedString(c.jwtPrivateKey)
+		jwtt, err = token.SignedString(jwtTestKey)
 		require.NoError(t, err)
 		_, err = c.verifyAccess(secrets1, jwtt)
 		assert.Error(t, err)
@@ -122,7 +165,7 @@ func TestVerifyAccess(t *testing.T) {
 			"exp":      "test",
 			"token_id": tokenID,
 		})
-		jwtt, err = token.SignedString(c.jwtPrivateKey)
+		jwtt, err = token.SignedString(jwtTestKey)
 		require.NoError(t, err)
 		_, err = c.verifyAccess(secrets1, jwtt)
 		assert.Error(t, err)
@@ -132,7 +175,7 @@ func TestVerifyAccess(t *testing.T) {
 			"iat": time.Now().Unix(),
 			"exp": time.Now().Add(3 * time.Minute).Unix(),
 		})
-		jwtt, err = token.SignedString(c.jwtPrivateKey)
+		jwtt, err = token.SignedString(jwtTestKey)
 		require.NoError(t, err)
 		_, err = c.verifyAccess(secrets1, jwtt)
 		assert.Error(t, err)
@@ -143,7 +186,7 @@ func TestVerifyAccess(t *testing.T) {
 			"exp":      time.Now().Add(3 * time.Minute).Unix(),
 			"token_id": 7,
 		})
-		jwtt, err = token.SignedString(c.jwtPrivateKey)
+		jwtt, err = token.SignedString(jwtTestKey)
 		require.NoError(t, err)
 		_, err = c.verifyAccess(secrets1, jwtt)
 		assert.Error(t, err)
@@ -197,7 +240,7 @@ func TestProofFunctionality(t *testing.T) {
 		}{}
 		fmt.Println(Rjwt)
 		_, err = jwt.ParseWithClaims(Rjwt, claims, func(tok *jwt.Token) (interface{}, error) {
-			return &c.jwtPrivateKey.PublicKey, nil
+			return &jwtTestKey.PublicKey, nil
 		})
 		require.NoError(t, err)
 
@@ -211,6 +254,68 @@ func TestProofFunctionality(t *testing.T) {
 	}
 }
 
+func TestCommitmentPool(t *testing.T) {
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{
+		DecryptionKeyID:       1,
+		DecryptionKey:         key,
+		JWTPrivateKeyID:       1,
+		JWTPrivateKey:         jwtTestKey,
+		CommitmentPoolSize:    2,
+		CommitmentPoolWorkers: 1,
+	})
+	defer c.Stop()
+	keyID := irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}
+	c.DangerousAddTrustedPublicKey(keyID, testPubK1)
+
+	pin := generatePin()
+	secrets, err := c.NewUserSecrets(pin, nil)
+	require.NoError(t, err)
+	jwtt, err := validateAuth(t, c, nil, secrets, pin)
+	require.NoError(t, err)
+
+	precomputed := func() int {
+		c.commitmentPool.Lock()
+		defer c.commitmentPool.Unlock()
+		set := c.commitmentPool.keySets[keyID.String()]
+		if set == nil {
+			return 0
+		}
+		return len(set.commitments)
+	}
+
+	// Commitments are precomputed for keys after they have been used
+	_, _, err = c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{keyID})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return precomputed() == 2 }, 10*time.Second, 10*time.Millisecond)
+
+	// Proofs using precomputed commitments are valid
+	c.commitmentPool.Lock()
+	pcommit := c.commitmentPool.keySets[keyID.String()].commitments[0].pcommits[0]
+	c.commitmentPool.Unlock()
+	W, commitID, err := c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{keyID})
+	require.NoError(t, err)
+	require.Equal(t, pcommit, W[0].Pcommit)
+	Rjwt, err := c.GenerateResponse(secrets, jwtt, commitID, big.NewInt(12345), keyID)
+	require.NoError(t, err)
+	claims := &struct {
+		jwt.StandardClaims
+		ProofP *gabi.ProofP
+	}{}
+	_, err = jwt.ParseWithClaims(Rjwt, claims, func(tok *jwt.Token) (interface{}, error) {
+		return &jwtTestKey.PublicKey, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, new(big.Int).Exp(testPubK1.R[0], claims.ProofP.SResponse, testPubK1.N).Cmp(
+		new(big.Int).Mod(
+			new(big.Int).Mul(
+				W[0].Pcommit,
+				new(big.Int).Exp(W[0].P, big.NewInt(12345), testPubK1.N)),
+			testPubK1.N)), "Crypto result off")
+}
+
 func TestCorruptedUserSecrets(t *testing.T) {
 	// Setup keys for test
 	var key AESKey
@@ -421,6 +526,157 @@ func TestNonExistingCommit(t *testing.T) {
 	}
 }
 
+func TestResetUserSecrets(t *testing.T) {
+	// Setup keys for test
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+
+	oldSigner, newSigner := test.NewSigner(t), test.NewSigner(t)
+	pin, newpin := generatePin(), generatePin()
+	secrets, err := c.NewUserSecrets(pin, signerPublicKey(t, oldSigner))
+	require.NoError(t, err)
+	jwtt, err := validateAuth(t, c, oldSigner, secrets, pin)
+	require.NoError(t, err)
+
+	// Reset pin and public key without knowing the old pin
+	newjwtt, newsecrets, err := c.ResetUserSecrets(secrets, newpin, signerPublicKey(t, newSigner))
+	require.NoError(t, err)
+	assert.NoError(t, c.ValidateJWT(newsecrets, newjwtt))
+	assert.Error(t, c.ValidateJWT(newsecrets, jwtt), "access token from before the reset still valid")
+
+	// The keyshare secret is kept
+	s, err := c.decryptUserSecrets(secrets)
+	require.NoError(t, err)
+	news, err := c.decryptUserSecrets(newsecrets)
+	require.NoError(t, err)
+	assert.Equal(t, s.KeyshareSecret, news.KeyshareSecret)
+
+	// Only the new pin and public key work
+	_, err = validateAuth(t, c, newSigner, newsecrets, newpin)
+	assert.NoError(t, err)
+	_, err = validateAuth(t, c, newSigner, newsecrets, pin)
+	assert.Error(t, err)
+	jwtt, err = irmaclient.SignerCreateJWT(oldSigner, "", irma.KeyshareAuthRequestClaims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(3 * time.Minute))},
+	})
+	require.NoError(t, err)
+	_, err = c.GenerateChallenge(newsecrets, jwtt)
+	assert.Error(t, err)
+}
+
+func TestDevices(t *testing.T) {
+	// Setup keys for test
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+
+	phone, tablet := test.NewSigner(t), test.NewSigner(t)
+	pin := generatePin()
+	secrets, err := c.NewUserSecrets(pin, signerPublicKey(t, phone))
+	require.NoError(t, err)
+
+	// The new device is not yet registered
+	authRequest, err := irmaclient.SignerCreateJWT(tablet, "", irma.KeyshareAuthRequestClaims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(3 * time.Minute))},
+	})
+	require.NoError(t, err)
+	_, err = c.GenerateChallenge(secrets, authRequest)
+	require.Error(t, err)
+
+	// Adding a device requires the pin, and a signature of a registered device
+	_, err = c.AddDevice(secrets, addDeviceJWT(t, phone, tablet, generatePin()))
+	require.ErrorIs(t, err, ErrInvalidPin)
+	_, err = c.AddDevice(secrets, addDeviceJWT(t, tablet, tablet, pin))
+	require.ErrorIs(t, err, ErrInvalidJWT)
+	secrets, err = c.AddDevice(secrets, addDeviceJWT(t, phone, tablet, pin))
+	require.NoError(t, err)
+	_, err = c.AddDevice(secrets, addDeviceJWT(t, tablet, tablet, pin))
+	require.ErrorIs(t, err, ErrDeviceExists)
+
+	// Both devices can now authenticate
+	jwtt, err := validateAuth(t, c, phone, secrets, pin)
+	require.NoError(t, err)
+	_, err = validateAuth(t, c, tablet, secrets, pin)
+	require.NoError(t, err)
+
+	// List devices
+	ids, err := c.Devices(secrets, jwtt)
+	require.NoError(t, err)
+	require.Equal(t, []string{signerDeviceID(t, phone), signerDeviceID(t, tablet)}, ids)
+	_, err = c.Devices(secrets, "invalid")
+	require.ErrorIs(t, err, ErrInvalidJWT)
+
+	// Revoke the phone
+	_, _, err = c.RevokeDevice(secrets, jwtt, "unknown")
+	require.ErrorIs(t, err, ErrUnknownDevice)
+	newjwtt, newsecrets, err := c.RevokeDevice(secrets, jwtt, signerDeviceID(t, phone))
+	require.NoError(t, err)
+	require.Error(t, c.ValidateJWT(newsecrets, jwtt), "access token from before the revocation still valid")
+	ids, err = c.Devices(newsecrets, newjwtt)
+	require.NoError(t, err)
+	require.Equal(t, []string{signerDeviceID(t, tablet)}, ids)
+	_, err = validateAuth(t, c, tablet, newsecrets, pin)
+	require.NoError(t, err)
+	authRequest, err = irmaclient.SignerCreateJWT(phone, "", irma.KeyshareAuthRequestClaims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(3 * time.Minute))},
+	})
+	require.NoError(t, err)
+	_, err = c.GenerateChallenge(newsecrets, authRequest)
+	require.Error(t, err)
+
+	// The last device cannot be revoked
+	_, _, err = c.RevokeDevice(newsecrets, newjwtt, signerDeviceID(t, tablet))
+	require.ErrorIs(t, err, ErrLastDevice)
+
+	// The amount of devices is limited
+	for i := 2; i < MaxDevices; i++ {
+		secrets, err = c.AddDevice(secrets, addDeviceJWT(t, phone, test.NewSigner(t), pin))
+		require.NoError(t, err)
+	}
+	_, err = c.AddDevice(secrets, addDeviceJWT(t, phone, test.NewSigner(t), pin))
+	require.ErrorIs(t, err, ErrTooManyDevices)
+}
+
+func TestDeviceChallenges(t *testing.T) {
+	// Setup keys for test
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+
+	phone, tablet := test.NewSigner(t), test.NewSigner(t)
+	pin := generatePin()
+	secrets, err := c.NewUserSecrets(pin, signerPublicKey(t, phone))
+	require.NoError(t, err)
+	secrets, err = c.AddDevice(secrets, addDeviceJWT(t, phone, tablet, pin))
+	require.NoError(t, err)
+
+	// Both devices request a challenge at the same time, without overwriting each other's
+	phoneResponse := doChallengeResponse(t, c, phone, secrets, pin)
+	tabletResponse := doChallengeResponse(t, c, tablet, secrets, pin)
+	_, err = c.ValidateAuth(secrets, phoneResponse)
+	require.NoError(t, err)
+	_, err = c.ValidateAuth(secrets, tabletResponse)
+	require.NoError(t, err)
+
+	// A device cannot answer the challenge of another device
+	jwtt, err := irmaclient.SignerCreateJWT(phone, "", irma.KeyshareAuthRequestClaims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(3 * time.Minute))},
+	})
+	require.NoError(t, err)
+	challenge, err := c.GenerateChallenge(secrets, jwtt)
+	require.NoError(t, err)
+	jwtt, err = irmaclient.SignerCreateJWT(tablet, "", irma.KeyshareAuthResponseClaims{
+		KeyshareAuthResponseData: irma.KeyshareAuthResponseData{Pin: pin, Challenge: challenge},
+	})
+	require.NoError(t, err)
+	_, err = c.ValidateAuth(secrets, jwtt)
+	require.ErrorIs(t, err, ErrChallengeResponseRequired)
+}
+
 // Test data
 const xmlPubKey1 = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
 <IssuerPublicKey xmlns="http://www.zurich.ibm.com/security/idemix">
@@ -561,3 +817,22 @@ func TestMain(m *testing.M) {
 	}
 	os.Exit(m.Run())
 }
+
+func addDeviceJWT(t *testing.T, signer, newDevice irmaclient.Signer, pin string) string {
+	pkbts, err := newDevice.PublicKey("keyname")
+	require.NoError(t, err)
+	jwtt, err := irmaclient.SignerCreateJWT(signer, "", irma.KeyshareDeviceAddClaims{
+		KeyshareDeviceAddData: irma.KeyshareDeviceAddData{
+			Pin:       pin,
+			PublicKey: pkbts,
+		},
+	})
+	require.NoError(t, err)
+	return jwtt
+}
+
+func signerDeviceID(t *testing.T, signer irmaclient.Signer) string {
+	pkbts, err := signed.MarshalPublicKey(signerPublicKey(t, signer))
+	require.NoError(t, err)
+	return irma.KeyshareDeviceID(pkbts)
+}
@@ -1,6 +1,7 @@
 package keysharecore
 
 import (
+	"crypto/ecdsa"
 	"encoding/base64"
 	"encoding/binary"
 	"io/ioutil"
@@ -48,7 +49,7 @@ func TestEncryptTestUser(t *testing.T) {
 	require.NoError(t, err)
 	without := base64.StdEncoding.EncodeToString(secrets)
 
-	user.PublicKey = &sk.PublicKey
+	user.PublicKeys = []*ecdsa.PublicKey{&sk.PublicKey}
 	secrets, err = c.encryptUserSecrets(user)
 	require.NoError(t, err)
 	with := base64.StdEncoding.EncodeToString(secrets)
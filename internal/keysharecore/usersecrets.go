@@ -13,6 +13,7 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/signed"
+	irma "github.com/privacybydesign/irmago"
 )
 
 type (
@@ -20,7 +21,8 @@ type (
 		Pin            []byte
 		KeyshareSecret *big.Int
 		ID             []byte
-		PublicKey      *ecdsa.PublicKey
+		// Public keys of the devices registered to the account; empty for legacy accounts
+		PublicKeys []*ecdsa.PublicKey
 	}
 
 	// UserSecrets contains the encrypted data of a keyshare user.
@@ -86,6 +88,8 @@ type marshaledUserSecrets struct {
 	KeyshareSecret []byte
 	ID             []byte
 	PublicKey      []byte
+	// Public keys of devices other than the first, which is stored in PublicKey for compatibility
+	AdditionalPublicKeys [][]byte
 }
 
 // MarshalCBOR implements cbor.Marshaler to ensure that all fields have a constant size, to minimize
@@ -95,15 +99,20 @@ func (s *unencryptedUserSecrets) MarshalCBOR() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	var pkBts []byte
-	if s.PublicKey != nil {
-		pkBts, err = signed.MarshalPublicKey(s.PublicKey)
+	var pks [][]byte
+	for _, pk := range s.PublicKeys {
+		pkBts, err := signed.MarshalPublicKey(pk)
 		if err != nil {
 			return nil, err
 		}
+		pks = append(pks, pkBts)
+	}
+	var pkBts []byte
+	if len(pks) > 0 {
+		pkBts, pks = pks[0], pks[1:]
 	}
 	return cbor.Marshal(marshaledUserSecrets{
-		s.Pin, secretBts, s.ID, pkBts,
+		s.Pin, secretBts, s.ID, pkBts, pks,
 	}, cbor.EncOptions{})
 }
 
@@ -118,21 +127,50 @@ func (s *unencryptedUserSecrets) UnmarshalCBOR(bytes []byte) error {
 		KeyshareSecret: new(big.Int).SetBytes(raw.KeyshareSecret),
 		ID:             raw.ID,
 	}
-	if len(raw.PublicKey) > 0 {
-		s.PublicKey, err = signed.UnmarshalPublicKey(raw.PublicKey)
+	if len(raw.PublicKey) == 0 {
+		return nil
+	}
+	for _, pkBts := range append([][]byte{raw.PublicKey}, raw.AdditionalPublicKeys...) {
+		pk, err := signed.UnmarshalPublicKey(pkBts)
 		if err != nil {
 			return err
 		}
+		s.PublicKeys = append(s.PublicKeys, pk)
 	}
 	return nil
 }
 
-// publicKey returns the user's public key. For use in jwt.ParseWithClaims().
-func (s *unencryptedUserSecrets) publicKey(_ *jwt.Token) (interface{}, error) {
-	if s.PublicKey == nil {
+// parseJWT parses the JWT into the claims, verifying that it is signed by one of the user's devices.
+// It returns the public key of that device.
+func (s *unencryptedUserSecrets) parseJWT(jwtt string, claims jwt.Claims) (*ecdsa.PublicKey, error) {
+	if len(s.PublicKeys) == 0 {
 		return nil, ErrKeyNotFound
 	}
-	return s.PublicKey, nil
+	var err error
+	for _, pk := range s.PublicKeys {
+		pk := pk
+		_, err = jwt.ParseWithClaims(jwtt, claims, func(_ *jwt.Token) (interface{}, error) {
+			return pk, nil
+		})
+		if err == nil {
+			return pk, nil
+		}
+	}
+	return nil, err
+}
+
+// deviceIndex returns the index of the public key of the device with the specified ID, or -1.
+func (s *unencryptedUserSecrets) deviceIndex(id string) (int, error) {
+	for i, pk := range s.PublicKeys {
+		bts, err := signed.MarshalPublicKey(pk)
+		if err != nil {
+			return 0, err
+		}
+		if irma.KeyshareDeviceID(bts) == id {
+			return i, nil
+		}
+	}
+	return -1, nil
 }
 
 func (c *Core) encryptUserSecrets(secrets unencryptedUserSecrets) (UserSecrets, error) {
@@ -153,11 +191,7 @@ func (c *Core) encryptUserSecrets(secrets unencryptedUserSecrets) (UserSecrets,
 	}
 
 	// Encrypt secrets
-	gcm, err := newGCM(c.decryptionKey)
-	if err != nil {
-		return nil, err
-	}
-	return gcm.Seal(encSecrets[:16], encSecrets[4:16], bts, nil), nil
+	return c.decryptionKey.Seal(encSecrets[:16], encSecrets[4:16], bts, nil), nil
 }
 
 func (c *Core) decryptUserSecrets(secrets UserSecrets) (unencryptedUserSecrets, error) {
@@ -165,17 +199,12 @@ func (c *Core) decryptUserSecrets(secrets UserSecrets) (unencryptedUserSecrets,
 	id := binary.LittleEndian.Uint32(secrets[0:])
 
 	// Fetch key
-	key, ok := c.decryptionKeys[id]
+	gcm, ok := c.decryptionKeys[id]
 	if !ok {
 		return unencryptedUserSecrets{}, ErrNoSuchKey
 	}
 
 	// try and decrypt secrets
-	gcm, err := newGCM(key)
-	if err != nil {
-		return unencryptedUserSecrets{}, err
-	}
-
 	bts, err := gcm.Open(nil, secrets[4:16], secrets[16:], nil)
 	if err != nil {
 		return unencryptedUserSecrets{}, err
@@ -203,16 +232,11 @@ func (c *Core) decryptUserSecretsIfPinOK(secrets UserSecrets, pin string) (unenc
 	return s, nil
 }
 
-func newGCM(key AESKey) (cipher.AEAD, error) {
-	keyedAes, err := aes.NewCipher(key[:])
-	if err != nil {
-		return nil, err
-	}
-	gcm, err := cipher.NewGCM(keyedAes)
-	if err != nil {
-		return nil, err
-	}
-	return gcm, nil
+func newGCM(key AESKey) cipher.AEAD {
+	// Neither can fail: AESKey has a valid AES key size, and AES has the block size required by GCM
+	keyedAes, _ := aes.NewCipher(key[:])
+	gcm, _ := cipher.NewGCM(keyedAes)
+	return gcm
 }
 
 // padBytes pads the given byte slice with zeros on the left such that the resulting byte slice
@@ -0,0 +1,84 @@
+//go:build !local_tests
+
+package sessiontest
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+func clearPostgresSessions(t *testing.T) {
+	db, err := sql.Open("pgx", test.PostgresTestUrl)
+	require.NoError(t, err)
+	defer common.Close(db)
+	_, err = db.Exec("DROP TABLE IF EXISTS irma_sessions")
+	require.NoError(t, err)
+}
+
+func postgresRequestorConfigDecorator(t *testing.T, fn func() *requestorserver.Configuration) func() *requestorserver.Configuration {
+	return func() *requestorserver.Configuration {
+		c := fn()
+		postgresConfigDecorator(t, func() *server.Configuration { return c.Configuration })()
+		return c
+	}
+}
+
+func postgresConfigDecorator(t *testing.T, fn func() *server.Configuration) func() *server.Configuration {
+	return func() *server.Configuration {
+		clearPostgresSessions(t) // Prevent side effects between different runs of the IRMA server.
+		c := fn()
+		c.StoreType = "postgres"
+		c.PostgresSettings = &server.PostgresSettings{ConnStr: test.PostgresTestUrl}
+		return c
+	}
+}
+
+func TestPostgres(t *testing.T) {
+	t.Run("SigningSession", apply(testSigningSession, postgresRequestorConfigDecorator(t, RequestorServerConfiguration)))
+	t.Run("DisclosureSession", apply(testDisclosureSession, postgresRequestorConfigDecorator(t, RequestorServerConfiguration)))
+	t.Run("IssuanceSession", apply(testIssuanceSession, postgresRequestorConfigDecorator(t, RequestorServerConfiguration)))
+
+	t.Run("ChainedSessions", apply(testChainedSessions, postgresConfigDecorator(t, IrmaServerConfiguration)))
+	t.Run("UnknownRequestorToken", apply(testUnknownRequestorToken, postgresConfigDecorator(t, IrmaServerConfiguration)))
+}
+
+func TestPostgresSessionSurvivesRestart(t *testing.T) {
+	conf := postgresConfigDecorator(t, IrmaServerConfiguration)()
+	irmaServer := StartIrmaServer(t, conf)
+	_, token, _, err := irmaServer.irma.StartSession(irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	), nil)
+	require.NoError(t, err)
+	require.NoError(t, irmaServer.irma.CancelSession(token))
+	irmaServer.Stop()
+
+	// Start a fresh server instance on the same database; the session result should still be there.
+	conf = IrmaServerConfiguration()
+	conf.StoreType = "postgres"
+	conf.PostgresSettings = &server.PostgresSettings{ConnStr: test.PostgresTestUrl}
+	irmaServer = StartIrmaServer(t, conf)
+	defer irmaServer.Stop()
+
+	result, err := irmaServer.irma.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusCancelled, result.Status)
+}
+
+func TestPostgresUnreachable(t *testing.T) {
+	conf := IrmaServerConfiguration()
+	conf.StoreType = "postgres"
+	conf.PostgresSettings = &server.PostgresSettings{
+		ConnStr: strings.Replace(test.PostgresTestUrl, "5432", "54321", 1),
+	}
+	_, err := irmaserver.New(conf)
+	require.Error(t, err)
+}
@@ -265,6 +265,32 @@ func TestRedisRedundancy(t *testing.T) {
 	doSession(t, request, nil, nil, nil, nil, nil, optionReuseServer)
 }
 
+func TestRedisOptimisticLocking(t *testing.T) {
+	mr, cert := startRedis(t, true)
+	defer mr.Close()
+
+	ports := []int{48690, 48691, 48692}
+	servers := make([]*requestorserver.Server, len(ports))
+
+	for i, port := range ports {
+		c := redisRequestorConfigDecorator(mr, cert, "", RequestorServerAuthConfiguration)()
+		c.Configuration.URL = fmt.Sprintf("http://localhost:%d/irma", port)
+		c.Configuration.OptimisticLocking = true
+		c.Port = port
+		servers[i] = StartRequestorServer(t, c)
+	}
+	lb := startLoadBalancer(t, ports)
+	defer func() {
+		require.NoError(t, lb.Close())
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	doSession(t, getDisclosureRequest(id), nil, nil, nil, nil, nil, optionReuseServer)
+}
+
 // Tests whether the right error is returned by the client's Failure handler
 func TestRedisSessionFailure(t *testing.T) {
 	mr, cert := startRedis(t, true)
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -30,13 +31,26 @@ func checkError(t *testing.T, err error) {
 }
 
 var schemeServer *http.Server
+var schemeServerRequests struct {
+	sync.Mutex
+	paths []string
+}
 var badServer *http.Server
 var badServerCount atomic.Uint32
 var testStorageDir = "client"
 
 func StartSchemeManagerHttpServer() {
 	path := FindTestdataFolder(nil)
-	schemeServer = &http.Server{Addr: "localhost:48681", Handler: http.FileServer(http.Dir(path))}
+	files := http.FileServer(http.Dir(path))
+	schemeServerRequests.Lock()
+	schemeServerRequests.paths = nil
+	schemeServerRequests.Unlock()
+	schemeServer = &http.Server{Addr: "localhost:48681", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		schemeServerRequests.Lock()
+		schemeServerRequests.paths = append(schemeServerRequests.paths, r.URL.Path)
+		schemeServerRequests.Unlock()
+		files.ServeHTTP(w, r)
+	})}
 	go func() {
 		_ = schemeServer.ListenAndServe()
 	}()
@@ -47,6 +61,14 @@ func StopSchemeManagerHttpServer() {
 	_ = schemeServer.Close()
 }
 
+// SchemeManagerHttpServerRequests returns the paths requested from the scheme manager HTTP server
+// since it was started.
+func SchemeManagerHttpServerRequests() []string {
+	schemeServerRequests.Lock()
+	defer schemeServerRequests.Unlock()
+	return append([]string{}, schemeServerRequests.paths...)
+}
+
 // StartBadHttpServer starts an HTTP server that times out and returns 500 on the first few times.
 func StartBadHttpServer(count uint32, timeout time.Duration, success string) {
 	badServer = &http.Server{Addr: "localhost:48682", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -40,33 +40,75 @@ func configureEmail() keyshare.EmailConfiguration {
 	}
 }
 
+// configureNotificationEmailAuth builds an authentication object for the notification email
+// server, if a username is specified.
+func configureNotificationEmailAuth() smtp.Auth {
+	if viper.GetString("notification_email_username") == "" {
+		return nil
+	}
+	return smtp.PlainAuth(
+		"",
+		viper.GetString("notification_email_username"),
+		viper.GetString("notification_email_password"),
+		viper.GetString("notification_email_hostname"),
+	)
+}
+
 func configureIRMAServer() *server.Configuration {
 	return &server.Configuration{
-		SchemesPath:            viper.GetString("schemes_path"),
-		SchemesAssetsPath:      viper.GetString("schemes_assets_path"),
-		SchemesUpdateInterval:  viper.GetInt("schemes_update"),
-		DisableSchemesUpdate:   viper.GetInt("schemes_update") == 0,
-		IssuerPrivateKeysPath:  viper.GetString("privkeys"),
-		RevocationDBType:       viper.GetString("revocation_db_type"),
-		RevocationDBConnStr:    viper.GetString("revocation_db_str"),
-		RevocationSettings:     irma.RevocationSettings{},
-		URL:                    viper.GetString("url"),
-		DisableTLS:             viper.GetBool("no_tls"),
-		Email:                  viper.GetString("email"),
-		EnableSSE:              viper.GetBool("sse"),
-		StoreType:              viper.GetString("store_type"),
-		Verbose:                viper.GetInt("verbose"),
-		Quiet:                  viper.GetBool("quiet"),
-		LogJSON:                viper.GetBool("log_json"),
-		Logger:                 logger,
-		Production:             viper.GetBool("production"),
-		MaxSessionLifetime:     viper.GetInt("max_session_lifetime"),
-		SessionResultLifetime:  viper.GetInt("session_result_lifetime"),
-		JwtIssuer:              viper.GetString("jwt_issuer"),
-		JwtPrivateKey:          viper.GetString("jwt_privkey"),
-		JwtPrivateKeyFile:      viper.GetString("jwt_privkey_file"),
-		AllowUnsignedCallbacks: viper.GetBool("allow_unsigned_callbacks"),
-		AugmentClientReturnURL: viper.GetBool("augment_client_return_url"),
+		SchemesPath:                 viper.GetString("schemes_path"),
+		SchemesAssetsPath:           viper.GetString("schemes_assets_path"),
+		SchemesUpdateInterval:       viper.GetInt("schemes_update"),
+		DisableSchemesUpdate:        viper.GetInt("schemes_update") == 0,
+		WatchSchemes:                viper.GetBool("watch"),
+		AllowUnsignedDemoSchemes:    viper.GetBool("allow_unsigned_demo_schemes"),
+		SchemesOverridesPath:        viper.GetString("schemes_overrides_path"),
+		SchemeURLs:                  viper.GetStringMapString("scheme_urls"),
+		SkipInvalidDescriptions:     viper.GetBool("skip_invalid_descriptions"),
+		IssuerPrivateKeysPath:       viper.GetString("privkeys"),
+		RevocationDBType:            viper.GetString("revocation_db_type"),
+		RevocationDBConnStr:         viper.GetString("revocation_db_str"),
+		RevocationSettings:          irma.RevocationSettings{},
+		URL:                         viper.GetString("url"),
+		DisableTLS:                  viper.GetBool("no_tls"),
+		Email:                       viper.GetString("email"),
+		EnableSSE:                   viper.GetBool("sse"),
+		StoreType:                   viper.GetString("store_type"),
+		OptimisticLocking:           viper.GetBool("optimistic_locking"),
+		SessionEncryptionKey:        viper.GetString("session_encryption_key"),
+		SessionEncryptionKeyFile:    viper.GetString("session_encryption_key_file"),
+		SessionDecryptionKeys:       viper.GetStringSlice("session_decryption_keys"),
+		Verbose:                     viper.GetInt("verbose"),
+		Quiet:                       viper.GetBool("quiet"),
+		LogJSON:                     viper.GetBool("log_json"),
+		AuditLog:                    viper.GetString("audit_log"),
+		AuditLogAttributeValues:     viper.GetBool("audit_log_attribute_values"),
+		StatsWindows:                viper.GetIntSlice("stats_windows"),
+		NotificationEmailServer:     viper.GetString("notification_email_server"),
+		NotificationEmailFrom:       viper.GetString("notification_email_from"),
+		NotificationEmailAuth:       configureNotificationEmailAuth(),
+		NotifyAttributeValues:       viper.GetBool("notify_attribute_values"),
+		Logger:                      logger,
+		Production:                  viper.GetBool("production"),
+		MaxSessionLifetime:          viper.GetInt("max_session_lifetime"),
+		MaxRequestedSessionLifetime: viper.GetInt("max_requested_session_lifetime"),
+		SessionResultLifetime:       viper.GetInt("session_result_lifetime"),
+		ExpiryTicker:                viper.GetInt("expiry_ticker"),
+		MaxRequestSize:              viper.GetInt64("max_request_size"),
+		StrictDecoding:              viper.GetBool("strict_decoding"),
+		MinProtocolVersion:          viper.GetString("min_protocol_version"),
+		MaxProtocolVersion:          viper.GetString("max_protocol_version"),
+		DisableLegacyProtocols:      viper.GetBool("disable_legacy_protocols"),
+		SessionTokenLength:          viper.GetInt("session_token_length"),
+		JwtIssuer:                   viper.GetString("jwt_issuer"),
+		JwtAudience:                 viper.GetString("jwt_audience"),
+		JwtPrivateKey:               viper.GetString("jwt_privkey"),
+		JwtPrivateKeyFile:           viper.GetString("jwt_privkey_file"),
+		JwtPublicKeyFiles:           viper.GetStringSlice("jwt_pubkey_files"),
+		AllowUnsignedCallbacks:      viper.GetBool("allow_unsigned_callbacks"),
+		CallbackHMACKey:             viper.GetString("callback_hmac_key"),
+		CallbackRetries:             viper.GetInt("callback_retries"),
+		AugmentClientReturnURL:      viper.GetBool("augment_client_return_url"),
 	}
 }
 
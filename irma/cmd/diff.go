@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff <old> <new>",
+	Short: "Show the changes between two versions of a scheme",
+	Long: `The diff command lists the issuers, credential types, attribute types and public keys that were added (+), removed (-) or changed (~) in the scheme in the <new> directory, compared to the same scheme in the <old> directory.
+
+Neither version needs to be signed, so that changes can be reviewed before signing the new version using "irma scheme sign". Changing the position of an attribute type within its credential type is reported as a change of that attribute type.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		changes, err := irma.SchemeDiff(args[0], args[1])
+		if err != nil {
+			die("Failed to compare schemes", err)
+		}
+		if changes.Empty() {
+			fmt.Println("No changes.")
+			return nil
+		}
+
+		printChanges("Issuers", changes.AddedIssuers, changes.RemovedIssuers, changes.ChangedIssuers)
+		printChanges("Credential types", changes.AddedCredentialTypes, changes.RemovedCredentialTypes, changes.ChangedCredentialTypes)
+		printChanges("Attribute types", changes.AddedAttributeTypes, changes.RemovedAttributeTypes, changes.ChangedAttributeTypes)
+		printChanges("Public keys", changes.AddedPublicKeys, changes.RemovedPublicKeys, changes.ChangedPublicKeys)
+		return nil
+	},
+}
+
+func printChanges[T fmt.Stringer](header string, added, removed, changed []T) {
+	if len(added)+len(removed)+len(changed) == 0 {
+		return
+	}
+	fmt.Println(header + ":")
+	for _, id := range added {
+		fmt.Println("  + " + id.String())
+	}
+	for _, id := range removed {
+		fmt.Println("  - " + id.String())
+	}
+	for _, id := range changed {
+		fmt.Println("  ~ " + id.String())
+	}
+}
+
+func init() {
+	schemeCmd.AddCommand(diffCmd)
+}
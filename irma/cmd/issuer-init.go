@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/spf13/cobra"
+)
+
+// issuerInitCmd represents the issuer init command
+var issuerInitCmd = &cobra.Command{
+	Use:   "init <path>",
+	Short: "Generate a skeleton for a new issuer",
+	Long: `The init command creates a new issuer in the directory at the specified path, which must be within an (issuer) scheme. The name of the directory is used as the issuer ID. The issuer directory contains:
+
+ - a description.xml with placeholders for the issuer's name and contact details in English and Dutch,
+ - a placeholder logo.png, to be replaced by the logo of the issuer,
+ - empty PublicKeys, PrivateKeys and Issues folders.
+
+Afterwards, edit the description, generate keys using "irma issuer keygen", add credential types to the Issues folder, and sign the scheme using "irma scheme sign".`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		id := filepath.Base(path)
+		schemepath := filepath.Dir(path)
+
+		bts, err := ioutil.ReadFile(filepath.Join(schemepath, "description.xml"))
+		if err != nil {
+			return errors.Errorf("%s is not within an issuer scheme: %s", path, err.Error())
+		}
+		scheme := &irma.SchemeManager{}
+		if err = common.Unmarshal("description.xml", bts, scheme); err != nil {
+			return errors.WrapPrefix(err, "failed to parse scheme description", 0)
+		}
+		if err = common.AssertPathNotExists(path); err != nil {
+			return errors.Errorf("%s already exists, not overwriting", path)
+		}
+
+		for _, dir := range []string{"PublicKeys", "PrivateKeys", "Issues"} {
+			if err = common.EnsureDirectoryExists(filepath.Join(path, dir)); err != nil {
+				return err
+			}
+		}
+		err = writeTemplate(filepath.Join(path, "description.xml"), issuerTemplate, map[string]interface{}{
+			"ID":     id,
+			"Scheme": scheme.ID,
+			"Demo":   scheme.Demo,
+		})
+		if err != nil {
+			die("Failed to write issuer description", err)
+		}
+		if err = writePlaceholderLogo(filepath.Join(path, "logo.png")); err != nil {
+			die("Failed to write issuer logo", err)
+		}
+		fmt.Println("Issuer skeleton written at", path)
+		return nil
+	},
+}
+
+var issuerTemplate = `<Issuer version="4">
+	<ID>{{xml .ID}}</ID>
+	<Name>
+		<en>{{if .Demo}}Demo {{end}}{{xml .ID}}</en>
+		<nl>{{if .Demo}}Demo {{end}}{{xml .ID}}</nl>
+	</Name>
+	<SchemeManager>{{xml .Scheme}}</SchemeManager>
+	<ContactAddress>TODO: postal address</ContactAddress>
+	<ContactEMail>TODO: email address</ContactEMail>
+	<Languages>
+		<Language>en</Language>
+		<Language>nl</Language>
+	</Languages>
+</Issuer>
+`
+
+func init() {
+	issuerCmd.AddCommand(issuerInitCmd)
+}
@@ -3,14 +3,12 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"time"
 
 	"github.com/go-errors/errors"
-	"github.com/privacybydesign/gabi/gabikeys"
-	"github.com/privacybydesign/irmago/internal/common"
+	irma "github.com/privacybydesign/irmago"
 	"github.com/spf13/cobra"
 )
 
@@ -25,6 +23,9 @@ The keygen command adds an IRMA issuer private/public keypair to the IRMA issuer
 By default the keys are stored within the PrivateKeys and PublicKeys subfolder of "path" (which are
 created if necessary), next to any existing private-public keypairs.
 
+If the issuer has a description.xml, it is first checked that the issuer belongs to the enclosing
+scheme and that the keypair supports enough attributes for all credential types of the issuer.
+
 After adding keys, the scheme must be resigned (using "irma scheme sign") before it can be used in
 IRMA applications.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -79,67 +80,27 @@ IRMA applications.`,
 				return err
 			}
 		}
-		if err = common.AssertPathExists(path); err != nil {
-			return errors.WrapPrefix(err, "Nonexisting path specified", 0)
-		}
 
-		if counter == 0 {
-			counter = uint(defaultCounter(path))
+		opts := irma.IssuerKeyPairOptions{
+			KeyLength:      keylength,
+			NumAttributes:  numAttributes,
+			ExpiryDate:     expiryDate,
+			PrivateKeyFile: privkeyfile,
+			PublicKeyFile:  pubkeyfile,
+			Overwrite:      overwrite,
+		}
+		if flags.Changed("counter") {
+			opts.Counter = &counter
 		}
 
-		// Now generate the key pair
 		fmt.Println("Generating keys (may take several minutes)")
-		sysParams, ok := gabikeys.DefaultSystemParameters[keylength]
-		if !ok {
-			return errors.Errorf("Unsupported key length, should be one of %v", gabikeys.DefaultKeyLengths)
-		}
-		privk, pubk, err := gabikeys.GenerateKeyPair(sysParams, numAttributes, counter, expiryDate)
-		if err != nil {
+		if _, _, err = irma.GenerateIssuerKeyPair(path, opts); err != nil {
 			return err
 		}
-
-		defaultFilename := strconv.Itoa(int(counter)) + ".xml"
-		if privkeyfile == "" {
-			keypath := filepath.Join(path, "PrivateKeys")
-			if err = common.EnsureDirectoryExists(keypath); err != nil {
-				return errors.WrapPrefix(err, "Failed to create"+keypath, 0)
-			}
-			privkeyfile = filepath.Join(keypath, defaultFilename)
-		}
-		if pubkeyfile == "" {
-			keypath := filepath.Join(path, "PublicKeys")
-			if err = common.EnsureDirectoryExists(keypath); err != nil {
-				return errors.WrapPrefix(err, "Failed to create"+keypath, 0)
-			}
-			pubkeyfile = filepath.Join(keypath, defaultFilename)
-		}
-
-		if _, err = privk.WriteToFile(privkeyfile, overwrite); err != nil {
-			return errors.New("private key file already exists, will not overwrite (force with -f flag)")
-		}
-		if _, err = pubk.WriteToFile(pubkeyfile, overwrite); err != nil {
-			return errors.New("public key file already exists, will not overwrite (force with -f flag)")
-		}
 		return nil
 	},
 }
 
-func defaultCounter(path string) (counter int) {
-	matches, _ := filepath.Glob(filepath.Join(path, "PublicKeys", "*.xml"))
-	for _, match := range matches {
-		filename := filepath.Base(match)
-		c, err := strconv.Atoi(filename[:len(filename)-4])
-		if err != nil {
-			fmt.Println(err.Error())
-			continue
-		}
-		if c >= counter {
-			counter = c + 1
-		}
-	}
-	return
-}
-
 func init() {
 	issuerCmd.AddCommand(issuerKeygenCmd)
 
@@ -148,7 +109,7 @@ func init() {
 	issuerKeygenCmd.Flags().StringP("expirydate", "e", "", "Expiry date for the key pair. Specify in RFC3339 (\"2006-01-02T15:04:05+07:00\") format. Alternatively, use the --valid-for option.")
 	issuerKeygenCmd.Flags().StringP("valid-for", "v", "1y", "The duration key pair should be valid starting from now. Specify as a number followed by either y, M, d, h, or m (for years, months, days, hours, and minutes, respectively). For example, use \"2y\" for a expiry date 2 years from now. This flag is ignored when expirydate flag is used.")
 	issuerKeygenCmd.Flags().IntP("keylength", "l", 2048, "Keylength")
-	issuerKeygenCmd.Flags().UintP("counter", "c", 0, "Override key counter")
+	issuerKeygenCmd.Flags().UintP("counter", "c", 0, "Override key counter (default: one more than the highest counter of existing public keys)")
 	issuerKeygenCmd.Flags().IntP("numattributes", "a", 12, "Number of attributes")
 	issuerKeygenCmd.Flags().BoolP("force-overwrite", "f", false, "Force overwriting of key files if files already exist")
 }
@@ -68,6 +68,7 @@ func init() {
 
 	headers["keyshare-attribute"] = "Keyshare server attribute issued during registration"
 	flags.String("keyshare-attribute", "", "Attribute identifier that contains username")
+	flags.String("scheme-manager", "", "Scheme manager of which this is the keyshare server, to issue the keyshare attribute declared in its description if --keyshare-attribute is not specified")
 
 	headers["email-server"] = "Email configuration (leave empty to disable sending emails)"
 	flags.String("email-server", "", "Email server to use for sending email address confirmation emails")
@@ -80,6 +81,18 @@ func init() {
 	flags.StringToString("registration-email-files", nil, "Translated emails for the registration email")
 	flags.StringToString("verification-url", nil, "Base URL for the email verification link (localized)")
 	flags.Int("email-token-validity", 168, "Validity of email token in hours")
+	flags.StringToString("recovery-email-subjects", nil, "Translated subject lines for the account recovery email")
+	flags.StringToString("recovery-email-files", nil, "Translated emails for the account recovery email (leave empty to disable account recovery)")
+	flags.Int("recovery-token-validity", 60, "Validity of account recovery token in minutes")
+
+	headers["max-pin-tries"] = "PIN attempt policy"
+	flags.Int("max-pin-tries", keyshareserver.DefaultMaxPinTries, "Number of wrong PIN attempts allowed before users are blocked")
+	flags.Int64("pin-backoff-start", keyshareserver.DefaultPinBackoffStart, "Duration in seconds of the first block, doubled after each further wrong PIN")
+	flags.Int64("max-pin-backoff", 0, "Maximum block duration in seconds (0 for unlimited)")
+	flags.Int("pin-permanent-block-after", 0, "Number of consecutive wrong PIN attempts after which users are blocked permanently (0 for never)")
+
+	headers["commitment-pool-size"] = "Keyshare sessions"
+	flags.Int("commitment-pool-size", 0, "Number of keyshare commitments to precompute per set of public keys used in sessions (0 to disable)")
 
 	headers["tls-cert"] = "TLS configuration (leave empty to disable TLS)"
 	flags.String("tls-cert", "", "TLS certificate (chain)")
@@ -93,6 +106,7 @@ func init() {
 	flags.BoolP("quiet", "q", false, "quiet")
 	flags.Bool("log-json", false, "Log in JSON format")
 	flags.Bool("production", false, "Production mode")
+	flags.Bool("metrics", false, "Serve metrics for Prometheus at /metrics (restrict access to this endpoint in your reverse proxy)")
 }
 
 func configureKeyshareServer(cmd *cobra.Command) (*keyshareserver.Configuration, error) {
@@ -117,13 +131,27 @@ func configureKeyshareServer(cmd *cobra.Command) (*keyshareserver.Configuration,
 		JwtPinExpiry:            viper.GetInt("jwt_pin_expiry"),
 		StoragePrimaryKeyFile:   viper.GetString("storage_primary_key_file"),
 		StorageFallbackKeyFiles: viper.GetStringSlice("storage_fallback_key_file"),
+		CommitmentPoolSize:      viper.GetInt("commitment_pool_size"),
 
 		KeyshareAttribute: irma.NewAttributeTypeIdentifier(viper.GetString("keyshare_attribute")),
+		SchemeManager:     irma.NewSchemeManagerIdentifier(viper.GetString("scheme_manager")),
 
 		RegistrationEmailSubjects: viper.GetStringMapString("registration_email_subjects"),
 		RegistrationEmailFiles:    viper.GetStringMapString("registration_email_files"),
 		VerificationURL:           viper.GetStringMapString("verification_url"),
 		EmailTokenValidity:        viper.GetInt("email_token_validity"),
+		RecoveryEmailSubjects:     viper.GetStringMapString("recovery_email_subjects"),
+		RecoveryEmailFiles:        viper.GetStringMapString("recovery_email_files"),
+		RecoveryTokenValidity:     viper.GetInt("recovery_token_validity"),
+
+		PinPolicy: keyshareserver.PinPolicy{
+			MaxTries:            viper.GetInt("max_pin_tries"),
+			BackoffStart:        viper.GetInt64("pin_backoff_start"),
+			MaxBackoff:          viper.GetInt64("max_pin_backoff"),
+			PermanentBlockAfter: viper.GetInt("pin_permanent_block_after"),
+		},
+
+		EnableMetrics: viper.GetBool("metrics"),
 	}
 
 	if conf.Production && conf.DBType != keyshareserver.DBTypePostgres {
@@ -1,6 +1,11 @@
 package cmd
 
 import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
 	"github.com/privacybydesign/irmago/server/keyshare/tasks"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -9,9 +14,26 @@ import (
 var keyshareTaskCmd = &cobra.Command{
 	Use:   "tasks",
 	Short: "Perform IRMA keyshare background tasks",
+	Long: `Perform IRMA keyshare background tasks. By default all tasks are performed once. If --schedule
+or --task-schedules is specified, the tasks are instead performed periodically until interrupted.`,
 	Run: func(command *cobra.Command, args []string) {
 		conf := configureKeyshareTasks(command)
-		if err := tasks.Do(conf); err != nil {
+		if conf.Schedule == "" && len(conf.TaskSchedules) == 0 {
+			if err := tasks.Do(conf); err != nil {
+				die("", err)
+			}
+			return
+		}
+
+		stop := make(chan struct{})
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupt
+			logger.Debug("Caught interrupt")
+			close(stop)
+		}()
+		if err := tasks.Run(conf, stop); err != nil {
 			die("", err)
 		}
 	},
@@ -35,6 +57,11 @@ func init() {
 	headers["expiry-delay"] = "Time period configuration"
 	flags.Int("expiry-delay", 365, "Number of days of inactivity until account expires")
 	flags.Int("delete-delay", 30, "Number of days until expired account should be deleted")
+	flags.Int("log-retention", 0, "Number of days after which log entries of users are deleted (0 to keep them indefinitely)")
+
+	headers["schedule"] = "Schedule configuration (leave empty to perform all tasks once)"
+	flags.String("schedule", "", "Cron expression (e.g. \"0 3 * * *\") according to which all tasks are performed periodically")
+	flags.StringToString("task-schedules", nil, "Cron expressions of specific tasks overriding --schedule (tasks: "+strings.Join(tasks.TaskNames, ", ")+")")
 
 	headers["email-server"] = "Email configuration (leave empty to disable sending emails)"
 	flags.String("email-server", "", "Email server to use for sending email address confirmation emails")
@@ -63,6 +90,10 @@ func configureKeyshareTasks(cmd *cobra.Command) *tasks.Configuration {
 		ExpiryDelay: viper.GetInt("expiry_delay"),
 		DeleteDelay: viper.GetInt("delete_delay"),
 
+		LogRetention:  viper.GetInt("log_retention"),
+		Schedule:      viper.GetString("schedule"),
+		TaskSchedules: viper.GetStringMapString("task_schedules"),
+
 		DeleteExpiredAccountSubjects: viper.GetStringMapString("expired_email_subjects"),
 		DeleteExpiredAccountFiles:    viper.GetStringMapString("expired_email_files"),
 
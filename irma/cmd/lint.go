@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/spf13/cobra"
+)
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint [<path>]",
+	Short: "Check the descriptions of a scheme for problems",
+	Long: `The lint command checks the descriptions of the issuer scheme at the specified path, or in the current directory if not specified, for missing translations, duplicate attribute IDs, missing logos, invalid URLs and unsupported XML versions, and prints the problems found.
+
+The scheme need not be signed, so that the command can be used while editing the scheme, e.g. in continuous integration of scheme repositories. Use "irma scheme verify" to check the signature of the scheme. The command fails if errors are found, but not if only warnings are found.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		var path string
+		if len(args) > 0 {
+			path = args[0]
+		} else {
+			path, err = os.Getwd()
+			if err != nil {
+				return err
+			}
+		}
+
+		findings, err := irma.LintScheme(path)
+		if err != nil {
+			die("Failed to lint scheme", err)
+		}
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			if findings == nil {
+				findings = []irma.LintFinding{}
+			}
+			bts, err := json.MarshalIndent(findings, "", "  ")
+			if err != nil {
+				die("Failed to encode findings", err)
+			}
+			fmt.Println(string(bts))
+		} else {
+			for _, finding := range findings {
+				fmt.Println(finding.String())
+			}
+		}
+
+		count := 0
+		for _, finding := range findings {
+			if finding.Severity == irma.LintError {
+				count++
+			}
+		}
+		if count > 0 {
+			die("Linting failed", errors.Errorf("found %d error(s)", count))
+		}
+		return nil
+	},
+}
+
+func init() {
+	schemeCmd.AddCommand(lintCmd)
+
+	lintCmd.Flags().Bool("json", false, "print findings as JSON")
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/mdp/qrterminal"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/defaultschemes"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -95,7 +96,7 @@ func configureRequest(cmd *cobra.Command) (irma.RequestorRequest, *irma.Configur
 		return nil, nil, err
 	}
 	if len(irmaconfig.SchemeManagers) == 0 {
-		if err = irmaconfig.DownloadDefaultSchemes(); err != nil {
+		if err = irmaconfig.InstallDefaultSchemes(defaultschemes.FS()); err != nil {
 			return nil, nil, err
 		}
 	}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/spf13/cobra"
+)
+
+// schemeInitCmd represents the scheme init command
+var schemeInitCmd = &cobra.Command{
+	Use:   "init <path>",
+	Short: "Generate a skeleton for a new scheme",
+	Long: `The init command creates a new scheme in the directory at the specified path, containing a description.xml with placeholders for the scheme's name and description in English and Dutch. The name of the directory is used as the scheme ID.
+
+Afterwards, edit the description, add issuers using "irma issuer init", and sign the scheme using "irma scheme sign" with a private key generated by "irma scheme keygen".`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		url, _ := flags.GetString("url")
+		demo, _ := flags.GetBool("demo")
+
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		id := filepath.Base(path)
+		if url == "" {
+			url = "https://example.com/schememanager/" + id
+		}
+		if err = common.AssertPathNotExists(filepath.Join(path, "description.xml")); err != nil {
+			return errors.Errorf("%s already contains a scheme, not overwriting", path)
+		}
+		if err = common.EnsureDirectoryExists(path); err != nil {
+			return err
+		}
+
+		err = writeTemplate(filepath.Join(path, "description.xml"), schemeTemplate, map[string]interface{}{
+			"ID":   id,
+			"URL":  url,
+			"Demo": demo,
+		})
+		if err != nil {
+			die("Failed to write scheme description", err)
+		}
+		fmt.Println("Scheme skeleton written at", path)
+		return nil
+	},
+}
+
+var schemeTemplate = `<SchemeManager version="7">
+	<Id>{{xml .ID}}</Id>
+	<Url>{{xml .URL}}</Url>
+	<Demo>{{.Demo}}</Demo>
+	<Name>
+		<en>{{if .Demo}}Demo {{end}}{{xml .ID}}</en>
+		<nl>{{if .Demo}}Demo {{end}}{{xml .ID}}</nl>
+	</Name>
+	<Description>
+		<en>TODO: English description of the scheme</en>
+		<nl>TODO: Nederlandse beschrijving van het schema</nl>
+	</Description>
+	<Languages>
+		<Language>en</Language>
+		<Language>nl</Language>
+	</Languages>
+</SchemeManager>
+`
+
+// writeTemplate writes the result of executing the specified template with the specified data
+// to the specified file. The template may use the xml function to escape text for use in XML.
+func writeTemplate(path, tmpl string, data interface{}) error {
+	t, err := template.New(filepath.Base(path)).Funcs(template.FuncMap{
+		"xml": func(s string) (string, error) {
+			var buf bytes.Buffer
+			err := xml.EscapeText(&buf, []byte(s))
+			return buf.String(), err
+		},
+	}).Parse(tmpl)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, data); err != nil {
+		return err
+	}
+	return common.SaveFile(path, buf.Bytes())
+}
+
+// writePlaceholderLogo writes a plain grey PNG image to the specified path, to be replaced by
+// the actual logo.
+func writePlaceholderLogo(path string) error {
+	const size = 256
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for i := range img.Pix {
+		img.Pix[i] = color.Gray{Y: 0xcc}.Y
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = png.Encode(f, img); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func init() {
+	schemeCmd.AddCommand(schemeInitCmd)
+
+	schemeInitCmd.Flags().String("url", "", "URL at which the scheme will be hosted (default https://example.com/schememanager/<id>)")
+	schemeInitCmd.Flags().Bool("demo", false, "Create a demo scheme, whose issuer private keys are public")
+}
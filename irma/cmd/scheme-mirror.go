@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+)
+
+// schemeMirrorCmd represents the scheme mirror command
+var schemeMirrorCmd = &cobra.Command{
+	Use:   "mirror <path> [<url>...]",
+	Short: "Serve a mirror of schemes",
+	Long: `The mirror command downloads the schemes at the specified URLs into the irma_configuration folder at path, keeps them up to date, and serves their files like the scheme servers do at /<scheme>/<file>, with their index and signature intact. If no URLs are given, the default IRMA schemes are mirrored. Schemes already present in path are not downloaded again, so that the mirror can be started without network access to the scheme servers.
+
+Point IRMA servers to the mirror using their --scheme-urls option, e.g. --scheme-urls pbdf=https://mirror.example.com/pbdf. As usual, they verify the schemes against their public keys, so the mirror need not be trusted.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		listenAddr, _ := flags.GetString("listen-addr")
+		port, _ := flags.GetInt("port")
+		interval, _ := flags.GetInt("update")
+		verbosity, _ := flags.GetCount("verbose")
+		logger = server.NewLogger(verbosity, false, false)
+		irma.SetLogger(logger)
+
+		conf, err := mirrorSchemes(args[0], args[1:])
+		if err != nil {
+			die("Failed to install schemes", err)
+		}
+		if interval > 0 {
+			if err = conf.AutoUpdateSchemes(interval); err != nil {
+				die("Failed to schedule scheme updates", err)
+			}
+		}
+
+		addr := fmt.Sprintf("%s:%d", listenAddr, port)
+		logger.Infof("Serving schemes at %s", addr)
+		die("Failed to serve schemes", http.ListenAndServe(addr, conf.SchemeMirrorHandler()))
+	},
+}
+
+// mirrorSchemes installs the schemes at the specified URLs (or the default schemes) into the
+// specified path, unless they are already present.
+func mirrorSchemes(path string, urls []string) (*irma.Configuration, error) {
+	if err := common.EnsureDirectoryExists(path); err != nil {
+		return nil, err
+	}
+	conf, err := irma.NewConfiguration(path, irma.ConfigurationOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if err = conf.ParseFolder(); err != nil {
+		return nil, err
+	}
+
+	installed := map[string]bool{}
+	for _, scheme := range conf.SchemeManagers {
+		installed[strings.TrimSuffix(scheme.URL, "/")] = true
+	}
+	for _, scheme := range conf.RequestorSchemes {
+		installed[strings.TrimSuffix(scheme.URL, "/")] = true
+	}
+
+	if len(urls) == 0 {
+		for _, scheme := range irma.DefaultSchemes {
+			if installed[scheme.URL] {
+				continue
+			}
+			if err = conf.InstallScheme(scheme.URL, scheme.Publickey); err != nil {
+				return nil, err
+			}
+		}
+		return conf, nil
+	}
+	for _, u := range urls {
+		if installed[strings.TrimSuffix(u, "/")] {
+			continue
+		}
+		if err = conf.DangerousTOFUInstallScheme(u); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
+func init() {
+	schemeCmd.AddCommand(schemeMirrorCmd)
+
+	flags := schemeMirrorCmd.Flags()
+	flags.SortFlags = false
+	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
+	flags.IntP("port", "p", 8080, "port at which to listen")
+	flags.IntP("update", "u", 10, "interval in minutes at which to update the schemes (0 to disable)")
+	flags.CountP("verbose", "v", "verbose (repeatable)")
+}
@@ -5,7 +5,9 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-errors/errors"
+	"github.com/mitchellh/mapstructure"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/requestorserver"
@@ -25,9 +27,38 @@ var serverCmd = &cobra.Command{
 		if err != nil {
 			die("", errors.WrapPrefix(err, "Failed to read configuration", 0))
 		}
-		serv, err := requestorserver.New(conf)
+		tenants, err := configureTenants(conf)
 		if err != nil {
-			die("", errors.WrapPrefix(err, "Failed to configure server", 0))
+			die("", errors.WrapPrefix(err, "Failed to read tenant configuration", 0))
+		}
+
+		var serv interface {
+			Drain()
+			Stop()
+		}
+		var start func() error
+		if len(tenants) > 0 {
+			mserv, err := requestorserver.NewMultiTenant(conf, tenants)
+			if err != nil {
+				die("", errors.WrapPrefix(err, "Failed to configure server", 0))
+			}
+			serv, start = mserv, mserv.Start
+		} else {
+			rserv, err := requestorserver.New(conf)
+			if err != nil {
+				die("", errors.WrapPrefix(err, "Failed to configure server", 0))
+			}
+			serv, start = rserv, func() error { return rserv.Start(conf) }
+		}
+
+		if viper.GetBool("watch") && viper.ConfigFileUsed() != "" {
+			viper.OnConfigChange(func(event fsnotify.Event) {
+				conf.Logger.WithField("file", event.Name).Info("Configuration file changed, reloading requestors")
+				if err := reloadServer(conf, serv); err != nil {
+					conf.Logger.WithField("error", err).Error("Failed to reload configuration, keeping current configuration")
+				}
+			})
+			viper.WatchConfig()
 		}
 
 		stopped := make(chan struct{})
@@ -35,19 +66,41 @@ var serverCmd = &cobra.Command{
 		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 		go func() {
-			if err := serv.Start(conf); err != nil {
+			if err := start(); err != nil {
 				die("", errors.WrapPrefix(err, "Failed to start server", 0))
 			}
 			conf.Logger.Debug("Server stopped")
 			stopped <- struct{}{}
 		}()
 
+		drained := make(chan struct{}, 1)
+		draining, stopping := false, false
 		for {
 			select {
 			case <-interrupt:
 				conf.Logger.Debug("Caught interrupt")
+				if stopping {
+					continue
+				}
+				if !draining && conf.DrainTimeout > 0 {
+					// Finish sessions in progress first; a second interrupt stops immediately
+					draining = true
+					conf.Logger.Info("Draining sessions before stopping, interrupt again to stop immediately")
+					go func() {
+						serv.Drain()
+						drained <- struct{}{}
+					}()
+					continue
+				}
+				stopping = true
 				serv.Stop() // causes serv.Start() above to return
 				conf.Logger.Debug("Sent stop signal to server")
+			case <-drained:
+				if !stopping {
+					stopping = true
+					serv.Stop()
+					conf.Logger.Debug("Sent stop signal to server")
+				}
 			case <-stopped:
 				conf.Logger.Info("Exiting")
 				close(stopped)
@@ -87,6 +140,10 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.StringP("schemes-path", "s", schemespath, "path to irma_configuration")
 	flags.String("schemes-assets-path", "", "if specified, copy schemes from here into --schemes-path")
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
+	flags.Bool("allow-unsigned-demo-schemes", false, "allow demo schemes without index signature (not allowed in production mode)")
+	flags.StringToString("scheme-urls", nil, "URLs from which schemes are updated instead of the URLs in their descriptions, per scheme ID (may be git+file URLs)")
+	flags.Bool("skip-invalid-descriptions", false, "skip issuers and credential types with invalid descriptions instead of disabling their scheme")
+	flags.String("schemes-overrides-path", "", "path to issuer and credential type descriptions and public keys overriding those of the schemes, for development (not allowed in production mode)")
 	flags.StringP("privkeys", "k", "", "path to IRMA private keys")
 	flags.String("static-path", "", "Host files under this path as static files (leave empty to disable)")
 	flags.String("static-prefix", "/", "Host static files under this URL prefix")
@@ -94,13 +151,25 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("revocation-db-type", "", "database type for revocation database (supported: mysql, postgres)")
 	flags.String("revocation-db-str", "", "connection string for revocation database")
 	flags.Bool("sse", false, "Enable server sent for status updates (experimental)")
+	flags.Bool("metrics", false, "Serve session metrics for Prometheus at /metrics of the requestor API")
+	flags.Bool("stats", false, "Serve aggregate statistics of the sessions handled by this server instance as JSON at /stats of the requestor API")
+	flags.String("admin-token", "", "Serve the admin API to list, inspect and expire sessions at /admin of the requestor API, authenticated using this token")
+	flags.IntSlice("stats-windows", nil, "time windows in minutes over which session statistics are computed (default 60,1440)")
+	flags.StringSlice("trusted-proxies", nil, "networks of proxies whose X-Forwarded-* headers are trusted to determine client addresses and the URL of the server")
+	flags.Bool("watch", false, "reload requestors and permissions when the configuration file changes, and schemes when they change on disk")
+	flags.Int("drain-timeout", 30, "on shutdown, wait at most this many seconds for sessions in progress to finish (0 to stop immediately)")
 
 	headers["port"] = "Server address and port to listen on"
 	flags.IntP("port", "p", 8088, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
 	flags.StringP("api-prefix", "a", "/", "prefix API endpoints with this string, e.g. POST /session becomes POST {api-prefix}/session")
+	flags.String("client-api-prefix", "", "prefix endpoints for the IRMA app and frontends with this string instead of api-prefix")
 	flags.Int("client-port", 0, "if specified, start a separate server for the IRMA app at this port")
 	flags.String("client-listen-addr", "", "address at which server for IRMA app listens")
+	flags.StringSlice("cors-allowed-origins", nil, "origins allowed to use the endpoints for the IRMA app and frontends (default all)")
+	flags.StringSlice("cors-allowed-methods", nil, "CORS allowed methods of the endpoints for the IRMA app and frontends (default GET, POST and DELETE)")
+	flags.StringSlice("cors-allowed-headers", nil, "CORS allowed headers of the endpoints for the IRMA app and frontends")
+	flags.String("tenants", "", "configuration of tenants to host at their own api_prefix (in JSON)")
 
 	headers["no-auth"] = "Requestor authentication and default requestor permissions"
 	flags.Bool("no-auth", !production, "whether or not to authenticate requestors (and reject all authenticated requests)")
@@ -116,12 +185,20 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.Bool("skip-private-keys-check", false, "whether or not to skip checking whether the private keys that requestors have permission for using are present in the configuration")
 	flags.String("static-sessions", "", "preconfigured static sessions (in JSON)")
 	flags.Int("max-session-lifetime", 15, "maximum duration of a session once a client connects in minutes")
+	flags.Int("max-requested-session-lifetime", 0, "maximum session lifetime in minutes that requestors may request (default max-session-lifetime)")
 	flags.Int("session-result-lifetime", 5, "determines how long a session result is preserved in minutes")
+	flags.Int("session-token-length", 20, "length of the randomly generated session tokens")
+	flags.Int("expiry-ticker", 10, "interval in seconds at which expired sessions are cleaned up")
+	flags.Int64("max-request-size", 10<<20, "maximum size in bytes of request bodies")
+	flags.String("min-protocol-version", "", "minimum IRMA protocol version accepted from IRMA apps (default minimum supported version)")
+	flags.String("max-protocol-version", "", "maximum IRMA protocol version accepted from IRMA apps (default maximum supported version)")
+	flags.Bool("disable-legacy-protocols", false, "reject IRMA apps speaking protocol versions below 2.4")
+	flags.Bool("strict-decoding", false, "reject requests containing JSON fields unknown to the server, or legacy session requests")
 
 	flags.String("revocation-settings", "", "revocation settings (in JSON)")
 
 	headers["store-type"] = "Session store configuration"
-	flags.String("store-type", "", "specifies how session state will be saved on the server (default \"memory\")")
+	flags.String("store-type", "", "specifies how session state will be saved on the server: memory, redis or postgres (default \"memory\")")
 	flags.String("redis-addr", "", "Redis address, to be specified as host:port")
 	flags.String("redis-pw", "", "Redis server password")
 	flags.Bool("redis-allow-empty-password", false, "explicitly allow an empty string as Redis password")
@@ -129,13 +206,24 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("redis-tls-cert", "", "use Redis TLS with specific certificate or certificate authority")
 	flags.String("redis-tls-cert-file", "", "use Redis TLS path to specific certificate or certificate authority")
 	flags.Bool("redis-no-tls", false, "disable Redis TLS (by default, Redis TLS is enabled with the system certificate pool)")
+	flags.String("postgres-str", "", "PostgreSQL connection string")
+	flags.Int("postgres-max-idle", 2, "maximum number of PostgreSQL connections in the idle connection pool")
+	flags.Int("postgres-max-open", 0, "maximum number of open PostgreSQL connections (default unlimited)")
+	flags.String("session-encryption-key", "", "base64-encoded AES key with which sessions are encrypted in the Redis or PostgreSQL store")
+	flags.String("session-encryption-key-file", "", "path to file containing base64-encoded AES key with which sessions are encrypted in the Redis or PostgreSQL store")
+	flags.StringSlice("session-decryption-keys", nil, "comma-separated list of base64-encoded previous session encryption keys, with which sessions encrypted before rotating the key are decrypted")
+	flags.Bool("optimistic-locking", false, "do not lock sessions in the Redis or PostgreSQL store, but reject concurrent changes (for multiple servers without sticky sessions)")
 
 	headers["jwt-issuer"] = "JWT configuration"
 	flags.StringP("jwt-issuer", "j", "irmaserver", "JWT issuer")
-	flags.String("jwt-privkey", "", "JWT private key")
-	flags.String("jwt-privkey-file", "", "path to JWT private key")
+	flags.String("jwt-audience", "", "JWT audience of session result JWTs")
+	flags.String("jwt-privkey", "", "JWT private key (RSA, ECDSA P-256 or Ed25519)")
+	flags.String("jwt-privkey-file", "", "path to JWT private key (RSA, ECDSA P-256 or Ed25519)")
+	flags.StringSlice("jwt-pubkey-files", nil, "paths to additional JWT public keys to publish at /.well-known/jwks.json, e.g. when rotating the JWT private key")
 	flags.Int("max-request-age", 300, "max age in seconds of a session request JWT")
 	flags.Bool("allow-unsigned-callbacks", false, "Allow callbackUrl in session requests when no JWT privatekey is installed (potentially unsafe)")
+	flags.String("callback-hmac-key", "", "key with which result callbacks are signed using HMAC-SHA256 in the X-IRMA-Signature header")
+	flags.Int("callback-retries", 3, "number of times a failed result callback is retried")
 	flags.Bool("augment-client-return-url", false, "Augment the client return url with the server session token if present")
 
 	headers["tls-cert"] = "TLS configuration (leave empty to disable TLS)"
@@ -143,20 +231,34 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("tls-cert-file", "", "path to TLS certificate (chain)")
 	flags.String("tls-privkey", "", "TLS private key")
 	flags.String("tls-privkey-file", "", "path to TLS private key")
+	flags.String("tls-client-ca", "", "CA certificate(s) for verifying client certificates of requestors")
+	flags.String("tls-client-ca-file", "", "path to CA certificate(s) for verifying client certificates of requestors")
 	flags.String("client-tls-cert", "", "TLS certificate (chain) for IRMA app server")
 	flags.String("client-tls-cert-file", "", "path to TLS certificate (chain) for IRMA app server")
 	flags.String("client-tls-privkey", "", "TLS private key for IRMA app server")
 	flags.String("client-tls-privkey-file", "", "path to TLS private key for IRMA app server")
+	flags.StringSlice("acme-hosts", nil, "hostnames for which to obtain TLS certificates automatically using ACME (e.g. Let's Encrypt), instead of using --tls-cert")
+	flags.String("acme-cache-dir", "", "directory in which to store the ACME account key and the obtained certificates")
+	flags.Int("acme-http-port", 0, "port at which to answer ACME HTTP-01 challenges (must be reachable at port 80; default only TLS-ALPN-01)")
+	flags.String("acme-directory-url", "", "directory URL of the ACME certificate authority (default Let's Encrypt)")
 	flags.Bool("no-tls", false, "disable TLS")
 
 	headers["email"] = "Email address (see README for more info)"
 	flags.StringP("email", "e", "", "Email address of server admin, for incidental notifications such as breaking API changes")
 	flags.Bool("no-email", !production, "Opt out of providing an email address with --email")
+	flags.String("notification-email-server", "", "SMTP server (host:port) for emailing session outcomes to the notifyEmail address of session requests (leave empty to disable)")
+	flags.String("notification-email-hostname", "", "Hostname used in the TLS certificate of the notification email server")
+	flags.String("notification-email-username", "", "Username to use when authenticating with the notification email server")
+	flags.String("notification-email-password", "", "Password to use when authenticating with the notification email server")
+	flags.String("notification-email-from", "", "Email address to use as sender address of session notifications")
+	flags.Bool("notify-attribute-values", false, "include disclosed attribute values in session notifications (by default they are omitted)")
 
 	headers["verbose"] = "Other options"
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 	flags.BoolP("quiet", "q", false, "quiet")
 	flags.Bool("log-json", false, "Log in JSON format")
+	flags.String("audit-log", "", "append audit events about sessions as JSON lines to this file (- for stdout)")
+	flags.Bool("audit-log-attribute-values", false, "include attribute values in audit events (by default they are redacted)")
 	flags.Bool("production", false, "Production mode")
 
 	return nil
@@ -177,33 +279,40 @@ func configureServer(cmd *cobra.Command) (*requestorserver.Configuration, error)
 
 	// Read configuration from flags and/or environmental variables
 	conf := &requestorserver.Configuration{
-		Configuration: configureIRMAServer(),
-		Permissions: requestorserver.Permissions{
-			Disclosing: handlePermission("disclose_perms"),
-			Signing:    handlePermission("sign_perms"),
-			Issuing:    handlePermission("issue_perms"),
-			Revoking:   handlePermission("revoke_perms"),
-		},
+		Configuration:                  configureIRMAServer(),
 		SkipPrivateKeysCheck:           viper.GetBool("skip_private_keys_check"),
 		ListenAddress:                  viper.GetString("listen_addr"),
 		Port:                           viper.GetInt("port"),
 		ApiPrefix:                      viper.GetString("api_prefix"),
+		ClientApiPrefix:                viper.GetString("client_api_prefix"),
 		ClientListenAddress:            viper.GetString("client_listen_addr"),
 		ClientPort:                     viper.GetInt("client_port"),
 		DisableRequestorAuthentication: viper.GetBool("no_auth"),
-		Requestors:                     make(map[string]requestorserver.Requestor),
 		MaxRequestAge:                  viper.GetInt("max_request_age"),
 		StaticPath:                     viper.GetString("static_path"),
 		StaticPrefix:                   viper.GetString("static_prefix"),
+		EnableMetrics:                  viper.GetBool("metrics"),
+		EnableStats:                    viper.GetBool("stats"),
+		AdminToken:                     viper.GetString("admin_token"),
+		DrainTimeout:                   viper.GetInt("drain_timeout"),
+		CORSAllowedOrigins:             viper.GetStringSlice("cors_allowed_origins"),
+		CORSAllowedMethods:             viper.GetStringSlice("cors_allowed_methods"),
+		CORSAllowedHeaders:             viper.GetStringSlice("cors_allowed_headers"),
 
 		TlsCertificate:           viper.GetString("tls_cert"),
 		TlsCertificateFile:       viper.GetString("tls_cert_file"),
 		TlsPrivateKey:            viper.GetString("tls_privkey"),
 		TlsPrivateKeyFile:        viper.GetString("tls_privkey_file"),
+		TlsClientCA:              viper.GetString("tls_client_ca"),
+		TlsClientCAFile:          viper.GetString("tls_client_ca_file"),
 		ClientTlsCertificate:     viper.GetString("client_tls_cert"),
 		ClientTlsCertificateFile: viper.GetString("client_tls_cert_file"),
 		ClientTlsPrivateKey:      viper.GetString("client_tls_privkey"),
 		ClientTlsPrivateKeyFile:  viper.GetString("client_tls_privkey_file"),
+		AcmeHosts:                viper.GetStringSlice("acme_hosts"),
+		AcmeCacheDir:             viper.GetString("acme_cache_dir"),
+		AcmeHTTPPort:             viper.GetInt("acme_http_port"),
+		AcmeDirectoryURL:         viper.GetString("acme_directory_url"),
 	}
 
 	if conf.Production {
@@ -217,7 +326,7 @@ func configureServer(cmd *cobra.Command) (*requestorserver.Configuration, error)
 
 	// Handle requestors
 	var err error
-	if err = handleMapOrString("requestors", &conf.Requestors); err != nil {
+	if err = configureRequestors(conf); err != nil {
 		return nil, err
 	}
 	if err = handleMapOrString("static_sessions", &conf.StaticSessions); err != nil {
@@ -249,7 +358,81 @@ func configureServer(cmd *cobra.Command) (*requestorserver.Configuration, error)
 		conf.RedisSettings.DisableTLS = viper.GetBool("redis_no_tls")
 	}
 
+	// Parse PostgreSQL store configuration
+	if conf.StoreType == "postgres" {
+		conf.PostgresSettings = &server.PostgresSettings{
+			ConnStr:      viper.GetString("postgres_str"),
+			MaxIdleConns: viper.GetInt("postgres_max_idle"),
+			MaxOpenConns: viper.GetInt("postgres_max_open"),
+		}
+		if conf.PostgresSettings.ConnStr == "" {
+			return nil, errors.New("When PostgreSQL is used as session data store, a connection string must be specified with the --postgres-str flag.")
+		}
+	}
+
 	logger.Debug("Done configuring")
 
 	return conf, nil
 }
+
+// configureRequestors reads the requestors, the global permissions and the trusted proxies into
+// the configuration. These options are reloaded when the configuration file changes.
+func configureRequestors(conf *requestorserver.Configuration) error {
+	conf.Permissions = requestorserver.Permissions{
+		Disclosing: handlePermission("disclose_perms"),
+		Signing:    handlePermission("sign_perms"),
+		Issuing:    handlePermission("issue_perms"),
+		Revoking:   handlePermission("revoke_perms"),
+	}
+	conf.TrustedProxies = viper.GetStringSlice("trusted_proxies")
+	conf.Requestors = make(map[string]requestorserver.Requestor)
+	return handleMapOrString("requestors", &conf.Requestors)
+}
+
+// reloadServer reloads the requestor configuration of the server, and of its tenants if any,
+// from the configuration file after it changed.
+func reloadServer(conf *requestorserver.Configuration, serv interface{}) error {
+	newconf := *conf
+	if err := configureRequestors(&newconf); err != nil {
+		return err
+	}
+	switch serv := serv.(type) {
+	case *requestorserver.MultiTenantServer:
+		tenants, err := configureTenants(&newconf)
+		if err != nil {
+			return err
+		}
+		return serv.Reload(tenants)
+	case *requestorserver.Server:
+		return serv.Reload(&newconf)
+	default:
+		return errors.Errorf("cannot reload %T", serv)
+	}
+}
+
+// configureTenants returns the tenants configured in the tenants option, if any. The configuration
+// of each tenant starts out as a copy of the main configuration without its requestors and static
+// sessions, to which the options of the tenant are applied.
+func configureTenants(conf *requestorserver.Configuration) (map[string]*requestorserver.Configuration, error) {
+	var m map[string]interface{}
+	if err := handleMapOrString("tenants", &m); err != nil {
+		return nil, err
+	}
+
+	tenants := make(map[string]*requestorserver.Configuration, len(m))
+	for name, options := range m {
+		tconf, sconf := *conf, *conf.Configuration
+		tconf.Configuration = &sconf
+		tconf.Requestors = map[string]requestorserver.Requestor{}
+		sconf.StaticSessions = nil
+		sconf.RevocationSettings = irma.RevocationSettings{}
+		for id, settings := range conf.RevocationSettings {
+			sconf.RevocationSettings[id] = settings
+		}
+		if err := mapstructure.Decode(options, &tconf); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to unmarshal configuration of tenant "+name, 0)
+		}
+		tenants[name] = &tconf
+	}
+	return tenants, nil
+}
@@ -76,10 +76,10 @@ func VerifyScheme(path string, verbose bool) error {
 	}
 
 	if _, err = conf.ParseSchemeFolder(path); err != nil {
-		return err
+		return diagnoseSchemes(conf, err, path)
 	}
 	if err := conf.ValidateKeys(); err != nil {
-		return err
+		return diagnoseSchemes(conf, err, path)
 	}
 
 	for _, warning := range conf.Warnings {
@@ -95,10 +95,10 @@ func VerifyIrmaConfiguration(path string, verbose bool) error {
 		return err
 	}
 	if err := conf.ParseFolder(); err != nil {
-		return err
+		return diagnoseSchemes(conf, err, schemeDirs(path)...)
 	}
 	if err := conf.ValidateKeys(); err != nil {
-		return err
+		return diagnoseSchemes(conf, err, schemeDirs(path)...)
 	}
 	if len(conf.SchemeManagers) == 0 {
 		return errors.New("Specified folder doesn't contain any schemes")
@@ -111,6 +111,33 @@ func VerifyIrmaConfiguration(path string, verbose bool) error {
 	return nil
 }
 
+// diagnoseSchemes prints all problems found in the specified scheme directories, to help fixing
+// them all at once instead of one at a time. If no problems are found, err is returned.
+func diagnoseSchemes(conf *irma.Configuration, err error, dirs ...string) error {
+	count := 0
+	for _, dir := range dirs {
+		for _, problem := range conf.DiagnoseScheme(dir) {
+			fmt.Printf("Error in scheme %s: %s\n", filepath.Base(dir), problem.Error())
+			count++
+		}
+	}
+	if count == 0 {
+		return err
+	}
+	return errors.Errorf("found %d problem(s), see above", count)
+}
+
+func schemeDirs(path string) []string {
+	var dirs []string
+	_ = common.IterateSubfolders(path, func(dir string, _ os.FileInfo) error {
+		if ok, _ := common.IsScheme(dir, false); ok {
+			dirs = append(dirs, dir)
+		}
+		return nil
+	})
+	return dirs
+}
+
 func init() {
 	schemeCmd.AddCommand(verifyCmd)
 }
@@ -0,0 +1,338 @@
+package irmaclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+	"golang.org/x/crypto/argon2"
+)
+
+// This file contains the export of all user data of a Client into a single blob encrypted with
+// a passphrase, suitable for storing in a (cloud) backup, and the restoring of such backups.
+
+const backupVersion = 1
+
+const backupSaltLength = 16
+
+// encryptedBackup is the (JSON-encoded) format of the blobs returned by ExportBackup.
+// The key derivation parameters are included so that they may be changed in the future.
+type encryptedBackup struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	Threads    uint8  `json:"threads"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// clientBackup contains all user data of a Client.
+type clientBackup struct {
+	SecretKey       *secretKey                                       `json:"sk"`
+	Credentials     []*backupCredential                              `json:"credentials"`
+	KeyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer `json:"keyshareServers"`
+	Logs            []*LogEntry                                      `json:"logs"`
+	Preferences     Preferences                                      `json:"preferences"`
+}
+
+type backupCredential struct {
+	Attributes *irma.AttributeList `json:"attributes"`
+	Signature  *clSignatureWitness `json:"signature"`
+}
+
+// ExportBackup returns all credentials, the secret key, keyshare server enrollments, logs and
+// preferences of the client, encrypted with a key derived from the passphrase (using Argon2id
+// and AES-GCM). Note that keyshare enrollments using a challenge-response key still depend on
+// the key of the Signer of this device.
+func (client *Client) ExportBackup(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("backup passphrase must not be empty")
+	}
+
+	client.credMutex.Lock()
+	backup := &clientBackup{
+		SecretKey:       client.secretkey,
+		KeyshareServers: client.keyshareServers,
+		Preferences:     client.Preferences,
+	}
+	for _, attrlistlist := range client.attributes {
+		for _, attrs := range attrlistlist {
+			sig := new(clSignatureWitness)
+			found, err := client.storage.load(signaturesBucket, attrs.Hash(), sig)
+			if err != nil {
+				client.credMutex.Unlock()
+				return nil, err
+			}
+			if !found {
+				client.credMutex.Unlock()
+				return nil, errors.Errorf("Signature of credential with hash %s cannot be found", attrs.Hash())
+			}
+			backup.Credentials = append(backup.Credentials, &backupCredential{Attributes: attrs, Signature: sig})
+		}
+	}
+	client.credMutex.Unlock()
+
+	err := client.storage.IterateLogs(func(log *LogEntry) error {
+		backup.Logs = append(backup.Logs, log)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := json.Marshal(backup)
+	if err != nil {
+		return nil, err
+	}
+	return encryptBackup(plaintext, passphrase)
+}
+
+// BackupRestoreResult reports what RestoreBackup changed in the client.
+type BackupRestoreResult struct {
+	// Credentials from the backup that were added to the client
+	Restored []*irma.CredentialInfo
+	// Singleton credentials that were present in the client and replaced by those from the backup
+	Replaced []*irma.CredentialInfo
+	// Credentials from the backup that the client already had
+	Skipped []*irma.CredentialInfo
+	// Keyshare server enrollments that were restored
+	KeyshareServers []irma.SchemeManagerIdentifier
+	// Restored keyshare enrollments that could not be verified using the PIN, for example because
+	// they are bound to the key of another device; these need to be recovered or removed.
+	KeyshareErrors map[irma.SchemeManagerIdentifier]error
+	// Number of log entries that were restored
+	Logs int
+}
+
+// RestoreBackup decrypts a backup created by ExportBackup and merges it into the client: singleton
+// credentials replace existing instances, other credentials are added alongside existing instances,
+// and keyshare enrollments and logs are added if not already present. The preferences of the client
+// are left as they are. The schemes of all credentials in the backup must be installed, and if the
+// client already contains credentials, the backup must have been made from the same secret key.
+// The restored keyshare enrollments are verified afterwards using the PIN, unless it is empty.
+func (client *Client) RestoreBackup(bts []byte, passphrase string, pin string) (*BackupRestoreResult, error) {
+	plaintext, err := decryptBackup(bts, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	backup := &clientBackup{}
+	if err = json.Unmarshal(plaintext, backup); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid backup", 0)
+	}
+	if backup.SecretKey == nil || backup.SecretKey.Key == nil {
+		return nil, errors.New("invalid backup: no secret key")
+	}
+
+	result, err := client.restoreBackup(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, schemeID := range result.KeyshareServers {
+		if pin == "" {
+			break
+		}
+		success, tries, blocked, err := client.KeyshareVerifyPin(pin, schemeID)
+		switch {
+		case err != nil:
+			result.KeyshareErrors[schemeID] = err
+		case blocked != 0:
+			result.KeyshareErrors[schemeID] = errors.Errorf("PIN blocked for %d seconds", blocked)
+		case !success:
+			result.KeyshareErrors[schemeID] = errors.Errorf("incorrect PIN, %d attempts left", tries)
+		}
+	}
+
+	client.handler.UpdateAttributes()
+	return result, nil
+}
+
+func (client *Client) restoreBackup(backup *clientBackup) (*BackupRestoreResult, error) {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+
+	// Check compatibility with the schemes and contents of this client before changing anything
+	creds := make([]*credential, 0, len(backup.Credentials))
+	for _, c := range backup.Credentials {
+		if c.Attributes == nil || len(c.Attributes.Ints) == 0 || c.Signature == nil || c.Signature.CLSignature == nil {
+			return nil, errors.New("invalid backup: incomplete credential")
+		}
+		attrs := irma.NewAttributeListFromInts(c.Attributes.Ints, client.Configuration)
+		if attrs.CredentialType() == nil {
+			return nil, errors.New("backup contains a credential of unknown type; install its scheme first")
+		}
+		pk, err := attrs.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if pk == nil {
+			return nil, errors.Errorf("unknown public key of credential type %s", attrs.CredentialType().Identifier())
+		}
+		ints := append([]*big.Int{backup.SecretKey.Key}, attrs.Ints...)
+		if !c.Signature.CLSignature.Verify(pk, ints) {
+			return nil, errors.Errorf("invalid backup: invalid signature on credential of type %s", attrs.CredentialType().Identifier())
+		}
+		cred, err := newCredential(&gabi.Credential{
+			Attributes:           ints,
+			Signature:            c.Signature.CLSignature,
+			NonRevocationWitness: c.Signature.Witness,
+			Pk:                   pk,
+		}, attrs, client.Configuration)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+	for schemeID, kss := range backup.KeyshareServers {
+		scheme := client.Configuration.GetSchemeManagers()[schemeID]
+		if scheme == nil || !scheme.Distributed() {
+			return nil, errors.Errorf("backup contains keyshare enrollment of unknown scheme %s", schemeID)
+		}
+		if existing := client.keyshareServers[schemeID]; existing != nil && existing.Username != kss.Username {
+			return nil, errors.Errorf("client is already enrolled at the keyshare server of scheme %s with another account", schemeID)
+		}
+	}
+	sameKey := client.secretkey.Key.Cmp(backup.SecretKey.Key) == 0
+	if !sameKey && len(client.CredentialInfoList()) > 0 {
+		return nil, errors.New("backup is made from another secret key than the credentials of this client")
+	}
+
+	result := &BackupRestoreResult{KeyshareErrors: map[irma.SchemeManagerIdentifier]error{}}
+
+	if !sameKey {
+		if err := client.storage.StoreSecretKey(backup.SecretKey); err != nil {
+			return nil, err
+		}
+		client.secretkey = backup.SecretKey
+	}
+
+	for schemeID, kss := range backup.KeyshareServers {
+		if client.keyshareServers[schemeID] != nil {
+			continue
+		}
+		client.keyshareServers[schemeID] = kss
+		result.KeyshareServers = append(result.KeyshareServers, schemeID)
+	}
+	if len(result.KeyshareServers) > 0 {
+		if err := client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, cred := range creds {
+		if attrs, _ := client.attributesByHash(cred.attrs.Hash()); attrs != nil {
+			result.Skipped = append(result.Skipped, cred.attrs.Info())
+			continue
+		}
+		id := cred.CredentialType().Identifier()
+		if cred.CredentialType().IsSingleton {
+			for _, attrs := range client.attrs(id) {
+				result.Replaced = append(result.Replaced, attrs.Info())
+			}
+		}
+		if err := client.addCredential(cred); err != nil {
+			return nil, err
+		}
+		result.Restored = append(result.Restored, cred.attrs.Info())
+	}
+
+	// Add the log entries that are not yet present, oldest first (the backup lists them newest first)
+	type logKey struct {
+		time int64
+		typ  irma.Action
+	}
+	present := map[logKey]struct{}{}
+	err := client.storage.IterateLogs(func(log *LogEntry) error {
+		present[logKey{time.Time(log.Time).Unix(), log.Type}] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = client.storage.Transaction(func(tx *transaction) error {
+		for i := len(backup.Logs) - 1; i >= 0; i-- {
+			log := backup.Logs[i]
+			if _, ok := present[logKey{time.Time(log.Time).Unix(), log.Type}]; ok {
+				continue
+			}
+			if err := client.storage.TxAddLogEntry(tx, log); err != nil {
+				return err
+			}
+			result.Logs++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func encryptBackup(plaintext []byte, passphrase string) ([]byte, error) {
+	blob := &encryptedBackup{
+		Version: backupVersion,
+		Salt:    make([]byte, backupSaltLength),
+		Time:    argon2Time,
+		Memory:  argon2Memory,
+		Threads: argon2Threads,
+	}
+	if _, err := rand.Read(blob.Salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := blob.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	blob.Nonce = make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(blob.Nonce); err != nil {
+		return nil, err
+	}
+	blob.Ciphertext = gcm.Seal(nil, blob.Nonce, plaintext, nil)
+
+	return json.Marshal(blob)
+}
+
+func decryptBackup(bts []byte, passphrase string) ([]byte, error) {
+	blob := &encryptedBackup{}
+	if err := json.Unmarshal(bts, blob); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid backup", 0)
+	}
+	if blob.Version != backupVersion {
+		return nil, errors.Errorf("unsupported backup version %d", blob.Version)
+	}
+	// Don't let a manipulated backup make us spend arbitrary amounts of time or memory
+	if blob.Time == 0 || blob.Time > 4*argon2Time || blob.Threads == 0 || blob.Memory > 4*argon2Memory {
+		return nil, errors.New("invalid backup: unsupported key derivation parameters")
+	}
+
+	gcm, err := blob.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid backup: wrong nonce size")
+	}
+	plaintext, err := gcm.Open(nil, blob.Nonce, blob.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt backup: wrong passphrase or corrupted backup")
+	}
+	return plaintext, nil
+}
+
+func (blob *encryptedBackup) cipher(passphrase string) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), blob.Salt, blob.Time, blob.Memory, blob.Threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
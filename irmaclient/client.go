@@ -1,8 +1,15 @@
 package irmaclient
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -72,12 +79,17 @@ type Client struct {
 	jobsPause  chan struct{} // sending pauses background jobs
 	jobsPaused bool
 
+	expiryJob     *gocron.Job // see SetCredentialExpiryHandler
+	schemeUpdater schemeUpdater
+
 	credMutex sync.Mutex
 }
 
 // TODO: consider if we should save irmamobile preferences here, because they would automatically
 // be part of any backup and syncing solution we implement at a later time
 type Preferences struct {
+	// DeveloperMode allows sessions with servers not using HTTPS, servers running in development
+	// mode, and sessions involving demo schemes. Apps should not make it easily accessible.
 	DeveloperMode bool
 }
 
@@ -193,17 +205,20 @@ func New(
 
 	// Perform new update functions from clientUpdates, if any
 	if err = client.update(); err != nil {
+		_ = client.storage.Close() // e.g. when using the wrong key, allow retrying
 		return nil, err
 	}
 
 	// Load our stuff
 	if client.Preferences, err = client.storage.LoadPreferences(); err != nil {
+		_ = client.storage.Close()
 		return nil, err
 	}
 	client.applyPreferences()
 
 	err = client.loadCredentialStorage()
 	if err != nil {
+		_ = client.storage.Close()
 		return nil, err
 	}
 
@@ -222,6 +237,7 @@ func New(
 
 	client.jobs = make(chan func(), 100)
 	client.initRevocation()
+	client.initPendingResponses()
 	client.StartJobs()
 
 	return client, schemeMgrErr
@@ -321,6 +337,47 @@ func (client *Client) CredentialInfoList() irma.CredentialInfoList {
 	return list
 }
 
+// ExpiringCredentials returns the credentials that have not expired yet but will do so within the
+// specified duration, sorted by their expiry date.
+func (client *Client) ExpiringCredentials(within time.Duration) irma.CredentialInfoList {
+	now := time.Now()
+	list := irma.CredentialInfoList{}
+	for _, info := range client.CredentialInfoList() {
+		expires := time.Time(info.Expires)
+		if expires.After(now) && expires.Before(now.Add(within)) {
+			list = append(list, info)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return time.Time(list[i].Expires).Before(time.Time(list[j].Expires))
+	})
+	return list
+}
+
+// SetCredentialExpiryHandler registers a handler that is called for each credential that will
+// expire within the specified duration, for example to schedule a local notification. The
+// credentials are checked immediately and then once a day, so the handler may be called multiple
+// times for the same credential. Passing a nil handler removes the current handler.
+func (client *Client) SetCredentialExpiryHandler(within time.Duration, handler func(cred *irma.CredentialInfo)) error {
+	if client.expiryJob != nil {
+		client.Configuration.Scheduler.RemoveByReference(client.expiryJob)
+		client.expiryJob = nil
+	}
+	if handler == nil {
+		return nil
+	}
+
+	var err error
+	client.expiryJob, err = client.Configuration.Scheduler.Every(1).Day().StartImmediately().Do(func() {
+		client.jobs <- func() {
+			for _, cred := range client.ExpiringCredentials(within) {
+				handler(cred)
+			}
+		}
+	})
+	return err
+}
+
 // addCredential adds the specified credential to the Client, saving its signature
 // immediately, and optionally cm.attributes as well.
 func (client *Client) addCredential(cred *credential) (err error) {
@@ -437,10 +494,14 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storeL
 
 // RemoveCredential removes the specified credential if that is allowed.
 func (client *Client) RemoveCredential(id irma.CredentialTypeIdentifier, index int) error {
-	if client.Configuration.CredentialTypes[id].DisallowDelete {
+	if client.Configuration.GetCredentialTypes()[id].DisallowDelete {
 		return errors.Errorf("configuration does not allow removal of credential type %s", id.String())
 	}
-	return client.remove(id, index, true)
+	if err := client.remove(id, index, true); err != nil {
+		return err
+	}
+	client.handler.UpdateAttributes()
+	return nil
 }
 
 // RemoveCredentialByHash removes the specified credential.
@@ -494,11 +555,22 @@ func (client *Client) RemoveStorage() error {
 	}
 	client.applyPreferences()
 
+	client.handler.UpdateAttributes()
 	return nil
 }
 
 // Attribute and credential getter methods
 
+// CredentialInfo returns information about the credential with the specified hash,
+// or nil if the client does not have it.
+func (client *Client) CredentialInfo(hash string) *irma.CredentialInfo {
+	attrs, _ := client.attributesByHash(hash)
+	if attrs == nil {
+		return nil
+	}
+	return attrs.Info()
+}
+
 // attrs returns cm.attributes[id], initializing it to an empty slice if necessary
 func (client *Client) attrs(id irma.CredentialTypeIdentifier) []*irma.AttributeList {
 	list, exists := client.attributes[id]
@@ -642,15 +714,18 @@ func (client *Client) addCredSuggestion(
 	request irma.SessionRequest, credTypeID irma.CredentialTypeIdentifier,
 	fixedAttrValue, haveCandidates bool,
 ) bool {
-	credType := client.Configuration.CredentialTypes[credTypeID]
+	credType := client.Configuration.GetCredentialTypes()[credTypeID]
 	credDeprecatedSince := credType.DeprecatedSince
-	issuerDeprecatedSince := client.Configuration.Issuers[credType.IssuerIdentifier()].DeprecatedSince
+	issuerDeprecatedSince := client.Configuration.GetIssuers()[credType.IssuerIdentifier()].DeprecatedSince
 	now := irma.Timestamp(time.Now())
 
 	if (!credDeprecatedSince.IsZero() && credDeprecatedSince.Before(now)) ||
 		(!issuerDeprecatedSince.IsZero() && issuerDeprecatedSince.Before(now)) {
 		return false
 	}
+	if scheme := client.Configuration.GetSchemeManagers()[credTypeID.SchemeManagerIdentifier()]; scheme != nil && scheme.Deprecated(time.Now()) {
+		return false
+	}
 
 	// Show option to add extra cards of non-singleton
 	if (credType.IssueURL != nil && len(*credType.IssueURL) != 0) && !credType.IsSingleton && !fixedAttrValue {
@@ -696,10 +771,17 @@ func (client *Client) satisfiesCon(base *irma.BaseRequest, attrs *irma.Attribute
 		return false, false
 	}
 	cred, _, _ := client.credentialByHash(attrs.Hash())
-	usable := !attrs.Revoked && attrs.IsValid() && (!base.RequestsRevocation(credtype) || cred.NonRevocationWitness != nil)
+	usable := !attrs.Revoked && attrs.IsValid() && !client.schemeExpired(credtype) &&
+		(!base.RequestsRevocation(credtype) || cred.NonRevocationWitness != nil)
 	return true, usable
 }
 
+// schemeExpired returns whether the scheme of the credential type no longer accepts its credentials.
+func (client *Client) schemeExpired(credtype irma.CredentialTypeIdentifier) bool {
+	scheme := client.Configuration.GetSchemeManagers()[credtype.SchemeManagerIdentifier()]
+	return scheme != nil && scheme.Expired(time.Now())
+}
+
 func (set credCandidateSet) multiply(candidates []*credCandidate) credCandidateSet {
 	result := make(credCandidateSet, 0, len(set)*len(candidates))
 	for _, cred := range candidates {
@@ -733,7 +815,7 @@ func (set credCandidateSet) expand(client *Client, base *irma.BaseRequest, con i
 					if err != nil {
 						return nil, err
 					}
-					attropt.Expired = !attrlist.IsValid()
+					attropt.Expired = !attrlist.IsValid() || client.schemeExpired(credopt.Type)
 					attropt.Revoked = attrlist.Revoked
 					attropt.NotRevokable = cred.NonRevocationWitness == nil && base.RequestsRevocation(credopt.Type)
 				}
@@ -868,7 +950,7 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 				continue // In this case we only disclose the metadata attribute, which is already handled above
 			}
 
-			attrIndex, err := client.Configuration.CredentialTypes[identifier.CredentialTypeIdentifier()].IndexOf(identifier)
+			attrIndex, err := client.Configuration.GetCredentialTypes()[identifier.CredentialTypeIdentifier()].IndexOf(identifier)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -967,7 +1049,7 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest, choic
 		if err != nil {
 			return nil, nil, nil, err
 		}
-		credtype := client.Configuration.CredentialTypes[futurecred.CredentialTypeID]
+		credtype := client.Configuration.GetCredentialTypes()[futurecred.CredentialTypeID]
 		credBuilder, err := gabi.NewCredentialBuilder(pk, request.GetContext(),
 			client.secretkey.Key, issuerProofNonce, credtype.RandomBlindAttributeIndices())
 		if err != nil {
@@ -1070,14 +1152,34 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 
 func (client *Client) genSchemeManagersList(enrolled bool) []irma.SchemeManagerIdentifier {
 	list := []irma.SchemeManagerIdentifier{}
-	for name, manager := range client.Configuration.SchemeManagers {
-		if _, contains := client.keyshareServers[name]; manager.Distributed() && contains == enrolled {
+	for name, manager := range client.Configuration.GetSchemeManagers() {
+		if !manager.Distributed() {
+			continue
+		}
+		status := client.KeyshareEnrollmentStatus(name)
+		if (enrolled && status == KeyshareEnrolled) || (!enrolled && status == KeyshareUnenrolled) {
 			list = append(list, manager.Identifier())
 		}
 	}
 	return list
 }
 
+// KeyshareEnrollmentStatus returns whether the client is enrolled at the keyshare server of the
+// specified scheme manager, or whether its enrollment started by KeyshareEnroll is still running.
+// The credentials of schemes with a keyshare server can only be used after enrolling, and sessions
+// involving them report unenrolled schemes using Handler.KeyshareEnrollmentMissing.
+func (client *Client) KeyshareEnrollmentStatus(manager irma.SchemeManagerIdentifier) KeyshareEnrollmentStatus {
+	kss, contains := client.keyshareServers[manager]
+	switch {
+	case !contains:
+		return KeyshareUnenrolled
+	case kss.enrolling:
+		return KeyshareEnrollmentPending
+	default:
+		return KeyshareEnrolled
+	}
+}
+
 func (client *Client) UnenrolledSchemeManagers() []irma.SchemeManagerIdentifier {
 	return client.genSchemeManagersList(false)
 }
@@ -1097,7 +1199,7 @@ func (client *Client) KeyshareEnroll(manager irma.SchemeManagerIdentifier, email
 }
 
 func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifier, email *string, pin string, lang string) error {
-	manager, ok := client.Configuration.SchemeManagers[managerID]
+	manager, ok := client.Configuration.GetSchemeManagers()[managerID]
 	if !ok {
 		return errors.New("Unknown scheme manager")
 	}
@@ -1138,6 +1240,7 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 	if err != nil {
 		return err
 	}
+	kss.enrolling = true
 
 	jwtt, err := SignerCreateJWT(client.signer, keyname, irma.KeyshareEnrollmentClaims{
 		KeyshareEnrollmentData: irma.KeyshareEnrollmentData{
@@ -1182,7 +1285,7 @@ func challengeResponseKeyName(scheme irma.SchemeManagerIdentifier) string {
 // if not, how many tries are left, or for how long the user is blocked. If an error is returned
 // it is of type *irma.SessionError.
 func (client *Client) KeyshareVerifyPin(pin string, schemeid irma.SchemeManagerIdentifier) (bool, int, int, error) {
-	scheme := client.Configuration.SchemeManagers[schemeid]
+	scheme := client.Configuration.GetSchemeManagers()[schemeid]
 	if scheme == nil || !scheme.Distributed() {
 		return false, 0, 0, &irma.SessionError{
 			Err:       errors.Errorf("Can't verify pin of scheme %s", schemeid.String()),
@@ -1266,7 +1369,7 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 		return errors.New("Unknown keyshare server")
 	}
 
-	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
+	transport := irma.NewHTTPTransport(client.Configuration.GetSchemeManagers()[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
 
 	claims := irma.KeyshareChangePinClaims{
 		KeyshareChangePinData: irma.KeyshareChangePinData{
@@ -1308,6 +1411,223 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 	}
 }
 
+// KeyshareRecoveryStart requests the keyshare server of the specified scheme manager to send a
+// recovery token to the specified email address, which must be a verified email address of the
+// keyshare account. For privacy reasons the keyshare server does not report whether this is the case.
+func (client *Client) KeyshareRecoveryStart(managerID irma.SchemeManagerIdentifier, email, lang string) error {
+	kss, ok := client.keyshareServers[managerID]
+	if !ok {
+		return errors.New("Unknown keyshare server")
+	}
+
+	transport := irma.NewHTTPTransport(client.Configuration.GetSchemeManagers()[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
+	return transport.Post("users/recovery/start", nil, irma.KeyshareRecoveryRequest{
+		Username: kss.Username,
+		Email:    email,
+		Language: lang,
+	})
+}
+
+// KeyshareRecover sets a new PIN at the keyshare server of the specified scheme manager, using a
+// recovery token obtained by email after KeyshareRecoveryStart. The keyshare account and the
+// credentials associated to it are kept.
+func (client *Client) KeyshareRecover(managerID irma.SchemeManagerIdentifier, token, pin string) error {
+	kss, ok := client.keyshareServers[managerID]
+	if !ok {
+		return errors.New("Unknown keyshare server")
+	}
+
+	keyname := challengeResponseKeyName(managerID)
+	pk, err := client.signer.PublicKey(keyname)
+	if err != nil {
+		return err
+	}
+	jwtt, err := SignerCreateJWT(client.signer, keyname, irma.KeyshareRecoveryClaims{
+		KeyshareRecoveryData: irma.KeyshareRecoveryData{
+			Username:  kss.Username,
+			Token:     token,
+			Pin:       kss.HashedPin(pin),
+			PublicKey: pk,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	transport := irma.NewHTTPTransport(client.Configuration.GetSchemeManagers()[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
+	res := &irma.KeysharePinStatus{}
+	err = transport.Post("users/recovery/finish", res, irma.KeyshareRecovery{RecoveryJWT: jwtt})
+	if err != nil {
+		return err
+	}
+	if res.Status != kssPinSuccess {
+		return errors.Errorf("unknown keyshare response for scheme %s", managerID)
+	}
+
+	// The keyshare server now knows the public key of our challenge-response key, so we use
+	// challenge-response from now on even if the account was registered before it was supported.
+	kss.token = res.Message
+	kss.ChallengeResponse = true
+	kss.PinOutOfSync = false
+	return client.storage.StoreKeyshareServers(client.keyshareServers)
+}
+
+// KeyshareDeviceEnrollment contains what a new device needs to use an existing keyshare account,
+// after its public key has been added to the account using KeyshareAddDevice on one of the devices
+// already registered to it.
+type KeyshareDeviceEnrollment struct {
+	SchemeManagerIdentifier irma.SchemeManagerIdentifier `json:"scheme"`
+	Username                string                       `json:"username"`
+	Nonce                   []byte                       `json:"nonce"`
+}
+
+// KeyshareDevicePublicKey returns the public key with which this device authenticates to the
+// keyshare server of the specified scheme manager. It is to be passed to KeyshareAddDevice
+// on a device that is already registered to the keyshare account.
+func (client *Client) KeyshareDevicePublicKey(managerID irma.SchemeManagerIdentifier) ([]byte, error) {
+	return client.signer.PublicKey(challengeResponseKeyName(managerID))
+}
+
+// KeyshareAddDevice registers the specified public key, obtained from KeyshareDevicePublicKey
+// on the new device, to our keyshare account at the keyshare server of the specified scheme manager.
+// The returned enrollment is to be passed to KeyshareEnrollDevice on the new device.
+func (client *Client) KeyshareAddDevice(
+	managerID irma.SchemeManagerIdentifier, pin string, pk []byte, name string,
+) (*KeyshareDeviceEnrollment, error) {
+	kss, ok := client.keyshareServers[managerID]
+	if !ok {
+		return nil, errors.New("Unknown keyshare server")
+	}
+	if !kss.ChallengeResponse {
+		return nil, errors.New("keyshare account does not support challenge-response, verify the PIN first")
+	}
+
+	jwtt, err := SignerCreateJWT(client.signer, challengeResponseKeyName(managerID), irma.KeyshareDeviceAddClaims{
+		KeyshareDeviceAddData: irma.KeyshareDeviceAddData{
+			Username:  kss.Username,
+			Pin:       kss.HashedPin(pin),
+			PublicKey: pk,
+			Name:      name,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	transport := irma.NewHTTPTransport(client.Configuration.GetSchemeManagers()[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
+	res := &irma.KeysharePinStatus{}
+	err = transport.Post("users/devices/add", res, irma.KeyshareDeviceAdd{DeviceAddJWT: jwtt})
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.Status {
+	case kssPinSuccess:
+		return &KeyshareDeviceEnrollment{
+			SchemeManagerIdentifier: managerID,
+			Username:                kss.Username,
+			Nonce:                   kss.Nonce,
+		}, nil
+	case kssPinFailure:
+		return nil, errors.Errorf("incorrect PIN for scheme %s", managerID)
+	case kssPinError:
+		return nil, errors.Errorf("user account is blocked for scheme %s", managerID)
+	default:
+		return nil, errors.Errorf("unknown keyshare response for scheme %s", managerID)
+	}
+}
+
+// KeyshareEnrollDevice makes this device use the keyshare account from the specified enrollment,
+// after verifying the PIN at the keyshare server. Note that this only concerns the keyshare account:
+// credentials are not transferred from the other devices.
+func (client *Client) KeyshareEnrollDevice(enrollment *KeyshareDeviceEnrollment, pin string) error {
+	managerID := enrollment.SchemeManagerIdentifier
+	manager, ok := client.Configuration.GetSchemeManagers()[managerID]
+	if !ok {
+		return errors.New("Unknown scheme manager")
+	}
+	if len(manager.KeyshareServer) == 0 {
+		return errors.New("Scheme manager has no keyshare server")
+	}
+	if _, ok = client.keyshareServers[managerID]; ok {
+		return errors.New("already enrolled at keyshare server")
+	}
+
+	kss := &keyshareServer{
+		Username:                enrollment.Username,
+		Nonce:                   enrollment.Nonce,
+		SchemeManagerIdentifier: managerID,
+		ChallengeResponse:       true,
+	}
+	transport := irma.NewHTTPTransport(manager.KeyshareServer, !client.Preferences.DeveloperMode)
+	success, _, _, err := client.verifyPinWorker(pin, kss, transport)
+	if err != nil {
+		return err
+	}
+	if !success {
+		return errors.Errorf("incorrect PIN for scheme %s", managerID)
+	}
+
+	client.keyshareServers[managerID] = kss
+	return client.storage.StoreKeyshareServers(client.keyshareServers)
+}
+
+// keyshareAuthorizedTransport verifies the PIN at the keyshare server of the specified scheme manager,
+// returning a transport that is authorized for operations on our keyshare account.
+func (client *Client) keyshareAuthorizedTransport(managerID irma.SchemeManagerIdentifier, pin string) (
+	*irma.HTTPTransport, *keyshareServer, error,
+) {
+	kss, ok := client.keyshareServers[managerID]
+	if !ok {
+		return nil, nil, errors.New("Unknown keyshare server")
+	}
+
+	transport := irma.NewHTTPTransport(client.Configuration.GetSchemeManagers()[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
+	success, _, _, err := client.verifyPinWorker(pin, kss, transport)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !success {
+		return nil, nil, errors.Errorf("incorrect PIN for scheme %s", managerID)
+	}
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	return transport, kss, nil
+}
+
+// KeyshareDevices returns the devices registered to our keyshare account at the keyshare server
+// of the specified scheme manager.
+func (client *Client) KeyshareDevices(managerID irma.SchemeManagerIdentifier, pin string) ([]irma.KeyshareDevice, error) {
+	transport, _, err := client.keyshareAuthorizedTransport(managerID, pin)
+	if err != nil {
+		return nil, err
+	}
+	var devices []irma.KeyshareDevice
+	if err = transport.Get("users/devices", &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// KeyshareRevokeDevice removes the device with the specified ID, as returned by KeyshareDevices,
+// from our keyshare account at the keyshare server of the specified scheme manager.
+func (client *Client) KeyshareRevokeDevice(managerID irma.SchemeManagerIdentifier, pin, deviceID string) error {
+	transport, kss, err := client.keyshareAuthorizedTransport(managerID, pin)
+	if err != nil {
+		return err
+	}
+	res := &irma.KeysharePinStatus{}
+	if err = transport.Post("users/devices/revoke", res, irma.KeyshareDevice{ID: deviceID}); err != nil {
+		return err
+	}
+	if res.Status != kssPinSuccess {
+		return errors.Errorf("unknown keyshare response for scheme %s", managerID)
+	}
+
+	// Revocation invalidates all authorization tokens, so we use the new one
+	kss.token = res.Message
+	return nil
+}
+
 // KeyshareRemove unenrolls the keyshare server of the specified scheme manager and removes all associated credentials.
 func (client *Client) KeyshareRemove(manager irma.SchemeManagerIdentifier) error {
 	return client.keyshareRemoveMultiple([]irma.SchemeManagerIdentifier{manager}, false)
@@ -1328,7 +1648,12 @@ func (client *Client) keyshareRemoveMultiple(schemeIDs []irma.SchemeManagerIdent
 			return errors.New("can't uninstall unknown keyshare server")
 		}
 	}
+	return client.removeSchemeData(schemeIDs, removeLogs)
+}
 
+// removeSchemeData removes the keyshare enrollments and credentials, and optionally the logs,
+// of the given schemes.
+func (client *Client) removeSchemeData(schemeIDs []irma.SchemeManagerIdentifier, removeLogs bool) error {
 	client.credMutex.Lock()
 	defer client.credMutex.Unlock()
 
@@ -1339,11 +1664,13 @@ func (client *Client) keyshareRemoveMultiple(schemeIDs []irma.SchemeManagerIdent
 			// close the client to prevent unexpected changes.
 			client.reportError(err)
 			_ = client.Close()
+			return
 		}
+		client.handler.UpdateAttributes()
 	}()
 
 	remainingSchemes := make(map[irma.SchemeManagerIdentifier]struct{})
-	for schemeID := range client.Configuration.SchemeManagers {
+	for schemeID := range client.Configuration.GetSchemeManagers() {
 		remainingSchemes[schemeID] = struct{}{}
 	}
 	for _, schemeID := range schemeIDs {
@@ -1416,6 +1743,14 @@ func (client *Client) LoadLogsBefore(beforeIndex uint64, max int) ([]*LogEntry,
 	return client.storage.LoadLogsBefore(beforeIndex, max)
 }
 
+// ChangeStorageKey re-encrypts the storage of the client with the specified key, which must be
+// passed to New from then on.
+func (client *Client) ChangeStorageKey(aesKey [32]byte) error {
+	client.credMutex.Lock()
+	defer client.credMutex.Unlock()
+	return client.storage.Rekey(aesKey)
+}
+
 func (client *Client) SetPreferences(pref Preferences) {
 	if pref.DeveloperMode {
 		irma.Logger.Info("developer mode enabled")
@@ -1429,6 +1764,20 @@ func (client *Client) SetPreferences(pref Preferences) {
 
 func (client *Client) applyPreferences() {}
 
+// checkDemoSchemes returns an error if the identifiers involve a demo scheme while
+// developer mode is disabled.
+func (client *Client) checkDemoSchemes(ids *irma.IrmaIdentifierSet) error {
+	if client.Preferences.DeveloperMode {
+		return nil
+	}
+	for id := range ids.SchemeManagers {
+		if scheme := client.Configuration.SchemeManagers[id]; scheme != nil && scheme.Demo {
+			return errors.Errorf("session involves demo scheme %s: enable developer mode in IRMA app", id)
+		}
+	}
+	return nil
+}
+
 // ConfigurationUpdated should be run after Configuration.Download().
 // For any credential type in the updated scheme to which new attributes were added, this function
 // sets the value of these new attributes to 0 in all instances that the client currently has of this
@@ -1445,7 +1794,7 @@ func (client *Client) ConfigurationUpdated(downloaded *irma.IrmaIdentifierSet) e
 		}
 		for i := range client.attributes[id] {
 			attrs := client.attributes[id][i].Ints
-			diff := len(client.Configuration.CredentialTypes[id].AttributeTypes) - (len(attrs) - 1)
+			diff := len(client.Configuration.GetCredentialTypes()[id].AttributeTypes) - (len(attrs) - 1)
 			if diff <= 0 {
 				continue
 			}
@@ -1469,14 +1818,64 @@ func (client *Client) ConfigurationUpdated(downloaded *irma.IrmaIdentifierSet) e
 	return nil
 }
 
-// RemoveScheme removes the given scheme and all credentials and log entries related to it.
+// InstallScheme downloads the scheme at the given URL and adds it to the configuration of the client,
+// provided that the SHA256 fingerprint of its public key (the hex-encoded hash of the DER encoding of
+// the key) equals the expected fingerprint, and that the scheme is validly signed by that key. This
+// allows installing schemes from a trusted source of their URL and fingerprint, such as a QR.
+// The scheme can be removed again using RemoveScheme.
+func (client *Client) InstallScheme(url string, fingerprint string) error {
+	url = strings.TrimSuffix(url, "/")
+	pk, err := irma.NewHTTPTransport(url, !client.Preferences.DeveloperMode).GetBytes("pk.pem")
+	if err != nil {
+		return err
+	}
+	actual, err := schemeKeyFingerprint(pk)
+	if err != nil {
+		return err
+	}
+	expected := strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+	if subtle.ConstantTimeCompare([]byte(actual), []byte(expected)) != 1 {
+		return errors.Errorf("public key of scheme at %s has fingerprint %s, expected %s", url, actual, expected)
+	}
+
+	before := map[irma.SchemeManagerIdentifier]struct{}{}
+	for id := range client.Configuration.GetSchemeManagers() {
+		before[id] = struct{}{}
+	}
+	if err = client.Configuration.InstallScheme(url, pk); err != nil {
+		return err
+	}
+	installed := &irma.IrmaIdentifierSet{SchemeManagers: map[irma.SchemeManagerIdentifier]struct{}{}}
+	for id := range client.Configuration.GetSchemeManagers() {
+		if _, ok := before[id]; !ok {
+			installed.SchemeManagers[id] = struct{}{}
+		}
+	}
+	client.handler.UpdateConfiguration(installed)
+	return nil
+}
+
+func schemeKeyFingerprint(pemBytes []byte) (string, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return "", errors.New("scheme public key is not PEM-encoded")
+	}
+	if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return "", errors.WrapPrefix(err, "invalid scheme public key", 0)
+	}
+	hash := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// RemoveScheme removes the given scheme, its keyshare enrollment if any, and all credentials and
+// log entries related to it.
 func (client *Client) RemoveScheme(schemeID irma.SchemeManagerIdentifier) error {
-	scheme, ok := client.Configuration.SchemeManagers[schemeID]
+	scheme, ok := client.Configuration.GetSchemeManagers()[schemeID]
 	if !ok {
 		return errors.New("unknown scheme manager")
 	}
 
-	err := client.keyshareRemoveMultiple([]irma.SchemeManagerIdentifier{schemeID}, true)
+	err := client.removeSchemeData([]irma.SchemeManagerIdentifier{schemeID}, true)
 	if err != nil {
 		return err
 	}
@@ -38,6 +38,7 @@ func (h *keyshareEnrollmentHandler) RequestPin(remainingAttempts int, callback P
 }
 
 func (h *keyshareEnrollmentHandler) Success(result string) {
+	h.kss.enrolling = false
 	_ = h.client.storage.StoreKeyshareServers(h.client.keyshareServers) // TODO handle err?
 	h.client.handler.EnrollmentSuccess(h.kss.SchemeManagerIdentifier)
 }
@@ -2,6 +2,8 @@ package irmaclient
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -120,6 +122,67 @@ func TestKeyshareAuthentication(t *testing.T) {
 	verifyPin(t, client)
 }
 
+func TestKeyshareRecoverInvalidToken(t *testing.T) {
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, irma.NewSchemeManagerIdentifier("test"))
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// The test keyshare server has no email server, so it cannot send recovery tokens
+	require.Error(t, client.KeyshareRecoveryStart(irma.NewSchemeManagerIdentifier("test"), "test@example.com", "en"))
+
+	err := client.KeyshareRecover(irma.NewSchemeManagerIdentifier("test"), "invalidtoken", "54321")
+	require.Error(t, err)
+	serr, ok := err.(*irma.SessionError)
+	require.True(t, ok)
+	require.Equal(t, "INVALID_TOKEN", serr.RemoteError.ErrorName)
+
+	// The PIN did not change
+	verifyPin(t, client)
+}
+
+func TestKeyshareDevices(t *testing.T) {
+	schemeID := irma.NewSchemeManagerIdentifier("test")
+	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, schemeID)
+	defer ks.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// A second device, with its own challenge-response key and without a keyshare enrollment
+	storage := test.SetupTestStorage(t)
+	require.NoError(t, os.Remove(filepath.Join(storage, "client", "ecdsa_sk.pem")))
+	client2, handler2 := parseExistingStorage(t, storage)
+	defer test.ClearTestStorage(t, client2, handler2.storage)
+	delete(client2.keyshareServers, schemeID)
+
+	// Register the challenge-response key of the first device
+	verifyPin(t, client)
+
+	pk, err := client2.KeyshareDevicePublicKey(schemeID)
+	require.NoError(t, err)
+	_, err = client.KeyshareAddDevice(schemeID, "00000", pk, "tablet")
+	require.Error(t, err)
+	enrollment, err := client.KeyshareAddDevice(schemeID, "12345", pk, "tablet")
+	require.NoError(t, err)
+
+	require.Error(t, client2.KeyshareEnrollDevice(enrollment, "00000"))
+	require.NoError(t, client2.KeyshareEnrollDevice(enrollment, "12345"))
+	verifyPin(t, client2)
+
+	devices, err := client2.KeyshareDevices(schemeID, "12345")
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	require.Contains(t, devices, irma.KeyshareDevice{ID: irma.KeyshareDeviceID(pk), Name: "tablet"})
+
+	// The second device revokes the first one
+	pk, err = client.KeyshareDevicePublicKey(schemeID)
+	require.NoError(t, err)
+	require.NoError(t, client2.KeyshareRevokeDevice(schemeID, "12345", irma.KeyshareDeviceID(pk)))
+	_, _, _, err = client.KeyshareVerifyPin("12345", schemeID)
+	require.Error(t, err)
+	verifyPin(t, client2)
+}
+
 // checkChallengeResponseEnforced manually sends a PIN auth message without challenge-response
 // to check that the server enforces challenge-response for this account.
 func checkChallengeResponseEnforced(t *testing.T, kss *keyshareServer) {
@@ -145,5 +208,5 @@ func verifyWrongPin(t *testing.T, client *Client) {
 	require.NoError(t, err)
 	require.False(t, succeeded)
 	require.Zero(t, blocked)
-	require.Equal(t, 1, tries)
+	require.Equal(t, 2, tries) // of the default 3 tries
 }
@@ -6,8 +6,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/privacybydesign/gabi/gabikeys"
 	"github.com/privacybydesign/gabi/signed"
@@ -275,8 +277,14 @@ func TestCredentialRemoval(t *testing.T) {
 	cred, err := client.credential(id, 0)
 	require.NoError(t, err)
 	require.NotNil(t, cred)
-	err = client.RemoveCredentialByHash(cred.attrs.Hash())
+	hash := cred.attrs.Hash()
+	info := client.CredentialInfo(hash)
+	require.NotNil(t, info)
+	require.Equal(t, id, info.Identifier())
+	err = client.RemoveCredentialByHash(hash)
 	require.NoError(t, err)
+	require.Equal(t, 1, handler.attributesUpdated)
+	require.Nil(t, client.CredentialInfo(hash))
 	cred, err = client.credential(id, 0)
 	require.NoError(t, err)
 	require.Nil(t, cred)
@@ -344,6 +352,70 @@ func TestCredentialInfoListNewAttribute(t *testing.T) {
 	require.Fail(t, "studentCard credential not found")
 }
 
+func TestSchemeUpdateInterval(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	attrid := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+	client.Configuration.SchemeManagers[irma.NewSchemeManagerIdentifier("irma-demo")].URL =
+		"http://localhost:48681/irma_configuration_updated/irma-demo"
+	// Pretend that the credential type is not yet known, so that the update adds it
+	delete(client.Configuration.CredentialTypes, credid)
+
+	added := make(chan []irma.CredentialTypeIdentifier, 1)
+	require.NoError(t, client.SetSchemeUpdateInterval(time.Hour, func(ids []irma.CredentialTypeIdentifier) {
+		added <- ids
+	}))
+	select {
+	case ids := <-added:
+		require.Equal(t, []irma.CredentialTypeIdentifier{credid}, ids)
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "scheme update handler not called")
+	}
+	require.NotNil(t, client.Configuration.CredentialTypes[credid].AttributeType(attrid))
+
+	// The schemes are not updated again within the interval, also not by a new client instance
+	updated, err := client.storage.LoadSchemesUpdated()
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), updated, 10*time.Second)
+	require.NoError(t, client.SetSchemeUpdateInterval(time.Hour, nil))
+	client.schemeUpdater.Lock()
+	require.False(t, client.schemeUpdater.running)
+	client.schemeUpdater.Unlock()
+}
+
+func TestInstallScheme(t *testing.T) {
+	// Use a client whose assets lack the test scheme, so that it can be installed and removed
+	storage := test.CreateTestStorage(t)
+	path := test.FindTestdataFolder(t)
+	assets := filepath.Join(storage, "assets")
+	require.NoError(t, common.CopyDirectory(filepath.Join(path, "irma_configuration", "irma-demo"), filepath.Join(assets, "irma-demo")))
+	handler := &TestClientHandler{t: t, c: make(chan error), storage: storage}
+	client, err := New(filepath.Join(storage, "client"), assets, handler, test.NewSigner(t), [32]byte{})
+	require.NoError(t, err)
+	defer test.ClearTestStorage(t, client, storage)
+
+	url := "http://localhost:48681/irma_configuration/test"
+	pk, err := os.ReadFile(filepath.Join(path, "irma_configuration", "test", "pk.pem"))
+	require.NoError(t, err)
+	fingerprint, err := schemeKeyFingerprint(pk)
+	require.NoError(t, err)
+
+	schemeID := irma.NewSchemeManagerIdentifier("test")
+	wrong := strings.Repeat("00", 32)
+	require.Error(t, client.InstallScheme(url, wrong))
+	require.NotContains(t, client.Configuration.SchemeManagers, schemeID)
+
+	require.NoError(t, client.InstallScheme(url, strings.ToUpper(fingerprint)))
+	require.Contains(t, client.Configuration.SchemeManagers, schemeID)
+	require.Contains(t, client.Configuration.CredentialTypes, irma.NewCredentialTypeIdentifier("test.test.email"))
+	require.Error(t, client.InstallScheme(url, fingerprint)) // already installed
+
+	require.NoError(t, client.RemoveScheme(schemeID))
+	require.NotContains(t, client.Configuration.SchemeManagers, schemeID)
+}
+
 func TestFreshStorage(t *testing.T) {
 	storage := test.CreateTestStorage(t)
 	client, handler := parseExistingStorage(t, storage)
@@ -365,6 +437,24 @@ func TestKeyshareEnrollmentRemoval(t *testing.T) {
 	require.NotContains(t, client.keyshareServers, "test")
 }
 
+func TestKeyshareEnrollmentStatus(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	id := irma.NewSchemeManagerIdentifier("test")
+	require.Equal(t, KeyshareEnrolled, client.KeyshareEnrollmentStatus(id))
+	require.Contains(t, client.EnrolledSchemeManagers(), id)
+
+	client.keyshareServers[id].enrolling = true
+	require.Equal(t, KeyshareEnrollmentPending, client.KeyshareEnrollmentStatus(id))
+	require.NotContains(t, client.EnrolledSchemeManagers(), id)
+	require.NotContains(t, client.UnenrolledSchemeManagers(), id)
+
+	require.NoError(t, client.KeyshareRemove(id))
+	require.Equal(t, KeyshareUnenrolled, client.KeyshareEnrollmentStatus(id))
+	require.Contains(t, client.UnenrolledSchemeManagers(), id)
+}
+
 func TestUpdatingStorage(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, client, handler.storage)
@@ -405,6 +495,223 @@ func TestRemoveStorage(t *testing.T) {
 	require.NotEqual(t, old_sk, new_sk)
 }
 
+func TestExportBackup(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	_, err := client.ExportBackup("")
+	require.Error(t, err)
+
+	bts, err := client.ExportBackup("passphrase")
+	require.NoError(t, err)
+
+	_, err = decryptBackup(bts, "wrong passphrase")
+	require.Error(t, err)
+
+	plaintext, err := decryptBackup(bts, "passphrase")
+	require.NoError(t, err)
+	var backup clientBackup
+	require.NoError(t, json.Unmarshal(plaintext, &backup))
+
+	require.Equal(t, client.secretkey.Key, backup.SecretKey.Key)
+	require.Len(t, backup.Credentials, len(client.CredentialInfoList()))
+	for _, cred := range backup.Credentials {
+		require.NotNil(t, cred.Signature)
+		attrs, _ := client.attributesByHash(cred.Attributes.Hash())
+		require.NotNil(t, attrs)
+	}
+	require.Contains(t, backup.KeyshareServers, irma.NewSchemeManagerIdentifier("test"))
+	logs, err := client.LoadNewestLogs(1000)
+	require.NoError(t, err)
+	require.Len(t, backup.Logs, len(logs))
+}
+
+func TestRestoreBackup(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	bts, err := client.ExportBackup("passphrase")
+	require.NoError(t, err)
+	logs, err := client.LoadNewestLogs(1000)
+	require.NoError(t, err)
+
+	freshClient, freshHandler := parseExistingStorage(t, test.CreateTestStorage(t))
+	defer test.ClearTestStorage(t, freshClient, freshHandler.storage)
+
+	_, err = freshClient.RestoreBackup(bts, "wrong passphrase", "")
+	require.Error(t, err)
+
+	result, err := freshClient.RestoreBackup(bts, "passphrase", "")
+	require.NoError(t, err)
+	require.Len(t, result.Restored, len(client.CredentialInfoList()))
+	require.Empty(t, result.Skipped)
+	require.Equal(t, []irma.SchemeManagerIdentifier{irma.NewSchemeManagerIdentifier("test")}, result.KeyshareServers)
+	require.Empty(t, result.KeyshareErrors)
+	require.Equal(t, len(logs), result.Logs)
+
+	require.Equal(t, client.secretkey.Key, freshClient.secretkey.Key)
+	require.Len(t, freshClient.CredentialInfoList(), len(client.CredentialInfoList()))
+	verifyClientIsUnmarshaled(t, freshClient)
+
+	// Restoring again changes nothing
+	result, err = freshClient.RestoreBackup(bts, "passphrase", "")
+	require.NoError(t, err)
+	require.Empty(t, result.Restored)
+	require.Len(t, result.Skipped, len(client.CredentialInfoList()))
+	require.Empty(t, result.KeyshareServers)
+	require.Zero(t, result.Logs)
+
+	// Credentials bound to another secret key cannot be merged
+	otherClient, otherHandler := parseStorage(t)
+	defer test.ClearTestStorage(t, otherClient, otherHandler.storage)
+	otherClient.secretkey, err = generateSecretKey()
+	require.NoError(t, err)
+	_, err = otherClient.RestoreBackup(bts, "passphrase", "")
+	require.Error(t, err)
+}
+
+func TestChangeStorageKey(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	_, err := DeriveStorageKey("12345", []byte("short"))
+	require.Error(t, err)
+	deviceSecret := []byte("0123456789abcdef")
+	key, err := DeriveStorageKey("12345", deviceSecret)
+	require.NoError(t, err)
+	otherKey, err := DeriveStorageKey("54321", deviceSecret)
+	require.NoError(t, err)
+	require.NotEqual(t, key, otherKey)
+
+	require.NoError(t, client.ChangeStorageKey(key))
+	require.NoError(t, client.Close())
+
+	// The storage can't be opened anymore with the old key
+	path := test.FindTestdataFolder(t)
+	_, err = New(
+		filepath.Join(handler.storage, "client"),
+		filepath.Join(path, "irma_configuration"),
+		handler,
+		test.NewSigner(t),
+		otherKey,
+	)
+	require.Error(t, err)
+
+	client, err = New(
+		filepath.Join(handler.storage, "client"),
+		filepath.Join(path, "irma_configuration"),
+		handler,
+		test.NewSigner(t),
+		key,
+	)
+	require.NoError(t, err)
+	verifyClientIsUnmarshaled(t, client)
+	verifyKeyshareIsUnmarshaled(t, client)
+}
+
+func TestExportLogs(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// Add a removal log entry
+	require.NoError(t, client.RemoveCredential(irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), 0))
+
+	logs, err := client.LoadNewestLogs(1000)
+	require.NoError(t, err)
+	require.NotEmpty(t, logs)
+
+	bts, err := client.ExportLogs()
+	require.NoError(t, err)
+	var exported []*ExportedLogEntry
+	require.NoError(t, json.Unmarshal(bts, &exported))
+	require.Len(t, exported, len(logs))
+	for i, log := range logs {
+		require.Equal(t, log.ID, exported[i].ID)
+		require.Equal(t, log.Type, exported[i].Type)
+	}
+	require.Equal(t, ActionRemoval, exported[0].Type)
+	require.Contains(t, exported[0].Removed, irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+}
+
+func TestExpiringCredentials(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	require.Empty(t, client.ExpiringCredentials(0))
+
+	var valid irma.CredentialInfoList
+	for _, cred := range client.CredentialInfoList() {
+		if !cred.IsExpired() {
+			valid = append(valid, cred)
+		}
+	}
+	require.NotEmpty(t, valid)
+	expiring := client.ExpiringCredentials(100 * 365 * 24 * time.Hour)
+	require.ElementsMatch(t, valid, expiring)
+	for i := 1; i < len(expiring); i++ {
+		require.False(t, time.Time(expiring[i].Expires).Before(time.Time(expiring[i-1].Expires)))
+	}
+
+	notified := make(chan *irma.CredentialInfo, len(expiring))
+	require.NoError(t, client.SetCredentialExpiryHandler(100*365*24*time.Hour, func(cred *irma.CredentialInfo) {
+		notified <- cred
+	}))
+	for range expiring {
+		select {
+		case cred := <-notified:
+			require.Contains(t, expiring, cred)
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "expiry handler not called")
+		}
+	}
+	require.NoError(t, client.SetCredentialExpiryHandler(0, nil))
+}
+
+func TestSubmitPendingResponses(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	v := irma.NewVersion(2, 8)
+	unreachable := &pendingResponse{
+		ServerURL:       "http://localhost:1/irma/session/abc/",
+		ProtocolVersion: v,
+		Path:            "proofs",
+		Response:        []byte("{}"),
+		Log:             &LogEntry{Type: irma.ActionSigning, Time: irma.Timestamp(time.Now())},
+		Expires:         irma.Timestamp(time.Now().Add(time.Minute)),
+	}
+	expired := *unreachable
+	expired.Expires = irma.Timestamp(time.Now().Add(-time.Minute))
+	require.NoError(t, client.storage.StorePendingResponse("unreachable", unreachable))
+	require.NoError(t, client.storage.StorePendingResponse("expired", &expired))
+
+	// The expired response is discarded, the other one is kept as its server cannot be reached
+	require.Error(t, client.SubmitPendingResponses())
+	responses, err := client.storage.LoadPendingResponses()
+	require.NoError(t, err)
+	require.Len(t, responses, 1)
+	require.Contains(t, responses, "unreachable")
+	require.Equal(t, "proofs", responses["unreachable"].Path)
+
+	require.NoError(t, client.SubmitPendingResponses())
+	logs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	for _, log := range logs {
+		require.NotEqual(t, irma.ActionSigning, log.Type)
+	}
+}
+
+func TestDeveloperModeDemoSchemes(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	demo := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.NoError(t, client.checkDemoSchemes(demo.Identifiers()))
+
+	client.SetPreferences(Preferences{DeveloperMode: false})
+	require.Error(t, client.checkDemoSchemes(demo.Identifiers()))
+	require.NoError(t, client.checkDemoSchemes(&irma.IrmaIdentifierSet{}))
+}
+
 func TestCredentialsConcurrency(t *testing.T) {
 	client, _ := parseStorage(t)
 	grp := sync.WaitGroup{}
@@ -429,13 +736,14 @@ func TestCredentialsConcurrency(t *testing.T) {
 // ------
 
 type TestClientHandler struct {
-	t       *testing.T
-	c       chan error
-	storage string
+	t                 *testing.T
+	c                 chan error
+	storage           string
+	attributesUpdated int
 }
 
 func (i *TestClientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet) {}
-func (i *TestClientHandler) UpdateAttributes()                               {}
+func (i *TestClientHandler) UpdateAttributes()                               { i.attributesUpdated++ }
 func (i *TestClientHandler) Revoked(cred *irma.CredentialIdentifier)         {}
 func (i *TestClientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier) {
 	select {
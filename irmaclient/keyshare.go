@@ -58,14 +58,27 @@ type keyshareServer struct {
 	SchemeManagerIdentifier irma.SchemeManagerIdentifier
 	ChallengeResponse       bool
 	token                   string
+	enrolling               bool // set while the enrollment session is running
 }
 
+// KeyshareEnrollmentStatus is the state of the enrollment of the client at a keyshare server.
+type KeyshareEnrollmentStatus string
+
+const (
+	KeyshareUnenrolled        KeyshareEnrollmentStatus = "unenrolled"
+	KeyshareEnrollmentPending KeyshareEnrollmentStatus = "pending"
+	KeyshareEnrolled          KeyshareEnrollmentStatus = "enrolled"
+)
+
 const (
 	kssUsernameHeader = "X-IRMA-Keyshare-Username"
 	kssAuthHeader     = "Authorization"
-	kssPinSuccess     = "success"
-	kssPinFailure     = "failure"
-	kssPinError       = "error"
+	// Reported to the keyshare server for the log of the user's account, which they can inspect
+	kssRequestorHeader   = "X-IRMA-Keyshare-Requestor"
+	kssSessionTypeHeader = "X-IRMA-Keyshare-Session-Type"
+	kssPinSuccess        = "success"
+	kssPinFailure        = "failure"
+	kssPinError          = "error"
 )
 
 func newKeyshareServer(schemeManagerIdentifier irma.SchemeManagerIdentifier) (*keyshareServer, error) {
@@ -100,6 +113,7 @@ func startKeyshareSession(
 	pin KeysharePinRequestor,
 	builders gabi.ProofBuilderList,
 	session irma.SessionRequest,
+	requestor *irma.RequestorInfo,
 	implicitDisclosure [][]*irma.AttributeIdentifier,
 	issuerProofNonce *big.Int,
 	timestamp *atum.Timestamp,
@@ -117,7 +131,7 @@ func startKeyshareSession(
 	}
 
 	for managerID := range schemeIDs {
-		if client.Configuration.SchemeManagers[managerID].Distributed() {
+		if client.Configuration.GetSchemeManagers()[managerID].Distributed() {
 			ksscount++
 			if _, enrolled := client.keyshareServers[managerID]; !enrolled {
 				err := errors.New("Not enrolled to keyshare server of scheme manager " + managerID.String())
@@ -146,7 +160,7 @@ func startKeyshareSession(
 	}
 
 	for managerID := range schemeIDs {
-		scheme := ks.client.Configuration.SchemeManagers[managerID]
+		scheme := ks.client.Configuration.GetSchemeManagers()[managerID]
 		if !scheme.Distributed() {
 			continue
 		}
@@ -155,6 +169,10 @@ func startKeyshareSession(
 		transport := irma.NewHTTPTransport(scheme.KeyshareServer, !ks.client.Preferences.DeveloperMode)
 		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
 		transport.SetHeader(kssAuthHeader, ks.keyshareServer.token)
+		transport.SetHeader(kssSessionTypeHeader, string(session.Action()))
+		if name := requestorName(requestor); name != "" {
+			transport.SetHeader(kssRequestorHeader, name)
+		}
 		ks.transports[managerID] = transport
 
 		// Try to parse token as a jwt to see if it is still valid; if so we don't need to ask for the PIN
@@ -241,6 +259,21 @@ func (ks *keyshareSession) VerifyPin(attempts int) {
 // clockdrift.
 const challengeRequestJWTExpiry = 3 * time.Minute
 
+// requestorName returns the name by which the requestor is recorded in the keyshare server's log:
+// its identifier in the requestor scheme if it has one, and its hostname otherwise.
+func requestorName(requestor *irma.RequestorInfo) string {
+	switch {
+	case requestor == nil: // manual session
+		return ""
+	case requestor.ID.String() != "":
+		return requestor.ID.String()
+	case len(requestor.Hostnames) > 0:
+		return requestor.Hostnames[0]
+	default:
+		return ""
+	}
+}
+
 func (kss *keyshareServer) doChallengeResponse(signer Signer, transport *irma.HTTPTransport, pin string) (*irma.KeysharePinStatus, error) {
 	keyname := challengeResponseKeyName(kss.SchemeManagerIdentifier)
 	jwtt, err := SignerCreateJWT(signer, keyname, irma.KeyshareAuthRequestClaims{
@@ -333,7 +366,7 @@ func (client *Client) verifyPinWorker(pin string, kss *keyshareServer, transport
 func (ks *keyshareSession) verifyPinAttempt(pin string) (
 	success bool, tries int, blocked int, manager irma.SchemeManagerIdentifier, err error) {
 	for manager = range ks.schemeIDs {
-		if !ks.client.Configuration.SchemeManagers[manager].Distributed() {
+		if !ks.client.Configuration.GetSchemeManagers()[manager].Distributed() {
 			continue
 		}
 
@@ -363,7 +396,7 @@ func (ks *keyshareSession) GetCommitments() {
 	for _, builder := range ks.builders {
 		pk := builder.PublicKey()
 		managerID := irma.NewIssuerIdentifier(pk.Issuer).SchemeManagerIdentifier()
-		if !ks.client.Configuration.SchemeManagers[managerID].Distributed() {
+		if !ks.client.Configuration.GetSchemeManagers()[managerID].Distributed() {
 			continue
 		}
 		if _, contains := pkids[managerID]; !contains {
@@ -375,7 +408,7 @@ func (ks *keyshareSession) GetCommitments() {
 	// Now inform each keyshare server of with respect to which public keys
 	// we want them to send us commitments
 	for managerID := range ks.schemeIDs {
-		if !ks.client.Configuration.SchemeManagers[managerID].Distributed() {
+		if !ks.client.Configuration.GetSchemeManagers()[managerID].Distributed() {
 			continue
 		}
 
@@ -476,7 +509,7 @@ func (ks *keyshareSession) finishDisclosureOrSigning(challenge *big.Int, respons
 	for i, builder := range ks.builders {
 		// Parse each received JWT
 		managerID := irma.NewIssuerIdentifier(builder.PublicKey().Issuer).SchemeManagerIdentifier()
-		if !ks.client.Configuration.SchemeManagers[managerID].Distributed() {
+		if !ks.client.Configuration.GetSchemeManagers()[managerID].Distributed() {
 			continue
 		}
 		claims := struct {
@@ -123,6 +123,56 @@ func (entry *LogEntry) GetSignedMessage() (abs *irma.SignedMessage, err error) {
 	}, nil
 }
 
+// ExportedLogEntry is the representation of a log entry in the export of ExportLogs,
+// containing the information of the entry in readable form.
+type ExportedLogEntry struct {
+	ID        uint64                                                    `json:"id"`
+	Type      irma.Action                                               `json:"type"`
+	Time      irma.Timestamp                                            `json:"time"`
+	Requestor *irma.RequestorInfo                                       `json:"requestor,omitempty"`
+	Disclosed [][]*irma.DisclosedAttribute                              `json:"disclosed,omitempty"`
+	Issued    irma.CredentialInfoList                                   `json:"issued,omitempty"`
+	Message   string                                                    `json:"message,omitempty"`
+	Removed   map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:"removed,omitempty"`
+}
+
+// Export returns the information of the log entry in readable form.
+func (entry *LogEntry) Export(conf *irma.Configuration) (*ExportedLogEntry, error) {
+	exported := &ExportedLogEntry{
+		ID:        entry.ID,
+		Type:      entry.Type,
+		Time:      entry.Time,
+		Requestor: entry.ServerName,
+		Message:   string(entry.SignedMessage),
+		Removed:   entry.Removed,
+	}
+	var err error
+	if exported.Disclosed, err = entry.GetDisclosedCredentials(conf); err != nil {
+		return nil, err
+	}
+	if exported.Issued, err = entry.GetIssuedCredentials(conf); err != nil {
+		return nil, err
+	}
+	return exported, nil
+}
+
+// ExportLogs returns all log entries as a JSON array of ExportedLogEntry, sorted from new to old.
+func (client *Client) ExportLogs() ([]byte, error) {
+	logs := []*ExportedLogEntry{}
+	err := client.storage.IterateLogs(func(log *LogEntry) error {
+		exported, err := log.Export(client.Configuration)
+		if err != nil {
+			return err
+		}
+		logs = append(logs, exported)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(logs)
+}
+
 func (session *session) createLogEntry(response interface{}) (*LogEntry, error) {
 	entry := &LogEntry{
 		Type:       session.Action,
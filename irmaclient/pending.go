@@ -0,0 +1,118 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/hashicorp/go-multierror"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// This file contains the queue of session responses that could not be sent to the IRMA server
+// because it could not be reached, and which are sent when connectivity returns.
+
+// Default maximum session lifetime of IRMA servers (see server.Configuration). The client does not
+// learn the lifetime of a session, so it assumes this one; if the server discarded the session
+// earlier, it rejects the response when it is submitted.
+const pendingResponseLifetime = 15 * time.Minute
+
+// pendingResponse is a response to an IRMA session that is yet to be sent to the IRMA server.
+type pendingResponse struct {
+	ServerURL       string
+	ForceHTTPS      bool
+	Headers         http.Header
+	ProtocolVersion *irma.ProtocolVersion
+	Path            string
+	Response        json.RawMessage
+	Log             *LogEntry      // added to the logs once the server has accepted the response
+	Expires         irma.Timestamp // after which the server will have discarded the session
+}
+
+// queueResponse stores the response of a signature session that could not be sent to the server,
+// to be sent later by SubmitPendingResponses.
+func (session *session) queueResponse(path string, response interface{}, message interface{}) error {
+	bts, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	log, err := session.createLogEntry(message)
+	if err != nil {
+		return err
+	}
+	return session.client.storage.StorePendingResponse(common.NewSessionToken(), &pendingResponse{
+		ServerURL:       session.transport.Server,
+		ForceHTTPS:      session.transport.ForceHTTPS,
+		Headers:         session.transport.Headers(),
+		ProtocolVersion: session.Version,
+		Path:            path,
+		Response:        bts,
+		Log:             log,
+		Expires:         irma.Timestamp(time.Now().Add(pendingResponseLifetime)),
+	})
+}
+
+// SubmitPendingResponses sends the queued responses of signature sessions whose IRMA server could
+// not be reached earlier. Responses are kept if the server still cannot be reached, unless the
+// session has expired in the meantime. The returned error reports the responses that were
+// discarded because they expired or were not accepted by the server.
+// The client also calls this function periodically.
+func (client *Client) SubmitPendingResponses() error {
+	responses, err := client.storage.LoadPendingResponses()
+	if err != nil {
+		return err
+	}
+
+	errs := &multierror.Error{}
+	for id, pending := range responses {
+		if time.Now().After(time.Time(pending.Expires)) {
+			errs = multierror.Append(errs, errors.Errorf("queued response to %s expired", pending.ServerURL))
+			if err = client.storage.DeletePendingResponse(id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		transport := irma.NewHTTPTransport(pending.ServerURL, pending.ForceHTTPS)
+		for name := range pending.Headers {
+			transport.SetHeader(name, pending.Headers.Get(name))
+		}
+		serverResponse := &irma.ServerSessionResponse{ProtocolVersion: pending.ProtocolVersion, SessionType: irma.ActionSigning}
+		err = transport.Post(pending.Path, serverResponse, pending.Response)
+		if serr, ok := err.(*irma.SessionError); ok && serr.ErrorType == irma.ErrorTransport {
+			continue // try again later
+		}
+
+		switch {
+		case err != nil:
+			errs = multierror.Append(errs, errors.WrapPrefix(err, "queued response not accepted by "+pending.ServerURL, 0))
+		case serverResponse.ProofStatus != irma.ProofStatusValid:
+			errs = multierror.Append(errs, errors.Errorf("queued response rejected by %s: %s", pending.ServerURL, serverResponse.ProofStatus))
+		default:
+			if err = client.storage.AddLogEntry(pending.Log); err != nil {
+				return err
+			}
+		}
+		if err = client.storage.DeletePendingResponse(id); err != nil {
+			return err
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// initPendingResponses periodically submits queued session responses.
+func (client *Client) initPendingResponses() {
+	_, err := client.Configuration.Scheduler.Every(1).Minute().
+		StartAt(time.Now().Add(time.Minute)).Do(func() {
+		client.jobs <- func() {
+			if err := client.SubmitPendingResponses(); err != nil {
+				client.reportError(err)
+			}
+		}
+	})
+	if err != nil {
+		client.reportError(err)
+	}
+}
@@ -96,7 +96,7 @@ func (client *Client) NonrevPrepare(request irma.SessionRequest) error {
 	var err error
 	var wg sync.WaitGroup
 	for id := range request.Disclosure().Identifiers().CredentialTypes {
-		credtype := client.Configuration.CredentialTypes[id]
+		credtype := client.Configuration.GetCredentialTypes()[id]
 		if !credtype.RevocationSupported() {
 			continue
 		}
@@ -244,7 +244,7 @@ func (client *Client) nonrevPrepareCache(id irma.CredentialTypeIdentifier, index
 // in the request, in background jobs, after the request has finished.
 func (client *Client) nonrevRepopulateCaches(request irma.SessionRequest) {
 	for id := range request.Disclosure().Identifiers().CredentialTypes {
-		credtype := client.Configuration.CredentialTypes[id]
+		credtype := client.Configuration.GetCredentialTypes()[id]
 		if credtype == nil || !credtype.RevocationSupported() {
 			continue
 		}
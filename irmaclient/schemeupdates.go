@@ -0,0 +1,111 @@
+package irmaclient
+
+import (
+	"sync"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the updating of the schemes of the client in the background. Instead of
+// updating periodically, which would be of little use on mobile devices where the app is not
+// running most of the time, the schemes are updated when they are stale at the moments the
+// client is (re)started or a session is started.
+
+type schemeUpdater struct {
+	sync.Mutex
+	interval time.Duration
+	handler  func(added []irma.CredentialTypeIdentifier)
+	updated  time.Time // of the last update attempt
+	running  bool
+}
+
+// SetSchemeUpdateInterval enables updating the schemes in the background at most once per
+// interval: right away, and later when a session is started, if the schemes were last updated
+// longer than interval ago (also by an earlier instance of the client). Missing scheme contents
+// that a session needs are downloaded by the session itself, regardless of this setting. The handler, if not nil,
+// is called with the credential types that were added to the schemes by an update.
+// Apps should call this when they are started. An interval of 0 disables the updates.
+func (client *Client) SetSchemeUpdateInterval(interval time.Duration, handler func(added []irma.CredentialTypeIdentifier)) error {
+	updated, err := client.storage.LoadSchemesUpdated()
+	if err != nil {
+		return err
+	}
+
+	client.schemeUpdater.Lock()
+	client.schemeUpdater.interval = interval
+	client.schemeUpdater.handler = handler
+	client.schemeUpdater.updated = updated
+	client.schemeUpdater.Unlock()
+
+	client.updateSchemesIfStale()
+	return nil
+}
+
+// updateSchemesIfStale schedules a job updating the schemes if they were last updated longer than
+// the scheme update interval ago. As background jobs are paused during sessions, when called at
+// the start of a session the update runs after the session.
+func (client *Client) updateSchemesIfStale() {
+	u := &client.schemeUpdater
+	u.Lock()
+	defer u.Unlock()
+	if u.interval == 0 || u.running || time.Since(u.updated) < u.interval {
+		return
+	}
+	u.running = true
+	client.jobs <- func() {
+		if err := client.updateSchemes(); err != nil {
+			client.reportError(err)
+		}
+	}
+}
+
+func (client *Client) updateSchemes() error {
+	u := &client.schemeUpdater
+	defer func() {
+		u.Lock()
+		u.running = false
+		u.Unlock()
+	}()
+
+	known := map[irma.CredentialTypeIdentifier]struct{}{}
+	for id := range client.Configuration.CredentialTypes {
+		known[id] = struct{}{}
+	}
+
+	var updated *irma.IrmaIdentifierSet
+	listener := func(_ *irma.Configuration, u *irma.IrmaIdentifierSet) { updated = u }
+	conf := client.Configuration
+	conf.SchemeUpdateListeners = append(conf.SchemeUpdateListeners, listener)
+	updateErr := conf.UpdateSchemes()
+	conf.SchemeUpdateListeners = conf.SchemeUpdateListeners[:len(conf.SchemeUpdateListeners)-1]
+
+	// Also after a failed update, don't try again until the next interval
+	now := time.Now()
+	u.Lock()
+	u.updated = now
+	handler := u.handler
+	u.Unlock()
+	if err := client.storage.StoreSchemesUpdated(now); err != nil {
+		return err
+	}
+
+	if updated != nil {
+		if err := client.ConfigurationUpdated(updated); err != nil {
+			return err
+		}
+		client.handler.UpdateConfiguration(updated)
+
+		var added []irma.CredentialTypeIdentifier
+		for id := range updated.CredentialTypes {
+			if _, ok := known[id]; !ok {
+				added = append(added, id)
+			}
+		}
+		if len(added) > 0 && handler != nil {
+			handler(added)
+		}
+	}
+
+	return updateErr
+}
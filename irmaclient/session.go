@@ -36,6 +36,9 @@ type Handler interface {
 	Cancelled()
 	Failure(err *irma.SessionError)
 
+	// KeyshareBlocked is called when the user is blocked at the keyshare server after too many
+	// wrong PIN attempts, with the duration of the block in seconds, or -1 if the user is blocked
+	// permanently or the duration is unknown.
 	KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int)
 	KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier)
 	KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier)
@@ -156,6 +159,7 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 
 // newManualSession starts a manual session, given a signature request in JSON and a handler to pass messages to
 func (client *Client) newManualSession(request irma.SessionRequest, handler Handler, action irma.Action) SessionDismisser {
+	client.updateSchemesIfStale()
 	client.PauseJobs()
 
 	doneChannel := make(chan struct{}, 1)
@@ -193,6 +197,7 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 		return client.newQrSession(newqr, handler)
 	}
 
+	client.updateSchemesIfStale()
 	client.PauseJobs()
 
 	u, _ := url.ParseRequestURI(qr.URL) // Qr validator already checked this for errors
@@ -311,7 +316,7 @@ func requestorInfo(serverURL string, conf *irma.Configuration) *irma.RequestorIn
 	}
 	u, _ := url.ParseRequestURI(serverURL) // Qr validator already checked this for errors
 	hostname := u.Hostname()
-	info, present := conf.Requestors[hostname]
+	info, present := conf.GetRequestors()[hostname]
 
 	if (u.Scheme == "https" || !common.ForceHTTPS) && present &&
 		(info.ValidUntil == nil || info.ValidUntil.After(irma.Timestamp(time.Now()))) {
@@ -354,6 +359,10 @@ func (session *session) processSessionInfo() {
 		})
 		return
 	}
+	if err := session.client.checkDemoSchemes(session.request.Identifiers()); err != nil {
+		session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Info: err.Error()})
+		return
+	}
 	confirmedProtocolVersion := baserequest.ProtocolVersion
 	if confirmedProtocolVersion != nil {
 		session.Version = confirmedProtocolVersion
@@ -498,6 +507,7 @@ func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 			session.Handler,
 			session.builders,
 			session.request,
+			session.RequestorInfo,
 			session.implicitDisclosure,
 			session.issuerProofNonce,
 			session.timestamp,
@@ -543,8 +553,18 @@ func (session *session) sendResponse(message interface{}) {
 	}
 
 	if session.IsInteractive() {
-		if err = session.transport.Post(path, &serverResponse, ourResponse); err != nil {
-			session.fail(err.(*irma.SessionError))
+		if err = session.postResponse(path, &serverResponse, ourResponse); err != nil {
+			serr := err.(*irma.SessionError)
+			// The signature does not become invalid when the server can't be reached,
+			// so we may submit it later, in contrast to responses of other session types
+			if session.Action == irma.ActionSigning && serr.ErrorType == irma.ErrorTransport {
+				if err = session.queueResponse(path, ourResponse, message); err != nil {
+					irma.Logger.Warn(errors.WrapPrefix(err, "Failed to queue session response", 0).ErrorStack())
+				} else {
+					serr = &irma.SessionError{ErrorType: irma.ErrorResponseQueued, Err: serr.Err}
+				}
+			}
+			session.fail(serr)
 			return
 		}
 		if serverResponse.ProofStatus != irma.ProofStatusValid {
@@ -580,6 +600,24 @@ func (session *session) sendResponse(message interface{}) {
 	}
 }
 
+// postResponse sends the response to the server. If this fails due to a connection error, it is
+// unknown whether the server received the response, so then it asks the server whether it is still
+// waiting for the response, and if so, sends it again.
+func (session *session) postResponse(path string, serverResponse **irma.ServerSessionResponse, response interface{}) error {
+	err := session.transport.Post(path, serverResponse, response)
+	if serr, ok := err.(*irma.SessionError); !ok || serr.ErrorType != irma.ErrorTransport {
+		return err
+	}
+
+	var status string
+	if session.transport.Get("status", &status) != nil ||
+		irma.ServerStatus(strings.Trim(status, `"`)) != irma.ServerStatusConnected {
+		return err
+	}
+	irma.Logger.Info("Connection to server lost while sending response, resending")
+	return session.transport.Post(path, serverResponse, response)
+}
+
 // Response calculation methods
 
 // getBuilders computes the builders for disclosure proofs or secretkey-knowledge proof (in case of disclosure/signing
@@ -622,7 +660,7 @@ func (session *session) getProof() (interface{}, error) {
 // and aborts the session if not
 func (session *session) checkKeyshareEnrollment() bool {
 	for id := range session.request.Identifiers().SchemeManagers {
-		distributed := session.client.Configuration.SchemeManagers[id].Distributed()
+		distributed := session.client.Configuration.GetSchemeManagers()[id].Distributed()
 		_, enrolled := session.client.keyshareServers[id]
 		if distributed && !enrolled {
 			session.finish(false)
@@ -671,7 +709,7 @@ func (session *session) Distributed() bool {
 	if session.Action == irma.ActionIssuing {
 		for _, credreq := range session.request.(*irma.IssuanceRequest).Credentials {
 			smi = credreq.CredentialTypeID.IssuerIdentifier().SchemeManagerIdentifier()
-			if session.client.Configuration.SchemeManagers[smi].Distributed() {
+			if session.client.Configuration.GetSchemeManagers()[smi].Distributed() {
 				return true
 			}
 		}
@@ -684,7 +722,7 @@ func (session *session) Distributed() bool {
 	for _, attrlist := range session.choice.Attributes {
 		for _, ai := range attrlist {
 			smi = ai.Type.CredentialTypeIdentifier().IssuerIdentifier().SchemeManagerIdentifier()
-			if session.client.Configuration.SchemeManagers[smi].Distributed() {
+			if session.client.Configuration.GetSchemeManagers()[smi].Distributed() {
 				return true
 			}
 		}
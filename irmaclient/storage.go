@@ -16,6 +16,7 @@ import (
 
 	"github.com/go-errors/errors"
 	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/argon2"
 )
 
 // This file contains the storage struct and its methods,
@@ -38,18 +39,44 @@ const databaseFile = "db2"
 
 // Bucketnames bbolt
 const (
-	userdataBucket  = "userdata"     // Key/value: specified below
-	skKey           = "sk"           // Value: *secretKey
-	credTypeKeysKey = "credTypeKeys" // Value: map[irma.CredentialTypeIdentifier][]byte
-	preferencesKey  = "preferences"  // Value: Preferences
-	updatesKey      = "updates"      // Value: []update
-	kssKey          = "kss"          // Value: map[irma.SchemeManagerIdentifier]*keyshareServer
-
-	attributesBucket = "attrs" // Key: []byte, value: []*irma.AttributeList
-	logsBucket       = "logs"  // Key: (auto-increment index), value: *LogEntry
-	signaturesBucket = "sigs"  // Key: credential.attrs.Hash, value: *gabi.CLSignature
+	userdataBucket    = "userdata"       // Key/value: specified below
+	skKey             = "sk"             // Value: *secretKey
+	credTypeKeysKey   = "credTypeKeys"   // Value: map[irma.CredentialTypeIdentifier][]byte
+	preferencesKey    = "preferences"    // Value: Preferences
+	updatesKey        = "updates"        // Value: []update
+	kssKey            = "kss"            // Value: map[irma.SchemeManagerIdentifier]*keyshareServer
+	schemesUpdatedKey = "schemesUpdated" // Value: irma.Timestamp
+
+	attributesBucket = "attrs"   // Key: []byte, value: []*irma.AttributeList
+	logsBucket       = "logs"    // Key: (auto-increment index), value: *LogEntry
+	signaturesBucket = "sigs"    // Key: credential.attrs.Hash, value: *gabi.CLSignature
+	pendingBucket    = "pending" // Key: (random), value: *pendingResponse
 )
 
+// Argon2id parameters for deriving encryption keys from PINs and passphrases,
+// following the recommendation of RFC 9106 for memory constrained environments.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
+// Minimum length of the device secret used in DeriveStorageKey
+const minDeviceSecretLength = 16
+
+// DeriveStorageKey derives a key for encrypting the client storage (see New) from the user's PIN
+// and a random secret stored on the device (for example in its secure hardware), so that
+// the storage can only be decrypted by someone who knows the PIN and has access to the device.
+// When the user changes their PIN, the storage should be re-encrypted using ChangeStorageKey.
+func DeriveStorageKey(pin string, deviceSecret []byte) ([32]byte, error) {
+	var key [32]byte
+	if len(deviceSecret) < minDeviceSecretLength {
+		return key, errors.Errorf("device secret must be at least %d bytes", minDeviceSecretLength)
+	}
+	copy(key[:], argon2.IDKey([]byte(pin), deviceSecret, argon2Time, argon2Memory, argon2Threads, 32))
+	return key, nil
+}
+
 func (s *storage) path(p string) string {
 	return filepath.Join(s.storagePath, p)
 }
@@ -492,12 +519,59 @@ func (s *storage) TxIterateLogs(tx *transaction, handler func(log *LogEntry) err
 	return nil
 }
 
+func (s *storage) StorePendingResponse(id string, response *pendingResponse) error {
+	return s.Transaction(func(tx *transaction) error {
+		return s.txStore(tx, pendingBucket, id, response)
+	})
+}
+
+func (s *storage) DeletePendingResponse(id string) error {
+	return s.Transaction(func(tx *transaction) error {
+		return s.txDelete(tx, pendingBucket, id)
+	})
+}
+
+func (s *storage) LoadPendingResponses() (map[string]*pendingResponse, error) {
+	responses := map[string]*pendingResponse{}
+	return responses, s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(pendingBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(key, value []byte) error {
+			plaintext, err := s.decrypt(value)
+			if err != nil {
+				return err
+			}
+			response := &pendingResponse{}
+			if err = json.Unmarshal(plaintext, response); err != nil {
+				return err
+			}
+			responses[string(key)] = response
+			return nil
+		})
+	})
+}
+
 func (s *storage) LoadUpdates() (updates []update, err error) {
 	updates = []update{}
 	_, err = s.load(userdataBucket, updatesKey, &updates)
 	return
 }
 
+func (s *storage) StoreSchemesUpdated(t time.Time) error {
+	return s.Transaction(func(tx *transaction) error {
+		ts := irma.Timestamp(t)
+		return s.txStore(tx, userdataBucket, schemesUpdatedKey, &ts)
+	})
+}
+
+func (s *storage) LoadSchemesUpdated() (time.Time, error) {
+	var t irma.Timestamp
+	_, err := s.load(userdataBucket, schemesUpdatedKey, &t)
+	return time.Time(t), err
+}
+
 func (s *storage) LoadPreferences() (Preferences, error) {
 	config := defaultPreferences
 	_, err := s.load(userdataBucket, preferencesKey, &config)
@@ -539,6 +613,9 @@ func (s *storage) TxDeleteAll(tx *transaction) error {
 	if err := s.TxDeleteLogs(tx); err != nil && err != bbolt.ErrBucketNotFound {
 		return err
 	}
+	if err := tx.DeleteBucket([]byte(pendingBucket)); err != nil && err != bbolt.ErrBucketNotFound {
+		return err
+	}
 	return nil
 }
 
@@ -548,6 +625,48 @@ func (s *storage) DeleteAll() error {
 	})
 }
 
+// Rekey re-encrypts all contents of the storage with the specified key in one transaction,
+// and uses the key from then on.
+func (s *storage) Rekey(aesKey [32]byte) error {
+	newStorage := &storage{aesKey: aesKey}
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			// The bucket may not be modified while iterating over it, so collect its contents first
+			var keys, values [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				if v == nil {
+					return nil // nested bucket; we don't use those
+				}
+				plaintext, err := s.decrypt(v)
+				if err != nil {
+					return err
+				}
+				ciphertext, err := newStorage.encrypt(plaintext)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, append([]byte{}, k...))
+				values = append(values, ciphertext)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for i := range keys {
+				if err = b.Put(keys[i], values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	s.aesKey = aesKey
+	return nil
+}
+
 func (s *storage) decrypt(ciphertext []byte) ([]byte, error) {
 	block, err := aes.NewCipher(s.aesKey[:])
 	if err != nil {
@@ -11,10 +11,12 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-co-op/gocron"
@@ -35,8 +37,8 @@ type Configuration struct {
 	Issuers         map[IssuerIdentifier]*Issuer
 	CredentialTypes map[CredentialTypeIdentifier]*CredentialType
 	AttributeTypes  map[AttributeTypeIdentifier]*AttributeType
-	kssPublicKeys   map[SchemeManagerIdentifier]map[int]*rsa.PublicKey
-	publicKeys      concmap.ConcMap[PublicKeyIdentifier, *gabikeys.PublicKey]
+	kssPublicKeys   concmap.ConcMap[kssPublicKeyIdentifier, *rsa.PublicKey]
+	publicKeys      concmap.LRU[PublicKeyIdentifier, *gabikeys.PublicKey]
 	reverseHashes   map[string]CredentialTypeIdentifier
 
 	// RequestorScheme data of the currently loaded requestorscheme
@@ -51,9 +53,17 @@ type Configuration struct {
 	// DisabledSchemeManagers keeps track of schemes that did not parse successfully
 	// (i.e., invalid signature, parsing error), and the problem that occurred when parsing them
 	DisabledSchemeManagers map[SchemeManagerIdentifier]*SchemeManagerError
+	// DisabledIssuers and DisabledCredentialTypes keep track of the issuers and credential types
+	// that were skipped because their descriptions are invalid, and the problem that occurred when
+	// parsing them. Only used if ConfigurationOptions.SkipInvalidDescriptions is set.
+	DisabledIssuers         map[IssuerIdentifier]error
+	DisabledCredentialTypes map[CredentialTypeIdentifier]error
 
 	// Listeners for configuration changes from initialization and updating of the schemes
 	UpdateListeners []ConfigurationListener
+	// Listeners for new or updated schemes, issuers, credential types and public keys
+	// downloaded by UpdateSchemes, e.g. by the scheme autoupdater
+	SchemeUpdateListeners []SchemeUpdateListener
 
 	// Path to the irma_configuration folder that this instance represents
 	Path        string
@@ -63,14 +73,29 @@ type Configuration struct {
 	Warnings    []string `json:"-"`
 
 	options     ConfigurationOptions
+	httpCache   *httpCache
 	initialized bool
 	assets      string
 	readOnly    bool
+
+	// updateLock serializes replacing the data of schemes, see replaceScheme
+	updateLock sync.Mutex
+	// mapsLock protects the map fields against being read while replaceScheme swaps them
+	mapsLock sync.RWMutex
+}
+
+type kssPublicKeyIdentifier struct {
+	Scheme  SchemeManagerIdentifier
+	Counter int
 }
 
 // ConfigurationListeners are the interface provided to react to changes in schemes.
 type ConfigurationListener func(conf *Configuration)
 
+// SchemeUpdateListeners are invoked by UpdateSchemes with the identifiers of the new or updated
+// entities, if any, after their data has been swapped into the Configuration.
+type SchemeUpdateListener func(conf *Configuration, updated *IrmaIdentifierSet)
+
 type UnknownIdentifierError struct {
 	ErrorType
 	Missing *IrmaIdentifierSet
@@ -88,16 +113,47 @@ type ConfigurationOptions struct {
 	RevocationDBConnStr string
 	RevocationDBType    string
 	RevocationSettings  RevocationSettings
+
+	// DangerousAllowUnsignedDemoSchemes allows demo schemes without index signature or public key
+	// to be parsed and updated. The hashes of their files must still match the index. Schemes with
+	// an invalid signature are never allowed. As the description declaring the scheme to be a demo
+	// scheme cannot be authenticated, this must only be used in test and demo environments.
+	DangerousAllowUnsignedDemoSchemes bool
+
+	// OverridesPath is a folder containing unauthenticated issuer and credential type descriptions
+	// and public keys that override those of the schemes, for use during development.
+	// See parseOverrides() for its structure.
+	OverridesPath string
+
+	// SchemeURLs maps scheme IDs to the URLs from which the schemes are updated, instead of the URLs
+	// in their descriptions, e.g. to update from a mirror. Unlike the URLs in scheme descriptions,
+	// these may be git+file URLs referring to git repositories on the local filesystem.
+	SchemeURLs map[string]string
+
+	// SkipInvalidDescriptions makes parsing of issuer schemes skip issuers and credential types whose
+	// descriptions are invalid, instead of disabling the entire scheme. Skipped entries are recorded
+	// in Configuration.DisabledIssuers and Configuration.DisabledCredentialTypes, and reported in
+	// Configuration.Warnings. Files not matching the scheme index still disable the scheme.
+	SkipInvalidDescriptions bool
+
+	// PublicKeyCacheSize is the maximum number of parsed issuer public keys that are kept in memory;
+	// the least recently used ones are parsed again when needed. If 0, DefaultPublicKeyCacheSize is
+	// used; if negative, all parsed public keys are kept.
+	PublicKeyCacheSize int
 }
 
+// DefaultPublicKeyCacheSize is the default of ConfigurationOptions.PublicKeyCacheSize.
+const DefaultPublicKeyCacheSize = 256
+
 // NewConfiguration returns a new configuration. After this
 // ParseFolder() should be called to parse the specified path.
 func NewConfiguration(path string, opts ConfigurationOptions) (conf *Configuration, err error) {
 	conf = &Configuration{
-		Path:     path,
-		assets:   opts.Assets,
-		readOnly: opts.ReadOnly,
-		options:  opts,
+		Path:      path,
+		assets:    opts.Assets,
+		readOnly:  opts.ReadOnly,
+		options:   opts,
+		httpCache: newHTTPCache(),
 	}
 
 	if conf.assets != "" { // If an assets folder is specified, then it must exist
@@ -188,6 +244,9 @@ func (conf *Configuration) ParseFolder() (err error) {
 		}
 		return err // Not a SchemeManagerError? return it & halt parsing now
 	}
+	if err = conf.parseOverrides(); err != nil {
+		return err
+	}
 
 	if !conf.options.IgnorePrivateKeys && len(conf.PrivateKeys.(*privateKeyRingMerge).rings) == 0 {
 		ring, err := newPrivateKeyRingScheme(conf)
@@ -281,7 +340,7 @@ func (conf *Configuration) Download(session SessionRequest) (downloaded *IrmaIde
 
 	// Try updating them
 	for id := range allMissing.allSchemes() {
-		if err = conf.UpdateScheme(conf.SchemeManagers[id], downloaded); err != nil {
+		if err = conf.UpdateScheme(conf.GetSchemeManagers()[id], downloaded); err != nil {
 			return
 		}
 	}
@@ -314,15 +373,14 @@ func (conf *Configuration) AddPrivateKeyRing(ring PrivateKeyRing) error {
 }
 
 // PublicKey returns the specified public key, or nil if not present in the Configuration.
+// Public keys are parsed on first use and cached, see ConfigurationOptions.PublicKeyCacheSize.
 func (conf *Configuration) PublicKey(id IssuerIdentifier, counter uint) (*gabikeys.PublicKey, error) {
-	// If we have not seen this issuer or key before in conf.publicKeys,
-	// try to parse the public key folder; new keys might have been put there since we last parsed it
-	if !conf.publicKeys.IsSet(PublicKeyIdentifier{id, counter}) {
-		if err := conf.parseKeysFolder(id); err != nil {
-			return nil, err
-		}
+	if pk := conf.publicKeys.Get(PublicKeyIdentifier{id, counter}); pk != nil {
+		return pk, nil
 	}
-	return conf.publicKeys.Get(PublicKeyIdentifier{id, counter}), nil
+	// Not parsed before or evicted from the cache; the key might also have been put in
+	// the scheme since we last looked
+	return conf.parsePublicKey(id, counter)
 }
 
 // PublicKeyLatest returns the latest private key of the specified issuer.
@@ -337,18 +395,52 @@ func (conf *Configuration) PublicKeyLatest(id IssuerIdentifier) (*gabikeys.Publi
 	return conf.PublicKey(id, indices[len(indices)-1])
 }
 
+// CurrentPublicKey returns the public key of this issuer that is to be used for issuance:
+// the one with the highest counter that has not expired.
+func (id *Issuer) CurrentPublicKey(conf *Configuration) (*gabikeys.PublicKey, error) {
+	issuerid := id.Identifier()
+	indices, err := conf.PublicKeyIndices(issuerid)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	for i := len(indices) - 1; i >= 0; i-- {
+		pk, err := conf.PublicKey(issuerid, indices[i])
+		if err != nil {
+			return nil, err
+		}
+		if pk != nil && pk.ExpiryDate > now {
+			return pk, nil
+		}
+	}
+	return nil, errors.Errorf("issuer %s has no unexpired public keys", issuerid)
+}
+
 func (conf *Configuration) PublicKeyIndices(issuerid IssuerIdentifier) (i []uint, err error) {
-	scheme := conf.SchemeManagers[issuerid.SchemeManagerIdentifier()]
-	return matchKeyPattern(filepath.Join(scheme.path(), issuerid.Name(), "PublicKeys", "*"))
+	scheme := conf.GetSchemeManagers()[issuerid.SchemeManagerIdentifier()]
+	if i, err = matchKeyPattern(filepath.Join(scheme.path(), issuerid.Name(), "PublicKeys", "*")); err != nil {
+		return nil, err
+	}
+	if conf.options.OverridesPath == "" {
+		return i, nil
+	}
+	overrides, err := matchKeyPattern(conf.overrideKeysPattern(issuerid))
+	if err != nil {
+		return nil, err
+	}
+	for _, counter := range overrides {
+		j := sort.Search(len(i), func(j int) bool { return i[j] >= counter })
+		if j == len(i) || i[j] != counter {
+			i = append(i[:j], append([]uint{counter}, i[j:]...)...)
+		}
+	}
+	return i, nil
 }
 
 func (conf *Configuration) ValidateKeys() error {
 	const expiryBoundary = int64(time.Hour/time.Second) * 24 * 31 // 1 month, TODO make configurable
 
 	for issuerid, issuer := range conf.Issuers {
-		if err := conf.parseKeysFolder(issuerid); err != nil {
-			return err
-		}
 		indices, err := conf.PublicKeyIndices(issuerid)
 		if err != nil {
 			return err
@@ -356,9 +448,12 @@ func (conf *Configuration) ValidateKeys() error {
 		if len(indices) == 0 {
 			continue
 		}
-		latest, err := conf.PublicKey(issuerid, indices[len(indices)-1])
-		if err != nil {
-			return err
+		// Check that all public keys parse
+		var latest *gabikeys.PublicKey
+		for _, counter := range indices {
+			if latest, err = conf.PublicKey(issuerid, counter); err != nil {
+				return err
+			}
 		}
 
 		// Check expiry date public keys only if issuer is not deprecated
@@ -412,27 +507,26 @@ func (conf *Configuration) KeyshareServerKeyFunc(scheme SchemeManagerIdentifier)
 
 // KeyshareServerPublicKey returns the i'th public key of the specified scheme.
 func (conf *Configuration) KeyshareServerPublicKey(schemeid SchemeManagerIdentifier, i int) (*rsa.PublicKey, error) {
-	if _, contains := conf.kssPublicKeys[schemeid]; !contains {
-		conf.kssPublicKeys[schemeid] = make(map[int]*rsa.PublicKey)
+	id := kssPublicKeyIdentifier{Scheme: schemeid, Counter: i}
+	if pk := conf.kssPublicKeys.Get(id); pk != nil {
+		return pk, nil
 	}
-	if _, contains := conf.kssPublicKeys[schemeid][i]; !contains {
-		scheme := conf.SchemeManagers[schemeid]
-		pkbts, err := ioutil.ReadFile(filepath.Join(scheme.path(), fmt.Sprintf("kss-%d.pem", i)))
-		if err != nil {
-			return nil, err
-		}
-		pkblk, _ := pem.Decode(pkbts)
-		genericPk, err := x509.ParsePKIXPublicKey(pkblk.Bytes)
-		if err != nil {
-			return nil, err
-		}
-		pk, ok := genericPk.(*rsa.PublicKey)
-		if !ok {
-			return nil, errors.New("Invalid keyshare server public key")
-		}
-		conf.kssPublicKeys[schemeid][i] = pk
+	scheme := conf.GetSchemeManagers()[schemeid]
+	pkbts, err := ioutil.ReadFile(filepath.Join(scheme.path(), fmt.Sprintf("kss-%d.pem", i)))
+	if err != nil {
+		return nil, err
+	}
+	pkblk, _ := pem.Decode(pkbts)
+	genericPk, err := x509.ParsePKIXPublicKey(pkblk.Bytes)
+	if err != nil {
+		return nil, err
 	}
-	return conf.kssPublicKeys[schemeid][i], nil
+	pk, ok := genericPk.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Invalid keyshare server public key")
+	}
+	conf.kssPublicKeys.Set(id, pk)
+	return pk, nil
 }
 
 // IsInitialized indicates whether this instance has successfully been initialized.
@@ -441,15 +535,64 @@ func (conf *Configuration) IsInitialized() bool {
 }
 
 func (conf *Configuration) ContainsAttributeType(attr AttributeTypeIdentifier) bool {
-	_, contains := conf.AttributeTypes[attr]
+	_, contains := conf.GetAttributeTypes()[attr]
 	return contains && conf.ContainsCredentialType(attr.CredentialTypeIdentifier())
 }
 
 // ContainsCredentialType checks if the configuration contains the specified credential type.
 func (conf *Configuration) ContainsCredentialType(cred CredentialTypeIdentifier) bool {
-	return conf.SchemeManagers[cred.IssuerIdentifier().SchemeManagerIdentifier()] != nil &&
-		conf.Issuers[cred.IssuerIdentifier()] != nil &&
-		conf.CredentialTypes[cred] != nil
+	return conf.GetSchemeManagers()[cred.IssuerIdentifier().SchemeManagerIdentifier()] != nil &&
+		conf.GetIssuers()[cred.IssuerIdentifier()] != nil &&
+		conf.GetCredentialTypes()[cred] != nil
+}
+
+// CredentialTypeLogo returns the path and contents of the logo of the specified credential type,
+// or of its issuer if the credential type has no logo. See IssuerLogo.
+func (conf *Configuration) CredentialTypeLogo(id CredentialTypeIdentifier) (string, []byte, error) {
+	credtype := conf.GetCredentialTypes()[id]
+	if credtype == nil {
+		return "", nil, errors.Errorf("unknown credential type %s", id)
+	}
+	path, bts, err := conf.schemeLogo(credtype.SchemeManagerIdentifier(), filepath.Join(credtype.IssuerID, "Issues", credtype.ID, "logo.png"))
+	if path != "" || err != nil {
+		return path, bts, err
+	}
+	return conf.IssuerLogo(credtype.IssuerIdentifier())
+}
+
+// IssuerLogo returns the path and contents of the logo of the specified issuer, after verifying
+// it against the index of its scheme. If the logo is missing or invalid, it is downloaded from
+// the scheme's remote. If the scheme index contains no logo, an empty path is returned.
+func (conf *Configuration) IssuerLogo(id IssuerIdentifier) (string, []byte, error) {
+	issuer := conf.GetIssuers()[id]
+	if issuer == nil {
+		return "", nil, errors.Errorf("unknown issuer %s", id)
+	}
+	return conf.schemeLogo(issuer.SchemeManagerIdentifier(), filepath.Join(issuer.ID, "logo.png"))
+}
+
+func (conf *Configuration) schemeLogo(schemeid SchemeManagerIdentifier, file string) (string, []byte, error) {
+	scheme := conf.GetSchemeManagers()[schemeid]
+	if scheme == nil {
+		return "", nil, errors.Errorf("unknown scheme %s", schemeid)
+	}
+	hash, ok := scheme.index[scheme.ID+"/"+filepath.ToSlash(file)]
+	if !ok {
+		return "", nil, nil
+	}
+	path := filepath.Join(scheme.path(), file)
+	bts, err := conf.readHashedFile(path, hash)
+	if err == nil {
+		return path, bts, nil
+	}
+	if conf.readOnly {
+		return "", nil, err
+	}
+	Logger.WithField("path", path).Info("Downloading missing or invalid logo")
+	if bts, err = downloadSignedFile(conf.schemeTransport(scheme), scheme.path(), filepath.ToSlash(file), hash); err != nil {
+		return "", nil, err
+	}
+	return path, bts, nil
 }
 
 func (conf *Configuration) addReverseHash(credid CredentialTypeIdentifier) {
@@ -458,48 +601,50 @@ func (conf *Configuration) addReverseHash(credid CredentialTypeIdentifier) {
 }
 
 func (conf *Configuration) hashToCredentialType(hash []byte) *CredentialType {
-	if str, exists := conf.reverseHashes[base64.StdEncoding.EncodeToString(hash)]; exists {
-		return conf.CredentialTypes[str]
+	if str, exists := conf.getReverseHashes()[base64.StdEncoding.EncodeToString(hash)]; exists {
+		return conf.GetCredentialTypes()[str]
 	}
 	return nil
 }
 
-// parse $schememanager/$issuer/PublicKeys/$i.xml for $i = 1, ...
-func (conf *Configuration) parseKeysFolder(issuerid IssuerIdentifier) error {
-	scheme := conf.SchemeManagers[issuerid.SchemeManagerIdentifier()]
-	pattern := filepath.Join(scheme.path(), issuerid.Name(), "PublicKeys", "*")
-	files, err := filepath.Glob(pattern)
+// parsePublicKey parses $schememanager/$issuer/PublicKeys/$counter.xml, or the corresponding
+// file in the overrides folder if present there, and caches it. It returns nil if neither exists.
+func (conf *Configuration) parsePublicKey(issuerid IssuerIdentifier, counter uint) (*gabikeys.PublicKey, error) {
+	filename := fmt.Sprintf("%d.xml", counter)
+	pk, err := conf.parseOverrideKey(issuerid, filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	for _, file := range files {
-		filename := filepath.Base(file)
-		count := filename[:len(filename)-4]
-		i, err := strconv.ParseUint(count, 10, 32)
-		if err != nil {
-			return err
+	if pk == nil {
+		scheme := conf.GetSchemeManagers()[issuerid.SchemeManagerIdentifier()]
+		if scheme == nil {
+			return nil, nil
 		}
-		relativepath, err := filepath.Rel(scheme.path(), file)
-		if err != nil {
-			return err
+		relativepath := filepath.Join(issuerid.Name(), "PublicKeys", filename)
+		if exists, err := common.PathExists(filepath.Join(scheme.path(), relativepath)); err != nil || !exists {
+			return nil, err
 		}
 		bts, found, err := conf.readSignedFile(scheme.index, scheme.path(), relativepath)
 		if err != nil || !found {
-			return err
-		}
-		pk, err := gabikeys.NewPublicKeyFromBytes(bts)
-		if err != nil {
-			return err
+			return nil, err
 		}
-		if pk.Counter != uint(i) {
-			return errors.Errorf("Public key %s of issuer %s has wrong <Counter>", file, issuerid.String())
+		if pk, err = gabikeys.NewPublicKeyFromBytes(bts); err != nil {
+			return nil, err
 		}
-		pk.Issuer = issuerid.String()
-		conf.publicKeys.Set(PublicKeyIdentifier{issuerid, uint(i)}, pk)
 	}
+	if pk.Counter != counter {
+		return nil, errors.Errorf("Public key %s of issuer %s has wrong <Counter>", filename, issuerid.String())
+	}
+	pk.Issuer = issuerid.String()
+	conf.publicKeys.Set(PublicKeyIdentifier{issuerid, counter}, pk)
+	return pk, nil
+}
 
-	return nil
+func (conf *Configuration) publicKeyCacheSize() int {
+	if conf.options.PublicKeyCacheSize == 0 {
+		return DefaultPublicKeyCacheSize
+	}
+	return conf.options.PublicKeyCacheSize
 }
 
 func sorter(ints []uint) func(i, j int) bool {
@@ -533,8 +678,10 @@ func (conf *Configuration) clear() {
 	conf.Requestors = make(map[string]*RequestorInfo)
 	conf.IssueWizards = make(map[IssueWizardIdentifier]*IssueWizard)
 	conf.DisabledRequestorSchemes = make(map[RequestorSchemeIdentifier]*SchemeManagerError)
-	conf.kssPublicKeys = make(map[SchemeManagerIdentifier]map[int]*rsa.PublicKey)
-	conf.publicKeys = concmap.New[PublicKeyIdentifier, *gabikeys.PublicKey]()
+	conf.DisabledIssuers = make(map[IssuerIdentifier]error)
+	conf.DisabledCredentialTypes = make(map[CredentialTypeIdentifier]error)
+	conf.kssPublicKeys = concmap.New[kssPublicKeyIdentifier, *rsa.PublicKey]()
+	conf.publicKeys = concmap.NewLRU[PublicKeyIdentifier, *gabikeys.PublicKey](conf.publicKeyCacheSize())
 	conf.reverseHashes = make(map[string]CredentialTypeIdentifier)
 	if conf.PrivateKeys == nil { // keep if already populated
 		conf.PrivateKeys = &privateKeyRingMerge{}
@@ -560,7 +707,7 @@ func (conf *Configuration) checkCredentialTypes(session SessionRequest, missing
 	case *IssuanceRequest:
 		for _, credreq := range s.Credentials {
 			// First check if we have this credential type
-			typ, contains = conf.CredentialTypes[credreq.CredentialTypeID]
+			typ, contains = conf.GetCredentialTypes()[credreq.CredentialTypeID]
 			if !contains {
 				missing.CredentialTypes[credreq.CredentialTypeID] = struct{}{}
 				continue
@@ -586,7 +733,7 @@ func (conf *Configuration) checkCredentialTypes(session SessionRequest, missing
 
 	_ = session.Disclosure().Disclose.Iterate(func(attr *AttributeRequest) error {
 		credid := attr.Type.CredentialTypeIdentifier()
-		if typ, contains = conf.CredentialTypes[credid]; !contains {
+		if typ, contains = conf.GetCredentialTypes()[credid]; !contains {
 			missing.CredentialTypes[credid] = struct{}{}
 			return nil
 		}
@@ -614,7 +761,7 @@ func (conf *Configuration) checkIdentifiers(session SessionRequest) (*IrmaIdenti
 // instance.
 func (conf *Configuration) checkSchemes(session SessionRequest, missing *IrmaIdentifierSet) {
 	for id := range session.Identifiers().SchemeManagers {
-		scheme, contains := conf.SchemeManagers[id]
+		scheme, contains := conf.GetSchemeManagers()[id]
 		if !contains || scheme.Status != SchemeManagerStatusValid {
 			missing.SchemeManagers[id] = struct{}{}
 		}
@@ -623,7 +770,7 @@ func (conf *Configuration) checkSchemes(session SessionRequest, missing *IrmaIde
 
 func (conf *Configuration) checkIssuers(set *IrmaIdentifierSet, missing *IrmaIdentifierSet) error {
 	for issid := range set.Issuers {
-		if _, contains := conf.Issuers[issid]; !contains {
+		if _, contains := conf.GetIssuers()[issid]; !contains {
 			missing.Issuers[issid] = struct{}{}
 		}
 	}
@@ -643,7 +790,7 @@ func (conf *Configuration) checkIssuers(set *IrmaIdentifierSet, missing *IrmaIde
 
 func (conf *Configuration) validateIssuer(scheme *SchemeManager, issuer *Issuer, dir string) error {
 	issuerid := issuer.Identifier()
-	conf.validateTranslations(fmt.Sprintf("Issuer %s", issuerid.String()), issuer, issuer.Languages)
+	conf.validateTranslations(fmt.Sprintf("Issuer %s", issuerid.String()), issuer, scheme.translationLanguages(issuer.Languages))
 	// Check that the issuer has public keys
 	pkpath := filepath.Join(scheme.path(), issuer.ID, "PublicKeys", "*")
 	files, err := filepath.Glob(pkpath)
@@ -671,7 +818,8 @@ func (conf *Configuration) validateIssuer(scheme *SchemeManager, issuer *Issuer,
 
 func (conf *Configuration) validateCredentialType(manager *SchemeManager, issuer *Issuer, cred *CredentialType, dir string) error {
 	credid := cred.Identifier()
-	conf.validateTranslations(fmt.Sprintf("Credential type %s", credid.String()), cred, cred.Languages)
+	langs := manager.translationLanguages(cred.Languages)
+	conf.validateTranslations(fmt.Sprintf("Credential type %s", credid.String()), cred, langs)
 	if cred.XMLVersion < 4 {
 		return errors.New("Unsupported credential type description")
 	}
@@ -699,10 +847,16 @@ func (conf *Configuration) validateCredentialType(manager *SchemeManager, issuer
 	if err := common.AssertPathExists(filepath.Join(dir, "logo.png")); err != nil {
 		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has no logo.png", credid.String()))
 	}
-	return conf.validateAttributes(cred)
+	colorRegexp := regexp.MustCompile("^#[0-9A-Fa-f]{6}$")
+	for _, color := range []string{cred.ForegroundColor, cred.BackgroundColor, cred.BackgroundGradientStart, cred.BackgroundGradientEnd} {
+		if color != "" && !colorRegexp.MatchString(color) {
+			conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has invalid color %s", credid.String(), color))
+		}
+	}
+	return conf.validateAttributes(cred, langs)
 }
 
-func (conf *Configuration) validateAttributes(cred *CredentialType) error {
+func (conf *Configuration) validateAttributes(cred *CredentialType, langs []string) error {
 	name := cred.Identifier().String()
 	indices := make(map[int]struct{})
 	revocation := false
@@ -712,7 +866,7 @@ func (conf *Configuration) validateAttributes(cred *CredentialType) error {
 	}
 	for i, attr := range cred.AttributeTypes {
 		if !attr.RevocationAttribute {
-			conf.validateTranslations(fmt.Sprintf("Attribute %s of credential type %s", attr.ID, cred.Identifier().String()), attr, cred.Languages)
+			conf.validateTranslations(fmt.Sprintf("Attribute %s of credential type %s", attr.ID, cred.Identifier().String()), attr, langs)
 		}
 		index := i
 		if attr.DisplayIndex != nil {
@@ -729,6 +883,12 @@ func (conf *Configuration) validateAttributes(cred *CredentialType) error {
 		if attr.RevocationAttribute && attr.RandomBlind {
 			return errors.New("attribute cannot be both revocation attribute and randomblind attribute")
 		}
+		if !attr.Type.valid() {
+			return errors.Errorf("attribute %s of credential type %s has unknown type %s", attr.ID, name, attr.Type)
+		}
+		if attr.Type != AttributeValueTypeString && (attr.RandomBlind || attr.RevocationAttribute) {
+			return errors.Errorf("attribute %s of credential type %s cannot have a type", attr.ID, name)
+		}
 	}
 	if len(indices) != count {
 		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has invalid attribute ordering, check the displayIndex tags", name))
@@ -763,7 +923,7 @@ func (conf *Configuration) validateTranslations(file string, o interface{}, lang
 		if field.Type() == reflect.TypeOf(&translatedString) {
 			tmp := field.Interface().(*TranslatedString)
 			if tmp == nil {
-				return
+				continue
 			}
 			val = *tmp
 		} else {
@@ -783,6 +943,158 @@ func (conf *Configuration) validateTranslations(file string, o interface{}, lang
 	}
 }
 
+// The following methods return the current maps of this Configuration. As the maps are swapped
+// rather than modified when schemes are updated (see replaceScheme), the returned maps may be read
+// while schemes are updated in the background, but they must not be modified. Reading the map fields
+// of the Configuration directly is only safe if no schemes are updated concurrently.
+
+func (conf *Configuration) GetSchemeManagers() map[SchemeManagerIdentifier]*SchemeManager {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.SchemeManagers
+}
+
+func (conf *Configuration) GetIssuers() map[IssuerIdentifier]*Issuer {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.Issuers
+}
+
+func (conf *Configuration) GetCredentialTypes() map[CredentialTypeIdentifier]*CredentialType {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.CredentialTypes
+}
+
+func (conf *Configuration) GetAttributeTypes() map[AttributeTypeIdentifier]*AttributeType {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.AttributeTypes
+}
+
+func (conf *Configuration) GetRequestorSchemes() map[RequestorSchemeIdentifier]*RequestorScheme {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.RequestorSchemes
+}
+
+func (conf *Configuration) GetRequestors() map[string]*RequestorInfo {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.Requestors
+}
+
+func (conf *Configuration) GetIssueWizards() map[IssueWizardIdentifier]*IssueWizard {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.IssueWizards
+}
+
+func (conf *Configuration) GetDisabledRequestorSchemes() map[RequestorSchemeIdentifier]*SchemeManagerError {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.DisabledRequestorSchemes
+}
+
+func (conf *Configuration) GetDisabledSchemeManagers() map[SchemeManagerIdentifier]*SchemeManagerError {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.DisabledSchemeManagers
+}
+
+func (conf *Configuration) GetDisabledIssuers() map[IssuerIdentifier]error {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.DisabledIssuers
+}
+
+func (conf *Configuration) GetDisabledCredentialTypes() map[CredentialTypeIdentifier]error {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.DisabledCredentialTypes
+}
+
+func (conf *Configuration) GetWarnings() []string {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.Warnings
+}
+
+func (conf *Configuration) getReverseHashes() map[string]CredentialTypeIdentifier {
+	conf.mapsLock.RLock()
+	defer conf.mapsLock.RUnlock()
+	return conf.reverseHashes
+}
+
+// replaceScheme replaces the data of the specified scheme in this Configuration by the data in
+// other, or removes it if other is nil. Goroutines may read the maps of this Configuration while
+// this happens, e.g. verifying sessions while the schemes are updated in the background, so the
+// maps are not modified in place. Instead, copies of the maps are modified and then swapped in
+// (copy-on-write) under mapsLock, so that each map obtained by readers using the Get* methods
+// is complete and no longer modified.
+// The public keys, which are kept in maps safe for concurrent use, are replaced at once.
+// Concurrent calls are serialized, so that no changes are lost.
+func (conf *Configuration) replaceScheme(scheme Scheme, other *Configuration) {
+	conf.updateLock.Lock()
+	defer conf.updateLock.Unlock()
+
+	cp := &Configuration{
+		SchemeManagers:           copyMap(conf.SchemeManagers),
+		Issuers:                  copyMap(conf.Issuers),
+		CredentialTypes:          copyMap(conf.CredentialTypes),
+		AttributeTypes:           copyMap(conf.AttributeTypes),
+		kssPublicKeys:            conf.kssPublicKeys.Clone(),
+		publicKeys:               conf.publicKeys.Clone(),
+		reverseHashes:            copyMap(conf.reverseHashes),
+		RequestorSchemes:         copyMap(conf.RequestorSchemes),
+		Requestors:               copyMap(conf.Requestors),
+		IssueWizards:             copyMap(conf.IssueWizards),
+		DisabledRequestorSchemes: copyMap(conf.DisabledRequestorSchemes),
+		DisabledSchemeManagers:   copyMap(conf.DisabledSchemeManagers),
+		DisabledIssuers:          copyMap(conf.DisabledIssuers),
+		DisabledCredentialTypes:  copyMap(conf.DisabledCredentialTypes),
+		Path:                     conf.Path,
+		PrivateKeys:              conf.PrivateKeys,
+		Warnings:                 conf.Warnings,
+		options:                  conf.options,
+		assets:                   conf.assets,
+		readOnly:                 conf.readOnly,
+	}
+	scheme.purge(cp)
+	if other != nil {
+		cp.join(other)
+		if err := cp.parseOverrides(); err != nil {
+			Logger.Warn("failed to parse scheme overrides: ", err)
+		}
+	}
+
+	conf.mapsLock.Lock()
+	defer conf.mapsLock.Unlock()
+	conf.SchemeManagers = cp.SchemeManagers
+	conf.Issuers = cp.Issuers
+	conf.CredentialTypes = cp.CredentialTypes
+	conf.AttributeTypes = cp.AttributeTypes
+	conf.kssPublicKeys.Assign(cp.kssPublicKeys)
+	conf.publicKeys.Assign(cp.publicKeys)
+	conf.reverseHashes = cp.reverseHashes
+	conf.RequestorSchemes = cp.RequestorSchemes
+	conf.Requestors = cp.Requestors
+	conf.IssueWizards = cp.IssueWizards
+	conf.DisabledRequestorSchemes = cp.DisabledRequestorSchemes
+	conf.DisabledSchemeManagers = cp.DisabledSchemeManagers
+	conf.DisabledIssuers = cp.DisabledIssuers
+	conf.DisabledCredentialTypes = cp.DisabledCredentialTypes
+	conf.Warnings = cp.Warnings
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	result := make(map[K]V, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
 func (conf *Configuration) join(other *Configuration) {
 	for key, val := range other.SchemeManagers {
 		conf.SchemeManagers[key] = val
@@ -793,6 +1105,12 @@ func (conf *Configuration) join(other *Configuration) {
 	for key, val := range other.Issuers {
 		conf.Issuers[key] = val
 	}
+	for key, val := range other.DisabledIssuers {
+		conf.DisabledIssuers[key] = val
+	}
+	for key, val := range other.DisabledCredentialTypes {
+		conf.DisabledCredentialTypes[key] = val
+	}
 	for key, val := range other.CredentialTypes {
 		conf.CredentialTypes[key] = val
 	}
@@ -802,9 +1120,9 @@ func (conf *Configuration) join(other *Configuration) {
 	for key, val := range other.AttributeTypes {
 		conf.AttributeTypes[key] = val
 	}
-	for key, val := range other.kssPublicKeys {
-		conf.kssPublicKeys[key] = val
-	}
+	other.kssPublicKeys.Iterate(func(key kssPublicKeyIdentifier, val *rsa.PublicKey) {
+		conf.kssPublicKeys.Set(key, val)
+	})
 	for key, val := range other.RequestorSchemes {
 		conf.RequestorSchemes[key] = val
 	}
@@ -820,8 +1138,6 @@ func (conf *Configuration) join(other *Configuration) {
 	other.publicKeys.Iterate(func(key PublicKeyIdentifier, val *gabikeys.PublicKey) {
 		conf.publicKeys.Set(key, val)
 	})
-
-	conf.CallListeners()
 }
 
 func (e *UnknownIdentifierError) Error() string {
@@ -7,22 +7,28 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-retryablehttp"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
 	"github.com/privacybydesign/gabi/revocation"
+	"github.com/privacybydesign/gabi/signed"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/internal/concmap"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -101,6 +107,319 @@ func TestUpdateConfiguration(t *testing.T) {
 	require.Contains(t, updated.RequestorSchemes, requestorschemeid)
 }
 
+func TestUpdateSchemes(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	conf, err := NewConfiguration(filepath.Join(storage, "client"), ConfigurationOptions{Assets: filepath.Join("testdata", "irma_configuration")})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	var updated *IrmaIdentifierSet
+	conf.SchemeUpdateListeners = append(conf.SchemeUpdateListeners, func(_ *Configuration, u *IrmaIdentifierSet) {
+		updated = u
+	})
+
+	// Nothing changed remotely, so the listeners are not invoked
+	require.NoError(t, conf.UpdateSchemes())
+	require.Nil(t, updated)
+
+	// A scheme that fails to update does not prevent the others from being updated
+	requestorscheme := conf.RequestorSchemes[NewRequestorSchemeIdentifier("test-requestors")]
+	requestorscheme.URL = "http://localhost:48681/nonexisting"
+	conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")].URL = "http://localhost:48681/irma_configuration_updated/irma-demo"
+	err = conf.UpdateSchemes()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "test-requestors")
+	require.NotNil(t, updated)
+	require.Contains(t, updated.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.True(t, conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")].
+		ContainsAttribute(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")))
+}
+
+func TestHTTPCache(t *testing.T) {
+	var requests, notModified int
+	cacheControl := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", cacheControl)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("index"))
+	}))
+	defer ts.Close()
+
+	cache := newHTTPCache()
+	transport := NewHTTPTransport(ts.URL, false)
+	get := func() bool {
+		bts, cached, err := transport.getBytesCached("index", cache)
+		require.NoError(t, err)
+		require.Equal(t, "index", string(bts))
+		return cached
+	}
+
+	// Unchanged files are revalidated using conditional requests
+	require.False(t, get())
+	require.False(t, get())
+	require.Equal(t, 2, requests)
+	require.Equal(t, 1, notModified)
+
+	// Fresh files are not requested at all
+	cacheControl = "public, max-age=60"
+	require.False(t, get())
+	require.True(t, get())
+	require.Equal(t, 3, requests)
+
+	// Files that may not be stored are downloaded each time
+	cache = newHTTPCache()
+	cacheControl = "no-store"
+	require.False(t, get())
+	require.False(t, get())
+	require.Equal(t, 5, requests)
+	require.Equal(t, 2, notModified)
+}
+
+func TestSchemeMirror(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	mirrored, err := NewConfiguration(filepath.Join(storage, "client"), ConfigurationOptions{Assets: filepath.Join("testdata", "irma_configuration")})
+	require.NoError(t, err)
+	require.NoError(t, mirrored.ParseFolder())
+	ts := httptest.NewServer(mirrored.SchemeMirrorHandler())
+	defer ts.Close()
+
+	// The mirrored scheme can be installed and verified as usual
+	conf, err := NewConfiguration(filepath.Join(storage, "mirror"), ConfigurationOptions{
+		SchemeURLs: map[string]string{"irma-demo": ts.URL + "/irma-demo"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.NoError(t, conf.DangerousTOFUInstallScheme(ts.URL+"/irma-demo"))
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+
+	// Only signed files and files needed to verify them are served
+	get := func(path string) int {
+		res, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+	require.Equal(t, http.StatusOK, get("/irma-demo/index.sig"))
+	require.Equal(t, http.StatusNotFound, get("/irma-demo/sk.pem"))
+	require.Equal(t, http.StatusNotFound, get("/irma-demo/../irma-demo/sk.pem"))
+	require.Equal(t, http.StatusNotFound, get("/nonexisting/index"))
+
+	// Files not matching the index are not served
+	require.Equal(t, http.StatusOK, get("/irma-demo/description.xml"))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(storage, "client", "irma-demo", "description.xml"), []byte("modified"), 0644))
+	require.Equal(t, http.StatusNotFound, get("/irma-demo/description.xml"))
+}
+
+func TestUpdateConfigurationFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+	GitSchemeCacheDir = filepath.Join(storage, "gitcache")
+	defer func() { GitSchemeCacheDir = "" }()
+
+	// Create a repository containing the updated irma-demo scheme in a subdirectory, tagged v1
+	repo := filepath.Join(storage, "schemes.git")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration_updated", "irma-demo"), filepath.Join(repo, "irma-demo")))
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	git("init", "--quiet")
+	git("add", ".")
+	git("commit", "--quiet", "-m", "irma-demo")
+	git("tag", "v1")
+
+	url := "git+file://" + filepath.ToSlash(repo) + "@v1/irma-demo"
+	transport := newHTTPTransport(url, false, true)
+	bts, err := transport.GetBytes("timestamp")
+	require.NoError(t, err)
+	expected, err := ioutil.ReadFile(filepath.Join(repo, "irma-demo", "timestamp"))
+	require.NoError(t, err)
+	require.Equal(t, expected, bts)
+	_, err = transport.GetBytes("nonexisting")
+	require.Error(t, err)
+	require.Equal(t, 404, err.(*SessionError).RemoteStatus)
+	_, err = newHTTPTransport("git+file://"+filepath.ToSlash(repo)+"@v2/irma-demo", false, true).GetBytes("timestamp")
+	require.Error(t, err)
+	// git+file URLs are only supported if they come from the local configuration
+	_, err = NewHTTPTransport(url, false).GetBytes("timestamp")
+	require.Error(t, err)
+
+	conf, err := NewConfiguration(filepath.Join(storage, "client"), ConfigurationOptions{Assets: filepath.Join("testdata", "irma_configuration")})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	scheme := conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")]
+	scheme.URL = url
+	require.Error(t, conf.UpdateScheme(scheme, nil))
+
+	conf, err = NewConfiguration(filepath.Join(storage, "client"), ConfigurationOptions{
+		Assets:     filepath.Join("testdata", "irma_configuration"),
+		SchemeURLs: map[string]string{"irma-demo": url},
+	})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	scheme = conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")]
+	updated := newIrmaIdentifierSet()
+	require.NoError(t, conf.UpdateScheme(scheme, updated))
+	require.Contains(t, updated.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.True(t, conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")].
+		ContainsAttribute(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")))
+}
+
+func TestSchemeOverrides(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	// Override a credential type of an issuer without overriding the issuer itself,
+	// and a public key of the issuer
+	overrides := filepath.Join(storage, "overrides")
+	require.NoError(t, common.CopyDirectory(
+		filepath.Join("testdata", "irma_configuration_updated", "irma-demo", "RU", "Issues", "studentCard"),
+		filepath.Join(overrides, "irma-demo", "RU", "Issues", "studentCard"),
+	))
+	bts, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", "irma-demo", "MijnOverheid", "PublicKeys", "2.xml"))
+	require.NoError(t, err)
+	require.NoError(t, common.EnsureDirectoryExists(filepath.Join(overrides, "irma-demo", "RU", "PublicKeys")))
+	require.NoError(t, common.SaveFile(filepath.Join(overrides, "irma-demo", "RU", "PublicKeys", "2.xml"), bts))
+
+	conf, err := NewConfiguration(filepath.Join(storage, "client"), ConfigurationOptions{
+		Assets:        filepath.Join("testdata", "irma_configuration"),
+		OverridesPath: overrides,
+	})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	check := func() {
+		require.True(t, conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")].
+			ContainsAttribute(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")))
+		require.Contains(t, conf.AttributeTypes, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute"))
+
+		expected, err := conf.PublicKey(NewIssuerIdentifier("irma-demo.MijnOverheid"), 2)
+		require.NoError(t, err)
+		pk, err := conf.PublicKey(NewIssuerIdentifier("irma-demo.RU"), 2)
+		require.NoError(t, err)
+		require.Equal(t, expected.N, pk.N)
+		require.Equal(t, "irma-demo.RU", pk.Issuer)
+		indices, err := conf.PublicKeyIndices(NewIssuerIdentifier("irma-demo.RU"))
+		require.NoError(t, err)
+		require.Equal(t, []uint{0, 1, 2}, indices)
+	}
+	check()
+
+	// Overrides are retained when the scheme is reloaded
+	require.NoError(t, conf.ReloadScheme(filepath.Join(storage, "client", "irma-demo")))
+	check()
+
+	// Overrides for unknown schemes are refused
+	require.NoError(t, common.EnsureDirectoryExists(filepath.Join(overrides, "nonexisting")))
+	require.Error(t, conf.ParseFolder())
+}
+
+func TestConcurrentSchemeReload(t *testing.T) {
+	conf := parseConfiguration(t)
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	issuerid := NewIssuerIdentifier("irma-demo.RU")
+	schemeid := NewSchemeManagerIdentifier("test")
+
+	// Readers always see complete schemes while they are reloaded, and do not race with the
+	// swapping of the maps when using the Get* accessors (run with -race to check the latter)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				assert.NotNil(t, conf.GetCredentialTypes()[credid])
+				assert.Contains(t, conf.GetAttributeTypes(), NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level"))
+				for range conf.GetIssuers() {
+				}
+				assert.True(t, conf.ContainsCredentialType(credid))
+				pk, err := conf.PublicKey(issuerid, 2)
+				assert.NoError(t, err)
+				assert.NotNil(t, pk)
+				kss, err := conf.KeyshareServerPublicKey(schemeid, 0)
+				assert.NoError(t, err)
+				assert.NotNil(t, kss)
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, conf.ReloadScheme(filepath.Join(conf.Path, "irma-demo")))
+		require.NoError(t, conf.ReloadScheme(filepath.Join(conf.Path, "test")))
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestInstallDefaultSchemes(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	readPk := func(scheme string) []byte {
+		pk, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", scheme, "pk.pem"))
+		require.NoError(t, err)
+		return pk
+	}
+	defaultSchemes := DefaultSchemes
+	defer func() { DefaultSchemes = defaultSchemes }()
+	DefaultSchemes = [2]SchemePointer{
+		{URL: "http://localhost:48681/irma_configuration/irma-demo", Publickey: readPk("irma-demo")},
+		{URL: "http://localhost:48681/irma_configuration/test", Publickey: readPk("test")},
+	}
+
+	// Only irma-demo is present in the assets, the test scheme is downloaded
+	assets := filepath.Join(storage, "assets")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(assets, "irma-demo")))
+
+	confpath := filepath.Join(storage, "schemes")
+	require.NoError(t, common.EnsureDirectoryExists(confpath))
+	conf, err := NewConfiguration(confpath, ConfigurationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.NoError(t, conf.InstallDefaultSchemes(os.DirFS(assets)))
+	require.Contains(t, conf.SchemeManagers, NewSchemeManagerIdentifier("irma-demo"))
+	require.Contains(t, conf.SchemeManagers, NewSchemeManagerIdentifier("test"))
+	for _, path := range test.SchemeManagerHttpServerRequests() {
+		require.NotContains(t, path, "/irma-demo/")
+	}
+
+	// Schemes are verified against the pinned public key
+	DefaultSchemes[0].Publickey = readPk("test")
+	confpath = filepath.Join(storage, "schemes2")
+	require.NoError(t, common.EnsureDirectoryExists(confpath))
+	conf, err = NewConfiguration(confpath, ConfigurationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Error(t, conf.InstallDefaultSchemes(os.DirFS(assets)))
+	require.NotContains(t, conf.SchemeManagers, NewSchemeManagerIdentifier("irma-demo"))
+	exists, err := common.PathExists(filepath.Join(confpath, "irma-demo"))
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
 func TestParseInvalidIrmaConfiguration(t *testing.T) {
 	// The description.xml of the scheme manager under this folder has been edited
 	// to invalidate the scheme manager signature
@@ -121,6 +440,311 @@ func TestParseInvalidIrmaConfiguration(t *testing.T) {
 	require.Equal(t, SchemeManagerStatusInvalidSignature, conf.SchemeManagers[id].Status)
 }
 
+func TestParseUnsignedDemoScheme(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	confpath := filepath.Join(storage, "irma_configuration")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration"), confpath))
+	parse := func(allowUnsigned bool) (*Configuration, error) {
+		conf, err := NewConfiguration(confpath, ConfigurationOptions{
+			ReadOnly:                          true,
+			DangerousAllowUnsignedDemoSchemes: allowUnsigned,
+		})
+		require.NoError(t, err)
+		return conf, conf.ParseFolder()
+	}
+
+	// Unsigned schemes are refused by default
+	require.NoError(t, os.Remove(filepath.Join(confpath, "irma-demo", "index.sig")))
+	_, err := parse(false)
+	require.Error(t, err)
+
+	// Demo schemes may be unsigned when explicitly allowed
+	conf, err := parse(true)
+	require.NoError(t, err)
+	require.Equal(t, SchemeManagerStatusValid, conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")].Status)
+
+	// Invalid signatures are never allowed
+	require.NoError(t, common.SaveFile(filepath.Join(confpath, "irma-demo", "index.sig"), []byte("invalid")))
+	_, err = parse(true)
+	require.Error(t, err)
+
+	// Signed schemes without a public key to verify the signature with are refused
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(confpath, "irma-demo")))
+	require.NoError(t, os.Remove(filepath.Join(confpath, "irma-demo", "pk.pem")))
+	_, err = parse(true)
+	require.Error(t, err)
+
+	// Neither are unsigned schemes that are not demo schemes
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(confpath, "irma-demo")))
+	_, err = parse(true)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(confpath, "test-requestors", "index.sig")))
+	_, err = parse(true)
+	require.Error(t, err)
+}
+
+func TestSignScheme(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	confpath := filepath.Join(storage, "irma_configuration")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration"), confpath))
+	sk, err := signed.GenerateKey()
+	require.NoError(t, err)
+
+	// Modify and re-sign an issuer scheme and a requestor scheme with a new key
+	descpath := filepath.Join(confpath, "irma-demo", "RU", "description.xml")
+	bts, err := os.ReadFile(descpath)
+	require.NoError(t, err)
+	bts = []byte(strings.Replace(string(bts), "Demo Radboud University Nijmegen", "Demo Radboud University", 1))
+	require.NoError(t, common.SaveFile(descpath, bts))
+	for _, scheme := range []string{"irma-demo", "test-requestors"} {
+		require.NoError(t, SignScheme(sk, filepath.Join(confpath, scheme)))
+	}
+
+	index, err := ComputeSchemeIndex(filepath.Join(confpath, "irma-demo"))
+	require.NoError(t, err)
+	require.Contains(t, index, "irma-demo/RU/description.xml")
+	require.Contains(t, index, "irma-demo/timestamp")
+	require.NotContains(t, index, "irma-demo/MijnOverheid/PrivateKeys/0.xml")
+	require.NotContains(t, index, "irma-demo/index")
+
+	conf, err := NewConfiguration(confpath, ConfigurationOptions{ReadOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Equal(t, SchemeManagerStatusValid, conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")].Status)
+	require.Equal(t, "Demo Radboud University", conf.Issuers[NewIssuerIdentifier("irma-demo.RU")].Name["en"])
+	require.Equal(t, SchemeManagerStatusValid, conf.RequestorSchemes[NewRequestorSchemeIdentifier("test-requestors")].Status)
+
+	// Files with Windows line endings are refused
+	require.NoError(t, common.SaveFile(descpath, []byte(strings.ReplaceAll(string(bts), "\n", "\r\n"))))
+	require.Error(t, SignScheme(sk, filepath.Join(confpath, "irma-demo")))
+}
+
+func TestDiagnoseScheme(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	confpath := filepath.Join(storage, "irma_configuration")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration"), confpath))
+	conf, err := NewConfiguration(confpath, ConfigurationOptions{ReadOnly: true})
+	require.NoError(t, err)
+	schemepath := filepath.Join(confpath, "irma-demo")
+	require.Empty(t, conf.DiagnoseScheme(schemepath))
+
+	// Modified file
+	descpath := filepath.Join(schemepath, "RU", "description.xml")
+	bts, err := os.ReadFile(descpath)
+	require.NoError(t, err)
+	require.NoError(t, common.SaveFile(descpath, append(bts, '\n')))
+	// Unsigned credential type with invalid XML
+	require.NoError(t, common.EnsureDirectoryExists(filepath.Join(schemepath, "RU", "Issues", "broken")))
+	require.NoError(t, common.SaveFile(filepath.Join(schemepath, "RU", "Issues", "broken", "description.xml"), []byte("<IssueSpecification")))
+	// Private key not corresponding to public key
+	bts, err = os.ReadFile(filepath.Join(schemepath, "MijnOverheid", "PrivateKeys", "2.xml"))
+	require.NoError(t, err)
+	require.NoError(t, common.SaveFile(filepath.Join(schemepath, "MijnOverheid", "PrivateKeys", "1.xml"), bts))
+
+	var paths []string
+	for _, problem := range conf.DiagnoseScheme(schemepath) {
+		paths = append(paths, problem.Path)
+	}
+	require.ElementsMatch(t, []string{
+		"RU/description.xml",
+		"RU/Issues/broken/description.xml", // not in index
+		"RU/Issues/broken/description.xml", // invalid XML
+		"MijnOverheid/PrivateKeys/1.xml",   // wrong counter
+		"MijnOverheid/PrivateKeys/1.xml",   // does not match public key
+	}, paths)
+
+	// Invalid signature
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), schemepath))
+	require.NoError(t, os.RemoveAll(filepath.Join(schemepath, "RU", "Issues", "broken")))
+	require.NoError(t, common.SaveFile(filepath.Join(schemepath, "index.sig"), []byte("invalid")))
+	problems := conf.DiagnoseScheme(schemepath)
+	require.Len(t, problems, 1)
+	require.Equal(t, "index.sig", problems[0].Path)
+}
+
+func TestLintScheme(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	schemepath := filepath.Join(storage, "irma-demo")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), schemepath))
+	findings, err := LintScheme(schemepath)
+	require.NoError(t, err)
+	require.Empty(t, findings)
+
+	credtypedir := filepath.Join(schemepath, "RU", "Issues", "studentCard")
+	bts, err := os.ReadFile(filepath.Join(credtypedir, "description.xml"))
+	require.NoError(t, err)
+	desc := strings.NewReplacer(
+		`<IssueSpecification version="4">`, `<IssueSpecification version="3">`,
+		"<nl>Studentenkaartnummer</nl>", "",
+		`<Attribute id="studentID">`, `<Attribute id="university">`,
+		"<nl>https://example.com</nl>", "<nl>example.com</nl>",
+	).Replace(string(bts))
+	require.NoError(t, common.SaveFile(filepath.Join(credtypedir, "description.xml"), []byte(desc)))
+	require.NoError(t, os.Remove(filepath.Join(credtypedir, "logo.png")))
+
+	findings, err = LintScheme(schemepath)
+	require.NoError(t, err)
+	file := "RU/Issues/studentCard/description.xml"
+	require.ElementsMatch(t, []LintFinding{
+		{LintError, file, "/IssueSpecification/@version", "XML version 3 is deprecated and no longer supported, use version 4"},
+		{LintError, file, "/IssueSpecification/IssueURL/nl", "invalid URL example.com"},
+		{LintWarning, file, "/IssueSpecification/Attributes/Attribute[@id='studentCardNumber']/Name", "missing nl translation"},
+		{LintError, file, "/IssueSpecification/Attributes/Attribute[@id='university']", "duplicate attribute ID university"},
+		{LintWarning, "RU/Issues/studentCard/logo.png", "", "logo is missing"},
+	}, findings)
+
+	_, err = LintScheme(filepath.Join("testdata", "irma_configuration", "test-requestors"))
+	require.Error(t, err)
+}
+
+func TestRequiredLanguages(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	confpath := filepath.Join(storage, "irma_configuration")
+	schemepath := filepath.Join(confpath, "irma-demo")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), schemepath))
+	descpath := filepath.Join(schemepath, "description.xml")
+	bts, err := os.ReadFile(descpath)
+	require.NoError(t, err)
+	bts = []byte(strings.Replace(string(bts), "<Languages>", "<RequiredLanguages><Language>de</Language></RequiredLanguages><Languages>", 1))
+	require.NoError(t, common.SaveFile(descpath, bts))
+	sk, err := signed.GenerateKey()
+	require.NoError(t, err)
+	require.NoError(t, SignScheme(sk, schemepath))
+
+	conf, err := NewConfiguration(confpath, ConfigurationOptions{ReadOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Equal(t, []string{"de"}, conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")].RequiredLanguages)
+	require.Contains(t, conf.Warnings, "Scheme irma-demo misses de translation in <Name> tag")
+	require.Contains(t, conf.Warnings, "Issuer irma-demo.RU misses de translation in <Name> tag")
+	require.Contains(t, conf.Warnings, "Credential type irma-demo.RU.studentCard misses de translation in <IssueURL> tag")
+	require.Contains(t, conf.Warnings, "Attribute level of credential type irma-demo.RU.studentCard misses de translation in <Description> tag")
+
+	findings, err := LintScheme(schemepath)
+	require.NoError(t, err)
+	require.Contains(t, findings, LintFinding{LintError, "RU/Issues/studentCard/description.xml",
+		"/IssueSpecification/Attributes/Attribute[@id='level']/Description", "missing translation in required language de"})
+	for _, finding := range findings {
+		require.Equal(t, LintError, finding.Severity)
+	}
+}
+
+func TestSkipInvalidDescriptions(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	confpath := filepath.Join(storage, "irma_configuration")
+	schemepath := filepath.Join(confpath, "irma-demo")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), schemepath))
+	require.NoError(t, common.SaveFile(filepath.Join(schemepath, "stemmen", "description.xml"), []byte("<Issuer")))
+	// fullName depends on root, so it must be skipped as well
+	require.NoError(t, common.SaveFile(filepath.Join(schemepath, "MijnOverheid", "Issues", "root", "description.xml"), []byte("<IssueSpecification")))
+	sk, err := signed.GenerateKey()
+	require.NoError(t, err)
+	require.NoError(t, SignScheme(sk, schemepath))
+
+	// By default, the entire scheme is disabled
+	conf, err := NewConfiguration(confpath, ConfigurationOptions{ReadOnly: true})
+	require.NoError(t, err)
+	require.Error(t, conf.ParseFolder())
+	require.Contains(t, conf.DisabledSchemeManagers, NewSchemeManagerIdentifier("irma-demo"))
+
+	conf, err = NewConfiguration(confpath, ConfigurationOptions{ReadOnly: true, SkipInvalidDescriptions: true})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Empty(t, conf.DisabledSchemeManagers)
+	require.Contains(t, conf.DisabledIssuers, NewIssuerIdentifier("irma-demo.stemmen"))
+	require.Contains(t, conf.DisabledCredentialTypes, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"))
+	require.Contains(t, conf.DisabledCredentialTypes, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"))
+	require.NotContains(t, conf.Issuers, NewIssuerIdentifier("irma-demo.stemmen"))
+	require.NotContains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"))
+	require.NotContains(t, conf.AttributeTypes, NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"))
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.singleton"))
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+
+	// Reloading the scheme keeps track of the skipped entries
+	require.NoError(t, conf.ReloadScheme(schemepath))
+	require.Contains(t, conf.DisabledIssuers, NewIssuerIdentifier("irma-demo.stemmen"))
+	require.Contains(t, conf.DisabledCredentialTypes, NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"))
+	require.Contains(t, conf.CredentialTypes, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+}
+
+func TestSchemeDiff(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	olddir := filepath.Join("testdata", "irma_configuration", "irma-demo")
+	newdir := filepath.Join(storage, "irma-demo")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration_updated", "irma-demo"), newdir))
+	require.NoError(t, os.Remove(filepath.Join(newdir, "RU", "PublicKeys", "2.xml")))
+	require.NoError(t, os.RemoveAll(filepath.Join(newdir, "stemmen")))
+
+	changes, err := SchemeDiff(olddir, newdir)
+	require.NoError(t, err)
+	require.False(t, changes.Empty())
+	require.Empty(t, changes.AddedIssuers)
+	require.Equal(t, []IssuerIdentifier{NewIssuerIdentifier("irma-demo.stemmen")}, changes.RemovedIssuers)
+	require.Equal(t, []CredentialTypeIdentifier{NewCredentialTypeIdentifier("irma-demo.stemmen.stempas")}, changes.RemovedCredentialTypes)
+	require.Equal(t, []CredentialTypeIdentifier{NewCredentialTypeIdentifier("irma-demo.RU.studentCard")}, changes.ChangedCredentialTypes)
+	require.Equal(t, []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")}, changes.AddedAttributeTypes)
+	require.Equal(t, []AttributeTypeIdentifier{NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")}, changes.ChangedAttributeTypes)
+	require.Contains(t, changes.RemovedPublicKeys, PublicKeyIdentifier{NewIssuerIdentifier("irma-demo.RU"), 2})
+	require.Contains(t, changes.RemovedPublicKeys, PublicKeyIdentifier{NewIssuerIdentifier("irma-demo.stemmen"), 0})
+	require.Empty(t, changes.ChangedPublicKeys)
+
+	changes, err = SchemeDiff(olddir, olddir)
+	require.NoError(t, err)
+	require.True(t, changes.Empty())
+
+	_, err = SchemeDiff(olddir, filepath.Join("testdata", "irma_configuration", "test"))
+	require.Error(t, err)
+}
+
+func TestGenerateIssuerKeyPair(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+
+	confpath := filepath.Join(storage, "irma_configuration")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration"), confpath))
+	issuerdir := filepath.Join(confpath, "irma-demo", "RU")
+
+	counter, err := NextIssuerKeyCounter(issuerdir)
+	require.NoError(t, err)
+	require.Equal(t, uint(3), counter)
+
+	// Key pairs not supporting all credential types of the issuer are refused before generating them
+	_, _, err = GenerateIssuerKeyPair(issuerdir, IssuerKeyPairOptions{KeyLength: 1024, NumAttributes: 3})
+	require.Error(t, err)
+	_, _, err = GenerateIssuerKeyPair(issuerdir, IssuerKeyPairOptions{KeyLength: 1000})
+	require.Error(t, err)
+	_, _, err = GenerateIssuerKeyPair(issuerdir, IssuerKeyPairOptions{KeyLength: 1024, Counter: new(uint)})
+	require.Error(t, err) // key 0 exists
+
+	_, pk, err := GenerateIssuerKeyPair(issuerdir, IssuerKeyPairOptions{KeyLength: 1024})
+	require.NoError(t, err)
+	require.Equal(t, uint(3), pk.Counter)
+	require.FileExists(t, filepath.Join(issuerdir, "PublicKeys", "3.xml"))
+	require.FileExists(t, filepath.Join(issuerdir, "PrivateKeys", "3.xml"))
+
+	// The new key pair is valid for the scheme after signing it
+	sk, err := signed.GenerateKey()
+	require.NoError(t, err)
+	require.NoError(t, SignScheme(sk, filepath.Join(confpath, "irma-demo")))
+	conf, err := NewConfiguration(confpath, ConfigurationOptions{ReadOnly: true})
+	require.NoError(t, err)
+	require.Empty(t, conf.DiagnoseScheme(filepath.Join(confpath, "irma-demo")))
+}
+
 func TestParseIrmaConfigurationLeftoverTempDir(t *testing.T) {
 	storage := test.SetupTestStorage(t)
 	defer test.ClearTestStorage(t, nil, storage)
@@ -158,6 +782,32 @@ func TestRetryHTTPRequest(t *testing.T) {
 	require.Equal(t, "42\n", string(bts))
 }
 
+func TestRetryPolicy(t *testing.T) {
+	test.StartBadHttpServer(1, 1*time.Second, "42")
+	defer test.StopBadHttpServer()
+
+	transport := NewHTTPTransport("http://localhost:48682", false)
+	transport.client.HTTPClient.Timeout = 500 * time.Millisecond
+	transport.SetRetryPolicy(RetryPolicy{Max: 3, WaitMin: 10 * time.Millisecond, WaitMax: 50 * time.Millisecond})
+
+	// A POST that timed out may have been handled by the server, so it is not retried;
+	// if it were, the bad server would have answered the retry
+	var s string
+	err := transport.Post("", &s, "request")
+	require.Error(t, err)
+	require.Equal(t, ErrorTransport, err.(*SessionError).ErrorType)
+	bts, err := transport.GetBytes("")
+	require.NoError(t, err)
+	require.Equal(t, "42\n", string(bts))
+
+	for attempt := 0; attempt < 5; attempt++ {
+		max := retryablehttp.DefaultBackoff(10*time.Millisecond, 50*time.Millisecond, attempt, nil)
+		wait := jitterBackoff(10*time.Millisecond, 50*time.Millisecond, attempt, nil)
+		require.GreaterOrEqual(t, wait, max/2)
+		require.LessOrEqual(t, wait, max)
+	}
+}
+
 func TestInvalidIrmaConfigurationRestoreFromRemote(t *testing.T) {
 	test.StartSchemeManagerHttpServer()
 	defer test.StopSchemeManagerHttpServer()
@@ -176,6 +826,20 @@ func TestInvalidIrmaConfigurationRestoreFromRemote(t *testing.T) {
 	require.NoError(t, err)
 	require.Empty(t, conf.DisabledSchemeManagers)
 
+	// only the invalid file is downloaded, along with the index and timestamp
+	var downloaded []string
+	for _, path := range test.SchemeManagerHttpServerRequests() {
+		if !strings.Contains(path, "/PrivateKeys/") && !strings.HasSuffix(path, "/sk.pem") {
+			downloaded = append(downloaded, path)
+		}
+	}
+	require.ElementsMatch(t, []string{
+		"/irma_configuration/irma-demo/index",
+		"/irma_configuration/irma-demo/index.sig",
+		"/irma_configuration/irma-demo/timestamp",
+		"/irma_configuration/irma-demo/RU/Issues/studentCard/description.xml",
+	}, downloaded)
+
 	// switch to correct assets, and parse again to check that ParseOrRestoreFolder
 	// left the folder in a consistent state
 	conf.assets = filepath.Join("testdata", "irma_configuration")
@@ -293,6 +957,40 @@ func TestInstallScheme(t *testing.T) {
 	require.NotNil(t, sk)
 }
 
+func TestLogos(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	conf, err := NewConfiguration(filepath.Join(storage, "client"), ConfigurationOptions{Assets: filepath.Join("testdata", "irma_configuration")})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	id := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	expected, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", "irma-demo", "RU", "Issues", "studentCard", "logo.png"))
+	require.NoError(t, err)
+	path, bts, err := conf.CredentialTypeLogo(id)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(storage, "client", "irma-demo", "RU", "Issues", "studentCard", "logo.png"), path)
+	require.Equal(t, expected, bts)
+
+	// Invalid logos are downloaded again
+	require.NoError(t, ioutil.WriteFile(path, []byte("invalid"), 0644))
+	_, bts, err = conf.CredentialTypeLogo(id)
+	require.NoError(t, err)
+	require.Equal(t, expected, bts)
+	bts, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, expected, bts)
+
+	// Credential types without logo fall back to the logo of their issuer
+	delete(conf.SchemeManagers[id.SchemeManagerIdentifier()].index, "irma-demo/RU/Issues/studentCard/logo.png")
+	path, _, err = conf.CredentialTypeLogo(id)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(storage, "client", "irma-demo", "RU", "logo.png"), path)
+}
+
 func TestMetadataAttribute(t *testing.T) {
 	metadata := NewMetadataAttribute(0x02)
 	if metadata.Version() != 0x02 {
@@ -401,6 +1099,97 @@ func TestAttributeDecoding(t *testing.T) {
 	require.Equal(t, *oldString, expected)
 }
 
+func TestAttributeValueTypes(t *testing.T) {
+	date := AttributeType{ID: "date", Type: AttributeValueTypeDate}
+	integer := AttributeType{ID: "integer", Type: AttributeValueTypeInteger}
+	boolean := AttributeType{ID: "boolean", Type: AttributeValueTypeBoolean}
+
+	for _, c := range []struct {
+		typ       AttributeType
+		value     string
+		canonical string
+		decoded   interface{}
+	}{
+		{AttributeType{ID: "string"}, " 007 ", " 007 ", " 007 "},
+		{date, "2000-01-31", "2000-01-31", time.Date(2000, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{integer, "+007", "7", int64(7)},
+		{integer, "-12", "-12", int64(-12)},
+		{boolean, "TRUE", "true", true},
+		{boolean, "0", "false", false},
+	} {
+		canonical, err := c.typ.EncodeValue(c.value)
+		require.NoError(t, err)
+		require.Equal(t, c.canonical, canonical)
+		decoded, err := c.typ.DecodeValue(c.value)
+		require.NoError(t, err)
+		require.Equal(t, c.decoded, decoded)
+	}
+
+	for _, c := range []struct {
+		typ   AttributeType
+		value string
+	}{
+		{date, "31-01-2000"}, {date, "2000-02-30"}, {integer, "1.5"}, {integer, ""}, {boolean, "yes"},
+		{AttributeType{ID: "unknown", Type: "unknown"}, "value"},
+	} {
+		_, err := c.typ.EncodeValue(c.value)
+		require.Error(t, err, c.value)
+	}
+
+	// Typed attributes are issued canonically and disclosed as typed values
+	conf := parseConfiguration(t)
+	attrid := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	conf.AttributeTypes[attrid].Type = AttributeValueTypeInteger
+	req := &CredentialRequest{
+		CredentialTypeID: attrid.CredentialTypeIdentifier(),
+		Attributes:       map[string]string{"BSN": "0012345"},
+	}
+	list, err := req.AttributeList(conf, 0x03, nil, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "12345", *list.UntranslatedAttribute(attrid))
+	value, err := (&DisclosedAttribute{Identifier: attrid, RawValue: list.UntranslatedAttribute(attrid)}).TypedValue(conf)
+	require.NoError(t, err)
+	require.Equal(t, int64(12345), value)
+
+	req.Attributes["BSN"] = "twelve"
+	err = req.Validate(conf)
+	require.Error(t, err)
+	require.Equal(t, ErrorInvalidRequest, err.(*SessionError).ErrorType)
+}
+
+func TestRandomBlindAttributes(t *testing.T) {
+	conf := parseConfiguration(t)
+	credid := NewCredentialTypeIdentifier("irma-demo.stemmen.stempas")
+	attrid := NewAttributeTypeIdentifier("irma-demo.stemmen.stempas.votingnumber")
+	require.True(t, conf.AttributeTypes[attrid].RandomBlind)
+	require.Equal(t, []int{2}, conf.CredentialTypes[credid].RandomBlindAttributeIndices())
+
+	// Issuers cannot choose the value of randomblind attributes
+	value := "12345"
+	req := &CredentialRequest{
+		CredentialTypeID:            credid,
+		Attributes:                  map[string]string{"election": "plantsoen", "votingnumber": value},
+		RandomBlindAttributeTypeIDs: conf.CredentialTypes[credid].RandomBlindAttributeNames(),
+	}
+	err := req.Validate(conf)
+	require.Error(t, err)
+	require.Equal(t, ErrorRandomBlind, err.(*SessionError).ErrorType)
+	delete(req.Attributes, "votingnumber")
+	require.NoError(t, req.Validate(conf))
+
+	// Neither can verifiers request a specific value
+	disclose := AttributeConDisCon{{{{Type: attrid, Value: &value}}}}
+	err = disclose.Validate(conf)
+	require.Error(t, err)
+	require.Equal(t, ErrorRandomBlind, err.(*SessionError).ErrorType)
+	disclose[0][0][0].Value = nil
+	require.NoError(t, disclose.Validate(conf))
+
+	// Randomblind values are random numbers, which are displayed in base 62
+	require.Nil(t, decodeRandomBlind(nil))
+	require.Equal(t, "Z", *decodeRandomBlind(big.NewInt(61)))
+}
+
 func TestSessionRequests(t *testing.T) {
 	attrval := "hello"
 	sigMessage := "message to be signed"
@@ -718,6 +1507,102 @@ var (
 	revocationPkCounter = uint(2)
 )
 
+func TestTranslationWithFallback(t *testing.T) {
+	ts := TranslatedString{"en": "Hello", "nl": "Hallo", "fr": ""}
+	require.Equal(t, "Hallo", ts.Translation("nl"))
+	require.Equal(t, "", ts.Translation("nl-BE"))
+
+	require.Equal(t, "Hallo", ts.TranslationWithFallback("nl"))
+	require.Equal(t, "Hallo", ts.TranslationWithFallback("nl-BE"))
+	require.Equal(t, "Hello", ts.TranslationWithFallback("fr"))
+	require.Equal(t, "Hello", ts.TranslationWithFallback("de"))
+
+	defer func() { TranslationFallbacks = map[string][]string{} }()
+	TranslationFallbacks = map[string][]string{"fy": {"nl"}}
+	require.Equal(t, "Hallo", ts.TranslationWithFallback("fy"))
+
+	// Without translation in a fallback language, the first available one is used
+	require.Equal(t, "Bonjour", TranslatedString{"fr": "Bonjour", "it": "Buongiorno"}.TranslationWithFallback("de"))
+	require.Equal(t, "", TranslatedString{"en": ""}.TranslationWithFallback("en"))
+	require.Equal(t, "", TranslatedString(nil).TranslationWithFallback("en"))
+}
+
+func TestTranslatedStringJSON(t *testing.T) {
+	var ts TranslatedString
+	ts.Set("en", "Age")
+	ts.Set("nl", "Leeftijd")
+	bts, err := json.Marshal(ts)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"en": "Age", "nl": "Leeftijd"}`, string(bts))
+
+	var decoded TranslatedString
+	require.NoError(t, json.Unmarshal(bts, &decoded))
+	require.Equal(t, ts, decoded)
+	require.NoError(t, json.Unmarshal([]byte(`"Age"`), &decoded))
+	require.Equal(t, TranslatedString{"": "Age", "en": "Age", "nl": "Age"}, decoded)
+	require.Error(t, json.Unmarshal([]byte(`["Age"]`), &decoded))
+
+	var request struct{ Label TranslatedString }
+	require.NoError(t, json.Unmarshal([]byte(`{"Label": null}`), &request))
+	require.Nil(t, request.Label)
+	bts, err = json.Marshal(request)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Label": null}`, string(bts))
+
+	translations := map[string]string{"en": "Age"}
+	ts = NewTranslatedStringFromMap(translations)
+	translations["en"] = "Changed"
+	require.Equal(t, TranslatedString{"en": "Age"}, ts)
+}
+
+func TestSchemeDescriptionsJSON(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	for _, c := range []struct {
+		descriptions interface{}
+		decoded      interface{}
+	}{
+		{conf.SchemeManagers, &map[SchemeManagerIdentifier]*SchemeManager{}},
+		{conf.Issuers, &map[IssuerIdentifier]*Issuer{}},
+		{conf.CredentialTypes, &map[CredentialTypeIdentifier]*CredentialType{}},
+		{conf.AttributeTypes, &map[AttributeTypeIdentifier]*AttributeType{}},
+	} {
+		bts, err := json.Marshal(c.descriptions)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(bts, c.decoded))
+		again, err := json.Marshal(c.decoded)
+		require.NoError(t, err)
+		require.JSONEq(t, string(bts), string(again))
+	}
+
+	bts, err := json.Marshal(conf.CredentialTypes[NewCredentialTypeIdentifier("irma-demo.RU.studentCard")])
+	require.NoError(t, err)
+	var credtype map[string]interface{}
+	require.NoError(t, json.Unmarshal(bts, &credtype))
+	require.Equal(t, map[string]interface{}{"en": "Demo Student Card", "nl": "Demo Studentenkaart"}, credtype["Name"])
+	require.Len(t, credtype["AttributeTypes"], 4)
+	require.NotContains(t, credtype, "XMLName")
+}
+
+func TestRevocationServers(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	urls, err := conf.RevocationServers(revocationTestCred)
+	require.NoError(t, err)
+	require.Equal(t, []string{"http://localhost:48683"}, urls)
+	require.Equal(t, RevocationParameters.DefaultUpdateEventCount, conf.CredentialTypes[revocationTestCred].RevocationUpdateCount)
+
+	_, err = conf.RevocationServers(NewCredentialTypeIdentifier("irma-demo.RU.studentCard"))
+	require.Error(t, err)
+	_, err = conf.RevocationServers(NewCredentialTypeIdentifier("irma-demo.RU.nonexistent"))
+	require.Equal(t, ErrorUnknownCredentialType, err)
+
+	require.Equal(t, []CredentialTypeIdentifier{
+		revocationTestCred,
+		NewCredentialTypeIdentifier("test.test.revocable"),
+	}, conf.RevocationCredentialTypes())
+}
+
 func TestRevocationMemoryStore(t *testing.T) {
 	conf := parseConfiguration(t)
 	db := conf.Revocation.memdb
@@ -847,6 +1732,72 @@ func TestPrivateKeyRings(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestCurrentPublicKey(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	// Key 2 of MijnOverheid has expired, so key 1 is to be used
+	pk, err := conf.Issuers[NewIssuerIdentifier("irma-demo.MijnOverheid")].CurrentPublicKey(conf)
+	require.NoError(t, err)
+	require.Equal(t, uint(1), pk.Counter)
+
+	pk, err = conf.Issuers[NewIssuerIdentifier("irma-demo.RU")].CurrentPublicKey(conf)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), pk.Counter)
+}
+
+func TestIndependentConfigurations(t *testing.T) {
+	// Configurations share no state, so that different sets of schemes can be used in one process
+	conf := parseConfiguration(t)
+	updated, err := NewConfiguration(filepath.Join("testdata", "irma_configuration_updated"), ConfigurationOptions{ReadOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, updated.ParseFolder())
+
+	attr := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+	require.False(t, conf.ContainsAttributeType(attr))
+	require.True(t, updated.ContainsAttributeType(attr))
+
+	ru := NewIssuerIdentifier("irma-demo.RU")
+	pk, err := conf.Issuers[ru].CurrentPublicKey(conf)
+	require.NoError(t, err)
+	updatedpk, err := updated.Issuers[ru].CurrentPublicKey(updated)
+	require.NoError(t, err)
+	require.NotSame(t, pk, updatedpk)
+	expected, err := updated.PublicKey(ru, updatedpk.Counter)
+	require.NoError(t, err)
+	require.Same(t, expected, updatedpk)
+}
+
+func TestSchemeDeprecation(t *testing.T) {
+	conf := parseConfiguration(t)
+	scheme := conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")]
+	require.NoError(t, xml.Unmarshal([]byte(`<SchemeManager version="7"><Id>irma-demo</Id>
+		<DeprecatedSince>1600000000</DeprecatedSince><ValidUntil>1700000000</ValidUntil></SchemeManager>`), scheme))
+	require.Equal(t, Timestamp(time.Unix(1600000000, 0)), scheme.DeprecatedSince)
+	require.Equal(t, Timestamp(time.Unix(1700000000, 0)), scheme.ValidUntil)
+
+	// During the grace period credentials are accepted, but not issued
+	grace := time.Unix(1650000000, 0)
+	require.True(t, scheme.Deprecated(grace))
+	require.False(t, scheme.Expired(grace))
+	require.True(t, scheme.Expired(time.Now()))
+	require.False(t, scheme.Deprecated(time.Unix(1500000000, 0)))
+
+	req := &CredentialRequest{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+		Attributes:       map[string]string{"BSN": "12345"},
+	}
+	err := req.Validate(conf)
+	require.Error(t, err)
+	require.Equal(t, ErrorInvalidSchemeManager, err.(*SessionError).ErrorType)
+
+	// Without DeprecatedSince, issuance stops at ValidUntil
+	scheme.DeprecatedSince = Timestamp{}
+	require.True(t, scheme.Deprecated(time.Now()))
+	scheme.ValidUntil = Timestamp(time.Now().Add(time.Hour))
+	require.False(t, scheme.Deprecated(time.Now()))
+	require.NoError(t, req.Validate(conf))
+}
+
 // Helper functions for wizard tests below
 func credid(s string) CredentialTypeIdentifier {
 	return NewCredentialTypeIdentifier(s)
@@ -1457,6 +2408,26 @@ func TestCredentialDependencies_UnmarshalXML(t *testing.T) {
 	)
 }
 
+func TestCredentialTypeDisplay(t *testing.T) {
+	var ct CredentialType
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4">
+		<SchemeManager>irma-demo</SchemeManager><IssuerID>RU</IssuerID><CredentialID>studentCard</CredentialID>
+		<ForegroundColor>#FFFFFF</ForegroundColor><BackgroundColor>#003B76</BackgroundColor>
+		<DisplayIndex>2</DisplayIndex>
+	</IssueSpecification>`), &ct))
+	require.Equal(t, "#FFFFFF", ct.ForegroundColor)
+	require.Equal(t, "#003B76", ct.BackgroundColor)
+	require.Equal(t, 2, *ct.DisplayIndex)
+
+	one := 1
+	a, b := credtype("irma-demo.a.a"), credtype("irma-demo.b.b")
+	c := credtype("irma-demo.c.c")
+	c.DisplayIndex = &one
+	types := []*CredentialType{b, &ct, a, c}
+	SortCredentialTypes(types)
+	require.Equal(t, []*CredentialType{c, &ct, a, b}, types)
+}
+
 func TestSchemeLanguageValidation(t *testing.T) {
 	conf := parseConfiguration(t)
 	langs := []string{"en", "nl"}
@@ -1536,26 +2507,71 @@ func TestDeleteScheme(t *testing.T) {
 	}
 }
 
-func TestParseKeysFolderConcurrency(t *testing.T) {
+func TestPublicKeyConcurrency(t *testing.T) {
 	conf := parseConfiguration(t)
+	issuerid := NewIssuerIdentifier("irma-demo.MijnOverheid")
 	grp := sync.WaitGroup{}
 
 	for j := 0; j < 1000; j++ {
-		// Clear map for next iteration
-		conf.publicKeys = concmap.New[PublicKeyIdentifier, *gabikeys.PublicKey]()
+		// Clear cache for next iteration, and keep it small so that keys are evicted concurrently
+		conf.publicKeys = concmap.NewLRU[PublicKeyIdentifier, *gabikeys.PublicKey](2)
 
 		for i := 0; i < 10; i++ {
 			grp.Add(1)
-			go func() {
-				require.NoError(t, conf.parseKeysFolder(NewIssuerIdentifier("irma-demo.MijnOverheid")))
+			go func(counter uint) {
+				pk, err := conf.PublicKey(issuerid, counter)
+				assert.NoError(t, err)
+				assert.NotNil(t, pk)
 				grp.Done()
-			}()
+			}(uint(i % 3))
 		}
 
 		grp.Wait()
 	}
 }
 
+func TestPublicKeyCache(t *testing.T) {
+	conf, err := NewConfiguration("testdata/irma_configuration", ConfigurationOptions{PublicKeyCacheSize: 2, IgnorePrivateKeys: true})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Zero(t, conf.publicKeys.Len())
+
+	issuerid := NewIssuerIdentifier("irma-demo.RU")
+	pk0, err := conf.PublicKey(issuerid, 0)
+	require.NoError(t, err)
+	require.NotNil(t, pk0)
+	require.Equal(t, uint(0), pk0.Counter)
+	require.Equal(t, "irma-demo.RU", pk0.Issuer)
+	require.Equal(t, 1, conf.publicKeys.Len())
+
+	// Only the requested keys are parsed, and the least recently used key is evicted
+	_, err = conf.PublicKey(issuerid, 1)
+	require.NoError(t, err)
+	pk, err := conf.PublicKey(issuerid, 0)
+	require.NoError(t, err)
+	require.Same(t, pk0, pk)
+	_, err = conf.PublicKey(issuerid, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, conf.publicKeys.Len())
+	require.True(t, conf.publicKeys.IsSet(PublicKeyIdentifier{issuerid, 0}))
+	require.False(t, conf.publicKeys.IsSet(PublicKeyIdentifier{issuerid, 1}))
+
+	// Evicted keys are parsed again
+	pk, err = conf.PublicKey(issuerid, 1)
+	require.NoError(t, err)
+	require.NotNil(t, pk)
+	require.Equal(t, uint(1), pk.Counter)
+
+	// Nonexisting keys are not cached
+	pk, err = conf.PublicKey(issuerid, 3)
+	require.NoError(t, err)
+	require.Nil(t, pk)
+	pk, err = conf.PublicKey(NewIssuerIdentifier("nonexisting.issuer"), 0)
+	require.NoError(t, err)
+	require.Nil(t, pk)
+	require.Equal(t, 2, conf.publicKeys.Len())
+}
+
 func TestInstallSchemeUnstableRemote(t *testing.T) {
 	testSchemeID := NewSchemeManagerIdentifier("test")
 	testSchemeURL := "http://localhost:48681/irma_configuration/test"
@@ -0,0 +1,150 @@
+package irma
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// IssuerKeyPairOptions contains the parameters for GenerateIssuerKeyPair.
+type IssuerKeyPairOptions struct {
+	// KeyLength in bits, one of gabikeys.DefaultKeyLengths (default 2048).
+	KeyLength int
+	// NumAttributes is the amount of attributes the key pair supports (default 12).
+	NumAttributes int
+	// ExpiryDate of the key pair (default one year from now).
+	ExpiryDate time.Time
+	// Counter of the key pair (default one more than the highest counter of the issuer's public keys).
+	Counter *uint
+	// PrivateKeyFile and PublicKeyFile to write the key pair to (default
+	// PrivateKeys/$counter.xml and PublicKeys/$counter.xml within the issuer directory).
+	PrivateKeyFile, PublicKeyFile string
+	// Overwrite existing key files.
+	Overwrite bool
+}
+
+// GenerateIssuerKeyPair generates a new issuer private/public key pair for the issuer in the
+// specified directory, and writes it to the issuer's PrivateKeys and PublicKeys folders (or the
+// files specified in the options). If the directory contains an issuer description, the key pair
+// is validated against the scheme before it is generated: the issuer must belong to the scheme
+// containing it, and the key pair must support enough attributes for all of its credential types.
+// Generating a key pair may take several minutes.
+func GenerateIssuerKeyPair(dir string, opts IssuerKeyPairOptions) (*gabikeys.PrivateKey, *gabikeys.PublicKey, error) {
+	if opts.KeyLength == 0 {
+		opts.KeyLength = 2048
+	}
+	if opts.NumAttributes == 0 {
+		opts.NumAttributes = 12
+	}
+	if opts.ExpiryDate.IsZero() {
+		opts.ExpiryDate = time.Now().AddDate(1, 0, 0)
+	}
+	sysParams, ok := gabikeys.DefaultSystemParameters[opts.KeyLength]
+	if !ok {
+		return nil, nil, errors.Errorf("Unsupported key length, should be one of %v", gabikeys.DefaultKeyLengths)
+	}
+	if err := common.AssertPathExists(dir); err != nil {
+		return nil, nil, errors.WrapPrefix(err, "Nonexisting path specified", 0)
+	}
+	if err := validateIssuerKeyPairOptions(dir, opts); err != nil {
+		return nil, nil, err
+	}
+
+	var counter uint
+	if opts.Counter != nil {
+		counter = *opts.Counter
+	} else {
+		var err error
+		if counter, err = NextIssuerKeyCounter(dir); err != nil {
+			return nil, nil, err
+		}
+	}
+	filename := strconv.FormatUint(uint64(counter), 10) + ".xml"
+	if opts.PrivateKeyFile == "" {
+		opts.PrivateKeyFile = filepath.Join(dir, "PrivateKeys", filename)
+	}
+	if opts.PublicKeyFile == "" {
+		opts.PublicKeyFile = filepath.Join(dir, "PublicKeys", filename)
+	}
+	if !opts.Overwrite {
+		if err := common.AssertPathNotExists(opts.PrivateKeyFile, opts.PublicKeyFile); err != nil {
+			return nil, nil, errors.WrapPrefix(err, "key file already exists, will not overwrite", 0)
+		}
+	}
+
+	sk, pk, err := gabikeys.GenerateKeyPair(sysParams, opts.NumAttributes, counter, opts.ExpiryDate)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range []string{opts.PrivateKeyFile, opts.PublicKeyFile} {
+		if err = common.EnsureDirectoryExists(filepath.Dir(file)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if _, err = sk.WriteToFile(opts.PrivateKeyFile, opts.Overwrite); err != nil {
+		return nil, nil, errors.WrapPrefix(err, "failed to write private key", 0)
+	}
+	if _, err = pk.WriteToFile(opts.PublicKeyFile, opts.Overwrite); err != nil {
+		return nil, nil, errors.WrapPrefix(err, "failed to write public key", 0)
+	}
+	return sk, pk, nil
+}
+
+// NextIssuerKeyCounter returns the counter for a new key pair of the issuer in the specified
+// directory: one more than the highest counter of its public keys, or 0 if it has none.
+func NextIssuerKeyCounter(dir string) (uint, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "PublicKeys", "*.xml"))
+	if err != nil {
+		return 0, err
+	}
+	var counter uint
+	for _, file := range files {
+		c, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), ".xml"), 10, 32)
+		if err != nil {
+			return 0, errors.Errorf("invalid public key filename %s", file)
+		}
+		if uint(c) >= counter {
+			counter = uint(c) + 1
+		}
+	}
+	return counter, nil
+}
+
+func validateIssuerKeyPairOptions(dir string, opts IssuerKeyPairOptions) error {
+	issuer := &Issuer{}
+	exists, err := readXMLFile(filepath.Join(dir, "description.xml"), issuer)
+	if err != nil || !exists {
+		return err
+	}
+	if issuer.ID != filepath.Base(dir) {
+		return errors.Errorf("Issuer %s has wrong directory name %s", issuer.ID, filepath.Base(dir))
+	}
+	schemeid, err := issuerSchemeID(filepath.Dir(dir))
+	if err != nil {
+		return err
+	}
+	if issuer.SchemeManagerID != schemeid {
+		return errors.Errorf("Issuer %s has wrong SchemeManager %s", issuer.ID, issuer.SchemeManagerID)
+	}
+
+	// Check that the key pair supports enough attributes for all credential types of the issuer,
+	// like Configuration.ValidateKeys does for the latest public key
+	return common.IterateSubfolders(filepath.Join(dir, "Issues"), func(credtypedir string, _ os.FileInfo) error {
+		credtype := &CredentialType{}
+		exists, err := readXMLFile(filepath.Join(credtypedir, "description.xml"), credtype)
+		if err != nil || !exists {
+			return err
+		}
+		if required := len(credtype.AttributeTypes) + 2; opts.NumAttributes < required {
+			return errors.Errorf("key pair would support %d attributes, but credential type %s requires %d",
+				opts.NumAttributes, credtype.ID, required)
+		}
+		return nil
+	})
+}
@@ -105,7 +105,7 @@ func (_ *PrivateKeyRingFolder) parseFilename(filename string) (*IssuerIdentifier
 }
 
 func (p *PrivateKeyRingFolder) readFile(filename string, id IssuerIdentifier) (*gabikeys.PrivateKey, error) {
-	scheme := p.conf.SchemeManagers[id.SchemeManagerIdentifier()]
+	scheme := p.conf.GetSchemeManagers()[id.SchemeManagerIdentifier()]
 	if scheme == nil {
 		return nil, errors.Errorf("Private key of issuer %s belongs to unknown scheme", id.String())
 	}
@@ -187,13 +187,13 @@ func newPrivateKeyRingScheme(conf *Configuration) (*privateKeyRingScheme, error)
 }
 
 func (p *privateKeyRingScheme) counters(issuerid IssuerIdentifier) (i []uint, err error) {
-	scheme := p.conf.SchemeManagers[issuerid.SchemeManagerIdentifier()]
+	scheme := p.conf.GetSchemeManagers()[issuerid.SchemeManagerIdentifier()]
 	return matchKeyPattern(filepath.Join(scheme.path(), issuerid.Name(), "PrivateKeys", "*"))
 }
 
 func (p *privateKeyRingScheme) Get(id IssuerIdentifier, counter uint) (*gabikeys.PrivateKey, error) {
 	schemeID := id.SchemeManagerIdentifier()
-	scheme := p.conf.SchemeManagers[schemeID]
+	scheme := p.conf.GetSchemeManagers()[schemeID]
 	if scheme == nil {
 		return nil, errors.Errorf("Private key of issuer %s belongs to unknown scheme", id.String())
 	}
@@ -283,7 +283,7 @@ func (p *privateKeyRingMerge) Iterate(id IssuerIdentifier, f func(sk *gabikeys.P
 }
 
 func validatePrivateKey(issuerid IssuerIdentifier, sk *gabikeys.PrivateKey, conf *Configuration) error {
-	if _, ok := conf.Issuers[issuerid]; !ok {
+	if _, ok := conf.GetIssuers()[issuerid]; !ok {
 		return errors.Errorf("Private key %d of issuer %s belongs to an unknown issuer", sk.Counter, issuerid.String())
 	}
 	pk, err := conf.PublicKey(issuerid, sk.Counter)
@@ -298,7 +298,7 @@ func validatePrivateKey(issuerid IssuerIdentifier, sk *gabikeys.PrivateKey, conf
 	}
 	if sk.RevocationSupported() != pk.RevocationSupported() {
 		msg := fmt.Sprintf("revocation support of private key %d of issuer %s is not consistent with corresponding public key", sk.Counter, issuerid.String())
-		if conf.SchemeManagers[issuerid.SchemeManagerIdentifier()].Demo {
+		if conf.GetSchemeManagers()[issuerid.SchemeManagerIdentifier()].Demo {
 			Logger.Warn(msg)
 		} else {
 			return errors.Errorf(msg)
@@ -308,7 +308,7 @@ func validatePrivateKey(issuerid IssuerIdentifier, sk *gabikeys.PrivateKey, conf
 }
 
 func validatePrivateKeyRing(ring PrivateKeyRing, conf *Configuration) error {
-	for issuerid := range conf.Issuers {
+	for issuerid := range conf.GetIssuers() {
 		err := ring.Iterate(issuerid, func(sk *gabikeys.PrivateKey) error {
 			return validatePrivateKey(issuerid, sk, conf)
 		})
@@ -2,6 +2,8 @@ package irma
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/url"
 	"regexp"
@@ -177,16 +179,16 @@ type ClientToken string
 
 // ParseClientToken parses a string to a ClientToken after validating the input.
 func ParseClientToken(input string) (ClientToken, error) {
-	if match := regexp.MustCompile(common.SessionTokenRegex).MatchString(input); match {
+	if match := regexp.MustCompile("^" + common.SessionTokenRegex + "$").MatchString(input); match {
 		return ClientToken(input), nil
 	} else {
 		return "", errors.New("string did not pass input validation for clientToken")
 	}
 }
 
-// ParseRequestorToken parses a string to a ClientToken after validating the input.
+// ParseRequestorToken parses a string to a RequestorToken after validating the input.
 func ParseRequestorToken(input string) (RequestorToken, error) {
-	if match := regexp.MustCompile(common.SessionTokenRegex).MatchString(input); match {
+	if match := regexp.MustCompile("^" + common.SessionTokenRegex + "$").MatchString(input); match {
 		return RequestorToken(input), nil
 	} else {
 		return "", errors.New("string did not pass input validation for requestorToken")
@@ -230,6 +232,8 @@ const (
 	ErrorProtocolVersionNotSupported = ErrorType("protocolVersionNotSupported")
 	// Error in HTTP communication
 	ErrorTransport = ErrorType("transport")
+	// The server could not be reached; the response is queued to be sent later
+	ErrorResponseQueued = ErrorType("responseQueued")
 	// HTTPS required
 	ErrorHTTPS = ErrorType("https")
 	// Invalid client JWT in first IRMA message
@@ -331,6 +335,58 @@ type KeyshareChangePinClaims struct {
 	KeyshareChangePinData
 }
 
+type KeyshareRecoveryRequest struct {
+	Username string `json:"id"`
+	Email    string `json:"email"`
+	Language string `json:"language,omitempty"`
+}
+
+type KeyshareRecovery struct {
+	RecoveryJWT string `json:"recovery_jwt"`
+}
+
+type KeyshareRecoveryData struct {
+	Username  string `json:"id"`
+	Token     string `json:"token"`
+	Pin       string `json:"pin"`
+	PublicKey []byte `json:"publickey"`
+}
+
+type KeyshareRecoveryClaims struct {
+	jwt.RegisteredClaims
+	KeyshareRecoveryData
+}
+
+// KeyshareDeviceAdd registers the public key of a new device to a keyshare account. Its JWT must
+// be signed by one of the devices already registered to the account.
+type KeyshareDeviceAdd struct {
+	DeviceAddJWT string `json:"jwt"`
+}
+
+type KeyshareDeviceAddData struct {
+	Username  string `json:"id"`
+	Pin       string `json:"pin"`
+	PublicKey []byte `json:"publickey"`
+	Name      string `json:"name,omitempty"`
+}
+
+type KeyshareDeviceAddClaims struct {
+	jwt.RegisteredClaims
+	KeyshareDeviceAddData
+}
+
+// KeyshareDevice is a device registered to a keyshare account.
+type KeyshareDevice struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// KeyshareDeviceID returns the identifier of the device with the specified marshaled public key.
+func KeyshareDeviceID(pk []byte) string {
+	hash := sha256.Sum256(pk)
+	return hex.EncodeToString(hash[:])
+}
+
 type KeyshareAuthRequest struct {
 	AuthRequestJWT string `json:"auth_request_jwt"`
 }
@@ -513,3 +569,22 @@ type FrontendSessionStatus struct {
 	Status      ServerStatus `json:"status"`
 	NextSession *Qr          `json:"nextSession,omitempty"`
 }
+
+// FrontendWebSocketMessage is exchanged between the frontend and the IRMA server over the WebSocket
+// at /session/{clientToken}/frontend/ws, in both directions.
+type FrontendWebSocketMessage struct {
+	Type          FrontendWebSocketMessageType `json:"type"`
+	Authorization FrontendAuthorization        `json:"authorization,omitempty"`
+	Status        *FrontendSessionStatus       `json:"status,omitempty"`
+	Error         *RemoteError                 `json:"error,omitempty"`
+}
+
+type FrontendWebSocketMessageType string
+
+const (
+	FrontendWebSocketAuthorize        FrontendWebSocketMessageType = "authorize"        // Sent by the frontend if it cannot set the Authorization header
+	FrontendWebSocketCancel           FrontendWebSocketMessageType = "cancel"           // Sent by the frontend to cancel the session
+	FrontendWebSocketPairingCompleted FrontendWebSocketMessageType = "pairingcompleted" // Sent by the frontend when the pairing code is entered
+	FrontendWebSocketStatus           FrontendWebSocketMessageType = "status"           // Sent by the server when the session status changes
+	FrontendWebSocketError            FrontendWebSocketMessageType = "error"            // Sent by the server when a frontend message cannot be handled
+)
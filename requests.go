@@ -23,6 +23,7 @@ const (
 	LDContextSignatureRequest       = "https://irma.app/ld/request/signature/v2"
 	LDContextIssuanceRequest        = "https://irma.app/ld/request/issuance/v2"
 	LDContextRevocationRequest      = "https://irma.app/ld/request/revocation/v1"
+	LDContextResultsRequest         = "https://irma.app/ld/request/results/v1"
 	LDContextFrontendOptionsRequest = "https://irma.app/ld/request/frontendoptions/v1"
 	LDContextClientSessionRequest   = "https://irma.app/ld/request/client/v1"
 	LDContextSessionOptions         = "https://irma.app/ld/options/v1"
@@ -126,10 +127,14 @@ type ServerJwt struct {
 // RequestorBaseRequest contains fields present in all RequestorRequest types
 // with which the requestor configures an IRMA session.
 type RequestorBaseRequest struct {
-	ResultJwtValidity int              `json:"validity,omitempty"`    // Validity of session result JWT in seconds
-	ClientTimeout     int              `json:"timeout,omitempty"`     // Wait this many seconds for the IRMA app to connect before the session times out
-	CallbackURL       string           `json:"callbackUrl,omitempty"` // URL to post session result to
-	NextSession       *NextSessionData `json:"nextSession,omitempty"` // Data about session to start after this one (if any)
+	ResultJwtValidity  int              `json:"validity,omitempty"`           // Validity of session result JWT in seconds
+	ClientTimeout      int              `json:"timeout,omitempty"`            // Wait this many seconds for the IRMA app to connect before the session times out
+	CallbackURL        string           `json:"callbackUrl,omitempty"`        // URL to post session result to
+	NextSession        *NextSessionData `json:"nextSession,omitempty"`        // Data about session to start after this one (if any)
+	MaxSessionLifetime int              `json:"maxSessionLifetime,omitempty"` // Overrides the maximum duration of the session once the IRMA app connects in minutes
+	RequirePairing     bool             `json:"requirePairing,omitempty"`     // Require pairing of the frontend and the IRMA app before the app receives the session request
+	ResultLifetime     int              `json:"resultLifetime,omitempty"`     // Overrides how long the session result remains available after the session has finished in minutes
+	NotifyEmail        string           `json:"notifyEmail,omitempty"`        // Email address to which a summary of the outcome of the session is sent, if enabled in the server
 }
 
 type NextSessionData struct {
@@ -191,6 +196,12 @@ type RevocationJwt struct {
 	Request *RevocationRequest `json:"revrequest"`
 }
 
+// ResultsJwt is a requestor JWT requesting the results of the sessions of the requestor.
+type ResultsJwt struct {
+	ServerJwt
+	Request *ResultsRequest `json:"resrequest"`
+}
+
 // A RequestorJwt contains an IRMA session object.
 type RequestorJwt interface {
 	Action() Action
@@ -246,6 +257,13 @@ type RevocationRequest struct {
 	Issued         int64                    `json:"issued,omitempty"`
 }
 
+// ResultsRequest requests the results of the sessions of the requestor that finished since the
+// specified time, as far as the server still retains them.
+type ResultsRequest struct {
+	LDContext string    `json:"@context,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
 type NonRevocationRequest struct {
 	Tolerance uint64                      `json:"tolerance,omitempty"`
 	Updates   map[uint]*revocation.Update `json:"updates,omitempty"`
@@ -306,6 +324,13 @@ func (r *RevocationRequest) Validate() error {
 	return nil
 }
 
+func (r *ResultsRequest) Validate() error {
+	if r.LDContext != LDContextResultsRequest {
+		return errors.New("not a results request")
+	}
+	return nil
+}
+
 var (
 	bigZero = big.NewInt(0)
 	bigOne  = big.NewInt(1)
@@ -341,7 +366,7 @@ func (b *BaseRequest) RevocationSupported() bool {
 
 func (b *BaseRequest) Validate(conf *Configuration) error {
 	for credid := range b.Revocation {
-		credtyp, ok := conf.CredentialTypes[credid]
+		credtyp, ok := conf.GetCredentialTypes()[credid]
 		if !ok {
 			return errors.Errorf("cannot requet nonrevocation proof for %s: unknown credential type", credid)
 		}
@@ -475,8 +500,13 @@ func (cdc AttributeConDisCon) Validate(conf *Configuration) error {
 		for _, con := range discon {
 			var nonsingleton *CredentialTypeIdentifier
 			for _, attr := range con {
+				// The value of a randomblind attribute is randomly generated by the issuer and the
+				// client together during issuance, so requesting a specific value makes no sense
+				if attrtype := conf.GetAttributeTypes()[attr.Type]; attrtype != nil && attrtype.RandomBlind && attr.Value != nil {
+					return &SessionError{ErrorType: ErrorRandomBlind, Err: errors.Errorf("cannot request specific value for randomblind attribute %s", attr.Type)}
+				}
 				typ := attr.Type.CredentialTypeIdentifier()
-				if !conf.CredentialTypes[typ].IsSingleton {
+				if !conf.GetCredentialTypes()[typ].IsSingleton {
 					if nonsingleton != nil && *nonsingleton != typ {
 						return errors.New("Multiple non-singletons within one inner conjunction are not allowed")
 					} else {
@@ -627,10 +657,13 @@ func (cr *CredentialRequest) Info(conf *Configuration, metadataVersion byte, iss
 // the credential type is known, all required attributes are present and no unknown attributes
 // are given.
 func (cr *CredentialRequest) Validate(conf *Configuration) error {
-	credtype := conf.CredentialTypes[cr.CredentialTypeID]
+	credtype := conf.GetCredentialTypes()[cr.CredentialTypeID]
 	if credtype == nil {
 		return &SessionError{ErrorType: ErrorUnknownIdentifier, Err: errors.New("Credential request of unknown credential type")}
 	}
+	if scheme := conf.GetSchemeManagers()[cr.CredentialTypeID.SchemeManagerIdentifier()]; scheme != nil && scheme.Deprecated(time.Now()) {
+		return &SessionError{ErrorType: ErrorInvalidSchemeManager, Err: errors.Errorf("scheme %s is deprecated, its credentials can no longer be issued", scheme.ID)}
+	}
 
 	// Check that there are no attributes in the credential request that aren't
 	// in the credential descriptor.
@@ -658,6 +691,11 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 		if present && attrtype.RandomBlind {
 			return &SessionError{ErrorType: ErrorRandomBlind, Err: errors.New("randomblind attribute cannot be set in credential request")}
 		}
+		if present {
+			if _, err := attrtype.EncodeValue(cr.Attributes[attrtype.ID]); err != nil {
+				return &SessionError{ErrorType: ErrorInvalidRequest, Err: err}
+			}
+		}
 	}
 
 	// Check that the random blind attributes match between client configuration / CredentialRequest
@@ -693,7 +731,7 @@ func (cr *CredentialRequest) AttributeList(
 		return nil, err
 	}
 
-	credtype := conf.CredentialTypes[cr.CredentialTypeID]
+	credtype := conf.GetCredentialTypes()[cr.CredentialTypeID]
 	if !credtype.RevocationSupported() && revocationAttr != nil {
 		return nil, errors.Errorf("cannot specify revocationAttr: credtype %s does not support revocation", cr.CredentialTypeID.String())
 	}
@@ -723,6 +761,7 @@ func (cr *CredentialRequest) AttributeList(
 		}
 		attrs[i+1] = new(big.Int)
 		if str, present := cr.Attributes[attrtype.ID]; present {
+			str, _ = attrtype.EncodeValue(str) // validated above
 			// Set attribute to str << 1 + 1
 			attrs[i+1].SetBytes([]byte(str))
 			if meta.Version() >= 0x03 {
@@ -1104,6 +1143,17 @@ func (claims *RevocationJwt) Sign(method jwt.SigningMethod, key interface{}) (st
 	return jwt.NewWithClaims(method, claims).SignedString(key)
 }
 
+func (claims *ResultsJwt) Valid() error {
+	if time.Time(claims.IssuedAt).After(time.Now()) {
+		return errors.New("Results jwt not yet valid")
+	}
+	return nil
+}
+
+func (claims *ResultsJwt) Sign(method jwt.SigningMethod, key interface{}) (string, error) {
+	return jwt.NewWithClaims(method, claims).SignedString(key)
+}
+
 func (claims *ServiceProviderJwt) Action() Action { return ActionDisclosing }
 
 func (claims *SignatureRequestorJwt) Action() Action { return ActionSigning }
@@ -594,7 +594,7 @@ func (rs *RevocationStorage) updateAccumulatorTimes() error {
 // Methods to update from remote revocation server
 
 func (rs *RevocationStorage) SyncDB(id CredentialTypeIdentifier) error {
-	ct := rs.conf.CredentialTypes[id]
+	ct := rs.conf.GetCredentialTypes()[id]
 	if ct == nil {
 		return ErrorUnknownCredentialType
 	}
@@ -629,7 +629,7 @@ func (rs *RevocationStorage) SyncIfOld(id CredentialTypeIdentifier, maxage uint6
 // SaveIssuanceRecord either stores the issuance record locally, if we are the revocation server of
 // the crecential type, or it signs and sends it to the remote revocation server.
 func (rs *RevocationStorage) SaveIssuanceRecord(id CredentialTypeIdentifier, rec *IssuanceRecord, sk *gabikeys.PrivateKey) error {
-	credtype := rs.conf.CredentialTypes[id]
+	credtype := rs.conf.GetCredentialTypes()[id]
 	if credtype == nil {
 		return ErrorUnknownCredentialType
 	}
@@ -707,15 +707,35 @@ func updateURL(id CredentialTypeIdentifier, conf *Configuration, rs RevocationSe
 	if settings != nil && settings.RevocationServerURL != "" {
 		return []string{settings.RevocationServerURL}, nil
 	} else {
-		credtype := conf.CredentialTypes[id]
-		if credtype == nil {
-			return nil, ErrorUnknownCredentialType
-		}
-		if !credtype.RevocationSupported() {
-			return nil, errors.New("credential type does not support revocation")
+		return conf.RevocationServers(id)
+	}
+}
+
+// RevocationServers returns the URLs of the revocation servers declared in the description of the
+// specified credential type, from which revocation updates are fetched and to which issuers send
+// their issuance records.
+func (conf *Configuration) RevocationServers(id CredentialTypeIdentifier) ([]string, error) {
+	credtype := conf.GetCredentialTypes()[id]
+	if credtype == nil {
+		return nil, ErrorUnknownCredentialType
+	}
+	if !credtype.RevocationSupported() {
+		return nil, errors.New("credential type does not support revocation")
+	}
+	return credtype.RevocationServers, nil
+}
+
+// RevocationCredentialTypes returns the credential types that support revocation, sorted by
+// identifier.
+func (conf *Configuration) RevocationCredentialTypes() []CredentialTypeIdentifier {
+	var ids []CredentialTypeIdentifier
+	for id, credtype := range conf.GetCredentialTypes() {
+		if credtype.RevocationSupported() {
+			ids = append(ids, id)
 		}
-		return credtype.RevocationServers, nil
 	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	return ids
 }
 
 func (rs *RevocationStorage) Load(debug bool, dbtype, connstr string, settings RevocationSettings) error {
@@ -818,7 +838,7 @@ func (rs *RevocationStorage) SetRevocationUpdates(b *BaseRequest) error {
 	}
 	var err error
 	for credid, params := range b.Revocation {
-		ct := rs.conf.CredentialTypes[credid]
+		ct := rs.conf.GetCredentialTypes()[credid]
 		if ct == nil {
 			return ErrorUnknownCredentialType
 		}
@@ -873,7 +893,7 @@ func (client RevocationClient) PostIssuanceRecord(id CredentialTypeIdentifier, s
 
 func (client RevocationClient) FetchUpdateFrom(id CredentialTypeIdentifier, pkcounter uint, from uint64) (*revocation.Update, error) {
 	// First fetch accumulator + latest few events
-	ct := client.Conf.CredentialTypes[id]
+	ct := client.Conf.GetCredentialTypes()[id]
 	if ct == nil {
 		return nil, ErrorUnknownCredentialType
 	}
@@ -905,7 +925,7 @@ func (client RevocationClient) FetchUpdateFrom(id CredentialTypeIdentifier, pkco
 		go func(i [2]uint64) {
 			events := &revocation.EventList{ComputeProduct: true}
 			if e := client.getMultiple(
-				client.Conf.CredentialTypes[id].RevocationServers,
+				client.Conf.GetCredentialTypes()[id].RevocationServers,
 				fmt.Sprintf("/revocation/%s/events/%d/%d/%d", id, pkcounter, i[0], i[1]),
 				events,
 			); e != nil {
@@ -1126,7 +1146,7 @@ func (rs RevocationSettings) Get(id CredentialTypeIdentifier) *RevocationSetting
 }
 
 func (rs RevocationSettings) fixCase(conf *Configuration) {
-	for id := range conf.CredentialTypes {
+	for id := range conf.GetCredentialTypes() {
 		idlc := NewCredentialTypeIdentifier(strings.ToLower(id.String()))
 		if settings := rs[idlc]; settings != nil {
 			delete(rs, idlc)
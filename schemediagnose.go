@@ -0,0 +1,296 @@
+package irma
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// SchemeProblem is a problem in a scheme found by DiagnoseScheme.
+type SchemeProblem struct {
+	// Path of the file containing the problem, relative to the scheme directory;
+	// empty if the problem concerns the scheme as a whole.
+	Path string
+	Err  error
+}
+
+func (p SchemeProblem) Error() string {
+	if p.Path == "" {
+		return p.Err.Error()
+	}
+	return p.Path + ": " + p.Err.Error()
+}
+
+type schemeDiagnosis struct {
+	dir      string
+	id       string
+	problems []SchemeProblem
+}
+
+func (d *schemeDiagnosis) add(path string, err error) {
+	if rel, relerr := filepath.Rel(d.dir, path); relerr == nil && !strings.HasPrefix(rel, "..") {
+		path = filepath.ToSlash(rel)
+	}
+	d.problems = append(d.problems, SchemeProblem{Path: path, Err: err})
+}
+
+func (d *schemeDiagnosis) addf(path string, format string, args ...interface{}) {
+	d.add(path, errors.Errorf(format, args...))
+}
+
+// DiagnoseScheme checks the scheme in the specified directory end-to-end and returns all problems
+// found, instead of aborting at the first one as ParseSchemeFolder does. It checks the index
+// signature, the hashes of all files in the index, that all files that should be signed are in the
+// index, that all descriptions are valid XML referring to the issuer and scheme they are contained
+// in, that credential types on which others within the scheme depend exist, and that the public
+// keys are valid and correspond to the private keys present. If none of these checks fail, the
+// scheme is parsed and its keys validated as a final check.
+// The scheme is not added to this Configuration.
+func (conf *Configuration) DiagnoseScheme(dir string) []SchemeProblem {
+	d := &schemeDiagnosis{dir: dir}
+	filename, err := common.SchemeFilename(dir)
+	if err != nil {
+		d.add("", err)
+		return d.problems
+	}
+	bts, err := ioutil.ReadFile(filepath.Join(dir, filename))
+	if err != nil {
+		d.add(filename, err)
+		return d.problems
+	}
+	var typ string
+	if d.id, typ, err = common.SchemeInfo(filename, bts); err != nil {
+		d.add(filename, err)
+		return d.problems
+	}
+	if d.id != filepath.Base(dir) {
+		d.addf(filename, "scheme ID %s does not match directory name %s", d.id, filepath.Base(dir))
+	}
+
+	conf.diagnoseIndex(d, SchemeType(typ))
+	if SchemeType(typ) == SchemeTypeIssuer {
+		conf.diagnoseIssuers(d)
+	}
+	if len(d.problems) > 0 {
+		return d.problems
+	}
+
+	// Everything we know to check separately is fine, so parse the scheme to catch the rest
+	temp, err := NewConfiguration(filepath.Dir(dir), ConfigurationOptions{ReadOnly: true})
+	if err != nil {
+		d.add("", err)
+		return d.problems
+	}
+	if _, err = temp.ParseSchemeFolder(dir); err != nil {
+		d.add("", err)
+	} else if err = temp.ValidateKeys(); err != nil {
+		d.add("", err)
+	}
+	return d.problems
+}
+
+func (conf *Configuration) diagnoseIndex(d *schemeDiagnosis, typ SchemeType) {
+	if err := conf.verifySignature(d.dir); err != nil {
+		d.add("index.sig", errors.Errorf("index signature is invalid (%s); re-sign the scheme using irma scheme sign", err.Error()))
+	}
+
+	bts, err := ioutil.ReadFile(filepath.Join(d.dir, "index"))
+	if err != nil {
+		d.add("index", err)
+		return
+	}
+	index := SchemeManagerIndex(make(map[string]SchemeFileHash))
+	if err = index.FromString(string(bts)); err != nil {
+		d.add("index", err)
+		return
+	}
+
+	// Check the hashes of all files in the index, in a deterministic order
+	paths := make([]string, 0, len(index))
+	for path := range index {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !strings.HasPrefix(path, d.id+"/") {
+			d.addf("index", "entry %s is not within scheme %s", path, d.id)
+			continue
+		}
+		file := filepath.Join(d.dir, filepath.FromSlash(strings.TrimPrefix(path, d.id+"/")))
+		exists, err := common.PathExists(file)
+		if err != nil {
+			d.add(file, err)
+			continue
+		}
+		if !exists {
+			d.addf(file, "file in index does not exist")
+			continue
+		}
+		if _, err = conf.readHashedFile(file, index[path]); err != nil {
+			d.addf(file, "file was modified after the scheme was signed; re-sign the scheme using irma scheme sign")
+		}
+	}
+
+	// Check that all files that should be signed are present in the index
+	err = common.WalkDir(d.dir, func(path string, info os.FileInfo) error {
+		if skipSigning(path, info, typ) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := index[d.id+"/"+filepath.ToSlash(rel)]; !ok {
+			d.addf(path, "file is not in the index; re-sign the scheme using irma scheme sign")
+		}
+		return nil
+	})
+	if err != nil {
+		d.add("", err)
+	}
+}
+
+func (conf *Configuration) diagnoseIssuers(d *schemeDiagnosis) {
+	credtypes := map[CredentialTypeIdentifier]*CredentialType{}
+	credtypeFiles := map[CredentialTypeIdentifier]string{}
+
+	err := common.IterateSubfolders(d.dir, func(issuerdir string, _ os.FileInfo) error {
+		// Like ParseSchemeFolder, skip directories without description
+		issuerName := filepath.Base(issuerdir)
+		file := filepath.Join(issuerdir, "description.xml")
+		if exists, err := common.PathExists(file); err != nil || !exists {
+			return err
+		}
+		issuer := &Issuer{}
+		if diagnoseXMLFile(d, file, issuer) {
+			if issuer.ID != issuerName {
+				d.addf(file, "issuer ID %s does not match directory name %s", issuer.ID, issuerName)
+			}
+			if issuer.SchemeManagerID != d.id {
+				d.addf(file, "issuer refers to scheme %s instead of %s", issuer.SchemeManagerID, d.id)
+			}
+		}
+		conf.diagnoseKeys(d, issuerdir)
+
+		credsdir := filepath.Join(issuerdir, "Issues")
+		exists, err := common.PathExists(credsdir)
+		if err != nil || !exists {
+			return err
+		}
+		return common.IterateSubfolders(credsdir, func(credtypedir string, _ os.FileInfo) error {
+			file := filepath.Join(credtypedir, "description.xml")
+			if exists, err := common.PathExists(file); err != nil || !exists {
+				return err
+			}
+			credtype := &CredentialType{}
+			if !diagnoseXMLFile(d, file, credtype) {
+				return nil
+			}
+			if credtype.ID != filepath.Base(credtypedir) {
+				d.addf(file, "credential type ID %s does not match directory name %s", credtype.ID, filepath.Base(credtypedir))
+			}
+			if credtype.IssuerID != issuerName {
+				d.addf(file, "credential type refers to issuer %s instead of %s", credtype.IssuerID, issuerName)
+			}
+			if credtype.SchemeManagerID != d.id {
+				d.addf(file, "credential type refers to scheme %s instead of %s", credtype.SchemeManagerID, d.id)
+			}
+			id := NewCredentialTypeIdentifier(fmt.Sprintf("%s.%s.%s", d.id, issuerName, filepath.Base(credtypedir)))
+			credtypes[id] = credtype
+			credtypeFiles[id] = file
+			return nil
+		})
+	})
+	if err != nil {
+		d.add("", err)
+	}
+
+	// Dependencies on credential types of other schemes cannot be checked here,
+	// as those schemes need not be present
+	ids := make([]CredentialTypeIdentifier, 0, len(credtypes))
+	for id := range credtypes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	for _, id := range ids {
+		for _, discon := range credtypes[id].Dependencies {
+			for _, con := range discon {
+				for _, dep := range con {
+					if dep.Root() == d.id && credtypes[dep] == nil {
+						d.addf(credtypeFiles[id], "dependency on nonexisting credential type %s", dep)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (conf *Configuration) diagnoseKeys(d *schemeDiagnosis, issuerdir string) {
+	files, err := filepath.Glob(filepath.Join(issuerdir, "PublicKeys", "*.xml"))
+	if err != nil {
+		d.add(issuerdir, err)
+		return
+	}
+	for _, file := range files {
+		filename := filepath.Base(file)
+		counter, err := strconv.ParseUint(strings.TrimSuffix(filename, ".xml"), 10, 32)
+		if err != nil {
+			d.addf(file, "public key filename must be its counter followed by .xml")
+			continue
+		}
+		pk, err := gabikeys.NewPublicKeyFromFile(file)
+		if err != nil {
+			d.add(file, err)
+			continue
+		}
+		if pk.Counter != uint(counter) {
+			d.addf(file, "public key has counter %d, which does not match its filename", pk.Counter)
+		}
+
+		skfile := filepath.Join(issuerdir, "PrivateKeys", filename)
+		exists, err := common.PathExists(skfile)
+		if err != nil {
+			d.add(skfile, err)
+			continue
+		}
+		if !exists {
+			continue
+		}
+		sk, err := gabikeys.NewPrivateKeyFromFile(skfile, true)
+		if err != nil {
+			d.add(skfile, err)
+			continue
+		}
+		if sk.Counter != pk.Counter {
+			d.addf(skfile, "private key has counter %d, while the corresponding public key has %d", sk.Counter, pk.Counter)
+		}
+		if new(big.Int).Mul(sk.P, sk.Q).Cmp(pk.N) != 0 {
+			d.addf(skfile, "private key does not correspond to public key %s", filepath.Join("PublicKeys", filename))
+		}
+	}
+}
+
+// diagnoseXMLFile unmarshals the specified file into dest, reporting any problem to d,
+// and returns whether it succeeded.
+func diagnoseXMLFile(d *schemeDiagnosis, file string, dest interface{}) bool {
+	bts, err := ioutil.ReadFile(file)
+	if err != nil {
+		d.add(file, err)
+		return false
+	}
+	if err = xml.Unmarshal(bts, dest); err != nil {
+		d.addf(file, "invalid XML: %s", err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,185 @@
+package irma
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// SchemeChanges contains the issuers, credential types, attribute types and public keys
+// that were added, removed or changed between two versions of an issuer scheme.
+type SchemeChanges struct {
+	AddedIssuers, RemovedIssuers, ChangedIssuers                         []IssuerIdentifier
+	AddedCredentialTypes, RemovedCredentialTypes, ChangedCredentialTypes []CredentialTypeIdentifier
+	AddedAttributeTypes, RemovedAttributeTypes, ChangedAttributeTypes    []AttributeTypeIdentifier
+	AddedPublicKeys, RemovedPublicKeys, ChangedPublicKeys                []PublicKeyIdentifier
+}
+
+// schemeContents contains the parsed contents of an issuer scheme directory, keyed by identifier.
+type schemeContents struct {
+	issuers    map[IssuerIdentifier]*Issuer
+	credtypes  map[CredentialTypeIdentifier]*CredentialType
+	attrtypes  map[AttributeTypeIdentifier]*AttributeType
+	publicKeys map[PublicKeyIdentifier][]byte
+}
+
+// SchemeDiff computes the changes between the issuer scheme in olddir and the one in newdir, so
+// that they can be reviewed before the new version is signed. As the new version is generally not
+// yet signed, the index and its signature are not checked in either directory; use DiagnoseScheme
+// or ParseSchemeFolder to verify the scheme.
+// Changes in the position of attribute types within their credential type are reported as
+// changed attribute types, as they affect existing credentials.
+func SchemeDiff(olddir, newdir string) (*SchemeChanges, error) {
+	oldid, err := issuerSchemeID(olddir)
+	if err != nil {
+		return nil, err
+	}
+	newid, err := issuerSchemeID(newdir)
+	if err != nil {
+		return nil, err
+	}
+	if oldid != newid {
+		return nil, errors.Errorf("cannot compare different schemes %s and %s", oldid, newid)
+	}
+
+	old, err := readSchemeContents(olddir, oldid)
+	if err != nil {
+		return nil, err
+	}
+	new, err := readSchemeContents(newdir, newid)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &SchemeChanges{}
+	changes.AddedIssuers, changes.RemovedIssuers, changes.ChangedIssuers = diffMaps(old.issuers, new.issuers,
+		func(a, b *Issuer) bool { return reflect.DeepEqual(a, b) })
+	changes.AddedCredentialTypes, changes.RemovedCredentialTypes, changes.ChangedCredentialTypes = diffMaps(old.credtypes, new.credtypes,
+		func(a, b *CredentialType) bool { return reflect.DeepEqual(a, b) })
+	changes.AddedAttributeTypes, changes.RemovedAttributeTypes, changes.ChangedAttributeTypes = diffMaps(old.attrtypes, new.attrtypes,
+		func(a, b *AttributeType) bool { return reflect.DeepEqual(a, b) })
+	changes.AddedPublicKeys, changes.RemovedPublicKeys, changes.ChangedPublicKeys = diffMaps(old.publicKeys, new.publicKeys,
+		func(a, b []byte) bool { return bytes.Equal(a, b) })
+	return changes, nil
+}
+
+// Empty returns whether no changes were found.
+func (changes *SchemeChanges) Empty() bool {
+	return len(changes.AddedIssuers)+len(changes.RemovedIssuers)+len(changes.ChangedIssuers)+
+		len(changes.AddedCredentialTypes)+len(changes.RemovedCredentialTypes)+len(changes.ChangedCredentialTypes)+
+		len(changes.AddedAttributeTypes)+len(changes.RemovedAttributeTypes)+len(changes.ChangedAttributeTypes)+
+		len(changes.AddedPublicKeys)+len(changes.RemovedPublicKeys)+len(changes.ChangedPublicKeys) == 0
+}
+
+func issuerSchemeID(dir string) (string, error) {
+	bts, err := ioutil.ReadFile(filepath.Join(dir, "description.xml"))
+	if err != nil {
+		return "", errors.WrapPrefix(err, "not an issuer scheme", 0)
+	}
+	id, typ, err := common.SchemeInfo("description.xml", bts)
+	if err != nil {
+		return "", err
+	}
+	if SchemeType(typ) != SchemeTypeIssuer {
+		return "", errors.Errorf("%s is not an issuer scheme", dir)
+	}
+	return id, nil
+}
+
+func readSchemeContents(dir, id string) (*schemeContents, error) {
+	contents := &schemeContents{
+		issuers:    map[IssuerIdentifier]*Issuer{},
+		credtypes:  map[CredentialTypeIdentifier]*CredentialType{},
+		attrtypes:  map[AttributeTypeIdentifier]*AttributeType{},
+		publicKeys: map[PublicKeyIdentifier][]byte{},
+	}
+	err := common.IterateSubfolders(dir, func(issuerdir string, _ os.FileInfo) error {
+		issuerid := NewIssuerIdentifier(id + "." + filepath.Base(issuerdir))
+		issuer := &Issuer{}
+		exists, err := readXMLFile(filepath.Join(issuerdir, "description.xml"), issuer)
+		if err != nil || !exists {
+			return err
+		}
+		contents.issuers[issuerid] = issuer
+
+		files, err := filepath.Glob(filepath.Join(issuerdir, "PublicKeys", "*.xml"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			counter, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), ".xml"), 10, 32)
+			if err != nil {
+				return errors.Errorf("invalid public key filename %s", file)
+			}
+			if contents.publicKeys[PublicKeyIdentifier{issuerid, uint(counter)}], err = ioutil.ReadFile(file); err != nil {
+				return err
+			}
+		}
+
+		return common.IterateSubfolders(filepath.Join(issuerdir, "Issues"), func(credtypedir string, _ os.FileInfo) error {
+			credid := NewCredentialTypeIdentifier(issuerid.String() + "." + filepath.Base(credtypedir))
+			credtype := &CredentialType{}
+			exists, err := readXMLFile(filepath.Join(credtypedir, "description.xml"), credtype)
+			if err != nil || !exists {
+				return err
+			}
+			contents.credtypes[credid] = credtype
+			for i, attr := range credtype.AttributeTypes {
+				attr.Index = i
+				contents.attrtypes[NewAttributeTypeIdentifier(credid.String()+"."+attr.ID)] = attr
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+func readXMLFile(path string, dest interface{}) (bool, error) {
+	bts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = xml.Unmarshal(bts, dest); err != nil {
+		return false, errors.WrapPrefix(err, "failed to parse "+path, 0)
+	}
+	return true, nil
+}
+
+// diffMaps returns the keys of the entries that were added to, removed from and changed in
+// newmap compared to oldmap, sorted by their string representation.
+func diffMaps[K interface {
+	comparable
+	String() string
+}, V any](oldmap, newmap map[K]V, equal func(a, b V) bool) (added, removed, changed []K) {
+	for k, v := range newmap {
+		if oldv, ok := oldmap[k]; !ok {
+			added = append(added, k)
+		} else if !equal(oldv, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range oldmap {
+		if _, ok := newmap[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	for _, list := range [][]K{added, removed, changed} {
+		sort.Slice(list, func(i, j int) bool { return list[i].String() < list[j].String() })
+	}
+	return
+}
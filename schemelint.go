@@ -0,0 +1,255 @@
+package irma
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// LintSeverity is the severity of a LintFinding.
+type LintSeverity string
+
+const (
+	// LintError is the severity of problems that make the scheme invalid or unusable.
+	LintError LintSeverity = "error"
+	// LintWarning is the severity of problems that degrade how the scheme is presented to users.
+	LintWarning LintSeverity = "warning"
+)
+
+const (
+	minSchemeXMLVersion         = 7
+	minIssuerXMLVersion         = 4
+	minCredentialTypeXMLVersion = 4
+)
+
+// LintFinding is a problem in a scheme found by LintScheme.
+type LintFinding struct {
+	Severity LintSeverity `json:"severity"`
+	// Path of the file containing the problem, relative to the scheme directory.
+	Path string `json:"path"`
+	// Location of the problem within the file as an XPath-like expression, e.g.
+	// /IssueSpecification/Attributes/Attribute[@id='email']/Name; empty if it concerns the entire file.
+	Location string `json:"location,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (f LintFinding) String() string {
+	location := f.Path
+	if f.Location != "" {
+		location += ":" + f.Location
+	}
+	return fmt.Sprintf("%s: %s: %s", f.Severity, location, f.Message)
+}
+
+type schemeLinter struct {
+	dir      string
+	scheme   *SchemeManager
+	findings []LintFinding
+}
+
+// LintScheme checks the descriptions of the issuer scheme in the specified directory for problems
+// that do not necessarily prevent the scheme from being parsed, and returns them as findings:
+// missing translations, duplicate attribute IDs, missing logos, invalid URLs and XML versions
+// that are no longer supported. As it is meant to be used while editing the scheme, e.g. in the
+// CI of scheme repositories, the index and its signature are not checked; use DiagnoseScheme
+// for that.
+func LintScheme(dir string) ([]LintFinding, error) {
+	if _, err := issuerSchemeID(dir); err != nil {
+		return nil, err
+	}
+	l := &schemeLinter{dir: dir}
+
+	file := filepath.Join(dir, "description.xml")
+	scheme := &SchemeManager{}
+	if !l.readXML(file, scheme) {
+		return l.findings, nil
+	}
+	l.scheme = scheme
+	l.checkXMLVersion(file, "/SchemeManager", scheme.XMLVersion, minSchemeXMLVersion)
+	l.checkTranslations(file, "/SchemeManager", scheme, scheme.Languages)
+	if scheme.URL == "" {
+		l.add(LintError, file, "/SchemeManager/Url", "scheme has no URL")
+	} else if u, err := url.Parse(scheme.URL); err == nil && strings.HasPrefix(u.Scheme, "git+") {
+		// Schemes may be distributed through git repositories, see gitTransport
+		if _, _, _, err = parseGitURL(u); err != nil {
+			l.add(LintError, file, "/SchemeManager/Url", "%s", err.Error())
+		}
+	} else {
+		l.checkURL(file, "/SchemeManager/Url", scheme.URL)
+	}
+	l.checkURL(file, "/SchemeManager/KeyshareServer", scheme.KeyshareServer)
+	l.checkURL(file, "/SchemeManager/KeyshareWebsite", scheme.KeyshareWebsite)
+	l.checkURL(file, "/SchemeManager/TimestampServer", scheme.TimestampServer)
+
+	err := common.IterateSubfolders(dir, func(issuerdir string, _ os.FileInfo) error {
+		// Like ParseSchemeFolder, skip directories without description
+		file := filepath.Join(issuerdir, "description.xml")
+		if exists, err := common.PathExists(file); err != nil || !exists {
+			return err
+		}
+		issuer := &Issuer{}
+		if !l.readXML(file, issuer) {
+			return nil
+		}
+		if len(issuer.Languages) == 0 {
+			issuer.Languages = scheme.Languages
+		}
+		l.checkXMLVersion(file, "/Issuer", issuer.XMLVersion, minIssuerXMLVersion)
+		l.checkTranslations(file, "/Issuer", issuer, issuer.Languages)
+		l.checkLogo(issuerdir)
+
+		return common.IterateSubfolders(filepath.Join(issuerdir, "Issues"), func(credtypedir string, _ os.FileInfo) error {
+			file := filepath.Join(credtypedir, "description.xml")
+			if exists, err := common.PathExists(file); err != nil || !exists {
+				return err
+			}
+			credtype := &CredentialType{}
+			if !l.readXML(file, credtype) {
+				return nil
+			}
+			if len(credtype.Languages) == 0 {
+				credtype.Languages = issuer.Languages
+			}
+			l.lintCredentialType(file, credtype)
+			l.checkLogo(credtypedir)
+			return nil
+		})
+	})
+	return l.findings, err
+}
+
+func (l *schemeLinter) lintCredentialType(file string, credtype *CredentialType) {
+	l.checkXMLVersion(file, "/IssueSpecification", credtype.XMLVersion, minCredentialTypeXMLVersion)
+	l.checkTranslations(file, "/IssueSpecification", credtype, credtype.Languages)
+	if credtype.IssueURL != nil {
+		for lang, u := range *credtype.IssueURL {
+			l.checkURL(file, "/IssueSpecification/IssueURL/"+lang, u)
+		}
+	}
+	for i, u := range credtype.RevocationServers {
+		l.checkURL(file, fmt.Sprintf("/IssueSpecification/RevocationServers/RevocationServer[%d]", i+1), u)
+	}
+
+	ids := map[string]bool{}
+	for _, attr := range credtype.AttributeTypes {
+		location := fmt.Sprintf("/IssueSpecification/Attributes/Attribute[@id='%s']", attr.ID)
+		if ids[attr.ID] {
+			l.add(LintError, file, location, "duplicate attribute ID %s", attr.ID)
+		}
+		ids[attr.ID] = true
+		// Revocation attributes are not shown to users
+		if !attr.RevocationAttribute {
+			l.checkTranslations(file, location, attr, credtype.Languages)
+		}
+	}
+}
+
+func (l *schemeLinter) add(severity LintSeverity, file, location, format string, args ...interface{}) {
+	if rel, err := filepath.Rel(l.dir, file); err == nil && !strings.HasPrefix(rel, "..") {
+		file = filepath.ToSlash(rel)
+	}
+	l.findings = append(l.findings, LintFinding{
+		Severity: severity,
+		Path:     file,
+		Location: location,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// readXML unmarshals the specified file into dest, reporting any problem as a finding,
+// and returns whether it succeeded.
+func (l *schemeLinter) readXML(file string, dest interface{}) bool {
+	bts, err := ioutil.ReadFile(file)
+	if err != nil {
+		l.add(LintError, file, "", "%s", err.Error())
+		return false
+	}
+	if err = xml.Unmarshal(bts, dest); err != nil {
+		l.add(LintError, file, "", "invalid XML: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+func (l *schemeLinter) checkXMLVersion(file, location string, version, min int) {
+	if version < min {
+		l.add(LintError, file, location+"/@version", "XML version %d is deprecated and no longer supported, use version %d", version, min)
+	}
+}
+
+func (l *schemeLinter) checkLogo(dir string) {
+	if err := common.AssertPathExists(filepath.Join(dir, "logo.png")); err != nil {
+		l.add(LintWarning, filepath.Join(dir, "logo.png"), "", "logo is missing")
+	}
+}
+
+// checkURL checks that u, if not empty, is an absolute HTTP URL, using HTTPS unless the scheme
+// is a demo scheme.
+func (l *schemeLinter) checkURL(file, location, u string) {
+	if u == "" {
+		return
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		l.add(LintError, file, location, "invalid URL %s", u)
+		return
+	}
+	if parsed.Scheme != "https" && !l.scheme.Demo {
+		l.add(LintError, file, location, "URL %s does not use https", u)
+	}
+}
+
+// checkTranslations checks, like Configuration.validateTranslations, that each TranslatedString
+// member of o contains a nonempty translation for each of the specified languages and the
+// required languages of the scheme. Missing translations in the latter are errors.
+func (l *schemeLinter) checkTranslations(file, location string, o interface{}, langs []string) {
+	required := map[string]bool{}
+	for _, lang := range l.scheme.RequiredLanguages {
+		required[lang] = true
+	}
+	langs = l.scheme.translationLanguages(langs)
+	v := reflect.ValueOf(o)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+		var ts TranslatedString
+		switch val := v.Field(i).Interface().(type) {
+		case TranslatedString:
+			ts = val
+		case *TranslatedString:
+			if val == nil {
+				continue
+			}
+			ts = *val
+		default:
+			continue
+		}
+
+		name := v.Type().Field(i).Name
+		if tag, ok := v.Type().Field(i).Tag.Lookup("xml"); ok && tag != "" {
+			name = strings.Split(tag, ",")[0]
+		}
+		if len(ts) == 0 {
+			l.add(LintWarning, file, location+"/"+name, "%s is empty", name)
+			continue
+		}
+		for _, lang := range ts.validate(langs) {
+			if required[lang] {
+				l.add(LintError, file, location+"/"+name, "missing translation in required language %s", lang)
+			} else {
+				l.add(LintWarning, file, location+"/"+name, "missing %s translation", lang)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package irma
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// unindexedSchemeFiles are the files that a scheme server serves next to the files in the index,
+// which are needed to install the scheme and verify the index.
+var unindexedSchemeFiles = map[string]bool{
+	"index":     true,
+	"index.sig": true,
+	"pk.pem":    true,
+}
+
+// SchemeMirrorHandler returns a handler that serves the schemes in the storage path of this
+// Configuration like their scheme servers do, at /<scheme directory>/<file>, so that it can mirror
+// them for deployments that should not depend on the availability of the scheme servers. Only
+// the index, its signature and the public key of a scheme are served, along with the files in
+// the index that match their hash in the index, so that clients verify the mirrored files
+// against the signature of the scheme as usual. Clients can be pointed to the mirror using
+// ConfigurationOptions.SchemeURLs. The files are read from disk per request, so that schemes
+// updated by UpdateSchemes (e.g. using AutoUpdateSchemes) are served as soon as they are updated.
+func (conf *Configuration) SchemeMirrorHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		bts, err := conf.readMirroredFile(r.URL.Path)
+		if err != nil {
+			Logger.WithFields(logrus.Fields{"path": r.URL.Path, "error": err.Error()}).Warn("mirrored scheme file is not valid")
+		}
+		if bts == nil {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, path.Base(r.URL.Path), time.Time{}, bytes.NewReader(bts))
+	})
+}
+
+// readMirroredFile returns the contents of the file at the specified URL path, or nil if the
+// file is not served by the mirror.
+func (conf *Configuration) readMirroredFile(urlPath string) ([]byte, error) {
+	urlPath = path.Clean("/" + urlPath)
+	parts := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)
+	if len(parts) != 2 || strings.HasPrefix(parts[0], ".") {
+		return nil, nil
+	}
+	dir, file := filepath.Join(conf.Path, parts[0]), parts[1]
+	if isscheme, err := common.IsScheme(dir, false); err != nil || !isscheme {
+		return nil, err
+	}
+
+	if unindexedSchemeFiles[file] {
+		bts, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, nil
+		}
+		return bts, nil
+	}
+
+	indexbts, err := ioutil.ReadFile(filepath.Join(dir, "index"))
+	if err != nil {
+		return nil, nil
+	}
+	index := SchemeManagerIndex(make(map[string]SchemeFileHash))
+	if err = index.FromString(string(indexbts)); err != nil {
+		return nil, err
+	}
+	bts, found, err := conf.readSignedFile(index, dir, filepath.FromSlash(file))
+	if !found || err != nil {
+		return nil, err
+	}
+	return bts, nil
+}
@@ -0,0 +1,167 @@
+package irma
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// The overrides folder (see ConfigurationOptions.OverridesPath) allows developers to iterate on
+// issuers and credential types without running a scheme server or signing scheme indices. It has
+// the same structure as the issuer schemes in irma_configuration:
+//
+//	$scheme/$issuer/description.xml
+//	$scheme/$issuer/PublicKeys/$counter.xml
+//	$scheme/$issuer/Issues/$credentialtype/description.xml
+//
+// each of which is optional and overrides or adds to the corresponding entity of the (signed)
+// scheme $scheme. The description of an issuer may be omitted if it exists in the scheme.
+// The files in the overrides folder are not authenticated, so it must never be used in production.
+
+// parseOverrides parses the issuers, credential types and public keys in the overrides folder
+// into this Configuration, replacing those of the schemes.
+func (conf *Configuration) parseOverrides() error {
+	if conf.options.OverridesPath == "" {
+		return nil
+	}
+	return common.IterateSubfolders(conf.options.OverridesPath, func(dir string, _ os.FileInfo) error {
+		id := NewSchemeManagerIdentifier(filepath.Base(dir))
+		scheme := conf.SchemeManagers[id]
+		if scheme == nil || scheme.Status != SchemeManagerStatusValid {
+			return errors.Errorf("overrides for unknown or invalid scheme %s", id)
+		}
+		Logger.WithField("scheme", id).Warn("Overriding scheme contents with unauthenticated files from ", dir)
+
+		// Parse the overrides using a copy of the scheme, whose index consists of the hashes of
+		// the files in the overrides folder, so that the regular parsing functions can be used
+		override, err := scheme.override(dir)
+		if err != nil {
+			return err
+		}
+		err = common.IterateSubfolders(dir, func(issuerdir string, _ os.FileInfo) error {
+			return override.parseIssuerOverride(conf, issuerdir)
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, credType := range conf.CredentialTypes {
+			if credType.SchemeManagerID == scheme.ID {
+				if err := credType.validateDependencies(conf, []CredentialTypeIdentifier{}, credType.Identifier()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (scheme *SchemeManager) override(dir string) (*SchemeManager, error) {
+	override := *scheme
+	override.storagepath = dir
+	override.index = SchemeManagerIndex{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		bts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(bts)
+		override.index[scheme.ID+"/"+filepath.ToSlash(rel)] = hash[:]
+		return nil
+	})
+	return &override, err
+}
+
+func (scheme *SchemeManager) parseIssuerOverride(conf *Configuration, dir string) error {
+	issuerid := NewIssuerIdentifier(scheme.ID + "." + filepath.Base(dir))
+	issuer := &Issuer{}
+	exists, err := conf.parseSchemeFile(scheme, filepath.Join(filepath.Base(dir), "description.xml"), issuer)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if issuer.XMLVersion < 4 {
+			return errors.New("Unsupported issuer description")
+		}
+		if len(issuer.Languages) == 0 {
+			issuer.Languages = scheme.Languages
+		}
+		if err = conf.validateIssuer(scheme, issuer, dir); err != nil {
+			return err
+		}
+		conf.Issuers[issuerid] = issuer
+	} else if issuer = conf.Issuers[issuerid]; issuer == nil {
+		return errors.Errorf("overrides for unknown issuer %s lack a description.xml", issuerid)
+	}
+	Logger.WithField("issuer", issuerid).Debug("Parsed issuer overrides")
+
+	if err = conf.parseOverrideKeys(issuerid); err != nil {
+		return err
+	}
+	exists, err = common.PathExists(filepath.Join(dir, "Issues"))
+	if err != nil || !exists {
+		return err
+	}
+	return scheme.parseCredentialsFolder(conf, issuer, filepath.Join(dir, "Issues"))
+}
+
+// parseOverrideKeys parses the public keys of the specified issuer in the overrides folder,
+// replacing those of the scheme with the same counter.
+func (conf *Configuration) parseOverrideKeys(issuerid IssuerIdentifier) error {
+	if conf.options.OverridesPath == "" {
+		return nil
+	}
+	files, err := filepath.Glob(conf.overrideKeysPattern(issuerid))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		filename := filepath.Base(file)
+		i, err := strconv.ParseUint(filename[:len(filename)-4], 10, 32)
+		if err != nil {
+			return err
+		}
+		pk, err := conf.parseOverrideKey(issuerid, filename)
+		if err != nil {
+			return err
+		}
+		if pk.Counter != uint(i) {
+			return errors.Errorf("Public key %s of issuer %s has wrong <Counter>", file, issuerid.String())
+		}
+		pk.Issuer = issuerid.String()
+		conf.publicKeys.Set(PublicKeyIdentifier{issuerid, uint(i)}, pk)
+		Logger.WithFields(logrus.Fields{"issuer": issuerid, "counter": i}).Debug("Parsed public key override")
+	}
+	return nil
+}
+
+// parseOverrideKey parses the specified public key file of the issuer in the overrides folder,
+// returning nil if it does not exist.
+func (conf *Configuration) parseOverrideKey(issuerid IssuerIdentifier, filename string) (*gabikeys.PublicKey, error) {
+	if conf.options.OverridesPath == "" {
+		return nil, nil
+	}
+	file := filepath.Join(filepath.Dir(conf.overrideKeysPattern(issuerid)), filename)
+	if exists, err := common.PathExists(file); err != nil || !exists {
+		return nil, err
+	}
+	return gabikeys.NewPublicKeyFromFile(file)
+}
+
+func (conf *Configuration) overrideKeysPattern(issuerid IssuerIdentifier) string {
+	return filepath.Join(conf.options.OverridesPath, issuerid.SchemeManagerIdentifier().String(), issuerid.Name(), "PublicKeys", "*")
+}
@@ -3,11 +3,14 @@ package irma
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
@@ -126,6 +129,61 @@ func (conf *Configuration) DownloadDefaultSchemes() error {
 	return nil
 }
 
+// InstallDefaultSchemes adds the default schemes to this Configuration from the specified file
+// system, which contains a directory per default scheme named after the last segment of its URL,
+// such as the embedded default schemes of the irma server. Each scheme is verified against the
+// pinned public key of DefaultSchemes. Default schemes absent from the file system are downloaded.
+func (conf *Configuration) InstallDefaultSchemes(assets fs.FS) error {
+	for _, s := range DefaultSchemes {
+		name := path.Base(s.URL)
+		if _, err := fs.Stat(assets, name); errors.Is(err, fs.ErrNotExist) {
+			Logger.WithFields(logrus.Fields{"url": s.URL}).Info("Downloading scheme")
+			if err = conf.installScheme(s.URL, s.Publickey, ""); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		Logger.WithFields(logrus.Fields{"scheme": name}).Info("Installing embedded scheme")
+		if err := conf.installSchemeFromFS(assets, name, s.Publickey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (conf *Configuration) installSchemeFromFS(assets fs.FS, name string, publickey []byte) (err error) {
+	if conf.readOnly {
+		return errors.New("cannot install scheme into a read-only configuration")
+	}
+	dir, err := conf.newSchemeDir(name, "")
+	if err != nil {
+		return err
+	}
+	var scheme Scheme
+	defer func() {
+		if err == nil {
+			return
+		}
+		if scheme != nil {
+			_ = scheme.delete(conf)
+		} else {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+
+	if err = common.CopyFS(assets, name, dir); err != nil {
+		return err
+	}
+	// Verify the scheme against the pinned public key, not against the one in the file system
+	if err = common.SaveFile(filepath.Join(dir, "pk.pem"), publickey); err != nil {
+		return err
+	}
+	scheme, err = conf.ParseSchemeFolder(dir)
+	return err
+}
+
 // InstallScheme downloads and adds the specified scheme to this Configuration,
 // provided its signature is valid against the specified key.
 // When an error occurs, this function will revert its changes.
@@ -170,17 +228,40 @@ func (conf *Configuration) AutoUpdateSchemes(interval int) error {
 	return nil
 }
 
+// UpdateSchemes updates all schemes from their remote URLs, notifying the SchemeUpdateListeners
+// of the new or updated entities. A scheme that fails to update does not prevent the others from
+// being updated; it keeps its current data, and the error is returned afterwards.
 func (conf *Configuration) UpdateSchemes() error {
-	for _, scheme := range conf.SchemeManagers {
-		if err := conf.UpdateScheme(scheme, nil); err != nil {
-			return err
+	var (
+		updated = newIrmaIdentifierSet()
+		failed  []string
+		err     error
+	)
+	update := func(scheme Scheme) {
+		if e := conf.UpdateScheme(scheme, updated); e != nil {
+			Logger.WithFields(logrus.Fields{"scheme": scheme.id(), "error": e.Error()}).Warn("failed to update scheme")
+			failed = append(failed, scheme.id())
+			if err == nil {
+				err = e
+			}
 		}
 	}
-	for _, scheme := range conf.RequestorSchemes {
-		if err := conf.UpdateScheme(scheme, nil); err != nil {
-			return err
+	for _, scheme := range conf.GetSchemeManagers() {
+		update(scheme)
+	}
+	for _, scheme := range conf.GetRequestorSchemes() {
+		update(scheme)
+	}
+
+	if !updated.Empty() {
+		Logger.WithField("updated", updated.String()).Info("schemes updated")
+		for _, listener := range conf.SchemeUpdateListeners {
+			listener(conf, updated)
 		}
 	}
+	if err != nil {
+		return errors.WrapPrefix(err, fmt.Sprintf("failed to update scheme(s) %s", strings.Join(failed, ", ")), 0)
+	}
 	return nil
 }
 
@@ -197,9 +278,8 @@ func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifie
 	}
 
 	var (
-		typ        = string(scheme.typ())
-		id         = scheme.id()
-		schemePath = scheme.path()
+		typ = string(scheme.typ())
+		id  = scheme.id()
 	)
 	Logger.WithFields(logrus.Fields{"scheme": id, "type": typ}).Info("checking for updates")
 	shouldUpdate, remoteState, err := conf.checkRemoteScheme(scheme)
@@ -209,6 +289,17 @@ func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifie
 	if !shouldUpdate {
 		return nil
 	}
+	return conf.updateScheme(scheme, remoteState, scheme.idx(), downloaded)
+}
+
+// updateScheme updates the scheme to the specified remote state, downloading the files in the
+// remote index that are new or modified compared to oldIndex, unless the local copy of the file
+// already matches the remote index. If oldIndex is nil, all local files are compared against the
+// remote index, so that only missing or invalid files are downloaded.
+func (conf *Configuration) updateScheme(
+	scheme Scheme, remoteState *remoteSchemeState, oldIndex SchemeManagerIndex, downloaded *IrmaIdentifierSet,
+) error {
+	schemePath := scheme.path()
 
 	// As long as we can write to the scheme directory, we guarantee that either
 	// - updating succeeded, and the updated scheme on disk has been verified and parsed
@@ -231,15 +322,22 @@ func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifie
 	if err = conf.writeSchemeIndex(newSchemePath, remoteState.indexBytes, remoteState.signatureBytes); err != nil {
 		return err
 	}
+	// the timestamp has already been downloaded and verified against the index
+	if err = common.SaveFile(filepath.Join(newSchemePath, "timestamp"), remoteState.timestampBytes); err != nil {
+		return err
+	}
 
 	// iterate over the index and download new and changed files into the temp dir
-	if err = conf.updateSchemeFiles(scheme, remoteState.index, newSchemePath, downloaded); err != nil {
+	if err = conf.updateSchemeFiles(scheme, oldIndex, remoteState.index, newSchemePath, downloaded); err != nil {
 		return err
 	}
 
 	// verify the updated scheme in the temp dir
 	var newconf *Configuration
-	if newconf, err = NewConfiguration(dir, ConfigurationOptions{}); err != nil {
+	if newconf, err = NewConfiguration(dir, ConfigurationOptions{
+		DangerousAllowUnsignedDemoSchemes: conf.options.DangerousAllowUnsignedDemoSchemes,
+		SkipInvalidDescriptions:           conf.options.SkipInvalidDescriptions,
+	}); err != nil {
 		return err
 	}
 	if scheme, err = newconf.ParseSchemeFolder(newSchemePath); err != nil {
@@ -254,8 +352,31 @@ func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifie
 		return err
 	}
 
-	scheme.purge(conf)
-	conf.join(newconf)
+	conf.replaceScheme(scheme, newconf)
+	conf.CallListeners()
+	return nil
+}
+
+// ReloadScheme parses the scheme in the specified directory, which must be a subdirectory of the
+// storage path, and replaces the current data of that scheme (if any) with it. The scheme is first
+// verified and parsed into another *Configuration instance, so that if any error occurs, the
+// current data of the scheme in this instance is left untouched.
+func (conf *Configuration) ReloadScheme(dir string) error {
+	newconf, err := NewConfiguration(conf.Path, ConfigurationOptions{
+		ReadOnly:                          true,
+		DangerousAllowUnsignedDemoSchemes: conf.options.DangerousAllowUnsignedDemoSchemes,
+		SkipInvalidDescriptions:           conf.options.SkipInvalidDescriptions,
+	})
+	if err != nil {
+		return err
+	}
+	scheme, err := newconf.ParseSchemeFolder(dir)
+	if err != nil {
+		return err
+	}
+
+	conf.replaceScheme(scheme, newconf)
+	conf.CallListeners()
 	return nil
 }
 
@@ -321,11 +442,10 @@ func (conf *Configuration) ParseSchemeFolder(dir string) (scheme Scheme, serr er
 // various maps on Configuration instances.
 
 func (conf *Configuration) updateSchemeFiles(
-	scheme Scheme, index SchemeManagerIndex, newschemepath string, downloaded *IrmaIdentifierSet,
+	scheme Scheme, oldIndex, index SchemeManagerIndex, newschemepath string, downloaded *IrmaIdentifierSet,
 ) error {
 	var (
-		transport = NewHTTPTransport(scheme.url(), true)
-		oldIndex  = scheme.idx()
+		transport = conf.schemeTransport(scheme)
 		id        = scheme.id()
 	)
 	for path, newHash := range index {
@@ -340,14 +460,20 @@ func (conf *Configuration) updateSchemeFiles(
 		if known && have && oldHash.Equal(newHash) {
 			continue // nothing to do, we already have this file
 		}
-		// Ensure that the folder in which to write the file exists
-		if err = os.MkdirAll(filepath.Dir(fullpath), 0700); err != nil {
-			return err
-		}
-		// Download the new file, store it in our scheme
+		// Our copy of the file may already match the new index, e.g. when restoring an invalid scheme
 		var bts []byte
-		if bts, err = downloadSignedFile(transport, newschemepath, pathStripped, newHash); err != nil {
-			return err
+		if have {
+			bts, err = conf.readHashedFile(fullpath, newHash)
+		}
+		if !have || err != nil {
+			// Ensure that the folder in which to write the file exists
+			if err = os.MkdirAll(filepath.Dir(fullpath), 0700); err != nil {
+				return err
+			}
+			// Download the new file, store it in our scheme
+			if bts, err = downloadSignedFile(transport, newschemepath, pathStripped, newHash); err != nil {
+				return err
+			}
 		}
 		// handle file contents per scheme type
 		if err = scheme.handleUpdateFile(conf, newschemepath, pathStripped, bts, transport, downloaded); err != nil {
@@ -451,18 +577,18 @@ func (conf *Configuration) reinstallSchemeFromAssets(scheme Scheme) error {
 	return err
 }
 
+// reinstallSchemeFromRemote restores the scheme to its remote version. As the local index cannot
+// be trusted, the local files are compared against the remote index instead, so that only missing
+// or invalid files are downloaded.
 func (conf *Configuration) reinstallSchemeFromRemote(scheme Scheme) error {
 	if conf.readOnly {
 		return errors.New("cannot install scheme into a read-only configuration")
 	}
-	pkbts, err := ioutil.ReadFile(filepath.Join(scheme.path(), "pk.pem"))
+	remoteState, err := conf.checkRemoteTimestamp(scheme)
 	if err != nil {
 		return err
 	}
-	if err = scheme.delete(conf); err != nil {
-		return err
-	}
-	return conf.installScheme(scheme.url(), pkbts, filepath.Base(scheme.path()))
+	return conf.updateScheme(scheme, remoteState, nil, nil)
 }
 
 // newSchemeDir returns the name of a newly created directory into which a scheme can be installed:
@@ -555,6 +681,14 @@ type remoteSchemeState struct {
 	signatureBytes []byte
 }
 
+// schemeTransport returns a transport to the URL from which the scheme is updated.
+func (conf *Configuration) schemeTransport(scheme Scheme) *HTTPTransport {
+	if u, ok := conf.options.SchemeURLs[scheme.id()]; ok {
+		return newHTTPTransport(u, true, true)
+	}
+	return NewHTTPTransport(scheme.url(), true)
+}
+
 func (conf *Configuration) checkRemoteScheme(scheme Scheme) (bool, *remoteSchemeState, error) {
 	remoteState, err := conf.checkRemoteTimestamp(scheme)
 	if err != nil {
@@ -576,28 +710,65 @@ func (conf *Configuration) checkRemoteScheme(scheme Scheme) (bool, *remoteScheme
 	return true, remoteState, nil
 }
 
+// checkRemoteTimestamp downloads and verifies the index and timestamp of the remote scheme.
+// These files are cached, so that checking an unchanged scheme only costs a few conditional
+// requests, or none if the scheme server allows caching them using Cache-Control.
 func (conf *Configuration) checkRemoteTimestamp(scheme Scheme) (*remoteSchemeState, error) {
-	t := NewHTTPTransport(scheme.url(), true)
-	indexbts, err := t.GetBytes("index")
-	if err != nil {
-		return nil, err
+	t := conf.schemeTransport(scheme)
+	state, cached, err := conf.downloadRemoteState(scheme, t)
+	if err != nil && cached {
+		// The files taken from the cache may not match the others if the remote scheme changed
+		// in the meantime, so retry without them
+		for _, file := range []string{"index", "timestamp", "index.sig"} {
+			conf.httpCache.put(t.Server+file, nil)
+		}
+		state, _, err = conf.downloadRemoteState(scheme, t)
 	}
-	sig, err := t.GetBytes("index.sig")
-	if err != nil {
-		return nil, err
+	return state, err
+}
+
+// downloadRemoteState downloads and verifies the index and timestamp of the remote scheme, also
+// returning whether any of the files was taken from the cache without contacting the server.
+func (conf *Configuration) downloadRemoteState(scheme Scheme, t *HTTPTransport) (*remoteSchemeState, bool, error) {
+	var cached bool
+	get := func(file string) ([]byte, error) {
+		bts, fromCache, err := t.getBytesCached(file, conf.httpCache)
+		cached = cached || fromCache
+		return bts, err
 	}
-	timestampbts, err := t.GetBytes("timestamp")
+	state, err := conf.verifyRemoteState(scheme, get)
+	return state, cached, err
+}
+
+func (conf *Configuration) verifyRemoteState(
+	scheme Scheme, get func(file string) ([]byte, error),
+) (*remoteSchemeState, error) {
+	indexbts, err := get("index")
 	if err != nil {
 		return nil, err
 	}
-	pk, err := conf.schemePublicKey(scheme.path())
+	timestampbts, err := get("timestamp")
 	if err != nil {
 		return nil, err
 	}
 
-	// Verify signature and the timestamp hash in the index
-	if err = signed.Verify(pk, indexbts, sig); err != nil {
-		return nil, err
+	// Verify signature and the timestamp hash in the index. Whether the signature may be absent
+	// depends on the remote scheme, not on whether the local copy of the scheme is signed.
+	sig, err := get("index.sig")
+	if err != nil {
+		serr, ok := err.(*SessionError)
+		if !ok || serr.RemoteStatus != http.StatusNotFound || !conf.allowUnsignedDemoScheme(scheme.path()) {
+			return nil, err
+		}
+		sig = nil
+	} else {
+		pk, err := conf.schemePublicKey(scheme.path())
+		if err != nil {
+			return nil, err
+		}
+		if err = signed.Verify(pk, indexbts, sig); err != nil {
+			return nil, err
+		}
 	}
 	index := SchemeManagerIndex(make(map[string]SchemeFileHash))
 	if err = index.FromString(string(indexbts)); err != nil {
@@ -623,6 +794,13 @@ func (conf *Configuration) writeSchemeIndex(dest string, indexbts, sigbts []byte
 	if err := common.SaveFile(filepath.Join(dest, "index"), indexbts); err != nil {
 		return err
 	}
+	if sigbts == nil {
+		// Unsigned demo scheme, see allowUnsignedScheme(); remove any signature of a previous version
+		if err := os.Remove(filepath.Join(dest, "index.sig")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
 	return common.SaveFile(filepath.Join(dest, "index.sig"), sigbts)
 }
 
@@ -696,6 +874,42 @@ func (conf *Configuration) verifySignature(dir string) (err error) {
 	return signed.Verify(pk, indexbts, sig)
 }
 
+// allowUnsignedScheme returns whether the scheme in the specified directory may be used without
+// verifying its index signature: only if the index signature is absent and allowUnsignedDemoScheme
+// allows it. If the index signature is present it is always verified, so that a missing public key
+// does not bypass verification.
+func (conf *Configuration) allowUnsignedScheme(dir string) bool {
+	hassig, err := common.PathExists(filepath.Join(dir, "index.sig"))
+	if err != nil || hassig {
+		return false
+	}
+	return conf.allowUnsignedDemoScheme(dir)
+}
+
+// allowUnsignedDemoScheme returns whether the scheme in the specified directory may be unsigned:
+// only if DangerousAllowUnsignedDemoSchemes is enabled and the scheme description declares a demo scheme.
+func (conf *Configuration) allowUnsignedDemoScheme(dir string) bool {
+	if !conf.options.DangerousAllowUnsignedDemoSchemes {
+		return false
+	}
+
+	filename, err := common.SchemeFilename(dir)
+	if err != nil {
+		return false
+	}
+	bts, err := ioutil.ReadFile(filepath.Join(dir, filename))
+	if err != nil {
+		return false
+	}
+	var description struct {
+		Demo bool `json:"demo" xml:"Demo"`
+	}
+	if err = common.Unmarshal(filename, bts, &description); err != nil {
+		return false
+	}
+	return description.Demo
+}
+
 func (conf *Configuration) schemePublicKey(dir string) (*ecdsa.PublicKey, error) {
 	pkbts, err := ioutil.ReadFile(filepath.Join(dir, "pk.pem"))
 	if err != nil {
@@ -733,7 +947,10 @@ func (conf *Configuration) readHashedFile(path string, hash SchemeFileHash) ([]b
 // parseIndex parses the index file of the specified manager.
 func (conf *Configuration) parseIndex(dir string) (SchemeManagerIndex, error, SchemeManagerStatus) {
 	if err := conf.verifySignature(dir); err != nil {
-		return nil, err, SchemeManagerStatusInvalidSignature
+		if !conf.allowUnsignedScheme(dir) {
+			return nil, err, SchemeManagerStatusInvalidSignature
+		}
+		Logger.WithField("scheme", filepath.Base(dir)).Warn("Using unsigned demo scheme")
 	}
 	path := filepath.Join(dir, "index")
 	if err := common.AssertPathExists(path); err != nil {
@@ -930,6 +1147,17 @@ func (scheme *SchemeManager) Distributed() bool {
 	return len(scheme.KeyshareServer) > 0
 }
 
+// Deprecated returns whether credentials of this scheme can no longer be issued at the
+// specified time, because the scheme is deprecated or no longer valid.
+func (scheme *SchemeManager) Deprecated(t time.Time) bool {
+	return (!scheme.DeprecatedSince.IsZero() && !scheme.DeprecatedSince.After(Timestamp(t))) || scheme.Expired(t)
+}
+
+// Expired returns whether credentials of this scheme are no longer accepted at the specified time.
+func (scheme *SchemeManager) Expired(t time.Time) bool {
+	return !scheme.ValidUntil.IsZero() && !scheme.ValidUntil.After(Timestamp(t))
+}
+
 func (scheme *SchemeManager) id() string { return scheme.ID }
 
 func (scheme *SchemeManager) idx() SchemeManagerIndex { return scheme.index }
@@ -950,25 +1178,17 @@ func (scheme *SchemeManager) setPath(path string) { scheme.storagepath = path }
 
 func (scheme *SchemeManager) parseContents(conf *Configuration) error {
 	err := common.IterateSubfolders(scheme.path(), func(dir string, _ os.FileInfo) error {
-		issuer := &Issuer{}
-
-		exists, err := conf.parseSchemeFile(scheme, filepath.Join(filepath.Base(dir), "description.xml"), issuer)
+		issuer, err := scheme.parseIssuer(conf, dir)
 		if err != nil {
+			if conf.options.SkipInvalidDescriptions {
+				conf.disableIssuer(NewIssuerIdentifier(scheme.ID+"."+filepath.Base(dir)), err)
+				return nil
+			}
 			return err
 		}
-		if !exists {
+		if issuer == nil {
 			return nil
 		}
-		if issuer.XMLVersion < 4 {
-			return errors.New("Unsupported issuer description")
-		}
-
-		if len(issuer.Languages) == 0 {
-			issuer.Languages = scheme.Languages
-		}
-		if err = conf.validateIssuer(scheme, issuer, dir); err != nil {
-			return err
-		}
 
 		conf.Issuers[issuer.Identifier()] = issuer
 		return scheme.parseCredentialsFolder(conf, issuer, filepath.Join(dir, "Issues"))
@@ -978,18 +1198,76 @@ func (scheme *SchemeManager) parseContents(conf *Configuration) error {
 		return err
 	}
 
-	// validate that there are no circular dependencies
-	for _, credType := range conf.CredentialTypes {
-		if credType.SchemeManagerID == scheme.ID {
-			if err := credType.validateDependencies(conf, []CredentialTypeIdentifier{}, credType.Identifier()); err != nil {
+	// validate that there are no circular dependencies. As skipping a credential type may break
+	// the dependencies of others, repeat until none are skipped.
+	for skipped := true; skipped; {
+		skipped = false
+		for _, credType := range conf.CredentialTypes {
+			if credType.SchemeManagerID != scheme.ID {
+				continue
+			}
+			err := credType.validateDependencies(conf, []CredentialTypeIdentifier{}, credType.Identifier())
+			if err == nil {
+				continue
+			}
+			if !conf.options.SkipInvalidDescriptions {
 				return err
 			}
+			conf.disableCredentialType(credType.Identifier(), err)
+			skipped = true
 		}
 	}
 
 	return nil
 }
 
+// parseIssuer parses and validates the issuer description in the specified directory, returning
+// nil if there is none.
+func (scheme *SchemeManager) parseIssuer(conf *Configuration, dir string) (*Issuer, error) {
+	issuer := &Issuer{}
+	exists, err := conf.parseSchemeFile(scheme, filepath.Join(filepath.Base(dir), "description.xml"), issuer)
+	if err != nil || !exists {
+		return nil, err
+	}
+	if issuer.XMLVersion < 4 {
+		return nil, errors.New("Unsupported issuer description")
+	}
+
+	if len(issuer.Languages) == 0 {
+		issuer.Languages = scheme.Languages
+	}
+	if err = conf.validateIssuer(scheme, issuer, dir); err != nil {
+		return nil, err
+	}
+	return issuer, nil
+}
+
+// disableIssuer skips the issuer with the specified ID, whose description is invalid.
+func (conf *Configuration) disableIssuer(id IssuerIdentifier, err error) {
+	Logger.WithField("issuer", id.String()).Warn("skipping invalid issuer: ", err)
+	conf.Warnings = append(conf.Warnings, fmt.Sprintf("Skipped issuer %s: %s", id.String(), err.Error()))
+	conf.DisabledIssuers[id] = err
+}
+
+// disableCredentialType skips the credential type with the specified ID, whose description is
+// invalid, removing it from the configuration if it was already added.
+func (conf *Configuration) disableCredentialType(id CredentialTypeIdentifier, err error) {
+	Logger.WithField("credtype", id.String()).Warn("skipping invalid credential type: ", err)
+	conf.Warnings = append(conf.Warnings, fmt.Sprintf("Skipped credential type %s: %s", id.String(), err.Error()))
+	conf.DisabledCredentialTypes[id] = err
+	delete(conf.CredentialTypes, id)
+	for attrid := range conf.AttributeTypes {
+		if attrid.CredentialTypeIdentifier() == id {
+			delete(conf.AttributeTypes, attrid)
+		}
+	}
+	for hash, credid := range conf.reverseHashes {
+		if credid == id {
+			delete(conf.reverseHashes, hash)
+		}
+	}
+}
+
 var (
 	errCircDep = errors.Errorf("No valid dependency branch could be built. There might be a circular dependency.")
 )
@@ -1004,6 +1282,10 @@ func (ct CredentialType) validateDependencies(conf *Configuration, validatedDeps
 			conSatisfied := true
 
 			for _, item := range con {
+				if conf.CredentialTypes[item] == nil {
+					return errors.Errorf("credential type %s has unknown dependency %s",
+						ct.Identifier().String(), item.String())
+				}
 				if conf.CredentialTypes[item].SchemeManagerID != ct.SchemeManagerID {
 					return errors.Errorf("credential type %s in scheme %s has dependency outside the scheme: %s",
 						ct.Identifier().String(), ct.SchemeManagerID, conf.CredentialTypes[item].Identifier().String())
@@ -1056,6 +1338,23 @@ func (d DependencyChain) String() string {
 	return strings.Join(deps, ", ")
 }
 
+// translationLanguages returns the languages in which the descriptions within this scheme
+// declaring the specified languages must be translated: those languages, and the
+// RequiredLanguages of the scheme.
+func (scheme *SchemeManager) translationLanguages(langs []string) []string {
+	result := append([]string{}, langs...)
+	present := map[string]bool{}
+	for _, lang := range langs {
+		present[lang] = true
+	}
+	for _, lang := range scheme.RequiredLanguages {
+		if !present[lang] {
+			result = append(result, lang)
+		}
+	}
+	return result
+}
+
 func (scheme *SchemeManager) validate(conf *Configuration) (error, SchemeManagerStatus) {
 	if scheme.XMLVersion < 7 {
 		return errors.New("Unsupported scheme manager description"), SchemeManagerStatusParsingError
@@ -1065,7 +1364,7 @@ func (scheme *SchemeManager) validate(conf *Configuration) (error, SchemeManager
 			return errors.Errorf("Scheme %s has keyshare URL but no keyshare public key kss-0.pem", scheme.ID), SchemeManagerStatusParsingError
 		}
 	}
-	conf.validateTranslations(fmt.Sprintf("Scheme %s", scheme.ID), scheme, scheme.Languages)
+	conf.validateTranslations(fmt.Sprintf("Scheme %s", scheme.ID), scheme, scheme.translationLanguages(scheme.Languages))
 
 	// Verify that all other files are validly signed
 	if err := scheme.verifyFiles(conf); err != nil {
@@ -1112,24 +1411,7 @@ func (scheme *SchemeManager) delete(conf *Configuration) error {
 		return errors.New("cannot delete scheme from a read-only configuration")
 	}
 
-	id := scheme.Identifier()
-	delete(conf.SchemeManagers, id)
-	delete(conf.DisabledSchemeManagers, id)
-	name := id.String()
-	for iss := range conf.Issuers {
-		if iss.Root() == name {
-			delete(conf.Issuers, iss)
-		}
-	}
-	conf.publicKeys.DeleteIf(func(id PublicKeyIdentifier, _ *gabikeys.PublicKey) bool {
-		return id.Issuer.Root() == name
-	})
-	for cred := range conf.CredentialTypes {
-		if cred.Root() == name {
-			delete(conf.CredentialTypes, cred)
-		}
-	}
-
+	conf.replaceScheme(scheme, nil)
 	return os.RemoveAll(scheme.path())
 }
 
@@ -1162,7 +1444,7 @@ func (scheme *SchemeManager) deleteError(conf *Configuration, err error) {
 }
 
 func (scheme *SchemeManager) present(id string, conf *Configuration) bool {
-	return conf.SchemeManagers[NewSchemeManagerIdentifier(id)] != nil
+	return conf.GetSchemeManagers()[NewSchemeManagerIdentifier(id)] != nil
 }
 
 func (_ *SchemeManager) typ() SchemeType { return SchemeTypeIssuer }
@@ -1171,7 +1453,19 @@ func (scheme *SchemeManager) purge(conf *Configuration) {
 	id := scheme.Identifier()
 	delete(conf.SchemeManagers, id)
 	delete(conf.DisabledSchemeManagers, id)
-	delete(conf.kssPublicKeys, id)
+	for issuerid := range conf.DisabledIssuers {
+		if issuerid.SchemeManagerIdentifier() == id {
+			delete(conf.DisabledIssuers, issuerid)
+		}
+	}
+	for credid := range conf.DisabledCredentialTypes {
+		if credid.SchemeManagerIdentifier() == id {
+			delete(conf.DisabledCredentialTypes, credid)
+		}
+	}
+	conf.kssPublicKeys.DeleteIf(func(keyid kssPublicKeyIdentifier, _ *rsa.PublicKey) bool {
+		return keyid.Scheme == id
+	})
 	for issuerid, issuer := range conf.Issuers {
 		if issuer.SchemeManagerIdentifier() == id {
 			delete(conf.Issuers, issuerid)
@@ -1220,24 +1514,17 @@ func (scheme *SchemeManager) verifyFiles(conf *Configuration) error {
 func (scheme *SchemeManager) parseCredentialsFolder(conf *Configuration, issuer *Issuer, path string) error {
 	var foundcred bool
 	err := common.IterateSubfolders(path, func(dir string, _ os.FileInfo) error {
-		cred := &CredentialType{}
-		rel, err := filepath.Rel(scheme.path(), filepath.Join(dir, "description.xml"))
-		if err != nil {
-			return err
-		}
-		exists, err := conf.parseSchemeFile(scheme, rel, cred)
+		cred, err := scheme.parseCredentialType(conf, issuer, dir)
 		if err != nil {
+			if conf.options.SkipInvalidDescriptions {
+				conf.disableCredentialType(NewCredentialTypeIdentifier(issuer.Identifier().String()+"."+filepath.Base(dir)), err)
+				return nil
+			}
 			return err
 		}
-		if !exists {
+		if cred == nil {
 			return nil
 		}
-		if len(cred.Languages) == 0 {
-			cred.Languages = issuer.Languages
-		}
-		if err = conf.validateCredentialType(scheme, issuer, cred, dir); err != nil {
-			return err
-		}
 		foundcred = true
 		if cred.RevocationUpdateCount == 0 {
 			cred.RevocationUpdateCount = RevocationParameters.DefaultUpdateEventCount
@@ -1268,6 +1555,27 @@ func (scheme *SchemeManager) parseCredentialsFolder(conf *Configuration, issuer
 	return err
 }
 
+// parseCredentialType parses and validates the credential type description in the specified
+// directory, returning nil if there is none.
+func (scheme *SchemeManager) parseCredentialType(conf *Configuration, issuer *Issuer, dir string) (*CredentialType, error) {
+	cred := &CredentialType{}
+	rel, err := filepath.Rel(scheme.path(), filepath.Join(dir, "description.xml"))
+	if err != nil {
+		return nil, err
+	}
+	exists, err := conf.parseSchemeFile(scheme, rel, cred)
+	if err != nil || !exists {
+		return nil, err
+	}
+	if len(cred.Languages) == 0 {
+		cred.Languages = issuer.Languages
+	}
+	if err = conf.validateCredentialType(scheme, issuer, cred, dir); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
 // downloadDemoPrivateKeys attempts to download the scheme and issuer private keys, if the scheme is
 // a demo scheme and if they are not already present in the scheme, without failing if any of them
 // is not available.
@@ -1478,8 +1786,7 @@ func (scheme *RequestorScheme) delete(conf *Configuration) error {
 	if conf.readOnly {
 		return errors.New("cannot delete scheme from a read-only configuration")
 	}
-	scheme.purge(conf)
-
+	conf.replaceScheme(scheme, nil)
 	return os.RemoveAll(scheme.path())
 }
 
@@ -1513,7 +1820,7 @@ func (scheme *RequestorScheme) deleteError(conf *Configuration, err error) {
 }
 
 func (scheme *RequestorScheme) present(id string, conf *Configuration) bool {
-	return conf.RequestorSchemes[NewRequestorSchemeIdentifier(id)] != nil
+	return conf.GetRequestorSchemes()[NewRequestorSchemeIdentifier(id)] != nil
 }
 
 func (_ *RequestorScheme) typ() SchemeType { return SchemeTypeRequestor }
@@ -0,0 +1,137 @@
+package irma
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/signed"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+var kssPublicKeyPattern = regexp.MustCompile(`kss-\d+\.pem$`)
+
+// SignScheme signs the scheme in the specified directory using the specified ECDSA private key of
+// the scheme: it writes a new timestamp, computes the index of the scheme and writes it along
+// with its signature to the index and index.sig files, and writes the public key to pk.pem.
+// The scheme is not verified after signing; use ParseSchemeFolder for that.
+func SignScheme(privatekey *ecdsa.PrivateKey, dir string) error {
+	// Write timestamp
+	bts := []byte(strconv.FormatInt(time.Now().Unix(), 10) + "\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "timestamp"), bts, 0644); err != nil {
+		return errors.WrapPrefix(err, "Failed to write timestamp", 0)
+	}
+
+	index, err := ComputeSchemeIndex(dir)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to calculate file index", 0)
+	}
+
+	// Write index
+	bts = []byte(index.String())
+	if err := ioutil.WriteFile(filepath.Join(dir, "index"), bts, 0644); err != nil {
+		return errors.WrapPrefix(err, "Failed to write index", 0)
+	}
+
+	// Create and write signature
+	sigbytes, err := signed.Sign(privatekey, bts)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to serialize signature", 0)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "index.sig"), sigbytes, 0644); err != nil {
+		return errors.WrapPrefix(err, "Failed to write index.sig", 0)
+	}
+
+	// Write public key
+	pemEncodedPub, err := signed.MarshalPemPublicKey(&privatekey.PublicKey)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to serialize public key", 0)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "pk.pem"), pemEncodedPub, 0644); err != nil {
+		return errors.WrapPrefix(err, "Failed to write public key", 0)
+	}
+	return nil
+}
+
+// ComputeSchemeIndex computes the index of the scheme in the specified directory, consisting of
+// the SHA256 hashes of all files in the scheme that are to be signed. Private keys, key proofs
+// and files of types not belonging in the scheme are skipped.
+func ComputeSchemeIndex(dir string) (SchemeManagerIndex, error) {
+	filename, err := common.SchemeFilename(dir)
+	if err != nil {
+		return nil, err
+	}
+	bts, err := ioutil.ReadFile(filepath.Join(dir, filename))
+	if err != nil {
+		return nil, err
+	}
+	id, typ, err := common.SchemeInfo(filename, bts)
+	if err != nil {
+		return nil, err
+	}
+
+	index := SchemeManagerIndex(make(map[string]SchemeFileHash))
+	err = common.WalkDir(dir, func(path string, info os.FileInfo) error {
+		if skipSigning(path, info, SchemeType(typ)) {
+			return nil
+		}
+		bts, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(filepath.Join(id, relativePath))
+
+		if filepath.Ext(path) != ".png" && bytes.Contains(bts, []byte("\r\n")) {
+			return errors.Errorf("%s contains CRLF (Windows) line endings, please convert to LF", relativePath)
+		}
+
+		hash := sha256.Sum256(bts)
+		index[relativePath] = hash[:]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func skipSigning(path string, info os.FileInfo, typ SchemeType) bool {
+	// Skip stuff we don't want
+	if info.IsDir() || // Can only sign files
+		strings.HasSuffix(path, "index") || // Skip the index file itself
+		strings.Contains(filepath.ToSlash(path), "/.git/") { // No need to traverse .git dirs, can take quite long
+		return true
+	}
+
+	switch typ {
+	case SchemeTypeIssuer:
+		if strings.Contains(filepath.ToSlash(path), "/PrivateKeys/") || // Don't sign private keys
+			strings.Contains(filepath.ToSlash(path), "/Proofs/") { // Or key proofs
+			return true
+		}
+		if !strings.HasSuffix(path, ".xml") &&
+			!strings.HasSuffix(path, ".png") &&
+			!kssPublicKeyPattern.MatchString(filepath.Base(path)) &&
+			filepath.Base(path) != "timestamp" {
+			return true
+		}
+	case SchemeTypeRequestor:
+		if !strings.HasSuffix(path, ".json") &&
+			filepath.Base(path) != "timestamp" {
+			return true
+		}
+	}
+	return false
+}
@@ -2,7 +2,10 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -13,6 +16,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5/middleware"
@@ -51,6 +55,21 @@ type SessionResult struct {
 // once an IRMA session has completed.
 type SessionHandler func(*SessionResult)
 
+// TokenGenerator generates the requestor and client tokens of new sessions. Generated tokens
+// must consist of 20 to 128 alphanumeric characters, dashes or underscores.
+type TokenGenerator interface {
+	NewToken() (string, error)
+}
+
+// RandomTokenGenerator generates random alphanumeric tokens of the specified length using crypto/rand.
+type RandomTokenGenerator struct {
+	Length int
+}
+
+func (g RandomTokenGenerator) NewToken() (string, error) {
+	return common.NewRandomString(g.Length, common.AlphanumericChars), nil
+}
+
 type LogOptions struct {
 	Response, Headers, From, EncodeBinary bool
 }
@@ -322,32 +341,87 @@ func TypeString(x interface{}) string {
 }
 
 func ResultJwt(sessionresult *SessionResult, issuer string, validity int, privatekey *rsa.PrivateKey) (string, error) {
+	return SignJwt(resultJwtClaims(sessionresult, issuer, "", validity), privatekey)
+}
+
+// ResultJwt returns a JWT containing the session result, signed using the JwtSigner of the configuration
+// and containing the configured issuer and audience.
+func (conf *Configuration) ResultJwt(sessionresult *SessionResult, validity int) (string, error) {
+	return SignJwt(resultJwtClaims(sessionresult, conf.JwtIssuer, conf.JwtAudience, validity), conf.JwtSigner)
+}
+
+func resultJwtClaims(sessionresult *SessionResult, issuer, audience string, validity int) jwt.Claims {
 	standardclaims := jwt.StandardClaims{
 		Issuer:   issuer,
+		Audience: audience,
 		IssuedAt: time.Now().Unix(),
 		Subject:  string(sessionresult.Type) + "_result",
 	}
 	standardclaims.ExpiresAt = standardclaims.IssuedAt + int64(validity)
 
-	var claims jwt.Claims
 	if sessionresult.LegacySession {
-		claims = struct {
+		return struct {
 			jwt.StandardClaims
 			*LegacySessionResult
 		}{standardclaims, sessionresult.Legacy()}
-	} else {
-		claims = struct {
-			jwt.StandardClaims
-			*SessionResult
-		}{standardclaims, sessionresult}
 	}
-
-	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(privatekey)
+	return struct {
+		jwt.StandardClaims
+		*SessionResult
+	}{standardclaims, sessionresult}
+}
+
+// ResultCallbackOptions configures how DoResultCallbackWithOptions POSTs session results.
+type ResultCallbackOptions struct {
+	// If set, the session result is sent as the JWT returned by this function
+	ResultJwt func(*SessionResult) (string, error)
+	// If set, the hex-encoded HMAC-SHA256 of the request body using this key is sent in the
+	// X-IRMA-Signature header, prefixed with "sha256=".
+	HMACKey []byte
+	// Number of times a failed callback is retried. If positive, connection errors are not
+	// additionally retried by the HTTP transport.
+	Retries int
+	// Delay before the first retry, doubled after each retry (default value 0 means 1 second)
+	RetryDelay time.Duration
+	// If set, retries are abandoned when the context is done
+	Context context.Context
+	// If set, retries in the background are added to the wait group, so they can be waited for
+	WaitGroup *sync.WaitGroup
+}
+
+// CallbackSignatureHeader is the HTTP header containing the HMAC signature of a result callback.
+const CallbackSignatureHeader = "X-IRMA-Signature"
+
+// ResultCallbackOptions returns the options with which result callbacks are done according to the
+// configuration: as a JWT if a JWT signer is configured, with the configured HMAC key and retries.
+func (conf *Configuration) ResultCallbackOptions(validity int) ResultCallbackOptions {
+	opts := ResultCallbackOptions{Retries: conf.CallbackRetries}
+	if conf.CallbackHMACKey != "" {
+		opts.HMACKey = []byte(conf.CallbackHMACKey)
+	}
+	if conf.JwtSigner != nil {
+		opts.ResultJwt = func(result *SessionResult) (string, error) {
+			return conf.ResultJwt(result, validity)
+		}
+	}
+	return opts
 }
 
+// DoResultCallback POSTs the session result to the callback URL, as a JWT signed with the RSA private
+// key if specified. Use DoResultCallbackWithOptions for other signing algorithms, HMAC signatures and retries.
 func DoResultCallback(callbackUrl string, result *SessionResult, issuer string, validity int, privatekey *rsa.PrivateKey) {
+	var opts ResultCallbackOptions
+	if privatekey != nil {
+		opts.ResultJwt = func(result *SessionResult) (string, error) {
+			return ResultJwt(result, issuer, validity, privatekey)
+		}
+	}
+	DoResultCallbackWithOptions(callbackUrl, result, opts)
+}
+
+// DoResultCallbackWithOptions POSTs the session result to the callback URL, as a JWT if opts.ResultJwt
+// is set. The first attempt is done synchronously; if it fails, any retries are done in the background.
+func DoResultCallbackWithOptions(callbackUrl string, result *SessionResult, opts ResultCallbackOptions) {
 	logger := Logger.WithFields(logrus.Fields{"session": result.Token, "callbackUrl": callbackUrl})
 	if !strings.HasPrefix(callbackUrl, "https") {
 		logger.Warn("POSTing session result to callback URL without TLS: attributes are unencrypted in traffic")
@@ -356,21 +430,80 @@ func DoResultCallback(callbackUrl string, result *SessionResult, issuer string,
 	}
 
 	var res interface{}
-	if privatekey != nil {
+	if opts.ResultJwt != nil {
 		var err error
-		res, err = ResultJwt(result, issuer, validity, privatekey)
+		res, err = opts.ResultJwt(result)
 		if err != nil {
 			_ = LogError(errors.WrapPrefix(err, "Failed to create JWT for result callback", 0))
 			return
 		}
 	} else {
-		res = result
+		bts, err := json.Marshal(result)
+		if err != nil {
+			_ = LogError(errors.WrapPrefix(err, "Failed to marshal session result for result callback", 0))
+			return
+		}
+		res = json.RawMessage(bts)
 	}
 
-	if err := irma.NewHTTPTransport(callbackUrl, false).Post("", nil, res); err != nil {
-		// not our problem, log it and go on
-		logger.Warn(errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0))
+	transport := irma.NewHTTPTransport(callbackUrl, false)
+	if opts.Retries > 0 {
+		transport.SetRetryMax(0)
 	}
+	if opts.HMACKey != nil {
+		var body []byte
+		switch r := res.(type) {
+		case string:
+			body = []byte(r)
+		case json.RawMessage:
+			body = r
+		}
+		mac := hmac.New(sha256.New, opts.HMACKey)
+		mac.Write(body)
+		transport.SetHeader(CallbackSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	err := transport.Post("", nil, res)
+	if err == nil {
+		return
+	}
+	// not our problem, log it and go on
+	logger.Warn(errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0))
+	if opts.Retries <= 0 {
+		return
+	}
+
+	delay := opts.RetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.WaitGroup != nil {
+		opts.WaitGroup.Add(1)
+	}
+	go func() {
+		if opts.WaitGroup != nil {
+			defer opts.WaitGroup.Done()
+		}
+		for i := 1; i <= opts.Retries; i++ {
+			select {
+			case <-ctx.Done():
+				logger.Warn("Abandoning retries of result callback")
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if err := transport.Post("", nil, res); err != nil {
+				logger.WithField("attempt", i).Warn(errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0))
+				continue
+			}
+			logger.WithField("attempt", i).Debug("POSTed session result on retry")
+			return
+		}
+	}()
 }
 
 func log(level logrus.Level, err error) error {
@@ -471,11 +604,24 @@ func NewLogger(verbosity int, quiet bool, json bool) *logrus.Logger {
 	return logger
 }
 
+// SizeLimitMiddleware limits the size of request bodies to PostSizeLimit.
 func SizeLimitMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, PostSizeLimit)
-		next.ServeHTTP(w, r)
-	})
+	return BodySizeLimitMiddleware(0)(next)
+}
+
+// BodySizeLimitMiddleware returns middleware limiting the size of request bodies to the specified
+// amount of bytes, or to PostSizeLimit if it is 0.
+func BodySizeLimitMiddleware(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := limit
+			if limit == 0 {
+				limit = PostSizeLimit
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
 func TimeoutMiddleware(except []string, timeout time.Duration) func(http.Handler) http.Handler {
@@ -2,11 +2,16 @@ package server
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -149,6 +154,67 @@ func TestServerTimeouts(t *testing.T) {
 	}
 }
 
+func TestResultCallbackSignatureAndRetries(t *testing.T) {
+	key := []byte("secret")
+	var attempts int
+	var mutex sync.Mutex
+	received := make(chan *SessionResult, 1)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(CallbackSignatureHeader))
+
+		result := &SessionResult{}
+		require.NoError(t, json.Unmarshal(body, result))
+		received <- result
+	})
+	s := startServer(t, handler, ReadTimeout)
+	defer stopServer(t, s)
+
+	DoResultCallbackWithOptions("http://localhost:34534", &SessionResult{Token: "token", Status: irma.ServerStatusDone},
+		ResultCallbackOptions{HMACKey: key, Retries: 2, RetryDelay: 10 * time.Millisecond})
+
+	select {
+	case result := <-received:
+		require.Equal(t, irma.RequestorToken("token"), result.Token)
+		require.Equal(t, irma.ServerStatusDone, result.Status)
+	case <-time.After(time.Second):
+		t.Fatal("result callback was not retried")
+	}
+	mutex.Lock()
+	require.Equal(t, 2, attempts)
+	mutex.Unlock()
+}
+
+func TestResultCallbackRetriesAbandoned(t *testing.T) {
+	var attempts int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	s := startServer(t, handler, ReadTimeout)
+	defer stopServer(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	DoResultCallbackWithOptions("http://localhost:34534", &SessionResult{Token: "token", Status: irma.ServerStatusDone},
+		ResultCallbackOptions{Retries: 5, RetryDelay: time.Hour, Context: ctx, WaitGroup: &wg})
+
+	cancel()
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
 func startServer(t *testing.T, handler http.Handler, timeout time.Duration) *http.Server {
 	s := &http.Server{
 		Addr:        "localhost:34534",
@@ -168,3 +234,53 @@ func stopServer(t *testing.T, server *http.Server) {
 	require.NoError(t, server.Shutdown(ctx))
 	cancel()
 }
+
+func TestCheckKnownFields(t *testing.T) {
+	valid := []string{
+		`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`,
+		`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[[{"type":"irma-demo.RU.studentCard.studentID","value":"456"}]]],"labels":{"0":{"en":"ID"}}}`,
+	}
+	for _, msg := range valid {
+		require.NoError(t, UnmarshalValidateStrict([]byte(msg), &irma.DisclosureRequest{}), msg)
+	}
+	// Field names are matched case insensitively, as by encoding/json
+	require.NoError(t, CheckKnownFields([]byte(`{"@Context":"","Disclose":[]}`), &irma.DisclosureRequest{}))
+
+	invalid := map[string]string{
+		`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]],"smuggled":1}`:                 "unknown field smuggled",
+		`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[[{"type":"irma-demo.RU.studentCard.studentID","extra":true}]]]}`:        "unknown field disclose[0][0][0].extra",
+		`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]} {"@context":"trailing data"}`: "",
+		`{"type":"disclosing","content":[{"label":"ID","attributes":["irma-demo.RU.studentCard.studentID"]}]}`:                                        "unknown field content",
+	}
+	for msg, expected := range invalid {
+		err := UnmarshalValidateStrict([]byte(msg), &irma.DisclosureRequest{})
+		require.Error(t, err, msg)
+		if expected != "" {
+			require.Equal(t, expected, err.Error())
+		}
+	}
+}
+
+func TestAESGCMCipher(t *testing.T) {
+	oldKey, newKey := []byte("0123456789abcdef"), []byte("fedcba9876543210")
+	old, err := NewAESGCMCipher(oldKey)
+	require.NoError(t, err)
+	ciphertext, err := old.Encrypt([]byte("session"), []byte("token"))
+	require.NoError(t, err)
+
+	// The ciphertext is bound to the session token
+	_, err = old.Decrypt(ciphertext, []byte("other"))
+	require.Error(t, err)
+
+	// After rotating the key, sessions encrypted with the old key can still be decrypted
+	rotated, err := NewAESGCMCipher(newKey, oldKey)
+	require.NoError(t, err)
+	plaintext, err := rotated.Decrypt(ciphertext, []byte("token"))
+	require.NoError(t, err)
+	require.Equal(t, "session", string(plaintext))
+
+	ciphertext, err = rotated.Encrypt([]byte("session"), []byte("token"))
+	require.NoError(t, err)
+	_, err = old.Decrypt(ciphertext, []byte("token"))
+	require.Error(t, err)
+}
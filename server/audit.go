@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+type AuditEventType string
+
+const (
+	AuditSessionStarted  AuditEventType = "session_started"
+	AuditSessionFinished AuditEventType = "session_finished"
+	AuditRequestDenied   AuditEventType = "request_denied"
+)
+
+// AuditEvent records who started which session, which attributes were requested and disclosed,
+// and the outcome of the session, as well as requests of requestors that were denied. Unless the
+// AuditLogAttributeValues option is enabled, attribute values are redacted.
+type AuditEvent struct {
+	Time      time.Time           `json:"time"`
+	Event     AuditEventType      `json:"event"`
+	Requestor string              `json:"requestor,omitempty"`
+	Token     irma.RequestorToken `json:"token,omitempty"`
+	Action    irma.Action         `json:"action"`
+
+	// Address of the requestor whose request was denied (request_denied only)
+	RemoteAddress string `json:"remoteAddress,omitempty"`
+
+	// Attributes requested in the session, and credentials to be issued (session_started only)
+	Requested irma.AttributeConDisCon         `json:"requested,omitempty"`
+	Issued    []irma.CredentialTypeIdentifier `json:"issued,omitempty"`
+
+	// Outcome of the session (session_finished only)
+	Status      irma.ServerStatus            `json:"status,omitempty"`
+	ProofStatus irma.ProofStatus             `json:"proofStatus,omitempty"`
+	Disclosed   [][]*irma.DisclosedAttribute `json:"disclosed,omitempty"`
+	Err         *irma.RemoteError            `json:"error,omitempty"`
+}
+
+// AuditSink receives audit events, e.g. to write them to a file or to forward them to a SIEM.
+// Audit is invoked synchronously while the session is being handled, so implementations
+// should return quickly.
+type AuditSink interface {
+	Audit(event *AuditEvent) error
+}
+
+// AuditLogWriter is an AuditSink that appends audit events as JSON lines to a writer.
+type AuditLogWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func NewAuditLogWriter(w io.Writer) *AuditLogWriter {
+	return &AuditLogWriter{w: w}
+}
+
+func (a *AuditLogWriter) Audit(event *AuditEvent) error {
+	bts, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, err = a.w.Write(append(bts, '\n'))
+	return err
+}
+
+// Audit sends the event to the configured AuditSink, if any, redacting attribute values
+// unless AuditLogAttributeValues is enabled. Failures are logged but otherwise ignored.
+func (conf *Configuration) Audit(event *AuditEvent) {
+	if conf.AuditSink == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if !conf.AuditLogAttributeValues {
+		redactAuditEvent(event)
+	}
+	if err := conf.AuditSink.Audit(event); err != nil {
+		_ = LogError(errors.WrapPrefix(err, "failed to write audit event", 0))
+	}
+}
+
+// redactAuditEvent removes attribute values from the event.
+func redactAuditEvent(event *AuditEvent) {
+	event.Requested = RedactRequested(event.Requested)
+	event.Disclosed = RedactDisclosed(event.Disclosed)
+}
+
+// RedactRequested returns a copy of the requested attributes without their required values.
+// Copies are made as the attributes may be shared with the session.
+func RedactRequested(requested irma.AttributeConDisCon) irma.AttributeConDisCon {
+	if requested == nil {
+		return nil
+	}
+	redacted := make(irma.AttributeConDisCon, len(requested))
+	for i, discon := range requested {
+		redacted[i] = make(irma.AttributeDisCon, len(discon))
+		for j, con := range discon {
+			redacted[i][j] = make(irma.AttributeCon, len(con))
+			for k, attr := range con {
+				attr.Value = nil
+				redacted[i][j][k] = attr
+			}
+		}
+	}
+	return redacted
+}
+
+// RedactDisclosed returns a copy of the disclosed attributes without their values.
+// Copies are made as the attributes may be shared with the session.
+func RedactDisclosed(disclosed [][]*irma.DisclosedAttribute) [][]*irma.DisclosedAttribute {
+	if disclosed == nil {
+		return nil
+	}
+	redacted := make([][]*irma.DisclosedAttribute, len(disclosed))
+	for i, con := range disclosed {
+		redacted[i] = make([]*irma.DisclosedAttribute, len(con))
+		for j, attr := range con {
+			if attr == nil {
+				continue
+			}
+			a := *attr
+			a.RawValue = nil
+			a.Value = nil
+			redacted[i][j] = &a
+		}
+	}
+	return redacted
+}
+
+func (conf *Configuration) verifyAuditLog() error {
+	if conf.AuditLog == "" || conf.AuditSink != nil {
+		return nil
+	}
+	if conf.AuditLog == "-" {
+		conf.AuditSink = NewAuditLogWriter(os.Stdout)
+		return nil
+	}
+	f, err := os.OpenFile(conf.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to open audit log", 0)
+	}
+	conf.AuditSink = NewAuditLogWriter(f)
+	conf.auditLogFile = f
+	return nil
+}
+
+// CloseAuditLog closes the audit log file opened for the AuditLog option, if any.
+func (conf *Configuration) CloseAuditLog() error {
+	if conf.auditLogFile == nil {
+		return nil
+	}
+	err := conf.auditLogFile.Close()
+	conf.auditLogFile = nil
+	conf.AuditSink = nil
+	return err
+}
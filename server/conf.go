@@ -1,10 +1,16 @@
 package server
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -15,7 +21,9 @@ import (
 	"github.com/privacybydesign/gabi/gabikeys"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/defaultschemes"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Configuration contains configuration for the irmaserver library and irmad.
@@ -32,6 +40,21 @@ type Configuration struct {
 	DisableSchemesUpdate bool `json:"disable_schemes_update" mapstructure:"disable_schemes_update"`
 	// Update all schemes every x minutes (default value 0 means 60) (use DisableSchemesUpdate to disable)
 	SchemesUpdateInterval int `json:"schemes_update" mapstructure:"schemes_update"`
+	// Watch the schemes for changes on disk, and reload changed schemes without restarting
+	WatchSchemes bool `json:"watch_schemes" mapstructure:"watch_schemes"`
+	// Allow demo schemes without index signature (only used if IrmaConfiguration == nil).
+	// Not allowed in production mode.
+	AllowUnsignedDemoSchemes bool `json:"allow_unsigned_demo_schemes" mapstructure:"allow_unsigned_demo_schemes"`
+	// Path to a folder with unauthenticated issuer and credential type descriptions and public keys
+	// overriding those of the schemes, for development (only used if IrmaConfiguration == nil).
+	// Not allowed in production mode.
+	SchemesOverridesPath string `json:"schemes_overrides_path" mapstructure:"schemes_overrides_path"`
+	// URLs from which schemes are updated instead of the URLs in their descriptions, per scheme ID
+	// (only used if IrmaConfiguration == nil). May be git+file URLs to local git repositories.
+	SchemeURLs map[string]string `json:"scheme_urls" mapstructure:"scheme_urls"`
+	// Skip issuers and credential types with invalid descriptions instead of disabling their entire
+	// scheme (only used if IrmaConfiguration == nil)
+	SkipInvalidDescriptions bool `json:"skip_invalid_descriptions" mapstructure:"skip_invalid_descriptions"`
 	// Path to issuer private keys to parse
 	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
 	// URL at which the IRMA app can reach this server during sessions
@@ -51,6 +74,29 @@ type Configuration struct {
 	StoreType string `json:"store_type" mapstructure:"store_type"`
 	// RedisSettings that need to be specified when Redis is used as session data store.
 	RedisSettings *RedisSettings `json:"redis_settings" mapstructure:"redis_settings"`
+	// PostgresSettings that need to be specified when PostgreSQL is used as session data store.
+	PostgresSettings *PostgresSettings `json:"postgres_settings" mapstructure:"postgres_settings"`
+	// Namespace of the sessions of this server in the Redis or PostgreSQL session store, separating
+	// them from the sessions of other servers (e.g. other tenants) that use the same store.
+	SessionNamespace string `json:"session_namespace" mapstructure:"session_namespace"`
+	// Use optimistic instead of pessimistic locking in the Redis or PostgreSQL session store: sessions
+	// are not locked while handling a request, and changes to a session are only stored if it was
+	// not modified concurrently by another server instance. Otherwise the request fails with
+	// SESSION_CONFLICT. Suitable for many server instances behind a load balancer without session affinity.
+	OptimisticLocking bool `json:"optimistic_locking" mapstructure:"optimistic_locking"`
+	// Base64-encoded AES key (16, 24 or 32 bytes) with which sessions are encrypted using AES-GCM
+	// before they are stored in the Redis, PostgreSQL or a custom session store.
+	SessionEncryptionKey     string `json:"session_encryption_key" mapstructure:"session_encryption_key"`
+	SessionEncryptionKeyFile string `json:"session_encryption_key_file" mapstructure:"session_encryption_key_file"`
+	// Base64-encoded previous session encryption keys, with which sessions that were encrypted before
+	// the session encryption key was rotated are decrypted
+	SessionDecryptionKeys []string `json:"session_decryption_keys" mapstructure:"session_decryption_keys"`
+	// Cipher with which sessions are encrypted in persistent session stores. If absent, AES-GCM with
+	// the session encryption key is used, if any. Can be set to encrypt using a key kept in a KMS.
+	SessionCipher SessionCipher `json:"-"`
+	// TracerProvider with which the OpenTelemetry spans of sessions are created. If absent, the
+	// globally registered TracerProvider is used (see otel.SetTracerProvider).
+	TracerProvider trace.TracerProvider `json:"-"`
 
 	// Static session requests that can be created by POST /session/{name}
 	StaticSessions map[string]interface{} `json:"static_sessions"`
@@ -59,23 +105,94 @@ type Configuration struct {
 
 	// Maximum duration of a session once a client connects in minutes (default value 0 means 15)
 	MaxSessionLifetime int `json:"max_session_lifetime" mapstructure:"max_session_lifetime"`
+	// Maximum session lifetime in minutes that requestors may specify using maxSessionLifetime in
+	// their session requests (default value 0 means MaxSessionLifetime)
+	MaxRequestedSessionLifetime int `json:"max_requested_session_lifetime" mapstructure:"max_requested_session_lifetime"`
 	// Determines how long a session result is preserved in minutes (default value 0 means 5)
 	SessionResultLifetime int `json:"session_result_lifetime" mapstructure:"session_result_lifetime"`
+	// Length of the randomly generated session tokens (default value 0 means 20, maximum is 128)
+	SessionTokenLength int `json:"session_token_length" mapstructure:"session_token_length"`
+	// Generates the session tokens. If absent, random alphanumeric tokens of length SessionTokenLength are generated.
+	TokenGenerator TokenGenerator `json:"-"`
+	// Interval in seconds at which expired sessions are cleaned up from the memory and PostgreSQL session stores (default value 0 means 10)
+	ExpiryTicker int `json:"expiry_ticker" mapstructure:"expiry_ticker"`
+
+	// Range of IRMA protocol versions (e.g. "2.5") accepted from IRMA apps, to restrict the range
+	// supported by the server, e.g. for staged rollouts of new protocol versions
+	MinProtocolVersion string `json:"min_protocol_version" mapstructure:"min_protocol_version"`
+	MaxProtocolVersion string `json:"max_protocol_version" mapstructure:"max_protocol_version"`
+	// Disable support for IRMA apps speaking protocol versions below 2.4, which are otherwise
+	// accepted for disclosure and issuance sessions
+	DisableLegacyProtocols bool `json:"disable_legacy_protocols" mapstructure:"disable_legacy_protocols"`
+
+	// Maximum size in bytes of request bodies (default value 0 means PostSizeLimit, i.e. 10 MB)
+	MaxRequestSize int64 `json:"max_request_size" mapstructure:"max_request_size"`
+	// Reject JSON messages containing fields unknown to the server (see CheckKnownFields), which
+	// includes session requests in the legacy (pre-condiscon) format
+	StrictDecoding bool `json:"strict_decoding" mapstructure:"strict_decoding"`
 
 	// Used in the "iss" field of result JWTs from /result-jwt and /getproof
 	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
-	// Private key to sign result JWTs with. If absent, /result-jwt and /getproof are disabled.
+	// If specified, used in the "aud" field of result JWTs from /result-jwt and /getproof
+	JwtAudience string `json:"jwt_audience" mapstructure:"jwt_audience"`
+	// Private key (RSA, ECDSA P-256 or Ed25519, in PEM) to sign result JWTs with using RS256, ES256 or EdDSA
+	// respectively. If absent, /result-jwt and /getproof are disabled.
 	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
 	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
-	// Parsed JWT private key
+	// Parsed JWT private key, if it is an RSA key
 	JwtRSAPrivateKey *rsa.PrivateKey `json:"-"`
+	// Signer of result JWTs. If absent, the JWT private key is used. Can be set to sign
+	// using a key that is not available in memory, e.g. one kept in a HSM.
+	JwtSigner crypto.Signer `json:"-"`
+	// Paths to PEM files of public keys that are published at /.well-known/jwks.json along with
+	// the public key of the JWT private key, e.g. of previous JWT private keys when rotating keys.
+	JwtPublicKeyFiles []string `json:"jwt_pubkey_files" mapstructure:"jwt_pubkey_files"`
+	jwtPublicKeys     []crypto.PublicKey
 	// Whether to allow callbackUrl to be set in session requests when no JWT privatekey is installed
 	// (which is potentially unsafe depending on the setup)
 	AllowUnsignedCallbacks bool `json:"allow_unsigned_callbacks" mapstructure:"allow_unsigned_callbacks"`
+	// If specified, result callbacks carry an HMAC-SHA256 signature of the request body using this key
+	// in the X-IRMA-Signature header
+	CallbackHMACKey string `json:"callback_hmac_key" mapstructure:"callback_hmac_key"`
+	// Number of times a failed result callback is retried, with exponential backoff starting at 1 second
+	CallbackRetries int `json:"callback_retries" mapstructure:"callback_retries"`
+	// If set, invoked before the next session of a chained session is started, to check whether the
+	// requestor (as passed to irmaserver.StartRequestorSession) of the previous session may start it.
+	AuthorizeNextSession func(requestor string, request irma.RequestorRequest) error `json:"-"`
+	// If set, invoked after starting the next session of a chained session that was authorized by
+	// AuthorizeNextSession, with an empty token if starting it failed.
+	NextSessionStarted func(requestor string, token irma.RequestorToken) `json:"-"`
+	// If set, returns the URL (ending in irma/) at which the IRMA app can reach this server for
+	// sessions started by the specified HTTP request, e.g. derived from the X-Forwarded-* headers set
+	// by a reverse proxy. If it returns an empty string, URL is used.
+	ExternalURL func(r *http.Request) string `json:"-"`
 	// Whether to augment the clientreturnurl with the server token of the request (this allows for stateless
 	// requestor servers more easily)
 	AugmentClientReturnURL bool `json:"augment_client_return_url" mapstructure:"augment_client_return_url"`
 
+	// Path of the file to which audit events are appended as JSON lines ("-" for stdout, empty to disable)
+	AuditLog string `json:"audit_log" mapstructure:"audit_log"`
+	// Whether to include attribute values in audit events (by default they are redacted)
+	AuditLogAttributeValues bool `json:"audit_log_attribute_values" mapstructure:"audit_log_attribute_values"`
+	// Custom destination of audit events. If specified, AuditLog is ignored.
+	AuditSink AuditSink `json:"-"`
+	// Audit log file opened for AuditLog, closed by CloseAuditLog
+	auditLogFile *os.File
+	// Time windows in minutes over which session statistics are computed (default 60 and 1440)
+	StatsWindows []int `json:"stats_windows" mapstructure:"stats_windows"`
+
+	// SMTP server (host:port) through which a summary of the outcome of a session is emailed to the
+	// address in the notifyEmail option of its session request (empty to disable)
+	NotificationEmailServer string `json:"notification_email_server" mapstructure:"notification_email_server"`
+	// Sender address of session notification emails
+	NotificationEmailFrom string `json:"notification_email_from" mapstructure:"notification_email_from"`
+	// Authentication to the SMTP server, if required
+	NotificationEmailAuth smtp.Auth `json:"-"`
+	// Whether to include disclosed attribute values in session notifications (by default they are omitted)
+	NotifyAttributeValues bool `json:"notify_attribute_values" mapstructure:"notify_attribute_values"`
+	// Custom destination of session notifications. If specified, NotificationEmailServer is ignored.
+	Notifier Notifier `json:"-"`
+
 	// Logging verbosity level: 0 is normal, 1 includes DEBUG level, 2 includes TRACE level
 	Verbose int `json:"verbose" mapstructure:"verbose"`
 	// Don't log anything at all
@@ -106,6 +223,12 @@ type RedisSettings struct {
 	DisableTLS         bool   `json:"no_tls,omitempty" mapstructure:"no_tls"`
 }
 
+type PostgresSettings struct {
+	ConnStr      string `json:"conn_str,omitempty" mapstructure:"conn_str"`
+	MaxIdleConns int    `json:"max_idle_conns,omitempty" mapstructure:"max_idle_conns"`
+	MaxOpenConns int    `json:"max_open_conns,omitempty" mapstructure:"max_open_conns"`
+}
+
 // Check ensures that the Configuration is loaded, usable and free of errors.
 func (conf *Configuration) Check() error {
 	if conf.Logger == nil {
@@ -121,6 +244,30 @@ func (conf *Configuration) Check() error {
 	if conf.SessionResultLifetime == 0 {
 		conf.SessionResultLifetime = 5
 	}
+	if conf.MaxRequestedSessionLifetime == 0 {
+		conf.MaxRequestedSessionLifetime = conf.MaxSessionLifetime
+	}
+	if conf.ExpiryTicker == 0 {
+		conf.ExpiryTicker = 10
+	}
+	if conf.MaxSessionLifetime < 0 || conf.SessionResultLifetime < 0 || conf.MaxRequestedSessionLifetime < 0 {
+		return errors.New("session lifetimes cannot be negative")
+	}
+	if conf.ExpiryTicker < 0 {
+		return errors.New("expiry_ticker cannot be negative")
+	}
+	if conf.SessionTokenLength == 0 {
+		conf.SessionTokenLength = common.SessionTokenLength
+	}
+	if conf.SessionTokenLength < common.SessionTokenLength || conf.SessionTokenLength > common.MaxSessionTokenLength {
+		return errors.Errorf("session_token_length must be between %d and %d", common.SessionTokenLength, common.MaxSessionTokenLength)
+	}
+	if conf.TokenGenerator == nil {
+		conf.TokenGenerator = RandomTokenGenerator{Length: conf.SessionTokenLength}
+	}
+	if conf.MaxRequestSize < 0 {
+		return errors.New("max_request_size cannot be negative")
+	}
 
 	// loop to avoid repetetive err != nil line triplets
 	for _, f := range []func() error{
@@ -130,7 +277,10 @@ func (conf *Configuration) Check() error {
 		conf.verifyEmail,
 		conf.verifyRevocation,
 		conf.verifyJwtPrivateKey,
+		conf.verifySessionEncryption,
 		conf.verifyStaticSessions,
+		conf.verifyAuditLog,
+		conf.verifyNotifications,
 	} {
 		if err := f(); err != nil {
 			_ = LogError(err)
@@ -146,14 +296,23 @@ func (conf *Configuration) Check() error {
 	if conf.EnableSSE && conf.StoreType == "redis" {
 		return errors.New("Currently server-sent events (SSE) cannot be used simultaneously with the Redis session store.")
 	}
+	if conf.EnableSSE && conf.StoreType == "postgres" {
+		return errors.New("Currently server-sent events (SSE) cannot be used simultaneously with the PostgreSQL session store.")
+	}
+	if conf.OptimisticLocking && conf.StoreType != "redis" && conf.StoreType != "postgres" {
+		return errors.New("Optimistic locking can only be used with the Redis or PostgreSQL session store.")
+	}
+	if conf.StoreType == "postgres" && (conf.PostgresSettings == nil || conf.PostgresSettings.ConnStr == "") {
+		return errors.New("When PostgreSQL is used as session data store, a connection string must be specified.")
+	}
 
 	return nil
 }
 
 func (conf *Configuration) HavePrivateKeys() bool {
 	var err error
-	for id := range conf.IrmaConfiguration.Issuers {
-		if conf.IrmaConfiguration.SchemeManagers[id.SchemeManagerIdentifier()].Demo {
+	for id := range conf.IrmaConfiguration.GetIssuers() {
+		if conf.IrmaConfiguration.GetSchemeManagers()[id.SchemeManagerIdentifier()].Demo {
 			continue
 		}
 		if _, err = conf.IrmaConfiguration.PrivateKeys.Latest(id); err == nil {
@@ -167,7 +326,7 @@ func (conf *Configuration) HavePrivateKeys() bool {
 
 func (conf *Configuration) verifyStaticSessions() error {
 	conf.StaticSessionRequests = make(map[string]irma.RequestorRequest)
-	if len(conf.StaticSessions) > 0 && conf.JwtRSAPrivateKey == nil && !conf.AllowUnsignedCallbacks {
+	if len(conf.StaticSessions) > 0 && conf.JwtSigner == nil && !conf.AllowUnsignedCallbacks {
 		return errors.New("static sessions configured but no JWT private key is installed: either install JWT or enable allow_unsigned_callbacks in configuration")
 	}
 	for name, r := range conf.StaticSessions {
@@ -214,6 +373,12 @@ func (conf *Configuration) verifyIrmaConf() error {
 			err    error
 			exists bool
 		)
+		if conf.AllowUnsignedDemoSchemes && conf.Production {
+			return errors.New("allow_unsigned_demo_schemes is not allowed in production mode")
+		}
+		if conf.SchemesOverridesPath != "" && conf.Production {
+			return errors.New("schemes_overrides_path is not allowed in production mode")
+		}
 		if conf.SchemesPath == "" {
 			conf.SchemesPath = irma.DefaultSchemesPath() // Returns an existing path
 		}
@@ -229,6 +394,11 @@ func (conf *Configuration) verifyIrmaConf() error {
 			RevocationDBType:    conf.RevocationDBType,
 			RevocationDBConnStr: conf.RevocationDBConnStr,
 			RevocationSettings:  conf.RevocationSettings,
+
+			DangerousAllowUnsignedDemoSchemes: conf.AllowUnsignedDemoSchemes,
+			OverridesPath:                     conf.SchemesOverridesPath,
+			SchemeURLs:                        conf.SchemeURLs,
+			SkipInvalidDescriptions:           conf.SkipInvalidDescriptions,
 		})
 		if err != nil {
 			return err
@@ -238,9 +408,9 @@ func (conf *Configuration) verifyIrmaConf() error {
 		}
 	}
 
-	if len(conf.IrmaConfiguration.SchemeManagers) == 0 {
-		conf.Logger.Infof("No schemes found in %s, downloading default (irma-demo and pbdf)", conf.SchemesPath)
-		if err := conf.IrmaConfiguration.DownloadDefaultSchemes(); err != nil {
+	if len(conf.IrmaConfiguration.GetSchemeManagers()) == 0 {
+		conf.Logger.Infof("No schemes found in %s, installing default (irma-demo and pbdf)", conf.SchemesPath)
+		if err := conf.IrmaConfiguration.InstallDefaultSchemes(defaultschemes.FS()); err != nil {
 			return err
 		}
 	}
@@ -299,7 +469,7 @@ func (conf *Configuration) verifyRevocation() error {
 	rev := conf.IrmaConfiguration.Revocation
 
 	// viper lowercases configuration keys, so we have to un-lowercase them back.
-	for id := range conf.IrmaConfiguration.CredentialTypes {
+	for id := range conf.IrmaConfiguration.GetCredentialTypes() {
 		lc := irma.NewCredentialTypeIdentifier(strings.ToLower(id.String()))
 		if lc == id {
 			continue
@@ -311,7 +481,7 @@ func (conf *Configuration) verifyRevocation() error {
 	}
 
 	for credid, settings := range conf.RevocationSettings {
-		if _, known := conf.IrmaConfiguration.CredentialTypes[credid]; !known {
+		if _, known := conf.IrmaConfiguration.GetCredentialTypes()[credid]; !known {
 			return errors.Errorf("unknown credential type %s in revocation settings", credid)
 		}
 		if settings.Authority {
@@ -327,7 +497,7 @@ func (conf *Configuration) verifyRevocation() error {
 		}
 	}
 
-	for credid, credtype := range conf.IrmaConfiguration.CredentialTypes {
+	for credid, credtype := range conf.IrmaConfiguration.GetCredentialTypes() {
 		if !credtype.RevocationSupported() {
 			continue
 		}
@@ -336,7 +506,7 @@ func (conf *Configuration) verifyRevocation() error {
 		settings := conf.RevocationSettings[credid]
 		if haveSK && (settings == nil || (settings.RevocationServerURL == "" && !settings.Server)) {
 			message := "Revocation-supporting private key installed for %s, but no revocation server is configured: issuance sessions will always fail"
-			if conf.IrmaConfiguration.SchemeManagers[credid.IssuerIdentifier().SchemeManagerIdentifier()].Demo {
+			if conf.IrmaConfiguration.GetSchemeManagers()[credid.IssuerIdentifier().SchemeManagerIdentifier()].Demo {
 				conf.Logger.Warnf(message, credid)
 			} else {
 				return errors.Errorf(message, credid)
@@ -401,18 +571,61 @@ func (conf *Configuration) verifyEmail() error {
 }
 
 func (conf *Configuration) verifyJwtPrivateKey() error {
-	if conf.JwtPrivateKey == "" && conf.JwtPrivateKeyFile == "" {
-		return nil
+	if conf.JwtSigner == nil && (conf.JwtPrivateKey != "" || conf.JwtPrivateKeyFile != "") {
+		keybytes, err := common.ReadKey(conf.JwtPrivateKey, conf.JwtPrivateKeyFile)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read private key", 0)
+		}
+		if conf.JwtSigner, err = parseJwtPrivateKey(keybytes); err != nil {
+			return err
+		}
+		if sk, ok := conf.JwtSigner.(*rsa.PrivateKey); ok {
+			conf.JwtRSAPrivateKey = sk
+		}
+		conf.Logger.Info("Private key parsed, JWT endpoints enabled")
+	}
+	if conf.JwtSigner == nil && conf.JwtRSAPrivateKey != nil {
+		conf.JwtSigner = conf.JwtRSAPrivateKey
+	}
+	if conf.JwtSigner != nil {
+		if _, err := JwtSigningMethod(conf.JwtSigner); err != nil {
+			return err
+		}
 	}
 
-	keybytes, err := common.ReadKey(conf.JwtPrivateKey, conf.JwtPrivateKeyFile)
-	if err != nil {
-		return errors.WrapPrefix(err, "failed to read private key", 0)
+	conf.jwtPublicKeys = nil
+	for _, path := range conf.JwtPublicKeyFiles {
+		keybytes, err := common.ReadKey("", path)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read JWT public key", 0)
+		}
+		block, _ := pem.Decode(keybytes)
+		if block == nil {
+			return errors.Errorf("failed to parse JWT public key %s: no PEM data found", path)
+		}
+		pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse JWT public key "+path, 0)
+		}
+		if _, err = NewJwk(pk); err != nil {
+			return errors.WrapPrefix(err, "failed to parse JWT public key "+path, 0)
+		}
+		conf.jwtPublicKeys = append(conf.jwtPublicKeys, pk)
 	}
+	return nil
+}
 
-	conf.JwtRSAPrivateKey, err = jwt.ParseRSAPrivateKeyFromPEM(keybytes)
-	conf.Logger.Info("Private key parsed, JWT endpoints enabled")
-	return err
+func parseJwtPrivateKey(keybytes []byte) (crypto.Signer, error) {
+	if sk, err := jwt.ParseRSAPrivateKeyFromPEM(keybytes); err == nil {
+		return sk, nil
+	}
+	if sk, err := jwt.ParseECPrivateKeyFromPEM(keybytes); err == nil {
+		return sk, nil
+	}
+	if sk, err := jwt.ParseEdPrivateKeyFromPEM(keybytes); err == nil {
+		return sk.(crypto.Signer), nil
+	}
+	return nil, errors.New("failed to parse JWT private key: expected an RSA, ECDSA or Ed25519 private key in PEM")
 }
 
 // ReplacePortString is a helper that returns a copy of the specified url of the form
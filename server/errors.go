@@ -36,11 +36,14 @@ var (
 	ErrorRevocation           Error = Error{Type: "REVOCATION", Status: 500, Description: "Revocation error"}
 	ErrorUnknownRevocationKey Error = Error{Type: "UNKNOWN_REVOCATION_KEY", Status: 404, Description: "No issuance records correspond to the given revocationKey"}
 
-	ErrorUnsupported     Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
-	ErrorInvalidRequest  Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
-	ErrorProtocolVersion Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
-	ErrorInvalidToken    Error = Error{Type: "INVALID_TOKEN", Status: 403, Description: "Provided token is unknown or invalid"}
-	ErrorInternal        Error = Error{Type: "INTERNAL_ERROR", Status: 500, Description: "Internal server error"}
+	ErrorUnsupported         Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
+	ErrorInvalidRequest      Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
+	ErrorProtocolVersion     Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
+	ErrorInvalidToken        Error = Error{Type: "INVALID_TOKEN", Status: 403, Description: "Provided token is unknown or invalid"}
+	ErrorRequestorKeyExpired Error = Error{Type: "REQUESTOR_KEY_EXPIRED", Status: 403, Description: "Requestor authentication key is expired or not yet valid"}
+	ErrorInternal            Error = Error{Type: "INTERNAL_ERROR", Status: 500, Description: "Internal server error"}
+	ErrorShuttingDown        Error = Error{Type: "SHUTTING_DOWN", Status: 503, Description: "Server is shutting down and does not accept new sessions"}
+	ErrorSessionConflict     Error = Error{Type: "SESSION_CONFLICT", Status: 409, Description: "Session was modified concurrently, retry the request"}
 )
 
 // Keyshare errors
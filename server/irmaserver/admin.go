@@ -0,0 +1,150 @@
+package irmaserver
+
+import (
+	"sort"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// This file contains the functions for inspecting and expiring sessions, for use by
+// administrators, e.g. to debug sessions of IRMA apps that got stuck.
+
+// SessionInfo describes a session in the list of active sessions.
+type SessionInfo struct {
+	Token      irma.RequestorToken `json:"token"`
+	Requestor  string              `json:"requestor,omitempty"`
+	Action     irma.Action         `json:"type"`
+	Status     irma.ServerStatus   `json:"status"`
+	Created    time.Time           `json:"created"`
+	LastActive time.Time           `json:"lastActive"`
+	Age        int64               `json:"age"` // seconds since the session was started
+}
+
+// SessionState is a sanitized dump of the state of a session. It contains neither attribute
+// values nor tokens other than the requestor token, and can be shared with e.g. app developers.
+type SessionState struct {
+	SessionInfo
+	ProtocolVersion  *irma.ProtocolVersion `json:"protocolVersion,omitempty"`
+	LegacyCompatible bool                  `json:"legacyCompatible"`
+	PairingMethod    irma.PairingMethod    `json:"pairingMethod"`
+	ClientAuthorized bool                  `json:"clientAuthorized"` // whether the IRMA app sent an authorization header
+
+	// Endpoint of the last request of the IRMA app and the HTTP status of its response
+	LastEndpoint       string `json:"lastEndpoint,omitempty"`
+	LastResponseStatus int    `json:"lastResponseStatus,omitempty"`
+
+	Requested      irma.AttributeConDisCon         `json:"requested,omitempty"`
+	Issued         []irma.CredentialTypeIdentifier `json:"issued,omitempty"`
+	KeyshareProofs []irma.SchemeManagerIdentifier  `json:"keyshareProofs,omitempty"`
+	NextSession    bool                            `json:"nextSession"`
+	ProofStatus    irma.ProofStatus                `json:"proofStatus,omitempty"`
+	Disclosed      [][]*irma.DisclosedAttribute    `json:"disclosed,omitempty"`
+	Err            *irma.RemoteError               `json:"error,omitempty"`
+}
+
+// ListSessions returns the sessions that have not yet reached a final status. Custom session
+// stores must implement SessionStoreLister to support this.
+func ListSessions() ([]*SessionInfo, error) {
+	return s.ListSessions()
+}
+func (s *Server) ListSessions() ([]*SessionInfo, error) {
+	tokens, err := s.sessions.requestorTokens()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*SessionInfo, 0, len(tokens))
+	for _, token := range tokens {
+		info, err := s.sessionInfo(token)
+		if _, ok := err.(*UnknownSessionError); ok {
+			continue // expired in the meantime
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.Status.Finished() {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+func (s *Server) sessionInfo(token irma.RequestorToken) (info *SessionInfo, err error) {
+	session, err := s.sessions.get(token)
+	defer func() { err = updateAndUnlock(session, err) }()
+	if err != nil {
+		return
+	}
+	info = session.info()
+	return
+}
+
+// InspectSession returns a sanitized dump of the state of the specified session.
+func InspectSession(requestorToken irma.RequestorToken) (*SessionState, error) {
+	return s.InspectSession(requestorToken)
+}
+func (s *Server) InspectSession(requestorToken irma.RequestorToken) (state *SessionState, err error) {
+	session, err := s.sessions.get(requestorToken)
+	defer func() { err = updateAndUnlock(session, err) }()
+	if err != nil {
+		return
+	}
+
+	state = &SessionState{
+		SessionInfo:        *session.info(),
+		ProtocolVersion:    session.Version,
+		LegacyCompatible:   session.LegacyCompatible,
+		PairingMethod:      session.Options.PairingMethod,
+		ClientAuthorized:   session.ClientAuth != "",
+		LastEndpoint:       session.ResponseCache.Endpoint,
+		LastResponseStatus: session.ResponseCache.Status,
+		Requested:          server.RedactRequested(session.request.Disclosure().Disclose),
+		Issued:             issuedCredentialTypes(session.request),
+		NextSession:        session.Next != nil,
+		ProofStatus:        session.Result.ProofStatus,
+		Disclosed:          server.RedactDisclosed(session.Result.Disclosed),
+		Err:                session.Result.Err,
+	}
+	for scheme := range session.KssProofs {
+		state.KeyshareProofs = append(state.KeyshareProofs, scheme)
+	}
+	sort.Slice(state.KeyshareProofs, func(i, j int) bool {
+		return state.KeyshareProofs[i].String() < state.KeyshareProofs[j].String()
+	})
+	return
+}
+
+// ExpireSession expires the specified session, as if its lifetime had passed, so that it can no
+// longer be continued by the IRMA app. If the session has already finished,
+// a *SessionFinishedError is returned and the session is left unchanged.
+func ExpireSession(requestorToken irma.RequestorToken) error {
+	return s.ExpireSession(requestorToken)
+}
+func (s *Server) ExpireSession(requestorToken irma.RequestorToken) (err error) {
+	session, err := s.sessions.get(requestorToken)
+	defer func() { err = updateAndUnlock(session, err) }()
+	if err != nil {
+		return
+	}
+
+	if session.Status.Finished() {
+		return &SessionFinishedError{requestorToken, session.Status}
+	}
+	session.conf.Logger.WithField("session", session.RequestorToken).Info("Session expired by administrator")
+	session.markAlive()
+	session.setStatus(irma.ServerStatusTimeout)
+	return
+}
+
+func (session *session) info() *SessionInfo {
+	return &SessionInfo{
+		Token:      session.RequestorToken,
+		Requestor:  session.Requestor,
+		Action:     session.Action,
+		Status:     session.Status,
+		Created:    session.Created,
+		LastActive: session.LastActive,
+		Age:        int64(time.Since(session.Created).Seconds()),
+	}
+}
@@ -9,6 +9,10 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"net/http"
+	"net/mail"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-co-op/gocron"
@@ -23,19 +27,37 @@ import (
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Server struct {
-	conf             *server.Configuration
-	router           *chi.Mux
-	sessions         sessionStore
-	scheduler        *gocron.Scheduler
-	serverSentEvents *sse.Server
+	conf              *server.Configuration
+	router            *chi.Mux
+	sessions          sessionStore
+	scheduler         *gocron.Scheduler
+	serverSentEvents  *sse.Server
+	schemeWatcher     *schemeWatcher
+	draining          int32
+	metrics           *sessionMetrics
+	stats             *sessionStats
+	frontendListeners *frontendListeners
+	tracer            trace.Tracer
+
+	// Result callbacks being retried in the background, which are abandoned when the server stops
+	callbacks       sync.WaitGroup
+	callbacksCtx    context.Context
+	cancelCallbacks context.CancelFunc
 }
 
 // Default server instance
 var s *Server
 
+// Interval in seconds at which keepalive messages are sent to server-sent event listeners
+const sseKeepAliveInterval = 15
+
+// Interval at which Drain checks whether all sessions have finished
+const drainPollInterval = 250 * time.Millisecond
+
 // Initialize the default server instance with the specified configuration using New().
 func Initialize(conf *server.Configuration) (err error) {
 	s, err = New(conf)
@@ -45,6 +67,14 @@ func New(conf *server.Configuration) (*Server, error) {
 	if err := conf.Check(); err != nil {
 		return nil, err
 	}
+	if _, _, err := protocolVersionRange(conf); err != nil {
+		return nil, err
+	}
+	for _, window := range conf.StatsWindows {
+		if window <= 0 {
+			return nil, errors.Errorf("stats_windows must be positive (was %d)", window)
+		}
+	}
 
 	var e *sse.Server
 	if conf.EnableSSE {
@@ -53,9 +83,24 @@ func New(conf *server.Configuration) (*Server, error) {
 	conf.IrmaConfiguration.Revocation.ServerSentEvents = e
 
 	s := &Server{
-		conf:             conf,
-		scheduler:        gocron.NewScheduler(time.UTC),
-		serverSentEvents: e,
+		conf:              conf,
+		scheduler:         gocron.NewScheduler(time.UTC),
+		serverSentEvents:  e,
+		metrics:           newSessionMetrics(),
+		frontendListeners: newFrontendListeners(),
+	}
+	s.stats = newSessionStats(s.statsWindows())
+	s.tracer = s.tracerProvider().Tracer(tracerName)
+	s.callbacksCtx, s.cancelCallbacks = context.WithCancel(context.Background())
+
+	if e != nil {
+		// Periodically send an empty message to all listeners, to prevent proxies from closing idle connections.
+		// Empty messages are ignored by EventSource implementations.
+		if _, err := s.scheduler.Every(sseKeepAliveInterval).Seconds().Do(func() {
+			e.SendMessage("", sse.NewMessage("", "", ""))
+		}); err != nil {
+			return nil, err
+		}
 	}
 
 	switch conf.StoreType {
@@ -66,9 +111,10 @@ func New(conf *server.Configuration) (*Server, error) {
 			requestor: make(map[irma.RequestorToken]*session),
 			client:    make(map[irma.ClientToken]*session),
 			conf:      conf,
+			server:    s,
 		}
 
-		if _, err := s.scheduler.Every(10).Seconds().Do(func() {
+		if _, err := s.scheduler.Every(conf.ExpiryTicker).Seconds().Do(func() {
 			s.sessions.(*memorySessionStore).deleteExpired()
 		}); err != nil {
 			return nil, err
@@ -94,10 +140,34 @@ func New(conf *server.Configuration) (*Server, error) {
 		s.sessions = &redisSessionStore{
 			client: cl,
 			conf:   conf,
+			server: s,
 			locker: redislock.New(cl),
 		}
+	case "postgres":
+		store, err := newPostgresSessionStore(s)
+		if err != nil {
+			return nil, err
+		}
+		s.sessions = store
+
+		if _, err := s.scheduler.Every(conf.ExpiryTicker).Seconds().Do(func() {
+			s.sessions.(*postgresSessionStore).deleteExpired()
+		}); err != nil {
+			return nil, err
+		}
 	default:
-		return nil, errors.New("storeType not known")
+		factory := sessionStoreFactory(conf.StoreType)
+		if factory == nil {
+			return nil, errors.New("storeType not known")
+		}
+		if conf.EnableSSE {
+			return nil, errors.New("Currently server-sent events (SSE) cannot be used simultaneously with custom session stores.")
+		}
+		store, err := factory(conf)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to create session store", 0)
+		}
+		s.sessions = &customSessionStore{store: store, conf: conf, server: s}
 	}
 
 	if _, err := s.scheduler.Every(irma.RevocationParameters.RequestorUpdateInterval).Seconds().Do(func() {
@@ -114,6 +184,13 @@ func New(conf *server.Configuration) (*Server, error) {
 		return nil, err
 	}
 
+	if conf.WatchSchemes {
+		var err error
+		if s.schemeWatcher, err = newSchemeWatcher(conf); err != nil {
+			return nil, errors.WrapPrefix(err, "failed to watch schemes", 0)
+		}
+	}
+
 	gocron.SetPanicHandler(server.GocronPanicHandler(s.conf.Logger))
 	s.scheduler.StartAsync()
 
@@ -176,14 +253,16 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 	opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: true}
 	r.Use(server.LogMiddleware("client", opts))
 
-	r.Use(server.SizeLimitMiddleware)
-	r.Use(server.TimeoutMiddleware([]string{"/statusevents", "/updateevents"}, server.WriteTimeout))
+	r.Use(server.BodySizeLimitMiddleware(s.conf.MaxRequestSize))
+	r.Use(server.TimeoutMiddleware([]string{"/statusevents", "/updateevents", "/frontend/ws"}, server.WriteTimeout))
 
 	notfound := &irma.RemoteError{Status: 404, ErrorName: string(server.ErrorInvalidRequest.Type)}
 	notallowed := &irma.RemoteError{Status: 405, ErrorName: string(server.ErrorInvalidRequest.Type)}
 	r.NotFound(errorWriter(notfound, server.WriteResponse))
 	r.MethodNotAllowed(errorWriter(notallowed, server.WriteResponse))
 
+	// The WebSocket is long-lived, so it does not use the session middleware that locks the session.
+	r.Get("/session/{clientToken}/frontend/ws", s.handleFrontendWebSocket)
 	r.Route("/session/{clientToken}", func(r chi.Router) {
 		r.Use(s.sessionMiddleware)
 		r.Delete("/", s.handleSessionDelete)
@@ -230,8 +309,45 @@ func (s *Server) Stop() {
 	if err := s.conf.IrmaConfiguration.Revocation.Close(); err != nil {
 		_ = server.LogWarning(err)
 	}
+	if s.schemeWatcher != nil {
+		s.schemeWatcher.stop()
+	}
 	s.scheduler.Stop()
 	s.sessions.stop()
+	s.cancelCallbacks()
+	s.callbacks.Wait()
+	if err := s.conf.CloseAuditLog(); err != nil {
+		_ = server.LogWarning(err)
+	}
+}
+
+// Drain stops the server from accepting new sessions, and waits until all sessions in progress
+// have finished or until the timeout elapses, whichever comes first. Chained sessions of sessions
+// in progress are still started. Drain only waits for sessions in the memory session store: sessions
+// in other session stores are persisted, so they can be finished at other server instances.
+func Drain(timeout time.Duration) {
+	s.Drain(timeout)
+}
+func (s *Server) Drain(timeout time.Duration) {
+	atomic.StoreInt32(&s.draining, 1)
+	memstore, ok := s.sessions.(*memorySessionStore)
+	if !ok {
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		count := memstore.unfinished()
+		if count == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.conf.Logger.WithField("count", count).Warn("Drain timeout elapsed, aborting unfinished sessions")
+			return
+		}
+		s.conf.Logger.WithField("count", count).Debug("Waiting for unfinished sessions")
+		time.Sleep(drainPollInterval)
+	}
 }
 
 // StartSession starts an IRMA session, running the handler on completion, if specified.
@@ -246,14 +362,35 @@ func StartSession(request interface{}, handler server.SessionHandler,
 }
 func (s *Server) StartSession(req interface{}, handler server.SessionHandler,
 ) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
-	return s.startNextSession(req, handler, nil, "")
+	if atomic.LoadInt32(&s.draining) != 0 {
+		return nil, "", nil, ErrDraining
+	}
+	return s.startNextSession(req, handler, nil, "", "")
 }
+
+// StartRequestorSession starts an IRMA session like StartSession, on behalf of the specified requestor.
+// When the session is followed by a chained session (see irma.NextSessionData), the AuthorizeNextSession
+// function of the configuration is used to check whether the requestor may start the next session.
+func (s *Server) StartRequestorSession(requestor string, req interface{}, handler server.SessionHandler,
+) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
+	if atomic.LoadInt32(&s.draining) != 0 {
+		return nil, "", nil, ErrDraining
+	}
+	return s.startNextSession(req, handler, nil, "", requestor)
+}
+
 func (s *Server) startNextSession(
-	req interface{}, handler server.SessionHandler, disclosed irma.AttributeConDisCon, FrontendAuth irma.FrontendAuthorization,
+	req interface{}, handler server.SessionHandler, disclosed irma.AttributeConDisCon, FrontendAuth irma.FrontendAuthorization, requestor string,
 ) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
 	if s.conf.StoreType == "redis" && handler != nil {
 		return nil, "", nil, errors.New("Handlers cannot be used in combination with Redis.")
 	}
+	if s.conf.StoreType == "postgres" && handler != nil {
+		return nil, "", nil, errors.New("Handlers cannot be used in combination with PostgreSQL.")
+	}
+	if _, ok := s.sessions.(*customSessionStore); ok && handler != nil {
+		return nil, "", nil, errors.New("Handlers cannot be used in combination with custom session stores.")
+	}
 	rrequest, err := server.ParseSessionRequest(req)
 	if err != nil {
 		return nil, "", nil, err
@@ -265,12 +402,23 @@ func (s *Server) startNextSession(
 	if err := s.validateRequest(request); err != nil {
 		return nil, "", nil, err
 	}
+	if lifetime := rrequest.Base().MaxSessionLifetime; lifetime > s.conf.MaxRequestedSessionLifetime {
+		return nil, "", nil, errors.Errorf("maxSessionLifetime cannot exceed %d minutes", s.conf.MaxRequestedSessionLifetime)
+	}
+	if email := rrequest.Base().NotifyEmail; email != "" {
+		if s.conf.Notifier == nil {
+			return nil, "", nil, errors.New("notifyEmail specified but session notifications are not enabled")
+		}
+		if _, err := mail.ParseAddress(email); err != nil {
+			return nil, "", nil, errors.WrapPrefix(err, "invalid notifyEmail", 0)
+		}
+	}
 	if action == irma.ActionIssuing {
 		// Include the AttributeTypeIdentifiers of random blind attributes to each CredentialRequest.
 		// This way, the client can check prematurely, i.e., before the session,
 		// if it has the same random blind attributes in it's configuration.
 		for _, cred := range request.(*irma.IssuanceRequest).Credentials {
-			cred.RandomBlindAttributeTypeIDs = s.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeNames()
+			cred.RandomBlindAttributeTypeIDs = s.conf.IrmaConfiguration.GetCredentialTypes()[cred.CredentialTypeID].RandomBlindAttributeNames()
 		}
 
 		if err := s.validateIssuanceRequest(request.(*irma.IssuanceRequest)); err != nil {
@@ -279,7 +427,9 @@ func (s *Server) startNextSession(
 	}
 
 	pairingRecommended := false
-	if rrequest.Base().NextSession != nil && rrequest.Base().NextSession.URL != "" {
+	if rrequest.Base().RequirePairing {
+		pairingRecommended = true
+	} else if rrequest.Base().NextSession != nil && rrequest.Base().NextSession.URL != "" {
 		pairingRecommended = true
 	} else if action == irma.ActionDisclosing {
 		err := request.Disclosure().Disclose.Iterate(func(attr *irma.AttributeRequest) error {
@@ -297,7 +447,7 @@ func (s *Server) startNextSession(
 	}
 
 	request.Base().DevelopmentMode = !s.conf.Production
-	session, err := s.newSession(action, rrequest, disclosed, FrontendAuth)
+	session, err := s.newSession(action, rrequest, disclosed, FrontendAuth, requestor)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -312,6 +462,14 @@ func (s *Server) startNextSession(
 			Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest)))
 	}
 	session.handler = handler
+	s.conf.Audit(&server.AuditEvent{
+		Event:     server.AuditSessionStarted,
+		Requestor: requestor,
+		Token:     session.RequestorToken,
+		Action:    action,
+		Requested: request.Disclosure().Disclose,
+		Issued:    issuedCredentialTypes(request),
+	})
 	return &irma.Qr{
 			Type: action,
 			URL:  s.conf.URL + "session/" + string(session.ClientToken),
@@ -337,10 +495,65 @@ func (s *Server) GetSessionResult(requestorToken irma.RequestorToken) (res *serv
 		return
 	}
 
+	_, span := session.startSpan(context.Background(), "irma.session.result")
+	span.End()
 	res = session.Result
 	return
 }
 
+// FinishedSessionResult is the result of a finished session, along with the time at which the
+// session finished.
+type FinishedSessionResult struct {
+	*server.SessionResult
+	Finished time.Time `json:"finished"`
+}
+
+// SessionResults returns the results of the sessions of the specified requestor that finished
+// since the specified time, ordered by the time at which they finished. Results are retained for
+// the session result lifetime after the session finished (see Configuration.SessionResultLifetime,
+// which can be overridden per session using RequestorBaseRequest.ResultLifetime). Custom session
+// stores must implement SessionStoreLister to support this.
+func SessionResults(requestor string, since time.Time) ([]*FinishedSessionResult, error) {
+	return s.SessionResults(requestor, since)
+}
+func (s *Server) SessionResults(requestor string, since time.Time) ([]*FinishedSessionResult, error) {
+	tokens, err := s.sessions.requestorTokens()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*FinishedSessionResult, 0)
+	for _, token := range tokens {
+		result, err := s.finishedSessionResult(token, requestor, since)
+		if _, ok := err.(*UnknownSessionError); ok {
+			continue // expired in the meantime
+		}
+		if err != nil {
+			return nil, err
+		}
+		if result != nil {
+			results = append(results, result)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Finished.Before(results[j].Finished)
+	})
+	return results, nil
+}
+
+func (s *Server) finishedSessionResult(token irma.RequestorToken, requestor string, since time.Time) (
+	result *FinishedSessionResult, err error,
+) {
+	session, err := s.sessions.get(token)
+	defer func() { err = updateAndUnlock(session, err) }()
+	if err != nil {
+		return
+	}
+	if session.Requestor == requestor && session.Status.Finished() && !session.Finished.Before(since) {
+		result = &FinishedSessionResult{SessionResult: session.Result, Finished: session.Finished}
+	}
+	return
+}
+
 // GetRequest retrieves the request submitted by the requestor that started the specified IRMA session.
 func GetRequest(requestorToken irma.RequestorToken) (irma.RequestorRequest, error) {
 	return s.GetRequest(requestorToken)
@@ -356,7 +569,8 @@ func (s *Server) GetRequest(requestorToken irma.RequestorToken) (req irma.Reques
 	return
 }
 
-// CancelSession cancels the specified IRMA session.
+// CancelSession cancels the specified IRMA session. If the session has already finished,
+// a *SessionFinishedError is returned and the session is left unchanged.
 func CancelSession(requestorToken irma.RequestorToken) error {
 	return s.CancelSession(requestorToken)
 }
@@ -367,6 +581,9 @@ func (s *Server) CancelSession(requestorToken irma.RequestorToken) (err error) {
 		return
 	}
 
+	if session.Status.Finished() {
+		return &SessionFinishedError{requestorToken, session.Status}
+	}
 	session.handleDelete()
 	return
 }
@@ -430,15 +647,16 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 	session, err := s.sessions.get(token)
 	err = updateAndUnlock(session, err)
 	if err != nil {
-		if _, ok := err.(*RedisError); ok {
+		switch err.(type) {
+		case *RedisError, *PostgresError, *SessionStoreError:
 			// In no flow, you should end up with an storeError. If you do, be alarmed!
-			// Only the Redis session store implementation actively uses these errors. As the Redis session store
-			// currently cannot be used in combination with SSE, there should be no storeError here.
+			// Only the Redis, PostgreSQL and custom session store implementations actively use these errors. As these
+			// session stores currently cannot be used in combination with SSE, there should be no storeError here.
 			// Furthermore, the specific storeError is already logged in `session.go` and does not have
 			// to be logged again.
 			err = server.LogError(errors.Errorf("unexpectedly triggered error when trying to receive session %s", token))
 			return
-		} else {
+		default:
 			return
 		}
 	}
@@ -493,6 +711,12 @@ func (s *Server) SessionStatus(requestorToken irma.RequestorToken) (statusChan c
 	if s.conf.StoreType == "redis" {
 		return nil, errors.New("SessionStatus cannot be used in combination with Redis.")
 	}
+	if s.conf.StoreType == "postgres" {
+		return nil, errors.New("SessionStatus cannot be used in combination with PostgreSQL.")
+	}
+	if _, ok := s.sessions.(*customSessionStore); ok {
+		return nil, errors.New("SessionStatus cannot be used in combination with custom session stores.")
+	}
 
 	session, err := s.sessions.get(requestorToken)
 	err = updateAndUnlock(session, err)
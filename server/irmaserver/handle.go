@@ -44,14 +44,22 @@ func (session *session) handleGetClientRequest(min, max *irma.ProtocolVersion, c
 	session.markAlive()
 	logger := session.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken})
 
+	// Handle legacy clients that do not support condiscon, by attempting to convert the condiscon
+	// session request to the legacy session request format
+	legacy, legacyErr := session.request.Legacy()
+	session.LegacyCompatible = legacyErr == nil
+	if legacyErr != nil {
+		logger.Info("Using condiscon: backwards compatibility with legacy IRMA apps is disabled")
+	}
+
 	var err error
 	if session.Version, err = session.chooseProtocolVersion(min, max); err != nil {
-		return nil, session.fail(server.ErrorProtocolVersion, "")
+		return nil, session.fail(server.ErrorProtocolVersion, err.Error())
 	}
 
-	// Protocol versions below 2.8 don't include an authorization header. Therefore skip the authorization
+	// Lower protocol versions don't include an authorization header. Therefore skip the authorization
 	// header presence check if a lower version is used.
-	if clientAuth == "" && session.Version.Above(2, 7) {
+	if clientAuth == "" && session.supports(featureClientAuthorization) {
 		return nil, session.fail(server.ErrorIrmaUnauthorized, "No authorization header provided")
 	}
 	session.ClientAuth = clientAuth
@@ -62,30 +70,22 @@ func (session *session) handleGetClientRequest(min, max *irma.ProtocolVersion, c
 		return nil, session.fail(server.ErrorRevocation, err.Error())
 	}
 
-	// Handle legacy clients that do not support condiscon, by attempting to convert the condiscon
-	// session request to the legacy session request format
-	legacy, legacyErr := session.request.Legacy()
-	session.LegacyCompatible = legacyErr == nil
-	if legacyErr != nil {
-		logger.Info("Using condiscon: backwards compatibility with legacy IRMA apps is disabled")
-	}
-
 	logger.WithFields(logrus.Fields{"version": session.Version.String()}).Debugf("Protocol version negotiated")
 	session.request.Base().ProtocolVersion = session.Version
 
-	if session.Options.PairingMethod != irma.PairingMethodNone && session.Version.Above(2, 7) {
+	if session.Options.PairingMethod != irma.PairingMethodNone && session.supports(featurePairing) {
 		session.setStatus(irma.ServerStatusPairing)
 	} else {
 		session.setStatus(irma.ServerStatusConnected)
 	}
 
-	if session.Version.Below(2, 5) {
+	if !session.supports(featureCondiscon) {
 		logger.Info("Returning legacy session format")
 		legacy.Base().ProtocolVersion = session.Version
 		return legacy, nil
 	}
 
-	if session.Version.Below(2, 8) {
+	if !session.supports(featureClientSessionRequest) {
 		// These versions do not support the ClientSessionRequest format, so send the SessionRequest.
 		request, err := session.getRequest()
 		if err != nil {
@@ -178,7 +178,7 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	for i, proof := range commitments.Proofs {
 		pubkey := pubkeys[i]
 		schemeid := irma.NewIssuerIdentifier(pubkey.Issuer).SchemeManagerIdentifier()
-		if session.conf.IrmaConfiguration.SchemeManagers[schemeid].Distributed() {
+		if session.conf.IrmaConfiguration.GetSchemeManagers()[schemeid].Distributed() {
 			proofP, err := session.getProofP(commitments, schemeid)
 			if err != nil {
 				return nil, session.fail(server.ErrorKeyshareProofMissing, err.Error())
@@ -212,7 +212,7 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	for i, cred := range request.Credentials {
 		id := cred.CredentialTypeID.IssuerIdentifier()
 		pk, _ := session.conf.IrmaConfiguration.PublicKey(id, cred.KeyCounter)
-		sk, _ := session.conf.IrmaConfiguration.PrivateKeys.Latest(id)
+		sk, _ := session.conf.IrmaConfiguration.PrivateKeys.Get(id, cred.KeyCounter)
 		issuer := gabi.NewIssuer(sk, pk, one)
 		proof, ok := commitments.Proofs[i+discloseCount].(*gabi.ProofU)
 		if !ok {
@@ -222,7 +222,7 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 		if err != nil {
 			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
 		}
-		rb := session.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeIndices()
+		rb := session.conf.IrmaConfiguration.GetCredentialTypes()[cred.CredentialTypeID].RandomBlindAttributeIndices()
 		sig, err := issuer.IssueSignature(proof.U, attrs, witness, commitments.Nonce2, rb)
 		if err != nil {
 			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
@@ -255,13 +255,8 @@ func (session *session) nextSession() (irma.RequestorRequest, irma.AttributeConD
 
 	var res interface{}
 	var err error
-	if session.conf.JwtRSAPrivateKey != nil {
-		res, err = server.ResultJwt(
-			session.Result,
-			session.conf.JwtIssuer,
-			base.ResultJwtValidity,
-			session.conf.JwtRSAPrivateKey,
-		)
+	if session.conf.JwtSigner != nil {
+		res, err = session.conf.ResultJwt(session.Result, base.ResultJwtValidity)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -300,7 +295,7 @@ func (session *session) nextSession() (irma.RequestorRequest, irma.AttributeConD
 	return req, disclosed, nil
 }
 
-func (s *Server) startNext(session *session, res *irma.ServerSessionResponse) error {
+func (s *Server) startNext(r *http.Request, session *session, res *irma.ServerSessionResponse) error {
 	next, disclosed, err := session.nextSession()
 	if err != nil {
 		return err
@@ -308,13 +303,22 @@ func (s *Server) startNext(session *session, res *irma.ServerSessionResponse) er
 	if next == nil {
 		return nil
 	}
+	if s.conf.AuthorizeNextSession != nil {
+		if err = s.conf.AuthorizeNextSession(session.Requestor, next); err != nil {
+			return err
+		}
+	}
 	// All attributes that were disclosed in the previous session, as well as any attributes
 	// from sessions before that, need to be disclosed in the new session as well.
 	// Therefore pass them as parameters to startNextSession
-	qr, token, _, err := s.startNextSession(next, nil, disclosed, session.FrontendAuth)
+	qr, token, _, err := s.startNextSession(next, nil, disclosed, session.FrontendAuth, session.Requestor)
+	if s.conf.AuthorizeNextSession != nil && s.conf.NextSessionStarted != nil {
+		s.conf.NextSessionStarted(session.Requestor, token)
+	}
 	if err != nil {
 		return err
 	}
+	s.setExternalURL(r, qr)
 	session.Result.NextSession = token
 	session.Next = qr
 
@@ -330,17 +334,21 @@ func (s *Server) handleSessionCommitments(w http.ResponseWriter, r *http.Request
 		server.WriteError(w, server.ErrorMalformedInput, err.Error())
 		return
 	}
-	if err := irma.UnmarshalValidate(bts, commitments); err != nil {
+	session := r.Context().Value("session").(*session)
+	if err := s.unmarshalCommitments(session, bts, commitments); err != nil {
 		server.WriteError(w, server.ErrorMalformedInput, err.Error())
 		return
 	}
-	session := r.Context().Value("session").(*session)
-	res, rerr := session.handlePostCommitments(commitments)
+	start := time.Now()
+	res, rerr := session.traceProofs(r.Context(), func() (*irma.ServerSessionResponse, *irma.RemoteError) {
+		return session.handlePostCommitments(commitments)
+	})
 	if rerr != nil {
 		server.WriteResponse(w, nil, rerr)
 		return
 	}
-	if err = s.startNext(session, res); err != nil {
+	s.metrics.proofVerified(session.Action, time.Since(start))
+	if err = s.startNext(r, session, res); err != nil {
 		server.WriteError(w, server.ErrorNextSession, err.Error())
 		return
 	}
@@ -357,21 +365,26 @@ func (s *Server) handleSessionProofs(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*session)
 	var res *irma.ServerSessionResponse
 	var rerr *irma.RemoteError
+	start := time.Now()
 	switch session.Action {
 	case irma.ActionDisclosing:
 		disclosure := &irma.Disclosure{}
-		if err := irma.UnmarshalValidate(bts, disclosure); err != nil {
+		if err := s.unmarshalDisclosure(session, bts, disclosure); err != nil {
 			server.WriteError(w, server.ErrorMalformedInput, err.Error())
 			return
 		}
-		res, rerr = session.handlePostDisclosure(disclosure)
+		res, rerr = session.traceProofs(r.Context(), func() (*irma.ServerSessionResponse, *irma.RemoteError) {
+			return session.handlePostDisclosure(disclosure)
+		})
 	case irma.ActionSigning:
 		signature := &irma.SignedMessage{}
-		if err := irma.UnmarshalValidate(bts, signature); err != nil {
+		if err := s.unmarshalValidate(bts, signature); err != nil {
 			server.WriteError(w, server.ErrorMalformedInput, err.Error())
 			return
 		}
-		res, rerr = session.handlePostSignature(signature)
+		res, rerr = session.traceProofs(r.Context(), func() (*irma.ServerSessionResponse, *irma.RemoteError) {
+			return session.handlePostSignature(signature)
+		})
 	default:
 		rerr = server.RemoteError(server.ErrorInvalidRequest, "")
 	}
@@ -379,7 +392,8 @@ func (s *Server) handleSessionProofs(w http.ResponseWriter, r *http.Request) {
 		server.WriteResponse(w, nil, rerr)
 		return
 	}
-	if err = s.startNext(session, res); err != nil {
+	s.metrics.proofVerified(session.Action, time.Since(start))
+	if err = s.startNext(r, session, res); err != nil {
 		server.WriteError(w, server.ErrorNextSession, err.Error())
 		return
 	}
@@ -431,7 +445,7 @@ func (s *Server) handleSessionGet(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleSessionGetRequest(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*session)
-	if session.Version.Below(2, 8) {
+	if !session.supports(featureClientSessionRequest) {
 		server.WriteError(w, server.ErrorUnexpectedRequest, "Endpoint is not support in used protocol version")
 		return
 	}
@@ -471,7 +485,7 @@ func (s *Server) handleFrontendOptionsPost(w http.ResponseWriter, r *http.Reques
 		server.WriteError(w, server.ErrorMalformedInput, err.Error())
 		return
 	}
-	err = irma.UnmarshalValidate(bts, optionsRequest)
+	err = s.unmarshalValidate(bts, optionsRequest)
 	if err != nil {
 		server.WriteError(w, server.ErrorMalformedInput, err.Error())
 		return
@@ -502,10 +516,21 @@ func (s *Server) handleStaticMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	qr, _, _, err := s.StartSession(rrequest, nil)
+	if err == ErrDraining {
+		server.WriteResponse(w, nil, server.RemoteError(server.ErrorShuttingDown, ""))
+		return
+	}
 	if err != nil {
-		server.WriteResponse(w, nil, server.RemoteError(server.ErrorMalformedInput, err.Error()))
+		switch err.(type) {
+		case *RedisError, *PostgresError, *SessionStoreError:
+			// Don't expose details about the session store to the client
+			server.WriteResponse(w, nil, server.RemoteError(server.ErrorInternal, ""))
+		default:
+			server.WriteResponse(w, nil, server.RemoteError(server.ErrorMalformedInput, err.Error()))
+		}
 		return
 	}
+	s.setExternalURL(r, qr)
 	server.WriteResponse(w, qr, nil)
 }
 
@@ -0,0 +1,98 @@
+package irmaserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// HealthStatus is the response of the health and readiness endpoints. Checks contains the
+// subsystems that were checked, mapped to "ok" or to a description of why they failed.
+type HealthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+const (
+	healthStatusOK       = "ok"
+	healthStatusReady    = "ready"
+	healthStatusNotReady = "not_ready"
+)
+
+// HealthHandler returns a http.Handler that reports whether the server process is alive,
+// e.g. for a liveness probe. It always responds with 200.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.WriteJson(w, HealthStatus{Status: healthStatusOK})
+	})
+}
+
+// ReadyHandler returns a http.Handler that reports whether the server is ready to handle
+// sessions, e.g. for a readiness probe: the schemes are parsed, the session store is reachable,
+// and the JWT private key is loaded if configured. It responds with 200 if so and 503 otherwise,
+// describing the failing subsystems. While the server is being drained, it is not ready.
+func (s *Server) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := s.Readiness()
+		if status.Status != healthStatusReady {
+			bts, _ := json.Marshal(status)
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write(bts)
+			return
+		}
+		server.WriteJson(w, status)
+	})
+}
+
+// Readiness checks whether the server is ready to handle sessions (see ReadyHandler).
+func Readiness() HealthStatus {
+	return s.Readiness()
+}
+func (s *Server) Readiness() HealthStatus {
+	checks := map[string]string{
+		"schemes":       s.checkSchemes(),
+		"session_store": healthStatusOK,
+		"jwt_keys":      healthStatusOK,
+	}
+	if err := s.sessions.ping(); err != nil {
+		checks["session_store"] = "unreachable: " + err.Error()
+	}
+	if s.conf.JwtSigner == nil && (s.conf.JwtPrivateKey != "" || s.conf.JwtPrivateKeyFile != "") {
+		checks["jwt_keys"] = "JWT private key not loaded"
+	}
+	if atomic.LoadInt32(&s.draining) == 1 {
+		checks["draining"] = "server is shutting down"
+	}
+
+	status := HealthStatus{Status: healthStatusReady, Checks: checks}
+	for _, check := range checks {
+		if check != healthStatusOK {
+			status.Status = healthStatusNotReady
+		}
+	}
+	return status
+}
+
+func (s *Server) checkSchemes() string {
+	conf := s.conf.IrmaConfiguration
+	if conf == nil || len(conf.GetSchemeManagers()) == 0 {
+		return "no schemes parsed"
+	}
+	var invalid []string
+	for id, scheme := range conf.GetSchemeManagers() {
+		if scheme.Status != irma.SchemeManagerStatusValid {
+			invalid = append(invalid, id.String()+" ("+string(scheme.Status)+")")
+		}
+	}
+	if len(invalid) == 0 {
+		return healthStatusOK
+	}
+	sort.Strings(invalid)
+	return "invalid schemes: " + strings.Join(invalid, ", ")
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/alexandrevicenzi/go-sse"
@@ -42,6 +43,9 @@ func (session *session) setStatus(status irma.ServerStatus) {
 		Info("Session status updated")
 	session.Status = status
 	session.Result.Status = status
+	if status.Finished() && session.Finished.IsZero() {
+		session.Finished = time.Now()
+	}
 	session.onStatusChange()
 }
 
@@ -56,7 +60,28 @@ func (session *session) onStatusChange() {
 
 	// Execute callback and handler if status is Finished
 	if session.Status.Finished() {
+		session.server.metrics.sessionFinished(session.Action, session.Status, session.Created, session.inMemory())
+		session.server.stats.sessionFinished(session.Action, session.Requestor, session.Status, time.Since(session.Created))
+		session.conf.Audit(&server.AuditEvent{
+			Event:       server.AuditSessionFinished,
+			Requestor:   session.Requestor,
+			Token:       session.RequestorToken,
+			Action:      session.Action,
+			Status:      session.Status,
+			ProofStatus: session.Result.ProofStatus,
+			Disclosed:   session.Result.Disclosed,
+			Err:         session.Result.Err,
+		})
 		session.doResultCallback()
+		session.conf.Notify(session.Rrequest.Base().NotifyEmail, &server.SessionNotification{
+			Requestor:   session.Requestor,
+			Token:       session.RequestorToken,
+			Action:      session.Action,
+			Status:      session.Status,
+			ProofStatus: session.Result.ProofStatus,
+			Disclosed:   session.Result.Disclosed,
+			Err:         session.Result.Err,
+		})
 
 		if session.handler != nil {
 			handler := session.handler
@@ -65,6 +90,11 @@ func (session *session) onStatusChange() {
 		}
 	}
 
+	// Send updates to the WebSockets of the frontend of this session
+	session.server.frontendListeners.notify(session.ClientToken,
+		&irma.FrontendSessionStatus{Status: session.Status, NextSession: session.Next},
+	)
+
 	// Send updates in case SSE is used
 	if session.sse == nil {
 		return
@@ -79,6 +109,13 @@ func (session *session) onStatusChange() {
 	session.sse.SendMessage("frontendsession/"+string(session.ClientToken),
 		sse.SimpleMessage(string(frontendstatus)),
 	)
+
+	// No status updates follow after a final status, so we can end the event streams of this session.
+	if session.Status.Finished() {
+		session.sse.CloseChannel("session/" + string(session.ClientToken))
+		session.sse.CloseChannel("session/" + string(session.RequestorToken))
+		session.sse.CloseChannel("frontendsession/" + string(session.ClientToken))
+	}
 }
 
 func (session *session) doResultCallback() {
@@ -86,12 +123,10 @@ func (session *session) doResultCallback() {
 	if url == "" {
 		return
 	}
-	server.DoResultCallback(url,
-		session.Result,
-		session.conf.JwtIssuer,
-		session.Rrequest.Base().ResultJwtValidity,
-		session.conf.JwtRSAPrivateKey,
-	)
+	opts := session.conf.ResultCallbackOptions(session.Rrequest.Base().ResultJwtValidity)
+	opts.Context = session.server.callbacksCtx
+	opts.WaitGroup = &session.server.callbacks
+	server.DoResultCallbackWithOptions(url, session.Result, opts)
 }
 
 // Checks whether requested options are valid in the current session context.
@@ -102,6 +137,9 @@ func (session *session) updateFrontendOptions(request *irma.FrontendOptionsReque
 	if request.PairingMethod == "" {
 		return &session.Options, nil
 	} else if request.PairingMethod == irma.PairingMethodNone {
+		if session.Rrequest.Base().RequirePairing {
+			return nil, errors.New("Pairing is required by the requestor for this session")
+		}
 		session.Options.PairingCode = ""
 	} else if request.PairingMethod == irma.PairingMethodPin {
 		session.Options.PairingCode = common.NewPairingCode()
@@ -128,33 +166,6 @@ func (session *session) fail(err server.Error, message string) *irma.RemoteError
 	return rerr
 }
 
-func (session *session) chooseProtocolVersion(minClient, maxClient *irma.ProtocolVersion) (*irma.ProtocolVersion, error) {
-	// Set minimum supported version to 2.5 if condiscon compatibility is required
-	minServer := minProtocolVersion
-	if !session.LegacyCompatible {
-		minServer = &irma.ProtocolVersion{Major: 2, Minor: 5}
-	}
-	// Set minimum to 2.6 if nonrevocation is required
-	if len(session.request.Base().Revocation) > 0 {
-		minServer = &irma.ProtocolVersion{Major: 2, Minor: 6}
-	}
-	// Set minimum to 2.7 if chained session are used
-	if session.Rrequest.Base().NextSession != nil {
-		minServer = &irma.ProtocolVersion{Major: 2, Minor: 7}
-	}
-
-	if minClient.AboveVersion(maxProtocolVersion) || maxClient.BelowVersion(minServer) || maxClient.BelowVersion(minClient) {
-		err := errors.Errorf("Protocol version negotiation failed, min=%s max=%s minServer=%s maxServer=%s", minClient.String(), maxClient.String(), minServer.String(), maxProtocolVersion.String())
-		_ = server.LogWarning(err)
-		return nil, err
-	}
-	if maxClient.AboveVersion(maxProtocolVersion) {
-		return maxProtocolVersion, nil
-	} else {
-		return maxClient, nil
-	}
-}
-
 const retryTimeLimit = 10 * time.Second
 
 // checkCache returns a previously cached response, for replaying against multiple requests from
@@ -179,7 +190,7 @@ func (session *session) checkCache(endpoint string, message []byte) (int, []byte
 
 func (session *session) computeWitness(sk *gabikeys.PrivateKey, cred *irma.CredentialRequest) (*revocation.Witness, error) {
 	id := cred.CredentialTypeID
-	credtyp := session.conf.IrmaConfiguration.CredentialTypes[id]
+	credtyp := session.conf.IrmaConfiguration.GetCredentialTypes()[id]
 	if !credtyp.RevocationSupported() || !session.request.Base().RevocationSupported() {
 		return nil, nil
 	}
@@ -233,7 +244,7 @@ func (session *session) computeAttributes(
 	}
 
 	issuedAt := time.Now()
-	attributes, err := cred.AttributeList(session.conf.IrmaConfiguration, 0x03, nonrevAttr, issuedAt)
+	attributes, err := cred.AttributeList(session.conf.IrmaConfiguration, irma.GetMetadataVersion(session.Version), nonrevAttr, issuedAt)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -256,31 +267,59 @@ func (session *session) computeAttributes(
 	return attributes.Ints, witness, nil
 }
 
-func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
-	for _, cred := range request.Credentials {
-		// Check that we have the appropriate private key
-		iss := cred.CredentialTypeID.IssuerIdentifier()
-		privatekey, err := s.conf.IrmaConfiguration.PrivateKeys.Latest(iss)
-		if err != nil {
-			return err
+// issuancePrivateKey returns the private key to issue credentials of the specified issuer with:
+// of the installed private keys whose public key has not expired, the one with the highest counter.
+func (s *Server) issuancePrivateKey(iss irma.IssuerIdentifier) (*gabikeys.PrivateKey, error) {
+	conf := s.conf.IrmaConfiguration
+	now := time.Now().Unix()
+	var privatekey, latest *gabikeys.PrivateKey
+	err := conf.PrivateKeys.Iterate(iss, func(sk *gabikeys.PrivateKey) error {
+		if latest == nil || sk.Counter > latest.Counter {
+			latest = sk
 		}
-		if privatekey == nil {
-			return errors.Errorf("missing private key of issuer %s", iss.String())
+		if privatekey != nil && sk.Counter <= privatekey.Counter {
+			return nil
 		}
-		pubkey, err := s.conf.IrmaConfiguration.PublicKey(iss, privatekey.Counter)
+		pubkey, err := conf.PublicKey(iss, sk.Counter)
 		if err != nil {
 			return err
 		}
-		if pubkey == nil {
-			return errors.Errorf("missing public key of issuer %s", iss.String())
+		if pubkey != nil && now <= pubkey.ExpiryDate {
+			privatekey = sk
 		}
-		now := time.Now()
-		if now.Unix() > pubkey.ExpiryDate {
-			return errors.Errorf("cannot issue using expired public key %s-%d", iss.String(), privatekey.Counter)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return nil, errors.Errorf("missing private key of issuer %s", iss.String())
+	}
+	if privatekey == nil {
+		return nil, errors.Errorf("cannot issue using expired public key %s-%d", iss.String(), latest.Counter)
+	}
+
+	// Warn if the issuer rotated its keys, but the private key of the new public key is not installed
+	if issuer := conf.GetIssuers()[iss]; issuer != nil {
+		if current, err := issuer.CurrentPublicKey(conf); err == nil && current.Counter > privatekey.Counter {
+			s.conf.Logger.Warnf("Issuing using public key %s-%d, while newer public key %s-%d exists of which the private key is not installed",
+				iss.String(), privatekey.Counter, iss.String(), current.Counter)
+		}
+	}
+	return privatekey, nil
+}
+
+func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
+	for _, cred := range request.Credentials {
+		// Check that we have the appropriate private key
+		iss := cred.CredentialTypeID.IssuerIdentifier()
+		privatekey, err := s.issuancePrivateKey(iss)
+		if err != nil {
+			return err
 		}
 		cred.KeyCounter = privatekey.Counter
 
-		if s.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RevocationSupported() {
+		if s.conf.IrmaConfiguration.GetCredentialTypes()[cred.CredentialTypeID].RevocationSupported() {
 			settings := s.conf.RevocationSettings[cred.CredentialTypeID]
 			if settings == nil || (settings.RevocationServerURL == "" && !settings.Server) {
 				return errors.Errorf("revocation enabled for %s but no revocation server configured", cred.CredentialTypeID)
@@ -300,7 +339,7 @@ func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 		if cred.Validity == nil {
 			cred.Validity = &defaultValidity
 		}
-		if cred.Validity.Before(irma.Timestamp(now)) {
+		if cred.Validity.Before(irma.Timestamp(time.Now())) {
 			return errors.New("cannot issue expired credentials")
 		}
 	}
@@ -371,7 +410,11 @@ func (session *session) getRequest() (irma.SessionRequest, error) {
 }
 
 func (session *session) updateAndUnlock() error {
+	start := time.Now()
 	err := session.sessions.update(session)
+	if !session.inMemory() {
+		session.traceStore("update", start, err)
+	}
 	if err != nil {
 		return err
 	}
@@ -390,6 +433,28 @@ func (s *sessionData) hash() [32]byte {
 	return sha256.Sum256(sessionJSON)
 }
 
+// marshal serializes the session data to be stored in a persistent session store, encrypting it
+// if a session cipher is configured. The client token is authenticated along with the encrypted
+// session, so that it cannot be loaded as another session.
+func (s *sessionData) marshal(conf *server.Configuration) ([]byte, error) {
+	bts, err := json.Marshal(s)
+	if err != nil || conf.SessionCipher == nil {
+		return bts, err
+	}
+	return conf.SessionCipher.Encrypt(bts, []byte(s.ClientToken))
+}
+
+// unmarshal deserializes session data loaded from a persistent session store (see marshal).
+func (s *sessionData) unmarshal(conf *server.Configuration, token irma.ClientToken, data []byte) error {
+	if conf.SessionCipher != nil {
+		var err error
+		if data, err = conf.SessionCipher.Decrypt(data, []byte(token)); err != nil {
+			return errors.WrapPrefix(err, "failed to decrypt session", 0)
+		}
+	}
+	return json.Unmarshal(data, s)
+}
+
 // UnmarshalJSON unmarshals sessionData.
 func (s *sessionData) UnmarshalJSON(data []byte) error {
 	type rawSessionData sessionData
@@ -424,6 +489,26 @@ func (s *sessionData) UnmarshalJSON(data []byte) error {
 
 // Other
 
+// unmarshalValidate unmarshals and validates a message from the IRMA app or a frontend, rejecting
+// unknown fields if StrictDecoding is enabled.
+func (s *Server) unmarshalValidate(data []byte, dest interface{}) error {
+	if s.conf.StrictDecoding {
+		return server.UnmarshalValidateStrict(data, dest)
+	}
+	return irma.UnmarshalValidate(data, dest)
+}
+
+// setExternalURL replaces the URL of the server in the session pointer by the one returned by
+// the ExternalURL function of the configuration for the specified request, if any.
+func (s *Server) setExternalURL(r *http.Request, qr *irma.Qr) {
+	if s.conf.ExternalURL == nil || qr == nil {
+		return
+	}
+	if url := s.conf.ExternalURL(r); url != "" && strings.HasPrefix(qr.URL, s.conf.URL) {
+		qr.URL = url + strings.TrimPrefix(qr.URL, s.conf.URL)
+	}
+}
+
 func (s *Server) validateRequest(request irma.SessionRequest) error {
 	if _, err := s.conf.IrmaConfiguration.Download(request); err != nil {
 		return err
@@ -455,6 +540,19 @@ func copyObject(i interface{}) (interface{}, error) {
 	return cpy, nil
 }
 
+// issuedCredentialTypes returns the types of the credentials to be issued in the session, if any.
+func issuedCredentialTypes(request irma.SessionRequest) []irma.CredentialTypeIdentifier {
+	isreq, ok := request.(*irma.IssuanceRequest)
+	if !ok {
+		return nil
+	}
+	types := make([]irma.CredentialTypeIdentifier, 0, len(isreq.Credentials))
+	for _, cred := range isreq.Credentials {
+		types = append(types, cred.CredentialTypeID)
+	}
+	return types
+}
+
 // purgeRequest logs the request excluding any attribute values.
 func purgeRequest(request irma.RequestorRequest) irma.RequestorRequest {
 	// We want to log as much as possible of the request, but no attribute values.
@@ -587,13 +685,31 @@ func (s *Server) sessionMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		r, span := session.traceClientRequest(r)
+		defer span.End()
+
+		// With optimistic locking, changes to the session may be rejected when storing them,
+		// so then the response is only sent once the session has been stored.
+		out := w
+		var buf *responseBuffer
+		if s.conf.OptimisticLocking {
+			buf = &responseBuffer{header: http.Header{}}
+			out = buf
+		}
+
 		defer func() {
 			err := session.updateAndUnlock()
-			if err != nil {
+			if err == ErrSessionConflict {
+				server.WriteError(w, server.ErrorSessionConflict, "")
+				return
+			} else if err != nil {
 				// Error already logged in update method.
 				server.WriteError(w, server.ErrorInternal, "")
 				return
 			}
+			if buf != nil {
+				buf.flush(w)
+			}
 
 			result := session.Result
 			r := r.Context().Value("sessionresult")
@@ -602,10 +718,45 @@ func (s *Server) sessionMiddleware(next http.Handler) http.Handler {
 			}
 		}()
 
-		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "session", session)))
+		next.ServeHTTP(out, r.WithContext(context.WithValue(r.Context(), "session", session)))
 	})
 }
 
+// responseBuffer is a http.ResponseWriter that buffers the response until it is flushed.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) Write(bts []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(bts)
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) flush(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	w.WriteHeader(b.status)
+	_, _ = w.Write(b.body.Bytes())
+}
+
 func (s *Server) pairingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		session := r.Context().Value("session").(*session)
@@ -0,0 +1,94 @@
+package irmaserver
+
+import (
+	"encoding/json"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// This file contains the translation shims for legacy IRMA apps, speaking protocol versions below
+// minProtocolVersion. These apps receive session requests in the legacy format and responses in
+// the legacy ServerSessionResponse format, as do apps speaking protocol versions below 2.5 and 2.7
+// respectively. In addition, they send their disclosure proofs without the indices of the
+// disclosed attributes, which are computed here from the session request, and they do not support
+// optional attributes in the metadata of issued credentials (see irma.GetMetadataVersion).
+
+// unmarshalDisclosure unmarshals the disclosure sent by the IRMA app. Legacy IRMA apps send
+// a bare proof list instead of an irma.Disclosure.
+func (s *Server) unmarshalDisclosure(session *session, bts []byte, disclosure *irma.Disclosure) error {
+	if session.supports(featureDisclosureIndices) {
+		return s.unmarshalValidate(bts, disclosure)
+	}
+	if err := json.Unmarshal(bts, &disclosure.Proofs); err != nil {
+		return err
+	}
+	var err error
+	disclosure.Indices, err = legacyDisclosureIndices(
+		disclosure.Proofs, session.request.Disclosure().Disclose, session.conf.IrmaConfiguration,
+	)
+	return err
+}
+
+// unmarshalCommitments unmarshals the issuance commitments sent by the IRMA app. Legacy IRMA apps
+// do not include the indices of the attributes disclosed in the commitments.
+func (s *Server) unmarshalCommitments(session *session, bts []byte, commitments *irma.IssueCommitmentMessage) error {
+	if err := s.unmarshalValidate(bts, commitments); err != nil {
+		return err
+	}
+	if session.supports(featureDisclosureIndices) {
+		return nil
+	}
+	if commitments.IssueCommitmentMessage == nil {
+		return errors.New("missing issuance commitments")
+	}
+	var err error
+	commitments.Indices, err = legacyDisclosureIndices(
+		commitments.Proofs, session.request.Disclosure().Disclose, session.conf.IrmaConfiguration,
+	)
+	return err
+}
+
+// legacyDisclosureIndices computes the indices of the disclosed attributes in the proofs of a
+// legacy IRMA app, by looking up for each disjunction of the request the first disclosed attribute
+// satisfying it. The request must be convertible to the legacy format, so each inner conjunction
+// contains a single attribute. Disjunctions that no disclosed attribute satisfies get no indices,
+// so that they are reported as unsatisfied when verifying the disclosure.
+func legacyDisclosureIndices(
+	proofs gabi.ProofList, condiscon irma.AttributeConDisCon, conf *irma.Configuration,
+) (irma.DisclosedAttributeIndices, error) {
+	indices := make(irma.DisclosedAttributeIndices, len(condiscon))
+	for i, discon := range condiscon {
+		indices[i] = []*irma.DisclosedAttributeIndex{}
+	disjunction:
+		for _, con := range discon {
+			for j, proof := range proofs {
+				proofd, ok := proof.(*gabi.ProofD)
+				if !ok || proofd.ADisclosed[1] == nil {
+					continue
+				}
+				credtype := irma.MetadataFromInt(proofd.ADisclosed[1], conf).CredentialType()
+				if credtype == nil {
+					return nil, errors.New("disclosure proof of unknown credential type")
+				}
+				// Index 1 is the metadata attribute, disclosing the presence of the credential
+				for k := 1; k < len(credtype.AttributeTypes)+2; k++ {
+					if proofd.ADisclosed[k] == nil {
+						continue
+					}
+					index := []*irma.DisclosedAttributeIndex{{CredentialIndex: j, AttributeIndex: k}}
+					satisfied, _, err := con.Satisfy(proofs, index, nil, conf)
+					if err != nil {
+						return nil, err
+					}
+					if satisfied {
+						indices[i] = index
+						break disjunction
+					}
+				}
+			}
+		}
+	}
+	return indices, nil
+}
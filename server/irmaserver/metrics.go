@@ -0,0 +1,170 @@
+package irmaserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// sessionMetrics keeps track of the sessions handled by a Server, for exposure in the Prometheus
+// text format by its MetricsHandler. As the metrics are kept in memory, they only cover the
+// sessions handled by this server instance.
+type sessionMetrics struct {
+	sync.Mutex
+	started      map[irma.Action]uint64
+	finished     map[sessionMetricsKey]uint64
+	duration     map[irma.Action]*histogram
+	verification map[irma.Action]*histogram
+	active       int64
+}
+
+type sessionMetricsKey struct {
+	action irma.Action
+	status irma.ServerStatus
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+var (
+	// Buckets (in seconds) of the session duration histogram
+	sessionDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 900}
+	// Buckets (in seconds) of the proof verification latency histogram
+	verificationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+)
+
+func newSessionMetrics() *sessionMetrics {
+	return &sessionMetrics{
+		started:      map[irma.Action]uint64{},
+		finished:     map[sessionMetricsKey]uint64{},
+		duration:     map[irma.Action]*histogram{},
+		verification: map[irma.Action]*histogram{},
+	}
+}
+
+// MetricsHandler returns a http.Handler that serves metrics about the sessions handled by
+// this server in the Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.metrics.write(w)
+	})
+}
+
+// sessionStarted records a new session. Active sessions are only counted for the memory store,
+// as sessions in other stores may finish or expire at other server instances.
+func (m *sessionMetrics) sessionStarted(action irma.Action, countActive bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.started[action]++
+	if countActive {
+		m.active++
+	}
+}
+
+// sessionFinished records a session that reached a final status. Its duration is only recorded
+// if the time at which it was created is known.
+func (m *sessionMetrics) sessionFinished(action irma.Action, status irma.ServerStatus, created time.Time, countActive bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.finished[sessionMetricsKey{action, status}]++
+	if !created.IsZero() {
+		observe(m.duration, sessionDurationBuckets, action, time.Since(created))
+	}
+	if countActive {
+		m.active--
+	}
+}
+
+func (m *sessionMetrics) proofVerified(action irma.Action, duration time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	observe(m.verification, verificationBuckets, action, duration)
+}
+
+func observe(histograms map[irma.Action]*histogram, buckets []float64, action irma.Action, duration time.Duration) {
+	h := histograms[action]
+	if h == nil {
+		h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		histograms[action] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *sessionMetrics) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintln(w, "# HELP irma_sessions_started_total Number of sessions started.")
+	fmt.Fprintln(w, "# TYPE irma_sessions_started_total counter")
+	for _, action := range sortedActions(m.started) {
+		fmt.Fprintf(w, "irma_sessions_started_total{action=%q} %d\n", action, m.started[action])
+	}
+
+	fmt.Fprintln(w, "# HELP irma_sessions_finished_total Number of sessions that reached a final status.")
+	fmt.Fprintln(w, "# TYPE irma_sessions_finished_total counter")
+	keys := make([]sessionMetricsKey, 0, len(m.finished))
+	for key := range m.finished {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].action != keys[j].action {
+			return keys[i].action < keys[j].action
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "irma_sessions_finished_total{action=%q,status=%q} %d\n", key.action, key.status, m.finished[key])
+	}
+
+	fmt.Fprintln(w, "# HELP irma_sessions_active Number of sessions that have not yet finished (memory session store only).")
+	fmt.Fprintln(w, "# TYPE irma_sessions_active gauge")
+	fmt.Fprintf(w, "irma_sessions_active %d\n", m.active)
+
+	writeHistograms(w, "irma_session_duration_seconds", "Duration of sessions from start until a final status.", m.duration)
+	writeHistograms(w, "irma_proof_verification_duration_seconds", "Time taken to verify the proofs sent by the IRMA app.", m.verification)
+}
+
+func writeHistograms(w io.Writer, name, help string, histograms map[irma.Action]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	actions := make([]irma.Action, 0, len(histograms))
+	for action := range histograms {
+		actions = append(actions, action)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i] < actions[j] })
+	for _, action := range actions {
+		h := histograms[action]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{action=%q,le=\"%g\"} %d\n", name, action, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{action=%q,le=\"+Inf\"} %d\n", name, action, h.count)
+		fmt.Fprintf(w, "%s_sum{action=%q} %g\n", name, action, h.sum)
+		fmt.Fprintf(w, "%s_count{action=%q} %d\n", name, action, h.count)
+	}
+}
+
+func sortedActions(m map[irma.Action]uint64) []irma.Action {
+	actions := make([]irma.Action, 0, len(m))
+	for action := range m {
+		actions = append(actions, action)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i] < actions[j] })
+	return actions
+}
@@ -0,0 +1,97 @@
+package irmaserver
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+	other, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer other.Stop()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	_, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+
+	metrics := s.metrics
+	metrics.Lock()
+	require.Equal(t, uint64(1), metrics.started[irma.ActionDisclosing])
+	require.Equal(t, int64(1), metrics.active)
+	metrics.Unlock()
+
+	require.NoError(t, s.CancelSession(token))
+
+	metrics.Lock()
+	require.Equal(t, uint64(1), metrics.finished[sessionMetricsKey{irma.ActionDisclosing, irma.ServerStatusCancelled}])
+	require.Zero(t, metrics.active)
+	require.NotZero(t, metrics.duration[irma.ActionDisclosing].count)
+	metrics.Unlock()
+
+	// Other servers keep their own metrics
+	other.metrics.Lock()
+	require.Zero(t, other.metrics.started[irma.ActionDisclosing])
+	other.metrics.Unlock()
+
+	// Sessions of which the creation time is unknown are not included in the duration histogram
+	metrics.sessionFinished(irma.ActionSigning, irma.ServerStatusDone, time.Time{}, false)
+	metrics.Lock()
+	require.Nil(t, metrics.duration[irma.ActionSigning])
+	metrics.Unlock()
+
+	w := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	require.Contains(t, body, "# TYPE irma_sessions_started_total counter")
+	require.Contains(t, body, `irma_sessions_finished_total{action="disclosing",status="CANCELLED"}`)
+	require.Contains(t, body, `irma_session_duration_seconds_bucket{action="disclosing",le="+Inf"}`)
+}
+
+func TestStats(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.StatsWindows = []int{5}
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	_, token, _, err := s.StartRequestorSession("statsrequestor", request, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.CancelSession(token))
+
+	w := httptest.NewRecorder()
+	s.StatsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	var result []*SessionStatistics
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	require.Len(t, result, 1)
+	require.Equal(t, 5, result[0].Window)
+	require.NotZero(t, result[0].Total.Count)
+	require.NotZero(t, result[0].Actions[string(irma.ActionDisclosing)].Count)
+	require.NotZero(t, result[0].Statuses[string(irma.ServerStatusCancelled)].Count)
+	require.Equal(t, uint64(1), result[0].Requestors["statsrequestor"].Count)
+
+	// Other servers keep their own statistics
+	other, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer other.Stop()
+	result = other.stats.compute([]int{5}, time.Now())
+	require.Zero(t, result[0].Total.Count)
+	require.Empty(t, result[0].Requestors)
+
+	// Sessions outside the window are not counted
+	result = s.stats.compute([]int{5}, time.Now().Add(time.Hour))
+	require.Zero(t, result[0].Total.Count)
+
+	conf = sessionsConf(t)
+	conf.StatsWindows = []int{0}
+	_, err = New(conf)
+	require.Error(t, err)
+}
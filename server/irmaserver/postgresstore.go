@@ -0,0 +1,270 @@
+package irmaserver
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-errors/errors"
+	_ "github.com/jackc/pgx/stdlib"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// postgresSessionStore stores sessions in a PostgreSQL database, such that sessions and their
+// results survive server restarts. A session is locked by reading its row within a transaction
+// using SELECT ... FOR UPDATE; the lock is released by committing the transaction in unlock().
+type postgresSessionStore struct {
+	db     *sql.DB
+	conf   *server.Configuration
+	server *Server
+}
+
+type PostgresError struct {
+	err error
+}
+
+func (err *PostgresError) Error() string {
+	return fmt.Sprintf("postgres error: %s", err.err)
+}
+
+const postgresSessionsTable = `
+	CREATE TABLE IF NOT EXISTS irma_sessions (
+		requestor_token text PRIMARY KEY,
+		client_token text NOT NULL UNIQUE,
+		data bytea NOT NULL,
+		expiry bigint NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS irma_sessions_expiry_index ON irma_sessions (expiry);
+	ALTER TABLE irma_sessions ADD COLUMN IF NOT EXISTS namespace text NOT NULL DEFAULT '';
+	ALTER TABLE irma_sessions ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 0;`
+
+func newPostgresSessionStore(s *Server) (*postgresSessionStore, error) {
+	conf := s.conf
+	db, err := sql.Open("pgx", conf.PostgresSettings.ConnStr)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxIdleConns(conf.PostgresSettings.MaxIdleConns)
+	db.SetMaxOpenConns(conf.PostgresSettings.MaxOpenConns)
+	if err = db.Ping(); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to connect to PostgreSQL", 0)
+	}
+	if _, err = db.Exec(postgresSessionsTable); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to create PostgreSQL sessions table", 0)
+	}
+	return &postgresSessionStore{db: db, conf: conf, server: s}, nil
+}
+
+func (s *postgresSessionStore) get(t irma.RequestorToken) (*session, error) {
+	var val string
+	err := s.db.QueryRow(
+		"SELECT client_token FROM irma_sessions WHERE requestor_token = $1 AND expiry > $2 AND namespace = $3",
+		string(t), time.Now().Unix(), s.conf.SessionNamespace,
+	).Scan(&val)
+	if err == sql.ErrNoRows {
+		return nil, server.LogError(&UnknownSessionError{t, ""})
+	} else if err != nil {
+		return nil, logAsPostgresError(err)
+	}
+
+	clientToken, err := irma.ParseClientToken(val)
+	if err != nil {
+		return nil, logAsPostgresError(err)
+	}
+	return s.clientGet(clientToken)
+}
+
+func (s *postgresSessionStore) clientGet(t irma.ClientToken) (*session, error) {
+	start := time.Now()
+	query := "SELECT data, version FROM irma_sessions WHERE client_token = $1 AND expiry > $2 AND namespace = $3"
+	var (
+		tx      *sql.Tx
+		row     *sql.Row
+		data    []byte
+		version int64
+		err     error
+	)
+	args := []interface{}{string(t), time.Now().Unix(), s.conf.SessionNamespace}
+	if s.conf.OptimisticLocking {
+		row = s.db.QueryRow(query, args...)
+	} else {
+		if tx, err = s.db.Begin(); err != nil {
+			return nil, logAsPostgresError(err)
+		}
+		row = tx.QueryRow(query+" FOR UPDATE", args...)
+	}
+	if err = row.Scan(&data, &version); err != nil {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+		if err == sql.ErrNoRows {
+			return nil, server.LogError(&UnknownSessionError{"", t})
+		}
+		return nil, logAsPostgresError(err)
+	}
+
+	session := &session{
+		sessions: s,
+		conf:     s.conf,
+		server:   s.server,
+		tx:       tx,
+		locked:   tx != nil,
+		version:  version,
+	}
+	if err := session.sessionData.unmarshal(s.conf, t, data); err != nil {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+		return nil, logAsPostgresError(err)
+	}
+	session.request = session.Rrequest.SessionRequest()
+	session.traceStore("load", start, nil)
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("Session received from PostgreSQL datastore")
+
+	// hashing the current session data needs to take place before the timeout check to detect all changes!
+	hash := session.sessionData.hash()
+	session.hashBefore = &hash
+
+	// timeout check
+	lifetime := session.maxLifetime()
+	if session.LastActive.Add(lifetime).Before(time.Now()) && !session.Status.Finished() {
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Info("Session expired")
+		session.markAlive()
+		session.setStatus(irma.ServerStatusTimeout)
+	}
+
+	return session, nil
+}
+
+func (s *postgresSessionStore) add(session *session) error {
+	sessionJSON, err := session.sessionData.marshal(s.conf)
+	if err != nil {
+		return server.LogError(err)
+	}
+	expiry := time.Now().Add(session.storeTimeout()).Unix()
+
+	query := `INSERT INTO irma_sessions (requestor_token, client_token, data, expiry, namespace) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (requestor_token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, version = irma_sessions.version + 1
+		WHERE irma_sessions.namespace = EXCLUDED.namespace`
+	args := []interface{}{string(session.RequestorToken), string(session.ClientToken), sessionJSON, expiry, s.conf.SessionNamespace}
+	if session.tx != nil {
+		_, err = session.tx.Exec(query, args...)
+	} else {
+		_, err = s.db.Exec(query, args...)
+	}
+	if err != nil {
+		return logAsPostgresError(err)
+	}
+
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("session added or updated in PostgreSQL datastore")
+	return nil
+}
+
+func (s *postgresSessionStore) update(session *session) error {
+	hash := session.hash()
+	if session.hashBefore == nil || *session.hashBefore == hash {
+		// if nothing changed, updating is not necessary
+		return nil
+	}
+	if s.conf.OptimisticLocking {
+		return s.compareAndSwap(session)
+	}
+	if session.tx == nil {
+		return logAsPostgresError(errors.Errorf("no transaction available for session with requestorToken %s", session.RequestorToken))
+	}
+	return s.add(session)
+}
+
+// compareAndSwap stores the session only if its version in the database is still the version
+// that was loaded, i.e. if it was not modified by another server instance meanwhile.
+func (s *postgresSessionStore) compareAndSwap(session *session) error {
+	sessionJSON, err := session.sessionData.marshal(s.conf)
+	if err != nil {
+		return server.LogError(err)
+	}
+	res, err := s.db.Exec(
+		`UPDATE irma_sessions SET data = $1, expiry = $2, version = version + 1
+		WHERE client_token = $3 AND namespace = $4 AND version = $5`,
+		sessionJSON, time.Now().Add(session.storeTimeout()).Unix(), string(session.ClientToken), s.conf.SessionNamespace, session.version,
+	)
+	if err != nil {
+		return logAsPostgresError(err)
+	}
+	if count, err := res.RowsAffected(); err != nil {
+		return logAsPostgresError(err)
+	} else if count == 0 {
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Warn("Session was modified concurrently, discarding changes")
+		return ErrSessionConflict
+	}
+
+	session.version++
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("session updated in PostgreSQL datastore")
+	return nil
+}
+
+func (s *postgresSessionStore) unlock(session *session) {
+	if !session.locked {
+		return
+	}
+	if session.tx != nil {
+		if err := session.tx.Commit(); err != nil {
+			// The transaction is rolled back by the database in this case, releasing the row lock.
+			_ = logAsPostgresError(err)
+		}
+		session.tx = nil
+	}
+	session.locked = false
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("session unlocked successfully")
+}
+
+func (s *postgresSessionStore) deleteExpired() {
+	res, err := s.db.Exec("DELETE FROM irma_sessions WHERE expiry <= $1", time.Now().Unix())
+	if err != nil {
+		_ = logAsPostgresError(err)
+		return
+	}
+	if count, err := res.RowsAffected(); err == nil && count > 0 {
+		s.conf.Logger.WithField("count", count).Debug("Deleted expired sessions from PostgreSQL datastore")
+	}
+}
+
+func (s *postgresSessionStore) ping() error {
+	return s.db.Ping()
+}
+
+func (s *postgresSessionStore) requestorTokens() ([]irma.RequestorToken, error) {
+	rows, err := s.db.Query(
+		"SELECT requestor_token FROM irma_sessions WHERE expiry > $1 AND namespace = $2",
+		time.Now().Unix(), s.conf.SessionNamespace,
+	)
+	if err != nil {
+		return nil, logAsPostgresError(err)
+	}
+	defer common.Close(rows)
+	var tokens []irma.RequestorToken
+	for rows.Next() {
+		var token string
+		if err = rows.Scan(&token); err != nil {
+			return nil, logAsPostgresError(err)
+		}
+		tokens = append(tokens, irma.RequestorToken(token))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, logAsPostgresError(err)
+	}
+	return tokens, nil
+}
+
+func (s *postgresSessionStore) stop() {
+	if err := s.db.Close(); err != nil {
+		_ = logAsPostgresError(err)
+	}
+	s.conf.Logger.Info("PostgreSQL connection closed successfully")
+}
+
+func logAsPostgresError(err error) error {
+	return server.LogError(&PostgresError{err})
+}
@@ -2,7 +2,7 @@ package irmaserver
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
 	"fmt"
 	"strings"
 	"sync"
@@ -21,6 +21,7 @@ import (
 	"github.com/privacybydesign/irmago/server"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 type session struct {
@@ -28,9 +29,14 @@ type session struct {
 	sse            *sse.Server
 	locked         bool
 	lock           *redislock.Lock
+	tx             *sql.Tx
+	release        func()
+	stored         string // session as loaded from Redis, when using optimistic locking
+	version        int64  // version of the session row in PostgreSQL
 	hashBefore     *[32]byte
 	sessions       sessionStore
 	conf           *server.Configuration
+	server         *Server
 	request        irma.SessionRequest
 	statusChannels []chan irma.ServerStatus
 	handler        server.SessionHandler
@@ -48,6 +54,8 @@ type sessionData struct {
 	Status             irma.ServerStatus
 	ResponseCache      responseCache
 	LastActive         time.Time
+	Created            time.Time
+	Finished           time.Time `json:",omitempty"`
 	Result             *server.SessionResult
 	KssProofs          map[irma.SchemeManagerIdentifier]*gabi.ProofP
 	Next               *irma.Qr
@@ -55,6 +63,8 @@ type sessionData struct {
 	ImplicitDisclosure irma.AttributeConDisCon
 	Options            irma.SessionOptions
 	ClientAuth         irma.ClientAuthorization
+	Requestor          string
+	Trace              propagation.MapCarrier `json:",omitempty"` // context of the trace of the session
 }
 
 type responseCache struct {
@@ -71,12 +81,15 @@ type sessionStore interface {
 	add(session *session) error
 	update(session *session) error
 	unlock(session *session)
+	ping() error
 	stop()
+	requestorTokens() ([]irma.RequestorToken, error)
 }
 
 type memorySessionStore struct {
 	sync.RWMutex
-	conf *server.Configuration
+	conf   *server.Configuration
+	server *Server
 
 	requestor map[irma.RequestorToken]*session
 	client    map[irma.ClientToken]*session
@@ -86,6 +99,7 @@ type redisSessionStore struct {
 	client *redis.Client
 	locker *redislock.Client
 	conf   *server.Configuration
+	server *Server
 }
 
 type RedisError struct {
@@ -109,6 +123,16 @@ func (err *UnknownSessionError) Error() string {
 	}
 }
 
+// SessionFinishedError is returned when the requestor cancels a session that has already finished.
+type SessionFinishedError struct {
+	requestorToken irma.RequestorToken
+	status         irma.ServerStatus
+}
+
+func (err *SessionFinishedError) Error() string {
+	return fmt.Sprintf("session %s already finished with status %s", err.requestorToken, err.status)
+}
+
 const (
 	maxLockLifetime            = 500 * time.Millisecond // After this the Redis lock self-deletes, preventing a deadlock
 	minLockRetryTime           = 30 * time.Millisecond
@@ -120,7 +144,10 @@ const (
 
 var (
 	minProtocolVersion = irma.NewVersion(2, 4)
-	maxProtocolVersion = irma.NewVersion(2, 8)
+	// Versions from minLegacyProtocolVersion up to minProtocolVersion are supported using the
+	// translation shims in legacy.go, unless disabled in the configuration
+	minLegacyProtocolVersion = irma.NewVersion(2, 0)
+	maxProtocolVersion       = irma.NewVersion(2, 8)
 
 	minFrontendProtocolVersion = irma.NewVersion(1, 0)
 	maxFrontendProtocolVersion = irma.NewVersion(1, 1)
@@ -177,6 +204,20 @@ func (s *memorySessionStore) unlock(session *session) {
 	}
 }
 
+func (s *memorySessionStore) ping() error {
+	return nil
+}
+
+func (s *memorySessionStore) requestorTokens() ([]irma.RequestorToken, error) {
+	s.RLock()
+	defer s.RUnlock()
+	tokens := make([]irma.RequestorToken, 0, len(s.requestor))
+	for token := range s.requestor {
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
 func (s *memorySessionStore) stop() {
 	s.Lock()
 	defer s.Unlock()
@@ -189,6 +230,26 @@ func (s *memorySessionStore) stop() {
 	}
 }
 
+// unfinished returns the number of sessions that have not yet reached a final status.
+func (s *memorySessionStore) unfinished() int {
+	s.RLock()
+	sessions := make([]*session, 0, len(s.requestor))
+	for _, session := range s.requestor {
+		sessions = append(sessions, session)
+	}
+	s.RUnlock()
+
+	count := 0
+	for _, session := range sessions {
+		session.Lock()
+		if !session.Status.Finished() {
+			count++
+		}
+		session.Unlock()
+	}
+	return count
+}
+
 func (s *memorySessionStore) deleteExpired() {
 	// First check which sessions have expired
 	// We don't need a write lock for this yet, so postpone that for actual deleting
@@ -203,11 +264,11 @@ func (s *memorySessionStore) deleteExpired() {
 	for token, session := range toCheck {
 		session.Lock()
 
-		timeout := time.Duration(s.conf.MaxSessionLifetime) * time.Minute
+		timeout := session.maxLifetime()
 		if session.Status == irma.ServerStatusInitialized && session.Rrequest.Base().ClientTimeout != 0 {
 			timeout = time.Duration(session.Rrequest.Base().ClientTimeout) * time.Second
 		} else if session.Status.Finished() {
-			timeout = time.Duration(s.conf.SessionResultLifetime) * time.Minute
+			timeout = session.resultLifetime()
 		}
 
 		if session.LastActive.Add(timeout).Before(time.Now()) {
@@ -238,8 +299,17 @@ func (s *memorySessionStore) deleteExpired() {
 	s.Unlock()
 }
 
+// key returns the Redis key under which the value with the given prefix and token is stored,
+// within the session namespace of the server if configured.
+func (s *redisSessionStore) key(prefix, token string) string {
+	if s.conf.SessionNamespace == "" {
+		return prefix + token
+	}
+	return s.conf.SessionNamespace + ":" + prefix + token
+}
+
 func (s *redisSessionStore) get(t irma.RequestorToken) (*session, error) {
-	val, err := s.client.Get(context.Background(), requestorTokenLookupPrefix+string(t)).Result()
+	val, err := s.client.Get(context.Background(), s.key(requestorTokenLookupPrefix, string(t))).Result()
 	if err == redis.Nil {
 		return nil, server.LogError(&UnknownSessionError{t, ""})
 	} else if err != nil {
@@ -256,24 +326,28 @@ func (s *redisSessionStore) get(t irma.RequestorToken) (*session, error) {
 }
 
 func (s *redisSessionStore) clientGet(t irma.ClientToken) (*session, error) {
+	start := time.Now()
 	session := &session{
 		sessions: s,
 		conf:     s.conf,
+		server:   s.server,
 	}
 
-	// lock via clientToken since requestorToken first fetches clientToken en then comes here, this is fine
-	lock, err := s.locker.Obtain(context.Background(), lockPrefix+string(t), maxLockLifetime, lockingRetryOptions)
-	if err != nil {
-		// It is possible that the session is already locked. However, it should not happen often.
-		// If you get the redislock.ErrNotObtained error often, you should investigate why.
-		return nil, logAsRedisError(err)
+	if !s.conf.OptimisticLocking {
+		// lock via clientToken since requestorToken first fetches clientToken en then comes here, this is fine
+		lock, err := s.locker.Obtain(context.Background(), s.key(lockPrefix, string(t)), maxLockLifetime, lockingRetryOptions)
+		if err != nil {
+			// It is possible that the session is already locked. However, it should not happen often.
+			// If you get the redislock.ErrNotObtained error often, you should investigate why.
+			return nil, logAsRedisError(err)
+		}
+		session.locked = true
+		session.lock = lock
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("session locked successfully")
 	}
-	session.locked = true
-	session.lock = lock
-	s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("session locked successfully")
 
 	// get the session data
-	val, err := s.client.Get(context.Background(), clientTokenLookupPrefix+string(t)).Result()
+	val, err := s.client.Get(context.Background(), s.key(clientTokenLookupPrefix, string(t))).Result()
 	if err == redis.Nil {
 		// Both session and error need to be returned. The session will already be locked and needs to
 		// be passed along, so it can be unlocked later.
@@ -282,10 +356,12 @@ func (s *redisSessionStore) clientGet(t irma.ClientToken) (*session, error) {
 		return session, logAsRedisError(err)
 	}
 
-	if err := json.Unmarshal([]byte(val), &session.sessionData); err != nil {
+	if err := session.sessionData.unmarshal(s.conf, t, []byte(val)); err != nil {
 		return session, logAsRedisError(err)
 	}
+	session.stored = val
 	session.request = session.Rrequest.SessionRequest()
+	session.traceStore("load", start, nil)
 	s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("Session received from Redis datastore")
 
 	// hashing the current session data needs to take place before the timeout check to detect all changes!
@@ -293,7 +369,7 @@ func (s *redisSessionStore) clientGet(t irma.ClientToken) (*session, error) {
 	session.hashBefore = &hash
 
 	// timeout check
-	lifetime := time.Duration(s.conf.MaxSessionLifetime) * time.Minute
+	lifetime := session.maxLifetime()
 	if session.LastActive.Add(lifetime).Before(time.Now()) && !session.Status.Finished() {
 		s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Info("Session expired")
 		session.markAlive()
@@ -303,9 +379,28 @@ func (s *redisSessionStore) clientGet(t irma.ClientToken) (*session, error) {
 	return session, nil
 }
 
-func (s *redisSessionStore) add(session *session) error {
-	sessionLifetime := time.Duration(s.conf.MaxSessionLifetime) * time.Minute
-	resultLifetime := time.Duration(s.conf.SessionResultLifetime) * time.Minute
+// maxLifetime returns the maximum duration of the session once a client connects. Requestors may
+// override the configured maximum using the maxSessionLifetime field of their session request, up to
+// the MaxRequestedSessionLifetime of the configuration.
+func (session *session) maxLifetime() time.Duration {
+	if lifetime := session.Rrequest.Base().MaxSessionLifetime; lifetime > 0 {
+		return time.Duration(lifetime) * time.Minute
+	}
+	return time.Duration(session.conf.MaxSessionLifetime) * time.Minute
+}
+
+// resultLifetime returns how long the session result remains available after the session has finished.
+func (session *session) resultLifetime() time.Duration {
+	if lifetime := session.Rrequest.Base().ResultLifetime; lifetime > 0 {
+		return time.Duration(lifetime) * time.Minute
+	}
+	return time.Duration(session.conf.SessionResultLifetime) * time.Minute
+}
+
+// storeTimeout returns the duration after which a persistent session store may remove the session.
+func (session *session) storeTimeout() time.Duration {
+	sessionLifetime := session.maxLifetime()
+	resultLifetime := session.resultLifetime()
 	// After the timeout, the session will automatically be removed. Therefore, the timeout needs to
 	// already include the session result lifetime. In this way, when the session expires, the session
 	// will be preserved until session result lifetime ends.
@@ -315,17 +410,22 @@ func (s *redisSessionStore) add(session *session) error {
 	} else if session.Status.Finished() {
 		timeout = resultLifetime
 	}
+	return timeout
+}
+
+func (s *redisSessionStore) add(session *session) error {
+	timeout := session.storeTimeout()
 
-	sessionJSON, err := json.Marshal(session.sessionData)
+	sessionJSON, err := session.sessionData.marshal(s.conf)
 	if err != nil {
 		return server.LogError(err)
 	}
 
-	err = s.client.Set(context.Background(), requestorTokenLookupPrefix+string(session.sessionData.RequestorToken), string(session.sessionData.ClientToken), timeout).Err()
+	err = s.client.Set(context.Background(), s.key(requestorTokenLookupPrefix, string(session.sessionData.RequestorToken)), string(session.sessionData.ClientToken), timeout).Err()
 	if err != nil {
 		return logAsRedisError(err)
 	}
-	err = s.client.Set(context.Background(), clientTokenLookupPrefix+string(session.sessionData.ClientToken), sessionJSON, timeout).Err()
+	err = s.client.Set(context.Background(), s.key(clientTokenLookupPrefix, string(session.sessionData.ClientToken)), sessionJSON, timeout).Err()
 	if err != nil {
 		return logAsRedisError(err)
 	}
@@ -341,6 +441,10 @@ func (s *redisSessionStore) update(session *session) error {
 		return nil
 	}
 
+	if s.conf.OptimisticLocking {
+		return s.compareAndSwap(session)
+	}
+
 	// Time passes between acquiring the lock and writing to Redis. Check before write action that lock is still valid.
 	if session.lock == nil {
 		return logAsRedisError(errors.Errorf("lock is not set for session with requestorToken %s", session.RequestorToken))
@@ -352,6 +456,42 @@ func (s *redisSessionStore) update(session *session) error {
 	return s.add(session)
 }
 
+// compareAndSwap stores the session only if it was not modified in Redis since it was loaded,
+// using a transaction that fails if the session is modified by another server instance meanwhile.
+func (s *redisSessionStore) compareAndSwap(session *session) error {
+	sessionJSON, err := session.sessionData.marshal(s.conf)
+	if err != nil {
+		return server.LogError(err)
+	}
+	ctx, timeout := context.Background(), session.storeTimeout()
+	key := s.key(clientTokenLookupPrefix, string(session.ClientToken))
+	err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == redis.Nil || current != session.stored {
+			return ErrSessionConflict
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, s.key(requestorTokenLookupPrefix, string(session.RequestorToken)), string(session.ClientToken), timeout)
+			pipe.Set(ctx, key, sessionJSON, timeout)
+			return nil
+		})
+		return err
+	}, key)
+	if err == ErrSessionConflict || err == redis.TxFailedErr {
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Warn("Session was modified concurrently, discarding changes")
+		return ErrSessionConflict
+	} else if err != nil {
+		return logAsRedisError(err)
+	}
+
+	session.stored = string(sessionJSON)
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("session updated in Redis datastore")
+	return nil
+}
+
 func (s *redisSessionStore) unlock(session *session) {
 	if !session.locked {
 		return
@@ -369,6 +509,23 @@ func (s *redisSessionStore) unlock(session *session) {
 	s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("session unlocked successfully")
 }
 
+func (s *redisSessionStore) ping() error {
+	return s.client.Ping(context.Background()).Err()
+}
+
+func (s *redisSessionStore) requestorTokens() ([]irma.RequestorToken, error) {
+	prefix := s.key(requestorTokenLookupPrefix, "")
+	var tokens []irma.RequestorToken
+	iter := s.client.Scan(context.Background(), 0, prefix+"*", 0).Iterator()
+	for iter.Next(context.Background()) {
+		tokens = append(tokens, irma.RequestorToken(strings.TrimPrefix(iter.Val(), prefix)))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, logAsRedisError(err)
+	}
+	return tokens, nil
+}
+
 func (s *redisSessionStore) stop() {
 	err := s.client.Close()
 	if err != nil {
@@ -379,9 +536,36 @@ func (s *redisSessionStore) stop() {
 
 var one *big.Int = big.NewInt(1)
 
-func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, disclosed irma.AttributeConDisCon, FrontendAuth irma.FrontendAuthorization) (*session, error) {
-	clientToken := irma.ClientToken(common.NewSessionToken())
-	requestorToken := irma.RequestorToken(common.NewSessionToken())
+// newSessionTokens generates a new client token and requestor token using the configured token generator.
+func (s *Server) newSessionTokens() (irma.ClientToken, irma.RequestorToken, error) {
+	token, err := s.conf.TokenGenerator.NewToken()
+	if err != nil {
+		return "", "", errors.WrapPrefix(err, "failed to generate client token", 0)
+	}
+	clientToken, err := irma.ParseClientToken(token)
+	if err != nil {
+		return "", "", err
+	}
+	if token, err = s.conf.TokenGenerator.NewToken(); err != nil {
+		return "", "", errors.WrapPrefix(err, "failed to generate requestor token", 0)
+	}
+	requestorToken, err := irma.ParseRequestorToken(token)
+	if err != nil {
+		return "", "", err
+	}
+	if string(clientToken) == string(requestorToken) {
+		return "", "", errors.New("token generator generated equal client and requestor tokens")
+	}
+	return clientToken, requestorToken, nil
+}
+
+func (s *Server) newSession(
+	action irma.Action, request irma.RequestorRequest, disclosed irma.AttributeConDisCon, FrontendAuth irma.FrontendAuthorization, requestor string,
+) (*session, error) {
+	clientToken, requestorToken, err := s.newSessionTokens()
+	if err != nil {
+		return nil, err
+	}
 	if len(FrontendAuth) == 0 {
 		FrontendAuth = irma.FrontendAuthorization(common.NewSessionToken())
 	}
@@ -399,6 +583,7 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, d
 		Action:         action,
 		Rrequest:       request,
 		LastActive:     time.Now(),
+		Created:        time.Now(),
 		RequestorToken: requestorToken,
 		ClientToken:    clientToken,
 		Status:         irma.ServerStatusInitialized,
@@ -414,12 +599,18 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, d
 		},
 		FrontendAuth:       FrontendAuth,
 		ImplicitDisclosure: disclosed,
+		Requestor:          requestor,
+	}
+	if request.Base().RequirePairing {
+		sd.Options.PairingMethod = irma.PairingMethodPin
+		sd.Options.PairingCode = common.NewPairingCode()
 	}
 	ses := &session{
 		sessionData: sd,
 		sessions:    s.sessions,
 		sse:         s.serverSentEvents,
 		conf:        s.conf,
+		server:      s,
 		request:     request.SessionRequest(),
 	}
 
@@ -428,14 +619,27 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, d
 	base.Nonce = nonce
 	base.Context = one
 
-	err := s.sessions.add(ses)
+	span := ses.traceStart()
+	start := time.Now()
+	err = s.sessions.add(ses)
+	if !ses.inMemory() {
+		ses.traceStore("add", start, err)
+	}
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
+	s.metrics.sessionStarted(action, ses.inMemory())
 
 	return ses, nil
 }
 
+// inMemory returns whether the session is kept in the memory session store.
+func (session *session) inMemory() bool {
+	_, ok := session.sessions.(*memorySessionStore)
+	return ok
+}
+
 func logAsRedisError(err error) error {
 	return server.LogError(&RedisError{err})
 }
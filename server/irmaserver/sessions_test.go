@@ -1,11 +1,22 @@
 package irmaserver
 
 import (
+	"encoding/json"
+	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/internal/test"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sirupsen/logrus"
@@ -44,6 +55,95 @@ func TestSessionHandlerInvokedOnCancel(t *testing.T) {
 	require.True(t, handlerInvoked)
 }
 
+type testNotifier struct {
+	to            string
+	notifications chan *server.SessionNotification
+}
+
+func (n *testNotifier) Notify(to string, notification *server.SessionNotification) error {
+	n.to = to
+	n.notifications <- notification
+	return nil
+}
+
+func TestSessionNotification(t *testing.T) {
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{NotifyEmail: "helpdesk@example.com"},
+		Request:              irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}
+
+	// notifyEmail is rejected when no notifier is configured
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	_, _, _, err = s.StartSession(request, nil)
+	require.Error(t, err)
+	s.Stop()
+
+	notifier := &testNotifier{notifications: make(chan *server.SessionNotification, 1)}
+	conf := sessionsConf(t)
+	conf.Notifier = notifier
+	s, err = New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	_, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.CancelSession(token))
+
+	select {
+	case notification := <-notifier.notifications:
+		require.Equal(t, "helpdesk@example.com", notifier.to)
+		require.Equal(t, token, notification.Token)
+		require.Equal(t, irma.ServerStatusCancelled, notification.Status)
+		require.False(t, notification.Time.IsZero())
+	case <-time.After(time.Second):
+		t.Fatal("no session notification sent")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	_, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+
+	drained := make(chan struct{})
+	go func() {
+		s.Drain(10 * time.Second)
+		close(drained)
+	}()
+	require.Eventually(t, func() bool {
+		_, _, _, err := s.StartSession(request, nil)
+		return err == ErrDraining
+	}, time.Second, 10*time.Millisecond)
+
+	select {
+	case <-drained:
+		t.Fatal("drain returned before unfinished session finished")
+	default:
+	}
+
+	require.NoError(t, s.CancelSession(token))
+	select {
+	case <-drained:
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain did not return after session finished")
+	}
+
+	// Drain returns when the timeout elapses
+	s, err = New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+	_, _, _, err = s.StartSession(request, nil)
+	require.NoError(t, err)
+	start := time.Now()
+	s.Drain(300 * time.Millisecond)
+	require.WithinDuration(t, start.Add(300*time.Millisecond), time.Now(), 500*time.Millisecond)
+}
+
 func TestSessionHandlerInvokedOnTimeout(t *testing.T) {
 	s, err := New(sessionsConf(t))
 	require.NoError(t, err)
@@ -76,7 +176,7 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 
 	req, err := server.ParseSessionRequest(`{"request":{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","devMode":true,"disclose":[[[{"type":"test.test.email.email","value":"example@example.com"}]]]}}`)
 	require.NoError(t, err)
-	session, err := s.newSession(irma.ActionDisclosing, req, nil, "")
+	session, err := s.newSession(irma.ActionDisclosing, req, nil, "", "")
 	require.NoError(t, err)
 
 	session.Lock()
@@ -99,7 +199,7 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 
 	// Make a new session; this involves adding it to the memory session store.
 	go func() {
-		_, _ = s.newSession(irma.ActionDisclosing, req, nil, "")
+		_, _ = s.newSession(irma.ActionDisclosing, req, nil, "", "")
 		addingCompleted = true
 	}()
 
@@ -108,3 +208,619 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 	require.True(t, addingCompleted)
 	require.False(t, deletingCompleted)
 }
+
+func TestSessionLifetimeOverride(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.MaxRequestedSessionLifetime = 60
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	req, err := server.ParseSessionRequest(`{"request":{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}}`)
+	require.NoError(t, err)
+	session, err := s.newSession(irma.ActionDisclosing, req, nil, "", "")
+	require.NoError(t, err)
+	require.Equal(t, 15*time.Minute, session.maxLifetime())
+
+	req, err = server.ParseSessionRequest(`{"maxSessionLifetime":60,"request":{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}}`)
+	require.NoError(t, err)
+	session, err = s.newSession(irma.ActionDisclosing, req, nil, "", "")
+	require.NoError(t, err)
+	require.Equal(t, 60*time.Minute, session.maxLifetime())
+	require.Equal(t, 65*time.Minute, session.storeTimeout())
+
+	// Requestors cannot exceed the configured maximum
+	_, _, _, err = s.StartSession(`{"maxSessionLifetime":61,"request":{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}}`, nil)
+	require.Error(t, err)
+}
+
+func TestNegativeExpiryTicker(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.ExpiryTicker = -1
+	_, err := New(conf)
+	require.Error(t, err)
+}
+
+func TestSessionResults(t *testing.T) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	start := func(requestor string) irma.RequestorToken {
+		_, token, _, err := s.StartRequestorSession(requestor, request, nil)
+		require.NoError(t, err)
+		return token
+	}
+	since := time.Now()
+	first, second, other := start("requestor"), start("requestor"), start("other")
+	start("requestor") // remains active
+	require.NoError(t, s.CancelSession(second))
+	require.NoError(t, s.CancelSession(first))
+	require.NoError(t, s.CancelSession(other))
+
+	// Only the finished sessions of the requestor are returned, in the order in which they finished
+	results, err := s.SessionResults("requestor", since)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, second, results[0].Token)
+	require.Equal(t, first, results[1].Token)
+	require.Equal(t, irma.ServerStatusCancelled, results[0].Status)
+	require.False(t, results[0].Finished.Before(since))
+
+	results, err = s.SessionResults("requestor", time.Now())
+	require.NoError(t, err)
+	require.Empty(t, results)
+}
+
+func TestSessionResultLifetimeOverride(t *testing.T) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+
+	req, err := server.ParseSessionRequest(`{"resultLifetime":1440,"request":{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}}`)
+	require.NoError(t, err)
+	session, err := s.newSession(irma.ActionDisclosing, req, nil, "", "")
+	require.NoError(t, err)
+	require.Equal(t, 24*time.Hour, session.resultLifetime())
+
+	session.setStatus(irma.ServerStatusDone)
+	require.Equal(t, 24*time.Hour, session.storeTimeout())
+}
+
+func TestRequirePairing(t *testing.T) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+
+	req, err := server.ParseSessionRequest(`{"requirePairing":true,"request":{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}}`)
+	require.NoError(t, err)
+	session, err := s.newSession(irma.ActionDisclosing, req, nil, "", "")
+	require.NoError(t, err)
+	require.Equal(t, irma.PairingMethod(irma.PairingMethodPin), session.Options.PairingMethod)
+	require.NotEmpty(t, session.Options.PairingCode)
+
+	// The frontend cannot disable pairing
+	_, err = session.updateFrontendOptions(&irma.FrontendOptionsRequest{PairingMethod: irma.PairingMethodNone})
+	require.Error(t, err)
+	require.Equal(t, irma.PairingMethod(irma.PairingMethodPin), session.Options.PairingMethod)
+}
+
+func TestClientTokenGrantsNoRequestorAccess(t *testing.T) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	qr, requestorToken, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+	require.NotContains(t, qr.URL, string(requestorToken))
+
+	// The QR only contains the client token, which must not give access to the session result.
+	clientToken := irma.RequestorToken(qr.URL[strings.LastIndex(qr.URL, "/")+1:])
+	_, err = s.GetSessionResult(clientToken)
+	require.IsType(t, &UnknownSessionError{}, err)
+	require.Error(t, s.CancelSession(clientToken))
+
+	result, err := s.GetSessionResult(requestorToken)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusInitialized, result.Status)
+}
+
+func TestServerSentEventsEndOnFinish(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.EnableSSE = true
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+	ts := httptest.NewServer(s.HandlerFunc())
+	defer ts.Close()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	qr, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+
+	res, err := http.Get(ts.URL + "/" + qr.URL + "/statusevents")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	received := make(chan string)
+	go func() {
+		body, _ := io.ReadAll(res.Body)
+		received <- string(body)
+	}()
+	time.Sleep(100 * time.Millisecond) // give SSE time to subscribe
+	require.NoError(t, s.CancelSession(token))
+
+	select {
+	case body := <-received:
+		require.Contains(t, body, string(irma.ServerStatusCancelled))
+	case <-time.After(2 * time.Second):
+		t.Fatal("event stream not closed after session finished")
+	}
+}
+
+type prefixTokenGenerator struct {
+	prefix string
+}
+
+func (g prefixTokenGenerator) NewToken() (string, error) {
+	return g.prefix + common.NewSessionToken(), nil
+}
+
+func TestTokenGenerator(t *testing.T) {
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+
+	conf := sessionsConf(t)
+	conf.SessionTokenLength = 64
+	s, err := New(conf)
+	require.NoError(t, err)
+	_, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+	require.Len(t, token, 64)
+	s.Stop()
+
+	conf = sessionsConf(t)
+	conf.TokenGenerator = prefixTokenGenerator{"sess_"}
+	s, err = New(conf)
+	require.NoError(t, err)
+	qr, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(token), "sess_"))
+	require.Contains(t, qr.URL, "session/sess_")
+	s.Stop()
+
+	conf = sessionsConf(t)
+	conf.TokenGenerator = prefixTokenGenerator{"invalid/"}
+	s, err = New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+	_, _, _, err = s.StartSession(request, nil)
+	require.Error(t, err)
+
+	conf = sessionsConf(t)
+	conf.SessionTokenLength = 10
+	_, err = New(conf)
+	require.Error(t, err)
+}
+
+type mapSessionStore struct {
+	mutex    sync.Mutex
+	locks    map[irma.ClientToken]*sync.Mutex
+	tokens   map[irma.RequestorToken]irma.ClientToken
+	sessions map[irma.ClientToken][]byte
+}
+
+func (m *mapSessionStore) ClientToken(token irma.RequestorToken) (irma.ClientToken, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	clientToken, ok := m.tokens[token]
+	if !ok {
+		return "", ErrUnknownSession
+	}
+	return clientToken, nil
+}
+
+func (m *mapSessionStore) Lock(token irma.ClientToken) (func(), error) {
+	m.mutex.Lock()
+	lock, ok := m.locks[token]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.locks[token] = lock
+	}
+	m.mutex.Unlock()
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+func (m *mapSessionStore) Load(token irma.ClientToken) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.sessions[token]
+	if !ok {
+		return nil, ErrUnknownSession
+	}
+	return data, nil
+}
+
+func (m *mapSessionStore) Store(requestorToken irma.RequestorToken, clientToken irma.ClientToken, data []byte, _ time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.tokens[requestorToken] = clientToken
+	m.sessions[clientToken] = data
+	return nil
+}
+
+func (m *mapSessionStore) Close() error {
+	return nil
+}
+
+func TestCustomSessionStore(t *testing.T) {
+	store := &mapSessionStore{
+		locks:    map[irma.ClientToken]*sync.Mutex{},
+		tokens:   map[irma.RequestorToken]irma.ClientToken{},
+		sessions: map[irma.ClientToken][]byte{},
+	}
+	RegisterSessionStore("map", func(*server.Configuration) (SessionStore, error) {
+		return store, nil
+	})
+	require.Panics(t, func() {
+		RegisterSessionStore("map", func(*server.Configuration) (SessionStore, error) { return store, nil })
+	})
+	require.Panics(t, func() {
+		RegisterSessionStore("redis", func(*server.Configuration) (SessionStore, error) { return store, nil })
+	})
+
+	conf := sessionsConf(t)
+	conf.StoreType = "map"
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	_, _, _, err = s.StartSession(request, func(*server.SessionResult) {})
+	require.Error(t, err)
+
+	_, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+	require.Len(t, store.sessions, 1)
+
+	result, err := s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusInitialized, result.Status)
+
+	require.NoError(t, s.CancelSession(token))
+	result, err = s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusCancelled, result.Status)
+	require.IsType(t, &SessionFinishedError{}, s.CancelSession(token))
+
+	_, err = s.GetSessionResult("nonexistent")
+	require.IsType(t, &UnknownSessionError{}, err)
+}
+
+func TestUnknownStoreType(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.StoreType = "nonexistent"
+	_, err := New(conf)
+	require.Error(t, err)
+}
+
+type auditRecorder struct {
+	sync.Mutex
+	events []*server.AuditEvent
+}
+
+func (a *auditRecorder) Audit(event *server.AuditEvent) error {
+	a.Lock()
+	defer a.Unlock()
+	a.events = append(a.events, event)
+	return nil
+}
+
+func TestAuditEvents(t *testing.T) {
+	recorder := &auditRecorder{}
+	conf := sessionsConf(t)
+	conf.AuditSink = recorder
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	value := "456"
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.Disclose[0][0][0].Value = &value
+	_, token, _, err := s.StartRequestorSession("myapp", request, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.CancelSession(token))
+
+	recorder.Lock()
+	defer recorder.Unlock()
+	require.Len(t, recorder.events, 2)
+
+	started := recorder.events[0]
+	require.Equal(t, server.AuditSessionStarted, started.Event)
+	require.Equal(t, "myapp", started.Requestor)
+	require.Equal(t, token, started.Token)
+	require.Equal(t, "irma-demo.RU.studentCard.studentID", started.Requested[0][0][0].Type.String())
+	require.Nil(t, started.Requested[0][0][0].Value)
+	require.Equal(t, &value, request.Disclose[0][0][0].Value, "redaction must not modify the session request")
+
+	finished := recorder.events[1]
+	require.Equal(t, server.AuditSessionFinished, finished.Event)
+	require.Equal(t, "myapp", finished.Requestor)
+	require.Equal(t, irma.ServerStatusCancelled, finished.Status)
+}
+
+func TestAuditLogFile(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.AuditLog = filepath.Join(t.TempDir(), "audit.log")
+	s, err := New(conf)
+	require.NoError(t, err)
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	_, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.CancelSession(token))
+
+	// The audit log file is closed when the server stops
+	s.Stop()
+	require.Nil(t, conf.AuditSink)
+	bts, err := os.ReadFile(conf.AuditLog)
+	require.NoError(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(string(bts)), "\n"), 2)
+}
+
+func TestWatchSchemes(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(test.FindTestdataFolder(t), "irma_configuration")
+	for _, scheme := range []string{"irma-demo", "test", "test-requestors"} {
+		require.NoError(t, common.CopyDirectory(filepath.Join(src, scheme), filepath.Join(dir, scheme)))
+	}
+
+	conf := sessionsConf(t)
+	conf.SchemesPath = dir
+	conf.DisableSchemesUpdate = true
+	conf.WatchSchemes = true
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	id := irma.NewSchemeManagerIdentifier("test2")
+	require.NotContains(t, conf.IrmaConfiguration.SchemeManagers, id)
+	require.NoError(t, common.CopyDirectory(filepath.Join(src, "test2"), filepath.Join(dir, "test2")))
+	require.Eventually(t, func() bool {
+		return conf.IrmaConfiguration.SchemeManagers[id] != nil
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestRedisOptimisticLockingConflict(t *testing.T) {
+	mr := miniredis.NewMiniRedis()
+	require.NoError(t, mr.Start())
+	defer mr.Close()
+
+	newServer := func() *Server {
+		conf := sessionsConf(t)
+		conf.StoreType = "redis"
+		conf.RedisSettings = &server.RedisSettings{Addr: mr.Addr(), DisableTLS: true}
+		conf.OptimisticLocking = true
+		s, err := New(conf)
+		require.NoError(t, err)
+		return s
+	}
+	s1, s2 := newServer(), newServer()
+	defer s1.Stop()
+	defer s2.Stop()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	qr, _, _, err := s1.StartSession(request, nil)
+	require.NoError(t, err)
+	token := irma.ClientToken(qr.URL[strings.LastIndex(qr.URL, "/")+1:])
+
+	// Both server instances load the session, and modify it concurrently
+	session1, err := s1.sessions.clientGet(token)
+	require.NoError(t, err)
+	session2, err := s2.sessions.clientGet(token)
+	require.NoError(t, err)
+	session1.setStatus(irma.ServerStatusConnected)
+	session2.setStatus(irma.ServerStatusCancelled)
+
+	require.NoError(t, session1.updateAndUnlock())
+	require.Equal(t, ErrSessionConflict, session2.updateAndUnlock())
+
+	session, err := s2.sessions.clientGet(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusConnected, session.Status)
+}
+
+func TestRedisSessionEncryption(t *testing.T) {
+	mr := miniredis.NewMiniRedis()
+	require.NoError(t, mr.Start())
+	defer mr.Close()
+
+	newServer := func(key string) *Server {
+		conf := sessionsConf(t)
+		conf.StoreType = "redis"
+		conf.RedisSettings = &server.RedisSettings{Addr: mr.Addr(), DisableTLS: true}
+		conf.SessionEncryptionKey = key
+		s, err := New(conf)
+		require.NoError(t, err)
+		return s
+	}
+	s := newServer("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	defer s.Stop()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	qr, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+	clientToken := qr.URL[strings.LastIndex(qr.URL, "/")+1:]
+
+	stored, err := mr.Get("session:" + clientToken)
+	require.NoError(t, err)
+	require.NotContains(t, stored, "studentCard")
+
+	result, err := s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusInitialized, result.Status)
+
+	// A server with a different key cannot read the session
+	other := newServer("ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=")
+	defer other.Stop()
+	_, err = other.GetSessionResult(token)
+	require.Error(t, err)
+}
+
+func TestReadiness(t *testing.T) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+
+	get := func(handler http.Handler) (int, HealthStatus) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		var status HealthStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		return w.Code, status
+	}
+
+	code, status := get(s.HealthHandler())
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", status.Status)
+
+	code, status = get(s.ReadyHandler())
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ready", status.Status)
+	require.Equal(t, "ok", status.Checks["session_store"])
+
+	s.Drain(0)
+	code, status = get(s.ReadyHandler())
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "not_ready", status.Status)
+	require.NotEmpty(t, status.Checks["draining"])
+}
+
+func TestProtocolVersionNegotiation(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.MaxProtocolVersion = "2.7"
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	newSession := func(request string) *session {
+		req, err := server.ParseSessionRequest(request)
+		require.NoError(t, err)
+		session, err := s.newSession(irma.ActionDisclosing, req, nil, "", "")
+		require.NoError(t, err)
+		return session
+	}
+	disclosure := `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+
+	// The maximum version of the configured range is used
+	session := newSession(`{"request":` + disclosure + `}`)
+	session.LegacyCompatible = true
+	version, err := session.chooseProtocolVersion(irma.NewVersion(2, 4), irma.NewVersion(2, 8))
+	require.NoError(t, err)
+	require.Equal(t, irma.NewVersion(2, 7), version)
+	session.Version = version
+	require.True(t, session.supports(featureChainedSessions))
+	require.False(t, session.supports(featurePairing))
+
+	// Legacy clients are supported for requests convertible to the legacy format
+	version, err = session.chooseProtocolVersion(irma.NewVersion(2, 4), irma.NewVersion(2, 4))
+	require.NoError(t, err)
+	require.Equal(t, irma.NewVersion(2, 4), version)
+
+	// Features required by the session must be supported by the client
+	session = newSession(`{"nextSession":{"url":"https://example.com/next"},"request":` + disclosure + `}`)
+	_, err = session.chooseProtocolVersion(irma.NewVersion(2, 4), irma.NewVersion(2, 4))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "features not supported by client: condiscon, chained_sessions")
+
+	// Pairing requires a version above the configured range
+	session = newSession(`{"requirePairing":true,"request":` + disclosure + `}`)
+	_, err = session.chooseProtocolVersion(irma.NewVersion(2, 4), irma.NewVersion(2, 8))
+	require.Error(t, err)
+
+	// Invalid ranges are rejected
+	for _, r := range [][2]string{{"1.0", ""}, {"", "3.0"}, {"2.7", "2.6"}, {"two", ""}} {
+		conf := sessionsConf(t)
+		conf.MinProtocolVersion, conf.MaxProtocolVersion = r[0], r[1]
+		_, err := New(conf)
+		require.Error(t, err, r)
+	}
+	conf = sessionsConf(t)
+	conf.MinProtocolVersion, conf.DisableLegacyProtocols = "2.3", true
+	_, err = New(conf)
+	require.Error(t, err)
+}
+
+func TestLegacyProtocolVersions(t *testing.T) {
+	conf := sessionsConf(t)
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	newSession := func(action irma.Action, request string) *session {
+		req, err := server.ParseSessionRequest(request)
+		require.NoError(t, err)
+		session, err := s.newSession(action, req, nil, "", "")
+		require.NoError(t, err)
+		session.LegacyCompatible = true
+		return session
+	}
+
+	// Legacy IRMA apps can perform disclosure sessions, but not signing sessions
+	session := newSession(irma.ActionDisclosing, `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`)
+	version, err := session.chooseProtocolVersion(irma.NewVersion(2, 0), irma.NewVersion(2, 3))
+	require.NoError(t, err)
+	require.Equal(t, irma.NewVersion(2, 3), version)
+	session = newSession(irma.ActionSigning, `{"@context":"https://irma.app/ld/request/signature/v2","message":"message","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`)
+	_, err = session.chooseProtocolVersion(irma.NewVersion(2, 0), irma.NewVersion(2, 3))
+	require.Error(t, err)
+
+	// Unless disabled in the configuration
+	conf.DisableLegacyProtocols = true
+	session = newSession(irma.ActionDisclosing, `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`)
+	_, err = session.chooseProtocolVersion(irma.NewVersion(2, 0), irma.NewVersion(2, 3))
+	require.Error(t, err)
+}
+
+func TestLegacyDisclosureIndices(t *testing.T) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	defer s.Stop()
+	conf := s.conf.IrmaConfiguration
+
+	credreq := &irma.CredentialRequest{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		Attributes:       map[string]string{"university": "Radboud", "studentCardNumber": "31415927", "studentID": "s1234567", "level": "42"},
+		KeyCounter:       2,
+	}
+	attrs, err := credreq.AttributeList(conf, 0x03, nil, time.Now())
+	require.NoError(t, err)
+	// The IRMA app discloses the studentID (attribute 2, after the secret key and metadata)
+	proofs := gabi.ProofList{
+		&gabi.ProofU{},
+		&gabi.ProofD{ADisclosed: map[int]*big.Int{1: attrs.Ints[0], 4: attrs.Ints[3]}},
+	}
+
+	condiscon := irma.AttributeConDisCon{
+		irma.AttributeDisCon{
+			irma.AttributeCon{irma.NewAttributeRequest("irma-demo.RU.studentCard.level")},
+			irma.AttributeCon{irma.NewAttributeRequest("irma-demo.RU.studentCard.studentID")},
+		},
+		irma.AttributeDisCon{
+			irma.AttributeCon{irma.NewAttributeRequest("irma-demo.MijnOverheid.root.BSN")},
+		},
+	}
+	indices, err := legacyDisclosureIndices(proofs, condiscon, conf)
+	require.NoError(t, err)
+	require.Equal(t, irma.DisclosedAttributeIndices{
+		{{CredentialIndex: 1, AttributeIndex: 4}},
+		{},
+	}, indices)
+
+	complete, disclosed, err := condiscon.Satisfy(&irma.Disclosure{Proofs: proofs, Indices: indices}, nil, conf)
+	require.NoError(t, err)
+	require.False(t, complete)
+	require.Equal(t, "s1234567", *disclosed[0][0].RawValue)
+}
@@ -0,0 +1,223 @@
+package irmaserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// SessionStore is the interface that custom session store backends (e.g. DynamoDB, etcd or Memcached)
+// have to implement. Custom session stores are made available using RegisterSessionStore, and are
+// selected by setting the StoreType of the server configuration to the name under which the store
+// was registered.
+//
+// Sessions are passed to the store in serialized form; the server takes care of (de)serializing
+// sessions, detecting changes and expiring sessions. A session is always stored under both its
+// requestor token and its client token. The server always locks a session using Lock before
+// loading it, and releases the lock only after any changes to the session have been stored.
+type SessionStore interface {
+	// ClientToken returns the client token of the session with the given requestor token,
+	// or ErrUnknownSession if no such session exists.
+	ClientToken(token irma.RequestorToken) (irma.ClientToken, error)
+	// Lock acquires an exclusive lock on the session with the given client token. It returns
+	// a function that releases the lock. The session does not need to exist.
+	Lock(token irma.ClientToken) (unlock func(), err error)
+	// Load returns the serialized session with the given client token,
+	// or ErrUnknownSession if no such session exists.
+	Load(token irma.ClientToken) ([]byte, error)
+	// Store adds or overwrites the serialized session. The store may delete the session
+	// once the given time to live has passed.
+	Store(requestorToken irma.RequestorToken, clientToken irma.ClientToken, data []byte, ttl time.Duration) error
+	// Close is called when the server is stopped.
+	Close() error
+}
+
+// SessionStorePinger can be implemented by a SessionStore to report whether the store is
+// reachable, in the readiness check of the server (see Server.ReadyHandler).
+type SessionStorePinger interface {
+	Ping() error
+}
+
+// SessionStoreLister can be implemented by a SessionStore to enumerate the requestor tokens of
+// its sessions, for listing the active sessions (see Server.ListSessions).
+type SessionStoreLister interface {
+	RequestorTokens() ([]irma.RequestorToken, error)
+}
+
+// SessionStoreFactory creates a SessionStore for the given server configuration.
+type SessionStoreFactory func(conf *server.Configuration) (SessionStore, error)
+
+// ErrUnknownSession should be returned by a SessionStore if a requested session does not exist.
+var ErrUnknownSession = errors.New("unknown session")
+
+// ErrSessionConflict is returned when storing a session fails because, when using optimistic
+// locking, the session was modified by another server instance after it was loaded.
+var ErrSessionConflict = errors.New("session was modified concurrently")
+
+// ErrDraining is returned when starting a session while the server is being drained (see Server.Drain).
+var ErrDraining = errors.New("server is shutting down and does not accept new sessions")
+
+// SessionStoreError is returned when a custom session store fails.
+type SessionStoreError struct {
+	err error
+}
+
+func (err *SessionStoreError) Error() string {
+	return fmt.Sprintf("session store error: %s", err.err)
+}
+
+var (
+	sessionStoreFactoriesMutex sync.RWMutex
+	sessionStoreFactories      = make(map[string]SessionStoreFactory)
+	builtinStoreTypes          = []string{"", "memory", "redis", "postgres"}
+)
+
+// RegisterSessionStore makes a custom session store available under the given name, such that it
+// is used by servers whose configuration has the given name as StoreType.
+// If RegisterSessionStore is called twice with the same name, or with the name of one of the
+// built-in session stores, it panics.
+func RegisterSessionStore(name string, factory SessionStoreFactory) {
+	sessionStoreFactoriesMutex.Lock()
+	defer sessionStoreFactoriesMutex.Unlock()
+	if factory == nil {
+		panic("irmaserver: RegisterSessionStore factory is nil")
+	}
+	for _, builtin := range builtinStoreTypes {
+		if name == builtin {
+			panic("irmaserver: RegisterSessionStore called for built-in store type " + name)
+		}
+	}
+	if _, dup := sessionStoreFactories[name]; dup {
+		panic("irmaserver: RegisterSessionStore called twice for store type " + name)
+	}
+	sessionStoreFactories[name] = factory
+}
+
+func sessionStoreFactory(name string) SessionStoreFactory {
+	sessionStoreFactoriesMutex.RLock()
+	defer sessionStoreFactoriesMutex.RUnlock()
+	return sessionStoreFactories[name]
+}
+
+// customSessionStore implements sessionStore on top of a SessionStore registered using RegisterSessionStore.
+type customSessionStore struct {
+	store  SessionStore
+	conf   *server.Configuration
+	server *Server
+}
+
+func (s *customSessionStore) get(t irma.RequestorToken) (*session, error) {
+	clientToken, err := s.store.ClientToken(t)
+	if err == ErrUnknownSession {
+		return nil, server.LogError(&UnknownSessionError{t, ""})
+	} else if err != nil {
+		return nil, logAsSessionStoreError(err)
+	}
+	return s.clientGet(clientToken)
+}
+
+func (s *customSessionStore) clientGet(t irma.ClientToken) (*session, error) {
+	start := time.Now()
+	unlock, err := s.store.Lock(t)
+	if err != nil {
+		return nil, logAsSessionStoreError(err)
+	}
+	session := &session{
+		sessions: s,
+		conf:     s.conf,
+		server:   s.server,
+		locked:   true,
+		release:  unlock,
+	}
+
+	// Both session and error need to be returned from here on, so the session can be unlocked later.
+	data, err := s.store.Load(t)
+	if err == ErrUnknownSession {
+		return session, server.LogError(&UnknownSessionError{"", t})
+	} else if err != nil {
+		return session, logAsSessionStoreError(err)
+	}
+	if err := session.sessionData.unmarshal(s.conf, t, data); err != nil {
+		return session, logAsSessionStoreError(err)
+	}
+	session.request = session.Rrequest.SessionRequest()
+	session.traceStore("load", start, nil)
+
+	// hashing the current session data needs to take place before the timeout check to detect all changes!
+	hash := session.sessionData.hash()
+	session.hashBefore = &hash
+
+	lifetime := session.maxLifetime()
+	if session.LastActive.Add(lifetime).Before(time.Now()) && !session.Status.Finished() {
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Info("Session expired")
+		session.markAlive()
+		session.setStatus(irma.ServerStatusTimeout)
+	}
+
+	return session, nil
+}
+
+func (s *customSessionStore) add(session *session) error {
+	data, err := session.sessionData.marshal(s.conf)
+	if err != nil {
+		return server.LogError(err)
+	}
+	if err = s.store.Store(session.RequestorToken, session.ClientToken, data, session.storeTimeout()); err != nil {
+		return logAsSessionStoreError(err)
+	}
+	return nil
+}
+
+func (s *customSessionStore) update(session *session) error {
+	hash := session.hash()
+	if session.hashBefore == nil || *session.hashBefore == hash {
+		// if nothing changed, updating is not necessary
+		return nil
+	}
+	return s.add(session)
+}
+
+func (s *customSessionStore) unlock(session *session) {
+	if !session.locked {
+		return
+	}
+	if session.release != nil {
+		session.release()
+		session.release = nil
+	}
+	session.locked = false
+}
+
+func (s *customSessionStore) ping() error {
+	if pinger, ok := s.store.(SessionStorePinger); ok {
+		return pinger.Ping()
+	}
+	return nil
+}
+
+func (s *customSessionStore) requestorTokens() ([]irma.RequestorToken, error) {
+	lister, ok := s.store.(SessionStoreLister)
+	if !ok {
+		return nil, errors.Errorf("session store %s does not support listing sessions", s.conf.StoreType)
+	}
+	tokens, err := lister.RequestorTokens()
+	if err != nil {
+		return nil, logAsSessionStoreError(err)
+	}
+	return tokens, nil
+}
+
+func (s *customSessionStore) stop() {
+	if err := s.store.Close(); err != nil {
+		_ = logAsSessionStoreError(err)
+	}
+}
+
+func logAsSessionStoreError(err error) error {
+	return server.LogError(&SessionStoreError{err})
+}
@@ -0,0 +1,141 @@
+package irmaserver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// sessionStats aggregates the sessions that finished at a Server per minute, from which its
+// StatsHandler computes statistics over the time windows of the configuration. As sessions are
+// only kept by the session store until their result lifetime has passed, the statistics cannot be
+// computed from the session store, but are aggregated in memory as sessions finish. Like the
+// metrics, they therefore only cover the sessions that finished at this server instance: when
+// multiple instances share a Redis or PostgreSQL session store, the statistics of all instances
+// need to be combined.
+type sessionStats struct {
+	sync.Mutex
+	retention time.Duration
+	minutes   map[int64]map[sessionStatsKey]*SessionCount
+}
+
+type sessionStatsKey struct {
+	action    irma.Action
+	requestor string
+	status    irma.ServerStatus
+}
+
+// SessionStatistics contains aggregate statistics of the sessions that finished within a time window.
+type SessionStatistics struct {
+	Window     int                      `json:"window"` // in minutes
+	From       time.Time                `json:"from"`
+	Total      SessionCount             `json:"total"`
+	Actions    map[string]*SessionCount `json:"actions"`
+	Requestors map[string]*SessionCount `json:"requestors"`
+	Statuses   map[string]*SessionCount `json:"statuses"`
+}
+
+// SessionCount contains the number of sessions and their average duration from start until a
+// final status, in seconds.
+type SessionCount struct {
+	Count           uint64  `json:"count"`
+	AverageDuration float64 `json:"averageDuration"`
+	totalDuration   float64
+}
+
+// Default time windows of the session statistics, in minutes
+var defaultStatsWindows = []int{60, 24 * 60}
+
+func newSessionStats(windows []int) *sessionStats {
+	st := &sessionStats{minutes: map[int64]map[sessionStatsKey]*SessionCount{}}
+	for _, window := range windows {
+		if d := time.Duration(window) * time.Minute; d > st.retention {
+			st.retention = d
+		}
+	}
+	return st
+}
+
+// StatsHandler returns a http.Handler that serves statistics about the sessions that finished at
+// this server instance within each of the time windows of the configuration, as JSON.
+func (s *Server) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.WriteJson(w, s.stats.compute(s.statsWindows(), time.Now()))
+	})
+}
+
+func (s *Server) statsWindows() []int {
+	if len(s.conf.StatsWindows) == 0 {
+		return defaultStatsWindows
+	}
+	return s.conf.StatsWindows
+}
+
+func (st *sessionStats) sessionFinished(action irma.Action, requestor string, status irma.ServerStatus, duration time.Duration) {
+	st.Lock()
+	defer st.Unlock()
+
+	now := time.Now()
+	minute := now.Unix() / 60
+	for m := range st.minutes {
+		if m <= now.Add(-st.retention).Unix()/60 {
+			delete(st.minutes, m)
+		}
+	}
+	if st.minutes[minute] == nil {
+		st.minutes[minute] = map[sessionStatsKey]*SessionCount{}
+	}
+	key := sessionStatsKey{action, requestor, status}
+	if st.minutes[minute][key] == nil {
+		st.minutes[minute][key] = &SessionCount{}
+	}
+	st.minutes[minute][key].add(1, duration.Seconds())
+}
+
+func (st *sessionStats) compute(windows []int, now time.Time) []*SessionStatistics {
+	st.Lock()
+	defer st.Unlock()
+
+	var result []*SessionStatistics
+	for _, window := range windows {
+		from := now.Add(-time.Duration(window) * time.Minute)
+		stat := &SessionStatistics{
+			Window:     window,
+			From:       from,
+			Actions:    map[string]*SessionCount{},
+			Requestors: map[string]*SessionCount{},
+			Statuses:   map[string]*SessionCount{},
+		}
+		for minute, counts := range st.minutes {
+			if minute < from.Unix()/60 {
+				continue
+			}
+			for key, count := range counts {
+				stat.Total.add(count.Count, count.totalDuration)
+				addCount(stat.Actions, string(key.action), count)
+				addCount(stat.Statuses, string(key.status), count)
+				if key.requestor != "" {
+					addCount(stat.Requestors, key.requestor, count)
+				}
+			}
+		}
+		result = append(result, stat)
+	}
+	return result
+}
+
+func addCount(counts map[string]*SessionCount, key string, count *SessionCount) {
+	if counts[key] == nil {
+		counts[key] = &SessionCount{}
+	}
+	counts[key].add(count.Count, count.totalDuration)
+}
+
+func (c *SessionCount) add(count uint64, duration float64) {
+	c.Count += count
+	c.totalDuration += duration
+	c.AverageDuration = c.totalDuration / float64(c.Count)
+}
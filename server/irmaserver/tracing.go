@@ -0,0 +1,122 @@
+package irmaserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// This file contains the OpenTelemetry instrumentation of sessions. Each session carries a trace,
+// which starts with the span in which the session is started. The context of that span is stored
+// in the session, so that all later spans of the session join its trace, also when the session is
+// handled by other server instances using a persistent session store: the requests of the IRMA
+// app and the frontend, the verification of the proofs, the retrieval of the session result and
+// the session store operations. Spans are exported by the TracerProvider in the configuration,
+// or else by the globally registered one (see otel.SetTracerProvider); by default, tracing is
+// disabled.
+
+const tracerName = "github.com/privacybydesign/irmago/server/irmaserver"
+
+// Attributes of the spans of sessions. Sessions are identified by their client token: unlike the
+// requestor token, it grants no access to the session result, so it may end up in tracing backends.
+const (
+	attributeToken       = attribute.Key("irma.session.client_token")
+	attributeAction      = attribute.Key("irma.session.type")
+	attributeRequestor   = attribute.Key("irma.requestor")
+	attributeProofStatus = attribute.Key("irma.proof.status")
+)
+
+// traceContextPropagator serializes the context of the trace of sessions into the sessions, and
+// reads the trace context that the callers of the server may include in their requests.
+var traceContextPropagator = propagation.TraceContext{}
+
+func (s *Server) tracerProvider() trace.TracerProvider {
+	if s.conf.TracerProvider != nil {
+		return s.conf.TracerProvider
+	}
+	return otel.GetTracerProvider()
+}
+
+// traceContext returns a context containing the trace of the session.
+func (session *session) traceContext() context.Context {
+	return traceContextPropagator.Extract(context.Background(), session.Trace)
+}
+
+// startSpan starts a span in the trace of the session.
+func (session *session) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = session.traceContext()
+	}
+	opts = append(opts, trace.WithAttributes(attributeToken.String(string(session.ClientToken))))
+	return session.server.tracer.Start(ctx, name, opts...)
+}
+
+// traceStore records a span for an operation on the session store that started at the
+// specified time.
+func (session *session) traceStore(operation string, start time.Time, err error) {
+	_, span := session.startSpan(context.Background(), "irma.store."+operation, trace.WithTimestamp(start))
+	endSpan(span, err)
+}
+
+// traceStart starts the span in which the session is started, and stores its context in the session.
+func (session *session) traceStart() trace.Span {
+	ctx, span := session.server.tracer.Start(context.Background(), "irma.session.start",
+		trace.WithAttributes(
+			attributeToken.String(string(session.ClientToken)),
+			attributeAction.String(string(session.Action)),
+			attributeRequestor.String(session.Requestor),
+		),
+	)
+	session.Trace = propagation.MapCarrier{}
+	traceContextPropagator.Inject(ctx, session.Trace)
+	return span
+}
+
+// traceClientRequest starts a span in the trace of the session for a request of the IRMA app or
+// the frontend, and returns the request with the span in its context. If the request carries a
+// trace context itself, the span is linked to it.
+func (session *session) traceClientRequest(r *http.Request) (*http.Request, trace.Span) {
+	name := r.Method + " /session/{clientToken}"
+	if i := strings.Index(r.URL.Path, string(session.ClientToken)); i >= 0 {
+		name += strings.TrimSuffix(r.URL.Path[i+len(session.ClientToken):], "/")
+	}
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindServer)}
+	remote := trace.SpanContextFromContext(traceContextPropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header)))
+	if remote.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: remote}))
+	}
+	_, span := session.startSpan(context.Background(), name, opts...)
+	return r.WithContext(trace.ContextWithSpan(r.Context(), span)), span
+}
+
+// endSpan ends the span, recording the error if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceProofs records a span for handling the proofs sent by the IRMA app, which handle verifies.
+func (session *session) traceProofs(
+	ctx context.Context, handle func() (*irma.ServerSessionResponse, *irma.RemoteError),
+) (*irma.ServerSessionResponse, *irma.RemoteError) {
+	_, span := session.startSpan(ctx, "irma.proof.verify")
+	res, rerr := handle()
+	span.SetAttributes(attributeProofStatus.String(string(session.Result.ProofStatus)))
+	if rerr != nil {
+		endSpan(span, rerr)
+	} else {
+		span.End()
+	}
+	return res, rerr
+}
@@ -0,0 +1,77 @@
+package irmaserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	conf := sessionsConf(t)
+	conf.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	qr, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+	clientToken := irma.ClientToken(qr.URL[strings.LastIndex(qr.URL, "/")+1:])
+
+	// A request of the IRMA app, carrying a trace context of its own
+	remoteTrace := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	r := httptest.NewRequest(http.MethodGet, "/session/"+string(clientToken)+"/status", nil)
+	r.Header.Set("traceparent", remoteTrace)
+	w := httptest.NewRecorder()
+	s.HandlerFunc()(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	session, err := s.sessions.clientGet(clientToken)
+	require.NoError(t, err)
+	_, rerr := session.traceProofs(context.Background(), func() (*irma.ServerSessionResponse, *irma.RemoteError) {
+		return nil, server.RemoteError(server.ErrorInvalidProofs, "")
+	})
+	require.NotNil(t, rerr)
+	require.NoError(t, session.updateAndUnlock())
+
+	_, err = s.GetSessionResult(token)
+	require.NoError(t, err)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	require.Contains(t, spans, "irma.session.start")
+	require.Contains(t, spans, "GET /session/{clientToken}/status")
+	require.Contains(t, spans, "irma.proof.verify")
+	require.Contains(t, spans, "irma.session.result")
+
+	// All spans belong to the trace of the session and carry its client token, but not the
+	// requestor token, which is a secret of the requestor
+	traceID := spans["irma.session.start"].SpanContext().TraceID()
+	for name, span := range spans {
+		require.Equal(t, traceID, span.SpanContext().TraceID(), name)
+		require.Contains(t, span.Attributes(), attributeToken.String(string(clientToken)), name)
+		for _, attr := range span.Attributes() {
+			require.NotEqual(t, string(token), attr.Value.Emit(), name)
+		}
+	}
+	require.Equal(t, spans["irma.session.start"].SpanContext().SpanID(), spans["irma.session.result"].Parent().SpanID())
+
+	// The trace context of the request is linked to
+	links := spans["GET /session/{clientToken}/status"].Links()
+	require.Len(t, links, 1)
+	require.Equal(t, "0af7651916cd43dd8448eb211c80319c", links[0].SpanContext.TraceID().String())
+
+	require.Equal(t, codes.Error, spans["irma.proof.verify"].Status().Code)
+}
@@ -0,0 +1,143 @@
+package irmaserver
+
+import (
+	"strings"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// protocolFeature is a feature of the protocol between the server and the IRMA app that is only
+// available from a certain protocol version onwards. Code depending on such a feature should check
+// whether the negotiated protocol version of the session supports it, using session.supports,
+// and sessions requiring the feature should declare so in session.requiredFeatures.
+type protocolFeature string
+
+const (
+	// Attribute indices in disclosures, and the current format of attribute-based signatures
+	featureDisclosureIndices protocolFeature = "disclosure_indices"
+	// Conjunctions of disjunctions of conjunctions in disclosure requests
+	featureCondiscon protocolFeature = "condiscon"
+	// Nonrevocation proofs
+	featureRevocation protocolFeature = "revocation"
+	// Chained sessions, i.e. a session followed by the next session of the requestor
+	featureChainedSessions protocolFeature = "chained_sessions"
+	// Device pairing between the frontend and the IRMA app
+	featurePairing protocolFeature = "pairing"
+	// Authorization header sent by the IRMA app
+	featureClientAuthorization protocolFeature = "client_authorization"
+	// ClientSessionRequest format of the session request sent to the IRMA app, containing
+	// the session options
+	featureClientSessionRequest protocolFeature = "client_session_request"
+)
+
+// protocolFeatureVersions maps each protocol feature to the protocol version introducing it.
+var protocolFeatureVersions = map[protocolFeature]*irma.ProtocolVersion{
+	featureDisclosureIndices:    irma.NewVersion(2, 4),
+	featureCondiscon:            irma.NewVersion(2, 5),
+	featureRevocation:           irma.NewVersion(2, 6),
+	featureChainedSessions:      irma.NewVersion(2, 7),
+	featurePairing:              irma.NewVersion(2, 8),
+	featureClientAuthorization:  irma.NewVersion(2, 8),
+	featureClientSessionRequest: irma.NewVersion(2, 8),
+}
+
+// protocolVersionRange returns the range of protocol versions that the server accepts, which is
+// the range supported by the server unless restricted by the configuration.
+func protocolVersionRange(conf *server.Configuration) (min, max *irma.ProtocolVersion, err error) {
+	supported := minLegacyProtocolVersion
+	if conf.DisableLegacyProtocols {
+		supported = minProtocolVersion
+	}
+	min, max = supported, maxProtocolVersion
+	if conf.MinProtocolVersion != "" {
+		if min, err = parseProtocolVersion(conf.MinProtocolVersion); err != nil {
+			return nil, nil, errors.WrapPrefix(err, "invalid min_protocol_version", 0)
+		}
+	}
+	if conf.MaxProtocolVersion != "" {
+		if max, err = parseProtocolVersion(conf.MaxProtocolVersion); err != nil {
+			return nil, nil, errors.WrapPrefix(err, "invalid max_protocol_version", 0)
+		}
+	}
+	if min.BelowVersion(supported) || max.AboveVersion(maxProtocolVersion) || max.BelowVersion(min) {
+		return nil, nil, errors.Errorf("protocol version range %s-%s is not within the supported range %s-%s",
+			min, max, supported, maxProtocolVersion)
+	}
+	return min, max, nil
+}
+
+func parseProtocolVersion(version string) (*irma.ProtocolVersion, error) {
+	v := &irma.ProtocolVersion{}
+	if err := v.UnmarshalJSON([]byte(version)); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// requiredFeatures returns the protocol features that the IRMA app must support for this session.
+// The request must be convertible to the legacy format for the condiscon feature to be optional,
+// so LegacyCompatible must be determined before.
+func (session *session) requiredFeatures() []protocolFeature {
+	var features []protocolFeature
+	if session.Action == irma.ActionSigning {
+		// The signature format of legacy protocol versions is not supported
+		features = append(features, featureDisclosureIndices)
+	}
+	if !session.LegacyCompatible {
+		features = append(features, featureCondiscon)
+	}
+	if len(session.request.Base().Revocation) > 0 {
+		features = append(features, featureRevocation)
+	}
+	if session.Rrequest.Base().NextSession != nil {
+		features = append(features, featureChainedSessions)
+	}
+	if session.Rrequest.Base().RequirePairing {
+		features = append(features, featurePairing)
+	}
+	return features
+}
+
+// supports returns whether the negotiated protocol version of the session supports the feature.
+func (session *session) supports(feature protocolFeature) bool {
+	return session.Version != nil && !session.Version.BelowVersion(protocolFeatureVersions[feature])
+}
+
+// chooseProtocolVersion negotiates the protocol version of the session: the highest version
+// within the range of the IRMA app and the range of the server, that supports all features
+// required by the session.
+func (session *session) chooseProtocolVersion(minClient, maxClient *irma.ProtocolVersion) (*irma.ProtocolVersion, error) {
+	minServer, maxServer, err := protocolVersionRange(session.conf)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	required := minServer
+	for _, feature := range session.requiredFeatures() {
+		version := protocolFeatureVersions[feature]
+		if maxClient.BelowVersion(version) {
+			missing = append(missing, string(feature))
+		}
+		if version.AboveVersion(required) {
+			required = version
+		}
+	}
+
+	if minClient.AboveVersion(maxServer) || maxClient.BelowVersion(required) || maxClient.BelowVersion(minClient) ||
+		required.AboveVersion(maxServer) {
+		err := errors.Errorf("Protocol version negotiation failed, min=%s max=%s minServer=%s maxServer=%s",
+			minClient.String(), maxClient.String(), required.String(), maxServer.String())
+		if len(missing) > 0 {
+			err = errors.Errorf("%s; features not supported by client: %s", err.Error(), strings.Join(missing, ", "))
+		}
+		_ = server.LogWarning(err)
+		return nil, err
+	}
+	if maxClient.AboveVersion(maxServer) {
+		return maxServer, nil
+	} else {
+		return maxClient, nil
+	}
+}
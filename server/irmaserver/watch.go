@@ -0,0 +1,146 @@
+package irmaserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// Time to wait after the last change to a scheme directory before reloading the scheme, so that
+// a scheme that is being written is reloaded only once and after it has been written completely.
+const schemeReloadDelay = time.Second
+
+// schemeWatcher watches the schemes directory for changes, and reloads the schemes that changed
+// into the IrmaConfiguration of the server.
+type schemeWatcher struct {
+	conf    *server.Configuration
+	watcher *fsnotify.Watcher
+	timers  map[string]*time.Timer
+	mutex   sync.Mutex
+	done    chan struct{}
+}
+
+func newSchemeWatcher(conf *server.Configuration) (*schemeWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &schemeWatcher{
+		conf:    conf,
+		watcher: watcher,
+		timers:  map[string]*time.Timer{},
+		done:    make(chan struct{}),
+	}
+	if err = w.add(conf.IrmaConfiguration.Path); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	go w.run()
+	conf.Logger.WithField("path", conf.IrmaConfiguration.Path).Info("Watching schemes for changes")
+	return w, nil
+}
+
+// add watches the specified directory and all of its subdirectories, except hidden ones
+// (which include the temporary directories used when updating schemes).
+func (w *schemeWatcher) add(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return w.watcher.Add(path)
+	})
+}
+
+// schemeDir returns the scheme directory containing the specified path, or "" if the path is not
+// within a scheme directory.
+func (w *schemeWatcher) schemeDir(path string) string {
+	rel, err := filepath.Rel(w.conf.IrmaConfiguration.Path, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	name := strings.Split(filepath.ToSlash(rel), "/")[0]
+	if strings.HasPrefix(name, ".") {
+		return ""
+	}
+	return filepath.Join(w.conf.IrmaConfiguration.Path, name)
+}
+
+func (w *schemeWatcher) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.conf.Logger.WithField("error", err).Warn("Error watching schemes")
+		}
+	}
+}
+
+func (w *schemeWatcher) handle(event fsnotify.Event) {
+	dir := w.schemeDir(event.Name)
+	if dir == "" {
+		return
+	}
+	if event.Op&fsnotify.Create != 0 {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			if err = w.add(event.Name); err != nil {
+				_ = server.LogWarning(err)
+			}
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if timer, ok := w.timers[dir]; ok {
+		timer.Reset(schemeReloadDelay)
+		return
+	}
+	w.timers[dir] = time.AfterFunc(schemeReloadDelay, func() {
+		w.mutex.Lock()
+		delete(w.timers, dir)
+		w.mutex.Unlock()
+		w.reload(dir)
+	})
+}
+
+func (w *schemeWatcher) reload(dir string) {
+	if _, err := os.Stat(filepath.Join(dir, "index")); err != nil {
+		return // not (or no longer) a scheme
+	}
+	if err := w.conf.IrmaConfiguration.ReloadScheme(dir); err != nil {
+		w.conf.Logger.WithFields(logrus.Fields{"dir": dir, "error": err}).Error("Failed to reload scheme, keeping current version")
+		return
+	}
+	w.conf.Logger.WithField("dir", dir).Info("Reloaded scheme")
+}
+
+func (w *schemeWatcher) stop() {
+	close(w.done)
+	_ = w.watcher.Close()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for dir, timer := range w.timers {
+		timer.Stop()
+		delete(w.timers, dir)
+	}
+}
@@ -0,0 +1,260 @@
+package irmaserver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Interval at which the session status is retrieved from persistent session stores, to notice
+	// status changes made by other server instances
+	frontendWebSocketSyncInterval = 5 * time.Second
+	// Time the frontend has to authorize itself after connecting
+	frontendWebSocketAuthTimeout = 10 * time.Second
+)
+
+var websocketUpgrader = websocket.Upgrader{
+	// Like the other frontend endpoints, the WebSocket may be used cross-origin.
+	// Access is protected by the frontend authorization token instead.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// frontendListeners keeps the channels over which the WebSockets of frontends receive the status
+// updates of their session, as they happen at this server instance.
+type frontendListeners struct {
+	sync.Mutex
+	channels map[irma.ClientToken]map[chan *irma.FrontendSessionStatus]struct{}
+}
+
+func newFrontendListeners() *frontendListeners {
+	return &frontendListeners{channels: map[irma.ClientToken]map[chan *irma.FrontendSessionStatus]struct{}{}}
+}
+
+func (l *frontendListeners) add(token irma.ClientToken) chan *irma.FrontendSessionStatus {
+	l.Lock()
+	defer l.Unlock()
+	ch := make(chan *irma.FrontendSessionStatus, 1)
+	if l.channels[token] == nil {
+		l.channels[token] = map[chan *irma.FrontendSessionStatus]struct{}{}
+	}
+	l.channels[token][ch] = struct{}{}
+	return ch
+}
+
+func (l *frontendListeners) remove(token irma.ClientToken, ch chan *irma.FrontendSessionStatus) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.channels[token], ch)
+	if len(l.channels[token]) == 0 {
+		delete(l.channels, token)
+	}
+}
+
+// notify sends the status to the listeners of the session without blocking. Listeners that did not
+// yet receive a previous status only receive the latest one.
+func (l *frontendListeners) notify(token irma.ClientToken, status *irma.FrontendSessionStatus) {
+	l.Lock()
+	defer l.Unlock()
+	for ch := range l.channels[token] {
+		select {
+		case ch <- status:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- status
+		}
+	}
+}
+
+// handleFrontendWebSocket serves a WebSocket over which the frontend receives session status updates
+// and sends commands. Unlike the other session endpoints, the session is not locked by a middleware
+// for the duration of the request, as the connection is long-lived. Instead, status updates are
+// pushed to the WebSocket as they happen, and the session is retrieved from the session store when
+// handling commands. As sessions in persistent session stores may also be updated by other server
+// instances, their status is additionally retrieved every frontendWebSocketSyncInterval.
+func (s *Server) handleFrontendWebSocket(w http.ResponseWriter, r *http.Request) {
+	token, err := irma.ParseClientToken(chi.URLParam(r, "clientToken"))
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	var frontendAuth irma.FrontendAuthorization
+	if _, rerr := s.frontendSession(token, func(session *session) {
+		frontendAuth = session.FrontendAuth
+	}); rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+
+	conn, err := websocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded with an HTTP error
+		_ = server.LogWarning(err)
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	logger := s.conf.Logger.WithFields(logrus.Fields{"clientToken": token})
+
+	// Frontends that cannot set the Authorization header (i.e. browsers) send it as their first message
+	if irma.FrontendAuthorization(r.Header.Get(irma.AuthorizationHeader)) != frontendAuth {
+		var msg irma.FrontendWebSocketMessage
+		_ = conn.SetReadDeadline(time.Now().Add(frontendWebSocketAuthTimeout))
+		if err := conn.ReadJSON(&msg); err != nil ||
+			msg.Type != irma.FrontendWebSocketAuthorize || msg.Authorization != frontendAuth {
+			logger.Info("Frontend WebSocket closed: unauthorized")
+			_ = s.writeFrontendWebSocketMessage(conn, irma.FrontendWebSocketMessage{
+				Type:  irma.FrontendWebSocketError,
+				Error: server.RemoteError(server.ErrorIrmaUnauthorized, ""),
+			})
+			return
+		}
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	// Handle commands from the frontend in the background; responses are passed to the loop below,
+	// as a WebSocket connection does not support concurrent writers.
+	responses := make(chan irma.FrontendWebSocketMessage)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(closed)
+		for {
+			var msg irma.FrontendWebSocketMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if rerr := s.handleFrontendWebSocketCommand(token, msg); rerr != nil {
+				select {
+				case responses <- irma.FrontendWebSocketMessage{Type: irma.FrontendWebSocketError, Error: rerr}:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	// Listen for status updates before retrieving the current status, so that no updates are missed
+	updates := s.frontendListeners.add(token)
+	defer s.frontendListeners.remove(token, updates)
+	var refresh <-chan time.Time
+	if _, ok := s.sessions.(*memorySessionStore); !ok {
+		ticker := time.NewTicker(frontendWebSocketSyncInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+	keepAlive := time.NewTicker(sseKeepAliveInterval * time.Second)
+	defer keepAlive.Stop()
+
+	status, rerr := s.frontendSession(token, nil)
+	var current *irma.FrontendSessionStatus
+	for {
+		if rerr != nil {
+			_ = s.writeFrontendWebSocketMessage(conn, irma.FrontendWebSocketMessage{Type: irma.FrontendWebSocketError, Error: rerr})
+			return
+		}
+		if status != nil && frontendStatusChanged(current, status) {
+			current = status
+			if err := s.writeFrontendWebSocketMessage(conn, irma.FrontendWebSocketMessage{
+				Type:   irma.FrontendWebSocketStatus,
+				Status: status,
+			}); err != nil {
+				return
+			}
+			if status.Status.Finished() {
+				// No status updates follow after a final status
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+					time.Now().Add(server.WriteTimeout),
+				)
+				return
+			}
+		}
+
+		status = nil
+		select {
+		case status = <-updates:
+		case <-refresh:
+			status, rerr = s.frontendSession(token, nil)
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(server.WriteTimeout)); err != nil {
+				return
+			}
+		case msg := <-responses:
+			if err := s.writeFrontendWebSocketMessage(conn, msg); err != nil {
+				return
+			}
+		case <-closed:
+			logger.Debug("Frontend WebSocket closed by frontend")
+			return
+		}
+	}
+}
+
+// frontendStatusChanged returns whether the frontend needs to be informed of the new status, i.e.
+// whether the session status or the next session of a chained session changed.
+func frontendStatusChanged(current, status *irma.FrontendSessionStatus) bool {
+	if current == nil || current.Status != status.Status {
+		return true
+	}
+	if (current.NextSession == nil) != (status.NextSession == nil) {
+		return true
+	}
+	return status.NextSession != nil && *current.NextSession != *status.NextSession
+}
+
+func (s *Server) handleFrontendWebSocketCommand(token irma.ClientToken, msg irma.FrontendWebSocketMessage) *irma.RemoteError {
+	var rerr *irma.RemoteError
+	_, err := s.frontendSession(token, func(session *session) {
+		switch msg.Type {
+		case irma.FrontendWebSocketCancel:
+			session.handleDelete()
+		case irma.FrontendWebSocketPairingCompleted:
+			if err := session.pairingCompleted(); err != nil {
+				rerr = server.RemoteError(server.ErrorUnexpectedRequest, err.Error())
+			}
+		default:
+			rerr = server.RemoteError(server.ErrorMalformedInput, "unknown message type")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return rerr
+}
+
+// frontendSession retrieves the session with the given client token, invokes f (if not nil) on it
+// while the session is locked, and returns the frontend status of the session afterwards.
+func (s *Server) frontendSession(token irma.ClientToken, f func(session *session)) (*irma.FrontendSessionStatus, *irma.RemoteError) {
+	session, err := s.sessions.clientGet(token)
+	var status *irma.FrontendSessionStatus
+	if err == nil {
+		if f != nil {
+			f(session)
+		}
+		status = &irma.FrontendSessionStatus{Status: session.Status, NextSession: session.Next}
+	}
+	if err = updateAndUnlock(session, err); err != nil {
+		if _, ok := err.(*UnknownSessionError); ok {
+			return nil, server.RemoteError(server.ErrorSessionUnknown, "")
+		}
+		return nil, server.RemoteError(server.ErrorInternal, "")
+	}
+	return status, nil
+}
+
+func (s *Server) writeFrontendWebSocketMessage(conn *websocket.Conn, msg irma.FrontendWebSocketMessage) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(server.WriteTimeout))
+	return conn.WriteJSON(msg)
+}
@@ -0,0 +1,117 @@
+package irmaserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func startWebSocketSession(t *testing.T) (*Server, *httptest.Server, string, *irma.FrontendSessionRequest) {
+	s, err := New(sessionsConf(t))
+	require.NoError(t, err)
+	ts := httptest.NewServer(s.HandlerFunc())
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	qr, _, frontendRequest, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/" + qr.URL + "/frontend/ws"
+	return s, ts, url, frontendRequest
+}
+
+func readWebSocketMessage(t *testing.T, conn *websocket.Conn) irma.FrontendWebSocketMessage {
+	var msg irma.FrontendWebSocketMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	return msg
+}
+
+func TestFrontendWebSocket(t *testing.T) {
+	s, ts, url, frontendRequest := startWebSocketSession(t)
+	defer s.Stop()
+	defer ts.Close()
+
+	header := http.Header{}
+	header.Set(irma.AuthorizationHeader, string(frontendRequest.Authorization))
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msg := readWebSocketMessage(t, conn)
+	require.Equal(t, irma.FrontendWebSocketStatus, msg.Type)
+	require.Equal(t, irma.ServerStatusInitialized, msg.Status.Status)
+
+	// Pairing is not enabled, so this should result in an error
+	require.NoError(t, conn.WriteJSON(irma.FrontendWebSocketMessage{Type: irma.FrontendWebSocketPairingCompleted}))
+	msg = readWebSocketMessage(t, conn)
+	require.Equal(t, irma.FrontendWebSocketError, msg.Type)
+	require.Equal(t, string(server.ErrorUnexpectedRequest.Type), msg.Error.ErrorName)
+
+	require.NoError(t, conn.WriteJSON(irma.FrontendWebSocketMessage{Type: irma.FrontendWebSocketCancel}))
+	msg = readWebSocketMessage(t, conn)
+	require.Equal(t, irma.FrontendWebSocketStatus, msg.Type)
+	require.Equal(t, irma.ServerStatusCancelled, msg.Status.Status)
+
+	// The server closes the connection after a final status
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+}
+
+func TestFrontendWebSocketAuthorization(t *testing.T) {
+	s, ts, url, frontendRequest := startWebSocketSession(t)
+	defer s.Stop()
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(irma.FrontendWebSocketMessage{
+		Type:          irma.FrontendWebSocketAuthorize,
+		Authorization: "invalid",
+	}))
+	msg := readWebSocketMessage(t, conn)
+	require.Equal(t, irma.FrontendWebSocketError, msg.Type)
+	require.Equal(t, string(server.ErrorIrmaUnauthorized.Type), msg.Error.ErrorName)
+	_ = conn.Close()
+
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(irma.FrontendWebSocketMessage{
+		Type:          irma.FrontendWebSocketAuthorize,
+		Authorization: frontendRequest.Authorization,
+	}))
+	msg = readWebSocketMessage(t, conn)
+	require.Equal(t, irma.FrontendWebSocketStatus, msg.Type)
+	require.Equal(t, irma.ServerStatusInitialized, msg.Status.Status)
+}
+
+func TestFrontendListeners(t *testing.T) {
+	listeners := newFrontendListeners()
+	ch := listeners.add("token")
+
+	// Listeners that are behind only receive the latest status
+	listeners.notify("token", &irma.FrontendSessionStatus{Status: irma.ServerStatusConnected})
+	listeners.notify("token", &irma.FrontendSessionStatus{Status: irma.ServerStatusDone})
+	listeners.notify("other", &irma.FrontendSessionStatus{Status: irma.ServerStatusCancelled})
+	require.Equal(t, irma.ServerStatusDone, (<-ch).Status)
+	require.Empty(t, ch)
+
+	listeners.remove("token", ch)
+	require.Empty(t, listeners.channels)
+}
+
+func TestFrontendStatusChanged(t *testing.T) {
+	done := &irma.FrontendSessionStatus{Status: irma.ServerStatusDone}
+	next := &irma.FrontendSessionStatus{Status: irma.ServerStatusDone, NextSession: &irma.Qr{URL: "url", Type: irma.ActionIssuing}}
+
+	require.True(t, frontendStatusChanged(nil, done))
+	require.False(t, frontendStatusChanged(done, &irma.FrontendSessionStatus{Status: irma.ServerStatusDone}))
+	require.True(t, frontendStatusChanged(done, next))
+	require.False(t, frontendStatusChanged(next, &irma.FrontendSessionStatus{Status: irma.ServerStatusDone, NextSession: &irma.Qr{URL: "url", Type: irma.ActionIssuing}}))
+	require.True(t, frontendStatusChanged(next, &irma.FrontendSessionStatus{Status: irma.ServerStatusDone, NextSession: &irma.Qr{URL: "other", Type: irma.ActionIssuing}}))
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// signerSigningMethod is a jwt.SigningMethod that signs using a crypto.Signer, so that JWTs can
+// also be signed using keys that are not available in memory (e.g. keys kept in a HSM).
+type signerSigningMethod struct {
+	verifier jwt.SigningMethod
+	hash     crypto.Hash
+}
+
+var (
+	signingMethodSignerRS256 = &signerSigningMethod{jwt.SigningMethodRS256, crypto.SHA256}
+	signingMethodSignerES256 = &signerSigningMethod{jwt.SigningMethodES256, crypto.SHA256}
+	signingMethodSignerEdDSA = &signerSigningMethod{jwt.SigningMethodEdDSA, 0}
+)
+
+// JwtSigningMethod returns the JWT signing method to use with the given signer, depending on the
+// type of its public key: RS256 for RSA keys, ES256 for ECDSA P-256 keys and EdDSA for Ed25519 keys.
+func JwtSigningMethod(signer crypto.Signer) (jwt.SigningMethod, error) {
+	switch pk := signer.Public().(type) {
+	case *rsa.PublicKey:
+		return signingMethodSignerRS256, nil
+	case *ecdsa.PublicKey:
+		if pk.Curve != elliptic.P256() {
+			return nil, errors.New("unsupported elliptic curve for JWT signing: only P-256 is supported")
+		}
+		return signingMethodSignerES256, nil
+	case ed25519.PublicKey:
+		return signingMethodSignerEdDSA, nil
+	default:
+		return nil, errors.Errorf("unsupported key type for JWT signing: %T", pk)
+	}
+}
+
+// SignJwt signs the claims using the given signer. The key ID of the signer's public key
+// (see NewJwk) is included in the "kid" header of the JWT.
+func SignJwt(claims jwt.Claims, signer crypto.Signer) (string, error) {
+	method, err := JwtSigningMethod(signer)
+	if err != nil {
+		return "", err
+	}
+	jwk, err := NewJwk(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = jwk.Kid
+	return token.SignedString(signer)
+}
+
+func (m *signerSigningMethod) Alg() string {
+	return m.verifier.Alg()
+}
+
+func (m *signerSigningMethod) Verify(signingString, signature string, key interface{}) error {
+	return m.verifier.Verify(signingString, signature, key)
+}
+
+func (m *signerSigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	digest := []byte(signingString)
+	if m.hash != 0 {
+		h := m.hash.New()
+		h.Write(digest)
+		digest = h.Sum(nil)
+	}
+	sig, err := signer.Sign(rand.Reader, digest, m.hash)
+	if err != nil {
+		return "", err
+	}
+	if m.verifier == jwt.SigningMethodES256 {
+		// crypto.Signer returns ASN.1 encoded ECDSA signatures, while JWTs use the concatenation of r and s
+		if sig, err = ecdsaRawSignature(sig, 32); err != nil {
+			return "", err
+		}
+	}
+	return jwt.EncodeSegment(sig), nil
+}
+
+func ecdsaRawSignature(der []byte, size int) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse ECDSA signature", 0)
+	}
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
+
+// Jwk is a JSON Web Key (RFC 7517) containing a public key with which JWTs can be verified.
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JwkSet is a JSON Web Key Set (RFC 7517), as served at /.well-known/jwks.json.
+type JwkSet struct {
+	Keys []*Jwk `json:"keys"`
+}
+
+// NewJwk returns the JWK of the given RSA, ECDSA P-256 or Ed25519 public key. Its key ID is the
+// JWK thumbprint (RFC 7638) of the key, which is also included in the header of JWTs signed by SignJwt.
+func NewJwk(pk crypto.PublicKey) (*Jwk, error) {
+	var jwk *Jwk
+	switch k := pk.(type) {
+	case *rsa.PublicKey:
+		jwk = &Jwk{
+			Kty: "RSA",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			N:   jwt.EncodeSegment(k.N.Bytes()),
+			E:   jwt.EncodeSegment(big.NewInt(int64(k.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("unsupported elliptic curve for JWK: only P-256 is supported")
+		}
+		x, y := make([]byte, 32), make([]byte, 32)
+		jwk = &Jwk{
+			Kty: "EC",
+			Alg: jwt.SigningMethodES256.Alg(),
+			Crv: "P-256",
+			X:   jwt.EncodeSegment(k.X.FillBytes(x)),
+			Y:   jwt.EncodeSegment(k.Y.FillBytes(y)),
+		}
+	case ed25519.PublicKey:
+		jwk = &Jwk{
+			Kty: "OKP",
+			Alg: jwt.SigningMethodEdDSA.Alg(),
+			Crv: "Ed25519",
+			X:   jwt.EncodeSegment(k),
+		}
+	default:
+		return nil, errors.Errorf("unsupported key type for JWK: %T", pk)
+	}
+	jwk.Use = "sig"
+	jwk.Kid = jwk.thumbprint()
+	return jwk, nil
+}
+
+func (jwk *Jwk) thumbprint() string {
+	// The thumbprint is the hash of a JSON object containing only the required members of the key,
+	// in lexicographic order and without whitespace.
+	var s string
+	switch jwk.Kty {
+	case "RSA":
+		s = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		s = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Crv, jwk.X, jwk.Y)
+	case "OKP":
+		s = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, jwk.Crv, jwk.X)
+	}
+	hash := sha256.Sum256([]byte(s))
+	return jwt.EncodeSegment(hash[:])
+}
+
+// JwkSet returns the public keys with which result JWTs of this server can be verified: the public
+// key of the JwtSigner followed by the keys in JwtPublicKeyFiles.
+func (conf *Configuration) JwkSet() (*JwkSet, error) {
+	set := &JwkSet{Keys: []*Jwk{}}
+	pks := conf.jwtPublicKeys
+	if conf.JwtSigner != nil {
+		pks = append([]crypto.PublicKey{conf.JwtSigner.Public()}, pks...)
+	}
+	for _, pk := range pks {
+		jwk, err := NewJwk(pk)
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+// opaqueSigner hides the concrete type of the private key, like a HSM-backed signer would.
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestResultJwtSigningAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for alg, signer := range map[string]crypto.Signer{
+		"RS256": rsaKey,
+		"ES256": ecKey,
+		"EdDSA": edKey,
+	} {
+		for _, s := range []crypto.Signer{signer, opaqueSigner{signer}} {
+			conf := &Configuration{JwtSigner: s, JwtIssuer: "testserver", JwtAudience: "testrequestor"}
+			j, err := conf.ResultJwt(&SessionResult{Token: "token", Type: irma.ActionDisclosing}, 60)
+			require.NoError(t, err)
+
+			claims := &jwt.StandardClaims{}
+			token, err := jwt.ParseWithClaims(j, claims, func(token *jwt.Token) (interface{}, error) {
+				return signer.Public(), nil
+			})
+			require.NoError(t, err, alg)
+			require.Equal(t, alg, token.Method.Alg())
+			require.Equal(t, "testserver", claims.Issuer)
+			require.True(t, claims.VerifyAudience("testrequestor", true))
+		}
+	}
+
+	ecKey384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, err = JwtSigningMethod(ecKey384)
+	require.Error(t, err)
+}
+
+func TestParseJwtPrivateKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	bts, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+
+	conf := &Configuration{JwtPrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: bts}))}
+	conf.Logger = NewLogger(0, true, false)
+	require.NoError(t, conf.verifyJwtPrivateKey())
+	require.Nil(t, conf.JwtRSAPrivateKey)
+	require.Equal(t, ecKey.Public(), conf.JwtSigner.Public())
+}
+
+func TestJwkSet(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	previousKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	bts, err := x509.MarshalPKIXPublicKey(&previousKey.PublicKey)
+	require.NoError(t, err)
+	pubkeyFile := filepath.Join(t.TempDir(), "previous.pem")
+	require.NoError(t, os.WriteFile(pubkeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts}), 0600))
+
+	conf := &Configuration{JwtSigner: ecKey, JwtPublicKeyFiles: []string{pubkeyFile}, Logger: NewLogger(0, true, false)}
+	require.NoError(t, conf.verifyJwtPrivateKey())
+	set, err := conf.JwkSet()
+	require.NoError(t, err)
+	require.Len(t, set.Keys, 2)
+	require.Equal(t, "EC", set.Keys[0].Kty)
+	require.Equal(t, "ES256", set.Keys[0].Alg)
+	require.Equal(t, "RSA", set.Keys[1].Kty)
+	require.Equal(t, "AQAB", set.Keys[1].E)
+
+	// The key ID of the signing key is included in the JWT header
+	j, err := conf.ResultJwt(&SessionResult{Token: "token", Type: irma.ActionDisclosing}, 60)
+	require.NoError(t, err)
+	token, _, err := new(jwt.Parser).ParseUnverified(j, &jwt.StandardClaims{})
+	require.NoError(t, err)
+	require.Equal(t, set.Keys[0].Kid, token.Header["kid"])
+
+	x, err := jwt.DecodeSegment(set.Keys[0].X)
+	require.NoError(t, err)
+	require.Equal(t, ecKey.X.Bytes(), new(big.Int).SetBytes(x).Bytes())
+}
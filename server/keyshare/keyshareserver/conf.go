@@ -1,9 +1,13 @@
 package keyshareserver
 
 import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/rsa"
 	"encoding/binary"
 	"html/template"
 	"io/ioutil"
+	"math"
 	"strings"
 	"time"
 
@@ -48,12 +52,25 @@ type Configuration struct {
 	JwtPinExpiry      int    `json:"jwt_pin_expiry" mapstructure:"jwt_pin_expiry"`
 	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
 	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
+	// Signer of keyshare JWTs, which must have an RSA key. If absent, the JWT private key is used.
+	// Can be set to sign using a key that is not available in memory, e.g. one kept in a HSM.
+	JwtSigner crypto.Signer `json:"-"`
 	// Decryption keys used for user secrets
 	StorageFallbackKeyFiles []string `json:"storage_fallback_key_files" mapstructure:"storage_fallback_key_files"`
 	StoragePrimaryKeyFile   string   `json:"storage_primary_key_file" mapstructure:"storage_primary_key_file"`
+	// AES-GCM cipher with which user secrets are encrypted, with its key ID. If absent, the primary
+	// storage key is used. Can be set to use a key that is not available in memory, e.g. one kept in a HSM.
+	StorageDecrypter      cipher.AEAD `json:"-"`
+	StorageDecrypterKeyID uint32      `json:"-"`
+	// Number of keyshare commitments to precompute in the background per set of public keys
+	// used in keyshare sessions (0 to disable), reducing the time users wait after entering their PIN
+	CommitmentPoolSize int `json:"commitment_pool_size" mapstructure:"commitment_pool_size"`
 
 	// Keyshare attribute to issue during registration
 	KeyshareAttribute irma.AttributeTypeIdentifier `json:"keyshare_attribute" mapstructure:"keyshare_attribute"`
+	// Scheme manager of which this is the keyshare server. If KeyshareAttribute is not set,
+	// the keyshare attribute declared in its description is issued during registration.
+	SchemeManager irma.SchemeManagerIdentifier `json:"scheme_manager" mapstructure:"scheme_manager"`
 
 	// Configuration for email sending during registration (email address use will be disabled if not present)
 	keyshare.EmailConfiguration `mapstructure:",squash"`
@@ -65,6 +82,87 @@ type Configuration struct {
 	VerificationURL map[string]string `json:"verification_url" mapstructure:"verification_url"`
 	// Amount of time user's email validation token is valid (in hours)
 	EmailTokenValidity int `json:"email_token_validity" mapstructure:"email_token_validity"`
+
+	// Configuration for account recovery using email (disabled if not present)
+	RecoveryEmailFiles     map[string]string `json:"recovery_email_files" mapstructure:"recovery_email_files"`
+	RecoveryEmailSubjects  map[string]string `json:"recovery_email_subjects" mapstructure:"recovery_email_subjects"`
+	recoveryEmailTemplates map[string]*template.Template
+	// Amount of time user's recovery token is valid (in minutes)
+	RecoveryTokenValidity int `json:"recovery_token_validity" mapstructure:"recovery_token_validity"`
+
+	// Blocking of users after wrong PIN attempts
+	PinPolicy `mapstructure:",squash"`
+
+	// Serve metrics in the Prometheus text format at /metrics
+	EnableMetrics bool `json:"metrics" mapstructure:"metrics"`
+}
+
+// PinPolicy determines how users are blocked after consecutive wrong PIN attempts. After MaxTries
+// wrong PINs the user is blocked for BackoffStart seconds, which doubles after each subsequent
+// wrong PIN, up to MaxBackoff seconds if nonzero. After PermanentBlockAfter wrong PINs, if nonzero,
+// the user is blocked permanently.
+type PinPolicy struct {
+	MaxTries            int   `json:"max_pin_tries" mapstructure:"max_pin_tries"`
+	BackoffStart        int64 `json:"pin_backoff_start" mapstructure:"pin_backoff_start"`
+	MaxBackoff          int64 `json:"max_pin_backoff" mapstructure:"max_pin_backoff"`
+	PermanentBlockAfter int   `json:"pin_permanent_block_after" mapstructure:"pin_permanent_block_after"`
+}
+
+// Defaults of PinPolicy.MaxTries and PinPolicy.BackoffStart.
+const (
+	DefaultMaxPinTries     = 3
+	DefaultPinBackoffStart = 60
+)
+
+// remainingTries returns how many wrong PINs the user may enter before being blocked,
+// after the specified amount of consecutive wrong PINs.
+func (p PinPolicy) remainingTries(failures int) int {
+	if p.blockedPermanently(failures) || failures >= p.MaxTries {
+		return 0
+	}
+	return p.MaxTries - failures
+}
+
+// blockDuration returns how long in seconds the user is blocked after the specified amount of
+// consecutive wrong PINs, or -1 if the user is blocked permanently.
+func (p PinPolicy) blockDuration(failures int) int64 {
+	if p.blockedPermanently(failures) {
+		return -1
+	}
+	if failures < p.MaxTries {
+		return 0
+	}
+	wait := p.BackoffStart
+	for i := p.MaxTries; i < failures && wait <= math.MaxInt64/2; i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+func (p PinPolicy) blockedPermanently(failures int) bool {
+	return p.PermanentBlockAfter > 0 && failures >= p.PermanentBlockAfter
+}
+
+func (p *PinPolicy) validate() error {
+	if p.MaxTries == 0 {
+		p.MaxTries = DefaultMaxPinTries
+	}
+	if p.BackoffStart == 0 {
+		p.BackoffStart = DefaultPinBackoffStart
+	}
+	if p.MaxTries < 1 || p.BackoffStart < 1 || p.MaxBackoff < 0 || p.PermanentBlockAfter < 0 {
+		return errors.New("PIN policy settings must be positive")
+	}
+	if p.MaxBackoff > 0 && p.MaxBackoff < p.BackoffStart {
+		return errors.Errorf("max_pin_backoff (%d) is less than pin_backoff_start (%d)", p.MaxBackoff, p.BackoffStart)
+	}
+	if p.PermanentBlockAfter > 0 && p.PermanentBlockAfter < p.MaxTries {
+		return errors.Errorf("pin_permanent_block_after (%d) is less than max_pin_tries (%d)", p.PermanentBlockAfter, p.MaxTries)
+	}
+	return nil
 }
 
 func readAESKey(filename string) (uint32, keysharecore.AESKey, error) {
@@ -97,13 +195,40 @@ func validateConf(conf *Configuration) error {
 		if _, ok := conf.VerificationURL[conf.DefaultLanguage]; !ok {
 			return server.LogError(errors.Errorf("Missing verification base url for default language"))
 		}
+		if len(conf.RecoveryEmailFiles) != 0 {
+			conf.recoveryEmailTemplates, err = keyshare.ParseEmailTemplates(
+				conf.RecoveryEmailFiles,
+				conf.RecoveryEmailSubjects,
+				conf.DefaultLanguage,
+			)
+			if err != nil {
+				return server.LogError(err)
+			}
+		}
 	}
 
 	if err = conf.VerifyEmailServer(); err != nil {
 		return server.LogError(err)
 	}
 
-	if conf.IrmaConfiguration.AttributeTypes[conf.KeyshareAttribute] == nil {
+	if conf.CommitmentPoolSize < 0 {
+		return server.LogError(errors.Errorf("commitment_pool_size must not be negative (was %d)", conf.CommitmentPoolSize))
+	}
+
+	if !conf.SchemeManager.Empty() {
+		scheme := conf.IrmaConfiguration.GetSchemeManagers()[conf.SchemeManager]
+		if scheme == nil {
+			return server.LogError(errors.Errorf("Unknown scheme manager: %s", conf.SchemeManager))
+		}
+		declared := irma.NewAttributeTypeIdentifier(scheme.KeyshareAttribute)
+		if conf.KeyshareAttribute.Empty() {
+			conf.KeyshareAttribute = declared
+		} else if conf.KeyshareAttribute != declared {
+			conf.Logger.Warnf("Keyshare attribute %s differs from keyshare attribute %s declared by scheme manager %s",
+				conf.KeyshareAttribute, declared, conf.SchemeManager)
+		}
+	}
+	if conf.IrmaConfiguration.GetAttributeTypes()[conf.KeyshareAttribute] == nil {
 		return server.LogError(errors.Errorf("Unknown keyshare attribute: %s", conf.KeyshareAttribute))
 	}
 	_, err = conf.IrmaConfiguration.PrivateKeys.Latest(conf.KeyshareAttribute.CredentialTypeIdentifier().IssuerIdentifier())
@@ -123,6 +248,15 @@ func validateConf(conf *Configuration) error {
 	if conf.EmailTokenValidity < 1 || conf.EmailTokenValidity > 8760 {
 		return server.LogError(errors.Errorf("EmailTokenValidity (%d) is less than one hour or more than one year", conf.EmailTokenValidity))
 	}
+	if conf.RecoveryTokenValidity == 0 {
+		conf.RecoveryTokenValidity = 60 // set default of 1 hour
+	}
+	if conf.RecoveryTokenValidity < 1 || conf.RecoveryTokenValidity > 1440 {
+		return server.LogError(errors.Errorf("RecoveryTokenValidity (%d) is less than one minute or more than one day", conf.RecoveryTokenValidity))
+	}
+	if err = conf.PinPolicy.validate(); err != nil {
+		return server.LogError(err)
+	}
 	return nil
 }
 
@@ -150,30 +284,42 @@ func setupDatabase(conf *Configuration) (DB, error) {
 
 func setupCore(conf *Configuration) (*keysharecore.Core, error) {
 	// Parse keysharecore private keys and create a valid keyshare core
-	if conf.JwtPrivateKey == "" && conf.JwtPrivateKeyFile == "" {
-		return nil, server.LogError(errors.Errorf("Missing keyshare server jwt key"))
-	}
-	keybytes, err := common.ReadKey(conf.JwtPrivateKey, conf.JwtPrivateKeyFile)
-	if err != nil {
-		return nil, server.LogError(errors.WrapPrefix(err, "failed to read keyshare server jwt key", 0))
-	}
-	jwtPrivateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keybytes)
-	if err != nil {
-		return nil, server.LogError(errors.WrapPrefix(err, "failed to read keyshare server jwt key", 0))
-	}
-	decKeyID, decKey, err := readAESKey(conf.StoragePrimaryKeyFile)
-	if err != nil {
-		return nil, server.LogError(errors.WrapPrefix(err, "failed to load primary storage key", 0))
+	jwtSigner := conf.JwtSigner
+	if jwtSigner == nil {
+		if conf.JwtPrivateKey == "" && conf.JwtPrivateKeyFile == "" {
+			return nil, server.LogError(errors.Errorf("Missing keyshare server jwt key"))
+		}
+		keybytes, err := common.ReadKey(conf.JwtPrivateKey, conf.JwtPrivateKeyFile)
+		if err != nil {
+			return nil, server.LogError(errors.WrapPrefix(err, "failed to read keyshare server jwt key", 0))
+		}
+		jwtSigner, err = jwt.ParseRSAPrivateKeyFromPEM(keybytes)
+		if err != nil {
+			return nil, server.LogError(errors.WrapPrefix(err, "failed to read keyshare server jwt key", 0))
+		}
+	} else if _, ok := jwtSigner.Public().(*rsa.PublicKey); !ok {
+		return nil, server.LogError(errors.Errorf("keyshare server jwt signer must have an RSA key"))
 	}
 
-	core := keysharecore.NewKeyshareCore(&keysharecore.Configuration{
-		DecryptionKeyID: decKeyID,
-		DecryptionKey:   decKey,
+	coreConf := &keysharecore.Configuration{
+		DecryptionKeyID: conf.StorageDecrypterKeyID,
+		Decrypter:       conf.StorageDecrypter,
 		JWTPrivateKeyID: conf.JwtKeyID,
-		JWTPrivateKey:   jwtPrivateKey,
+		JWTPrivateKey:   jwtSigner,
 		JWTIssuer:       conf.JwtIssuer,
 		JWTPinExpiry:    conf.JwtPinExpiry,
-	})
+
+		CommitmentPoolSize: conf.CommitmentPoolSize,
+	}
+	if conf.StorageDecrypter == nil {
+		var err error
+		coreConf.DecryptionKeyID, coreConf.DecryptionKey, err = readAESKey(conf.StoragePrimaryKeyFile)
+		if err != nil {
+			return nil, server.LogError(errors.WrapPrefix(err, "failed to load primary storage key", 0))
+		}
+	}
+
+	core := keysharecore.NewKeyshareCore(coreConf)
 	for _, keyFile := range conf.StorageFallbackKeyFiles {
 		id, key, err := readAESKey(keyFile)
 		if err != nil {
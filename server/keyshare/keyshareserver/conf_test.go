@@ -1,13 +1,20 @@
 package keyshareserver
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/privacybydesign/gabi/signed"
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func validConf(t *testing.T) *Configuration {
@@ -58,6 +65,28 @@ func TestConf(t *testing.T) {
 	_, err = New(conf)
 	assert.Error(t, err)
 
+	// Keys can be provided as signer and cipher instead of as files, e.g. when kept in a HSM
+	conf = validConf(t)
+	keybytes, err := os.ReadFile(conf.JwtPrivateKeyFile)
+	require.NoError(t, err)
+	conf.JwtSigner, err = jwt.ParseRSAPrivateKeyFromPEM(keybytes)
+	require.NoError(t, err)
+	conf.JwtPrivateKeyFile = ""
+	var key keysharecore.AESKey
+	block, err := aes.NewCipher(key[:])
+	require.NoError(t, err)
+	conf.StorageDecrypter, err = cipher.NewGCM(block)
+	require.NoError(t, err)
+	conf.StoragePrimaryKeyFile = ""
+	_, err = New(conf)
+	assert.NoError(t, err)
+
+	conf = validConf(t)
+	conf.JwtSigner, err = signed.GenerateKey()
+	require.NoError(t, err)
+	_, err = New(conf)
+	assert.Error(t, err)
+
 	conf = validConf(t)
 	conf.DBType = "undefined"
 	_, err = New(conf)
@@ -68,8 +97,37 @@ func TestConf(t *testing.T) {
 	_, err = New(conf)
 	assert.Error(t, err)
 
+	// The keyshare attribute can be taken from the scheme description
+	conf = validConf(t)
+	conf.KeyshareAttribute = irma.AttributeTypeIdentifier{}
+	conf.SchemeManager = irma.NewSchemeManagerIdentifier("test")
+	_, err = New(conf)
+	assert.NoError(t, err)
+	assert.Equal(t, irma.NewAttributeTypeIdentifier("test.test.mijnirma.email"), conf.KeyshareAttribute)
+
+	conf = validConf(t)
+	conf.SchemeManager = irma.NewSchemeManagerIdentifier("nonexisting")
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.KeyshareAttribute = irma.AttributeTypeIdentifier{}
+	conf.SchemeManager = irma.NewSchemeManagerIdentifier("irma-demo") // declares no keyshare attribute
+	_, err = New(conf)
+	assert.Error(t, err)
+
 	conf = validConf(t)
 	conf.IssuerPrivateKeysPath = testdataPath // no private keys here
 	_, err = New(conf)
 	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.CommitmentPoolSize = -1
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.RecoveryTokenValidity = 2000
+	_, err = New(conf)
+	assert.Error(t, err)
 }
@@ -1,6 +1,7 @@
 package keyshareserver
 
 import (
+	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 
 	"github.com/go-errors/errors"
@@ -9,6 +10,8 @@ import (
 var (
 	errUserAlreadyExists = errors.New("Cannot create user, username already taken")
 	errInvalidRecord     = errors.New("Invalid record in database")
+	errEmailNotFound     = errors.New("Email address not found for user")
+	errTokenNotFound     = errors.New("Token not found")
 )
 
 type eventType string
@@ -19,8 +22,18 @@ const (
 	eventTypePinCheckFailed  eventType = "PIN_CHECK_FAILED"
 	eventTypePinCheckBlocked eventType = "PIN_CHECK_BLOCKED"
 	eventTypeIRMASession     eventType = "IRMA_SESSION"
+	eventTypeRecovered       eventType = "RECOVERED"
+	eventTypeDeviceAdded     eventType = "DEVICE_ADDED"
+	eventTypeDeviceRevoked   eventType = "DEVICE_REVOKED"
 )
 
+// irmaSessionLogParam is the parameter of IRMA_SESSION log entries, so that users can see with
+// which requestors they performed which kind of sessions. Both fields are reported by the client.
+type irmaSessionLogParam struct {
+	Requestor   string      `json:"requestor,omitempty"`
+	SessionType irma.Action `json:"type,omitempty"`
+}
+
 // DB is an interface used by server to manage data storage.
 // There are multiple implementations of this, currently:
 //   - memorydb (memorydb.go) storing all data in memory (forgets everything after reboot)
@@ -33,11 +46,12 @@ type DB interface {
 	// reservePinTry reserves a pin check attempt, and additionally it returns:
 	//  - allowed is whether the user is allowed to do the pin check (false if user is blocked)
 	//  - tries is how many tries are remaining, after this pin check
-	//  - wait is how long the user must wait before the next attempt is allowed if tries is 0
-	// resetPinTries increases the user's try count and (if applicable) the date when the user
-	// is unblocked again in the database, regardless of if the pin check succeeds after this
-	// invocation.
-	reservePinTry(user *User) (allowed bool, tries int, wait int64, err error)
+	//  - wait is how long the user must wait before the next attempt is allowed if tries is 0,
+	//    or -1 if the user is blocked permanently
+	// reservePinTry increases the user's try count and (if applicable) the date when the user
+	// is unblocked again in the database according to the policy, regardless of if the pin check
+	// succeeds after this invocation.
+	reservePinTry(user *User, policy PinPolicy) (allowed bool, tries int, wait int64, err error)
 
 	// resetPinTries resets the user's pin count and unblock date fields in the database to their
 	// default values (0 past attempts, no unblock date).
@@ -50,6 +64,18 @@ type DB interface {
 
 	// Store email verification tokens on registration
 	addEmailVerification(user *User, emailAddress, token string, validity int) error
+
+	// Account recovery tokens, valid for the specified amount of minutes. addRecoveryToken returns
+	// errEmailNotFound if the email address is not a verified email address of the user, and
+	// consumeRecoveryToken returns errTokenNotFound if the user has no such unexpired token.
+	addRecoveryToken(user *User, emailAddress, token string, validity int) error
+	consumeRecoveryToken(user *User, token string) error
+
+	// Names of the devices registered to the user, by device ID. The devices themselves are
+	// registered in the user's secrets.
+	setDeviceName(user *User, deviceID, name string) error
+	deviceNames(user *User) (map[string]string, error)
+	removeDeviceName(user *User, deviceID string) error
 }
 
 // User represents a user of this server.
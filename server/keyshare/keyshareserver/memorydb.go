@@ -2,6 +2,7 @@ package keyshareserver
 
 import (
 	"sync"
+	"time"
 
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/server/keyshare"
@@ -14,10 +15,35 @@ import (
 type memoryDB struct {
 	sync.Mutex
 	users map[string]keysharecore.UserSecrets
+	pins  map[string]*memoryPinState
+
+	// Verified email addresses of users; as memoryDB does not store email addresses during
+	// registration, these have to be set directly.
+	emails         map[string][]string
+	recoveryTokens map[string]memoryRecoveryToken
+	deviceNameMap  map[string]map[string]string
+}
+
+// memoryPinState keeps track of the wrong PIN attempts of a user.
+type memoryPinState struct {
+	failures     int
+	blockedUntil int64
+}
+
+// memoryRecoveryToken is an account recovery token of a user.
+type memoryRecoveryToken struct {
+	username string
+	expiry   int64
 }
 
 func NewMemoryDB() DB {
-	return &memoryDB{users: map[string]keysharecore.UserSecrets{}}
+	return &memoryDB{
+		users:          map[string]keysharecore.UserSecrets{},
+		pins:           map[string]*memoryPinState{},
+		emails:         map[string][]string{},
+		recoveryTokens: map[string]memoryRecoveryToken{},
+		deviceNameMap:  map[string]map[string]string{},
+	}
 }
 
 func (db *memoryDB) user(username string) (*User, error) {
@@ -61,13 +87,45 @@ func (db *memoryDB) updateUser(user *User) error {
 	return nil
 }
 
-func (db *memoryDB) reservePinTry(user *User) (bool, int, int64, error) {
-	// Since this is a testing DB, implementing anything more than always allow creates hastle
-	return true, 1, 0, nil
+func (db *memoryDB) reservePinTry(user *User, policy PinPolicy) (bool, int, int64, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	if _, exists := db.users[user.Username]; !exists {
+		return false, 0, 0, keyshare.ErrUserNotFound
+	}
+	state := db.pins[user.Username]
+	if state == nil {
+		state = &memoryPinState{}
+		db.pins[user.Username] = state
+	}
+
+	now := time.Now().Unix()
+	allowed := !policy.blockedPermanently(state.failures) && state.blockedUntil <= now
+	if allowed {
+		state.failures++
+		if wait := policy.blockDuration(state.failures); wait > 0 {
+			state.blockedUntil = now + wait
+		}
+	}
+
+	if policy.blockedPermanently(state.failures) {
+		return allowed, 0, -1, nil
+	}
+	wait := state.blockedUntil - now
+	if wait < 0 {
+		wait = 0
+	}
+	return allowed, policy.remainingTries(state.failures), wait, nil
 }
 
 func (db *memoryDB) resetPinTries(user *User) error {
-	// Since this is a testing DB, implementing anything more than always allow creates hastle
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	delete(db.pins, user.Username)
 	return nil
 }
 
@@ -85,3 +143,69 @@ func (db *memoryDB) addEmailVerification(user *User, emailAddress, token string,
 	// We don't need to do anything here, as this information cannot be extracted locally
 	return nil
 }
+
+func (db *memoryDB) addRecoveryToken(user *User, emailAddress, token string, validity int) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	for _, email := range db.emails[user.Username] {
+		if email == emailAddress {
+			db.recoveryTokens[token] = memoryRecoveryToken{
+				username: user.Username,
+				expiry:   time.Now().Add(time.Duration(validity) * time.Minute).Unix(),
+			}
+			return nil
+		}
+	}
+	return errEmailNotFound
+}
+
+func (db *memoryDB) consumeRecoveryToken(user *User, token string) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	t, ok := db.recoveryTokens[token]
+	if !ok || t.username != user.Username || t.expiry < time.Now().Unix() {
+		return errTokenNotFound
+	}
+	delete(db.recoveryTokens, token)
+	return nil
+}
+
+func (db *memoryDB) setDeviceName(user *User, deviceID, name string) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	if _, exists := db.users[user.Username]; !exists {
+		return keyshare.ErrUserNotFound
+	}
+	if db.deviceNameMap[user.Username] == nil {
+		db.deviceNameMap[user.Username] = map[string]string{}
+	}
+	db.deviceNameMap[user.Username][deviceID] = name
+	return nil
+}
+
+func (db *memoryDB) deviceNames(user *User) (map[string]string, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	names := map[string]string{}
+	for id, name := range db.deviceNameMap[user.Username] {
+		names[id] = name
+	}
+	return names, nil
+}
+
+func (db *memoryDB) removeDeviceName(user *User, deviceID string) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	delete(db.deviceNameMap[user.Username], deviceID)
+	return nil
+}
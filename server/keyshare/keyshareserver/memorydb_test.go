@@ -1,8 +1,11 @@
 package keyshareserver
 
 import (
+	"math"
 	"testing"
 
+	"github.com/privacybydesign/irmago/server/keyshare"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -35,7 +38,7 @@ func TestMemoryDBUserManagement(t *testing.T) {
 	err = db.addLog(nuser, eventTypePinCheckSuccess, nil)
 	assert.NoError(t, err)
 
-	ok, tries, wait, err := db.reservePinTry(nuser)
+	ok, tries, wait, err := db.reservePinTry(nuser, PinPolicy{MaxTries: DefaultMaxPinTries, BackoffStart: DefaultPinBackoffStart})
 	assert.NoError(t, err)
 	assert.True(t, ok)
 	assert.True(t, tries > 0)
@@ -44,3 +47,79 @@ func TestMemoryDBUserManagement(t *testing.T) {
 	err = db.setSeen(nuser)
 	assert.NoError(t, err)
 }
+
+func TestMemoryDBPinReservation(t *testing.T) {
+	db := NewMemoryDB()
+	user := &User{Username: "testuser"}
+	require.NoError(t, db.AddUser(user))
+	policy := PinPolicy{MaxTries: 2, BackoffStart: 60, MaxBackoff: 100, PermanentBlockAfter: 5}
+
+	ok, tries, wait, err := db.reservePinTry(user, policy)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, tries)
+	assert.Equal(t, int64(0), wait)
+
+	// Out of tries: blocked for BackoffStart
+	ok, tries, wait, err = db.reservePinTry(user, policy)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 0, tries)
+	assert.Equal(t, int64(60), wait)
+
+	ok, tries, wait, err = db.reservePinTry(user, policy)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 0, tries)
+	assert.InDelta(t, 60, wait, 1)
+
+	// A successful attempt resets the tries
+	require.NoError(t, db.resetPinTries(user))
+	ok, tries, _, err = db.reservePinTry(user, policy)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, tries)
+
+	// Blocked permanently after PermanentBlockAfter wrong attempts
+	policy = PinPolicy{MaxTries: 1, BackoffStart: 60, PermanentBlockAfter: 1}
+	require.NoError(t, db.resetPinTries(user))
+	ok, tries, wait, err = db.reservePinTry(user, policy)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 0, tries)
+	assert.Equal(t, int64(-1), wait)
+	ok, _, wait, err = db.reservePinTry(user, policy)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, int64(-1), wait)
+
+	_, _, _, err = db.reservePinTry(&User{Username: "nonexistent"}, policy)
+	assert.ErrorIs(t, err, keyshare.ErrUserNotFound)
+}
+
+func TestPinPolicy(t *testing.T) {
+	policy := PinPolicy{MaxTries: 3, BackoffStart: 60}
+	require.NoError(t, policy.validate())
+	assert.Equal(t, 3, policy.remainingTries(0))
+	assert.Equal(t, 1, policy.remainingTries(2))
+	assert.Equal(t, 0, policy.remainingTries(3))
+	assert.Equal(t, int64(0), policy.blockDuration(2))
+	assert.Equal(t, int64(60), policy.blockDuration(3))
+	assert.Equal(t, int64(120), policy.blockDuration(4))
+	assert.Equal(t, int64(240), policy.blockDuration(5))
+	assert.Greater(t, policy.blockDuration(1000), int64(math.MaxInt64/2)) // does not overflow
+
+	policy.MaxBackoff = 200
+	policy.PermanentBlockAfter = 6
+	assert.Equal(t, int64(120), policy.blockDuration(4))
+	assert.Equal(t, int64(200), policy.blockDuration(5))
+	assert.Equal(t, int64(-1), policy.blockDuration(6))
+	assert.Equal(t, 0, policy.remainingTries(6))
+
+	policy = PinPolicy{}
+	require.NoError(t, policy.validate())
+	assert.Equal(t, PinPolicy{MaxTries: DefaultMaxPinTries, BackoffStart: DefaultPinBackoffStart}, policy)
+	require.Error(t, (&PinPolicy{MaxTries: 3, PermanentBlockAfter: 2}).validate())
+	require.Error(t, (&PinPolicy{BackoffStart: 60, MaxBackoff: 30}).validate())
+	require.Error(t, (&PinPolicy{MaxTries: -1}).validate())
+}
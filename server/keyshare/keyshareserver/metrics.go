@@ -0,0 +1,151 @@
+package keyshareserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// keyshareMetrics keeps track of the requests handled by a Server, for exposure in the Prometheus
+// text format by its MetricsHandler. As the metrics are kept in memory, they only cover the
+// requests handled by this server instance.
+type keyshareMetrics struct {
+	sync.Mutex
+	registrations uint64
+	pinChecks     map[pinCheckResult]uint64
+	commitments   uint64
+	latency       map[string]*histogram
+}
+
+// pinCheckResult is the outcome of a PIN verification, as recorded in the metrics.
+type pinCheckResult string
+
+const (
+	pinCheckSuccess pinCheckResult = "success"
+	pinCheckFailure pinCheckResult = "failure"
+	// The PIN was wrong and the user is now blocked
+	pinCheckBlocked pinCheckResult = "blocked"
+	// The PIN was not checked because the user is blocked
+	pinCheckRefused pinCheckResult = "refused"
+)
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Buckets (in seconds) of the request latency histogram
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+func newKeyshareMetrics() *keyshareMetrics {
+	return &keyshareMetrics{
+		pinChecks: map[pinCheckResult]uint64{},
+		latency:   map[string]*histogram{},
+	}
+}
+
+// MetricsHandler returns a http.Handler that serves metrics about the requests handled by
+// this server in the Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.metrics.write(w)
+	})
+}
+
+// metricsMiddleware records the latency of the requests to the keyshare API, by route.
+func (s *Server) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		if route == "" {
+			return // unknown endpoint
+		}
+		s.metrics.requestHandled(route, time.Since(start))
+	})
+}
+
+func (m *keyshareMetrics) registered() {
+	m.Lock()
+	defer m.Unlock()
+	m.registrations++
+}
+
+func (m *keyshareMetrics) pinChecked(result pinCheckResult) {
+	m.Lock()
+	defer m.Unlock()
+	m.pinChecks[result]++
+}
+
+func (m *keyshareMetrics) commitmentsGenerated() {
+	m.Lock()
+	defer m.Unlock()
+	m.commitments++
+}
+
+func (m *keyshareMetrics) requestHandled(route string, duration time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	h := m.latency[route]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[route] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *keyshareMetrics) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintln(w, "# HELP irma_keyshare_registrations_total Number of users registered.")
+	fmt.Fprintln(w, "# TYPE irma_keyshare_registrations_total counter")
+	fmt.Fprintf(w, "irma_keyshare_registrations_total %d\n", m.registrations)
+
+	fmt.Fprintln(w, "# HELP irma_keyshare_pin_checks_total Number of PIN verifications, by result.")
+	fmt.Fprintln(w, "# TYPE irma_keyshare_pin_checks_total counter")
+	results := make([]pinCheckResult, 0, len(m.pinChecks))
+	for result := range m.pinChecks {
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i] < results[j] })
+	for _, result := range results {
+		fmt.Fprintf(w, "irma_keyshare_pin_checks_total{result=%q} %d\n", result, m.pinChecks[result])
+	}
+
+	fmt.Fprintln(w, "# HELP irma_keyshare_commitments_total Number of commitment requests handled.")
+	fmt.Fprintln(w, "# TYPE irma_keyshare_commitments_total counter")
+	fmt.Fprintf(w, "irma_keyshare_commitments_total %d\n", m.commitments)
+
+	name := "irma_keyshare_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken to handle requests to the keyshare API, by route.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	routes := make([]string, 0, len(m.latency))
+	for route := range m.latency {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		h := m.latency[route]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{route=%q,le=\"%g\"} %d\n", name, route, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{route=%q,le=\"+Inf\"} %d\n", name, route, h.count)
+		fmt.Fprintf(w, "%s_sum{route=%q} %g\n", name, route, h.sum)
+		fmt.Fprintf(w, "%s_count{route=%q} %d\n", name, route, h.count)
+	}
+}
@@ -0,0 +1,46 @@
+package keyshareserver
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	db := createDB(t)
+	keyshareServer, httpServer := StartKeyshareServer(t, &testDB{db: db, ok: true, tries: 0, wait: 5, err: nil}, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/verify/pin",
+		`{"id":"legacyuser","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/verify/pin",
+		`{"id":"legacyuser","pin":"puZGbaLDmFywGhFDi4vW2G87Zh"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "error", jwtMsg.Status)
+
+	metrics := keyshareServer.metrics
+	metrics.Lock()
+	require.Equal(t, uint64(1), metrics.pinChecks[pinCheckSuccess])
+	require.Equal(t, uint64(1), metrics.pinChecks[pinCheckBlocked])
+	require.Zero(t, metrics.pinChecks[pinCheckFailure])
+	require.Equal(t, uint64(2), metrics.latency["/api/v1/users/verify/pin"].count)
+	metrics.Unlock()
+
+	// The metrics endpoint is only served when enabled
+	test.HTTPGet(t, nil, "http://localhost:8080/metrics", nil, 404, nil)
+
+	w := httptest.NewRecorder()
+	keyshareServer.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	require.Contains(t, body, "# TYPE irma_keyshare_registrations_total counter")
+	require.Contains(t, body, `irma_keyshare_pin_checks_total{result="blocked"} 1`)
+	require.Contains(t, body, `irma_keyshare_request_duration_seconds_count{route="/api/v1/users/verify/pin"} 2`)
+}
@@ -19,9 +19,6 @@ type postgresDB struct {
 	db keyshare.DB
 }
 
-// Number of tries allowed on pin before we start with exponential backoff
-const maxPinTries = 3
-
 // Max number of active tokens per email address within the emailTokenRateLimitDuration
 const emailTokenRateLimit = 3
 
@@ -30,10 +27,6 @@ const emailTokenRateLimitDuration = 60
 
 var errTooManyTokens = errors.New("Too many unhandled email tokens for given email address")
 
-// Initial amount of time user is forced to back off when having multiple pin failures (in seconds).
-// var so that tests may change it.
-var backoffStart int64 = 60
-
 // newPostgresDB opens a new database connection using the given maximum connection bounds.
 // For the maxOpenConns, maxIdleTime and maxOpenTime parameters, the value 0 means unlimited.
 func newPostgresDB(connstring string, maxIdleConns, maxOpenConns int, maxIdleTime, maxOpenTime time.Duration) (DB, error) {
@@ -102,21 +95,24 @@ func (db *postgresDB) updateUser(user *User) error {
 	)
 }
 
-func (db *postgresDB) reservePinTry(user *User) (bool, int, int64, error) {
+func (db *postgresDB) reservePinTry(user *User, policy PinPolicy) (bool, int, int64, error) {
 	// Check that account is not blocked already, and if not,
 	//  update pinCounter and pinBlockDate
 	uprows, err := db.db.Query(`
 		UPDATE irma.users
 		SET pin_counter = pin_counter+1,
 			pin_block_date = $1 + CASE WHEN pin_counter-$3 < 0 THEN 0
+			                           WHEN $5::bigint > 0 THEN LEAST($5::bigint, $2*2^GREATEST(0, pin_counter-$3))
 			                           ELSE $2*2^GREATEST(0, pin_counter-$3)
 			                      END
-		WHERE id=$4 AND pin_block_date<=$1 AND coredata IS NOT NULL
+		WHERE id=$4 AND pin_block_date<=$1 AND ($6::integer = 0 OR pin_counter < $6::integer) AND coredata IS NOT NULL
 		RETURNING pin_counter, pin_block_date`,
 		time.Now().Unix(),
-		backoffStart,
-		maxPinTries-1,
-		user.id)
+		policy.BackoffStart,
+		policy.MaxTries-1,
+		user.id,
+		policy.MaxBackoff,
+		policy.PermanentBlockAfter)
 	if err != nil {
 		return false, 0, 0, err
 	}
@@ -133,7 +129,7 @@ func (db *postgresDB) reservePinTry(user *User) (bool, int, int64, error) {
 		}
 		// if no results, then account either does not exist (which would be weird here) or is blocked
 		// so request wait timeout
-		pinrows, err := db.db.Query("SELECT pin_block_date FROM irma.users WHERE id=$1 AND coredata IS NOT NULL", user.id)
+		pinrows, err := db.db.Query("SELECT pin_counter, pin_block_date FROM irma.users WHERE id=$1 AND coredata IS NOT NULL", user.id)
 		if err != nil {
 			return false, 0, 0, err
 		}
@@ -144,7 +140,7 @@ func (db *postgresDB) reservePinTry(user *User) (bool, int, int64, error) {
 			}
 			return false, 0, 0, keyshare.ErrUserNotFound
 		}
-		err = pinrows.Scan(&wait)
+		err = pinrows.Scan(&tries, &wait)
 		if err != nil {
 			return false, 0, 0, err
 		}
@@ -156,12 +152,13 @@ func (db *postgresDB) reservePinTry(user *User) (bool, int, int64, error) {
 		if err != nil {
 			return false, 0, 0, err
 		}
-		tries = maxPinTries - tries
-		if tries < 0 {
-			tries = 0
-		}
 	}
 
+	// tries now contains the amount of consecutive wrong attempts including this one
+	if policy.blockedPermanently(tries) {
+		return allowed, 0, -1, nil
+	}
+	tries = policy.remainingTries(tries)
 	wait = wait - time.Now().Unix()
 	if wait < 0 {
 		wait = 0
@@ -233,3 +230,84 @@ func (db *postgresDB) addEmailVerification(user *User, emailAddress, token strin
 		expiry.Unix())
 	return err
 }
+
+func (db *postgresDB) addRecoveryToken(user *User, emailAddress, token string, validity int) error {
+	now := time.Now()
+
+	// Check whether the email address is a verified email address of the user
+	err := db.db.QueryScan("SELECT 1 FROM irma.emails WHERE user_id = $1 AND email = $2 AND (delete_on >= $3 OR delete_on IS NULL)",
+		nil, user.id, emailAddress, now.Unix())
+	if err == sql.ErrNoRows {
+		return errEmailNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	expiry := now.Add(time.Duration(validity) * time.Minute)
+	maxPrevExpiry := expiry.Add(-1 * time.Duration(emailTokenRateLimitDuration) * time.Minute)
+
+	// Check whether rate limiting is necessary
+	amount, err := db.db.ExecCount("SELECT 1 FROM irma.recovery_tokens WHERE user_id = $1 AND expiry > $2",
+		user.id,
+		maxPrevExpiry.Unix())
+	if err != nil {
+		return err
+	}
+	if amount >= emailTokenRateLimit {
+		return errTooManyTokens
+	}
+
+	_, err = db.db.Exec("INSERT INTO irma.recovery_tokens (token, user_id, expiry) VALUES ($1, $2, $3)",
+		token,
+		user.id,
+		expiry.Unix())
+	return err
+}
+
+func (db *postgresDB) consumeRecoveryToken(user *User, token string) error {
+	aff, err := db.db.ExecCount("DELETE FROM irma.recovery_tokens WHERE token = $1 AND user_id = $2 AND expiry >= $3",
+		token,
+		user.id,
+		time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if aff != 1 {
+		return errTokenNotFound
+	}
+	return nil
+}
+
+func (db *postgresDB) setDeviceName(user *User, deviceID, name string) error {
+	_, err := db.db.Exec(
+		`INSERT INTO irma.devices (user_id, device_id, name) VALUES ($1, $2, $3)
+		 ON CONFLICT (user_id, device_id) DO UPDATE SET name = $3`,
+		user.id,
+		deviceID,
+		name)
+	return err
+}
+
+func (db *postgresDB) deviceNames(user *User) (map[string]string, error) {
+	names := map[string]string{}
+	err := db.db.QueryIterate("SELECT device_id, name FROM irma.devices WHERE user_id = $1",
+		func(rows *sql.Rows) error {
+			var id, name string
+			if err := rows.Scan(&id, &name); err != nil {
+				return err
+			}
+			names[id] = name
+			return nil
+		},
+		user.id)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (db *postgresDB) removeDeviceName(user *User, deviceID string) error {
+	_, err := db.db.Exec("DELETE FROM irma.devices WHERE user_id = $1 AND device_id = $2", user.id, deviceID)
+	return err
+}
@@ -54,11 +54,74 @@ func TestPostgresDBUserManagement(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestPostgresDBRecoveryTokens(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl, 2, 0, 0, 0)
+	require.NoError(t, err)
+	pdb := db.(*postgresDB)
+
+	user := &User{Username: "testuser", Secrets: []byte{123}}
+	require.NoError(t, db.AddUser(user))
+	other := &User{Username: "otheruser", Secrets: []byte{123}}
+	require.NoError(t, db.AddUser(other))
+
+	_, err = pdb.db.Exec("INSERT INTO irma.emails (user_id, email, delete_on) VALUES ($1, 'test@example.com', NULL), ($1, 'deleted@example.com', 0)", user.id)
+	require.NoError(t, err)
+
+	// Only verified email addresses that are not scheduled for deletion are accepted
+	assert.ErrorIs(t, db.addRecoveryToken(user, "unknown@example.com", "token", 60), errEmailNotFound)
+	assert.ErrorIs(t, db.addRecoveryToken(user, "deleted@example.com", "token", 60), errEmailNotFound)
+	assert.ErrorIs(t, db.addRecoveryToken(other, "test@example.com", "token", 60), errEmailNotFound)
+
+	for i := 0; i < emailTokenRateLimit; i++ {
+		require.NoError(t, db.addRecoveryToken(user, "test@example.com", fmt.Sprintf("token-%d", i), 60))
+	}
+	assert.ErrorIs(t, db.addRecoveryToken(user, "test@example.com", "token-rate-limited", 60), errTooManyTokens)
+
+	// Tokens can only be consumed once, and only by the user they were issued to
+	assert.ErrorIs(t, db.consumeRecoveryToken(other, "token-0"), errTokenNotFound)
+	assert.NoError(t, db.consumeRecoveryToken(user, "token-0"))
+	assert.ErrorIs(t, db.consumeRecoveryToken(user, "token-0"), errTokenNotFound)
+	assert.ErrorIs(t, db.consumeRecoveryToken(user, "unknown"), errTokenNotFound)
+
+	// Expired tokens cannot be consumed
+	_, err = pdb.db.Exec("UPDATE irma.recovery_tokens SET expiry = 0 WHERE token = 'token-1'")
+	require.NoError(t, err)
+	assert.ErrorIs(t, db.consumeRecoveryToken(user, "token-1"), errTokenNotFound)
+}
+
+func TestPostgresDBDevices(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl, 2, 0, 0, 0)
+	require.NoError(t, err)
+
+	user := &User{Username: "testuser", Secrets: []byte{123}}
+	err = db.AddUser(user)
+	require.NoError(t, err)
+
+	require.NoError(t, db.setDeviceName(user, "device1", "phone"))
+	require.NoError(t, db.setDeviceName(user, "device2", "tablet"))
+	require.NoError(t, db.setDeviceName(user, "device2", "laptop"))
+
+	names, err := db.deviceNames(user)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"device1": "phone", "device2": "laptop"}, names)
+
+	require.NoError(t, db.removeDeviceName(user, "device1"))
+	names, err = db.deviceNames(user)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"device2": "laptop"}, names)
+}
+
 func TestPostgresDBPinReservation(t *testing.T) {
 	SetupDatabase(t)
 	defer TeardownDatabase(t)
 
-	backoffStart = 2
+	policy := PinPolicy{MaxTries: DefaultMaxPinTries, BackoffStart: 2}
 
 	db, err := newPostgresDB(test.PostgresTestUrl, 2, 0, 0, 0)
 	require.NoError(t, err)
@@ -72,26 +135,26 @@ func TestPostgresDBPinReservation(t *testing.T) {
 	// invoking db.resetPinTries(user). So below we may think of reservePinTry invocations as
 	// wrong pin attempts.
 
-	ok, tries, wait, err := db.reservePinTry(user)
+	ok, tries, wait, err := db.reservePinTry(user, policy)
 	require.NoError(t, err)
 	assert.True(t, ok)
-	assert.Equal(t, maxPinTries-1, tries)
+	assert.Equal(t, policy.MaxTries-1, tries)
 	assert.Equal(t, int64(0), wait)
 
 	// Try until we have no tries left
 	for tries != 0 {
-		ok, tries, wait, err = db.reservePinTry(user)
+		ok, tries, wait, err = db.reservePinTry(user, policy)
 		require.NoError(t, err)
 		assert.True(t, ok)
 	}
 
-	assert.Equal(t, backoffStart, wait) // next attempt after first timeout
+	assert.Equal(t, policy.BackoffStart, wait) // next attempt after first timeout
 
 	// We have used all tries; we are now blocked. Wait till just before block end
 	time.Sleep(time.Duration(wait-1) * time.Second)
 
 	// Try again, not yet allowed
-	ok, tries, wait, err = db.reservePinTry(user)
+	ok, tries, wait, err = db.reservePinTry(user, policy)
 	assert.NoError(t, err)
 	assert.False(t, ok)
 	assert.Equal(t, 0, tries)
@@ -101,33 +164,33 @@ func TestPostgresDBPinReservation(t *testing.T) {
 	time.Sleep(2 * time.Second)
 
 	// Trying is now allowed
-	ok, tries, wait, err = db.reservePinTry(user)
+	ok, tries, wait, err = db.reservePinTry(user, policy)
 	assert.NoError(t, err)
 	assert.True(t, ok)
 	assert.Equal(t, 0, tries)
-	assert.Equal(t, 2*backoffStart, wait) // next attempt after doubled timeout
+	assert.Equal(t, 2*policy.BackoffStart, wait) // next attempt after doubled timeout
 
 	// Since we just used another attempt we are now blocked again
-	ok, tries, wait, err = db.reservePinTry(user)
+	ok, tries, wait, err = db.reservePinTry(user, policy)
 	assert.NoError(t, err)
 	assert.False(t, ok)
 	assert.Equal(t, 0, tries)
-	assert.Equal(t, 2*backoffStart, wait)
+	assert.Equal(t, 2*policy.BackoffStart, wait)
 
 	// Wait to be unblocked again
 	time.Sleep(time.Duration(wait+1) * time.Second)
 
 	// Try a final time
-	ok, tries, wait, err = db.reservePinTry(user)
+	ok, tries, wait, err = db.reservePinTry(user, policy)
 	assert.NoError(t, err)
 	assert.True(t, ok)
 	assert.Equal(t, 0, tries)
-	assert.Equal(t, 4*backoffStart, wait) // next attempt after again a doubled timeout
+	assert.Equal(t, 4*policy.BackoffStart, wait) // next attempt after again a doubled timeout
 
 	err = db.resetPinTries(user)
 	assert.NoError(t, err)
 
-	ok, tries, wait, err = db.reservePinTry(user)
+	ok, tries, wait, err = db.reservePinTry(user, policy)
 	assert.NoError(t, err)
 	assert.True(t, ok)
 	assert.True(t, tries > 0)
@@ -42,16 +42,27 @@ type Server struct {
 
 	// Session data, keeping track of current keyshare protocol session state for each user
 	store sessionStore
+
+	metrics *keyshareMetrics
 }
 
 var errMissingCommitment = errors.New("missing previous call to getCommitments")
 
+const (
+	// Headers in which the client reports the requestor and type of the session, for the user's log
+	sessionRequestorHeader = "X-IRMA-Keyshare-Requestor"
+	sessionTypeHeader      = "X-IRMA-Keyshare-Session-Type"
+
+	maxRequestorLength = 255
+)
+
 func New(conf *Configuration) (*Server, error) {
 	var err error
 	s := &Server{
 		conf:      conf,
 		store:     newMemorySessionStore(10 * time.Second),
 		scheduler: gocron.NewScheduler(time.UTC),
+		metrics:   newKeyshareMetrics(),
 	}
 
 	// Setup IRMA session server
@@ -102,6 +113,7 @@ func New(conf *Configuration) (*Server, error) {
 func (s *Server) Stop() {
 	s.scheduler.Stop()
 	s.irmaserv.Stop()
+	s.core.Stop()
 }
 
 func (s *Server) Handler() http.Handler {
@@ -116,6 +128,7 @@ func (s *Server) Handler() http.Handler {
 
 		opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: true}
 		router.Use(server.LogMiddleware("keyshareserver", opts))
+		router.Use(s.metricsMiddleware)
 
 		s.routeHandler(router)
 
@@ -124,6 +137,13 @@ func (s *Server) Handler() http.Handler {
 		})
 	})
 
+	if s.conf.EnableMetrics {
+		router.Group(func(r chi.Router) {
+			r.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
+			r.Get("/metrics", s.MetricsHandler().ServeHTTP)
+		})
+	}
+
 	// IRMA server for issuing myirma credential during registration
 	router.Mount("/irma/", s.irmaserv.HandlerFunc())
 	return router
@@ -146,12 +166,21 @@ func (s *Server) routeHandler(r chi.Router) http.Handler {
 	r.Post("/users/change/pin", s.handleChangePin)
 	r.Post("/users/register_publickey", s.handleRegisterPublicKey)
 
-	// Keyshare sessions
+	// Account recovery
+	r.Post("/users/recovery/start", s.handleRecoveryStart)
+	r.Post("/users/recovery/finish", s.handleRecoveryFinish)
+
+	// Device management
+	r.Post("/users/devices/add", s.handleAddDevice)
+
+	// Keyshare sessions and device management
 	r.Group(func(router chi.Router) {
 		router.Use(s.userMiddleware)
 		router.Use(s.authorizationMiddleware)
 		router.Post("/prove/getCommitments", s.handleCommitments)
 		router.Post("/prove/getResponse", s.handleResponse)
+		router.Get("/users/devices", s.handleDevices)
+		router.Post("/users/devices/revoke", s.handleRevokeDevice)
 	})
 
 	return r
@@ -160,7 +189,7 @@ func (s *Server) routeHandler(r chi.Router) http.Handler {
 // On configuration changes, update the keyshare core with all current public keys of the IRMA issuers.
 func (s *Server) loadIdemixKeys(conf *irma.Configuration) error {
 	errs := multierror.Error{}
-	for _, issuer := range conf.Issuers {
+	for _, issuer := range conf.GetIssuers() {
 		keyIDs, err := conf.PublicKeyIndices(issuer.Identifier())
 		if err != nil {
 			errs.Errors = append(errs.Errors, errors.Errorf("issuer %v: could not find key IDs: %v", issuer, err))
@@ -196,7 +225,7 @@ func (s *Server) handleCommitments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	commitments, err := s.generateCommitments(user, authorization, keys)
+	commitments, err := s.generateCommitments(user, authorization, keys, sessionLogParam(r))
 	if err != nil && (err == keysharecore.ErrInvalidChallenge || err == keysharecore.ErrInvalidJWT) {
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
@@ -210,13 +239,35 @@ func (s *Server) handleCommitments(w http.ResponseWriter, r *http.Request) {
 	server.WriteJson(w, commitments)
 }
 
-func (s *Server) generateCommitments(user *User, authorization string, keys []irma.PublicKeyIdentifier) (*irma.ProofPCommitmentMap, error) {
+// sessionLogParam returns the requestor and session type that the client reported in the
+// request headers, if any, for inclusion in the log entry of the session.
+func sessionLogParam(r *http.Request) *irmaSessionLogParam {
+	param := &irmaSessionLogParam{
+		Requestor:   r.Header.Get(sessionRequestorHeader),
+		SessionType: irma.Action(r.Header.Get(sessionTypeHeader)),
+	}
+	if len(param.Requestor) > maxRequestorLength {
+		param.Requestor = ""
+	}
+	switch param.SessionType {
+	case irma.ActionDisclosing, irma.ActionSigning, irma.ActionIssuing:
+	default:
+		param.SessionType = ""
+	}
+	if param.Requestor == "" && param.SessionType == "" {
+		return nil // older clients don't send these headers
+	}
+	return param
+}
+
+func (s *Server) generateCommitments(user *User, authorization string, keys []irma.PublicKeyIdentifier, logParam *irmaSessionLogParam) (*irma.ProofPCommitmentMap, error) {
 	// Generate commitments
 	commitments, commitID, err := s.core.GenerateCommitments(user.Secrets, authorization, keys)
 	if err != nil {
 		s.conf.Logger.WithField("error", err).Warn("Could not generate commitments for request")
 		return nil, err
 	}
+	s.metrics.commitmentsGenerated()
 
 	// Prepare output message format
 	mappedCommitments := map[irma.PublicKeyIdentifier]*gabi.ProofPCommitment{}
@@ -234,6 +285,7 @@ func (s *Server) generateCommitments(user *User, authorization string, keys []ir
 	s.store.add(user.Username, &session{
 		KeyID:    keys[len(keys)-1],
 		CommitID: commitID,
+		LogParam: logParam,
 	})
 
 	// And send response
@@ -294,7 +346,11 @@ func (s *Server) generateResponse(user *User, authorization string, challenge *b
 	}
 
 	// Make log entry
-	err = s.db.addLog(user, eventTypeIRMASession, nil)
+	var logParam interface{}
+	if sessionData.LogParam != nil {
+		logParam = sessionData.LogParam
+	}
+	err = s.db.addLog(user, eventTypeIRMASession, logParam)
 	if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
 		return "", err
@@ -414,6 +470,7 @@ func (s *Server) verifyAuth(user *User, msg irma.KeyshareAuthResponse) (irma.Key
 		return irma.KeysharePinStatus{}, err
 	}
 	if !ok {
+		s.metrics.pinChecked(pinCheckRefused)
 		return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
 	}
 
@@ -439,6 +496,7 @@ func (s *Server) verifyAuth(user *User, msg irma.KeyshareAuthResponse) (irma.Key
 			return irma.KeysharePinStatus{}, err
 		}
 		if tries == 0 {
+			s.metrics.pinChecked(pinCheckBlocked)
 			err = s.db.addLog(user, eventTypePinCheckBlocked, wait)
 			if err != nil {
 				s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
@@ -446,11 +504,13 @@ func (s *Server) verifyAuth(user *User, msg irma.KeyshareAuthResponse) (irma.Key
 			}
 			return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
 		} else {
+			s.metrics.pinChecked(pinCheckFailure)
 			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries)}, nil
 		}
 	}
 
 	// Handle success
+	s.metrics.pinChecked(pinCheckSuccess)
 	err = s.db.resetPinTries(user)
 	if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not reset users pin check logic")
@@ -620,6 +680,7 @@ func (s *Server) register(msg irma.KeyshareEnrollment) (*irma.Qr, error) {
 		s.conf.Logger.WithField("error", err).Error("Could not store new user in database")
 		return nil, err
 	}
+	s.metrics.registered()
 
 	// Send email if user specified email address
 	if data.Email != nil && *data.Email != "" && s.conf.EmailServer != "" {
@@ -670,6 +731,377 @@ func (s *Server) sendRegistrationEmail(user *User, language, email string) error
 	)
 }
 
+// /users/recovery/start
+func (s *Server) handleRecoveryStart(w http.ResponseWriter, r *http.Request) {
+	if s.conf.recoveryEmailTemplates == nil {
+		server.WriteError(w, server.ErrorInternal, "not enabled in configuration")
+		return
+	}
+
+	var msg irma.KeyshareRecoveryRequest
+	if err := server.ParseBody(r, &msg); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	err := s.sendRecoveryEmail(msg)
+	if err == keyshare.ErrInvalidEmail {
+		server.WriteError(w, server.ErrorInvalidEmail, "")
+		return
+	}
+	// In case of an unknown user or email address, or of too many requests, we should not write
+	// an error. Otherwise, we would leak information about our user base.
+	if err != nil && err != keyshare.ErrUserNotFound && err != errEmailNotFound && err != errTooManyTokens {
+		// already logged
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent) // No need for content.
+}
+
+func (s *Server) sendRecoveryEmail(msg irma.KeyshareRecoveryRequest) error {
+	user, err := s.db.user(msg.Username)
+	if err != nil {
+		if err != keyshare.ErrUserNotFound {
+			s.conf.Logger.WithField("error", err).Error("Could not fetch user for recovery")
+		}
+		return err
+	}
+
+	// Generate token and add it to the database, if the email address belongs to the user
+	token := common.NewSessionToken()
+	err = s.db.addRecoveryToken(user, msg.Email, token, s.conf.RecoveryTokenValidity)
+	if err != nil {
+		if err != errEmailNotFound && err != errTooManyTokens {
+			s.conf.Logger.WithField("error", err).Error("Could not generate recovery token record")
+		}
+		return err
+	}
+
+	language := msg.Language
+	if language == "" {
+		language = user.Language
+	}
+	return s.conf.SendEmail(
+		s.conf.recoveryEmailTemplates,
+		s.conf.RecoveryEmailSubjects,
+		map[string]string{"Token": token},
+		msg.Email,
+		language,
+	)
+}
+
+// /users/recovery/finish
+func (s *Server) handleRecoveryFinish(w http.ResponseWriter, r *http.Request) {
+	var msg irma.KeyshareRecovery
+	if err := server.ParseBody(r, &msg); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	data, pk, err := s.parseRecoveryMessage(msg)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	user, err := s.db.user(data.Username)
+	if err != nil {
+		s.conf.Logger.WithFields(logrus.Fields{"username": data.Username, "error": err}).Warn("Could not find user in db")
+		// Respond as for an unknown token, so as not to reveal whether the account exists
+		server.WriteError(w, server.ErrorInvalidToken, "Unknown recovery token")
+		return
+	}
+
+	result, err := s.recoverUser(user, data, pk)
+	if err == errTokenNotFound {
+		server.WriteError(w, server.ErrorInvalidToken, "Unknown recovery token")
+		return
+	}
+	if err == keysharecore.ErrPinTooLong {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		// already logged
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, result)
+}
+
+func (s *Server) parseRecoveryMessage(msg irma.KeyshareRecovery) (*irma.KeyshareRecoveryData, *ecdsa.PublicKey, error) {
+	var (
+		pk     *ecdsa.PublicKey
+		err    error
+		claims = &irma.KeyshareRecoveryClaims{}
+	)
+	// As during registration, the JWT contains in its body the public key with which it is signed.
+	_, err = jwt.ParseWithClaims(msg.RecoveryJWT, claims, func(token *jwt.Token) (interface{}, error) {
+		pk, err = signed.UnmarshalPublicKey(claims.PublicKey)
+		return pk, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &claims.KeyshareRecoveryData, pk, nil
+}
+
+func (s *Server) recoverUser(user *User, data *irma.KeyshareRecoveryData, pk *ecdsa.PublicKey) (irma.KeysharePinStatus, error) {
+	jwtt, secrets, err := s.core.ResetUserSecrets(user.Secrets, data.Pin, pk)
+	if err != nil {
+		if err != keysharecore.ErrPinTooLong {
+			s.conf.Logger.WithField("error", err).Error("Could not reset user secrets")
+		}
+		return irma.KeysharePinStatus{}, err
+	}
+
+	// Only consume the token once we know that the recovery will succeed
+	err = s.db.consumeRecoveryToken(user, data.Token)
+	if err != nil {
+		if err != errTokenNotFound {
+			s.conf.Logger.WithField("error", err).Error("Could not consume recovery token")
+		}
+		return irma.KeysharePinStatus{}, err
+	}
+
+	user.Secrets = secrets
+	err = s.db.updateUser(user)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not write updated user to database")
+		return irma.KeysharePinStatus{}, err
+	}
+
+	// The user may have been blocked because of having forgotten the pin
+	err = s.db.resetPinTries(user)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not reset users pin check logic")
+		// Do not send to user
+	}
+	err = s.db.setSeen(user)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not indicate user activity")
+		// Do not send to user
+	}
+	err = s.db.addLog(user, eventTypeRecovered, nil)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
+		return irma.KeysharePinStatus{}, err
+	}
+
+	return irma.KeysharePinStatus{Status: "success", Message: jwtt}, nil
+}
+
+// /users/devices/add
+func (s *Server) handleAddDevice(w http.ResponseWriter, r *http.Request) {
+	var msg irma.KeyshareDeviceAdd
+	if err := server.ParseBody(r, &msg); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	claims := &irma.KeyshareDeviceAddClaims{}
+	// We need the username inside the JWT here. The JWT is verified later within addDevice().
+	_, _, err := jwt.NewParser().ParseUnverified(msg.DeviceAddJWT, claims)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	user, err := s.db.user(claims.Username)
+	if err != nil {
+		s.conf.Logger.WithFields(logrus.Fields{"username": claims.Username, "error": err}).Warn("Could not find user in db")
+		server.WriteError(w, server.ErrorUserNotRegistered, "")
+		return
+	}
+
+	result, err := s.addDevice(user, msg.DeviceAddJWT, claims)
+	if err == keysharecore.ErrDeviceExists || err == keysharecore.ErrTooManyDevices ||
+		err == keysharecore.ErrInvalidJWT {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		// already logged
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, result)
+}
+
+func (s *Server) addDevice(user *User, jwtt string, claims *irma.KeyshareDeviceAddClaims) (irma.KeysharePinStatus, error) {
+	// Check whether pin check is currently allowed
+	ok, tries, wait, err := s.reservePinCheck(user)
+	if err != nil {
+		return irma.KeysharePinStatus{}, err
+	}
+	if !ok {
+		return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+	}
+
+	secrets, err := s.core.AddDevice(user.Secrets, jwtt)
+	if err == keysharecore.ErrInvalidPin {
+		if tries == 0 {
+			return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+		} else {
+			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries)}, nil
+		}
+	} else if err != nil {
+		s.conf.Logger.WithField("error", err).Warn("Could not add device")
+		return irma.KeysharePinStatus{}, err
+	}
+
+	// Mark pincheck as success, resetting users wait and count
+	err = s.db.resetPinTries(user)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not reset users pin check logic")
+		// Do not send to user
+	}
+
+	user.Secrets = secrets
+	err = s.db.updateUser(user)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not write updated user to database")
+		return irma.KeysharePinStatus{}, err
+	}
+
+	deviceID, err := deviceID(claims.PublicKey)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not compute device ID")
+		return irma.KeysharePinStatus{}, err
+	}
+	if claims.Name != "" {
+		err = s.db.setDeviceName(user, deviceID, claims.Name)
+		if err != nil {
+			s.conf.Logger.WithField("error", err).Error("Could not store device name")
+			// Do not send to user
+		}
+	}
+	err = s.db.addLog(user, eventTypeDeviceAdded, deviceID)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
+		return irma.KeysharePinStatus{}, err
+	}
+
+	return irma.KeysharePinStatus{Status: "success"}, nil
+}
+
+// deviceID computes the ID of the device with the given public key in the same way as the
+// keyshare core does, i.e. over the canonical encoding of the key.
+func deviceID(pkBts []byte) (string, error) {
+	pk, err := signed.UnmarshalPublicKey(pkBts)
+	if err != nil {
+		return "", err
+	}
+	pkBts, err = signed.MarshalPublicKey(pk)
+	if err != nil {
+		return "", err
+	}
+	return irma.KeyshareDeviceID(pkBts), nil
+}
+
+// GET /users/devices
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	// Fetch from context
+	user := r.Context().Value("user").(*User)
+	authorization := r.Context().Value("authorization").(string)
+
+	if !r.Context().Value("hasValidAuthorization").(bool) {
+		s.conf.Logger.Warn("Could not list devices due to invalid authorization")
+		server.WriteError(w, server.ErrorInvalidRequest, "Invalid authorization")
+		return
+	}
+
+	devices, err := s.devices(user, authorization)
+	if err != nil {
+		// already logged
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, devices)
+}
+
+func (s *Server) devices(user *User, authorization string) ([]irma.KeyshareDevice, error) {
+	ids, err := s.core.Devices(user.Secrets, authorization)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not list devices")
+		return nil, err
+	}
+	names, err := s.db.deviceNames(user)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not fetch device names")
+		return nil, err
+	}
+
+	devices := make([]irma.KeyshareDevice, 0, len(ids))
+	for _, id := range ids {
+		devices = append(devices, irma.KeyshareDevice{ID: id, Name: names[id]})
+	}
+	return devices, nil
+}
+
+// /users/devices/revoke
+func (s *Server) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	// Fetch from context
+	user := r.Context().Value("user").(*User)
+	authorization := r.Context().Value("authorization").(string)
+
+	var msg irma.KeyshareDevice
+	if err := server.ParseBody(r, &msg); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	if !r.Context().Value("hasValidAuthorization").(bool) {
+		s.conf.Logger.Warn("Could not revoke device due to invalid authorization")
+		server.WriteError(w, server.ErrorInvalidRequest, "Invalid authorization")
+		return
+	}
+
+	result, err := s.revokeDevice(user, authorization, msg.ID)
+	if err == keysharecore.ErrUnknownDevice || err == keysharecore.ErrLastDevice {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		// already logged
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, result)
+}
+
+func (s *Server) revokeDevice(user *User, authorization, deviceID string) (irma.KeysharePinStatus, error) {
+	jwtt, secrets, err := s.core.RevokeDevice(user.Secrets, authorization, deviceID)
+	if err != nil {
+		if err != keysharecore.ErrUnknownDevice && err != keysharecore.ErrLastDevice {
+			s.conf.Logger.WithField("error", err).Error("Could not revoke device")
+		}
+		return irma.KeysharePinStatus{}, err
+	}
+
+	user.Secrets = secrets
+	err = s.db.updateUser(user)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not write updated user to database")
+		return irma.KeysharePinStatus{}, err
+	}
+
+	err = s.db.removeDeviceName(user, deviceID)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not remove device name")
+		// Do not send to user
+	}
+	err = s.db.addLog(user, eventTypeDeviceRevoked, deviceID)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
+		return irma.KeysharePinStatus{}, err
+	}
+
+	return irma.KeysharePinStatus{Status: "success", Message: jwtt}, nil
+}
+
 func (s *Server) userMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Extract username from request
@@ -710,7 +1142,7 @@ func (s *Server) authorizationMiddleware(next http.Handler) http.Handler {
 }
 
 func (s *Server) reservePinCheck(user *User) (bool, int, int64, error) {
-	ok, tries, wait, err := s.db.reservePinTry(user)
+	ok, tries, wait, err := s.db.reservePinTry(user, s.conf.PinPolicy)
 	if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not reserve pin check slot")
 		return false, 0, 0, err
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
 )
 
 func TestServerRegistrationWithEmail(t *testing.T) {
@@ -40,3 +41,27 @@ func TestServerRegistrationWithEmail(t *testing.T) {
 		200, nil,
 	)
 }
+
+func TestServerRecoveryStart(t *testing.T) {
+	db := createDB(t)
+	db.(*memoryDB).emails["testusername"] = []string{"test@example.com"}
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "localhost:1025")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/recovery/start",
+		`{"id":"testusername","email":"test@example.com","language":"en"}`, nil,
+		204, nil,
+	)
+	require.Len(t, db.(*memoryDB).recoveryTokens, 1)
+
+	// Unknown users and email addresses are not distinguishable from known ones
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/recovery/start",
+		`{"id":"testusername","email":"other@example.com","language":"en"}`, nil,
+		204, nil,
+	)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/recovery/start",
+		`{"id":"doesnotexist","email":"test@example.com","language":"en"}`, nil,
+		204, nil,
+	)
+	require.Len(t, db.(*memoryDB).recoveryTokens, 1)
+}
@@ -129,6 +129,10 @@ func TestServerHandleRegister(t *testing.T) {
 	msg, err := json.Marshal(irma.KeyshareEnrollment{EnrollmentJWT: j})
 	require.NoError(t, err)
 	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/register", string(msg), nil, 500, nil)
+
+	keyshareServer.metrics.Lock()
+	require.Equal(t, uint64(4), keyshareServer.metrics.registrations)
+	keyshareServer.metrics.Unlock()
 }
 
 func TestPinTries(t *testing.T) {
@@ -354,6 +358,202 @@ func TestPinNoRemainingTries(t *testing.T) {
 	}
 }
 
+func recoveryJWT(t *testing.T, sk *ecdsa.PrivateKey, data irma.KeyshareRecoveryData) string {
+	pk, err := signed.MarshalPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+	data.PublicKey = pk
+	j, err := jwt.NewWithClaims(jwt.SigningMethodES256, irma.KeyshareRecoveryClaims{
+		KeyshareRecoveryData: data,
+	}).SignedString(sk)
+	require.NoError(t, err)
+	return marshalJSON(t, irma.KeyshareRecovery{RecoveryJWT: j})
+}
+
+func TestRecovery(t *testing.T) {
+	db := createDB(t)
+	db.(*memoryDB).emails["testusername"] = []string{"test@example.com"}
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	// Without an email server, no recovery emails can be sent
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/recovery/start",
+		`{"id":"testusername","email":"test@example.com"}`, nil,
+		500, nil,
+	)
+
+	user, err := db.user("testusername")
+	require.NoError(t, err)
+	require.ErrorIs(t, db.addRecoveryToken(user, "other@example.com", "token", 60), errEmailNotFound)
+	require.NoError(t, db.addRecoveryToken(user, "test@example.com", "token", 60))
+
+	sk, err := signed.GenerateKey()
+	require.NoError(t, err)
+	newpin := "puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SA=\n"
+
+	// wrong token, nonexisting user, and invalid jwt; the first two must be indistinguishable
+	remoteErr := &irma.RemoteError{}
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/recovery/finish",
+		recoveryJWT(t, sk, irma.KeyshareRecoveryData{Username: "testusername", Token: "wrongtoken", Pin: newpin}), nil,
+		403, remoteErr,
+	)
+	require.Equal(t, string(server.ErrorInvalidToken.Type), remoteErr.ErrorName)
+	unknownUserErr := &irma.RemoteError{}
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/recovery/finish",
+		recoveryJWT(t, sk, irma.KeyshareRecoveryData{Username: "doesnotexist", Token: "token", Pin: newpin}), nil,
+		403, unknownUserErr,
+	)
+	require.Equal(t, remoteErr.ErrorName, unknownUserErr.ErrorName)
+	require.Equal(t, remoteErr.Message, unknownUserErr.Message)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/recovery/finish",
+		`{"recovery_jwt":"ey.invalid"}`, nil,
+		400, nil,
+	)
+
+	// normal flow
+	res := &irma.KeysharePinStatus{}
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/recovery/finish",
+		recoveryJWT(t, sk, irma.KeyshareRecoveryData{Username: "testusername", Token: "token", Pin: newpin}), nil,
+		200, res,
+	)
+	require.Equal(t, "success", res.Status)
+	require.NotEmpty(t, res.Message)
+
+	// the token can be used only once
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/recovery/finish",
+		recoveryJWT(t, sk, irma.KeyshareRecoveryData{Username: "testusername", Token: "token", Pin: newpin}), nil,
+		403, nil,
+	)
+
+	// challenge-response works with the new key and pin
+	jwtt := doChallengeResponse(t, sk, "testusername", newpin)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/verify/pin_challengeresponse",
+		marshalJSON(t, irma.KeyshareAuthResponse{AuthResponseJWT: jwtt}), nil,
+		200, res,
+	)
+	require.Equal(t, "success", res.Status)
+
+	// but not with the old key
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/verify_start",
+		authJWT(t, loadClientPrivateKey(t), "testusername"), nil,
+		500, nil,
+	)
+}
+
+func deviceAddJWT(t *testing.T, signer *ecdsa.PrivateKey, newDevice *ecdsa.PublicKey, pin, name string) string {
+	pk, err := signed.MarshalPublicKey(newDevice)
+	require.NoError(t, err)
+	j, err := jwt.NewWithClaims(jwt.SigningMethodES256, irma.KeyshareDeviceAddClaims{
+		KeyshareDeviceAddData: irma.KeyshareDeviceAddData{
+			Username:  "testusername",
+			Pin:       pin,
+			PublicKey: pk,
+			Name:      name,
+		},
+	}).SignedString(signer)
+	require.NoError(t, err)
+	return marshalJSON(t, irma.KeyshareDeviceAdd{DeviceAddJWT: j})
+}
+
+func TestDevices(t *testing.T) {
+	db := createDB(t)
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	sk := loadClientPrivateKey(t)
+	pin := "puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"
+	newsk, err := signed.GenerateKey()
+	require.NoError(t, err)
+
+	// wrong pin, and signed by an unregistered device
+	res := &irma.KeysharePinStatus{}
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/devices/add",
+		deviceAddJWT(t, sk, &newsk.PublicKey, "wrongpin", "phone"), nil,
+		200, res,
+	)
+	require.Equal(t, "failure", res.Status)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/devices/add",
+		deviceAddJWT(t, newsk, &newsk.PublicKey, pin, "phone"), nil,
+		400, nil,
+	)
+
+	// normal flow
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/devices/add",
+		deviceAddJWT(t, sk, &newsk.PublicKey, pin, "phone"), nil,
+		200, res,
+	)
+	require.Equal(t, "success", res.Status)
+
+	// a device cannot be added twice
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/devices/add",
+		deviceAddJWT(t, sk, &newsk.PublicKey, pin, "phone"), nil,
+		400, nil,
+	)
+
+	// both devices can now authenticate
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/verify/pin_challengeresponse",
+		marshalJSON(t, irma.KeyshareAuthResponse{AuthResponseJWT: doChallengeResponse(t, sk, "testusername", pin)}), nil,
+		200, res,
+	)
+	require.Equal(t, "success", res.Status)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/verify/pin_challengeresponse",
+		marshalJSON(t, irma.KeyshareAuthResponse{AuthResponseJWT: doChallengeResponse(t, newsk, "testusername", pin)}), nil,
+		200, res,
+	)
+	require.Equal(t, "success", res.Status)
+	headers := http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{res.Message},
+	}
+
+	// list devices
+	var devices []irma.KeyshareDevice
+	test.HTTPGet(t, nil, "http://localhost:8080/api/v1/users/devices", headers, 200, &devices)
+	require.Len(t, devices, 2)
+	pk, err := signed.MarshalPublicKey(&newsk.PublicKey)
+	require.NoError(t, err)
+	newID := irma.KeyshareDeviceID(pk)
+	pk, err = signed.MarshalPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+	oldID := irma.KeyshareDeviceID(pk)
+	require.Contains(t, devices, irma.KeyshareDevice{ID: newID, Name: "phone"})
+	require.Contains(t, devices, irma.KeyshareDevice{ID: oldID})
+
+	test.HTTPGet(t, nil, "http://localhost:8080/api/v1/users/devices", http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{"ey.ey.ey"},
+	}, 400, nil)
+
+	// revoke devices
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/devices/revoke",
+		marshalJSON(t, irma.KeyshareDevice{ID: "unknown"}), headers,
+		400, nil,
+	)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/devices/revoke",
+		marshalJSON(t, irma.KeyshareDevice{ID: oldID}), headers,
+		200, res,
+	)
+	require.Equal(t, "success", res.Status)
+	require.NotEmpty(t, res.Message)
+
+	// the old authorization is invalidated
+	test.HTTPGet(t, nil, "http://localhost:8080/api/v1/users/devices", headers, 400, nil)
+	headers.Set("Authorization", res.Message)
+	test.HTTPGet(t, nil, "http://localhost:8080/api/v1/users/devices", headers, 200, &devices)
+	require.Equal(t, []irma.KeyshareDevice{{ID: newID, Name: "phone"}}, devices)
+
+	// the revoked device can no longer authenticate
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/verify_start",
+		authJWT(t, sk, "testusername"), nil,
+		500, nil,
+	)
+
+	// the last device cannot be revoked
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/devices/revoke",
+		marshalJSON(t, irma.KeyshareDevice{ID: newID}), headers,
+		400, nil,
+	)
+}
+
 func TestMissingUser(t *testing.T) {
 	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
 	defer StopKeyshareServer(t, keyshareServer, httpServer)
@@ -447,14 +647,22 @@ func TestKeyshareSessions(t *testing.T) {
 			400, nil,
 		)
 
+		require.Nil(t, keyshareServer.store.get(user.username).LogParam)
+
 		// can start session while another is already active
 		test.HTTPPost(t, nil, "http://localhost:8080/api/v1/prove/getCommitments",
 			`["test.test-3"]`, http.Header{
-				"X-IRMA-Keyshare-Username": []string{user.username},
-				"Authorization":            []string{user.auth},
+				"X-IRMA-Keyshare-Username":     []string{user.username},
+				"Authorization":                []string{user.auth},
+				"X-IRMA-Keyshare-Requestor":    []string{"localhost"},
+				"X-IRMA-Keyshare-Session-Type": []string{"disclosing"},
 			},
 			200, nil,
 		)
+		require.Equal(t,
+			&irmaSessionLogParam{Requestor: "localhost", SessionType: irma.ActionDisclosing},
+			keyshareServer.store.get(user.username).LogParam,
+		)
 
 		// finish session
 		test.HTTPPost(t, nil, "http://localhost:8080/api/v1/prove/getResponse",
@@ -465,6 +673,11 @@ func TestKeyshareSessions(t *testing.T) {
 			200, nil,
 		)
 	}
+
+	// Only successfully generated commitments are counted
+	keyshareServer.metrics.Lock()
+	require.Equal(t, uint64(4), keyshareServer.metrics.commitments)
+	keyshareServer.metrics.Unlock()
 }
 
 func StartKeyshareServer(t *testing.T, db DB, emailserver string) (*Server, *http.Server) {
@@ -495,6 +708,12 @@ func StartKeyshareServer(t *testing.T, db DB, emailserver string) (*Server, *htt
 		VerificationURL: map[string]string{
 			"en": "http://example.com/verify/",
 		},
+		RecoveryEmailFiles: map[string]string{
+			"en": filepath.Join(testdataPath, "emailtemplate.html"),
+		},
+		RecoveryEmailSubjects: map[string]string{
+			"en": "testsubject",
+		},
 	})
 	require.NoError(t, err)
 
@@ -541,7 +760,7 @@ func (db *testDB) updateUser(user *User) error {
 	return db.db.updateUser(user)
 }
 
-func (db *testDB) reservePinTry(_ *User) (bool, int, int64, error) {
+func (db *testDB) reservePinTry(_ *User, _ PinPolicy) (bool, int, int64, error) {
 	return db.ok, db.tries, db.wait, db.err
 }
 
@@ -561,6 +780,26 @@ func (db *testDB) addEmailVerification(user *User, email, token string, validity
 	return db.db.addEmailVerification(user, email, token, validity)
 }
 
+func (db *testDB) addRecoveryToken(user *User, email, token string, validity int) error {
+	return db.db.addRecoveryToken(user, email, token, validity)
+}
+
+func (db *testDB) consumeRecoveryToken(user *User, token string) error {
+	return db.db.consumeRecoveryToken(user, token)
+}
+
+func (db *testDB) setDeviceName(user *User, deviceID, name string) error {
+	return db.db.setDeviceName(user, deviceID, name)
+}
+
+func (db *testDB) deviceNames(user *User) (map[string]string, error) {
+	return db.db.deviceNames(user)
+}
+
+func (db *testDB) removeDeviceName(user *User, deviceID string) error {
+	return db.db.removeDeviceName(user, deviceID)
+}
+
 func createDB(t *testing.T) DB {
 	db := NewMemoryDB()
 	err := db.AddUser(&User{
@@ -10,6 +10,8 @@ import (
 type session struct {
 	KeyID    irma.PublicKeyIdentifier // last used key, used in signing the issuance message
 	CommitID uint64
+	// Requestor and session type as reported by the client, recorded in the user's log
+	LogParam *irmaSessionLogParam
 	expiry   time.Time
 }
 
@@ -83,12 +83,12 @@ func processConfiguration(conf *Configuration) error {
 	}
 	var multierr multierror.Error
 	for _, attr := range conf.KeyshareAttributes {
-		if conf.IrmaConfiguration.AttributeTypes[attr] == nil {
+		if conf.IrmaConfiguration.GetAttributeTypes()[attr] == nil {
 			multierr.Errors = append(multierr.Errors, errors.Errorf("Unknown keyshare attribute: %s", attr))
 		}
 	}
 	for _, attr := range conf.EmailAttributes {
-		if conf.IrmaConfiguration.AttributeTypes[attr] == nil {
+		if conf.IrmaConfiguration.GetAttributeTypes()[attr] == nil {
 			multierr.Errors = append(multierr.Errors, errors.Errorf("Unknown email attribute: %s", attr))
 		}
 	}
@@ -2,6 +2,7 @@ package myirmaserver
 
 import (
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"net/http"
 	"net/mail"
@@ -110,6 +111,7 @@ func (s *Server) Handler() http.Handler {
 			// User account data
 			router.Get("/user", s.handleUserInfo)
 			router.Get("/user/logs/{offset}", s.handleGetLogs)
+			router.Get("/user/logs/export", s.handleExportLogs)
 			router.Post("/user/delete", s.handleDeleteUser)
 
 			// Email address management
@@ -504,6 +506,60 @@ func (s *Server) handleGetLogs(w http.ResponseWriter, r *http.Request) {
 	server.WriteJson(w, entries)
 }
 
+// Number of log entries fetched at a time from the database when exporting them
+const exportLogsBatchSize = 100
+
+func (s *Server) handleExportLogs(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		s.conf.Logger.Info("Malformed request: unsupported log export format")
+		server.WriteError(w, server.ErrorInvalidRequest, "unsupported format")
+		return
+	}
+
+	session := r.Context().Value("session").(*session)
+	entries := []logEntry{} // Ensure we never send an nil as empty list
+	for offset := 0; ; offset += exportLogsBatchSize {
+		batch, err := s.db.logs(*session.userID, offset, exportLogsBatchSize)
+		if err != nil {
+			s.conf.Logger.WithField("error", err).Error("Could not load log entries")
+			server.WriteError(w, server.ErrorInternal, err.Error())
+			return
+		}
+		entries = append(entries, batch...)
+		if len(batch) < exportLogsBatchSize {
+			break
+		}
+	}
+
+	session.expiry = time.Now().Add(time.Duration(s.conf.SessionLifetime) * time.Second)
+	s.setCookie(w, session.token, s.conf.SessionLifetime)
+
+	w.Header().Set("Content-Disposition", "attachment; filename=irma-log."+format)
+	if format == "json" {
+		server.WriteJson(w, entries)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"timestamp", "event", "param"})
+	for _, entry := range entries {
+		param := ""
+		if entry.Param != nil {
+			param = *entry.Param
+		}
+		_ = cw.Write([]string{strconv.FormatInt(entry.Timestamp, 10), entry.Event, param})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not write log entries")
+	}
+}
+
 func (s *Server) processRemoveEmail(session *session, email string) error {
 	user, err := s.db.user(*session.userID)
 	if err != nil {
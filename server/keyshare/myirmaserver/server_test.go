@@ -34,6 +34,8 @@ func TestServerInvalidMessage(t *testing.T) {
 
 	test.HTTPGet(t, nil, "http://localhost:8081/user/logs/0", nil, 400, nil)
 
+	test.HTTPGet(t, nil, "http://localhost:8081/user/logs/export", nil, 400, nil)
+
 	test.HTTPPost(t, nil, "http://localhost:8081/user/delete", "", nil, 400, nil)
 
 	test.HTTPPost(t, nil, "http://localhost:8081/email/add", "", nil, 400, nil)
@@ -207,6 +209,18 @@ func TestServerUserData(t *testing.T) {
 	assert.Equal(t, []logEntry{
 		{Timestamp: 120, Event: "test2", Param: &str15},
 	}, logs)
+
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs/export?format=xml", nil, 400, nil)
+
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs/export", nil, 200, &logs)
+	assert.Equal(t, []logEntry{
+		{Timestamp: 110, Event: "test", Param: &strEmpty},
+		{Timestamp: 120, Event: "test2", Param: &str15},
+	}, logs)
+
+	var csv []byte
+	test.HTTPGet(t, client, "http://localhost:8081/user/logs/export?format=csv", nil, 200, &csv)
+	assert.Equal(t, "timestamp,event,param\n110,test,\n120,test2,15\n", string(csv))
 }
 
 func StartMyIrmaServer(t *testing.T, db db, emailserver string) (*Server, *http.Server) {
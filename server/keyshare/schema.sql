@@ -33,6 +33,24 @@ CREATE TABLE IF NOT EXISTS irma.email_verification_tokens
 );
 CREATE UNIQUE INDEX email_verification_token_index ON irma.email_verification_tokens (token);
 
+CREATE TABLE IF NOT EXISTS irma.recovery_tokens
+(
+    id serial PRIMARY KEY,
+    token text NOT NULL,
+    expiry bigint NOT NULL,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX recovery_token_index ON irma.recovery_tokens (token);
+
+CREATE TABLE IF NOT EXISTS irma.devices
+(
+    id serial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE,
+    device_id text NOT NULL,
+    name text NOT NULL
+);
+CREATE UNIQUE INDEX devices_user_device_index ON irma.devices (user_id, device_id);
+
 CREATE TABLE IF NOT EXISTS irma.email_login_tokens
 (
     id serial PRIMARY KEY,
@@ -3,6 +3,8 @@ package tasks
 import (
 	"html/template"
 
+	"github.com/go-errors/errors"
+
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/keyshare"
@@ -17,6 +19,15 @@ type Configuration struct {
 	ExpiryDelay int `json:"expiry_delay" mapstructure:"expiry_delay"`
 	DeleteDelay int `json:"delete_delay" mapstructure:"delete_delay"`
 
+	// Number of days after which log entries of users are deleted (0 to keep them indefinitely)
+	LogRetention int `json:"log_retention" mapstructure:"log_retention"`
+
+	// Cron expression (e.g. "0 3 * * *") according to which Run performs the tasks periodically
+	Schedule string `json:"schedule" mapstructure:"schedule"`
+	// Cron expressions of specific tasks by task name (see TaskNames), overriding Schedule.
+	// When running periodically, tasks without a schedule are not performed.
+	TaskSchedules map[string]string `json:"task_schedules" mapstructure:"task_schedules"`
+
 	// Email sending configuration
 	keyshare.EmailConfiguration `mapstructure:",squash"`
 
@@ -61,5 +72,14 @@ func processConfiguration(conf *Configuration) error {
 		return server.LogError(err)
 	}
 
+	if conf.LogRetention < 0 {
+		return server.LogError(errors.Errorf("log_retention must not be negative (was %d)", conf.LogRetention))
+	}
+	for name := range conf.TaskSchedules {
+		if !validTaskName(name) {
+			return server.LogError(errors.Errorf("task_schedules: unknown task %s", name))
+		}
+	}
+
 	return nil
 }
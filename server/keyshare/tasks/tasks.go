@@ -5,8 +5,10 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/go-co-op/gocron"
 	"github.com/go-errors/errors"
 	_ "github.com/jackc/pgx/stdlib"
+	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/server/keyshare"
 )
 
@@ -32,20 +34,90 @@ func newHandler(conf *Configuration) (*taskHandler, error) {
 	return task, nil
 }
 
+// TaskNames contains the names of the tasks, in the order in which Do performs them.
+var TaskNames = []string{"cleanup_emails", "cleanup_tokens", "cleanup_accounts", "expire_accounts", "cleanup_logs"}
+
+func validTaskName(name string) bool {
+	for _, n := range TaskNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *taskHandler) tasks() map[string]func() {
+	return map[string]func(){
+		"cleanup_emails":   t.cleanupEmails,
+		"cleanup_tokens":   t.cleanupTokens,
+		"cleanup_accounts": t.cleanupAccounts,
+		"expire_accounts":  t.expireAccounts,
+		"cleanup_logs":     t.cleanupLogs,
+	}
+}
+
+// Do performs all tasks once.
 func Do(conf *Configuration) error {
 	task, err := newHandler(conf)
 	if err != nil {
 		return err
 	}
+	defer common.Close(task.db)
 
-	task.cleanupEmails()
-	task.cleanupTokens()
-	task.cleanupAccounts()
-	task.expireAccounts()
+	tasks := task.tasks()
+	for _, name := range TaskNames {
+		tasks[name]()
+	}
 
 	return nil
 }
 
+// Run performs the tasks periodically according to the schedules in the configuration,
+// until the stop channel is closed.
+func Run(conf *Configuration, stop <-chan struct{}) error {
+	task, err := newHandler(conf)
+	if err != nil {
+		return err
+	}
+	defer common.Close(task.db)
+
+	scheduler, err := task.scheduler()
+	if err != nil {
+		return err
+	}
+	scheduler.StartAsync()
+	<-stop
+	scheduler.Stop()
+
+	return nil
+}
+
+// scheduler returns a scheduler performing each task according to its schedule. A task is not
+// started while its previous run is still in progress.
+func (t *taskHandler) scheduler() (*gocron.Scheduler, error) {
+	scheduler := gocron.NewScheduler(time.UTC)
+	scheduler.SingletonModeAll()
+	tasks := t.tasks()
+	scheduled := 0
+	for _, name := range TaskNames {
+		schedule := t.conf.Schedule
+		if s, ok := t.conf.TaskSchedules[name]; ok {
+			schedule = s
+		}
+		if schedule == "" {
+			continue
+		}
+		if _, err := scheduler.Cron(schedule).Do(tasks[name]); err != nil {
+			return nil, errors.Errorf("invalid schedule %q of task %s: %v", schedule, name, err)
+		}
+		scheduled++
+	}
+	if scheduled == 0 {
+		return nil, errors.New("no tasks scheduled")
+	}
+	return scheduler, nil
+}
+
 // Remove email addresses marked for deletion long enough ago
 func (t *taskHandler) cleanupEmails() {
 	_, err := t.db.Exec("DELETE FROM irma.emails WHERE delete_on < $1", time.Now().Unix())
@@ -54,7 +126,7 @@ func (t *taskHandler) cleanupEmails() {
 	}
 }
 
-// Remove old login and email verification tokens
+// Remove old login, email verification and recovery tokens
 func (t *taskHandler) cleanupTokens() {
 	_, err := t.db.Exec("DELETE FROM irma.email_login_tokens WHERE expiry < $1", time.Now().Unix())
 	if err != nil {
@@ -64,6 +136,11 @@ func (t *taskHandler) cleanupTokens() {
 	_, err = t.db.Exec("DELETE FROM irma.email_verification_tokens WHERE expiry < $1", time.Now().Unix())
 	if err != nil {
 		t.conf.Logger.WithField("error", err).Error("Could not remove email verification tokens that have expired")
+		return
+	}
+	_, err = t.db.Exec("DELETE FROM irma.recovery_tokens WHERE expiry < $1", time.Now().Unix())
+	if err != nil {
+		t.conf.Logger.WithField("error", err).Error("Could not remove recovery tokens that have expired")
 	}
 }
 
@@ -106,6 +183,18 @@ func (t *taskHandler) sendExpiryEmails(id int64, username, lang string) error {
 	return nil
 }
 
+// Remove log entries older than the log retention period
+func (t *taskHandler) cleanupLogs() {
+	if t.conf.LogRetention == 0 {
+		return
+	}
+	_, err := t.db.Exec("DELETE FROM irma.log_entry_records WHERE time < $1",
+		time.Now().Add(time.Duration(-24*t.conf.LogRetention)*time.Hour).Unix())
+	if err != nil {
+		t.conf.Logger.WithField("error", err).Error("Could not remove log entries older than the retention period")
+	}
+}
+
 // Mark old unused accounts for deletion, and inform their owners.
 func (t *taskHandler) expireAccounts() {
 	// Disable this task when email server is not given
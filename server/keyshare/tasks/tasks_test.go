@@ -83,6 +83,8 @@ func TestCleanupTokens(t *testing.T) {
 	require.NoError(t, err)
 	_, err = db.Exec("INSERT INTO irma.email_login_tokens (token, email, expiry) VALUES ('t1', 't1@example.com', 0), ('t2', 't2@example.com', $1)", time.Now().Add(time.Hour).Unix())
 	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO irma.recovery_tokens (token, user_id, expiry) VALUES ('t1', 15, 0), ('t2', 15, $1)", time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
 
 	th, err := newHandler(&Configuration{DBConnStr: test.PostgresTestUrl, Logger: irma.Logger})
 	require.NoError(t, err)
@@ -91,6 +93,7 @@ func TestCleanupTokens(t *testing.T) {
 
 	assert.Equal(t, 1, countRows(t, db, "email_verification_tokens", ""))
 	assert.Equal(t, 1, countRows(t, db, "email_login_tokens", ""))
+	assert.Equal(t, 1, countRows(t, db, "recovery_tokens", ""))
 }
 
 func TestCleanupAccounts(t *testing.T) {
@@ -110,6 +113,59 @@ func TestCleanupAccounts(t *testing.T) {
 	assert.Equal(t, 2, countRows(t, db, "users", ""))
 }
 
+func TestCleanupLogs(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := sql.Open("pgx", test.PostgresTestUrl)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (15, 'testuser', 15, '', '', 0,0)")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO irma.log_entry_records (time, event, param, user_id) VALUES ($1, 'PIN_CHECK_SUCCESS', '', 15), ($2, 'PIN_CHECK_SUCCESS', '', 15)",
+		time.Now().Add(-48*time.Hour).Unix(),
+		time.Now().Unix())
+	require.NoError(t, err)
+
+	// Logs are kept indefinitely by default
+	th, err := newHandler(&Configuration{DBConnStr: test.PostgresTestUrl, Logger: irma.Logger})
+	require.NoError(t, err)
+	th.cleanupLogs()
+	assert.Equal(t, 2, countRows(t, db, "log_entry_records", ""))
+
+	th, err = newHandler(&Configuration{DBConnStr: test.PostgresTestUrl, LogRetention: 1, Logger: irma.Logger})
+	require.NoError(t, err)
+	th.cleanupLogs()
+	assert.Equal(t, 1, countRows(t, db, "log_entry_records", ""))
+}
+
+func TestSchedules(t *testing.T) {
+	th := &taskHandler{conf: &Configuration{Logger: irma.Logger}}
+	_, err := th.scheduler()
+	require.Error(t, err)
+
+	th.conf.Schedule = "0 3 * * *"
+	scheduler, err := th.scheduler()
+	require.NoError(t, err)
+	require.Len(t, scheduler.Jobs(), len(TaskNames))
+
+	// Schedules of specific tasks override the default schedule
+	th.conf.Schedule = ""
+	th.conf.TaskSchedules = map[string]string{"cleanup_logs": "@daily"}
+	scheduler, err = th.scheduler()
+	require.NoError(t, err)
+	require.Len(t, scheduler.Jobs(), 1)
+
+	th.conf.TaskSchedules = map[string]string{"cleanup_logs": "invalid"}
+	_, err = th.scheduler()
+	require.Error(t, err)
+
+	require.Error(t, processConfiguration(&Configuration{
+		TaskSchedules: map[string]string{"unknown": "@daily"},
+		Logger:        irma.Logger,
+	}))
+	require.Error(t, processConfiguration(&Configuration{LogRetention: -1, Logger: irma.Logger}))
+}
+
 func xTimesEntry(x int, template string) (result string) {
 	for i := 0; i < x; i++ {
 		nr := strconv.Itoa(i)
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// SessionNotification summarizes the outcome of a session, for the email address specified in
+// the notifyEmail option of the session request. Unless the NotifyAttributeValues option
+// is enabled, no attribute values are included.
+type SessionNotification struct {
+	Time        time.Time
+	Requestor   string
+	Token       irma.RequestorToken
+	Action      irma.Action
+	Status      irma.ServerStatus
+	ProofStatus irma.ProofStatus
+	Disclosed   [][]*irma.DisclosedAttribute
+	Err         *irma.RemoteError
+}
+
+// Notifier delivers session notifications to the specified email address. Notify is invoked
+// in a separate goroutine once the session has finished.
+type Notifier interface {
+	Notify(to string, notification *SessionNotification) error
+}
+
+// EmailNotifier is a Notifier that sends session notifications as plain text emails using SMTP.
+type EmailNotifier struct {
+	Server string // host:port of the SMTP server
+	From   string
+	Auth   smtp.Auth
+}
+
+func (n *EmailNotifier) Notify(to string, notification *SessionNotification) error {
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+	fromAddr, err := mail.ParseAddress(n.From)
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "To: %s\r\n", toAddr.Address)
+	fmt.Fprintf(&msg, "From: %s\r\n", fromAddr.Address)
+	fmt.Fprintf(&msg, "Subject: IRMA %s session %s\r\n", notification.Action, notification.Status)
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	notification.write(&msg)
+
+	return smtp.SendMail(n.Server, n.Auth, fromAddr.Address, []string{toAddr.Address}, msg.Bytes())
+}
+
+// write writes a human-readable summary of the notification to the buffer.
+func (notification *SessionNotification) write(msg *bytes.Buffer) {
+	fmt.Fprintf(msg, "Session:      %s\r\n", notification.Token)
+	if notification.Requestor != "" {
+		fmt.Fprintf(msg, "Requestor:    %s\r\n", notification.Requestor)
+	}
+	fmt.Fprintf(msg, "Type:         %s\r\n", notification.Action)
+	fmt.Fprintf(msg, "Status:       %s\r\n", notification.Status)
+	if notification.ProofStatus != "" {
+		fmt.Fprintf(msg, "Proof status: %s\r\n", notification.ProofStatus)
+	}
+	if notification.Err != nil {
+		fmt.Fprintf(msg, "Error:        %s\r\n", notification.Err.ErrorName)
+	}
+	fmt.Fprintf(msg, "Finished at:  %s\r\n", notification.Time.UTC().Format(time.RFC3339))
+	for _, con := range notification.Disclosed {
+		for _, attr := range con {
+			value := "(empty)"
+			if attr.RawValue != nil {
+				value = *attr.RawValue
+			}
+			fmt.Fprintf(msg, "Disclosed:    %s = %s\r\n", attr.Identifier, value)
+		}
+	}
+}
+
+// Notify sends a notification of the outcome of the session to the specified email address using
+// the configured Notifier, omitting attribute values unless NotifyAttributeValues is enabled.
+// The notification is sent asynchronously; failures are logged but otherwise ignored.
+func (conf *Configuration) Notify(to string, notification *SessionNotification) {
+	if conf.Notifier == nil || to == "" {
+		return
+	}
+	if notification.Time.IsZero() {
+		notification.Time = time.Now()
+	}
+	if !conf.NotifyAttributeValues {
+		notification.Disclosed = nil
+	}
+	go func() {
+		if err := conf.Notifier.Notify(to, notification); err != nil {
+			_ = LogError(errors.WrapPrefix(err, "failed to send session notification", 0))
+		}
+	}()
+}
+
+func (conf *Configuration) verifyNotifications() error {
+	if conf.NotificationEmailServer == "" || conf.Notifier != nil {
+		return nil
+	}
+	if _, err := mail.ParseAddress(conf.NotificationEmailFrom); err != nil {
+		return errors.WrapPrefix(err, "notification_email_server requires a valid notification_email_from", 0)
+	}
+	conf.Notifier = &EmailNotifier{
+		Server: conf.NotificationEmailServer,
+		From:   conf.NotificationEmailFrom,
+		Auth:   conf.NotificationEmailAuth,
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package requestorserver
+
+import (
+	"crypto/tls"
+	"os"
+
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func (conf *Configuration) acmeEnabled() bool {
+	return len(conf.AcmeHosts) > 0
+}
+
+// verifyAcme checks the ACME configuration and creates the autocert.Manager that obtains and
+// renews the TLS certificates of the server.
+func (conf *Configuration) verifyAcme() error {
+	if !conf.acmeEnabled() {
+		if conf.AcmeHTTPPort != 0 {
+			return errors.New("acme_http_port must be combined with acme_hosts")
+		}
+		return nil
+	}
+	if conf.TlsCertificate != "" || conf.TlsCertificateFile != "" || conf.TlsPrivateKey != "" || conf.TlsPrivateKeyFile != "" {
+		return errors.New("acme_hosts cannot be combined with a TLS certificate or private key")
+	}
+	if conf.AcmeCacheDir == "" {
+		return errors.New("acme_hosts requires acme_cache_dir, in which the obtained certificates are stored")
+	}
+	if conf.AcmeHTTPPort < 0 || conf.AcmeHTTPPort > 65535 {
+		return errors.Errorf("acme_http_port must be between 0 and 65535 (was %d)", conf.AcmeHTTPPort)
+	}
+	if conf.AcmeHTTPPort != 0 && (conf.AcmeHTTPPort == conf.Port || conf.AcmeHTTPPort == conf.ClientPort) {
+		return errors.New("acme_http_port must be different from port and client_port")
+	}
+	if err := os.MkdirAll(conf.AcmeCacheDir, 0700); err != nil {
+		return errors.WrapPrefix(err, "Failed to create acme_cache_dir", 0)
+	}
+
+	conf.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(conf.AcmeCacheDir),
+		HostPolicy: autocert.HostWhitelist(conf.AcmeHosts...),
+		Email:      conf.Email,
+	}
+	if conf.AcmeDirectoryURL != "" {
+		conf.acme.Client = &acme.Client{DirectoryURL: conf.AcmeDirectoryURL}
+	}
+	conf.Logger.WithField("hosts", conf.AcmeHosts).Info("Obtaining TLS certificates using ACME")
+	return nil
+}
+
+// acmeTlsConfig returns a TLS configuration using the certificates obtained using ACME, which also
+// answers TLS-ALPN-01 challenges.
+func (conf *Configuration) acmeTlsConfig() *tls.Config {
+	tlsConf := conf.acme.TLSConfig()
+	tlsConf.MinVersion = tls.VersionTLS12
+	return tlsConf
+}
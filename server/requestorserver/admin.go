@@ -0,0 +1,63 @@
+package requestorserver
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// attachAdminEndpoints adds the endpoints with which administrators can list the active sessions,
+// inspect their state and expire them.
+func (s *Server) attachAdminEndpoints(r chi.Router) {
+	r.Use(s.adminMiddleware)
+	r.Get("/sessions", s.handleAdminSessions)
+	r.Route("/session/{requestorToken}", func(r chi.Router) {
+		r.Use(s.tokenMiddleware)
+		r.Get("/", s.handleAdminInspect)
+		r.Post("/expire", s.handleAdminExpire)
+	})
+}
+
+// adminMiddleware only lets requests through whose Authorization header contains the admin token.
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := s.config().AdminToken
+		auth := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			server.WriteError(w, server.ErrorUnauthorized, "invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.irmaserv.ListSessions()
+	if err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, sessions)
+}
+
+func (s *Server) handleAdminInspect(w http.ResponseWriter, r *http.Request) {
+	requestorToken := r.Context().Value("requestorToken").(irma.RequestorToken)
+	state, err := s.irmaserv.InspectSession(requestorToken)
+	if err != nil {
+		mapToServerError(w, err)
+		return
+	}
+	server.WriteJson(w, state)
+}
+
+func (s *Server) handleAdminExpire(w http.ResponseWriter, r *http.Request) {
+	requestorToken := r.Context().Value("requestorToken").(irma.RequestorToken)
+	if err := s.irmaserv.ExpireSession(requestorToken); err != nil {
+		mapToServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
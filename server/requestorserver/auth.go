@@ -1,6 +1,12 @@
 package requestorserver
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"net/http"
 	"strings"
 	"time"
@@ -32,6 +38,12 @@ type Authenticator interface {
 	AuthenticateRevocation(
 		headers http.Header, body []byte,
 	) (applies bool, request *irma.RevocationRequest, requestor string, err *irma.RemoteError)
+
+	// AuthenticateResults is like AuthenticateSession, for requests for the results of the
+	// sessions of the requestor.
+	AuthenticateResults(
+		headers http.Header, body []byte,
+	) (applies bool, request *irma.ResultsRequest, requestor string, err *irma.RemoteError)
 }
 
 type AuthenticationMethod string
@@ -41,23 +53,42 @@ const (
 	AuthenticationMethodHmac      = "hmac"
 	AuthenticationMethodPublicKey = "publickey"
 	AuthenticationMethodToken     = "token"
+	AuthenticationMethodTLS       = "tls"
 	AuthenticationMethodNone      = "none"
 )
 
 type HmacAuthenticator struct {
-	hmackeys      map[string]interface{}
+	hmackeys      map[string][]*requestorKey
 	maxRequestAge int
 }
 type PublicKeyAuthenticator struct {
-	publickeys    map[string]interface{}
+	publickeys    map[string][]*requestorKey
 	maxRequestAge int
 }
 type PresharedKeyAuthenticator struct {
-	presharedkeys map[string]string
+	presharedkeys map[string]*requestorKey
 }
 type NilAuthenticator struct{}
 
-var authenticators map[AuthenticationMethod]Authenticator
+// ClientCertificateAuthenticator authenticates requestors by the TLS client certificate they
+// present, either by the SHA-256 fingerprint of the certificate or, if the certificate was
+// verified against the configured client CA, by its subject alternative names.
+// As the TLS connection state is not available in the HTTP headers, it is invoked using
+// AuthenticateSessionTLS and AuthenticateRevocationTLS instead of the Authenticator methods.
+type ClientCertificateAuthenticator struct {
+	fingerprints map[string]string
+	names        map[string]string
+	verifyNames  bool
+}
+
+// requestorKey is an authentication key of a requestor, which is only accepted between
+// notBefore and notAfter if those are set.
+type requestorKey struct {
+	requestor string
+	key       interface{}
+	notBefore time.Time
+	notAfter  time.Time
+}
 
 func (NilAuthenticator) AuthenticateSession(
 	headers http.Header, body []byte,
@@ -83,6 +114,12 @@ func (NilAuthenticator) AuthenticateRevocation(headers http.Header, body []byte)
 	return true, r, "", nil
 }
 
+// AuthenticateResults never applies: without requestor authentication anyone could retrieve
+// the results of all sessions.
+func (NilAuthenticator) AuthenticateResults(headers http.Header, body []byte) (bool, *irma.ResultsRequest, string, *irma.RemoteError) {
+	return false, nil, "", nil
+}
+
 func (NilAuthenticator) Initialize(name string, requestor Requestor) error {
 	return nil
 }
@@ -97,21 +134,25 @@ func (hauth *HmacAuthenticator) AuthenticateRevocation(headers http.Header, body
 	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
 }
 
-func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) error {
-	bts, err := common.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
-	}
+func (hauth *HmacAuthenticator) AuthenticateResults(headers http.Header, body []byte) (bool, *irma.ResultsRequest, string, *irma.RemoteError) {
+	return jwtAuthenticateResults(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
+}
 
-	// We accept any of the base64 encodings
-	bts, err = common.Base64Decode(bts)
+func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) error {
+	keys, err := requestor.keys(name, func(bts []byte) (interface{}, error) {
+		// We accept any of the base64 encodings
+		bts, err := common.Base64Decode(bts)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to base64 decode hmac key of requestor "+name, 0)
+		}
+		return bts, nil
+	})
 	if err != nil {
-		return errors.WrapPrefix(err, "Failed to base64 decode hmac key of requestor "+name, 0)
+		return err
 	}
 
-	hauth.hmackeys[name] = bts
+	hauth.hmackeys[name] = keys
 	return nil
-
 }
 
 func (pkauth *PublicKeyAuthenticator) AuthenticateSession(
@@ -124,17 +165,18 @@ func (pkauth *PublicKeyAuthenticator) AuthenticateRevocation(headers http.Header
 	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
 }
 
-func (pkauth *PublicKeyAuthenticator) Initialize(name string, requestor Requestor) error {
-	bts, err := common.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
-	}
+func (pkauth *PublicKeyAuthenticator) AuthenticateResults(headers http.Header, body []byte) (bool, *irma.ResultsRequest, string, *irma.RemoteError) {
+	return jwtAuthenticateResults(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
+}
 
-	pk, err := jwt.ParseRSAPublicKeyFromPEM(bts)
+func (pkauth *PublicKeyAuthenticator) Initialize(name string, requestor Requestor) error {
+	keys, err := requestor.keys(name, func(bts []byte) (interface{}, error) {
+		return jwt.ParseRSAPublicKeyFromPEM(bts)
+	})
 	if err != nil {
 		return err
 	}
-	pkauth.publickeys[name] = pk
+	pkauth.publickeys[name] = keys
 
 	return nil
 }
@@ -146,10 +188,14 @@ func (pskauth *PresharedKeyAuthenticator) AuthenticateSession(
 	if auth == "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
 		return false, nil, "", nil
 	}
-	requestor, ok := pskauth.presharedkeys[auth]
+	key, ok := pskauth.presharedkeys[auth]
 	if !ok {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "")
 	}
+	if rerr := key.checkValidity(time.Now()); rerr != nil {
+		return true, nil, "", rerr
+	}
+	requestor := key.requestor
 	request, err := server.ParseSessionRequest(body)
 	if err != nil {
 		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
@@ -162,10 +208,14 @@ func (pskauth *PresharedKeyAuthenticator) AuthenticateRevocation(headers http.He
 	if auth == "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
 		return false, nil, "", nil
 	}
-	requestor, ok := pskauth.presharedkeys[auth]
+	key, ok := pskauth.presharedkeys[auth]
 	if !ok {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "")
 	}
+	if rerr := key.checkValidity(time.Now()); rerr != nil {
+		return true, nil, "", rerr
+	}
+	requestor := key.requestor
 	r := &irma.RevocationRequest{}
 	if err := irma.UnmarshalValidate(body, r); err != nil {
 		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
@@ -173,40 +223,246 @@ func (pskauth *PresharedKeyAuthenticator) AuthenticateRevocation(headers http.He
 	return true, r, requestor, nil
 }
 
+func (pskauth *PresharedKeyAuthenticator) AuthenticateResults(headers http.Header, body []byte) (bool, *irma.ResultsRequest, string, *irma.RemoteError) {
+	auth := headers.Get("Authorization")
+	if auth == "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
+		return false, nil, "", nil
+	}
+	key, ok := pskauth.presharedkeys[auth]
+	if !ok {
+		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "")
+	}
+	if rerr := key.checkValidity(time.Now()); rerr != nil {
+		return true, nil, "", rerr
+	}
+	r := &irma.ResultsRequest{}
+	if err := irma.UnmarshalValidate(body, r); err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, r, key.requestor, nil
+}
+
 func (pskauth *PresharedKeyAuthenticator) Initialize(name string, requestor Requestor) error {
+	keys, err := requestor.keys(name, func(bts []byte) (interface{}, error) {
+		return string(bts), nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		pskauth.presharedkeys[key.key.(string)] = key
+	}
+	return nil
+}
+
+func (cauth *ClientCertificateAuthenticator) AuthenticateSession(
+	headers http.Header, body []byte,
+) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
+	return false, nil, "", nil
+}
+
+func (cauth *ClientCertificateAuthenticator) AuthenticateRevocation(headers http.Header, body []byte) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
+	return false, nil, "", nil
+}
+
+func (cauth *ClientCertificateAuthenticator) AuthenticateResults(headers http.Header, body []byte) (bool, *irma.ResultsRequest, string, *irma.RemoteError) {
+	return false, nil, "", nil
+}
+
+// AuthenticateSessionTLS is like AuthenticateSession, but additionally takes the state of the
+// TLS connection over which the session request was received.
+func (cauth *ClientCertificateAuthenticator) AuthenticateSessionTLS(
+	state *tls.ConnectionState, headers http.Header, body []byte,
+) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
+	requestor, ok := cauth.requestor(state, headers)
+	if !ok {
+		return false, nil, "", nil
+	}
+	request, err := server.ParseSessionRequest(body)
+	if err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, request, requestor, nil
+}
+
+// AuthenticateRevocationTLS is like AuthenticateRevocation, but additionally takes the state of the
+// TLS connection over which the revocation request was received.
+func (cauth *ClientCertificateAuthenticator) AuthenticateRevocationTLS(
+	state *tls.ConnectionState, headers http.Header, body []byte,
+) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
+	requestor, ok := cauth.requestor(state, headers)
+	if !ok {
+		return false, nil, "", nil
+	}
+	r := &irma.RevocationRequest{}
+	if err := irma.UnmarshalValidate(body, r); err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, r, requestor, nil
+}
+
+// AuthenticateResultsTLS is like AuthenticateResults, but additionally takes the state of the
+// TLS connection over which the results request was received.
+func (cauth *ClientCertificateAuthenticator) AuthenticateResultsTLS(
+	state *tls.ConnectionState, headers http.Header, body []byte,
+) (bool, *irma.ResultsRequest, string, *irma.RemoteError) {
+	requestor, ok := cauth.requestor(state, headers)
+	if !ok {
+		return false, nil, "", nil
+	}
+	r := &irma.ResultsRequest{}
+	if err := irma.UnmarshalValidate(body, r); err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, r, requestor, nil
+}
+
+// requestor returns the name of the requestor to which the presented client certificate belongs.
+// Requests that also use other authentication (i.e. an Authorization header) are left to the other authenticators.
+func (cauth *ClientCertificateAuthenticator) requestor(state *tls.ConnectionState, headers http.Header) (string, bool) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+	if headers.Get("Authorization") != "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
+		return "", false
+	}
+
+	cert := state.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	if requestor, ok := cauth.fingerprints[hex.EncodeToString(fingerprint[:])]; ok {
+		return requestor, true
+	}
+
+	// Names can only be trusted if the certificate was verified against the client CA
+	if !cauth.verifyNames || len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+	names := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		if requestor, ok := cauth.names[name]; ok {
+			return requestor, true
+		}
+	}
+	return "", false
+}
+
+func (cauth *ClientCertificateAuthenticator) Initialize(name string, requestor Requestor) error {
+	if len(requestor.ClientCertificateNames) > 0 {
+		if !cauth.verifyNames {
+			return errors.Errorf("Requestor %s: client_cert_names requires tls_client_ca or tls_client_ca_file to be configured", name)
+		}
+		for _, n := range requestor.ClientCertificateNames {
+			if other, ok := cauth.names[n]; ok && other != name {
+				return errors.Errorf("Requestor %s: client certificate name %s already used by requestor %s", name, n, other)
+			}
+			cauth.names[n] = name
+		}
+		if requestor.AuthenticationKey == "" && requestor.AuthenticationKeyFile == "" {
+			return nil
+		}
+	}
+
 	bts, err := common.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
 	}
-	pskauth.presharedkeys[string(bts)] = name
+	fingerprint, err := certificateFingerprint(bts)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to parse client certificate of requestor "+name, 0)
+	}
+	cauth.fingerprints[fingerprint] = name
 	return nil
 }
 
 // Helper functions
 
-// Given an (unauthenticated) jwt, return the key against which it should be verified using the "kid" header
-func jwtKeyExtractor(publickeys map[string]interface{}) func(token *jwt.Token) (interface{}, error) {
-	return func(token *jwt.Token) (interface{}, error) {
-		var ok bool
-		kid, ok := token.Header["kid"]
-		if !ok {
-			kid = token.Claims.(*jwt.StandardClaims).Issuer
+// certificateFingerprint returns the hex-encoded SHA-256 fingerprint of the given PEM certificate,
+// or normalizes the given fingerprint (which may contain colons, as printed by openssl).
+func certificateFingerprint(bts []byte) (string, error) {
+	bts = bytes.TrimSpace(bts)
+	if block, _ := pem.Decode(bts); block != nil {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", err
 		}
-		requestor, ok := kid.(string)
-		if !ok {
-			return nil, errors.New("requestor name was not a string")
+		fingerprint := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(fingerprint[:]), nil
+	}
+
+	fingerprint, err := hex.DecodeString(strings.ReplaceAll(string(bts), ":", ""))
+	if err != nil || len(fingerprint) != sha256.Size {
+		return "", errors.New("key must be a PEM certificate or a hex-encoded SHA-256 certificate fingerprint")
+	}
+	return hex.EncodeToString(fingerprint), nil
+}
+
+// keys reads and parses the authentication keys of the requestor: its key or key_file, if set,
+// followed by the keys in AuthenticationKeys.
+func (requestor Requestor) keys(name string, parse func([]byte) (interface{}, error)) ([]*requestorKey, error) {
+	configured := requestor.AuthenticationKeys
+	if requestor.AuthenticationKey != "" || requestor.AuthenticationKeyFile != "" || len(configured) == 0 {
+		configured = append([]RequestorKey{{
+			Key:     requestor.AuthenticationKey,
+			KeyFile: requestor.AuthenticationKeyFile,
+		}}, configured...)
+	}
+
+	keys := make([]*requestorKey, 0, len(configured))
+	for _, k := range configured {
+		bts, err := common.ReadKey(k.Key, k.KeyFile)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
 		}
-		token.Claims.(*jwt.StandardClaims).Issuer = requestor
-		if pk, ok := publickeys[requestor]; ok {
-			return pk, nil
+		key := &requestorKey{requestor: name}
+		if key.key, err = parse(bts); err != nil {
+			return nil, err
 		}
-		return nil, errors.Errorf("Unknown requestor: %s", requestor)
+		if k.NotBefore != "" {
+			if key.notBefore, err = time.Parse(time.RFC3339, k.NotBefore); err != nil {
+				return nil, errors.WrapPrefix(err, "Failed to parse not_before of key of requestor "+name, 0)
+			}
+		}
+		if k.NotAfter != "" {
+			if key.notAfter, err = time.Parse(time.RFC3339, k.NotAfter); err != nil {
+				return nil, errors.WrapPrefix(err, "Failed to parse not_after of key of requestor "+name, 0)
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// checkValidity returns an error if the key is not valid at the given time.
+func (key *requestorKey) checkValidity(t time.Time) *irma.RemoteError {
+	if !key.notBefore.IsZero() && t.Before(key.notBefore) {
+		return server.RemoteError(server.ErrorRequestorKeyExpired, "key not valid before "+key.notBefore.Format(time.RFC3339))
+	}
+	if !key.notAfter.IsZero() && t.After(key.notAfter) {
+		return server.RemoteError(server.ErrorRequestorKeyExpired, "key expired at "+key.notAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Given an (unauthenticated) jwt, return the name of the requestor using the "kid" header,
+// or the issuer if the "kid" header is absent
+func jwtRequestor(token *jwt.Token) (string, error) {
+	kid, ok := token.Header["kid"]
+	if !ok {
+		kid = token.Claims.(*jwt.StandardClaims).Issuer
 	}
+	requestor, ok := kid.(string)
+	if !ok {
+		return "", errors.New("requestor name was not a string")
+	}
+	return requestor, nil
 }
 
 // jwtAuthenticate is a helper function for JWT-based authenticators that verifies and parses JWTs.
 func jwtAuthenticate(
-	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
+	headers http.Header, body []byte, signatureAlg string, keys map[string][]*requestorKey, maxRequestAge int,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
 	if !jwtApplies(headers, body, signatureAlg) {
 		return false, nil, "", nil
@@ -223,12 +479,12 @@ func jwtAuthenticate(
 		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
 
-	requestor := claims.Issuer // presence is ensured by jwtKeyExtractor
+	requestor := claims.Issuer // presence is ensured by jwtValidateClaims
 	return true, parsedJwt.RequestorRequest(), requestor, nil
 }
 
 func jwtAutheticateRevocation(
-	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
+	headers http.Header, body []byte, signatureAlg string, keys map[string][]*requestorKey, maxRequestAge int,
 ) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
 	if !jwtApplies(headers, body, signatureAlg) {
 		return false, nil, "", nil
@@ -250,17 +506,71 @@ func jwtAutheticateRevocation(
 	return true, revocationJwt.Request, revocationJwt.ServerName, nil
 }
 
+func jwtAuthenticateResults(
+	headers http.Header, body []byte, signatureAlg string, keys map[string][]*requestorKey, maxRequestAge int,
+) (bool, *irma.ResultsRequest, string, *irma.RemoteError) {
+	if !jwtApplies(headers, body, signatureAlg) {
+		return false, nil, "", nil
+	}
+
+	validatedJwt, claims, validationErr := jwtValidateClaims(body, keys, maxRequestAge)
+	if validationErr != nil {
+		return true, nil, "", validationErr
+	}
+
+	// Read JWT contents
+	resultsJwt := &irma.ResultsJwt{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(validatedJwt, resultsJwt); err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	if resultsJwt.Type != "results_request" || resultsJwt.Request == nil || resultsJwt.Request.Validate() != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, "Invalid JWT body")
+	}
+	return true, resultsJwt.Request, claims.Issuer, nil
+}
+
 func jwtValidateClaims(
-	body []byte, keys map[string]interface{}, maxRequestAge int,
+	body []byte, keys map[string][]*requestorKey, maxRequestAge int,
 ) (string, *jwt.StandardClaims, *irma.RemoteError) {
-	// Verify JWT signature. We do not yet store the JWT contents here, because we need to know the session type first
-	// before we can construct a struct instance of the appropriate type into which to unmarshal the JWT contents.
-	claims := &jwt.StandardClaims{}
 	requestorJwt := string(body)
-	_, err := jwt.ParseWithClaims(requestorJwt, claims, jwtKeyExtractor(keys))
+	token, _, err := new(jwt.Parser).ParseUnverified(requestorJwt, &jwt.StandardClaims{})
+	if err != nil {
+		return "", nil, server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	requestor, err := jwtRequestor(token)
+	if err != nil {
+		return "", nil, server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	requestorKeys, ok := keys[requestor]
+	if !ok {
+		return "", nil, server.RemoteError(server.ErrorInvalidRequest, "Unknown requestor: "+requestor)
+	}
+
+	// Verify JWT signature against each of the keys of the requestor. We do not yet store the JWT contents here,
+	// because we need to know the session type first before we can construct a struct instance of the
+	// appropriate type into which to unmarshal the JWT contents.
+	var claims *jwt.StandardClaims
+	var rerr *irma.RemoteError
+	for _, key := range requestorKeys {
+		claims = &jwt.StandardClaims{}
+		_, err = jwt.ParseWithClaims(requestorJwt, claims, func(*jwt.Token) (interface{}, error) {
+			return key.key, nil
+		})
+		if err != nil {
+			continue
+		}
+		if rerr = key.checkValidity(time.Now()); rerr == nil {
+			break
+		}
+	}
+	if rerr != nil {
+		// The JWT was signed using a key that is no longer (or not yet) valid
+		return "", nil, rerr
+	}
 	if err != nil {
 		return "", nil, server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
+	claims.Issuer = requestor
 	if time.Unix(claims.IssuedAt, 0).Add(time.Duration(maxRequestAge) * time.Second).Before(time.Now()) {
 		return "", nil, server.RemoteError(server.ErrorUnauthorized, "jwt too old")
 	}
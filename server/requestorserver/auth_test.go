@@ -1,7 +1,19 @@
 package requestorserver
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,8 +25,8 @@ import (
 )
 
 func TestPresharedKeyAuthenticator_Authenticate(t *testing.T) {
-	authenticator := PresharedKeyAuthenticator{presharedkeys: map[string]string{
-		"token": "my_requestor",
+	authenticator := PresharedKeyAuthenticator{presharedkeys: map[string]*requestorKey{
+		"token": {requestor: "my_requestor"},
 	}}
 
 	validRequestBody := []byte(`{"request": {"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}}`)
@@ -86,8 +98,8 @@ func TestHmacAuthenticator_AuthenticateSession(t *testing.T) {
 	key := []byte("953BCAB6F25F3622619A9A16BE895")
 	invalidKey := []byte("A5BB219FFB6199756DF8A284A3392")
 	authenticator := HmacAuthenticator{
-		hmackeys: map[string]interface{}{
-			"my_requestor": key,
+		hmackeys: map[string][]*requestorKey{
+			"my_requestor": {{requestor: "my_requestor", key: key}},
 		},
 		maxRequestAge: 500,
 	}
@@ -175,8 +187,8 @@ func TestHmacAuthenticator_AuthenticateRevocation(t *testing.T) {
 	key := []byte("953BCAB6F25F3622619A9A16BE895")
 	invalidKey := []byte("A5BB219FFB6199756DF8A284A3392")
 	authenticator := HmacAuthenticator{
-		hmackeys: map[string]interface{}{
-			"my_requestor": key,
+		hmackeys: map[string][]*requestorKey{
+			"my_requestor": {{requestor: "my_requestor", key: key}},
 		},
 		maxRequestAge: 500,
 	}
@@ -269,3 +281,150 @@ func newRevocationJwt(servername string, rr *irma.RevocationRequest) *irma.Revoc
 		Request: rr,
 	}
 }
+
+func TestHmacAuthenticator_AuthenticateResults(t *testing.T) {
+	key := []byte("953BCAB6F25F3622619A9A16BE895")
+	authenticator := HmacAuthenticator{
+		hmackeys: map[string][]*requestorKey{
+			"my_requestor": {{requestor: "my_requestor", key: key}},
+		},
+		maxRequestAge: 500,
+	}
+	since := time.Now().Add(-time.Hour).Truncate(time.Second)
+	requestHeaders := map[string][]string{
+		"Content-Type": {"text/plain"},
+	}
+	sign := func(typ string) []byte {
+		j := &irma.ResultsJwt{
+			ServerJwt: irma.ServerJwt{Type: typ, ServerName: "my_requestor", IssuedAt: irma.Timestamp(time.Now())},
+			Request:   &irma.ResultsRequest{LDContext: irma.LDContextResultsRequest, Since: since},
+		}
+		bts, err := j.Sign(jwt.SigningMethodHS256, key)
+		require.NoError(t, err)
+		return []byte(bts)
+	}
+
+	applies, request, requestor, rerr := authenticator.AuthenticateResults(requestHeaders, sign("results_request"))
+	require.Nil(t, rerr)
+	require.True(t, applies)
+	require.Equal(t, "my_requestor", requestor)
+	require.True(t, since.Equal(request.Since))
+
+	// JWTs for other purposes are not accepted
+	applies, _, _, rerr = authenticator.AuthenticateResults(requestHeaders, sign("revocation_request"))
+	require.True(t, applies)
+	require.NotNil(t, rerr)
+}
+
+func TestHmacAuthenticator_KeyRotation(t *testing.T) {
+	oldKey := []byte("953BCAB6F25F3622619A9A16BE895")
+	newKey := []byte("A5BB219FFB6199756DF8A284A3392")
+	futureKey := []byte("0F6D5D0D7CE1C1EA0B5A2A0F29C53")
+	encode := func(key []byte) string { return base64.StdEncoding.EncodeToString(key) }
+
+	authenticator := &HmacAuthenticator{hmackeys: map[string][]*requestorKey{}, maxRequestAge: 500}
+	require.NoError(t, authenticator.Initialize("my_requestor", Requestor{
+		AuthenticationKeys: []RequestorKey{
+			{Key: encode(oldKey), NotAfter: time.Now().Add(-time.Hour).Format(time.RFC3339)},
+			{Key: encode(newKey), NotBefore: time.Now().Add(-2 * time.Hour).Format(time.RFC3339)},
+			{Key: encode(futureKey), NotBefore: time.Now().Add(time.Hour).Format(time.RFC3339)},
+		},
+	}))
+	require.Error(t, authenticator.Initialize("invalid_requestor", Requestor{
+		AuthenticationKeys: []RequestorKey{{Key: encode(newKey), NotAfter: "tomorrow"}},
+	}))
+
+	disclosureRequest := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	requestHeaders := map[string][]string{"Content-Type": {"text/plain"}}
+	sign := func(key []byte) []byte {
+		j, err := irma.NewServiceProviderJwt("my_requestor", disclosureRequest).Sign(jwt.SigningMethodHS256, key)
+		require.NoError(t, err)
+		return []byte(j)
+	}
+
+	applies, _, requestor, rerr := authenticator.AuthenticateSession(requestHeaders, sign(newKey))
+	require.Nil(t, rerr)
+	require.True(t, applies)
+	require.Equal(t, "my_requestor", requestor)
+
+	for _, key := range [][]byte{oldKey, futureKey} {
+		applies, _, _, rerr = authenticator.AuthenticateSession(requestHeaders, sign(key))
+		require.True(t, applies)
+		require.NotNil(t, rerr)
+		require.Equal(t, string(server.ErrorRequestorKeyExpired.Type), rerr.ErrorName)
+	}
+}
+
+func TestClientCertificateAuthenticator_Authenticate(t *testing.T) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "requestor.example.com"},
+		DNSNames:     []string{"requestor.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &sk.PublicKey, sk)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	fingerprint := sha256.Sum256(der)
+
+	authenticator := &ClientCertificateAuthenticator{fingerprints: map[string]string{}, names: map[string]string{}, verifyNames: true}
+	require.NoError(t, authenticator.Initialize("pem_requestor", Requestor{
+		AuthenticationKey: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}))
+	require.NoError(t, authenticator.Initialize("name_requestor", Requestor{
+		ClientCertificateNames: []string{"requestor.example.com"},
+	}))
+	require.Error(t, authenticator.Initialize("invalid_requestor", Requestor{AuthenticationKey: "abcd"}))
+
+	validRequestBody := []byte(`{"request": {"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}}`)
+	requestHeaders := map[string][]string{"Content-Type": {"application/json"}}
+
+	t.Run("fingerprint", func(t *testing.T) {
+		state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		applies, request, requestor, err := authenticator.AuthenticateSessionTLS(state, requestHeaders, validRequestBody)
+		require.Nil(t, err)
+		require.True(t, applies)
+		require.NotNil(t, request)
+		require.Equal(t, "pem_requestor", requestor)
+	})
+
+	t.Run("verified name", func(t *testing.T) {
+		authenticator := &ClientCertificateAuthenticator{fingerprints: map[string]string{}, names: map[string]string{}, verifyNames: true}
+		require.NoError(t, authenticator.Initialize("name_requestor", Requestor{
+			AuthenticationKey:      hex.EncodeToString(make([]byte, sha256.Size)),
+			ClientCertificateNames: []string{"requestor.example.com"},
+		}))
+
+		// Names are not trusted if the certificate was not verified against the client CA
+		state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		applies, _, _, _ := authenticator.AuthenticateSessionTLS(state, requestHeaders, validRequestBody)
+		require.False(t, applies)
+
+		state.VerifiedChains = [][]*x509.Certificate{{cert}}
+		applies, _, requestor, err := authenticator.AuthenticateSessionTLS(state, requestHeaders, validRequestBody)
+		require.Nil(t, err)
+		require.True(t, applies)
+		require.Equal(t, "name_requestor", requestor)
+	})
+
+	t.Run("no certificate", func(t *testing.T) {
+		applies, _, _, _ := authenticator.AuthenticateSessionTLS(&tls.ConnectionState{}, requestHeaders, validRequestBody)
+		require.False(t, applies)
+		applies, _, _, _ = authenticator.AuthenticateSessionTLS(nil, requestHeaders, validRequestBody)
+		require.False(t, applies)
+	})
+
+	t.Run("fingerprint format", func(t *testing.T) {
+		colons := strings.ToUpper(hex.EncodeToString(fingerprint[:1]))
+		for _, b := range fingerprint[1:] {
+			colons += ":" + strings.ToUpper(hex.EncodeToString([]byte{b}))
+		}
+		normalized, err := certificateFingerprint([]byte(colons))
+		require.NoError(t, err)
+		require.Equal(t, hex.EncodeToString(fingerprint[:]), normalized)
+	})
+}
@@ -2,13 +2,16 @@ package requestorserver
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/go-errors/errors"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/server"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type Configuration struct {
@@ -30,11 +33,19 @@ type Configuration struct {
 	// Route requests via this path, so instead of POST /session, it will
 	// be POST {ApiPrefix}/session.  Should start with a "/".
 	ApiPrefix string `json:"api_prefix" mapstructure:"api_prefix"`
+	// Route the endpoints for the IRMA app and frontends (/irma/...) and the static files via this
+	// path instead of ApiPrefix, so that e.g. a reverse proxy can expose only this path publicly.
+	// Should start with a "/"; defaults to ApiPrefix.
+	ClientApiPrefix string `json:"client_api_prefix" mapstructure:"client_api_prefix"`
 	// TLS configuration
 	TlsCertificate     string `json:"tls_cert" mapstructure:"tls_cert"`
 	TlsCertificateFile string `json:"tls_cert_file" mapstructure:"tls_cert_file"`
 	TlsPrivateKey      string `json:"tls_privkey" mapstructure:"tls_privkey"`
 	TlsPrivateKeyFile  string `json:"tls_privkey_file" mapstructure:"tls_privkey_file"`
+	// CA certificate(s) against which client certificates of requestors using the tls
+	// authentication method are verified, so that they can be identified by client_cert_names
+	TlsClientCA     string `json:"tls_client_ca" mapstructure:"tls_client_ca"`
+	TlsClientCAFile string `json:"tls_client_ca_file" mapstructure:"tls_client_ca_file"`
 
 	// If specified, start a separate server for the IRMA app at his port
 	ClientPort int `json:"client_port" mapstructure:"client_port"`
@@ -46,9 +57,27 @@ type Configuration struct {
 	ClientTlsPrivateKey      string `json:"client_tls_privkey" mapstructure:"client_tls_privkey"`
 	ClientTlsPrivateKeyFile  string `json:"client_tls_privkey_file" mapstructure:"client_tls_privkey_file"`
 
+	// Obtain and renew the TLS certificate automatically from an ACME certificate authority (by
+	// default Let's Encrypt) for these hostnames, instead of using a configured TLS certificate.
+	// Challenges are answered using TLS-ALPN-01, requiring the TLS port to be reachable at port 443,
+	// and using HTTP-01 if AcmeHTTPPort is set, requiring that port to be reachable at port 80.
+	AcmeHosts []string `json:"acme_hosts" mapstructure:"acme_hosts"`
+	// Directory in which the ACME account key and the obtained certificates are stored
+	AcmeCacheDir string `json:"acme_cache_dir" mapstructure:"acme_cache_dir"`
+	// If specified, answer ACME HTTP-01 challenges at this port (at ListenAddress)
+	AcmeHTTPPort int `json:"acme_http_port" mapstructure:"acme_http_port"`
+	// Directory URL of the ACME certificate authority (default Let's Encrypt)
+	AcmeDirectoryURL string `json:"acme_directory_url" mapstructure:"acme_directory_url"`
+
 	// Requestor-specific permission and authentication configuration
 	Requestors map[string]Requestor `json:"requestors"`
 
+	// Proxies (CIDR ranges or IP addresses) whose X-Forwarded-* headers are trusted: X-Forwarded-For
+	// to determine the address of clients, for logging and for the allowed_networks option of
+	// requestors, and X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix to determine the
+	// URL of the server in session pointers instead of the configured URL
+	TrustedProxies []string `json:"trusted_proxies" mapstructure:"trusted_proxies"`
+
 	// Max age in seconds of a session request JWT (using iat field)
 	MaxRequestAge int `json:"max_request_age" mapstructure:"max_request_age"`
 
@@ -56,6 +85,30 @@ type Configuration struct {
 	StaticPath string `json:"static_path" mapstructure:"static_path"`
 	// Host static files under this URL prefix
 	StaticPrefix string `json:"static_prefix" mapstructure:"static_prefix"`
+
+	// CORS policy of the endpoints for the IRMA app and for frontends such as irma-frontend, and of
+	// the static files. By default, requests from all origins are allowed. If the allowed headers are
+	// specified, they must include the headers used by frontends (Authorization and Content-Type).
+	CORSAllowedOrigins []string `json:"cors_allowed_origins" mapstructure:"cors_allowed_origins"`
+	CORSAllowedMethods []string `json:"cors_allowed_methods" mapstructure:"cors_allowed_methods"`
+	CORSAllowedHeaders []string `json:"cors_allowed_headers" mapstructure:"cors_allowed_headers"`
+
+	// When shutting down, stop accepting new sessions and wait at most this many seconds for the
+	// sessions in progress to finish (0 to stop immediately)
+	DrainTimeout int `json:"drain_timeout" mapstructure:"drain_timeout"`
+
+	// Serve session metrics in the Prometheus text format at /metrics of the requestor API
+	EnableMetrics bool `json:"metrics" mapstructure:"metrics"`
+	// Serve aggregate session statistics over the configured stats_windows as JSON at /stats of the requestor API
+	EnableStats bool `json:"stats" mapstructure:"stats"`
+	// If specified, serve the admin API at /admin of the requestor API, to list, inspect and expire
+	// sessions, to requests having this token in their Authorization header
+	AdminToken string `json:"admin_token" mapstructure:"admin_token"`
+
+	authenticators    map[AuthenticationMethod]Authenticator
+	acme              *autocert.Manager
+	trustedProxies    []*net.IPNet
+	requestorNetworks map[string][]*net.IPNet
 }
 
 // Permissions specify which attributes or credential a requestor may verify or issue.
@@ -66,6 +119,16 @@ type Permissions struct {
 	Revoking   []string `json:"revoke_perms" mapstructure:"revoke_perms"`
 }
 
+// RequestorKey is an authentication key of a requestor that is only accepted from NotBefore until
+// NotAfter (RFC 3339 timestamps), if set. By configuring multiple keys with overlapping validity,
+// requestors can rotate their keys without downtime.
+type RequestorKey struct {
+	Key       string `json:"key" mapstructure:"key"`
+	KeyFile   string `json:"key_file" mapstructure:"key_file"`
+	NotBefore string `json:"not_before" mapstructure:"not_before"`
+	NotAfter  string `json:"not_after" mapstructure:"not_after"`
+}
+
 // Requestor contains all configuration (disclosure or verification permissions and authentication)
 // for a requestor.
 type Requestor struct {
@@ -74,6 +137,33 @@ type Requestor struct {
 	AuthenticationMethod  AuthenticationMethod `json:"auth_method" mapstructure:"auth_method"`
 	AuthenticationKey     string               `json:"key" mapstructure:"key"`
 	AuthenticationKeyFile string               `json:"key_file" mapstructure:"key_file"`
+	// Additional keys, each valid within an optional time window, allowing requestors to rotate keys
+	AuthenticationKeys []RequestorKey `json:"keys" mapstructure:"keys"`
+
+	// Maximum amount of sessions this requestor may start per minute (0 for no limit)
+	MaxSessionsPerMinute int `json:"max_sessions_per_minute" mapstructure:"max_sessions_per_minute"`
+	// Maximum amount of sessions of this requestor that may be unfinished at the same time (0 for no limit)
+	MaxConcurrentSessions int `json:"max_concurrent_sessions" mapstructure:"max_concurrent_sessions"`
+
+	// Networks (CIDR ranges or IP addresses) from which this requestor may submit requests;
+	// if empty, requests are accepted from anywhere
+	AllowedNetworks []string `json:"allowed_networks" mapstructure:"allowed_networks"`
+
+	// Subject alternative names (DNS names, email addresses or URIs) of client certificates
+	// identifying this requestor, for the tls authentication method
+	ClientCertificateNames []string `json:"client_cert_names" mapstructure:"client_cert_names"`
+}
+
+// PermissionError is returned when a session request of a requestor contains attributes or
+// credentials that the requestor is not permitted to use in that session.
+type PermissionError struct {
+	Requestor  string
+	Permission string   // name of the permission setting that lacks the required entries
+	Denied     []string // identifiers of the attribute or credential types that are not permitted
+}
+
+func (err *PermissionError) Error() string {
+	return fmt.Sprintf("requestor %s lacks %s for %s", err.Requestor, err.Permission, strings.Join(err.Denied, ", "))
 }
 
 // CanIssue returns whether or not the specified requestor may issue the specified credentials.
@@ -85,53 +175,86 @@ func (conf *Configuration) CanIssue(requestor string, creds []*irma.CredentialRe
 	if len(permissions) == 0 { // requestor is not present in the permissions
 		return false, ""
 	}
-
-	for _, cred := range creds {
-		id := cred.CredentialTypeID
-		if contains(permissions, "*") ||
-			contains(permissions, id.Root()+".*") ||
-			contains(permissions, id.IssuerIdentifier().String()+".*") ||
-			contains(permissions, id.String()) {
-			continue
-		} else {
-			return false, id.String()
-		}
+	if denied := deniedCredentials(permissions, creds); len(denied) > 0 {
+		return false, denied[0]
 	}
-
 	return true, ""
 }
 
 // CanVerifyOrSign returns whether or not the specified requestor may use the selected attributes
 // in any of the supported session types.
 func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action, disjunctions irma.AttributeConDisCon) (bool, string) {
-	var permissions []string
+	permissions, _ := conf.attributePermissions(requestor, action)
+	if len(permissions) == 0 { // requestor is not present in the permissions
+		return false, ""
+	}
+	if denied := deniedAttributes(permissions, disjunctions); len(denied) > 0 {
+		return false, denied[0]
+	}
+	return true, ""
+}
+
+// CheckPermissions checks whether the specified requestor may issue the credentials and use the
+// attributes in the session request, returning a *PermissionError listing all credential or
+// attribute types that are not permitted if not.
+func (conf *Configuration) CheckPermissions(requestor string, request irma.SessionRequest) error {
+	if request.Action() == irma.ActionIssuing {
+		permissions := append(conf.Requestors[requestor].Issuing, conf.Issuing...)
+		creds := request.(*irma.IssuanceRequest).Credentials
+		if denied := deniedCredentials(permissions, creds); len(denied) > 0 {
+			return &PermissionError{Requestor: requestor, Permission: "issue_perms", Denied: denied}
+		}
+	}
+
+	condiscon := request.Disclosure().Disclose
+	if len(condiscon) > 0 {
+		permissions, name := conf.attributePermissions(requestor, request.Action())
+		if denied := deniedAttributes(permissions, condiscon); len(denied) > 0 {
+			return &PermissionError{Requestor: requestor, Permission: name, Denied: denied}
+		}
+	}
+	return nil
+}
+
+// attributePermissions returns the permissions of the requestor for using attributes in sessions
+// of the given type, and the name of the permission setting.
+func (conf *Configuration) attributePermissions(requestor string, action irma.Action) ([]string, string) {
 	switch action {
-	case irma.ActionDisclosing:
-		permissions = append(conf.Requestors[requestor].Disclosing, conf.Disclosing...)
-	case irma.ActionIssuing:
-		permissions = append(conf.Requestors[requestor].Disclosing, conf.Disclosing...)
+	case irma.ActionDisclosing, irma.ActionIssuing:
+		return append(conf.Requestors[requestor].Disclosing, conf.Disclosing...), "disclose_perms"
 	case irma.ActionSigning:
-		permissions = append(conf.Requestors[requestor].Signing, conf.Signing...)
+		return append(conf.Requestors[requestor].Signing, conf.Signing...), "sign_perms"
 	}
-	if len(permissions) == 0 { // requestor is not present in the permissions
-		return false, ""
+	return nil, ""
+}
+
+func deniedCredentials(permissions []string, creds []*irma.CredentialRequest) []string {
+	var denied []string
+	for _, cred := range creds {
+		id := cred.CredentialTypeID
+		if !(contains(permissions, "*") ||
+			contains(permissions, id.Root()+".*") ||
+			contains(permissions, id.IssuerIdentifier().String()+".*") ||
+			contains(permissions, id.String())) {
+			denied = append(denied, id.String())
+		}
 	}
+	return denied
+}
 
-	err := disjunctions.Iterate(func(attr *irma.AttributeRequest) error {
-		if contains(permissions, "*") ||
+func deniedAttributes(permissions []string, disjunctions irma.AttributeConDisCon) []string {
+	var denied []string
+	_ = disjunctions.Iterate(func(attr *irma.AttributeRequest) error {
+		if !(contains(permissions, "*") ||
 			contains(permissions, attr.Type.Root()+".*") ||
 			contains(permissions, attr.Type.CredentialTypeIdentifier().IssuerIdentifier().String()+".*") ||
 			contains(permissions, attr.Type.CredentialTypeIdentifier().String()+".*") ||
-			contains(permissions, attr.Type.String()) {
-			return nil
-		} else {
-			return errors.New(attr.Type.String())
+			contains(permissions, attr.Type.String())) && !contains(denied, attr.Type.String()) {
+			denied = append(denied, attr.Type.String())
 		}
+		return nil
 	})
-	if err != nil {
-		return false, err.Error()
-	}
-	return true, ""
+	return denied
 }
 
 func (conf *Configuration) CanRevoke(requestor string, cred irma.CredentialTypeIdentifier) (bool, string) {
@@ -152,9 +275,22 @@ func (conf *Configuration) CanRevoke(requestor string, cred irma.CredentialTypeI
 	return false, cred.String()
 }
 
+// authorizeNextSession checks whether the specified requestor may start the next session of a
+// chained session, which is retrieved from the nextSession URL of the requestor's previous session.
+func (conf *Configuration) authorizeNextSession(requestor string, rrequest irma.RequestorRequest) error {
+	if requestor == "" && !conf.DisableRequestorAuthentication {
+		// Sessions without requestor are static sessions, which are configured by the server admin
+		return nil
+	}
+	if err := conf.CheckPermissions(requestor, rrequest.SessionRequest()); err != nil {
+		return errors.WrapPrefix(err, "not authorized to start next session", 0)
+	}
+	return nil
+}
+
 func (conf *Configuration) initialize() error {
 	if conf.DisableRequestorAuthentication {
-		authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}
+		conf.authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}
 		conf.Logger.Warn("Authentication of incoming session requests disabled: anyone who can reach this server can use it")
 		havekeys := conf.HavePrivateKeys()
 		if len(conf.Permissions.Issuing) > 0 && havekeys {
@@ -164,35 +300,9 @@ func (conf *Configuration) initialize() error {
 				return errors.New("If issuing is enabled in production mode, requestor authentication must be enabled, or client_listen_addr and client_port must be used")
 			}
 		}
-	} else {
-		if len(conf.Requestors) == 0 {
-			revServer := false
-			for _, s := range conf.RevocationSettings {
-				if s.Server {
-					revServer = true
-				}
-			}
-			if !revServer {
-				return errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
-			}
-		}
-		authenticators = map[AuthenticationMethod]Authenticator{
-			AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
-		}
-
-		// Initialize authenticators
-		for name, requestor := range conf.Requestors {
-			authenticator, ok := authenticators[requestor.AuthenticationMethod]
-			if !ok {
-				return errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s)",
-					name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac, AuthenticationMethodPublicKey)
-			}
-			if err := authenticator.Initialize(name, requestor); err != nil {
-				return err
-			}
-		}
+	}
+	if err := conf.initializeRequestors(); err != nil {
+		return err
 	}
 
 	if conf.Port <= 0 || conf.Port > 65535 {
@@ -209,19 +319,21 @@ func (conf *Configuration) initialize() error {
 		return errors.New("client_listen_addr must be combined with a nonzero client_port")
 	}
 
+	if err := conf.verifyAcme(); err != nil {
+		return err
+	}
 	tlsConf, err := conf.tlsConfig()
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to read TLS configuration", 0)
 	}
+	if tlsConf == nil && conf.clientCertificateAuthentication() {
+		return errors.New("Requestors using the tls authentication method require TLS to be enabled")
+	}
 	clientTlsConf, err := conf.clientTlsConfig()
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to read client TLS configuration", 0)
 	}
 
-	if err := conf.validatePermissions(); err != nil {
-		return err
-	}
-
 	if conf.StaticPath != "" {
 		if err := common.AssertPathExists(conf.StaticPath); err != nil {
 			return errors.WrapPrefix(err, "Invalid static_path", 0)
@@ -264,17 +376,72 @@ func (conf *Configuration) initialize() error {
 		return errors.Errorf("api_prefix must start with a slash, but doesn't: %s", conf.ApiPrefix)
 	}
 
-	if conf.URL != "" && !strings.HasSuffix(conf.URL, conf.ApiPrefix+"irma/") {
-		conf.Logger.Warnf("Are the URL and API-prefix set correctly?: %s does not end with %s.", conf.URL, conf.ApiPrefix+"irma/")
+	if conf.ClientApiPrefix == "" {
+		conf.ClientApiPrefix = conf.ApiPrefix
+	}
+	if !strings.HasSuffix(conf.ClientApiPrefix, "/") {
+		conf.ClientApiPrefix += "/"
+	}
+	if !strings.HasPrefix(conf.ClientApiPrefix, "/") {
+		return errors.Errorf("client_api_prefix must start with a slash, but doesn't: %s", conf.ClientApiPrefix)
+	}
+
+	if conf.URL != "" && !strings.HasSuffix(conf.URL, conf.ClientApiPrefix+"irma/") {
+		conf.Logger.Warnf("Are the URL and API-prefix set correctly?: %s does not end with %s.", conf.URL, conf.ClientApiPrefix+"irma/")
 	}
 
-	if len(conf.StaticSessions) != 0 && conf.JwtRSAPrivateKey == nil {
+	if len(conf.StaticSessions) != 0 && conf.JwtSigner == nil {
 		conf.Logger.Warn("Static sessions enabled and no JWT private key installed. Ensure that POSTs to the callback URLs of static sessions are trustworthy by keeping the callback URLs secret and by using HTTPS.")
 	}
 
 	return nil
 }
 
+// initializeRequestors initializes and validates the requestors, their keys, permissions and
+// networks, and the global permissions. It is also used when reloading the requestor configuration.
+func (conf *Configuration) initializeRequestors() error {
+	if !conf.DisableRequestorAuthentication {
+		if len(conf.Requestors) == 0 {
+			revServer := false
+			for _, s := range conf.RevocationSettings {
+				if s.Server {
+					revServer = true
+				}
+			}
+			if !revServer {
+				return errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
+			}
+		}
+		conf.authenticators = map[AuthenticationMethod]Authenticator{
+			AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string][]*requestorKey{}, maxRequestAge: conf.MaxRequestAge},
+			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string][]*requestorKey{}, maxRequestAge: conf.MaxRequestAge},
+			AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]*requestorKey{}},
+			AuthenticationMethodTLS: &ClientCertificateAuthenticator{
+				fingerprints: map[string]string{},
+				names:        map[string]string{},
+				verifyNames:  conf.TlsClientCA != "" || conf.TlsClientCAFile != "",
+			},
+		}
+
+		// Initialize authenticators
+		for name, requestor := range conf.Requestors {
+			authenticator, ok := conf.authenticators[requestor.AuthenticationMethod]
+			if !ok {
+				return errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s, %s)",
+					name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac, AuthenticationMethodPublicKey, AuthenticationMethodTLS)
+			}
+			if err := authenticator.Initialize(name, requestor); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := conf.initializeNetworks(); err != nil {
+		return err
+	}
+	return conf.validatePermissions()
+}
+
 func (conf *Configuration) validatePermissions() error {
 	if conf.DisableRequestorAuthentication && len(conf.Requestors) != 0 {
 		return errors.New("Requestors must not be configured when requestor authentication is disabled")
@@ -322,21 +489,21 @@ func (conf *Configuration) validatePermissionSet(requestor string, requestorperm
 				}
 			}
 			if len(parts) > 0 && parts[0] != "*" {
-				if conf.IrmaConfiguration.SchemeManagers[irma.NewSchemeManagerIdentifier(parts[0])] == nil {
+				if conf.IrmaConfiguration.GetSchemeManagers()[irma.NewSchemeManagerIdentifier(parts[0])] == nil {
 					errs = append(errs, fmt.Sprintf("%s %s permission '%s': unknown scheme", requestor, typ, permission))
 					continue // no sense in checking if issuer, credtype or attr type are known; they won't be
 				}
 			}
 			if len(parts) > 1 && parts[1] != "*" {
 				id := irma.NewIssuerIdentifier(strings.Join(parts[:2], "."))
-				if conf.IrmaConfiguration.Issuers[id] == nil {
+				if conf.IrmaConfiguration.GetIssuers()[id] == nil {
 					errs = append(errs, fmt.Sprintf("%s %s permission '%s': unknown issuer", requestor, typ, permission))
 					continue
 				}
 			}
 			if len(parts) > 2 && parts[2] != "*" {
 				id := irma.NewCredentialTypeIdentifier(strings.Join(parts[:3], "."))
-				credtype := conf.IrmaConfiguration.CredentialTypes[id]
+				credtype := conf.IrmaConfiguration.GetCredentialTypes()[id]
 				if credtype == nil {
 					errs = append(errs, fmt.Sprintf("%s %s permission '%s': unknown credential type", requestor, typ, permission))
 					continue
@@ -361,7 +528,7 @@ func (conf *Configuration) validatePermissionSet(requestor string, requestorperm
 			}
 			if len(parts) > 3 && parts[3] != "*" {
 				id := irma.NewAttributeTypeIdentifier(strings.Join(parts[:4], "."))
-				if conf.IrmaConfiguration.AttributeTypes[id] == nil {
+				if conf.IrmaConfiguration.GetAttributeTypes()[id] == nil {
 					errs = append(errs, fmt.Sprintf("%s %s permission '%s': unknown attribute type", requestor, typ, permission))
 					continue
 				}
@@ -373,11 +540,54 @@ func (conf *Configuration) validatePermissionSet(requestor string, requestorperm
 }
 
 func (conf *Configuration) clientTlsConfig() (*tls.Config, error) {
-	return server.TLSConf(conf.ClientTlsCertificate, conf.ClientTlsCertificateFile, conf.ClientTlsPrivateKey, conf.ClientTlsPrivateKeyFile)
+	tlsConf, err := server.TLSConf(conf.ClientTlsCertificate, conf.ClientTlsCertificateFile, conf.ClientTlsPrivateKey, conf.ClientTlsPrivateKeyFile)
+	if tlsConf == nil && err == nil && conf.acme != nil {
+		tlsConf = conf.acmeTlsConfig()
+	}
+	return tlsConf, err
 }
 
 func (conf *Configuration) tlsConfig() (*tls.Config, error) {
-	return server.TLSConf(conf.TlsCertificate, conf.TlsCertificateFile, conf.TlsPrivateKey, conf.TlsPrivateKeyFile)
+	var tlsConf *tls.Config
+	var err error
+	if conf.acme != nil {
+		tlsConf = conf.acmeTlsConfig()
+	} else {
+		tlsConf, err = server.TLSConf(conf.TlsCertificate, conf.TlsCertificateFile, conf.TlsPrivateKey, conf.TlsPrivateKeyFile)
+	}
+	if err != nil || tlsConf == nil || !conf.clientCertificateAuthentication() {
+		return tlsConf, err
+	}
+
+	// Ask for client certificates without requiring them, as other requestors and
+	// (if no separate client server is used) the IRMA app do not present one
+	if conf.TlsClientCA == "" && conf.TlsClientCAFile == "" {
+		tlsConf.ClientAuth = tls.RequestClientCert
+		return tlsConf, nil
+	}
+	bts, err := common.ReadKey(conf.TlsClientCA, conf.TlsClientCAFile)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to read client CA", 0)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bts) {
+		return nil, errors.New("client CA contains no PEM certificates")
+	}
+	tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConf.ClientCAs = pool
+	return tlsConf, nil
+}
+
+func (conf *Configuration) clientCertificateAuthentication() bool {
+	if conf.DisableRequestorAuthentication {
+		return false
+	}
+	for _, requestor := range conf.Requestors {
+		if requestor.AuthenticationMethod == AuthenticationMethodTLS {
+			return true
+		}
+	}
+	return false
 }
 
 func (conf *Configuration) separateClientServer() bool {
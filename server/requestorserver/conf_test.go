@@ -1,12 +1,22 @@
 package requestorserver
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
 )
 
 func createCredentialRequest(identifier string, attributes map[string]string) []*irma.CredentialRequest {
@@ -219,3 +229,402 @@ func TestCanVerifyOrSign(t *testing.T) {
 		}
 	}
 }
+
+func TestAuthorizeNextSession(t *testing.T) {
+	confJSON := `{
+		"requestors": {
+			"myapp": {
+				"disclose_perms": [ "irma-demo.MijnOverheid.ageLower.over18" ],
+				"issue_perms": [ "irma-demo.MijnOverheid.ageLower" ],
+				"auth_method": "token",
+				"key": "eGE2PSomOT84amVVdTU"
+			}
+		}
+	}`
+	var conf Configuration
+	require.NoError(t, json.Unmarshal([]byte(confJSON), &conf))
+
+	allowed := irma.NewIssuanceRequest(createCredentialRequest("irma-demo.MijnOverheid.ageLower", map[string]string{"over12": "yes"}))
+	require.NoError(t, conf.authorizeNextSession("myapp", &irma.IdentityProviderRequest{Request: allowed}))
+	require.Error(t, conf.authorizeNextSession("yourapp", &irma.IdentityProviderRequest{Request: allowed}))
+
+	notAllowed := irma.NewIssuanceRequest(createCredentialRequest("irma-demo.MijnOverheid.fullName", map[string]string{"firstname": "John"}))
+	require.Error(t, conf.authorizeNextSession("myapp", &irma.IdentityProviderRequest{Request: notAllowed}))
+
+	disclosure := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over18"))
+	require.NoError(t, conf.authorizeNextSession("myapp", &irma.ServiceProviderRequest{Request: disclosure}))
+	disclosure = irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over12"))
+	require.Error(t, conf.authorizeNextSession("myapp", &irma.ServiceProviderRequest{Request: disclosure}))
+
+	// Static sessions have no requestor and are not restricted
+	require.NoError(t, conf.authorizeNextSession("", &irma.IdentityProviderRequest{Request: notAllowed}))
+}
+
+func TestCheckPermissions(t *testing.T) {
+	confJSON := `{
+		"requestors": {
+			"myapp": {
+				"disclose_perms": [ "irma-demo.MijnOverheid.ageLower.over18" ],
+				"auth_method": "token",
+				"key": "eGE2PSomOT84amVVdTU"
+			}
+		}
+	}`
+	var conf Configuration
+	require.NoError(t, json.Unmarshal([]byte(confJSON), &conf))
+
+	request := irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over18"),
+		irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over12"),
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	)
+	err := conf.CheckPermissions("myapp", request)
+	require.IsType(t, &PermissionError{}, err)
+	require.Equal(t, "disclose_perms", err.(*PermissionError).Permission)
+	require.Equal(t, []string{"irma-demo.MijnOverheid.ageLower.over12", "irma-demo.RU.studentCard.studentID"}, err.(*PermissionError).Denied)
+
+	// myapp may not request signatures at all
+	signature := irma.NewSignatureRequest("message", irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over18"))
+	err = conf.CheckPermissions("myapp", signature)
+	require.IsType(t, &PermissionError{}, err)
+	require.Equal(t, "requestor myapp lacks sign_perms for irma-demo.MijnOverheid.ageLower.over18", err.Error())
+
+	issuance := irma.NewIssuanceRequest(createCredentialRequest("irma-demo.MijnOverheid.ageLower", map[string]string{"over12": "yes"}))
+	require.EqualError(t, conf.CheckPermissions("myapp", issuance), "requestor myapp lacks issue_perms for irma-demo.MijnOverheid.ageLower")
+
+	require.NoError(t, conf.CheckPermissions("myapp", irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over18"))))
+}
+
+func TestReload(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	requestor := func(key string) Requestor {
+		return Requestor{
+			Permissions:          Permissions{Disclosing: []string{"*"}},
+			AuthenticationMethod: AuthenticationMethodToken,
+			AuthenticationKey:    key,
+		}
+	}
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		},
+		Port:       48682,
+		Requestors: map[string]Requestor{"old": requestor("old")},
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+
+	body := `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+	startSession := func(token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/session", strings.NewReader(body))
+		r.Header.Set("Authorization", token)
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+	require.Equal(t, http.StatusOK, startSession("old"))
+
+	require.NoError(t, s.Reload(&Configuration{Requestors: map[string]Requestor{"new": requestor("new")}}))
+	require.Equal(t, http.StatusForbidden, startSession("old"))
+	require.Equal(t, http.StatusOK, startSession("new"))
+
+	// An invalid configuration is rejected, and the current one remains in use
+	invalid := requestor("invalid")
+	invalid.AuthenticationMethod = "nonexistent"
+	require.Error(t, s.Reload(&Configuration{Requestors: map[string]Requestor{"invalid": invalid}}))
+	require.Equal(t, http.StatusOK, startSession("new"))
+}
+
+func TestClientCorsPolicy(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		CORSAllowedOrigins:             []string{"https://example.com"},
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+
+	preflight := func(path, origin string) string {
+		r := httptest.NewRequest(http.MethodOptions, path, nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w.Header().Get("Access-Control-Allow-Origin")
+	}
+
+	path := "/irma/session/123/frontend/status"
+	require.Equal(t, "https://example.com", preflight(path, "https://example.com"))
+	require.Empty(t, preflight(path, "https://attacker.example"))
+
+	// The requestor API is not affected
+	require.Equal(t, "*", preflight("/session/123/status", "https://attacker.example"))
+}
+
+func TestAcme(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	cacheDir := filepath.Join(t.TempDir(), "acme")
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			URL:         "http://irma.example.com",
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		AcmeHosts:                      []string{"irma.example.com"},
+		AcmeCacheDir:                   cacheDir,
+		AcmeHTTPPort:                   48680,
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+
+	require.DirExists(t, cacheDir)
+	require.Equal(t, "https://irma.example.com/irma/", s.config().URL)
+	require.Equal(t, 2, s.serverCount())
+	tlsConf, err := s.config().tlsConfig()
+	require.NoError(t, err)
+	require.NotNil(t, tlsConf.GetCertificate)
+	require.Contains(t, tlsConf.NextProtos, acme.ALPNProto)
+
+	// Certificates are only requested for the configured hosts
+	_, err = tlsConf.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	require.Error(t, err)
+
+	// ACME HTTP-01 server redirects other requests to HTTPS
+	r := httptest.NewRequest(http.MethodGet, "http://irma.example.com/irma/session/123", nil)
+	w := httptest.NewRecorder()
+	s.config().acme.HTTPHandler(nil).ServeHTTP(w, r)
+	require.Equal(t, http.StatusFound, w.Code)
+	require.Equal(t, "https://irma.example.com/irma/session/123", w.Header().Get("Location"))
+
+	invalid := []*Configuration{
+		{AcmeHosts: []string{"irma.example.com"}},
+		{AcmeHosts: []string{"irma.example.com"}, AcmeCacheDir: cacheDir, TlsCertificateFile: "cert.pem"},
+		{AcmeHosts: []string{"irma.example.com"}, AcmeCacheDir: cacheDir, Port: 48682, AcmeHTTPPort: 48682},
+		{AcmeHTTPPort: 80},
+	}
+	for _, conf := range invalid {
+		conf.Configuration = &server.Configuration{Logger: logger}
+		require.Error(t, conf.verifyAcme())
+	}
+}
+
+func TestClientApiPrefix(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			URL:         "http://localhost:48682/public",
+		},
+		Port:                           48682,
+		ApiPrefix:                      "/",
+		ClientApiPrefix:                "/public",
+		DisableRequestorAuthentication: true,
+		Permissions:                    Permissions{Disclosing: []string{"*"}},
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+	require.Equal(t, "/public/", s.config().ClientApiPrefix)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	body := `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+	w := do(http.MethodPost, "/session", body)
+	require.Equal(t, http.StatusOK, w.Code)
+	var pkg server.SessionPackage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pkg))
+	require.True(t, strings.HasPrefix(pkg.SessionPtr.URL, "http://localhost:48682/public/irma/session/"))
+	path := strings.TrimPrefix(pkg.SessionPtr.URL, "http://localhost:48682")
+
+	// The client endpoints are only available under the client API prefix, and vice versa
+	require.Equal(t, http.StatusOK, do(http.MethodGet, path+"/status", "").Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, strings.TrimPrefix(path, "/public")+"/status", "").Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodPost, "/public/session", body).Code)
+}
+
+func TestStrictDecoding(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:         logger,
+			SchemesPath:    filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			StrictDecoding: true,
+			MaxRequestSize: 1 << 10,
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		Permissions:                    Permissions{Disclosing: []string{"*"}},
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+
+	startSession := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/session", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	request := `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+	require.Equal(t, http.StatusOK, startSession(request).Code)
+	require.Equal(t, http.StatusOK, startSession(`{"validity":120,"request":`+request+`}`).Code)
+
+	w := startSession(`{"validity":120,"smuggled":true,"request":` + request + `}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "unknown field smuggled")
+	require.Equal(t, http.StatusBadRequest, startSession(`{"type":"disclosing","content":[{"label":"ID","attributes":["irma-demo.RU.studentCard.studentID"]}]}`).Code)
+
+	// Bodies larger than the maximum request size are rejected
+	w = startSession(`{"validity":120,"request":` + request + `,"padding":"` + strings.Repeat("a", 1<<10) + `"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "request body too large")
+}
+
+func TestAdminApi(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		},
+		Port:                           48682,
+		AdminToken:                     "admintoken",
+		DisableRequestorAuthentication: true,
+		Permissions:                    Permissions{Disclosing: []string{"*"}},
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+
+	do := func(method, path, body, auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodPost, "/session", `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var pkg server.SessionPackage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pkg))
+	token := string(pkg.Token)
+
+	// The admin token is required
+	require.Equal(t, http.StatusForbidden, do(http.MethodGet, "/admin/sessions", "", "").Code)
+	require.Equal(t, http.StatusForbidden, do(http.MethodGet, "/admin/sessions", "", "wrongtoken").Code)
+
+	w = do(http.MethodGet, "/admin/sessions", "", "admintoken")
+	require.Equal(t, http.StatusOK, w.Code)
+	var sessions []*irmaserver.SessionInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 1)
+	require.Equal(t, irma.ServerStatusInitialized, sessions[0].Status)
+
+	w = do(http.MethodGet, "/admin/session/"+token, "", "admintoken")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotContains(t, w.Body.String(), string(pkg.FrontendRequest.Authorization))
+	var state irmaserver.SessionState
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &state))
+	require.Equal(t, irma.RequestorToken(token), state.Token)
+	require.Equal(t, "irma-demo.RU.studentCard.studentID", state.Requested[0][0][0].Type.String())
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodPost, "/admin/session/"+token+"/expire", "", "admintoken").Code)
+	result, err := s.irmaserv.GetSessionResult(irma.RequestorToken(token))
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusTimeout, result.Status)
+
+	// Finished sessions are not listed and cannot be expired again
+	w = do(http.MethodGet, "/admin/sessions", "", "admintoken")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+	require.Empty(t, sessions)
+	require.Equal(t, http.StatusForbidden, do(http.MethodPost, "/admin/session/"+token+"/expire", "", "admintoken").Code)
+}
+
+func TestResultHistory(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		},
+		Port: 48682,
+		Requestors: map[string]Requestor{
+			"requestor": {
+				Permissions:          Permissions{Disclosing: []string{"*"}},
+				AuthenticationMethod: AuthenticationMethodToken,
+				AuthenticationKey:    "requestor",
+			},
+			"other": {
+				Permissions:          Permissions{Disclosing: []string{"*"}},
+				AuthenticationMethod: AuthenticationMethodToken,
+				AuthenticationKey:    "other",
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+
+	do := func(path, body, auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	since := time.Now().Add(-time.Second).UTC().Format(time.RFC3339)
+	w := do("/session", `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`, "requestor")
+	require.Equal(t, http.StatusOK, w.Code)
+	var pkg server.SessionPackage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pkg))
+	require.NoError(t, s.irmaserv.CancelSession(pkg.Token))
+
+	request := `{"@context":"https://irma.app/ld/request/results/v1","since":"` + since + `"}`
+	w = do("/result", request, "requestor")
+	require.Equal(t, http.StatusOK, w.Code)
+	var results []*irmaserver.FinishedSessionResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	require.Len(t, results, 1)
+	require.Equal(t, pkg.Token, results[0].Token)
+	require.Equal(t, irma.ServerStatusCancelled, results[0].Status)
+	require.False(t, results[0].Finished.IsZero())
+
+	// Requestors only receive the results of their own sessions
+	w = do("/result", request, "other")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	require.Empty(t, results)
+
+	// The requestor must be authenticated
+	require.Equal(t, http.StatusBadRequest, do("/result", request, "").Code)
+	require.Equal(t, http.StatusForbidden, do("/result", request, "invalid").Code)
+}
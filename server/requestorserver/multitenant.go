@@ -0,0 +1,175 @@
+package requestorserver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// MultiTenantServer hosts multiple requestor servers (tenants) in a single process, listening
+// on a single address. Each tenant has its own configuration (requestors, JWT keys, schemes,
+// and so on) and is served under its own API prefix. The sessions of each tenant are kept in
+// a separate namespace of the session store.
+type MultiTenantServer struct {
+	listener *Server
+	tlsConf  *tls.Config
+	tenants  []*Server // sorted by decreasing length of the API prefix
+	names    map[string]*Server
+}
+
+// NewMultiTenant creates a server hosting the specified tenants. The listen address, port and
+// TLS configuration of the server are taken from conf; those of the tenants are ignored.
+// Tenants must have distinct API prefixes, and cannot use a separate client server, a separate
+// client API prefix or the tls authentication method. If the session namespace of a tenant is not set, its name is used.
+func NewMultiTenant(conf *Configuration, tenants map[string]*Configuration) (*MultiTenantServer, error) {
+	if len(tenants) == 0 {
+		return nil, errors.New("No tenants configured")
+	}
+
+	if conf.Configuration == nil {
+		conf.Configuration = &server.Configuration{}
+	}
+	if conf.Logger == nil {
+		conf.Logger = server.NewLogger(conf.Verbose, conf.Quiet, conf.LogJSON)
+	}
+	if conf.Port <= 0 || conf.Port > 65535 {
+		return nil, errors.Errorf("Port must be between 1 and 65535 (was %d)", conf.Port)
+	}
+	if err := conf.verifyAcme(); err != nil {
+		return nil, err
+	}
+	tlsConf, err := conf.tlsConfig()
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to read TLS configuration", 0)
+	}
+
+	s := &MultiTenantServer{listener: &Server{conf: conf}, tlsConf: tlsConf, names: map[string]*Server{}}
+	if err := s.addTenants(tenants); err != nil {
+		for _, tenant := range s.tenants {
+			tenant.irmaserv.Stop()
+		}
+		return nil, err
+	}
+
+	sort.Slice(s.tenants, func(i, j int) bool {
+		return len(s.tenants[i].config().ApiPrefix) > len(s.tenants[j].config().ApiPrefix)
+	})
+	return s, nil
+}
+
+func (s *MultiTenantServer) addTenants(tenants map[string]*Configuration) error {
+	conf := s.listener.conf
+	prefixes := map[string]string{}
+	for name, tconf := range tenants {
+		prefix := tconf.ApiPrefix
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		if other, ok := prefixes[prefix]; ok {
+			return errors.Errorf("Tenants %s and %s have the same api_prefix %s", name, other, prefix)
+		}
+		prefixes[prefix] = name
+	}
+
+	for name, tconf := range tenants {
+		if tconf.ClientPort != 0 {
+			return errors.Errorf("Tenant %s: client_port is not supported for tenants", name)
+		}
+		if tconf.ClientApiPrefix != "" && tconf.ClientApiPrefix != tconf.ApiPrefix {
+			return errors.Errorf("Tenant %s: client_api_prefix is not supported for tenants", name)
+		}
+		if tconf.clientCertificateAuthentication() {
+			return errors.Errorf("Tenant %s: the %s authentication method is not supported for tenants", name, AuthenticationMethodTLS)
+		}
+		tconf.ListenAddress, tconf.Port = conf.ListenAddress, conf.Port
+		tconf.TlsCertificate, tconf.TlsCertificateFile = conf.TlsCertificate, conf.TlsCertificateFile
+		tconf.TlsPrivateKey, tconf.TlsPrivateKeyFile = conf.TlsPrivateKey, conf.TlsPrivateKeyFile
+		if tconf.SessionNamespace == "" {
+			tconf.SessionNamespace = name
+		}
+
+		tenant, err := New(tconf)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to configure tenant "+name, 0)
+		}
+		s.tenants = append(s.tenants, tenant)
+		s.names[name] = tenant
+	}
+	return nil
+}
+
+// Reload reloads the requestor configuration of each of the tenants (see Server.Reload). The new
+// configurations of all tenants are validated before any of them is applied, so that either all
+// tenants or none are reloaded. Tenants cannot be added or removed without restarting.
+func (s *MultiTenantServer) Reload(tenants map[string]*Configuration) error {
+	if len(tenants) != len(s.names) {
+		return errors.New("Cannot reload tenants: adding or removing tenants requires a restart")
+	}
+	confs := make(map[*Server]*Configuration, len(tenants))
+	for name, tconf := range tenants {
+		tenant, ok := s.names[name]
+		if !ok {
+			return errors.Errorf("Cannot reload tenants: unknown tenant %s", name)
+		}
+		newconf, err := tenant.reloadedConfig(tconf)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to reload tenant "+name, 0)
+		}
+		confs[tenant] = newconf
+	}
+	for tenant, newconf := range confs {
+		tenant.applyConfig(newconf)
+	}
+	return nil
+}
+
+// Handler returns a http.Handler that routes requests to the tenant whose API prefix matches
+// the request path.
+func (s *MultiTenantServer) Handler() http.Handler {
+	handlers := make([]http.Handler, len(s.tenants))
+	for i, tenant := range s.tenants {
+		handlers[i] = tenant.Handler()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, tenant := range s.tenants {
+			if strings.HasPrefix(r.URL.Path, tenant.config().ApiPrefix) {
+				handlers[i].ServeHTTP(w, r)
+				return
+			}
+		}
+		server.WriteError(w, server.ErrorInvalidRequest, "unknown tenant")
+	})
+}
+
+// Start the server. If successful then it will not return until Stop() is called.
+func (s *MultiTenantServer) Start() error {
+	s.listener.stop = make(chan struct{})
+	s.listener.stopped = make(chan struct{}, 1)
+	return s.listener.startServer(s.Handler(), "Server", s.listener.conf.ListenAddress, s.listener.conf.Port, s.listener.conf.ApiPrefix, s.tlsConf)
+}
+
+// Drain drains all tenants concurrently (see Server.Drain).
+func (s *MultiTenantServer) Drain() {
+	var wg sync.WaitGroup
+	for _, tenant := range s.tenants {
+		wg.Add(1)
+		go func(tenant *Server) {
+			defer wg.Done()
+			tenant.Drain()
+		}(tenant)
+	}
+	wg.Wait()
+}
+
+func (s *MultiTenantServer) Stop() {
+	for _, tenant := range s.tenants {
+		tenant.irmaserv.Stop()
+	}
+	s.listener.stop <- struct{}{}
+	<-s.listener.stopped
+}
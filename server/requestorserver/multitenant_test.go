@@ -0,0 +1,100 @@
+package requestorserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func tenantConf(t *testing.T, prefix, token string) *Configuration {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	return &Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		},
+		ApiPrefix: prefix,
+		Requestors: map[string]Requestor{
+			"requestor": {
+				Permissions:          Permissions{Disclosing: []string{"*"}},
+				AuthenticationMethod: AuthenticationMethodToken,
+				AuthenticationKey:    token,
+			},
+		},
+	}
+}
+
+func TestMultiTenantServer(t *testing.T) {
+	listener := &Configuration{Configuration: &server.Configuration{Logger: logrus.New()}, Port: 48682}
+	s, err := NewMultiTenant(listener, map[string]*Configuration{
+		"a": tenantConf(t, "/a", "token-a"),
+		"b": tenantConf(t, "/b/", "token-b"),
+	})
+	require.NoError(t, err)
+	defer func() {
+		for _, tenant := range s.tenants {
+			tenant.irmaserv.Stop()
+		}
+	}()
+
+	handler := s.Handler()
+	body := `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+	startSession := func(path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Authorization", token)
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := startSession("/a/session", "token-a")
+	require.Equal(t, http.StatusOK, w.Code)
+	var pkg server.SessionPackage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pkg))
+
+	// Requestors and sessions of one tenant are unknown to the other
+	require.NotEqual(t, http.StatusOK, startSession("/b/session", "token-a").Code)
+	require.Equal(t, http.StatusOK, startSession("/b/session", "token-b").Code)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/b/session/"+string(pkg.Token)+"/status", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/a/session/"+string(pkg.Token)+"/status", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	require.Equal(t, http.StatusBadRequest, startSession("/c/session", "token-a").Code)
+
+	_, err = NewMultiTenant(listener, map[string]*Configuration{
+		"a": tenantConf(t, "/a", "token-a"),
+		"b": tenantConf(t, "/a/", "token-b"),
+	})
+	require.Error(t, err)
+}
+
+func TestMultiTenantListenerConfiguration(t *testing.T) {
+	// The listener configuration does not need a logger
+	s, err := NewMultiTenant(&Configuration{Port: 48682}, map[string]*Configuration{
+		"a": tenantConf(t, "/a", "token-a"),
+	})
+	require.NoError(t, err)
+	require.NotNil(t, s.listener.conf.Logger)
+	for _, tenant := range s.tenants {
+		tenant.irmaserv.Stop()
+	}
+
+	// An invalid TLS configuration is reported instead of ignored
+	_, err = NewMultiTenant(&Configuration{Port: 48682, TlsCertificate: "invalid", TlsPrivateKey: "invalid"}, map[string]*Configuration{
+		"a": tenantConf(t, "/a", "token-a"),
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,190 @@
+package requestorserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// parseNetworks parses a list of CIDR ranges or single IP addresses.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, n := range networks {
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP address %s", n)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "invalid network", 0)
+		}
+		parsed = append(parsed, ipnet)
+	}
+	return parsed, nil
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf *Configuration) initializeNetworks() error {
+	var err error
+	if conf.trustedProxies, err = parseNetworks(conf.TrustedProxies); err != nil {
+		return errors.WrapPrefix(err, "Failed to parse trusted_proxies", 0)
+	}
+	conf.requestorNetworks = map[string][]*net.IPNet{}
+	for name, requestor := range conf.Requestors {
+		if len(requestor.AllowedNetworks) == 0 {
+			continue
+		}
+		if conf.requestorNetworks[name], err = parseNetworks(requestor.AllowedNetworks); err != nil {
+			return errors.WrapPrefix(err, "Failed to parse allowed_networks of requestor "+name, 0)
+		}
+	}
+	return nil
+}
+
+// remoteIP returns the IP address of the client that made the request. If the request was
+// received from a trusted proxy, the X-Forwarded-For header is used to determine the address
+// of the client: it is the rightmost address in the header not belonging to a trusted proxy.
+func (conf *Configuration) remoteIP(r *http.Request) net.IP {
+	ip := peerIP(r)
+	if ip == nil || !networksContain(conf.trustedProxies, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !networksContain(conf.trustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// peerIP returns the IP address of the peer from which the request was received directly. As
+// remoteAddrMiddleware may have replaced the remote address of the request by the address of the
+// client, the original remote address is taken from the request context if present.
+func peerIP(r *http.Request) net.IP {
+	addr, ok := r.Context().Value("peerAddress").(string)
+	if !ok {
+		addr = r.RemoteAddr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// fromTrustedProxy returns whether the request was received directly from a trusted proxy.
+func (conf *Configuration) fromTrustedProxy(r *http.Request) bool {
+	ip := peerIP(r)
+	return ip != nil && networksContain(conf.trustedProxies, ip)
+}
+
+// forwardedHeader returns the first (i.e., set by the outermost proxy) value of the specified
+// X-Forwarded-* header.
+func forwardedHeader(r *http.Request, name string) string {
+	return strings.TrimSpace(strings.Split(r.Header.Get(name), ",")[0])
+}
+
+// externalURL returns the URL (ending in irma/) at which the IRMA app can reach the server, as
+// derived from the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers of the
+// request if it was received from a trusted proxy that set X-Forwarded-Host. Otherwise, or if the
+// headers are invalid, it returns the empty string, meaning that the configured URL is used.
+func (conf *Configuration) externalURL(r *http.Request) string {
+	if !conf.fromTrustedProxy(r) {
+		return ""
+	}
+	host := forwardedHeader(r, "X-Forwarded-Host")
+	if host == "" || strings.ContainsAny(host, "/\\?#@ ") {
+		return ""
+	}
+	proto := strings.ToLower(forwardedHeader(r, "X-Forwarded-Proto"))
+	switch proto {
+	case "":
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	case "http", "https":
+	default:
+		return ""
+	}
+	prefix := strings.TrimSuffix(forwardedHeader(r, "X-Forwarded-Prefix"), "/")
+	if strings.ContainsAny(prefix, "\\?#@ ") || (prefix != "" && prefix[0] != '/') {
+		return ""
+	}
+	return proto + "://" + host + prefix + conf.ClientApiPrefix + "irma/"
+}
+
+// remoteAddrMiddleware replaces the remote address of requests received from a trusted proxy by
+// the address of the client as determined by remoteIP, so that the address of the client is logged.
+// The original remote address is kept in the request context, for fromTrustedProxy and remoteIP.
+func (s *Server) remoteAddrMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := s.config()
+		if conf.fromTrustedProxy(r) {
+			if ip := conf.remoteIP(r); ip != nil {
+				r = r.WithContext(context.WithValue(r.Context(), "peerAddress", r.RemoteAddr))
+				r.RemoteAddr = ip.String()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkNetwork checks whether the request of the requestor originates from one of the networks
+// in the allowed_networks of the requestor, if configured. If not, an error response is written
+// and the denied request is audited.
+func (s *Server) checkNetwork(w http.ResponseWriter, r *http.Request, requestor string, action irma.Action) bool {
+	networks, ok := s.config().requestorNetworks[requestor]
+	if !ok {
+		return true
+	}
+	ip := s.config().remoteIP(r)
+	if ip != nil && networksContain(networks, ip) {
+		return true
+	}
+
+	var addr string
+	if ip != nil {
+		addr = ip.String()
+	}
+	s.config().Logger.WithFields(logrus.Fields{"requestor": requestor, "ip": addr}).Warn("Request of requestor from disallowed network")
+	rerr := server.RemoteError(server.ErrorUnauthorized, "request not allowed from "+addr)
+	s.config().Audit(&server.AuditEvent{
+		Event:         server.AuditRequestDenied,
+		Requestor:     requestor,
+		Action:        action,
+		RemoteAddress: addr,
+		Err:           rerr,
+	})
+	server.WriteResponse(w, nil, rerr)
+	return false
+}
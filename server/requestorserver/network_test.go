@@ -0,0 +1,160 @@
+package requestorserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type auditRecorder struct {
+	events []*server.AuditEvent
+}
+
+func (a *auditRecorder) Audit(event *server.AuditEvent) error {
+	a.events = append(a.events, event)
+	return nil
+}
+
+func TestRemoteIP(t *testing.T) {
+	conf := &Configuration{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}}
+	require.NoError(t, conf.initializeNetworks())
+
+	r := httptest.NewRequest(http.MethodPost, "/session", nil)
+	r.RemoteAddr = "203.0.113.5:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	require.Equal(t, "203.0.113.5", conf.remoteIP(r).String())
+
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 198.51.100.7, 192.168.1.1")
+	require.Equal(t, "198.51.100.7", conf.remoteIP(r).String())
+}
+
+func TestAllowedNetworks(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	audit := &auditRecorder{}
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			AuditSink:   audit,
+		},
+		Port: 48682,
+		Requestors: map[string]Requestor{
+			"myapp": {
+				Permissions:          Permissions{Disclosing: []string{"*"}},
+				AuthenticationMethod: AuthenticationMethodToken,
+				AuthenticationKey:    "myapp",
+				AllowedNetworks:      []string{"192.0.2.0/24", "2001:db8::1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+
+	body := `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+	startSession := func(addr string) int {
+		r := httptest.NewRequest(http.MethodPost, "/session", strings.NewReader(body))
+		r.RemoteAddr = addr
+		r.Header.Set("Authorization", "myapp")
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, startSession("192.0.2.10:1234"))
+	require.Equal(t, http.StatusOK, startSession("[2001:db8::1]:1234"))
+	require.Equal(t, http.StatusForbidden, startSession("198.51.100.7:1234"))
+
+	event := audit.events[len(audit.events)-1]
+	require.Equal(t, server.AuditRequestDenied, event.Event)
+	require.Equal(t, "myapp", event.Requestor)
+	require.Equal(t, "198.51.100.7", event.RemoteAddress)
+
+	_, err = parseNetworks([]string{"not-an-ip"})
+	require.Error(t, err)
+}
+
+func TestExternalURL(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			URL:         "http://localhost:48682",
+		},
+		Port:                           48682,
+		DisableRequestorAuthentication: true,
+		Permissions:                    Permissions{Disclosing: []string{"*"}},
+		TrustedProxies:                 []string{"10.0.0.0/8"},
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+
+	body := `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+	startSession := func(addr string, headers map[string]string) string {
+		r := httptest.NewRequest(http.MethodPost, "/session", strings.NewReader(body))
+		r.RemoteAddr = addr
+		r.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		var pkg server.SessionPackage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pkg))
+		return pkg.SessionPtr.URL
+	}
+
+	forwarded := map[string]string{
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Host":   "irma.example.com, proxy.internal",
+		"X-Forwarded-Prefix": "/irmaserver/",
+	}
+	require.True(t, strings.HasPrefix(startSession("10.1.2.3:1234", forwarded), "https://irma.example.com/irmaserver/irma/session/"))
+	require.True(t, strings.HasPrefix(startSession("10.1.2.3:1234", nil), "http://localhost:48682/irma/session/"))
+
+	// X-Forwarded-For does not prevent the other headers from being used
+	forwarded["X-Forwarded-For"] = "198.51.100.7"
+	require.True(t, strings.HasPrefix(startSession("10.1.2.3:1234", forwarded), "https://irma.example.com/irmaserver/irma/session/"))
+	delete(forwarded, "X-Forwarded-For")
+
+	// Headers from untrusted clients, and invalid headers, are ignored
+	require.True(t, strings.HasPrefix(startSession("203.0.113.5:1234", forwarded), "http://localhost:48682/irma/session/"))
+	require.True(t, strings.HasPrefix(startSession("10.1.2.3:1234", map[string]string{
+		"X-Forwarded-Proto": "javascript",
+		"X-Forwarded-Host":  "irma.example.com",
+	}), "http://localhost:48682/irma/session/"))
+	require.True(t, strings.HasPrefix(startSession("10.1.2.3:1234", map[string]string{
+		"X-Forwarded-Host": "evil.example/path",
+	}), "http://localhost:48682/irma/session/"))
+
+	// The address of the client is determined from X-Forwarded-For
+	var remoteAddr string
+	handler := s.remoteAddrMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	require.Equal(t, "198.51.100.7", remoteAddr)
+
+	// and the peer address remains available after the remote address is replaced
+	handler = s.remoteAddrMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.True(t, s.config().fromTrustedProxy(r))
+		require.Equal(t, "198.51.100.7", s.config().remoteIP(r).String())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+}
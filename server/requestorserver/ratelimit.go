@@ -0,0 +1,193 @@
+package requestorserver
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// concurrentSessionsRetryAfter is the time after which requestors that exceeded their maximum
+// amount of concurrent sessions are advised to try again.
+const concurrentSessionsRetryAfter = 5 * time.Second
+
+// requestorLimiter enforces the max_sessions_per_minute and max_concurrent_sessions limits of
+// requestors. As it keeps track of the sessions in memory, the limits apply per server instance.
+type requestorLimiter struct {
+	sync.Mutex
+	started map[string][]time.Time
+	open    map[string]map[irma.RequestorToken]struct{}
+	pending map[string]int
+	// reservations of next sessions of chained sessions, released when they have been started
+	next map[string][]*sessionReservation
+}
+
+// sessionReservation is a session reserved by reserveSession, together with the concurrent
+// sessions limit of the requestor at the time, so that releasing it is not affected by
+// configuration reloads in the meantime.
+type sessionReservation struct {
+	requestor     string
+	maxConcurrent int
+}
+
+func newRequestorLimiter() *requestorLimiter {
+	return &requestorLimiter{
+		started: map[string][]time.Time{},
+		open:    map[string]map[irma.RequestorToken]struct{}{},
+		pending: map[string]int{},
+		next:    map[string][]*sessionReservation{},
+	}
+}
+
+// reserveSession checks whether the requestor may start a new session and if so, reserves it.
+// If not, it returns how long the requestor should wait before trying again and the reason.
+// The reservation is nil if the requestor has no limits. Each reservation must be followed by
+// a call to releaseSession.
+func (s *Server) reserveSession(requestor string) (*sessionReservation, time.Duration, string) {
+	r, ok := s.config().Requestors[requestor]
+	if !ok || (r.MaxSessionsPerMinute <= 0 && r.MaxConcurrentSessions <= 0) {
+		return nil, 0, ""
+	}
+	if r.MaxConcurrentSessions > 0 {
+		s.pruneOpenSessions(requestor, r.MaxConcurrentSessions)
+	}
+
+	l := s.limiter
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if r.MaxSessionsPerMinute > 0 {
+		started := l.started[requestor]
+		for len(started) > 0 && now.Sub(started[0]) >= time.Minute {
+			started = started[1:]
+		}
+		l.started[requestor] = started
+		if len(started) >= r.MaxSessionsPerMinute {
+			return nil, started[0].Add(time.Minute).Sub(now),
+				fmt.Sprintf("maximum of %d sessions per minute exceeded", r.MaxSessionsPerMinute)
+		}
+	}
+
+	if r.MaxConcurrentSessions > 0 && len(l.open[requestor])+l.pending[requestor] >= r.MaxConcurrentSessions {
+		return nil, concurrentSessionsRetryAfter,
+			fmt.Sprintf("maximum of %d concurrent sessions exceeded", r.MaxConcurrentSessions)
+	}
+
+	if r.MaxSessionsPerMinute > 0 {
+		l.started[requestor] = append(l.started[requestor], now)
+	}
+	l.pending[requestor]++
+	return &sessionReservation{requestor: requestor, maxConcurrent: r.MaxConcurrentSessions}, 0, ""
+}
+
+// releaseSession finishes a reservation made by reserveSession, recording the session as open
+// if it was started successfully (i.e. if the token is nonempty).
+func (s *Server) releaseSession(reservation *sessionReservation, token irma.RequestorToken) {
+	if reservation == nil {
+		return
+	}
+
+	l := s.limiter
+	l.Lock()
+	defer l.Unlock()
+
+	requestor := reservation.requestor
+	l.pending[requestor]--
+	if token == "" || reservation.maxConcurrent <= 0 {
+		return
+	}
+	if l.open[requestor] == nil {
+		l.open[requestor] = map[irma.RequestorToken]struct{}{}
+	}
+	l.open[requestor][token] = struct{}{}
+}
+
+// reserveNextSession reserves the next session of a chained session of the requestor, which is
+// released by releaseNextSession once the IRMA server has started it.
+func (s *Server) reserveNextSession(requestor string) error {
+	reservation, _, reason := s.reserveSession(requestor)
+	if reason != "" {
+		return errors.New("not allowed to start next session: " + reason)
+	}
+	if reservation == nil {
+		return nil
+	}
+	s.limiter.Lock()
+	defer s.limiter.Unlock()
+	s.limiter.next[requestor] = append(s.limiter.next[requestor], reservation)
+	return nil
+}
+
+func (s *Server) releaseNextSession(requestor string, token irma.RequestorToken) {
+	l := s.limiter
+	l.Lock()
+	reservations := l.next[requestor]
+	if len(reservations) == 0 {
+		l.Unlock()
+		return
+	}
+	reservation := reservations[0]
+	if len(reservations) == 1 {
+		delete(l.next, requestor)
+	} else {
+		l.next[requestor] = reservations[1:]
+	}
+	l.Unlock()
+	s.releaseSession(reservation, token)
+}
+
+// pruneOpenSessions removes the sessions of the requestor that have finished or expired, if the
+// requestor has reached its maximum of concurrent sessions. The session store is consulted, since
+// sessions may finish at other server instances; this is done without holding the limiter lock.
+func (s *Server) pruneOpenSessions(requestor string, maxConcurrent int) {
+	l := s.limiter
+	l.Lock()
+	if len(l.open[requestor])+l.pending[requestor] < maxConcurrent {
+		l.Unlock()
+		return
+	}
+	tokens := make([]irma.RequestorToken, 0, len(l.open[requestor]))
+	for token := range l.open[requestor] {
+		tokens = append(tokens, token)
+	}
+	l.Unlock()
+
+	var finished []irma.RequestorToken
+	for _, token := range tokens {
+		res, err := s.irmaserv.GetSessionResult(token)
+		if err != nil || res.Status.Finished() {
+			finished = append(finished, token)
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	for _, token := range finished {
+		delete(l.open[requestor], token)
+	}
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	server.WriteError(w, server.ErrorTooManyRequests, msg)
+}
+
+// checkRateLimit reserves a session for the requestor, or writes a 429 response if the requestor
+// exceeded its limits.
+func (s *Server) checkRateLimit(w http.ResponseWriter, requestor string) (*sessionReservation, bool) {
+	reservation, retryAfter, reason := s.reserveSession(requestor)
+	if reason != "" {
+		s.config().Logger.WithFields(logrus.Fields{"requestor": requestor, "reason": reason}).Warn("Requestor exceeded session limit")
+		writeTooManyRequests(w, retryAfter, reason)
+		return nil, false
+	}
+	return reservation, true
+}
@@ -0,0 +1,120 @@
+package requestorserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionLimits(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		},
+		Port: 48682,
+		Requestors: map[string]Requestor{
+			"limited": {
+				Permissions:           Permissions{Disclosing: []string{"*"}},
+				AuthenticationMethod:  AuthenticationMethodToken,
+				AuthenticationKey:     "limited",
+				MaxSessionsPerMinute:  3,
+				MaxConcurrentSessions: 2,
+			},
+			"unlimited": {
+				Permissions:          Permissions{Disclosing: []string{"*"}},
+				AuthenticationMethod: AuthenticationMethodToken,
+				AuthenticationKey:    "unlimited",
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+
+	body := `{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+	startSession := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/session", strings.NewReader(body))
+		r.Header.Set("Authorization", token)
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	var tokens []irma.RequestorToken
+	for i := 0; i < 2; i++ {
+		w := startSession("limited")
+		require.Equal(t, http.StatusOK, w.Code)
+		var pkg server.SessionPackage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pkg))
+		tokens = append(tokens, pkg.Token)
+	}
+
+	// Too many concurrent sessions
+	w := startSession("limited")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "5", w.Header().Get("Retry-After"))
+
+	// Other requestors are not affected
+	require.Equal(t, http.StatusOK, startSession("unlimited").Code)
+
+	// After a session finishes, the next one can be started
+	require.NoError(t, s.irmaserv.CancelSession(tokens[0]))
+	require.Equal(t, http.StatusOK, startSession("limited").Code)
+
+	// Too many sessions per minute
+	require.NoError(t, s.irmaserv.CancelSession(tokens[1]))
+	w = startSession("limited")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+}
+
+func TestSessionReservations(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	s, err := New(&Configuration{
+		Configuration: &server.Configuration{
+			Logger:      logger,
+			SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		},
+		Port: 48682,
+		Requestors: map[string]Requestor{
+			"limited": {
+				Permissions:           Permissions{Disclosing: []string{"*"}},
+				AuthenticationMethod:  AuthenticationMethodToken,
+				AuthenticationKey:     "limited",
+				MaxConcurrentSessions: 1,
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer s.irmaserv.Stop()
+
+	// Releasing a reservation is not affected by removing the limits in the meantime
+	reservation, _, reason := s.reserveSession("limited")
+	require.Empty(t, reason)
+	r := s.config().Requestors["limited"]
+	s.config().Requestors["limited"] = Requestor{Permissions: r.Permissions, AuthenticationMethod: r.AuthenticationMethod, AuthenticationKey: r.AuthenticationKey}
+	s.releaseSession(reservation, "")
+	require.Zero(t, s.limiter.pending["limited"])
+	s.config().Requestors["limited"] = r
+
+	// Next sessions of chained sessions count towards the limits
+	require.NoError(t, s.reserveNextSession("limited"))
+	require.Error(t, s.reserveNextSession("limited"))
+	s.releaseNextSession("limited", "token")
+	require.Zero(t, s.limiter.pending["limited"])
+	require.Contains(t, s.limiter.open["limited"], irma.RequestorToken("token"))
+	require.Empty(t, s.limiter.next)
+}
@@ -14,10 +14,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
+	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
@@ -29,18 +32,27 @@ import (
 // Server is a requestor server instance.
 type Server struct {
 	conf     *Configuration
+	confLock sync.RWMutex
 	irmaserv *irmaserver.Server
 	stop     chan struct{}
 	stopped  chan struct{}
+	limiter  *requestorLimiter
+}
+
+// config returns the current configuration of the server, which is replaced when it is reloaded.
+func (s *Server) config() *Configuration {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.conf
 }
 
 // Start the server. If successful then it will not return until Stop() is called.
 func (s *Server) Start(config *Configuration) error {
-	if s.conf.LogJSON {
-		s.conf.Logger.WithField("configuration", s.conf).Debug("Configuration")
+	if s.config().LogJSON {
+		s.config().Logger.WithField("configuration", s.config()).Debug("Configuration")
 	} else {
-		bts, _ := json.MarshalIndent(s.conf, "", "   ")
-		s.conf.Logger.Debug("Configuration: ", string(bts), "\n")
+		bts, _ := json.MarshalIndent(s.config(), "", "   ")
+		s.config().Logger.Debug("Configuration: ", string(bts), "\n")
 	}
 
 	// We start either one or two servers, depending on whether a separate client server is enabled, such that:
@@ -51,19 +63,21 @@ func (s *Server) Start(config *Configuration) error {
 	// - any unexpected error is dealt with here instead of when stopping using Stop().
 	// Inspired by https://dave.cheney.net/practical-go/presentations/qcon-china.html#_never_start_a_goroutine_without_when_it_will_stop
 
-	count := 1
-	if s.conf.separateClientServer() {
-		count = 2
-	}
+	count := s.serverCount()
 	done := make(chan error, count)
 	s.stop = make(chan struct{})
 	s.stopped = make(chan struct{}, count)
 
-	if s.conf.separateClientServer() {
+	if s.config().separateClientServer() {
 		go func() {
 			done <- s.startClientServer()
 		}()
 	}
+	if s.config().AcmeHTTPPort != 0 {
+		go func() {
+			done <- s.startAcmeServer()
+		}()
+	}
 	go func() {
 		done <- s.startRequestorServer()
 	}()
@@ -84,18 +98,36 @@ func (s *Server) Start(config *Configuration) error {
 }
 
 func (s *Server) startRequestorServer() error {
-	tlsConf, _ := s.conf.tlsConfig()
-	return s.startServer(s.Handler(), "Server", s.conf.ListenAddress, s.conf.Port, tlsConf)
+	tlsConf, _ := s.config().tlsConfig()
+	return s.startServer(s.Handler(), "Server", s.config().ListenAddress, s.config().Port, s.config().ApiPrefix, tlsConf)
 }
 
 func (s *Server) startClientServer() error {
-	tlsConf, _ := s.conf.clientTlsConfig()
-	return s.startServer(s.ClientHandler(), "Client server", s.conf.ClientListenAddress, s.conf.ClientPort, tlsConf)
+	tlsConf, _ := s.config().clientTlsConfig()
+	return s.startServer(s.ClientHandler(), "Client server", s.config().ClientListenAddress, s.config().ClientPort, s.config().ClientApiPrefix, tlsConf)
+}
+
+// startAcmeServer starts a server answering ACME HTTP-01 challenges, which redirects all other
+// requests to HTTPS.
+func (s *Server) startAcmeServer() error {
+	return s.startServer(s.config().acme.HTTPHandler(nil), "ACME HTTP-01 server", s.config().ListenAddress, s.config().AcmeHTTPPort, "/", nil)
 }
 
-func (s *Server) startServer(handler http.Handler, name, addr string, port int, tlsConf *tls.Config) error {
+// serverCount returns the number of servers started by Start.
+func (s *Server) serverCount() int {
+	count := 1
+	if s.config().separateClientServer() {
+		count++
+	}
+	if s.config().AcmeHTTPPort != 0 {
+		count++
+	}
+	return count
+}
+
+func (s *Server) startServer(handler http.Handler, name, addr string, port int, prefix string, tlsConf *tls.Config) error {
 	fulladdr := fmt.Sprintf("%s:%d", addr, port)
-	s.conf.Logger.Info(name, " listening at ", fulladdr, s.conf.ApiPrefix)
+	s.config().Logger.Info(name, " listening at ", fulladdr, prefix)
 
 	serv := &http.Server{
 		Addr:      fulladdr,
@@ -117,23 +149,45 @@ func (s *Server) startServer(handler http.Handler, name, addr string, port int,
 	}()
 
 	if tlsConf != nil {
-		s.conf.Logger.Info(name, " TLS enabled")
+		s.config().Logger.Info(name, " TLS enabled")
 		return server.FilterStopError(serv.ListenAndServeTLS("", ""))
 	} else {
 		return server.FilterStopError(serv.ListenAndServe())
 	}
 }
 
+// Drain stops the server from accepting new sessions, and waits until the sessions in progress
+// have finished or until the drain timeout of the configuration elapses (see irmaserver.Server.Drain).
+// Afterwards, Stop should be called.
+func (s *Server) Drain() {
+	if s.config().DrainTimeout > 0 {
+		s.irmaserv.Drain(time.Duration(s.config().DrainTimeout) * time.Second)
+	}
+}
+
 func (s *Server) Stop() {
 	s.irmaserv.Stop()
 	s.stop <- struct{}{}
-	<-s.stopped
-	if s.conf.separateClientServer() {
+	for i := 0; i < s.serverCount(); i++ {
 		<-s.stopped
 	}
 }
 
 func New(config *Configuration) (*Server, error) {
+	s := &Server{
+		conf:    config,
+		limiter: newRequestorLimiter(),
+	}
+	config.Configuration.AuthorizeNextSession = func(requestor string, request irma.RequestorRequest) error {
+		if err := s.config().authorizeNextSession(requestor, request); err != nil {
+			return err
+		}
+		return s.reserveNextSession(requestor)
+	}
+	config.Configuration.NextSessionStarted = s.releaseNextSession
+	config.Configuration.ExternalURL = func(r *http.Request) string {
+		return s.config().externalURL(r)
+	}
 	irmaserv, err := irmaserver.New(config.Configuration)
 	if err != nil {
 		return nil, err
@@ -141,10 +195,48 @@ func New(config *Configuration) (*Server, error) {
 	if err := config.initialize(); err != nil {
 		return nil, err
 	}
-	return &Server{
-		conf:     config,
-		irmaserv: irmaserv,
-	}, nil
+	s.irmaserv = irmaserv
+	return s, nil
+}
+
+// Reload replaces the requestor configuration of the server, i.e. the requestors with their keys,
+// permissions, limits and allowed networks, the global permissions and the trusted proxies, by those
+// of the specified configuration; its other options are ignored. The new configuration is validated
+// first: if it is invalid, an error is returned and the current configuration remains in use.
+// Sessions in progress are not affected.
+func (s *Server) Reload(config *Configuration) error {
+	newconf, err := s.reloadedConfig(config)
+	if err != nil {
+		return err
+	}
+	s.applyConfig(newconf)
+	return nil
+}
+
+func (s *Server) reloadedConfig(config *Configuration) (*Configuration, error) {
+	current := s.config()
+	if current.DisableRequestorAuthentication {
+		return nil, errors.New("Cannot reload requestors when requestor authentication is disabled")
+	}
+
+	newconf := *current
+	newconf.Requestors = config.Requestors
+	newconf.Permissions = config.Permissions
+	newconf.TrustedProxies = config.TrustedProxies
+	if newconf.clientCertificateAuthentication() && !current.clientCertificateAuthentication() {
+		return nil, errors.Errorf("Cannot reload requestors: enabling the %s authentication method requires a restart", AuthenticationMethodTLS)
+	}
+	if err := newconf.initializeRequestors(); err != nil {
+		return nil, err
+	}
+	return &newconf, nil
+}
+
+func (s *Server) applyConfig(config *Configuration) {
+	s.confLock.Lock()
+	s.conf = config
+	s.confLock.Unlock()
+	config.Logger.WithField("requestors", len(config.Requestors)).Info("Reloaded requestor configuration")
 }
 
 var corsOptions = cors.Options{
@@ -153,24 +245,50 @@ var corsOptions = cors.Options{
 	AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
 }
 
-func (s *Server) prefixRouter(router *chi.Mux) (prefixedRouter *chi.Mux) {
+// clientCorsOptions returns the CORS policy of the endpoints for the IRMA app and frontends,
+// which defaults to corsOptions for the options that are not configured.
+func (conf *Configuration) clientCorsOptions() cors.Options {
+	options := corsOptions
+	if len(conf.CORSAllowedOrigins) > 0 {
+		options.AllowedOrigins = conf.CORSAllowedOrigins
+	}
+	if len(conf.CORSAllowedMethods) > 0 {
+		options.AllowedMethods = conf.CORSAllowedMethods
+	}
+	if len(conf.CORSAllowedHeaders) > 0 {
+		options.AllowedHeaders = conf.CORSAllowedHeaders
+	}
+	return options
+}
+
+// prefixRouter mounts the requestor endpoints, if any, at the API prefix and the client
+// endpoints, if any, at the client API prefix.
+func (s *Server) prefixRouter(router, clientRouter *chi.Mux) (prefixedRouter *chi.Mux) {
 	prefixedRouter = chi.NewRouter()
-	prefixedRouter.Mount(s.conf.ApiPrefix, router)
+	prefixedRouter.Use(s.remoteAddrMiddleware)
+	if router != nil {
+		prefixedRouter.Mount(s.config().ApiPrefix, router)
+	}
+	if clientRouter != nil {
+		prefixedRouter.Mount(s.config().ClientApiPrefix, clientRouter)
+	}
 	return
 }
 
 func (s *Server) ClientHandler() http.Handler {
 	router := chi.NewRouter()
-	router.Use(cors.New(corsOptions).Handler)
 	s.attachClientEndpoints(router)
-	return s.prefixRouter(router)
+	return s.prefixRouter(nil, router)
 }
 
 func (s *Server) attachClientEndpoints(router *chi.Mux) {
-	router.Mount("/irma/", s.irmaserv.HandlerFunc())
-	if s.conf.StaticPath != "" {
-		router.Mount(s.conf.StaticPrefix, s.StaticFilesHandler())
-	}
+	router.Group(func(r chi.Router) {
+		r.Use(cors.New(s.config().clientCorsOptions()).Handler)
+		r.Mount("/irma/", s.irmaserv.HandlerFunc())
+		if s.config().StaticPath != "" {
+			r.Mount(s.config().StaticPrefix, s.StaticFilesHandler())
+		}
+	})
 }
 
 // Handler returns a http.Handler that handles all IRMA requestor messages
@@ -178,11 +296,17 @@ func (s *Server) attachClientEndpoints(router *chi.Mux) {
 func (s *Server) Handler() http.Handler {
 	router := chi.NewRouter()
 	router.Use(server.RecoverMiddleware)
-	router.Use(cors.New(corsOptions).Handler)
 
-	if !s.conf.separateClientServer() {
-		// Mount server for irmaclient
-		s.attachClientEndpoints(router)
+	// Mount server for irmaclient, under the API prefix or under its own prefix
+	var clientRouter *chi.Mux
+	if !s.config().separateClientServer() {
+		if s.config().ClientApiPrefix == s.config().ApiPrefix {
+			s.attachClientEndpoints(router)
+		} else {
+			clientRouter = chi.NewRouter()
+			clientRouter.Use(server.RecoverMiddleware)
+			s.attachClientEndpoints(clientRouter)
+		}
 	}
 
 	log := server.LogOptions{Response: true, Headers: true, From: true}
@@ -193,7 +317,7 @@ func (s *Server) Handler() http.Handler {
 	// while not adding it to the endpoints already added above (which do their own logging).
 
 	router.Group(func(r chi.Router) {
-		r.Use(server.SizeLimitMiddleware)
+		r.Use(server.BodySizeLimitMiddleware(s.config().MaxRequestSize))
 		r.Use(server.TimeoutMiddleware([]string{"/statusevents"}, server.WriteTimeout))
 		r.Use(cors.New(corsOptions).Handler)
 		r.Use(server.LogMiddleware("requestor", log))
@@ -213,37 +337,70 @@ func (s *Server) Handler() http.Handler {
 			})
 		})
 
+		r.Post("/result", s.handleResultHistory)
 		r.Get("/publickey", s.handlePublicKey)
+		r.Get("/.well-known/jwks.json", s.handleJwks)
 	})
 
+	if s.config().AdminToken != "" {
+		router.Group(func(r chi.Router) {
+			r.Use(server.BodySizeLimitMiddleware(s.config().MaxRequestSize))
+			r.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
+			// Don't log headers, which contain the admin token
+			r.Use(server.LogMiddleware("admin", server.LogOptions{Response: true, From: true}))
+			r.Route("/admin", s.attachAdminEndpoints)
+		})
+	}
+
 	router.Group(func(r chi.Router) {
-		r.Use(server.SizeLimitMiddleware)
+		r.Use(server.BodySizeLimitMiddleware(s.config().MaxRequestSize))
 		r.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
 		r.Use(cors.New(corsOptions).Handler)
 		r.Use(server.LogMiddleware("revocation", log))
 		r.Post("/revocation", s.handleRevocation)
 	})
 
-	return s.prefixRouter(router)
+	// Health and readiness probes, e.g. for Kubernetes
+	router.Group(func(r chi.Router) {
+		r.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
+		r.Get("/health", s.irmaserv.HealthHandler().ServeHTTP)
+		r.Get("/ready", s.irmaserv.ReadyHandler().ServeHTTP)
+	})
+
+	if s.config().EnableMetrics {
+		router.Group(func(r chi.Router) {
+			r.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
+			r.Get("/metrics", s.irmaserv.MetricsHandler().ServeHTTP)
+		})
+	}
+
+	if s.config().EnableStats {
+		router.Group(func(r chi.Router) {
+			r.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
+			r.Get("/stats", s.irmaserv.StatsHandler().ServeHTTP)
+		})
+	}
+
+	return s.prefixRouter(router, clientRouter)
 }
 
 func (s *Server) StaticFilesHandler() http.Handler {
-	if len(s.conf.URL) > 6 {
-		url := s.conf.URL[:len(s.conf.URL)-6] + s.conf.StaticPrefix
-		s.conf.Logger.Infof("Hosting files at %s under %s", s.conf.StaticPath, url)
+	if len(s.config().URL) > 6 {
+		url := s.config().URL[:len(s.config().URL)-6] + s.config().StaticPrefix
+		s.config().Logger.Infof("Hosting files at %s under %s", s.config().StaticPath, url)
 	} else { // URL not known, don't log it but otherwise continue
-		s.conf.Logger.Infof("Hosting files at %s", s.conf.StaticPath)
+		s.config().Logger.Infof("Hosting files at %s", s.config().StaticPath)
 	}
 	opts := server.LogOptions{Response: false, Headers: false, From: false}
-	return http.StripPrefix(s.conf.StaticPrefix, server.LogMiddleware("static", opts)(
-		http.FileServer(http.Dir(s.conf.StaticPath))),
+	return http.StripPrefix(s.config().StaticPrefix, server.LogMiddleware("static", opts)(
+		http.FileServer(http.Dir(s.config().StaticPath))),
 	)
 }
 
 func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		s.conf.Logger.Error("Could not read session request HTTP POST body")
+		s.config().Logger.Error("Could not read session request HTTP POST body")
 		_ = server.LogError(err)
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
@@ -258,8 +415,12 @@ func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 		rerr      *irma.RemoteError
 		applies   bool
 	)
-	for _, authenticator := range authenticators { // rrequest abbreviates "requestor request"
-		applies, rrequest, requestor, rerr = authenticator.AuthenticateSession(r.Header, body)
+	for _, authenticator := range s.config().authenticators { // rrequest abbreviates "requestor request"
+		if cauth, ok := authenticator.(*ClientCertificateAuthenticator); ok {
+			applies, rrequest, requestor, rerr = cauth.AuthenticateSessionTLS(r.TLS, r.Header, body)
+		} else {
+			applies, rrequest, requestor, rerr = authenticator.AuthenticateSession(r.Header, body)
+		}
 		if applies || rerr != nil {
 			break
 		}
@@ -267,8 +428,35 @@ func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 	if ok := s.checkAuth(w, r, rerr, applies, body); !ok {
 		return
 	}
+	if ok := s.checkNetwork(w, r, requestor, rrequest.SessionRequest().Action()); !ok {
+		return
+	}
+	if ok := s.checkKnownFields(w, r, body, rrequest, rrequest.SessionRequest()); !ok {
+		return
+	}
+
+	s.createSession(w, r, requestor, rrequest)
+}
 
-	s.createSession(w, requestor, rrequest)
+// checkKnownFields checks, if strict decoding is enabled, that the JSON body of the request
+// contains no fields unknown to the server, i.e., that it fits one of the specified messages into
+// which it was parsed. If not, an error response is written.
+func (s *Server) checkKnownFields(w http.ResponseWriter, r *http.Request, body []byte, messages ...interface{}) bool {
+	if !s.config().StrictDecoding || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return true
+	}
+	var firstErr error
+	for _, msg := range messages {
+		err := server.CheckKnownFields(body, msg)
+		if err == nil {
+			return true
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	server.WriteError(w, server.ErrorInvalidRequest, firstErr.Error())
+	return false
 }
 
 func (s *Server) tokenMiddleware(next http.Handler) http.Handler {
@@ -286,7 +474,7 @@ func (s *Server) tokenMiddleware(next http.Handler) http.Handler {
 func (s *Server) handleRevocation(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		s.conf.Logger.Error("Could not read revocation request HTTP POST body")
+		s.config().Logger.Error("Could not read revocation request HTTP POST body")
 		_ = server.LogError(err)
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
@@ -298,8 +486,12 @@ func (s *Server) handleRevocation(w http.ResponseWriter, r *http.Request) {
 		rerr      *irma.RemoteError
 		applies   bool
 	)
-	for _, authenticator := range authenticators {
-		applies, revreq, requestor, rerr = authenticator.AuthenticateRevocation(r.Header, body)
+	for _, authenticator := range s.config().authenticators {
+		if cauth, ok := authenticator.(*ClientCertificateAuthenticator); ok {
+			applies, revreq, requestor, rerr = cauth.AuthenticateRevocationTLS(r.TLS, r.Header, body)
+		} else {
+			applies, revreq, requestor, rerr = authenticator.AuthenticateRevocation(r.Header, body)
+		}
 		if applies || rerr != nil {
 			break
 		}
@@ -307,10 +499,61 @@ func (s *Server) handleRevocation(w http.ResponseWriter, r *http.Request) {
 	if ok := s.checkAuth(w, r, rerr, applies, body); !ok {
 		return
 	}
+	if ok := s.checkNetwork(w, r, requestor, irma.ActionRevoking); !ok {
+		return
+	}
+	if ok := s.checkKnownFields(w, r, body, revreq); !ok {
+		return
+	}
 
 	s.revoke(w, requestor, revreq)
 }
 
+// handleResultHistory returns the results of the sessions of the authenticated requestor that
+// finished since the time specified in the request, as far as they are still retained.
+func (s *Server) handleResultHistory(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.config().Logger.Error("Could not read results request HTTP POST body")
+		_ = server.LogError(err)
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	var (
+		resreq    *irma.ResultsRequest
+		requestor string
+		rerr      *irma.RemoteError
+		applies   bool
+	)
+	for _, authenticator := range s.config().authenticators {
+		if cauth, ok := authenticator.(*ClientCertificateAuthenticator); ok {
+			applies, resreq, requestor, rerr = cauth.AuthenticateResultsTLS(r.TLS, r.Header, body)
+		} else {
+			applies, resreq, requestor, rerr = authenticator.AuthenticateResults(r.Header, body)
+		}
+		if applies || rerr != nil {
+			break
+		}
+	}
+	if ok := s.checkAuth(w, r, rerr, applies, body); !ok {
+		return
+	}
+	if ok := s.checkNetwork(w, r, requestor, ""); !ok {
+		return
+	}
+	if ok := s.checkKnownFields(w, r, body, resreq); !ok {
+		return
+	}
+
+	results, err := s.irmaserv.SessionResults(requestor, resreq.Since)
+	if err != nil {
+		mapToServerError(w, err)
+		return
+	}
+	server.WriteJson(w, results)
+}
+
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	requestorToken := r.Context().Value("requestorToken").(irma.RequestorToken)
 
@@ -326,7 +569,7 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
 	requestorToken := r.Context().Value("requestorToken").(irma.RequestorToken)
 
-	s.conf.Logger.WithFields(logrus.Fields{"session": requestorToken}).Debug("new client subscribed to server sent events")
+	s.config().Logger.WithFields(logrus.Fields{"session": requestorToken}).Debug("new client subscribed to server sent events")
 	r = r.WithContext(context.WithValue(r.Context(), "sse", common.SSECtx{
 		Component: server.ComponentSession,
 		Arg:       string(requestorToken),
@@ -366,8 +609,8 @@ func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
-	if s.conf.JwtRSAPrivateKey == nil {
-		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
+	if s.config().JwtSigner == nil {
+		s.config().Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
 	}
@@ -386,13 +629,9 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	j, err := server.ResultJwt(res,
-		s.conf.JwtIssuer,
-		request.Base().ResultJwtValidity,
-		s.conf.JwtRSAPrivateKey,
-	)
+	j, err := s.config().ResultJwt(res, request.Base().ResultJwtValidity)
 	if err != nil {
-		s.conf.Logger.Error("Failed to sign session result JWT")
+		s.config().Logger.Error("Failed to sign session result JWT")
 		_ = server.LogError(err)
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
@@ -401,8 +640,8 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
-	if s.conf.JwtRSAPrivateKey == nil {
-		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
+	if s.config().JwtSigner == nil {
+		s.config().Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
 	}
@@ -429,8 +668,11 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	claims["iat"] = time.Now().Unix()
-	if s.conf.JwtIssuer != "" {
-		claims["iss"] = s.conf.JwtIssuer
+	if s.config().JwtIssuer != "" {
+		claims["iss"] = s.config().JwtIssuer
+	}
+	if s.config().JwtAudience != "" {
+		claims["aud"] = s.config().JwtAudience
 	}
 	claims["status"] = res.ProofStatus
 
@@ -457,10 +699,9 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	resultJwt, err := token.SignedString(s.conf.JwtRSAPrivateKey)
+	resultJwt, err := server.SignJwt(claims, s.config().JwtSigner)
 	if err != nil {
-		s.conf.Logger.Error("Failed to sign session result JWT")
+		s.config().Logger.Error("Failed to sign session result JWT")
 		_ = server.LogError(err)
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
@@ -469,12 +710,12 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
-	if s.conf.JwtRSAPrivateKey == nil {
+	if s.config().JwtSigner == nil {
 		server.WriteError(w, server.ErrorUnsupported, "")
 		return
 	}
 
-	bts, err := x509.MarshalPKIXPublicKey(&s.conf.JwtRSAPrivateKey.PublicKey)
+	bts, err := x509.MarshalPKIXPublicKey(s.config().JwtSigner.Public())
 	if err != nil {
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
@@ -486,36 +727,36 @@ func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(pubBytes)
 }
 
-func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest irma.RequestorRequest) {
+func (s *Server) handleJwks(w http.ResponseWriter, r *http.Request) {
+	if s.config().JwtSigner == nil {
+		server.WriteError(w, server.ErrorUnsupported, "")
+		return
+	}
+	set, err := s.config().JwkSet()
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	server.WriteJson(w, set)
+}
+
+func (s *Server) createSession(w http.ResponseWriter, r *http.Request, requestor string, rrequest irma.RequestorRequest) {
 	// Authorize request: check if the requestor is allowed to verify or issue
 	// the requested attributes or credentials
 	request := rrequest.SessionRequest()
-	if request.Action() == irma.ActionIssuing {
-		allowed, reason := s.conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials)
-		if !allowed {
-			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
-				Warn("Requestor not authorized to issue credential; full request: ", server.ToJson(request))
-			server.WriteError(w, server.ErrorUnauthorized, reason)
-			return
-		}
-	}
-
-	condiscon := request.Disclosure().Disclose
-	if len(condiscon) > 0 {
-		allowed, reason := s.conf.CanVerifyOrSign(requestor, request.Action(), condiscon)
-		if !allowed {
-			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
-				Warn("Requestor not authorized to verify attribute; full request: ", server.ToJson(request))
-			server.WriteError(w, server.ErrorUnauthorized, reason)
-			return
-		}
+	if err := s.config().CheckPermissions(requestor, request); err != nil {
+		s.config().Logger.WithFields(logrus.Fields{"requestor": requestor, "denied": err.(*PermissionError).Denied}).
+			Warn("Requestor not authorized for session request; full request: ", server.ToJson(request))
+		server.WriteError(w, server.ErrorUnauthorized, err.Error())
+		return
 	}
 
 	if rrequest.Base().NextSession != nil && rrequest.Base().NextSession.URL == "" {
-		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("nextSession provided with empty URL")
+		s.config().Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("nextSession provided with empty URL")
 		server.WriteError(w, server.ErrorInvalidRequest, "nextSession provided with empty URL")
+		return
 	}
-	if s.conf.JwtRSAPrivateKey == nil && !s.conf.AllowUnsignedCallbacks {
+	if s.config().JwtSigner == nil && !s.config().AllowUnsignedCallbacks {
 		var field string
 		if rrequest.Base().CallbackURL != "" {
 			field = "callbackUrl"
@@ -524,22 +765,40 @@ func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest
 		}
 		if field != "" {
 			errormsg := field + " provided but no JWT private key is installed: either install JWT or enable allow_unsigned_callbacks in configuration"
-			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn(errormsg)
+			s.config().Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn(errormsg)
 			server.WriteError(w, server.ErrorUnsupported, errormsg)
 			return
 		}
 	}
 
+	reservation, ok := s.checkRateLimit(w, requestor)
+	if !ok {
+		return
+	}
+
 	// Everything is authenticated and parsed, we're good to go!
-	qr, requestorToken, frontendRequest, err := s.irmaserv.StartSession(rrequest, nil)
+	qr, requestorToken, frontendRequest, err := s.irmaserv.StartRequestorSession(requestor, rrequest, nil)
+	s.releaseSession(reservation, requestorToken)
+	if err == irmaserver.ErrDraining {
+		server.WriteError(w, server.ErrorShuttingDown, "")
+		return
+	}
 	if err != nil {
-		if _, ok := err.(*irmaserver.RedisError); ok {
+		switch err.(type) {
+		case *irmaserver.RedisError, *irmaserver.PostgresError, *irmaserver.SessionStoreError:
 			server.WriteError(w, server.ErrorInternal, "")
-		} else {
+		default:
 			server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		}
 		return
 	}
+	// If the IRMA app reaches the server through the same reverse proxy as the requestor,
+	// use the URL of the server as seen by the proxy
+	if !s.config().separateClientServer() {
+		if url := s.config().externalURL(r); url != "" && strings.HasPrefix(qr.URL, s.config().URL) {
+			qr.URL = url + strings.TrimPrefix(qr.URL, s.config().URL)
+		}
+	}
 
 	server.WriteJson(w, server.SessionPackage{
 		SessionPtr:      qr,
@@ -549,9 +808,9 @@ func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest
 }
 
 func (s *Server) revoke(w http.ResponseWriter, requestor string, request *irma.RevocationRequest) {
-	allowed, reason := s.conf.CanRevoke(requestor, request.CredentialType)
+	allowed, reason := s.config().CanRevoke(requestor, request.CredentialType)
 	if !allowed {
-		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "message": reason}).
+		s.config().Logger.WithFields(logrus.Fields{"requestor": requestor, "message": reason}).
 			Warn("Requestor not authorized to revoke credential; full request: ", server.ToJson(request))
 		server.WriteError(w, server.ErrorUnauthorized, reason)
 		return
@@ -580,11 +839,11 @@ func (s *Server) checkAuth(w http.ResponseWriter, r *http.Request, rerr *irma.Re
 	if !applies {
 		var ctype = r.Header.Get("Content-Type")
 		if !regexp.MustCompile("^application/json").MatchString(ctype) && !regexp.MustCompile("^text/plain").MatchString(ctype) {
-			s.conf.Logger.Warnf("Session request uses unsupported Content-Type: %s", ctype)
+			s.config().Logger.Warnf("Session request uses unsupported Content-Type: %s", ctype)
 			server.WriteError(w, server.ErrorInvalidRequest, "Unsupported Content-Type: "+ctype)
 			return false
 		}
-		s.conf.Logger.Warnf("Session request uses unknown authentication method")
+		s.config().Logger.Warnf("Session request uses unknown authentication method")
 		server.WriteError(w, server.ErrorInvalidRequest, "request could not be authenticated")
 		return false
 	}
@@ -592,9 +851,12 @@ func (s *Server) checkAuth(w http.ResponseWriter, r *http.Request, rerr *irma.Re
 }
 
 func mapToServerError(w http.ResponseWriter, err error) {
-	if _, ok := err.(*irmaserver.UnknownSessionError); ok {
+	switch err.(type) {
+	case *irmaserver.UnknownSessionError:
 		server.WriteError(w, server.ErrorSessionUnknown, "")
-	} else {
+	case *irmaserver.SessionFinishedError:
+		server.WriteError(w, server.ErrorUnexpectedRequest, err.Error())
+	default:
 		server.WriteError(w, server.ErrorInternal, "")
 	}
 }
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// SessionCipher encrypts sessions before they are stored in a persistent session store (Redis,
+// PostgreSQL or a custom session store), and decrypts them after they are loaded. Sessions contain
+// the attributes disclosed in them, so encrypting them prevents a dump of the store from revealing
+// these attributes. The additional data, consisting of the client token of the session, must be
+// authenticated along with the ciphertext, so that the encrypted data of one session cannot be
+// substituted for that of another.
+type SessionCipher interface {
+	Encrypt(plaintext, additionalData []byte) ([]byte, error)
+	Decrypt(ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// AESGCMCipher is a SessionCipher using AES-GCM. The ciphertext consists of the random nonce
+// followed by the sealed plaintext.
+type AESGCMCipher struct {
+	aead cipher.AEAD
+	// Ciphers of previous keys, with which sessions that were encrypted before rotating the key
+	// can still be decrypted
+	decryption []cipher.AEAD
+}
+
+// NewAESGCMCipher returns an AESGCMCipher using the specified AES key of 16, 24 or 32 bytes.
+// Sessions are encrypted using the key, and decrypted using the key or else using one of the
+// decryption keys, allowing the key to be rotated without losing sessions encrypted with
+// previous keys.
+func NewAESGCMCipher(key []byte, decryptionKeys ...[]byte) (*AESGCMCipher, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	c := &AESGCMCipher{aead: aead}
+	for _, k := range decryptionKeys {
+		if aead, err = newAESGCM(k); err != nil {
+			return nil, err
+		}
+		c.decryption = append(c.decryption, aead)
+	}
+	return c, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *AESGCMCipher) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func (c *AESGCMCipher) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	size := c.aead.NonceSize()
+	if len(ciphertext) < size {
+		return nil, errors.New("session ciphertext too short")
+	}
+	plaintext, err := c.aead.Open(nil, ciphertext[:size], ciphertext[size:], additionalData)
+	for _, aead := range c.decryption {
+		if err == nil {
+			break
+		}
+		plaintext, err = aead.Open(nil, ciphertext[:size], ciphertext[size:], additionalData)
+	}
+	return plaintext, err
+}
+
+func (conf *Configuration) verifySessionEncryption() error {
+	if conf.SessionCipher == nil && (conf.SessionEncryptionKey != "" || conf.SessionEncryptionKeyFile != "") {
+		keybytes, err := common.ReadKey(conf.SessionEncryptionKey, conf.SessionEncryptionKeyFile)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read session encryption key", 0)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(keybytes)))
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to decode session encryption key (must be base64)", 0)
+		}
+		decryptionKeys := make([][]byte, 0, len(conf.SessionDecryptionKeys))
+		for _, k := range conf.SessionDecryptionKeys {
+			decryptionKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(k))
+			if err != nil {
+				return errors.WrapPrefix(err, "failed to decode session decryption key (must be base64)", 0)
+			}
+			decryptionKeys = append(decryptionKeys, decryptionKey)
+		}
+		if conf.SessionCipher, err = NewAESGCMCipher(key, decryptionKeys...); err != nil {
+			return errors.WrapPrefix(err, "invalid session encryption or decryption key", 0)
+		}
+	} else if len(conf.SessionDecryptionKeys) > 0 {
+		return errors.New("session decryption keys require a session encryption key")
+	}
+	if conf.SessionCipher != nil && (conf.StoreType == "" || conf.StoreType == "memory") {
+		conf.Logger.Warn("Session encryption is configured but has no effect with the memory session store")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// UnmarshalValidateStrict unmarshals and validates the JSON message into dest like
+// irma.UnmarshalValidate, but first checks using CheckKnownFields that the message contains
+// no fields that dest does not know.
+func UnmarshalValidateStrict(data []byte, dest interface{}) error {
+	if err := CheckKnownFields(data, dest); err != nil {
+		return err
+	}
+	return irma.UnmarshalValidate(data, dest)
+}
+
+// CheckKnownFields checks that all fields of the JSON objects in the message occur in the type of
+// dest (or the types of its fields, recursively) into which they would be unmarshaled, so that
+// no fields can be smuggled past the server. As with encoding/json, field names are matched case
+// insensitively. Values unmarshaled into interface types are not checked. Objects are always
+// checked against the fields of the struct into which they are unmarshaled, also if the struct
+// has a custom JSON unmarshaler, so that legacy message formats are rejected.
+func CheckKnownFields(data []byte, dest interface{}) error {
+	return checkKnownFields(data, reflect.TypeOf(dest), "")
+}
+
+func checkKnownFields(data json.RawMessage, typ reflect.Type, path string) error {
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil {
+		return nil
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		if data[0] != '{' {
+			return nil // not an object, left to (custom) unmarshaler
+		}
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		fields := map[string]reflect.Type{}
+		jsonFields(typ, fields)
+		for key, value := range obj {
+			fieldtyp, ok := fields[strings.ToLower(key)]
+			if !ok {
+				return errors.Errorf("unknown field %s", fieldPath(path, key))
+			}
+			if err := checkKnownFields(value, fieldtyp, fieldPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if data[0] != '{' {
+			return nil
+		}
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+		for key, value := range obj {
+			if err := checkKnownFields(value, typ.Elem(), fieldPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if data[0] != '[' {
+			return nil
+		}
+		var arr []json.RawMessage
+		if err := json.Unmarshal(data, &arr); err != nil {
+			return err
+		}
+		for i, value := range arr {
+			if err := checkKnownFields(value, typ.Elem(), path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fieldPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// jsonFields adds the JSON field names (lowercased) of the struct type to fields, including
+// those of embedded structs, mapped to their types.
+func jsonFields(typ reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue // unexported
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		fieldtyp := f.Type
+		if f.Anonymous && name == "" {
+			if fieldtyp.Kind() == reflect.Ptr {
+				fieldtyp = fieldtyp.Elem()
+			}
+			if fieldtyp.Kind() == reflect.Struct {
+				jsonFields(fieldtyp, fields)
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+}
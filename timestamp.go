@@ -71,7 +71,7 @@ func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int, n
 
 		// Determine timestamp server that should be used
 		schemeId := meta.CredentialType().SchemeManagerIdentifier()
-		tss := conf.SchemeManagers[schemeId].TimestampServer
+		tss := conf.GetSchemeManagers()[schemeId].TimestampServer
 		if tss == "" {
 			return nil, "", errors.Errorf("No timestamp server specified in scheme %s", schemeId.String())
 		}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	mathrand "math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -38,6 +39,27 @@ type HTTPTransport struct {
 
 var HTTPHeaders = map[string]http.Header{}
 
+// RetryPolicy determines how a HTTPTransport retries requests that fail due to connection errors.
+// Only requests using idempotent methods (GET, HEAD, DELETE) are retried, and other requests only
+// if they failed to connect to the server, as these may otherwise have been received and handled
+// by the server already. The wait before each retry increases exponentially from WaitMin up to
+// WaitMax, and is randomized (jittered) to avoid retries of many clients coinciding.
+type RetryPolicy struct {
+	Max     int           // maximum number of retries
+	WaitMin time.Duration // wait before the first retry
+	WaitMax time.Duration // maximum wait before a retry
+}
+
+// DefaultRetryPolicy is the RetryPolicy of new HTTPTransports.
+var DefaultRetryPolicy = RetryPolicy{
+	Max:     2,
+	WaitMin: 100 * time.Millisecond,
+	WaitMax: 200 * time.Millisecond,
+}
+
+// Context key for the HTTP method of requests, for use in checkRetry
+type methodContextKey struct{}
+
 // Logger is used for logging. If not set, init() will initialize it to logrus.StandardLogger().
 var Logger *logrus.Logger
 
@@ -71,6 +93,12 @@ func SetTLSClientConfig(config *tls.Config) {
 
 // NewHTTPTransport returns a new HTTPTransport.
 func NewHTTPTransport(serverURL string, forceHTTPS bool) *HTTPTransport {
+	return newHTTPTransport(serverURL, forceHTTPS, false)
+}
+
+// newHTTPTransport returns a new HTTPTransport, which supports git+file URLs only if allowGitFile
+// is set, as these must only be used if they come from the local configuration.
+func newHTTPTransport(serverURL string, forceHTTPS, allowGitFile bool) *HTTPTransport {
 	if Logger.IsLevelEnabled(logrus.TraceLevel) {
 		transportlogger = log.New(Logger.WriterLevel(logrus.TraceLevel), "transport: ", 0)
 	} else {
@@ -96,16 +124,12 @@ func NewHTTPTransport(serverURL string, forceHTTPS bool) *HTTPTransport {
 		},
 	}
 
+	registerGitProtocols(innerTransport, allowGitFile)
+
 	client := &retryablehttp.Client{
-		Logger:       transportlogger,
-		RetryWaitMin: 100 * time.Millisecond,
-		RetryWaitMax: 200 * time.Millisecond,
-		RetryMax:     2,
-		Backoff:      retryablehttp.DefaultBackoff,
-		CheckRetry: func(ctx context.Context, resp *http.Response, err error) (bool, error) {
-			// Don't retry on 5xx (which retryablehttp does by default)
-			return err != nil || resp.StatusCode == 0, err
-		},
+		Logger:     transportlogger,
+		Backoff:    jitterBackoff,
+		CheckRetry: checkRetry,
 		HTTPClient: &http.Client{
 			Timeout:   time.Second * 3,
 			Transport: innerTransport,
@@ -123,12 +147,40 @@ func NewHTTPTransport(serverURL string, forceHTTPS bool) *HTTPTransport {
 	if headers == nil {
 		headers = http.Header{}
 	}
-	return &HTTPTransport{
+	transport := &HTTPTransport{
 		Server:     serverURL,
 		ForceHTTPS: forceHTTPS,
 		headers:    headers,
 		client:     client,
 	}
+	transport.SetRetryPolicy(DefaultRetryPolicy)
+	return transport
+}
+
+func checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	// Don't retry on 5xx (which retryablehttp does by default)
+	if err == nil && resp.StatusCode != 0 {
+		return false, nil
+	}
+	switch ctx.Value(methodContextKey{}) {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		return true, err
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial", err
+}
+
+// jitterBackoff returns a random duration between half of and the full exponential backoff
+// for the given attempt, bounded by min and max.
+func jitterBackoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	wait := retryablehttp.DefaultBackoff(min, max, attemptNum, resp)
+	if wait <= 1 {
+		return wait
+	}
+	return wait/2 + time.Duration(mathrand.Int63n(int64(wait/2)))
 }
 
 func (transport *HTTPTransport) marshal(o interface{}) ([]byte, error) {
@@ -174,31 +226,59 @@ func (transport *HTTPTransport) log(prefix string, message interface{}, binary b
 	}
 }
 
+// SetRetryMax sets the maximum number of times requests failing due to connection errors are retried.
+func (transport *HTTPTransport) SetRetryMax(retries int) {
+	transport.client.RetryMax = retries
+}
+
+// SetRetryPolicy sets how requests failing due to connection errors are retried.
+func (transport *HTTPTransport) SetRetryPolicy(policy RetryPolicy) {
+	transport.client.RetryMax = policy.Max
+	transport.client.RetryWaitMin = policy.WaitMin
+	transport.client.RetryWaitMax = policy.WaitMax
+}
+
 // SetHeader sets a header to be sent in requests.
 func (transport *HTTPTransport) SetHeader(name, val string) {
 	transport.headers.Set(name, val)
 }
 
+// Headers returns a copy of the headers that the transport includes in its requests.
+func (transport *HTTPTransport) Headers() http.Header {
+	return transport.headers.Clone()
+}
+
 func (transport *HTTPTransport) request(
 	url string, method string, reader io.Reader, contenttype string,
 ) (response *http.Response, err error) {
-	var req retryablehttp.Request
+	return transport.requestWithHeaders(url, method, reader, contenttype, nil)
+}
+
+// requestWithHeaders performs a request, sending the specified headers next to those of the transport.
+func (transport *HTTPTransport) requestWithHeaders(
+	url string, method string, reader io.Reader, contenttype string, headers http.Header,
+) (response *http.Response, err error) {
 	u := transport.Server + url
-	if common.ForceHTTPS && transport.ForceHTTPS && !strings.HasPrefix(u, "https") {
+	if common.ForceHTTPS && transport.ForceHTTPS && !strings.HasPrefix(u, "https") && !strings.HasPrefix(u, "git+https") {
 		return nil, &SessionError{ErrorType: ErrorHTTPS, Err: errors.New("remote server does not use https")}
 	}
-	req.Request, err = http.NewRequest(method, u, reader)
+	// Using a retryablehttp request, the body is sent again when the request is retried
+	ctx := context.WithValue(context.Background(), methodContextKey{}, method)
+	req, err := retryablehttp.NewRequestWithContext(ctx, method, u, reader)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
 	req.Header = transport.headers.Clone()
+	for name, values := range headers {
+		req.Header[name] = values
+	}
 	if req.Header.Get("User-agent") == "" {
 		req.Header.Set("User-Agent", "irmago")
 	}
 	if reader != nil && contenttype != "" {
 		req.Header.Set("Content-Type", contenttype)
 	}
-	res, err := transport.client.Do(&req)
+	res, err := transport.client.Do(req)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
@@ -10,6 +10,7 @@ import (
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
 	"github.com/privacybydesign/gabi/revocation"
+	"github.com/sirupsen/logrus"
 )
 
 // ProofStatus is the status of the complete proof
@@ -42,11 +43,30 @@ type DisclosedAttribute struct {
 	NotRevokedBefore *Timestamp              `json:"notrevokedbefore,omitempty"`
 }
 
+// TypedValue returns the value of the disclosed attribute as a string, a time.Time, an int64 or
+// a bool, depending on the type of the attribute (see AttributeType.DecodeValue), or nil if the
+// attribute has no value.
+func (attr *DisclosedAttribute) TypedValue(conf *Configuration) (interface{}, error) {
+	if attr.RawValue == nil {
+		return nil, nil
+	}
+	typ := conf.GetAttributeTypes()[attr.Identifier]
+	if typ == nil {
+		return *attr.RawValue, nil
+	}
+	return typ.DecodeValue(*attr.RawValue)
+}
+
 // ProofList is a gabi.ProofList with some extra methods.
 type ProofList gabi.ProofList
 
 var ErrMissingPublicKey = errors.New("Missing public key")
 
+// LongExpiredKeyPeriod is the time after the expiry of a public key after which disclosures of
+// credentials signed with that key are logged with a warning: although such credentials may still
+// be valid, the issuer should have rotated to a new key long ago.
+var LongExpiredKeyPeriod = 365 * 24 * time.Hour
+
 // ExtractPublicKeys returns the public keys of each proof in the proofList, in the same order,
 // for later use in verification of the proofList. If one of the proofs is not a ProofD
 // an error is returned.
@@ -74,7 +94,7 @@ func (pl ProofList) ExtractPublicKeys(configuration *Configuration) ([]*gabikeys
 }
 
 // Expired returns true if any of the contained disclosure proofs is specified at the specified time,
-// or now, when the specified time is nil.
+// or now, when the specified time is nil, or if its scheme is no longer valid at that time.
 func (pl ProofList) Expired(configuration *Configuration, t *time.Time) (bool, error) {
 	if t == nil {
 		temp := time.Now()
@@ -89,6 +109,11 @@ func (pl ProofList) Expired(configuration *Configuration, t *time.Time) (bool, e
 		if metadata.Expiry().Before(*t) {
 			return true, nil
 		}
+		if typ := metadata.CredentialType(); typ != nil {
+			if scheme := configuration.GetSchemeManagers()[typ.SchemeManagerIdentifier()]; scheme != nil && scheme.Expired(*t) {
+				return true, nil
+			}
+		}
 		pk, err := metadata.PublicKey()
 		if err != nil {
 			return false, err
@@ -96,6 +121,10 @@ func (pl ProofList) Expired(configuration *Configuration, t *time.Time) (bool, e
 		if metadata.SigningDate().Unix() > pk.ExpiryDate {
 			return true, nil
 		}
+		if t.After(time.Unix(pk.ExpiryDate, 0).Add(LongExpiredKeyPeriod)) {
+			Logger.WithFields(logrus.Fields{"issuer": pk.Issuer, "counter": pk.Counter}).
+				Warnf("Disclosed credential was signed with a public key that expired at %s", time.Unix(pk.ExpiryDate, 0))
+		}
 	}
 	return false, nil
 }
@@ -151,7 +180,7 @@ func (pl ProofList) VerifyProofs(
 	keyshareServers := make([]string, len(pl))
 	for i := range pl {
 		schemeID := NewIssuerIdentifier(publickeys[i].Issuer).SchemeManagerIdentifier()
-		if !configuration.SchemeManagers[schemeID].Distributed() {
+		if !configuration.GetSchemeManagers()[schemeID].Distributed() {
 			keyshareServers[i] = "." // dummy value: no IRMA scheme will ever have this name
 		} else {
 			keyshareServers[i] = schemeID.Name()
@@ -10,6 +10,10 @@ import (
 
 const pollInterval = 1000 * time.Millisecond
 
+// Number of consecutive status polls failing due to connection errors after which polling is
+// aborted; until then the connection loss is assumed to be transient
+const maxPollFailures = 5
+
 func WaitStatus(transport *HTTPTransport, initialStatus ServerStatus, statuschan chan ServerStatus, errorchan chan error) {
 	if err := subscribeSSE(transport, statuschan, errorchan, false); err != nil {
 		go poll(transport, initialStatus, statuschan, errorchan)
@@ -18,7 +22,7 @@ func WaitStatus(transport *HTTPTransport, initialStatus ServerStatus, statuschan
 
 func WaitStatusChanged(transport *HTTPTransport, initialStatus ServerStatus, statuschan chan ServerStatus, errorchan chan error) {
 	if err := subscribeSSE(transport, statuschan, errorchan, true); err != nil {
-		go pollUntilChange(transport, initialStatus, statuschan, errorchan)
+		go pollUntilChange(transport, initialStatus, 0, statuschan, errorchan)
 	}
 }
 
@@ -59,7 +63,7 @@ func poll(transport *HTTPTransport, initialStatus ServerStatus, statuschan chan
 	status := initialStatus
 	statuschanPolling := make(chan ServerStatus)
 	errorchanPolling := make(chan error)
-	go pollUntilChange(transport, status, statuschanPolling, errorchanPolling)
+	go pollUntilChange(transport, status, 0, statuschanPolling, errorchanPolling)
 	for {
 		select {
 		case status = <-statuschanPolling:
@@ -74,18 +78,22 @@ func poll(transport *HTTPTransport, initialStatus ServerStatus, statuschan chan
 				errorchan <- err
 				return
 			}
-			go pollUntilChange(transport, status, statuschanPolling, errorchanPolling)
+			go pollUntilChange(transport, status, 0, statuschanPolling, errorchanPolling)
 		}
 	}
 }
 
-func pollUntilChange(transport *HTTPTransport, initialStatus ServerStatus, statuschan chan ServerStatus, errorchan chan error) {
+func pollUntilChange(transport *HTTPTransport, initialStatus ServerStatus, failures int, statuschan chan ServerStatus, errorchan chan error) {
 	// First we wait
 	<-time.NewTimer(pollInterval).C
 
 	// Get session status
 	var s string
 	if err := transport.Get("status", &s); err != nil {
+		if serr, ok := err.(*SessionError); ok && serr.ErrorType == ErrorTransport && failures+1 < maxPollFailures {
+			go pollUntilChange(transport, initialStatus, failures+1, statuschan, errorchan)
+			return
+		}
 		errorchan <- err
 		return
 	}
@@ -98,5 +106,5 @@ func pollUntilChange(transport *HTTPTransport, initialStatus ServerStatus, statu
 		return
 	}
 
-	go pollUntilChange(transport, status, statuschan, errorchan)
+	go pollUntilChange(transport, status, 0, statuschan, errorchan)
 }